@@ -1,32 +1,53 @@
 package main
 
 import (
-	"context"
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
-	"crypto/ed25519"
-	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"io"
+	mrand "math/rand"
+	"mime"
+	"strconv"
 	"strings"
 
+	"pathlab/internal/adminauth"
+	"pathlab/internal/adminlimit"
+	"pathlab/internal/capture"
+	"pathlab/internal/config"
+	"pathlab/internal/dashboard"
+	"pathlab/internal/health"
 	"pathlab/internal/impair"
+	"pathlab/internal/mitm"
+	"pathlab/internal/otel"
 	"pathlab/internal/proxy"
+	"pathlab/internal/proxyproto"
 	"pathlab/internal/rules"
 	"pathlab/internal/tlsinspect"
+	"pathlab/internal/udpproxy"
 	"pathlab/internal/receipts"
+	"pathlab/internal/receiptsdb"
+	"pathlab/internal/replicate"
+	"pathlab/internal/slo"
+	"pathlab/internal/socks"
+	"pathlab/internal/tcpinfo"
+	"pathlab/internal/trace"
 	"pathlab/internal/quicinspect"
 )
 
@@ -42,11 +63,181 @@ func main() {
 		listenAddr   = flag.String("listen", getenv("PATHLAB_LISTEN", ":10443"), "TCP listen address for proxy (client connects here)")
 		upstreamAddr = flag.String("upstream", getenv("PATHLAB_UPSTREAM", "127.0.0.1:8443"), "Upstream server address (host:port)")
 		adminAddr    = flag.String("admin", getenv("PATHLAB_ADMIN", ":8080"), "Admin HTTP API address")
-		readTimeout  = flag.Duration("read-timeout", 30*time.Second, "I/O read timeout")
-		writeTimeout = flag.Duration("write-timeout", 30*time.Second, "I/O write timeout")
+		readTimeout  = flag.Duration("read-timeout", 30*time.Second, "Time allowed to receive the PROXY protocol header and complete the SOCKS5 handshake")
+		peekTimeout  = flag.Duration("handshake-peek-timeout", proxy.DefaultHandshakePeekTimeout, "Time allowed to receive the whole ClientHello; a slower one is relayed unparsed under CLEAN (0 = -read-timeout)")
+		maxCHBytes   = flag.Int("max-handshake-bytes", tlsinspect.DefaultMaxHandshakeBytes, "Largest ClientHello accepted; a client declaring a bigger one is reset at once (receipt outcome oversized_ch)")
+		writeTimeout = flag.Duration("write-timeout", 0, "DEPRECATED, has no effect (a warning is logged when set): connections close after -idle-timeout without traffic")
+		drainTimeout = flag.Duration("drain-timeout", 15*time.Second, "On SIGINT/SIGTERM, how long open connections may finish before they are closed (outcome drained)")
+		idleTimeout  = flag.Duration("idle-timeout", 5*time.Minute, "Close a connection after this long without a byte either way (0 = never; idle_timeout_seconds overrides)")
+		receiptsDB   = flag.String("receipts-db", getenv("PATHLAB_RECEIPTS_DB", ""), "SQLite database every receipt is also written to, asynchronously; GET /receipts/query runs against it (empty = off)")
+		keepAlive    = flag.String("keepalive", getenv("PATHLAB_KEEPALIVE", ""), "TCP keepalives on client and upstream sockets: on, off, or empty for Go's default (on, 15s); keepalive_enabled overrides")
+		keepIdle     = flag.Duration("keepalive-idle", 0, "Idle time before keepalive probes start, and between probes (0 = default; keepalive_idle_seconds overrides)")
 		keyFile     = flag.String("keyfile", getenv("PATHLAB_KEYFILE", "pathlab-ed25519.key"), "Path to Ed25519 seed file (created if missing)")
+		replicateTo = flag.String("replicate-to", getenv("PATHLAB_REPLICATE_TO", ""), "Peer admin base URL (e.g. http://peer:8080) to push every config change to")
+		mitmCACert  = flag.String("mitm-ca-cert", getenv("PATHLAB_MITM_CA_CERT", ""), "PEM CA certificate INTERCEPT_TLS signs with (default: generated in memory)")
+		mitmCAKey   = flag.String("mitm-ca-key", getenv("PATHLAB_MITM_CA_KEY", ""), "PEM private key for -mitm-ca-cert")
+		sloMs       = flag.Float64("slo-ms", 0, "p95 handshake objective (ms) for CLEAN connections; alerts when exceeded (0 = off, see /slo)")
+		sloWindow   = flag.Duration("slo-window", slo.DefaultWindow, "Rolling window the CLEAN handshake p95 is computed over")
+		captureDir      = flag.String("capture-dir", getenv("PATHLAB_CAPTURE_DIR", ""), "Directory each connection's raw ClientHello records are saved to (empty = off, see /captures/stats)")
+		captureMaxBytes = flag.Int64("capture-max-total-bytes", 256<<20, "Total size captures may use; the oldest are deleted to make room (0 = unlimited)")
+		collectTCPInfo  = flag.Bool("collect-tcpinfo", getenv("PATHLAB_COLLECT_TCPINFO", "") == "1", "Read TCP_INFO of client connections (Linux): client_rtt_ms in receipts, per-prefix RTTs at /clients/rtt")
+		captureCH       = flag.Bool("capture-clienthello", getenv("PATHLAB_CAPTURE_CLIENTHELLO", "") == "1", "Put each connection's ClientHello records on its receipt, base64 (ch_b64, up to 16KB)")
+		captureMaxFiles = flag.Int("capture-max-files", 10000, "Number of capture files kept; the oldest are deleted to make room (0 = unlimited)")
+		maxConns        = flag.Int("max-conns", 0, "Connections proxied at once; see -overflow for the rest (0 = unlimited)")
+		overflow        = flag.String("overflow", proxy.OverflowReject, "At -max-conns: reject (reset new connections at once) or queue (hold them for a slot up to -queue-timeout)")
+		queueTimeout    = flag.Duration("queue-timeout", 5*time.Second, "How long -overflow=queue holds a connection before resetting it")
+		listenUDP       = flag.String("listen-udp", getenv("PATHLAB_LISTEN_UDP", ""), "UDP listen address for relaying datagrams (QUIC) to the upstream's UDP port (empty = off)")
+		udpFlowTimeout  = flag.Duration("udp-flow-timeout", udpproxy.DefaultFlowTimeout, "Idle time after which a UDP flow ends and its receipt is emitted")
+		acceptProxy     = flag.Bool("accept-proxy-protocol", getenv("PATHLAB_ACCEPT_PROXY_PROTOCOL", "") == "1", "Require a PROXY protocol v1/v2 header on client connections; receipts record the address it carries")
+		sendProxy       = flag.Bool("send-proxy-protocol", getenv("PATHLAB_SEND_PROXY_PROTOCOL", "") == "1", "Start upstream connections with a PROXY protocol v2 header carrying the client address")
+		dialTimeout     = flag.Duration("dial-timeout", proxy.DefaultDialTimeout, "Timeout of each upstream dial attempt")
+		dialRetries     = flag.Int("dial-retries", 0, "Further upstream dial attempts after the first fails, with doubling backoff from 100ms")
+		dialFallback    = flag.String("dial-fallback", getenv("PATHLAB_DIAL_FALLBACK", ""), "host:port dialed when the upstream's attempts all fail (empty = none)")
+		upstreamMode    = flag.String("upstream-mode", proxy.UpstreamProxy, "proxy (dial -upstream), echo (PathLab echoes the client's bytes) or sink (PathLab reads and discards, never responds)")
+		terminateTLS    = flag.Bool("terminate-tls", false, "Terminate client TLS with -tls-cert/-tls-key, re-encrypt to the upstream and impair the plaintext in between")
+		tlsCert         = flag.String("tls-cert", getenv("PATHLAB_TLS_CERT", ""), "PEM certificate (chain) presented to clients under -terminate-tls")
+		tlsKey          = flag.String("tls-key", getenv("PATHLAB_TLS_KEY", ""), "PEM private key for -tls-cert")
+		tlsInsecure     = flag.Bool("upstream-tls-insecure", false, "Under -terminate-tls, do not verify the upstream's certificate")
+		socks5          = flag.Bool("socks5", getenv("PATHLAB_SOCKS5", "") == "1", "Clients connect as to a SOCKS5 proxy and CONNECT to the upstream of their choice, which replaces -upstream and -route")
+		socksUser       = flag.String("socks5-user", getenv("PATHLAB_SOCKS5_USER", ""), "Username SOCKS5 clients must authenticate with (with -socks5-pass; empty = no authentication)")
+		socksPass       = flag.String("socks5-pass", getenv("PATHLAB_SOCKS5_PASS", ""), "Password for -socks5-user")
+		socksOpen       = flag.Bool("socks5-open", getenv("PATHLAB_SOCKS5_OPEN", "") == "1", "Allow -socks5 without -socks5-user on a -listen address that is not loopback: an open proxy to anything the host can reach")
+		rulesFile       = flag.String("rules-file", getenv("PATHLAB_RULES_FILE", ""), "Rules file loaded at startup and reloaded when it changes; an edit that does not parse keeps the active rules (empty = rules via the API only)")
+		rulesPoll       = flag.Duration("rules-poll", rules.DefaultPollInterval, "How often -rules-file is checked for changes (0 = load it at startup only)")
+		receiptsFile    = flag.String("receipts-file", getenv("PATHLAB_RECEIPTS_FILE", ""), "Append-only NDJSON journal of receipts; the newest are reloaded at startup and IDs continue (empty = memory only)")
+		receiptsFsync   = flag.String("receipts-fsync", receipts.FsyncInterval, "When -receipts-file is fsynced: always (after every receipt) or interval (every second)")
+		receiptsMax     = flag.Int("receipts-max", receipts.DefaultCapacity, "Receipts kept in memory; the oldest are evicted to make room")
+		receiptsMaxAge  = flag.Duration("receipts-max-age", 0, "Evict receipts older than this, checked periodically (0 = only when -receipts-max is reached)")
+		adminToken      = flag.String("admin-token", getenv("PATHLAB_ADMIN_TOKEN", ""), "Bearer token required by admin API requests that change state (empty = no authentication)")
+		configFile      = flag.String("config", getenv("PATHLAB_CONFIG", ""), "YAML or JSON server config file; flags given on the command line override it, SIGHUP reloads it (empty = flags only)")
+		readOnlyToken   = flag.String("admin-readonly-token", getenv("PATHLAB_ADMIN_READONLY_TOKEN", ""), "Bearer token for read-only admin API requests, which then need it or -admin-token (empty = reads are open)")
+		adminRate       = flag.Float64("admin-rate", adminlimit.DefaultRate, "State-changing admin API requests allowed per second per client IP; over it they get 429 (0 = unlimited)")
+		adminBurst      = flag.Int("admin-burst", adminlimit.DefaultBurst, "State-changing admin API requests a client IP may make at once under -admin-rate")
+		adminMaxBody    = flag.Int64("admin-max-body", adminlimit.DefaultMaxBody, "Largest admin API request body in bytes; larger ones get 413 (0 = unlimited)")
+		traceConns      = flag.Int("trace-conns", trace.DefaultKeep, "Connections whose event timeline is kept for GET /connections/{id}/trace (0 = off)")
+		otlpEndpoint    = flag.String("otlp-endpoint", getenv("PATHLAB_OTLP_ENDPOINT", ""), "OTLP/HTTP collector (e.g. http://localhost:4318) every connection is exported to as a trace, in JSON (empty = off)")
+		mirror          = flag.String("mirror", getenv("PATHLAB_MIRROR", ""), "host:port that gets a best-effort copy of every connection's client->upstream bytes; its responses are discarded (empty = off)")
 	)
+	var routes []string
+	flag.Func("route", "Send connections whose SNI is sni (or matches *.domain) to host:port instead of -upstream: sni=host:port, repeatable", func(s string) error {
+		routes = append(routes, s)
+		return proxy.NewRouter("").Add(s)
+	})
+	bodyLimits := maps.Clone(adminlimit.DefaultBodies)
+	flag.Func("admin-body-limit", "Body cap in bytes for one admin API path, overriding -admin-max-body: /path=bytes, repeatable (default /quic/parse_initial=65536)", func(s string) error {
+		path, n, err := adminlimit.ParseBody(s)
+		if err != nil {
+			return err
+		}
+		bodyLimits[path] = n
+		return nil
+	})
 	flag.Parse()
+	// -config: the file's values stand in for the flags not given on the command line.
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	var fileCfg *config.Config
+	if *configFile != "" {
+		c, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatalf("-config: %v", err)
+		}
+		for _, st := range c.Settings() {
+			if st.Value == "" || setFlags[st.Flag] {
+				continue
+			}
+			if err := flag.Set(st.Flag, st.Value); err != nil {
+				log.Fatalf("-config: %s: %v", st.Key, err)
+			}
+		}
+		fileCfg = c
+		log.Printf("[pathlab] loaded config %s", *configFile)
+	}
+	if *overflow != proxy.OverflowReject && *overflow != proxy.OverflowQueue {
+		log.Fatalf("-overflow must be %s or %s, got %q", proxy.OverflowReject, proxy.OverflowQueue, *overflow)
+	}
+	if *readOnlyToken != "" && *adminToken == "" {
+		log.Fatalf("-admin-readonly-token requires -admin-token")
+	}
+	// -write-timeout is kept only so old command lines still start; say so whenever it is given.
+	if setFlags["write-timeout"] {
+		log.Printf("[pathlab] WARNING: -write-timeout=%s has no effect and will be removed; connections are closed after -idle-timeout (%s) without traffic", *writeTimeout, *idleTimeout)
+	}
+	switch *upstreamMode {
+	case proxy.UpstreamProxy, proxy.UpstreamEcho, proxy.UpstreamSink:
+	default:
+		log.Fatalf("-upstream-mode must be %s, %s or %s, got %q", proxy.UpstreamProxy, proxy.UpstreamEcho, proxy.UpstreamSink, *upstreamMode)
+	}
+	if *terminateTLS && *upstreamMode != proxy.UpstreamProxy {
+		log.Fatalf("-terminate-tls needs -upstream-mode %s", proxy.UpstreamProxy)
+	}
+	proxy.SetUpstreamMode(*upstreamMode)
+	if *upstreamMode != proxy.UpstreamProxy {
+		log.Printf("[pathlab] upstream mode %s: no upstream is dialed", *upstreamMode)
+	}
+	if *dialRetries < 0 {
+		log.Fatalf("-dial-retries must be >= 0, got %d", *dialRetries)
+	}
+	if *maxCHBytes <= 0 {
+		log.Fatalf("-max-handshake-bytes must be > 0, got %d", *maxCHBytes)
+	}
+	proxy.SetMaxHandshakeBytes(*maxCHBytes)
+	proxy.SetSendProxyProtocol(*sendProxy)
+	// Timeouts a SIGHUP reload of -config can change; a connection reads them as it starts.
+	type connTimeouts struct{ read, peek, idle, drain time.Duration }
+	var timeouts atomic.Pointer[connTimeouts]
+	loadTimeouts := func() {
+		timeouts.Store(&connTimeouts{read: *readTimeout, peek: *peekTimeout, idle: *idleTimeout, drain: *drainTimeout})
+		proxy.SetDialConfig(proxy.DialConfig{Timeout: *dialTimeout, Retries: *dialRetries, Fallback: *dialFallback})
+	}
+	loadTimeouts()
+	var keepAliveDefault *bool
+	switch *keepAlive {
+	case "":
+	case "on", "off":
+		on := *keepAlive == "on"
+		keepAliveDefault = &on
+	default:
+		log.Fatalf("-keepalive must be on, off or empty, got %q", *keepAlive)
+	}
+	// connDefaults fills in what a connection's config leaves to the flags.
+	connDefaults := func(cfg impair.Config) impair.Config {
+		if cfg.IdleTimeoutSeconds == 0 {
+			cfg.IdleTimeoutSeconds = timeouts.Load().idle.Seconds()
+		}
+		if cfg.KeepAliveEnabled == nil {
+			cfg.KeepAliveEnabled = keepAliveDefault
+		}
+		if cfg.KeepAliveIdleSeconds == 0 {
+			cfg.KeepAliveIdleSeconds = keepIdle.Seconds()
+		}
+		return cfg
+	}
+	var socksCreds *socks.Credentials
+	if *socksUser != "" || *socksPass != "" {
+		if !*socks5 || *socksUser == "" || *socksPass == "" {
+			log.Fatalf("-socks5-user and -socks5-pass go together, with -socks5")
+		}
+		socksCreds = &socks.Credentials{Username: *socksUser, Password: *socksPass}
+	}
+	if *socks5 && socksCreds == nil && !loopbackListen(*listenAddr) {
+		if !*socksOpen {
+			log.Fatalf("-socks5 without -socks5-user on %s would be an open proxy: set -socks5-user/-socks5-pass, listen on loopback, or pass -socks5-open", *listenAddr)
+		}
+		log.Printf("[pathlab] WARNING: unauthenticated SOCKS5 on %s (-socks5-open)", *listenAddr)
+	}
+	if *mirror != "" {
+		proxy.SetMirror(*mirror)
+		log.Printf("[pathlab] mirroring client traffic to %s", *mirror)
+	}
+	if *terminateTLS {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("-terminate-tls: load -tls-cert/-tls-key: %v", err)
+		}
+		proxy.SetTLSTermination(&proxy.TerminateConfig{Certificate: cert, InsecureUpstream: *tlsInsecure})
+		log.Printf("[pathlab] terminating TLS with %s; impairments apply to plaintext", *tlsCert)
+	}
 
 	// Shared impairment state
 	state := &impair.State{}
@@ -60,27 +251,211 @@ func main() {
 	}
 	log.Printf("[pathlab] listening on %s, upstream %s, admin %s", *listenAddr, *upstreamAddr, *adminAddr)
 
-	// Rules state
-	var ruleSet atomic.Value // stores rules.Set
-	ruleSet.Store(rules.Set{})
+	// Per-SNI upstreams; unrouted connections go to -upstream.
+	router := proxy.NewRouter(*upstreamAddr)
+	for _, rt := range routes {
+		_ = router.Add(rt) // validated when the flag was parsed
+		log.Printf("[pathlab] route %s", rt)
+	}
 
-	// Receipts key management: load or create Ed25519 seed file (32 bytes)
-	seed, err := os.ReadFile(*keyFile)
-	if err != nil || len(seed) != 32 {
-		var newSeed [32]byte
-		if _, rerr := rand.Read(newSeed[:]); rerr != nil {
-			log.Fatalf("generate ed25519 seed: %v", rerr)
+	// Rules state
+	ruleSet := &rules.Store{} // active rules; hit counters survive reloads
+	shadowSet := &rules.Store{} // POST /rules?mode=shadow: evaluated and reported on receipts, never applied
+	sniRates := rules.NewSNIRates(rules.DefaultRateWindow, rules.DefaultRateNames) // sni_conn_rate
+	if *rulesFile != "" {
+		set, err := rules.LoadFile(*rulesFile)
+		if err != nil {
+			log.Fatalf("-rules-file: %v", err)
 		}
-		if werr := os.WriteFile(*keyFile, newSeed[:], 0600); werr != nil {
-			log.Fatalf("write keyfile: %v", werr)
+		ruleSet.ReplaceFrom(set, rules.SourceFile)
+		log.Printf("[pathlab] loaded %d rules from %s", len(set.Rules), *rulesFile)
+	}
+	// The config file's impairment and rules replace the defaults; -rules-file wins over its rules.
+	configTargets := config.Targets{Impair: state, Rules: ruleSet}
+	if *rulesFile != "" {
+		configTargets.Rules = nil
+	}
+	if fileCfg != nil {
+		if _, err := config.Apply(nil, fileCfg, configTargets); err != nil {
+			log.Fatalf("-config: %v", err)
+		}
+		if *rulesFile != "" && (fileCfg.Rules != config.Rules{}) {
+			log.Printf("[pathlab] -rules-file given: rules in %s ignored", *configFile)
 		}
-		seed = newSeed[:]
+	}
+	holds := proxy.NewHoldRegistry() // connections held open by the also_hold rule modifier
+	contacts := impair.NewTTLStore() // keys already seen by the FIRST_CONTACT modifier
+	var liveConns sync.Map           // conn id -> liveConn, target of per-connection overrides
+	conns := proxy.NewConnRegistry() // client connections being proxied, drained on shutdown
+	traces := trace.NewLog(*traceConns) // event timelines of the last -trace-conns connections
+
+	// Receipts key management: load or create Ed25519 seed file (32 bytes), plus the
+	// seeds POST /receipts/rotate_key archived, which still verify older receipts
+	pubPriv, retiredKeys, created, err := receipts.LoadKeyFile(*keyFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if created {
 		log.Printf("[pathlab] generated new ed25519 keyfile %s", *keyFile)
 	} else {
-		log.Printf("[pathlab] loaded ed25519 keyfile %s", *keyFile)
+		log.Printf("[pathlab] loaded ed25519 keyfile %s (%d retired keys)", *keyFile, len(retiredKeys))
+	}
+	rcpts := receipts.NewManager(*receiptsMax, pubPriv, receipts.ManagerOptions{MaxAge: *receiptsMaxAge})
+	go rcpts.PruneEvery(context.Background(), receipts.PruneInterval(*receiptsMaxAge))
+	var rdb *receiptsdb.DB
+	if *receiptsDB != "" {
+		if rdb, err = receiptsdb.Open(*receiptsDB, receiptsdb.Options{Logf: log.Printf}); err != nil {
+			log.Fatalf("-receipts-db: %v", err)
+		}
+		rdb.Start(rcpts)
+		log.Printf("[pathlab] writing receipts to %s", *receiptsDB)
+	}
+	for _, pub := range retiredKeys {
+		rcpts.AddVerificationKey(pub)
+	}
+	// -otlp-endpoint: each connection's receipt and timeline also become an exported trace.
+	var otlp *otel.Exporter
+	if *otlpEndpoint != "" {
+		if otlp, err = otel.NewExporter(*otlpEndpoint, otel.Options{}); err != nil {
+			log.Fatalf("-otlp-endpoint: %v", err)
+		}
+		log.Printf("[pathlab] exporting connection traces to %s", *otlpEndpoint)
+	}
+	connReceipt := func(rec *trace.Recorder, r receipts.Receipt, cfg *impair.Config) {
+		rcpts.Add(r)
+		if otlp != nil {
+			otlp.Export(otel.ConnectionSpans(otel.Connection{Events: rec.Events(), Receipt: r, Impair: cfg})...)
+		}
+	}
+	// Readiness (GET /readyz): the upstreams dial and the keyfile loads, probed in the background.
+	ready := &health.Prober{Checks: []health.Check{{Name: "keyfile", Run: func(context.Context) error { return receipts.CheckKeyFile(*keyFile) }}}}
+	if !*socks5 && *upstreamMode == proxy.UpstreamProxy {
+		for _, addr := range router.Upstreams() {
+			ready.Checks = append(ready.Checks, health.DialCheck("upstream "+addr, addr))
+		}
+		if *dialFallback != "" {
+			ready.Checks = append(ready.Checks, health.DialCheck("dial_fallback "+*dialFallback, *dialFallback))
+		}
+	}
+	go ready.RunEvery(context.Background(), health.DefaultInterval)
+	if *receiptsFile != "" {
+		n, err := rcpts.OpenJournal(*receiptsFile, receipts.JournalOptions{Fsync: *receiptsFsync, Logf: log.Printf})
+		if err != nil {
+			log.Fatalf("receipts: %v", err)
+		}
+		log.Printf("[pathlab] receipts journal %s: %d receipts replayed", *receiptsFile, n)
+	}
+
+	// Baseline SLO: CLEAN handshake durations, alerting when the upstream itself degrades.
+	baseline, err := slo.New(slo.Config{SLOMs: *sloMs, Window: sloWindow.String()})
+	if err != nil {
+		log.Fatalf("slo: %v", err)
+	}
+
+	// Client RTTs from TCP_INFO separate a distant client from latency the impairment adds.
+	clientRTTs := tcpinfo.NewRTTStats()
+
+	// Captures: raw ClientHello records per connection, kept under a global disk budget.
+	var captures *capture.Manager
+	if *captureDir != "" {
+		captures, err = capture.New(*captureDir, capture.Limits{MaxTotalBytes: *captureMaxBytes, MaxFiles: *captureMaxFiles})
+		if err != nil {
+			log.Fatalf("capture dir: %v", err)
+		}
+		log.Printf("[pathlab] capturing ClientHellos to %s (max %d bytes, %d files)", *captureDir, *captureMaxBytes, *captureMaxFiles)
+	}
+
+	// Interception CA for INTERCEPT_TLS; fetch it from GET /mitm/ca.pem to trust it in tests.
+	if *mitmCACert != "" {
+		ca, err := mitm.LoadCA(*mitmCACert, *mitmCAKey)
+		if err != nil {
+			log.Fatalf("load mitm CA: %v", err)
+		}
+		proxy.SetInterceptCA(ca)
+		log.Printf("[pathlab] loaded interception CA %s", *mitmCACert)
+	}
+
+	presetConfig := func(name string) (impair.Config, bool) {
+		p, ok := state.Preset(name)
+		return p.Config, ok
+	}
+
+	// Admin mutations are serialized and each leaves a signed config_change receipt whose
+	// digests are the replication snapshot hash before and after the change.
+	var adminMu sync.Mutex
+	configSnapshot := func() replicate.Snapshot {
+		snap := replicate.Snapshot{Impair: state.Get(), Rules: ruleSet.Load().Source()}
+		for _, p := range state.Presets() {
+			if snap.Presets == nil {
+				snap.Presets = map[string]impair.Config{}
+			}
+			snap.Presets[p.Name] = p.Config
+		}
+		return snap
+	}
+	mutate := func(action string, actor receipts.Actor, fn func()) {
+		adminMu.Lock()
+		defer adminMu.Unlock()
+		prev := configSnapshot().Hash()
+		fn()
+		rcpts.Add(receipts.ConfigChange(action, actor, prev, configSnapshot().Hash()))
+	}
+	// adminActor is the actor of an admin API request: its address and the token it was authenticated with.
+	adminActor := func(r *http.Request) receipts.Actor {
+		role, tokenID := adminauth.Identity(r)
+		return receipts.Actor{Addr: r.RemoteAddr, Role: role, TokenID: tokenID}
+	}
+
+	// Config replication: impairment, rules and presets are exported as a signed manifest and, with
+	// -replicate-to, pushed to a warm standby after every admin mutation.
+	replNode := replicate.NewNode(pubPriv, configSnapshot, func(snap replicate.Snapshot) error {
+		set, err := rules.Parse(strings.NewReader(snap.Rules))
+		if err != nil {
+			return fmt.Errorf("rules: %w", err)
+		}
+		if err := snap.Impair.Validate(); err != nil {
+			return err
+		}
+		for name, cfg := range snap.Presets {
+			if !impair.ValidPresetName(name) {
+				return fmt.Errorf("preset %q: invalid name", name)
+			}
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("preset %s: %w", name, err)
+			}
+		}
+		mutate(receipts.ActionConfigImport, receipts.Actor{Addr: "replication"}, func() {
+			ruleSet.Replace(set)
+			state.Apply(snap.Impair)
+			for _, p := range state.Presets() {
+				if _, ok := snap.Presets[p.Name]; !ok {
+					state.DeletePreset(p.Name)
+				}
+			}
+			for name, cfg := range snap.Presets {
+				state.SetPreset(name, cfg)
+			}
+		})
+		log.Printf("[pathlab] imported replicated config (profile=%s, %d rules, %d presets)", snap.Impair.Profile, len(set.Rules), len(snap.Presets))
+		return nil
+	})
+	// A duration_seconds apply running out changes the config without any handler involved.
+	state.OnRevert(func(impair.Config) { replNode.Changed() })
+	if *replicateTo != "" {
+		var client *http.Client // the peer is expected to share -admin-token
+		if *adminToken != "" {
+			client = &http.Client{Timeout: 5 * time.Second, Transport: adminauth.Transport(*adminToken, nil)}
+		}
+		replNode.ReplicateTo(context.Background(), *replicateTo, client)
+		log.Printf("[pathlab] replicating config changes to %s", *replicateTo)
+	}
+	if *rulesFile != "" && *rulesPoll > 0 {
+		go rules.PollFile(context.Background(), *rulesFile, *rulesPoll, func(set rules.Set) {
+			mutate(receipts.ActionRulesLoad, receipts.Actor{Addr: "file:" + *rulesFile}, func() { ruleSet.ReplaceFrom(set, rules.SourceFile) })
+			replNode.Changed()
+			log.Printf("[pathlab] reloaded %d rules from %s", len(set.Rules), *rulesFile)
+		}, func(format string, args ...any) { log.Printf("[pathlab] "+format, args...) })
 	}
-	pubPriv := ed25519.NewKeyFromSeed(seed)
-	rcpts := receipts.NewManager(256, pubPriv)
 
 	// Start admin API
 	mux := http.NewServeMux()
@@ -89,6 +464,13 @@ func main() {
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("ok"))
 	})
+	// 503 while a check fails; the report is the background prober's unless it is stale.
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		rep := ready.Ready(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if !rep.Ready { w.WriteHeader(http.StatusServiceUnavailable) }
+		json.NewEncoder(w).Encode(rep)
+	})
 	mux.HandleFunc("/quic/parse_initial", func(w http.ResponseWriter, r *http.Request) {
 		// Accept hex body of a UDP datagram containing a QUIC Initial.
 		data, _ := io.ReadAll(r.Body)
@@ -99,8 +481,24 @@ func main() {
 		s := quicinspect.ParseInitial(buf)
 		json.NewEncoder(w).Encode(s)
 	})
+	mux.HandleFunc("GET /mitm/ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		ca, err := proxy.InterceptCA()
+		if err != nil { http.Error(w, err.Error(), http.StatusInternalServerError); return }
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = w.Write(ca.CertPEM())
+	})
 	mux.HandleFunc("/receipts/pubkey", func(w http.ResponseWriter, r *http.Request) {
-		json.NewEncoder(w).Encode(map[string]string{"ed25519_pubkey_hex": rcpts.PublicKeyHex()})
+		json.NewEncoder(w).Encode(map[string]any{"ed25519_pubkey_hex": rcpts.PublicKeyHex(), "key_id": rcpts.KeyID(), "keys": rcpts.Keys()})
+	})
+	// Rotation archives the current seed next to -keyfile, so receipts it signed keep verifying after a restart.
+	mux.HandleFunc("POST /receipts/rotate_key", func(w http.ResponseWriter, r *http.Request) {
+		oldID := rcpts.KeyID()
+		priv, err := receipts.RotateKeyFile(*keyFile)
+		if err != nil { http.Error(w, err.Error(), http.StatusInternalServerError); return }
+		newID := rcpts.Rotate(priv)
+		mutate(receipts.ActionKeyRotate, adminActor(r), func() {})
+		log.Printf("[pathlab] receipts signing key rotated: %s -> %s", oldID, newID)
+		json.NewEncoder(w).Encode(map[string]any{"key_id": newID, "retired_key_id": oldID, "ed25519_pubkey_hex": rcpts.PublicKeyHex()})
 	})
 	mux.HandleFunc("/receipts", func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
@@ -113,7 +511,20 @@ func main() {
 		}
 		limit := 0
 		if v := q.Get("limit"); v != "" { fmt.Sscanf(v, "%d", &limit) }
-		json.NewEncoder(w).Encode(map[string]any{"receipts": rcpts.List(limit)})
+		ret := rcpts.Retention()
+		out := map[string]any{"retained": ret.Retained, "evicted_total": ret.EvictedTotal, "oldest_id": ret.OldestID}
+		kind, label := q.Get("kind"), q.Get("correlation_label")
+		switch {
+		case label != "":
+			out["receipts"] = rcpts.ListWhere(limit, func(rc receipts.Receipt) bool {
+				return rc.CorrelationLabel == label && (kind == "" || rc.Kind == kind)
+			})
+		case kind != "":
+			out["receipts"] = rcpts.ListKind(kind, limit)
+		default:
+			out["receipts"] = rcpts.List(limit)
+		}
+		json.NewEncoder(w).Encode(out)
 	})
 	mux.HandleFunc("/receipts/verify", func(w http.ResponseWriter, r *http.Request) {
 		idStr := r.URL.Query().Get("id")
@@ -122,8 +533,118 @@ func main() {
 		fmt.Sscanf(idStr, "%d", &id)
 		rec, err := rcpts.Get(id)
 		if err != nil { http.Error(w, "not found", http.StatusNotFound); return }
-		hashOK, sigOK := rcpts.Verify(rec)
-		json.NewEncoder(w).Encode(map[string]any{"id": id, "hash_ok": hashOK, "sig_ok": sigOK})
+		hashOK, sigOK, chain := rcpts.Verify(rec)
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "hash_ok": hashOK, "sig_ok": sigOK, "chain": chain})
+	})
+	// Correlation tags the next connection receipt from a client address, to tie a drill attempt to its receipt.
+	mux.HandleFunc("POST /receipts/correlate", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ClientAddrPrefix string `json:"client_addr_prefix"`
+			Label            string `json:"label"`
+			TTLSeconds       int    `json:"ttl_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest); return }
+		c, err := rcpts.Correlate(req.ClientAddrPrefix, req.Label, time.Duration(req.TTLSeconds)*time.Second)
+		if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+		json.NewEncoder(w).Encode(c)
+	})
+	mux.HandleFunc("GET /receipts/correlate", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"pending": rcpts.Correlations()})
+	})
+	mux.HandleFunc("POST /receipts/anchor", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			FromID int64 `json:"from_id"`
+			ToID   int64 `json:"to_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest); return }
+		a, err := rcpts.Anchor(req.FromID, req.ToID)
+		if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+		json.NewEncoder(w).Encode(a)
+	})
+	mux.HandleFunc("GET /receipts/anchors", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"anchors": rcpts.Anchors()})
+	})
+	mux.HandleFunc("GET /receipts/proof", func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		var anchor int
+		fmt.Sscanf(r.URL.Query().Get("id"), "%d", &id)
+		fmt.Sscanf(r.URL.Query().Get("anchor"), "%d", &anchor)
+		p, err := rcpts.Prove(id, anchor)
+		if err != nil { http.Error(w, err.Error(), http.StatusNotFound); return }
+		json.NewEncoder(w).Encode(p)
+	})
+	mux.HandleFunc("POST /receipts/verify_batch", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IDs []int64 `json:"ids"`
+			All bool    `json:"all"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest); return }
+		if !req.All && len(req.IDs) == 0 { http.Error(w, "ids or all required", http.StatusBadRequest); return }
+		json.NewEncoder(w).Encode(rcpts.VerifyBatch(req.IDs, req.All))
+	})
+	// Export streams the retained receipts for offline analysis; kind and limit filter as in /receipts.
+	mux.HandleFunc("GET /receipts/export", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		format := q.Get("format")
+		if format == "" { format = receipts.FormatJSONL }
+		var contentType string
+		switch format {
+		case receipts.FormatCSV:
+			contentType = "text/csv; charset=utf-8"
+		case receipts.FormatJSONL:
+			contentType = "application/x-ndjson"
+		default:
+			http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+			return
+		}
+		limit := 0
+		if v := q.Get("limit"); v != "" { fmt.Sscanf(v, "%d", &limit) }
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pathlab-receipts-%s.%s"`, time.Now().UTC().Format("20060102T150405Z"), format))
+		if err := rcpts.Export(w, format, q.Get("kind"), limit); err != nil {
+			log.Printf("[pathlab] receipts export: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /receipts/chain/verify", func(w http.ResponseWriter, r *http.Request) {
+		var from, to int64
+		if v := r.URL.Query().Get("from"); v != "" { fmt.Sscanf(v, "%d", &from) }
+		if v := r.URL.Query().Get("to"); v != "" { fmt.Sscanf(v, "%d", &to) }
+		json.NewEncoder(w).Encode(rcpts.VerifyChain(from, to))
+	})
+	mux.HandleFunc("GET /receipts/summary", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var window time.Duration
+		if v := q.Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 { http.Error(w, "window must be a duration such as 15m", http.StatusBadRequest); return }
+			window = d
+		}
+		top := receipts.DefaultSummaryTop
+		if v := q.Get("top"); v != "" { fmt.Sscanf(v, "%d", &top) }
+		json.NewEncoder(w).Encode(rcpts.Summary(window, top))
+	})
+	mux.HandleFunc("GET /receipts/query", func(w http.ResponseWriter, r *http.Request) {
+		q, err := receipts.ParseQuery(r.URL.Query())
+		if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+		// With -receipts-db every receipt is queried, not just the retained ones; source=ring asks for those.
+		if rdb != nil && r.URL.Query().Get("source") != "ring" {
+			res, err := rdb.Query(r.Context(), q)
+			if err != nil { http.Error(w, err.Error(), http.StatusInternalServerError); return }
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		json.NewEncoder(w).Encode(rcpts.Query(q))
+	})
+	// CI gate: 200 when every expectation holds, 417 with the same per-expectation detail otherwise.
+	mux.HandleFunc("POST /assert", func(w http.ResponseWriter, r *http.Request) {
+		a, err := receipts.ParseAssertion(r.Body)
+		if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+		res := rcpts.Assert(a)
+		w.Header().Set("Content-Type", "application/json")
+		if !res.Pass { w.WriteHeader(http.StatusExpectationFailed) }
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false) // keep conditions like ">=0.9" readable in CI logs
+		enc.Encode(res)
 	})
 	mux.HandleFunc("/receipts/stream", func(w http.ResponseWriter, r *http.Request) {
 		flusher, ok := w.(http.Flusher)
@@ -144,95 +665,341 @@ func main() {
 			}
 		}
 	})
+	mux.HandleFunc("GET /receipts/stream/sse", rcpts.ServeSSE)
+	// One WebSocket for a dashboard: receipts, impairment changes and connection stats.
+	mux.Handle("GET /ws", &dashboard.Feed{Receipts: rcpts, Impair: state, Conns: conns})
+	mux.HandleFunc("GET /slo", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(baseline.Status(time.Now()))
+	})
+	mux.HandleFunc("POST /slo", func(w http.ResponseWriter, r *http.Request) {
+		cfg := baseline.Status(time.Now()).Config
+		if r.Header.Get("Content-Type") == "application/json" {
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil { http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest); return }
+		} else {
+			q := r.URL.Query()
+			if v := q.Get("slo_ms"); v != "" { fmt.Sscanf(v, "%g", &cfg.SLOMs) }
+			if v := q.Get("window"); v != "" { cfg.Window = v }
+			if v := q.Get("min_samples"); v != "" { fmt.Sscanf(v, "%d", &cfg.MinSamples) }
+		}
+		if err := baseline.Configure(cfg); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+		log.Printf("[pathlab] slo set: p95 <= %gms over %s", cfg.SLOMs, cfg.Window)
+		json.NewEncoder(w).Encode(baseline.Status(time.Now()))
+	})
+	mux.HandleFunc("GET /clients/rtt", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"enabled": *collectTCPInfo, "prefixes": clientRTTs.Snapshot()})
+	})
+	mux.HandleFunc("GET /captures/stats", func(w http.ResponseWriter, r *http.Request) {
+		if captures == nil { json.NewEncoder(w).Encode(map[string]any{"enabled": false}); return }
+		json.NewEncoder(w).Encode(struct{ Enabled bool `json:"enabled"`; capture.Stats }{true, captures.Stats()})
+	})
+	mux.HandleFunc("GET /impair/profiles", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(impair.ProfileCatalog())
+	})
 	mux.HandleFunc("/impair/status", func(w http.ResponseWriter, r *http.Request) {
-		json.NewEncoder(w).Encode(state.Snapshot())
+		type keepAliveStatus struct {
+			Enabled     *bool   `json:"enabled"` // null: Go's default (on, 15s)
+			IdleSeconds float64 `json:"idle_seconds,omitempty"`
+		}
+		st := struct {
+			impair.Status
+			KeepAlive keepAliveStatus    `json:"keepalive"` // what new connections get, flags included
+			Mirror    *proxy.MirrorStats `json:"mirror,omitempty"`
+		}{Status: state.Status()}
+		eff := connDefaults(st.Config)
+		st.KeepAlive = keepAliveStatus{eff.KeepAliveEnabled, eff.KeepAliveIdleSeconds}
+		if *mirror != "" {
+			m := proxy.MirrorTotals()
+			st.Mirror = &m
+		}
+		json.NewEncoder(w).Encode(st)
 	})
 	mux.HandleFunc("/impair/clear", func(w http.ResponseWriter, r *http.Request) {
-		state.Apply(impair.Config{Profile: impair.ProfileClean, ThresholdBytes: 1300})
-		json.NewEncoder(w).Encode(state.Snapshot())
+		mutate(receipts.ActionImpairClear, adminActor(r), func() {
+			state.Apply(impair.Config{Profile: impair.ProfileClean, ThresholdBytes: 1300})
+		})
+		replNode.Changed()
+		json.NewEncoder(w).Encode(state.Status())
 	})
 	mux.HandleFunc("/impair/apply", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "POST required", http.StatusMethodNotAllowed)
 			return
 		}
-		var cfg impair.Config
-		if r.Header.Get("Content-Type") == "application/json" {
-			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
-				http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
-				return
-			}
-		} else {
-			// Accept query params for quick testing
-			q := r.URL.Query()
-			cfg.Profile = impair.ProfileName(q.Get("profile"))
-			if cfg.Profile == "" {
-				cfg.Profile = impair.ProfileClean
-			}
-			if v := q.Get("threshold_bytes"); v != "" {
-				var tb int
-				fmt.Sscanf(v, "%d", &tb)
-				cfg.ThresholdBytes = tb
-			}
-			if v := q.Get("latency_ms"); v != "" {
-				fmt.Sscanf(v, "%d", &cfg.LatencyMs)
-			}
-			if v := q.Get("bandwidth_kbps"); v != "" {
-				fmt.Sscanf(v, "%d", &cfg.BandwidthKbps)
-			}
-			if v := q.Get("bandwidth_down_kbps"); v != "" { fmt.Sscanf(v, "%d", &cfg.BandwidthDownKbps) }
-			if v := q.Get("blackhole_seconds"); v != "" { fmt.Sscanf(v, "%d", &cfg.BlackholeSeconds) }
+		if name := r.URL.Query().Get("preset"); name != "" {
+			if _, ok := state.Preset(name); !ok { http.Error(w, fmt.Sprintf("unknown preset %q", name), http.StatusNotFound); return }
+			mutate(receipts.ActionImpairApply, adminActor(r), func() { state.ApplyPreset(name) })
+			replNode.Changed()
+			json.NewEncoder(w).Encode(state.Status())
+			return
 		}
-		state.Apply(cfg)
-		json.NewEncoder(w).Encode(state.Snapshot())
+		cfg, err := configFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !knownProfile(w, cfg.Profile) || !validConfig(w, cfg) {
+			return
+		}
+		mutate(receipts.ActionImpairApply, adminActor(r), func() { state.Apply(cfg) })
+		replNode.Changed()
+		json.NewEncoder(w).Encode(state.Status())
+	})
+
+	// Presets: named configs for /impair/apply?preset=<name> and "then preset:<name>" rules.
+	mux.HandleFunc("GET /impair/presets", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"presets": state.Presets()})
+	})
+	mux.HandleFunc("GET /impair/presets/{name}", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := state.Preset(r.PathValue("name"))
+		if !ok { http.Error(w, "unknown preset", http.StatusNotFound); return }
+		json.NewEncoder(w).Encode(p)
+	})
+	mux.HandleFunc("PUT /impair/presets/{name}", func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := configFromRequest(r)
+		if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+		if !knownProfile(w, cfg.Profile) || !validConfig(w, cfg) { return }
+		name := r.PathValue("name")
+		if !impair.ValidPresetName(name) { http.Error(w, fmt.Sprintf("invalid preset name %q: use 1-64 of a-z, 0-9, '-', '_', '.'", name), http.StatusBadRequest); return }
+		var p impair.Preset
+		mutate(receipts.ActionPresetPut, adminActor(r), func() { p, _ = state.SetPreset(name, cfg) })
+		replNode.Changed()
+		log.Printf("[pathlab] preset %s stored (profile=%s)", p.Name, p.Config.Profile)
+		json.NewEncoder(w).Encode(p)
+	})
+	mux.HandleFunc("DELETE /impair/presets/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := state.Preset(r.PathValue("name")); !ok { http.Error(w, "unknown preset", http.StatusNotFound); return }
+		mutate(receipts.ActionPresetDelete, adminActor(r), func() { state.DeletePreset(r.PathValue("name")) })
+		replNode.Changed()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Per-connection overrides: the new config applies to subsequent reads/writes of a live connection.
+	mux.HandleFunc("GET /impair/conn/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		fmt.Sscanf(r.PathValue("id"), "%d", &id)
+		v, ok := liveConns.Load(id)
+		if !ok { http.Error(w, "connection not active", http.StatusNotFound); return }
+		json.NewEncoder(w).Encode(v.(liveConn).state.Status())
+	})
+	mux.HandleFunc("POST /impair/conn/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var id int64
+		fmt.Sscanf(r.PathValue("id"), "%d", &id)
+		v, ok := liveConns.Load(id)
+		if !ok { http.Error(w, "connection not active", http.StatusNotFound); return }
+		cfg, err := configFromRequest(r)
+		if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+		if !knownProfile(w, cfg.Profile) || !validConfig(w, cfg) { return }
+		lc := v.(liveConn)
+		if err := proxy.CanOverride(lc.started, cfg.Profile); err != nil { http.Error(w, err.Error(), http.StatusConflict); return }
+		cs := lc.state
+		cs.Apply(cfg)
+		conns.Describe(id, "", string(cfg.Profile))
+		log.Printf("[conn %d] admin override -> profile=%s", id, cfg.Profile)
+		json.NewEncoder(w).Encode(cs.Status())
+	})
+
+	// Live connections: listed with their byte counts so far; DELETE closes both legs
+	// and the receipt's outcome is admin_killed.
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		list := conns.List()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"count": len(list), "connections": list})
+	})
+	mux.HandleFunc("GET /connections/{id}/trace", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil { http.Error(w, "bad connection id", http.StatusBadRequest); return }
+		events, ok := traces.Get(id)
+		if !ok { http.Error(w, "no trace for this connection (not seen, evicted, or -trace-conns 0)", http.StatusNotFound); return }
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "events": events})
+	})
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil { http.Error(w, "bad connection id", http.StatusBadRequest); return }
+		if !conns.Kill(id) { http.Error(w, "connection not active", http.StatusNotFound); return }
+		log.Printf("[conn %d] closed by admin (%s)", id, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
 	})
 
+	// parseRules reads a rule set from a request body: a JSON array of {rule, description}
+	// with Content-Type application/json, rule text otherwise.
+	parseRules := func(r *http.Request) (rules.Set, error) {
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+			return rules.ParseJSON(r.Body)
+		}
+		return rules.Parse(r.Body)
+	}
 	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			// list current rules
-			curr := ruleSet.Load().(rules.Set)
+			// list current rules, in evaluation order
+			curr := ruleSet.Load()
+			if r.URL.Query().Get("format") == "json" {
+				json.NewEncoder(w).Encode(curr.JSON())
+				return
+			}
 			var out []string
-			for _, ru := range curr.Rules { out = append(out, ru.Raw) }
-			json.NewEncoder(w).Encode(map[string]any{"rules": out})
+			var active []bool // per rule: false outside its "between" window
+			var priorities []int
+			now := time.Now()
+			for _, ru := range curr.Rules {
+				out, active, priorities = append(out, ru.Raw), append(active, ru.ActiveAt(now)), append(priorities, ru.Priority)
+			}
+			resp := map[string]any{"rules": out, "active": active, "priorities": priorities}
+			if src, at := ruleSet.Origin(); src != "" {
+				resp["source"], resp["last_reload"] = src, at
+			}
+			if sh := shadowSet.Load(); len(sh.Rules) > 0 {
+				var shadow []string
+				for _, ru := range sh.Rules { shadow = append(shadow, ru.Raw) }
+				resp["shadow"] = shadow
+			}
+			json.NewEncoder(w).Encode(resp)
 		case http.MethodPost:
-			// accept plain text body
-			set, err := rules.Parse(r.Body)
+			set, err := parseRules(r)
 			if err != nil {
 				http.Error(w, "parse error: "+err.Error(), http.StatusBadRequest)
 				return
 			}
-			ruleSet.Store(set)
-			json.NewEncoder(w).Encode(map[string]any{"loaded": len(set.Rules)})
+			var report rules.ReloadReport
+			switch mode := r.URL.Query().Get("mode"); mode {
+			case "", "active":
+			case "shadow":
+				mutate(receipts.ActionRulesShadow, adminActor(r), func() { report = shadowSet.Replace(set) })
+				json.NewEncoder(w).Encode(report)
+				return
+			default:
+				http.Error(w, "mode must be active or shadow", http.StatusBadRequest)
+				return
+			}
+			mutate(receipts.ActionRulesLoad, adminActor(r), func() {
+				report = ruleSet.Replace(set)
+				if r.URL.Query().Get("reset_counters") == "true" { ruleSet.ResetCounters() }
+			})
+			replNode.Changed()
+			json.NewEncoder(w).Encode(report)
 		case http.MethodDelete:
-			ruleSet.Store(rules.Set{})
+			mutate(receipts.ActionRulesClear, adminActor(r), func() { ruleSet.Replace(rules.Set{}) })
+			replNode.Changed()
 			w.WriteHeader(http.StatusNoContent)
 		default:
 			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
 		}
 	})
 
+	replNode.Register(mux)
+
+	mux.HandleFunc("/rules/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Query().Get("set") == "shadow" {
+			json.NewEncoder(w).Encode(shadowSet.Stats())
+			return
+		}
+		json.NewEncoder(w).Encode(ruleSet.Stats())
+	})
+
+	mux.HandleFunc("/rules/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(shadowSet.Load().Rules) == 0 {
+			http.Error(w, "no shadow rule set loaded", http.StatusConflict)
+			return
+		}
+		var report rules.ReloadReport
+		mutate(receipts.ActionRulesPromote, adminActor(r), func() { report, _ = ruleSet.Promote(shadowSet) })
+		replNode.Changed()
+		json.NewEncoder(w).Encode(report)
+	})
+
+	mux.HandleFunc("/rules/lint", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		// Parse without installing: the first parse error, else the warnings.
+		set, err := parseRules(r)
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]any{"valid": false, "error": err.Error()})
+			return
+		}
+		warnings := rules.Lint(set, presetConfig)
+		if warnings == nil { warnings = []rules.Warning{} }
+		json.NewEncoder(w).Encode(map[string]any{"valid": true, "rules": len(set.Rules), "warnings": warnings})
+	})
+
 	mux.HandleFunc("/rules/test", func(w http.ResponseWriter, r *http.Request) {
-		// Accept query parameters to synthesize a tlsinspect.Result and show matched profile.
+		// Accept query parameters to synthesize a tlsinspect.Result and show matched profile,
+		// or a captured ClientHello (ch_b64, as on receipts) to run through the real parser.
 		q := r.URL.Query()
 		var fake tlsinspect.Result
+		if v := q.Get("ch_b64"); v != "" {
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil { http.Error(w, "ch_b64: "+err.Error(), http.StatusBadRequest); return }
+			if _, fake, err = tlsinspect.ParseClientHello(bytes.NewReader(b)); err != nil {
+				http.Error(w, "ch_b64: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		if v := q.Get("ch_bytes"); v != "" { fmt.Sscanf(v, "%d", &fake.HandshakeBytes) }
 		if v := q.Get("pqc_hint"); v != "" { b := v == "1" || v == "true"; fake.PQCHint = b }
 		if v := q.Get("cipher_count"); v != "" { fmt.Sscanf(v, "%d", &fake.CipherSuites) }
 		if v := q.Get("sni"); v != "" { fake.SNI = v }
-		if v := q.Get("alpn"); v != "" { fake.ALPN = append(fake.ALPN, v) }
+		if v := q.Get("alpn"); v != "" { fake.ALPN = append(fake.ALPN, strings.Split(v, ",")...) }
 		if v := r.URL.Query().Get("ja3"); v != "" { fake.JA3 = strings.ToLower(v) }
-		set := ruleSet.Load().(rules.Set)
-		if prof, ok := set.Match(fake); ok {
-			json.NewEncoder(w).Encode(map[string]any{"matched": true, "profile": prof})
+		if v := q.Get("ja3_normalized"); v != "" { fake.NormalizedJA3 = strings.ToLower(v) }
+		if v := q.Get("grease_count"); v != "" { fmt.Sscanf(v, "%d", &fake.GreaseCount) }
+		if v := q.Get("tls_max_version"); v != "" { fmt.Sscan(v, &fake.MaxVersion) }
+		if v := q.Get("ech_present"); v != "" { fake.ECHPresent = v == "1" || v == "true" }
+		if v := q.Get("offers_psk"); v != "" { fake.OffersPSK = v == "1" || v == "true" }
+		if v := q.Get("early_data"); v != "" { fake.EarlyData = v == "1" || v == "true" }
+		var conn rules.ConnInfo
+		if v := q.Get("src_ip"); v != "" {
+			ip := net.ParseIP(v)
+			if ip == nil { http.Error(w, "src_ip: bad address", http.StatusBadRequest); return }
+			conn.RemoteAddr = &net.TCPAddr{IP: ip}
+		}
+		if v := q.Get("sni_conn_rate"); v != "" { fmt.Sscanf(v, "%d", &conn.SNIRate) }
+		set := ruleSet.Load()
+		set.Rand = func() float64 { return 0 } // a dry run always selects sampled rules
+		if ru, ok := set.MatchRuleAt(fake, conn, time.Now()); ok {
+			cfg, found := ru.Config(state.Get(), presetConfig)
+			out := map[string]any{"matched": true, "profile": cfg.Profile}
+			if ru.Sample > 0 { out["sample_percent"] = ru.Sample * 100 }
+			if ru.Preset != "" { out["preset"], out["preset_found"] = ru.Preset, found }
+			if ru.Overlay != (impair.Config{}) { out["config"] = cfg }
+			json.NewEncoder(w).Encode(out)
 			return
 		}
 		json.NewEncoder(w).Encode(map[string]any{"matched": false})
 	})
 
+	// With -admin-token, requests are classed by method (GET reads, anything else writes)
+	// except for the paths below.
+	guard := adminauth.Policy{AdminToken: *adminToken, ReadOnlyToken: *readOnlyToken, Paths: map[string]adminauth.Class{
+		"/healthz":               adminauth.Public,
+		"/readyz":                adminauth.Public,
+		"/impair/clear":          adminauth.Write, // any method clears
+		"/rules/lint":            adminauth.Read,  // POSTs that only compute
+		"/rules/test":            adminauth.Read,
+		"/assert":                adminauth.Read,
+		"/quic/parse_initial":    adminauth.Read,
+		"/receipts/verify_batch": adminauth.Read,
+	}}
+	adminLimits := adminlimit.New(adminlimit.Limits{Rate: *adminRate, Burst: *adminBurst, MaxBody: *adminMaxBody, Bodies: bodyLimits, Classify: guard.Classify})
+	mux.HandleFunc("GET /admin/limits", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(adminLimits.Status())
+	})
+	if *adminToken != "" {
+		log.Printf("[pathlab] admin API requires a bearer token for changes (read-only token: %v)", *readOnlyToken != "")
+	}
 	adminSrv := &http.Server{
 		Addr:         *adminAddr,
-		Handler:      mux,
+		Handler:      adminLimits.Wrap(guard.Wrap(mux)),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 	}
@@ -243,128 +1010,637 @@ func main() {
 		}
 	}()
 
+	// UDP relay: one flow per client address, a receipt when each flow ends.
+	var udpSrv *udpproxy.Server
+	if *listenUDP != "" {
+		udpSrv, err = udpproxy.Listen(*listenUDP, udpproxy.Options{
+			Upstream:    *upstreamAddr,
+			FlowTimeout: *udpFlowTimeout,
+			State:       state,
+			NextID:      func() int64 { return atomic.AddInt64(&connCount, 1) },
+			OnFlowEnd: func(f udpproxy.Flow) {
+				applied := f.ImpairApplied
+				initial := f.Initial
+				rcpts.Add(receipts.Receipt{
+					Kind:           receipts.KindConnection,
+					ConnID:         f.ID,
+					Timestamp:      f.End.UTC(),
+					ClientAddr:     f.Client,
+					UpstreamAddr:   f.Upstream,
+					AppliedProfile: string(f.Profile),
+					GlobalProfile:  string(f.GlobalProfile),
+					ImpairApplied:  &applied,
+					DurationMs:     float64(f.End.Sub(f.Start)) / float64(time.Millisecond),
+					Transport:      "udp",
+					QUICInitial:    &initial,
+					DatagramsUp:    f.DatagramsUp,
+					DatagramsDown:  f.DatagramsDown,
+					DatagramsLost:  f.Dropped,
+					Truncated:      f.Truncated,
+					Outcome:        f.Reason,
+				})
+			},
+		})
+		if err != nil {
+			log.Fatalf("listen-udp %s: %v", *listenUDP, err)
+		}
+		log.Printf("[pathlab] relaying UDP on %s to %s", *listenUDP, *upstreamAddr)
+		go udpSrv.Serve()
+	}
+
 	// Accept loop
 	var wg sync.WaitGroup
+	limiter := proxy.NewConnLimiter(*maxConns, *overflow, *queueTimeout)
+	if limiter != nil {
+		log.Printf("[pathlab] at most %d concurrent connections, overflow=%s", *maxConns, *overflow)
+	}
 	go func() {
 		for {
 			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				log.Printf("accept error: %v", err)
 				continue
 			}
 			id := atomic.AddInt64(&connCount, 1)
+			rec := traces.Start(id)
+			if rec == nil && otlp != nil {
+				rec = trace.NewRecorder() // -trace-conns 0: kept for the export only
+			}
+			// -max-conns: the slot is taken here, before the connection gets a goroutine,
+			// so a flood past the limit costs none; while one connection queues the
+			// rest wait in the listen backlog. Without a slot the connection is reset;
+			// record that and move on.
+			queued, lerr := limiter.Admit(conn)
+			if lerr != nil {
+				outcome := "rejected"
+				if errors.Is(lerr, proxy.ErrQueueTimedOut) { outcome = "queued_timeout" }
+				log.Printf("[conn %d] %s from %s: %v", id, outcome, conn.RemoteAddr(), lerr)
+				connReceipt(rec, receipts.Receipt{
+					Kind:          receipts.KindConnection,
+					ConnID:        id,
+					Timestamp:     time.Now().UTC(),
+					ClientAddr:    conn.RemoteAddr().String(),
+					UpstreamAddr:  *upstreamAddr,
+					GlobalProfile: string(state.Get().Profile),
+					QueuedMs:      float64(queued) / float64(time.Millisecond),
+					TraceMs:       closeTrace(rec, outcome),
+					Outcome:       outcome,
+					Error:         lerr.Error(),
+				}, nil)
+				conn.Close()
+				continue
+			}
 			wg.Add(1)
 			go func(id int64, c net.Conn) {
 				defer wg.Done()
 				defer c.Close()
-				_ = c.SetReadDeadline(time.Now().Add(*readTimeout))
-				_ = c.SetWriteDeadline(time.Now().Add(*writeTimeout))
+				defer limiter.Release()
+				raw := c
+				tracked, ok := conns.Track(id, raw)
+				if !ok {
+					return // shutting down
+				}
+				c = tracked
+				defer conns.Untrack(id)
+				_ = c.SetReadDeadline(time.Now().Add(timeouts.Load().read))
 				baseCfg := state.Get()
 				logger := log.New(os.Stdout, "", log.LstdFlags)
+				// Right after accept the kernel's smoothed RTT is the TCP handshake RTT.
+				var clientRTT float64
+				if *collectTCPInfo {
+					if info, err := tcpinfo.Read(raw); err == nil {
+						clientRTT = float64(info.RTT) / float64(time.Millisecond)
+						if ap, err := netip.ParseAddrPort(c.RemoteAddr().String()); err == nil {
+							clientRTTs.Observe(ap.Addr(), info.RTT, time.Now())
+						}
+					} else if !errors.Is(err, tcpinfo.ErrUnsupported) {
+						logger.Printf("[conn %d] tcp_info: %v", id, err)
+					}
+				}
+
+				// A connection that fails before its first flight gets an error receipt
+				// (under -socks5 no upstream was named yet).
+				earlyError := func(err error) {
+					var up string
+					if !*socks5 {
+						up = *upstreamAddr
+					}
+					connReceipt(rec, receipts.Receipt{
+						Kind:          receipts.KindConnection,
+						ConnID:        id,
+						Timestamp:     time.Now().UTC(),
+						ClientAddr:    c.RemoteAddr().String(),
+						UpstreamAddr:  up,
+						GlobalProfile: string(baseCfg.Profile),
+						TraceMs:       closeTrace(rec, "error"),
+						Outcome:       "error",
+						Error:         err.Error(),
+					}, nil)
+				}
+				// -accept-proxy-protocol: strip the balancer's header; from here on c reports
+				// the client address it carries.
+				if *acceptProxy {
+					ppc, err := proxyproto.Accept(c)
+					if err != nil {
+						logger.Printf("[conn %d] proxy protocol from %s: %v", id, c.RemoteAddr(), err)
+						earlyError(err)
+						return
+					}
+					c = ppc
+				}
+				// -socks5: the client names its upstream before sending anything else, and
+				// hears whether it connected: the dial happens before the reply.
+				var socksDest string
+				var socksUp *proxy.Upstream
+				if *socks5 {
+					dest, err := socks.Accept(c, socksCreds, func(dest string) error {
+						if *upstreamMode != proxy.UpstreamProxy {
+							return nil // echo/sink: nothing to dial
+						}
+						up, err := proxy.DialUpstream(dest, baseCfg)
+						if err != nil {
+							return err
+						}
+						rec.Record(trace.UpstreamDialed, fmt.Sprintf("%s, %d attempts", up.ServedBy, up.Attempts))
+						socksUp = &up
+						return nil
+					})
+					if socksUp != nil {
+						defer socksUp.Conn.Close() // for the paths that end before the handler
+					}
+					if err != nil {
+						logger.Printf("[conn %d] socks5 from %s: %v", id, c.RemoteAddr(), err)
+						earlyError(err)
+						return
+					}
+					socksDest = dest
+				}
 
-				// Peek ClientHello for rule matching (non-destructive) by creating a tee buffer
-				// We re-use tlsinspect.ParseClientHello by wrapping a reader that accumulates bytes then
-				// replays them to the normal proxy handlers according to chosen profile.
-				br := bufio.NewReader(c)
-				raw, res, perr := tlsinspect.ParseClientHello(br)
+				// Parse the ClientHello once for rule matching and captures; the peeked conn
+				// replays it to the handlers, which reuse the parse. Past the first flight
+				// only -idle-timeout bounds the connection.
+				pc := proxy.PeekClientHello(c, timeouts.Load().peek)
+				records, res, perr := pc.ClientHello()
+				if perr != nil {
+					rec.Record(trace.CHParsed, perr.Error())
+				} else {
+					rec.Record(trace.CHParsed, fmt.Sprintf("sni=%q ch_bytes=%d", res.SNI, res.HandshakeBytes))
+				}
+				if errors.Is(perr, tlsinspect.ErrHandshakeTooLarge) {
+					// Nothing is dialed or buffered further for an oversized ClientHello.
+					logger.Printf("[conn %d] %v: reset", id, perr)
+					pc.Abort()
+					connReceipt(rec, receipts.Receipt{
+						Kind:            receipts.KindConnection,
+						ConnID:          id,
+						Timestamp:       time.Now().UTC(),
+						ClientAddr:      c.RemoteAddr().String(),
+						ClientRTTMs:     clientRTT,
+						GlobalProfile:   string(baseCfg.Profile),
+						HandshakeBytes:  res.HandshakeBytes,
+						CHParseError:    perr.Error(),
+						CHRecords:       res.Records,
+						CHBytesReceived: res.BytesReceived,
+						CHHeaderSeen:    res.HeaderSeen,
+						TraceMs:         closeTrace(rec, "oversized_ch"),
+						Outcome:         "oversized_ch",
+					}, nil)
+					return
+				}
+				if captures != nil && len(records) > 0 {
+					name := fmt.Sprintf("%s-conn%d.bin", time.Now().UTC().Format("20060102T150405"), id)
+					if err := captures.Save(name, records); err != nil {
+						logger.Printf("[conn %d] capture not saved: %v", id, err)
+					}
+				}
 				var chosen impair.ProfileName = baseCfg.Profile
+				var matched rules.Rule
+				var decision rules.Decision
+				var shadowProfile string
 				if perr == nil {
-					set := ruleSet.Load().(rules.Set)
-					if prof, ok := set.Match(res); ok {
-						chosen = prof
-						logger.Printf("[conn %d] rule matched -> profile=%s (ch_bytes=%d pqc_hint=%v)", id, chosen, res.HandshakeBytes, res.PQCHint)
+					conn := rules.ConnInfo{RemoteAddr: c.RemoteAddr(), SNIRate: sniRates.Add(res.SNI)}
+					decision = ruleSet.Decide(res, conn)
+					for _, ru := range decision.SampledOut {
+						logger.Printf("[conn %d] rule matched -> %s, not sampled (%g%%)", id, ru.Action(), ru.Sample*100)
 					}
+					if ru := decision.Rule; decision.OK {
+						matched = ru
+						chosen = ru.Profile
+						rec.Record(trace.RuleMatched, ru.Raw)
+						logger.Printf("[conn %d] rule matched -> %s (ch_bytes=%d pqc_hint=%v)", id, ru.Action(), res.HandshakeBytes, res.PQCHint)
+					}
+					shadowProfile = shadowSet.Shadow(res, conn, baseCfg.Profile)
+				}
+				var chB64 string
+				if *captureCH && len(records) > 0 {
+					if len(records) <= receipts.MaxCHCapture {
+						chB64 = base64.StdEncoding.EncodeToString(records)
+					} else {
+						logger.Printf("[conn %d] ClientHello of %d bytes not put on the receipt (max %d)", id, len(records), receipts.MaxCHCapture)
+					}
+				}
+				var alpnFirst string
+				if len(res.ALPN) > 0 { alpnFirst = res.ALPN[0] }
+				var maxVersion string
+				if res.MaxVersion != 0 { maxVersion = tlsinspect.VersionName(res.MaxVersion) }
+				// A retry overlapping a held connection with the same fingerprint is paired with it.
+				holdKey := proxy.HoldKey(res.JA3, res.SNI)
+				var partner int64
+				if res.JA3 != "" {
+					partner = holds.Pair(holdKey, id)
 				}
-				// Reconstruct reader including already-read bytes for handler
-				full := append(raw, drainBuffered(br)...) // raw includes only handshake bytes; additional buffered bytes appended
-				replay := bufio.NewReader(&prependReader{prefix: full, rest: c})
 				cfg := baseCfg; cfg.Profile = chosen
-				logger.Printf("[conn %d] accepted from %s -> upstream %s, profile=%s", id, c.RemoteAddr(), *upstreamAddr, cfg.Profile)
-				// Hand off using replay reader by temporarily swapping in proxy internals (simpler: dial upstream inside this path again)
-				// Simplify: call specialized entry passing pre-read bytes (future refactor)
-				// Fallback: if parse failed, just use original conn (already consumed unknown bytes though)
+				if matched.Raw != "" { // profile or preset, with the rule's inline parameters
+					var ok bool
+					if cfg, ok = matched.Config(baseCfg, presetConfig); !ok {
+						logger.Printf("[conn %d] preset %q not found, keeping profile=%s", id, matched.Preset, cfg.Profile)
+					}
+					chosen = cfg.Profile
+				}
+				// the applied rule, else one that matched but was sampled out; none under the global profile
+				reported, _, ruleSampled := decision.Reported()
+				if matched.AlsoHold > 0 {
+					cfg.AlsoHoldMs = int(matched.AlsoHold / time.Millisecond)
+					holds.Begin(id, holdKey)
+				}
+				// apply_percent: only a share of connections get the profile, the rest run CLEAN.
+				impairApplied := state.RollApply(cfg)
+				if !impairApplied {
+					cfg.Profile = impair.ProfileClean
+				}
+				// FAILURE_RAMP: roll once per connection against the current ramp probability.
+				var rampPct float64
+				if cfg.Profile == impair.ProfileFailureRamp {
+					cfg.Profile, rampPct = impair.FailureRampDecision(cfg, time.Now(), mrand.Float64())
+				}
+				// Without a ClientHello (plain HTTP, any non-TLS bytes) there is nothing to
+				// impair by: relay the stream byte for byte.
 				if perr != nil {
-					logger.Printf("[conn %d] clienthello parse error (rules skipped): %v", id, perr)
+					logger.Printf("[conn %d] clienthello parse error (rules skipped, passing through): %v", id, perr)
+					cfg.Profile = impair.ProfileClean
 				}
+				// FIRST_CONTACT, from the rule's or preset's config when one applies: only a key's
+				// first connection within the TTL is impaired. A connection that already runs CLEAN
+				// does not use up the key.
+				var firstContact bool
+				if cfg.Profile != impair.ProfileClean {
+					clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+					var fcOn bool
+					if firstContact, fcOn = impair.FirstContact(contacts, cfg, clientIP, res.JA3); fcOn && !firstContact {
+						cfg.Profile = impair.ProfileClean
+					}
+				}
+				upstream := router.Resolve(res.SNI)
+				if socksDest != "" {
+					upstream = socksDest
+				}
+				logger.Printf("[conn %d] accepted from %s -> upstream %s, profile=%s", id, c.RemoteAddr(), upstream, cfg.Profile)
+				cfg = connDefaults(cfg)
 				start := time.Now()
-				err := proxy.HandleConnection(replayConn{Conn: c, reader: replay}, *upstreamAddr, cfg, id, logger)
+				connState := impair.NewState(cfg)
+				conns.Describe(id, c.RemoteAddr().String(), string(cfg.Profile))
+				liveConns.Store(id, liveConn{state: connState, started: cfg.Profile})
+				var stats proxy.Stats
+				var err error
+				if socksUp != nil {
+					stats, err = proxy.HandleConnectionDialed(pc, *socksUp, connState, id, logger, rec)
+				} else {
+					stats, err = proxy.HandleConnectionTraced(pc, upstream, connState, id, logger, rec)
+				}
+				liveConns.Delete(id)
 				dur := time.Since(start)
+				var overridden string
+				if final := connState.Get().Profile; final != cfg.Profile { overridden = string(final) }
+				if cfg.AlsoHoldMs > 0 {
+					if p := holds.End(id); p != 0 { partner = p }
+				}
 				outcome := "closed"
 				var errStr string
 				if err != nil { outcome = "error"; errStr = err.Error() }
+				if stats.IdleTimedOut { outcome, errStr = "idle_timeout", "" }
+				if stats.MaxLifetime { outcome, errStr = "max_lifetime", "" }
+				if closedBy := conns.Finish(id); closedBy != "" { outcome, errStr = closedBy, "" }
 				logger.Printf("[conn %d] %s (%.0fms)", id, outcome, dur.Seconds()*1000)
+				var serverVersion, serverCipher, serverGroup string
+				if stats.ServerVersion != 0 {
+					serverVersion, serverCipher = tlsinspect.VersionName(stats.ServerVersion), tls.CipherSuiteName(stats.ServerCipher)
+				}
+				if stats.ServerGroup != 0 { serverGroup = tlsinspect.GroupName(stats.ServerGroup) }
 				// Emit receipt
 				receipt := receipts.Receipt{
-					ConnID:         id,
-					Timestamp:      time.Now().UTC(),
-					ClientAddr:     c.RemoteAddr().String(),
-					UpstreamAddr:   *upstreamAddr,
-					AppliedProfile: string(cfg.Profile),
-					GlobalProfile:  string(baseCfg.Profile),
-					RuleMatched:    string(chosen),
-					HandshakeBytes: res.HandshakeBytes,
-					CipherCount:    res.CipherSuites,
-					PQCHint:        res.PQCHint,
-					SNI:            res.SNI,
-					ALPN:           res.ALPN,
-					JA3:            res.JA3,
-					Outcome:        outcome,
-					Error:          errStr,
+					Kind:            receipts.KindConnection,
+					ConnID:          id,
+					Timestamp:       time.Now().UTC(),
+					ClientAddr:      c.RemoteAddr().String(),
+					ClientRTTMs:     clientRTT,
+					DurationMs:      float64(dur) / float64(time.Millisecond),
+					SlowHandshakeMs: float64(stats.SlowHandshake) / float64(time.Millisecond),
+					TTFBDelayMs:     float64(stats.FirstByteDelay) / float64(time.Millisecond),
+					UpstreamTTFBMs:  float64(stats.UpstreamTTFB) / float64(time.Millisecond),
+					QueuedMs:        float64(queued) / float64(time.Millisecond),
+					UpstreamAddr:    upstream,
+					SOCKSDest:       socksDest,
+					DialAttempts:    stats.DialAttempts,
+					ServedBy:        stats.Upstream,
+					UpstreamMode:    stats.UpstreamMode,
+					BytesUp:         stats.BytesUp,
+					BytesDown:       stats.BytesDown,
+					MirrorDropped:   stats.MirrorDropped,
+					FirstByteMs:     float64(stats.FirstByteLatency) / float64(time.Millisecond),
+					TraceMs:         closeTrace(rec, outcome),
+					AppliedProfile:  string(cfg.Profile),
+					GlobalProfile:   string(baseCfg.Profile),
+					RuleMatched:     reported.Raw,
+					RuleID:          reported.ID,
+					RuleSampled:     ruleSampled,
+					RuleDescription: reported.Description,
+					ShadowProfile:   shadowProfile,
+					HandshakeBytes:  res.HandshakeBytes,
+					CipherCount:     res.CipherSuites,
+					PQCHint:         res.PQCHint,
+					SNI:             res.SNI,
+					ALPN:            res.ALPN,
+					ALPNFirst:       alpnFirst,
+					JA3:             res.JA3,
+					JA3Normalized:   res.NormalizedJA3,
+					GreaseCount:     res.GreaseCount,
+					CHSHA256:        res.CHSHA256,
+					CHB64:           chB64,
+					TLSMaxVersion:   maxVersion,
+					ECHPresent:      res.ECHPresent,
+					OffersPSK:       res.OffersPSK,
+					PSKIdentities:   res.PSKIdentityCount,
+					SessionIDLen:    res.SessionIDLen,
+					EarlyData:       res.EarlyData,
+					DroppedBytes:    stats.DroppedBytes,
+					DroppedDown:     stats.DroppedDown,
+					BlackholeDir:    stats.BlackholeDir,
+					ResetAtBytes:    stats.ResetAtBytes,
+					ServerBytes:     stats.ServerBytes,
+					ReorderedChunks: stats.ReorderedChunks,
+					HeldMs:          stats.HeldMs,
+					CorruptedChunks: stats.CorruptedChunks,
+					FinalKbps:       stats.FinalKbps,
+					StallAtBytes:    stats.StallAtBytes,
+					StallMs:         stats.StallMs,
+					InterceptCN:     stats.InterceptCN,
+					InterceptResult: stats.InterceptResult,
+					HRR:             stats.HRR,
+					ServerVersion:   serverVersion,
+					ServerCipher:    serverCipher,
+					ServerGroup:     serverGroup,
+					OverlapPartner:  partner,
+					FirstContact:    firstContact,
+					ImpairApplied:   &impairApplied,
+					FailureRampPct:  rampPct,
+					OverriddenTo:    overridden,
+					Outcome:         outcome,
+					Error:           errStr,
+				}
+				// Only untouched CLEAN connections measure the baseline.
+				if cfg.Profile == impair.ProfileClean && overridden == "" && stats.HandshakeTime > 0 {
+					receipt.HandshakeMs = float64(stats.HandshakeTime) / float64(time.Millisecond)
+					if a := baseline.Observe(stats.HandshakeTime, time.Now()); a != nil {
+						log.Printf("[pathlab] %s: CLEAN handshake p95 %.1fms vs slo %gms over %s (%d samples)", a.State, a.P95Ms, a.SLOMs, a.Window, a.Samples)
+						rcpts.Add(receipts.SLOAlert(a.State, a.P95Ms, a.SLOMs, a.Samples, a.Window))
+					}
+				}
+				receipt.HalfClosed, receipt.HalfClosedBytes = stats.HalfClosed, stats.HalfClosedBytes
+				receipt.Terminated, receipt.ClientTLSVersion, receipt.UpstreamTLSVersion = stats.Terminated, stats.ClientTLS, stats.UpstreamTLS
+				if secs := stats.Duration.Seconds(); secs > 0 {
+					receipt.UpKbps, receipt.DownKbps = float64(stats.BytesUp*8)/1000/secs, float64(stats.BytesDown*8)/1000/secs
+				}
+				if perr != nil {
+					// a stalled or non-TLS client: record how far its first flight got
+					receipt.CHParseError = perr.Error()
+					receipt.CHRecords, receipt.CHBytesReceived, receipt.CHHeaderSeen = res.Records, res.BytesReceived, res.HeaderSeen
+				}
+				if stats.RetryCH != nil {
+					receipt.RetryCHBytes = stats.RetryCH.HandshakeBytes
+					receipt.RetryPQCHint = stats.RetryCH.PQCHint
 				}
 				_ = hex.EncodeToString // keep import used until we add manual verification example later
-				rcpts.Add(receipt)
+				connReceipt(rec, receipt, &cfg)
 			}(id, conn)
 		}
 	}()
 
+	// SIGHUP re-reads -config: the impairment, rules and timeouts (except the queue's) apply
+	// at once, to new connections; other changes are logged and wait for a restart.
+	if *configFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		configTargets.Settings = func(changed []config.Setting) {
+			for _, st := range changed {
+				if setFlags[st.Flag] {
+					log.Printf("[pathlab] %s in %s ignored: -%s was given", st.Key, *configFile, st.Flag)
+					continue
+				}
+				v := st.Value
+				if v == "" {
+					v = flag.Lookup(st.Flag).DefValue
+				}
+				if err := flag.Set(st.Flag, v); err != nil {
+					log.Printf("[pathlab] %s: %v", st.Key, err)
+				}
+			}
+			loadTimeouts()
+		}
+		configTargets.Mutate = func(what string, fn func()) {
+			action := receipts.ActionImpairApply
+			if what == "rules" {
+				action = receipts.ActionRulesLoad
+			}
+			mutate(action, receipts.Actor{Addr: "config:" + *configFile}, fn)
+			replNode.Changed()
+		}
+		go func() {
+			for range hup {
+				next, err := config.Load(*configFile)
+				if err == nil {
+					var rep config.Report
+					if rep, err = config.Apply(fileCfg, next, configTargets); err == nil {
+						fileCfg = next
+						log.Printf("[pathlab] reloaded %s: applied %v", *configFile, rep.Applied)
+						var restart []string
+						for _, key := range rep.Restart {
+							for _, st := range next.Settings() {
+								if st.Key == key && !setFlags[st.Flag] {
+									restart = append(restart, key)
+								}
+							}
+						}
+						if len(restart) > 0 {
+							log.Printf("[pathlab] %s changed in %s: takes effect after a restart", strings.Join(restart, ", "), *configFile)
+						}
+					}
+				}
+				if err != nil {
+					log.Printf("[pathlab] reload: %v; keeping the running config", err)
+				}
+			}
+		}()
+	}
+
 	// graceful shutdown
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
 	<-sigc
 	log.Printf("[pathlab] shutting down...")
 	ln.Close()
+	if udpSrv != nil {
+		udpSrv.Close()
+	}
+	drain := timeouts.Load().drain
+	if n := conns.Len(); n > 0 {
+		log.Printf("[pathlab] draining %d connections (up to %s)", n, drain)
+	}
+	if forced := conns.Drain(drain); forced > 0 {
+		log.Printf("[pathlab] closed %d connections still open after -drain-timeout", forced)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_ = adminSrv.Shutdown(ctx)
 	wg.Wait()
+	if rdb != nil {
+		if err := rdb.Close(); err != nil {
+			log.Printf("[pathlab] receipts db: %v", err)
+		}
+		log.Printf("[pathlab] receipts db: %+v", rdb.Stats())
+	}
+	otlp.Close()
+	if err := rcpts.CloseJournal(); err != nil {
+		log.Printf("[pathlab] receipts journal: %v", err)
+	}
 	log.Printf("[pathlab] bye")
 }
 
-// bufferedConn is a thin wrapper (unused now but placeholder for future enhancements)
-type bufferedConn struct {
-	net.Conn
-	reader *bufio.Reader
+// liveConn is an active connection's override target and the profile its handler
+// was chosen for.
+type liveConn struct {
+	state   *impair.State
+	started impair.ProfileName
 }
 
-// prependReader allows us to replay already-parsed bytes before reading from the live conn.
-type prependReader struct {
-	prefix []byte
-	rest   net.Conn
+// closeTrace records a connection's Closed event with its outcome and returns the
+// timeline's offsets for its receipt.
+func closeTrace(rec *trace.Recorder, outcome string) map[string]float64 {
+	rec.Record(trace.Closed, outcome)
+	return rec.Offsets()
 }
 
-func (p *prependReader) Read(b []byte) (int, error) {
-	if len(p.prefix) > 0 {
-		n := copy(b, p.prefix)
-		p.prefix = p.prefix[n:]
-		return n, nil
+// loopbackListen reports whether the listen address addr only accepts connections
+// from this host.
+func loopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
 	}
-	return p.rest.Read(b)
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
 }
 
-// replayConn injects a custom reader while satisfying net.Conn.
-type replayConn struct {
-	net.Conn
-	reader *bufio.Reader
+// knownProfile rejects an unknown profile name with 400 and the valid names; an empty
+// name is allowed and means CLEAN.
+func knownProfile(w http.ResponseWriter, name impair.ProfileName) bool {
+	if _, ok := impair.LookupProfile(name); ok || name == "" {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{"error": fmt.Sprintf("unknown profile %q", name), "valid_profiles": impair.ProfileNames()})
+	return false
 }
 
-func (r replayConn) Read(b []byte) (int, error) { return r.reader.Read(b) }
+// validConfig writes a 422 listing every invalid field and returns false when cfg
+// does not pass impair.Config.Validate.
+func validConfig(w http.ResponseWriter, cfg impair.Config) bool {
+	err := cfg.Validate()
+	if err == nil {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "errors": err.(*impair.ValidationError).Fields})
+	return false
+}
 
-func drainBuffered(br *bufio.Reader) []byte {
-	var buf bytes.Buffer
-	for br.Buffered() > 0 {
-		chunk, _ := br.Peek(br.Buffered())
-		buf.Write(chunk)
-		br.Discard(len(chunk))
+// configFromRequest reads an impair.Config from a JSON body or, for quick testing, query params.
+func configFromRequest(r *http.Request) (impair.Config, error) {
+	var cfg impair.Config
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("bad json: %w", err)
+		}
+	} else {
+		// Accept query params for quick testing
+		q := r.URL.Query()
+		cfg.Profile = impair.ProfileName(q.Get("profile"))
+		if cfg.Profile == "" {
+			cfg.Profile = impair.ProfileClean
+		}
+		if v := q.Get("threshold_bytes"); v != "" {
+			var tb int
+			fmt.Sscanf(v, "%d", &tb)
+			cfg.ThresholdBytes = tb
+		}
+		if v := q.Get("latency_ms"); v != "" {
+			fmt.Sscanf(v, "%d", &cfg.LatencyMs)
+		}
+		if v := q.Get("jitter_ms"); v != "" { fmt.Sscanf(v, "%d", &cfg.JitterMs) }
+		if v := q.Get("latency_down_ms"); v != "" { fmt.Sscanf(v, "%d", &cfg.LatencyDownMs) }
+		if v := q.Get("jitter_down_ms"); v != "" { fmt.Sscanf(v, "%d", &cfg.JitterDownMs) }
+		cfg.JitterDistribution = q.Get("jitter_distribution")
+		if v := q.Get("jitter_seed"); v != "" { fmt.Sscanf(v, "%d", &cfg.JitterSeed) }
+		if v := q.Get("bandwidth_kbps"); v != "" {
+			fmt.Sscanf(v, "%d", &cfg.BandwidthKbps)
+		}
+		if v := q.Get("bandwidth_down_kbps"); v != "" { fmt.Sscanf(v, "%d", &cfg.BandwidthDownKbps) }
+		if v := q.Get("burst_bytes"); v != "" { fmt.Sscanf(v, "%d", &cfg.BurstBytes) }
+		if v := q.Get("bandwidth_floor_kbps"); v != "" { fmt.Sscanf(v, "%d", &cfg.BandwidthFloorKbps) }
+		if v := q.Get("ramp_seconds"); v != "" { fmt.Sscanf(v, "%g", &cfg.RampSeconds) }
+		cfg.GlobalBandwidth, _ = strconv.ParseBool(q.Get("global_bandwidth"))
+		if v := q.Get("blackhole_seconds"); v != "" { fmt.Sscanf(v, "%d", &cfg.BlackholeSeconds) }
+		cfg.ApplyToRetryCH, _ = strconv.ParseBool(q.Get("apply_to_retry_ch"))
+		if v := q.Get("keepalive_enabled"); v != "" {
+			on, err := strconv.ParseBool(v)
+			if err != nil {
+				return cfg, fmt.Errorf("keepalive_enabled: %w", err)
+			}
+			cfg.KeepAliveEnabled = &on
+		}
+		if v := q.Get("keepalive_idle_seconds"); v != "" { fmt.Sscanf(v, "%g", &cfg.KeepAliveIdleSeconds) }
+		cfg.BlackholeDirection = q.Get("blackhole_direction")
+		if v := q.Get("loss_percent"); v != "" { fmt.Sscanf(v, "%g", &cfg.LossPercent) }
+		if v := q.Get("first_byte_delay_ms"); v != "" { fmt.Sscanf(v, "%d", &cfg.FirstByteDelayMs) }
+		if v := q.Get("reset_after_bytes"); v != "" { fmt.Sscanf(v, "%d", &cfg.ResetAfterBytes) }
+		if v := q.Get("abort_after_server_bytes"); v != "" { fmt.Sscanf(v, "%d", &cfg.AbortAfterServerBytes) }
+		if v := q.Get("reorder_percent"); v != "" { fmt.Sscanf(v, "%g", &cfg.ReorderPercent) }
+		if v := q.Get("reorder_window_bytes"); v != "" { fmt.Sscanf(v, "%d", &cfg.ReorderWindowBytes) }
+		if v := q.Get("drip_bytes"); v != "" { fmt.Sscanf(v, "%d", &cfg.DripBytes) }
+		if v := q.Get("drip_interval_ms"); v != "" { fmt.Sscanf(v, "%d", &cfg.DripIntervalMs) }
+		if v := q.Get("corrupt_percent"); v != "" { fmt.Sscanf(v, "%g", &cfg.CorruptPercent) }
+		cfg.CorruptDirection = q.Get("corrupt_direction")
+		if v := q.Get("stall_after_bytes"); v != "" { fmt.Sscanf(v, "%d", &cfg.StallAfterBytes) }
+		if v := q.Get("stall_seconds"); v != "" { fmt.Sscanf(v, "%g", &cfg.StallSeconds) }
+		if v := q.Get("half_close_after_bytes"); v != "" { fmt.Sscanf(v, "%d", &cfg.HalfCloseAfterBytes) }
+		cfg.InterceptCN = q.Get("intercept_cn")
+		cfg.InterceptRedirect = q.Get("intercept_redirect")
+		if v := q.Get("max_pct"); v != "" { fmt.Sscanf(v, "%g", &cfg.MaxPct) }
+		if v := q.Get("ramp_minutes"); v != "" { fmt.Sscanf(v, "%g", &cfg.RampMinutes) }
+		cfg.RampShape = q.Get("ramp_shape")
+		cfg.FirstContactKey = q.Get("first_contact_key")
+		if v := q.Get("first_contact_ttl_seconds"); v != "" { fmt.Sscanf(v, "%d", &cfg.FirstContactTTLSeconds) }
+		if v := q.Get("apply_percent"); v != "" { fmt.Sscanf(v, "%g", &cfg.ApplyPercent) }
+		if v := q.Get("duration_seconds"); v != "" { fmt.Sscanf(v, "%g", &cfg.DurationSeconds) }
+		if v := q.Get("idle_timeout_seconds"); v != "" { fmt.Sscanf(v, "%g", &cfg.IdleTimeoutSeconds) }
+		if v := q.Get("max_conn_seconds"); v != "" { fmt.Sscanf(v, "%g", &cfg.MaxConnSeconds) }
 	}
-	return buf.Bytes()
+	return cfg, nil
 }
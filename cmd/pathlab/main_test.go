@@ -0,0 +1,204 @@
+package main
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+
+    "pathlab/internal/adminauth"
+    "pathlab/internal/impair"
+    "pathlab/internal/receipts"
+    "pathlab/internal/trace"
+)
+
+// TestMain lets a test run the real server: the test binary re-executed with
+// PATHLAB_TEST_MAIN=1 is pathlab.
+func TestMain(m *testing.M) {
+    if os.Getenv("PATHLAB_TEST_MAIN") == "1" {
+        main()
+        os.Exit(0)
+    }
+    os.Exit(m.Run())
+}
+
+func freeAddr(t *testing.T) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    return ln.Addr().String()
+}
+
+// pathlab is a running server and the tokens its admin API takes.
+type pathlab struct {
+    t                 *testing.T
+    listen, admin     string
+    adminTok, viewTok string
+}
+
+func startPathlab(t *testing.T, upstream string) *pathlab {
+    p := &pathlab{t: t, listen: freeAddr(t), admin: freeAddr(t), adminTok: "admin-secret", viewTok: "viewer"}
+    cmd := exec.Command(os.Args[0], "-listen", p.listen, "-admin", p.admin, "-upstream", upstream,
+        "-keyfile", filepath.Join(t.TempDir(), "pathlab.key"), "-admin-token", p.adminTok, "-admin-readonly-token", p.viewTok)
+    cmd.Env = append(os.Environ(), "PATHLAB_TEST_MAIN=1")
+    var logs bytes.Buffer
+    cmd.Stdout, cmd.Stderr = &logs, &logs
+    if err := cmd.Start(); err != nil { t.Fatalf("start: %v", err) }
+    t.Cleanup(func(){
+        cmd.Process.Signal(syscall.SIGTERM)
+        cmd.Wait()
+        if t.Failed() { t.Logf("pathlab log:\n%s", logs.String()) }
+    })
+    for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+        if resp, err := http.Get("http://" + p.admin + "/healthz"); err == nil {
+            resp.Body.Close()
+            return p
+        }
+        if time.Now().After(deadline) { t.Fatalf("admin API never came up") }
+    }
+}
+
+func (p *pathlab) call(method, path, token, body string, want int) []byte {
+    req, _ := http.NewRequest(method, "http://"+p.admin+path, strings.NewReader(body))
+    req.Header.Set("Authorization", "Bearer "+token)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { p.t.Fatalf("%s %s: %v", method, path, err) }
+    defer resp.Body.Close()
+    b, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != want { p.t.Fatalf("%s %s: %d %s, want %d", method, path, resp.StatusCode, b, want) }
+    return b
+}
+
+func (p *pathlab) receipts() []receipts.Receipt {
+    var out struct{ Receipts []receipts.Receipt }
+    if err := json.Unmarshal(p.call("GET", "/receipts", p.viewTok, "", 200), &out); err != nil { p.t.Fatalf("receipts: %v", err) }
+    return out.Receipts
+}
+
+// connect makes one TLS request through the proxy and waits for its receipt.
+func (p *pathlab) connect() {
+    before := len(p.receipts())
+    c, err := tls.Dial("tcp", p.listen, &tls.Config{ServerName: "int.test", InsecureSkipVerify: true})
+    if err != nil { p.t.Fatalf("dial through proxy: %v", err) }
+    fmt.Fprintf(c, "GET / HTTP/1.0\r\nHost: int.test\r\n\r\n")
+    if b, _ := io.ReadAll(c); !bytes.Contains(b, []byte("upstream ok")) { p.t.Fatalf("response %q", b) }
+    c.Close()
+    for deadline := time.Now().Add(5 * time.Second); len(p.receipts()) == before; time.Sleep(20 * time.Millisecond) {
+        if time.Now().After(deadline) { p.t.Fatalf("no connection receipt") }
+    }
+}
+
+func TestAdminCallsLeaveAVerifiableChainWithConnections(t *testing.T) {
+    upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "upstream ok") }))
+    defer upstream.Close()
+    p := startPathlab(t, upstream.Listener.Addr().String())
+
+    p.call("POST", "/impair/apply?profile=LATENCY_50MS_JITTER_10&latency_ms=1", p.adminTok, "", 200)
+    p.connect()
+    p.call("POST", "/rules", p.adminTok, "when sni_contains int.test then CLEAN", 200)
+    p.connect()
+    p.call("PUT", "/impair/presets/slow?profile=LATENCY_50MS_JITTER_10&latency_ms=5", p.adminTok, "", 200)
+    p.call("POST", "/impair/apply", p.viewTok, "", 403) // refused: no receipt
+    p.call("POST", "/receipts/rotate_key", p.adminTok, "", 200)
+    p.connect()
+    p.call("DELETE", "/impair/presets/slow", p.adminTok, "", 204)
+    p.call("POST", "/impair/clear", p.adminTok, "", 200)
+
+    rs := p.receipts()
+    var got []string
+    for _, r := range rs {
+        if r.Kind == receipts.KindConnection { got = append(got, "conn") } else { got = append(got, r.Action) }
+    }
+    want := "impair_apply conn rules_load conn preset_put key_rotate conn preset_delete impair_clear"
+    if strings.Join(got, " ") != want { t.Fatalf("receipts %v\nwant      %s", got, want) }
+
+    var prev receipts.Receipt
+    for _, r := range rs {
+        if r.Kind != receipts.KindConfigChange { continue }
+        if r.ActorRole != adminauth.RoleAdmin || r.ActorTokenID != adminauth.TokenID(p.adminTok) || !strings.HasPrefix(r.Actor, "127.0.0.1:") {
+            t.Errorf("%s: actor %q role %q token %q", r.Action, r.Actor, r.ActorRole, r.ActorTokenID)
+        }
+        if prev.StateDigest != "" && r.PrevDigest != prev.StateDigest { t.Errorf("%s: prev_digest %s, previous change left %s", r.Action, r.PrevDigest, prev.StateDigest) }
+        prev = r
+    }
+
+    var chain receipts.ChainReport
+    json.Unmarshal(p.call("GET", "/receipts/chain/verify", p.viewTok, "", 200), &chain)
+    if !chain.OK || chain.Checked != len(rs) || chain.From != rs[0].ID || chain.To != rs[len(rs)-1].ID { t.Fatalf("chain %+v over %d receipts", chain, len(rs)) }
+}
+
+func TestConnectionTraceOfARuleMatchedAbort(t *testing.T) {
+    upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    upstream.Config.ErrorLog = log.New(io.Discard, "", 0) // the aborted handshake
+    upstream.StartTLS()
+    defer upstream.Close()
+    p := startPathlab(t, upstream.Listener.Addr().String())
+    p.call("POST", "/rules", p.adminTok, "when sni_contains abort.test then ABORT_AFTER_CH", 200)
+
+    before := len(p.receipts())
+    if c, err := tls.Dial("tcp", p.listen, &tls.Config{ServerName: "abort.test", InsecureSkipVerify: true}); err == nil {
+        c.Close()
+        t.Fatalf("handshake completed under ABORT_AFTER_CH")
+    }
+    rs := p.receipts()
+    for deadline := time.Now().Add(5 * time.Second); len(rs) == before; time.Sleep(20 * time.Millisecond) {
+        if time.Now().After(deadline) { t.Fatalf("no connection receipt") }
+        rs = p.receipts()
+    }
+    r := rs[len(rs)-1]
+    if r.Kind != receipts.KindConnection || r.AppliedProfile != string(impair.ProfileAbortAfterCH) { t.Fatalf("receipt %+v", r) }
+
+    var got struct{ Events []trace.Event }
+    if err := json.Unmarshal(p.call("GET", fmt.Sprintf("/connections/%d/trace", r.ConnID), p.viewTok, "", 200), &got); err != nil { t.Fatalf("trace: %v", err) }
+    events := got.Events
+    want := []string{trace.Accepted, trace.CHParsed, trace.RuleMatched, trace.UpstreamDialed, trace.ImpairmentApplied, trace.Closed}
+    if len(events) != len(want) { t.Fatalf("got %d events %+v, want %v", len(events), events, want) }
+    for i, e := range events {
+        if e.Name != want[i] { t.Fatalf("event %d = %s, want %s (all: %+v)", i, e.Name, want[i], events) }
+        if i > 0 && e.OffsetMs < events[i-1].OffsetMs { t.Fatalf("%s at %.3fms before %s at %.3fms", e.Name, e.OffsetMs, events[i-1].Name, events[i-1].OffsetMs) }
+    }
+    if d := events[2].Detail; !strings.Contains(d, "abort.test") { t.Fatalf("rule_matched detail = %q", d) }
+    if d := events[4].Detail; d != string(impair.ProfileAbortAfterCH) { t.Fatalf("impairment_applied detail = %q", d) }
+}
+
+func TestFirstContactFollowsTheRulesConfig(t *testing.T) {
+    upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "upstream ok") }))
+    defer upstream.Close()
+    p := startPathlab(t, upstream.Listener.Addr().String())
+    last := func() receipts.Receipt { rs := p.receipts(); return rs[len(rs)-1] }
+    latency := string(impair.ProfileLatencyJitter)
+
+    // the global FIRST_CONTACT does not carry over to a preset without it
+    p.call("POST", "/impair/apply?profile=LATENCY_50MS_JITTER_10&latency_ms=1&first_contact_key=ip", p.adminTok, "", 200)
+    p.call("PUT", "/impair/presets/slow?profile=LATENCY_50MS_JITTER_10&latency_ms=1", p.adminTok, "", 200)
+    p.call("POST", "/rules", p.adminTok, "when sni_contains int.test then preset:slow", 200)
+    for i := 0; i < 2; i++ {
+        p.connect()
+        if r := last(); r.AppliedProfile != latency || r.FirstContact { t.Fatalf("preset without first_contact_key, conn %d: %s first_contact=%v", i, r.AppliedProfile, r.FirstContact) }
+    }
+
+    // a CLEAN connection does not use up the key a later rule's FIRST_CONTACT keys on
+    p.call("PUT", "/impair/presets/clean?profile=CLEAN&first_contact_key=ja3", p.adminTok, "", 200)
+    p.call("POST", "/rules", p.adminTok, "when sni_contains int.test then preset:clean", 200)
+    p.connect()
+    if r := last(); r.AppliedProfile != string(impair.ProfileClean) || r.FirstContact { t.Fatalf("CLEAN preset: %s first_contact=%v", r.AppliedProfile, r.FirstContact) }
+
+    // the rule's inline first_contact_key impairs only the key's first connection
+    p.call("POST", "/rules", p.adminTok, "when sni_contains int.test then LATENCY_50MS_JITTER_10 latency_ms=1 first_contact_key=ja3", 200)
+    p.connect()
+    if r := last(); r.AppliedProfile != latency || !r.FirstContact { t.Fatalf("first connection: %s first_contact=%v", r.AppliedProfile, r.FirstContact) }
+    p.connect()
+    if r := last(); r.AppliedProfile != string(impair.ProfileClean) || r.FirstContact { t.Fatalf("second connection: %s first_contact=%v", r.AppliedProfile, r.FirstContact) }
+}
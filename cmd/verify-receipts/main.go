@@ -0,0 +1,69 @@
+package main
+
+// verify-receipts checks an exported receipt file offline: each receipt's hash and Ed25519
+// signature against the proxy's public key (the one its key_id names, when the key was
+// rotated: pass every key, comma-separated), and the prev_hash link between consecutive
+// receipts. It exits 1 if any receipt fails and 2 on bad usage or an unreadable file.
+// The checks live in internal/receipts; this is a thin CLI over them.
+//
+// Usage:
+//   curl -s "http://localhost:8080/receipts/export?format=jsonl" > receipts.jsonl
+//   go run ./cmd/verify-receipts -pubkey <hex from /receipts/pubkey> receipts.jsonl
+//   ... | go run ./cmd/verify-receipts -pubkey <hex> -
+
+import (
+    "crypto/ed25519"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+
+    "pathlab/internal/receipts"
+)
+
+func main() {
+    pubHex := flag.String("pubkey", "", "Ed25519 public keys, hex, comma-separated (GET /receipts/pubkey)")
+    flag.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: verify-receipts -pubkey <hex> <receipts.jsonl | ->")
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    var pubs []ed25519.PublicKey
+    for _, h := range strings.Split(*pubHex, ",") {
+        pub, err := hex.DecodeString(strings.TrimSpace(h))
+        if err != nil || len(pub) != ed25519.PublicKeySize {
+            fmt.Fprintf(os.Stderr, "-pubkey must be %d-byte hex Ed25519 public keys, got %q\n", ed25519.PublicKeySize, h)
+            os.Exit(2)
+        }
+        pubs = append(pubs, pub)
+    }
+    if flag.NArg() != 1 {
+        flag.Usage()
+        os.Exit(2)
+    }
+
+    var in io.Reader = os.Stdin
+    if name := flag.Arg(0); name != "-" {
+        f, err := os.Open(name)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(2)
+        }
+        defer f.Close()
+        in = f
+    }
+    rep, err := receipts.VerifyStream(in, pubs...)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    for _, f := range rep.Failures {
+        fmt.Printf("FAIL: %s\n", f)
+    }
+    fmt.Printf("%d receipts, %d failed\n", rep.Records, rep.Failed)
+    if rep.Failed > 0 {
+        os.Exit(1)
+    }
+}
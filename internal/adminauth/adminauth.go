@@ -0,0 +1,147 @@
+// Package adminauth guards the admin API with bearer tokens: an admin token for
+// requests that change state, and optionally a separate read-only token for the rest.
+// Tokens are compared in constant time; failures are answered with a JSON error body,
+// 401 for a missing or unknown token and 403 for a read-only token on a change.
+package adminauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Class is what a request may do, and so which token it needs.
+type Class int
+
+const (
+	Read   Class = iota // admin or read-only token; none when no read-only token is set
+	Write               // admin token
+	Public              // no token (health checks)
+)
+
+// ClassifyMethod treats GET, HEAD and OPTIONS as Read and every other method as Write.
+func ClassifyMethod(r *http.Request) Class {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return Read
+	}
+	return Write
+}
+
+// Roles of the token a request was authenticated with (see Identity).
+const (
+	RoleAdmin    = "admin"
+	RoleReadOnly = "read-only"
+)
+
+type identityKey struct{}
+
+type identity struct{ role, tokenID string }
+
+// Identity returns the role and TokenID of the token r was let through with, or
+// empty strings when it needed none (no guard, Public, or Read without a read-only
+// token).
+func Identity(r *http.Request) (role, tokenID string) {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	return id.role, id.tokenID
+}
+
+// TokenID identifies a token without revealing it: the first 6 bytes of its SHA-256,
+// in hex.
+func TokenID(tok string) string {
+	d := digest(tok)
+	return hex.EncodeToString(d[:6])
+}
+
+// Policy configures Wrap.
+type Policy struct {
+	AdminToken    string           // required; empty disables the guard
+	ReadOnlyToken string           // empty: Read requests need no token
+	Paths         map[string]Class // by URL path, overriding ClassifyMethod: a GET that changes state, a POST that only computes
+}
+
+// Classify returns r's class under p.
+func (p Policy) Classify(r *http.Request) Class {
+	if c, ok := p.Paths[r.URL.Path]; ok {
+		return c
+	}
+	return ClassifyMethod(r)
+}
+
+// Wrap returns next guarded by p. With no AdminToken it returns next unchanged.
+func (p Policy) Wrap(next http.Handler) http.Handler {
+	if p.AdminToken == "" {
+		return next
+	}
+	admin, readOnly := digest(p.AdminToken), digest(p.ReadOnlyToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := p.Classify(r)
+		if class == Public || (class == Read && p.ReadOnlyToken == "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tok, ok := bearer(r)
+		if !ok {
+			deny(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		d := digest(tok)
+		isAdmin := subtle.ConstantTimeCompare(d[:], admin[:]) == 1
+		isReadOnly := p.ReadOnlyToken != "" && subtle.ConstantTimeCompare(d[:], readOnly[:]) == 1
+		switch {
+		case isAdmin, class == Read && isReadOnly:
+			role := RoleAdmin
+			if !isAdmin {
+				role = RoleReadOnly
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity{role, TokenID(tok)})))
+		case isReadOnly:
+			deny(w, http.StatusForbidden, "read-only token cannot change state")
+		default:
+			deny(w, http.StatusUnauthorized, "invalid bearer token")
+		}
+	})
+}
+
+// digest hashes a token so comparisons take the same time whatever its length.
+func digest(tok string) [sha256.Size]byte { return sha256.Sum256([]byte(tok)) }
+
+// bearer returns the token of an "Authorization: Bearer <token>" header.
+func bearer(r *http.Request) (string, bool) {
+	scheme, tok, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(tok) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(tok), true
+}
+
+func deny(w http.ResponseWriter, status int, msg string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pathlab"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// Transport returns a RoundTripper that sends token as a bearer token on every
+// request, for calls to another instance's admin API (replication); base nil means
+// http.DefaultTransport.
+func Transport(token string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripper(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+token)
+		return base.RoundTrip(r)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
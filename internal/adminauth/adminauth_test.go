@@ -0,0 +1,119 @@
+package adminauth
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func newGuard(readOnly string) http.Handler {
+    ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+    return Policy{
+        AdminToken:    "admin-secret",
+        ReadOnlyToken: readOnly,
+        Paths:         map[string]Class{"/healthz": Public, "/impair/clear": Write, "/rules/lint": Read},
+    }.Wrap(ok)
+}
+
+func do(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, nil)
+    if token != "" { req.Header.Set("Authorization", "Bearer "+token) }
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, req)
+    return rec
+}
+
+func TestEndpointClasses(t *testing.T) {
+    h := newGuard("viewer")
+    cases := []struct {
+        method, path, token string
+        want                int
+    }{
+        // mutating: admin token only
+        {"POST", "/impair/apply", "", 401},
+        {"POST", "/impair/apply", "wrong", 401},
+        {"POST", "/impair/apply", "viewer", 403},
+        {"POST", "/impair/apply", "admin-secret", 200},
+        {"GET", "/impair/clear", "", 401},
+        {"GET", "/impair/clear", "viewer", 403},
+        {"GET", "/impair/clear", "admin-secret", 200},
+        {"POST", "/rules", "viewer", 403},
+        {"DELETE", "/rules", "wrong", 401},
+        {"DELETE", "/rules", "admin-secret", 200},
+        // read-only: either token
+        {"GET", "/impair/status", "", 401},
+        {"GET", "/impair/status", "wrong", 401},
+        {"GET", "/impair/status", "viewer", 200},
+        {"GET", "/impair/status", "admin-secret", 200},
+        {"POST", "/rules/lint", "viewer", 200},
+        // public
+        {"GET", "/healthz", "", 200},
+    }
+    for _, c := range cases {
+        rec := do(h, c.method, c.path, c.token)
+        if rec.Code != c.want { t.Errorf("%s %s token %q: %d, want %d", c.method, c.path, c.token, rec.Code, c.want) }
+        if rec.Code == 200 { continue }
+        var body map[string]string
+        if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] == "" { t.Errorf("%s %s: error body %q", c.method, c.path, rec.Body) }
+        if rec.Code == 401 && rec.Header().Get("WWW-Authenticate") == "" { t.Errorf("%s %s: no WWW-Authenticate", c.method, c.path) }
+    }
+}
+
+func TestReadsOpenWithoutReadOnlyToken(t *testing.T) {
+    h := newGuard("")
+    if rec := do(h, "GET", "/impair/status", ""); rec.Code != 200 { t.Fatalf("read without token: %d", rec.Code) }
+    if rec := do(h, "POST", "/impair/apply", ""); rec.Code != 401 { t.Fatalf("write without token: %d", rec.Code) }
+    if rec := do(h, "POST", "/impair/apply", "admin-secret"); rec.Code != 200 { t.Fatalf("write with token: %d", rec.Code) }
+}
+
+func TestBearerParsing(t *testing.T) {
+    h := newGuard("")
+    for _, hdr := range []string{"admin-secret", "Basic admin-secret", "Bearer", "Bearer "} {
+        req := httptest.NewRequest("POST", "/rules", nil)
+        req.Header.Set("Authorization", hdr)
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        if rec.Code != 401 { t.Errorf("Authorization %q: %d", hdr, rec.Code) }
+    }
+    req := httptest.NewRequest("POST", "/rules", nil)
+    req.Header.Set("Authorization", "bearer admin-secret")
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, req)
+    if rec.Code != 200 { t.Errorf("lower-case scheme: %d", rec.Code) }
+}
+
+func TestNoAdminTokenDisablesGuard(t *testing.T) {
+    next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+    if h := (Policy{ReadOnlyToken: "x"}).Wrap(next); h == nil { t.Fatal("nil handler") }
+    rec := do(Policy{}.Wrap(next), "POST", "/impair/apply", "")
+    if rec.Code != 200 { t.Fatalf("unguarded: %d", rec.Code) }
+}
+
+func TestTransportSendsToken(t *testing.T) {
+    srv := httptest.NewServer(newGuard(""))
+    defer srv.Close()
+    client := &http.Client{Transport: Transport("admin-secret", nil)}
+    resp, err := client.Post(srv.URL+"/config/import", "application/json", nil)
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    if resp.StatusCode != 200 { t.Fatalf("with transport: %d", resp.StatusCode) }
+}
+
+func TestIdentityOfAuthenticatedRequests(t *testing.T) {
+    h := Policy{AdminToken: "admin-secret", ReadOnlyToken: "viewer"}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        role, id := Identity(r)
+        w.Write([]byte(role + " " + id))
+    }))
+    for _, c := range []struct{ method, token, want string }{
+        {"POST", "admin-secret", "admin " + TokenID("admin-secret")},
+        {"GET", "admin-secret", "admin " + TokenID("admin-secret")},
+        {"GET", "viewer", "read-only " + TokenID("viewer")},
+    } {
+        if got := do(h, c.method, "/impair/apply", c.token).Body.String(); got != c.want { t.Errorf("%s with %s: %q, want %q", c.method, c.token, got, c.want) }
+    }
+    if id := TokenID("admin-secret"); len(id) != 12 || id == TokenID("viewer") { t.Fatalf("token id %q", id) }
+    // No guard: nobody authenticated.
+    open := Policy{}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { role, id := Identity(r); w.Write([]byte(role + id)) }))
+    if got := do(open, "POST", "/impair/apply", "").Body.String(); got != "" { t.Fatalf("open API identity %q", got) }
+}
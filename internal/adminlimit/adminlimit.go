@@ -0,0 +1,220 @@
+// Package adminlimit caps what a client can ask of the admin API: a token bucket per
+// client IP on requests that change state, and a size limit on request bodies by
+// route. Requests over a limit are answered with a JSON error body, 429 (with
+// Retry-After) for the rate and 413 for the size.
+package adminlimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pathlab/internal/adminauth"
+)
+
+// Defaults for the admin API flags.
+const (
+	DefaultRate    = 10      // state-changing requests per second per client IP (-admin-rate)
+	DefaultBurst   = 20      // (-admin-burst)
+	DefaultMaxBody = 1 << 20 // bytes (-admin-max-body)
+)
+
+// DefaultBodies are the routes whose bodies get a smaller cap than DefaultMaxBody.
+var DefaultBodies = map[string]int64{
+	"/quic/parse_initial": 64 << 10, // one hex-encoded datagram
+}
+
+// maxBuckets is how many client buckets a Limiter holds before dropping the full ones.
+const maxBuckets = 1024
+
+// Limits configures a Limiter.
+type Limits struct {
+	Rate     float64                             // state-changing requests per second per client IP; 0 = unlimited
+	Burst    int                                 // requests a client may make at once; 0 = Rate rounded up
+	MaxBody  int64                               // request body cap; 0 = unlimited
+	Bodies   map[string]int64                    // by URL path, overriding MaxBody
+	Classify func(*http.Request) adminauth.Class // requests of class Write are rate limited; nil = adminauth.ClassifyMethod
+}
+
+// ParseBody parses a "path=bytes" body limit (-admin-body-limit).
+func ParseBody(spec string) (path string, n int64, err error) {
+	path, size, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return "", 0, fmt.Errorf("body limit %q: want /path=bytes", spec)
+	}
+	if n, err = strconv.ParseInt(size, 10, 64); err != nil || n < 0 {
+		return "", 0, fmt.Errorf("body limit %q: bytes must be a number >= 0", spec)
+	}
+	return path, n, nil
+}
+
+// Status is what GET /admin/limits reports.
+type Status struct {
+	RatePerSec   float64          `json:"rate_per_sec"` // 0 = unlimited
+	Burst        int              `json:"burst"`
+	MaxBodyBytes int64            `json:"max_body_bytes"` // 0 = unlimited
+	BodyLimits   map[string]int64 `json:"body_limits,omitempty"`
+	Clients      int              `json:"clients"`      // client IPs with a bucket
+	RateLimited  int64            `json:"rate_limited"` // requests answered 429
+	TooLarge     int64            `json:"too_large"`    // requests answered 413
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// Limiter enforces Limits.
+type Limiter struct {
+	lim Limits
+	now func() time.Time
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	rateLimited int64
+	tooLarge    int64
+}
+
+// New returns a Limiter enforcing l.
+func New(l Limits) *Limiter {
+	if l.Burst <= 0 {
+		l.Burst = max(1, int(math.Ceil(l.Rate)))
+	}
+	if l.Classify == nil {
+		l.Classify = adminauth.ClassifyMethod
+	}
+	return &Limiter{lim: l, now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// Status returns the limits and how often they were hit.
+func (l *Limiter) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := Status{RatePerSec: l.lim.Rate, MaxBodyBytes: l.lim.MaxBody, Clients: len(l.buckets), RateLimited: l.rateLimited, TooLarge: l.tooLarge}
+	if l.lim.Rate > 0 {
+		st.Burst = l.lim.Burst
+	}
+	if len(l.lim.Bodies) > 0 {
+		st.BodyLimits = make(map[string]int64, len(l.lim.Bodies))
+		for p, n := range l.lim.Bodies {
+			st.BodyLimits[p] = n
+		}
+	}
+	return st
+}
+
+// allow takes a token from ip's bucket, or returns how long until one is there.
+func (l *Limiter) allow(ip string) (bool, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := float64(l.lim.Burst)
+	b, ok := l.buckets[ip]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.dropFull(now)
+		}
+		b = &bucket{tokens: burst, at: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.at).Seconds()*l.lim.Rate)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	l.rateLimited++
+	return false, time.Duration((1 - b.tokens) / l.lim.Rate * float64(time.Second))
+}
+
+// dropFull forgets the clients whose buckets have refilled; they start full anyway.
+func (l *Limiter) dropFull(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*l.lim.Rate >= float64(l.lim.Burst) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// bodyLimit returns the cap on r's body, 0 for none.
+func (l *Limiter) bodyLimit(r *http.Request) int64 {
+	if n, ok := l.lim.Bodies[r.URL.Path]; ok {
+		return n
+	}
+	return l.lim.MaxBody
+}
+
+// Wrap returns next behind the limits.
+func (l *Limiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.lim.Rate > 0 && l.lim.Classify(r) == adminauth.Write {
+			if ok, wait := l.allow(clientIP(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				deny(w, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+		}
+		if n := l.bodyLimit(r); n > 0 && r.Body != nil && r.Body != http.NoBody {
+			if !l.limitBody(w, r, n) {
+				l.mu.Lock()
+				l.tooLarge++
+				l.mu.Unlock()
+				deny(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body over %d bytes", n))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody caps r's body at n bytes and reports false when it is longer. A body of
+// unknown length is read ahead, so the handler never sees one cut short.
+func (l *Limiter) limitBody(w http.ResponseWriter, r *http.Request, n int64) bool {
+	if r.ContentLength > n {
+		return false
+	}
+	if r.ContentLength >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		return true
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, n))
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		return false
+	}
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), errReader{err}))
+	return true
+}
+
+// errReader returns err, or io.EOF for nil, after the bytes read ahead.
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	return 0, io.EOF
+}
+
+// clientIP is the address of r's client without the port.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func deny(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
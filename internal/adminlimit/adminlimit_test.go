@@ -0,0 +1,70 @@
+package adminlimit
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func echoLen() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        b, err := io.ReadAll(r.Body)
+        if err != nil { http.Error(w, err.Error(), 400); return }
+        w.Write([]byte(strings.Repeat("x", len(b))))
+    })
+}
+
+func send(h http.Handler, method, path, ip string, body io.Reader) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, body)
+    req.RemoteAddr = ip + ":40000"
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, req)
+    return rec
+}
+
+func TestRateLimitPerClientOnChanges(t *testing.T) {
+    l := New(Limits{Rate: 1, Burst: 2})
+    now := time.Unix(1000, 0)
+    l.now = func() time.Time { return now }
+    h := l.Wrap(echoLen())
+    for i := 0; i < 2; i++ {
+        if rec := send(h, "POST", "/impair/apply", "10.0.0.1", nil); rec.Code != 200 { t.Fatalf("request %d within the burst: %d", i, rec.Code) }
+    }
+    rec := send(h, "POST", "/impair/apply", "10.0.0.1", nil)
+    var body map[string]string
+    if rec.Code != 429 || rec.Header().Get("Retry-After") != "1" || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body["error"] == "" { t.Fatalf("over the rate: %d %q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body) }
+    if rec := send(h, "GET", "/impair/status", "10.0.0.1", nil); rec.Code != 200 { t.Fatalf("read was rate limited: %d", rec.Code) }
+    if rec := send(h, "POST", "/impair/apply", "10.0.0.2", nil); rec.Code != 200 { t.Fatalf("other client limited: %d", rec.Code) }
+    now = now.Add(time.Second)
+    if rec := send(h, "POST", "/impair/apply", "10.0.0.1", nil); rec.Code != 200 { t.Fatalf("after refill: %d", rec.Code) }
+    if st := l.Status(); st.RateLimited != 1 || st.Clients != 2 || st.Burst != 2 { t.Fatalf("status %+v", st) }
+}
+
+func TestBodyLimits(t *testing.T) {
+    l := New(Limits{MaxBody: 100, Bodies: map[string]int64{"/quic/parse_initial": 10}})
+    h := l.Wrap(echoLen())
+    if rec := send(h, "POST", "/rules", "10.0.0.1", strings.NewReader(strings.Repeat("a", 100))); rec.Code != 200 || rec.Body.Len() != 100 { t.Fatalf("body at the cap: %d", rec.Code) }
+    if rec := send(h, "POST", "/rules", "10.0.0.1", strings.NewReader(strings.Repeat("a", 101))); rec.Code != 413 || !strings.Contains(rec.Body.String(), `"error"`) { t.Fatalf("body over the cap: %d %s", rec.Code, rec.Body) }
+    if rec := send(h, "POST", "/quic/parse_initial", "10.0.0.1", strings.NewReader(strings.Repeat("a", 11))); rec.Code != 413 { t.Fatalf("route cap not applied: %d", rec.Code) }
+
+    // A body of unknown length is read ahead.
+    chunked := func(n int) io.Reader { return io.MultiReader(strings.NewReader(strings.Repeat("a", n))) }
+    req := httptest.NewRequest("POST", "/rules", chunked(150)); req.ContentLength = -1
+    rec := httptest.NewRecorder(); h.ServeHTTP(rec, req)
+    if rec.Code != 413 { t.Fatalf("unknown-length body over the cap: %d", rec.Code) }
+    req = httptest.NewRequest("POST", "/rules", chunked(50)); req.ContentLength = -1
+    rec = httptest.NewRecorder(); h.ServeHTTP(rec, req)
+    if rec.Code != 200 || rec.Body.Len() != 50 { t.Fatalf("unknown-length body under the cap: %d len %d", rec.Code, rec.Body.Len()) }
+    if st := l.Status(); st.TooLarge != 3 || st.BodyLimits["/quic/parse_initial"] != 10 || st.RateLimited != 0 { t.Fatalf("status %+v", st) }
+}
+
+func TestParseBody(t *testing.T) {
+    if p, n, err := ParseBody("/rules=2048"); err != nil || p != "/rules" || n != 2048 { t.Fatalf("got %q %d %v", p, n, err) }
+    for _, bad := range []string{"rules=1", "/rules", "/rules=-1", "/rules=1k"} {
+        if _, _, err := ParseBody(bad); err == nil { t.Errorf("ParseBody(%q) accepted", bad) }
+    }
+}
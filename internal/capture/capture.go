@@ -0,0 +1,217 @@
+// Package capture stores connection captures on disk under a global budget. The
+// Manager caps the number of files and their total size, deleting the least recently
+// written captures to make room and refusing a capture that cannot fit, so a long
+// soak cannot fill the disk.
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrOverBudget is returned by Save when a capture cannot fit within the limits.
+var ErrOverBudget = errors.New("capture budget exhausted")
+
+// tmpSuffix marks a capture still being written; such files are ignored on startup.
+const tmpSuffix = ".tmp"
+
+// Limits bound what the Manager keeps on disk; zero means unlimited.
+type Limits struct {
+	MaxTotalBytes int64
+	MaxFiles      int
+}
+
+// Stats is the GET /captures/stats view.
+type Stats struct {
+	Dir           string `json:"dir"`
+	Files         int    `json:"files"`
+	TotalBytes    int64  `json:"total_bytes"`
+	MaxFiles      int    `json:"max_files,omitempty"`
+	MaxTotalBytes int64  `json:"max_total_bytes,omitempty"`
+	Pending       int    `json:"pending"`       // captures being written (not evictable)
+	Saved         int64  `json:"saved"`         // captures written since start
+	Evicted       int64  `json:"evicted"`       // files deleted to make room
+	EvictedBytes  int64  `json:"evicted_bytes"` // bytes those files held
+	Refused       int64  `json:"refused"`       // captures dropped because they could not fit
+}
+
+type entry struct {
+	name    string
+	size    int64
+	seq     uint64 // write order; lowest is evicted first
+	pending bool
+}
+
+// Manager owns a capture directory. Safe for concurrent use.
+type Manager struct {
+	dir    string
+	limits Limits
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	total   int64
+	seq     uint64
+	stats   Stats
+}
+
+// New returns a Manager for dir, creating it if needed. Captures already in dir count
+// against the limits (oldest first by modification time) and are evicted if over.
+func New(dir string, limits Limits) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		name string
+		size int64
+		mod  time.Time
+	}
+	var existing []found
+	for _, de := range des {
+		if !de.Type().IsRegular() || strings.HasSuffix(de.Name(), tmpSuffix) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		existing = append(existing, found{de.Name(), fi.Size(), fi.ModTime()})
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].mod.Before(existing[j].mod) })
+	m := &Manager{dir: dir, limits: limits, entries: map[string]*entry{}}
+	for _, f := range existing {
+		m.seq++
+		m.entries[f.name] = &entry{name: f.name, size: f.size, seq: m.seq}
+		m.total += f.size
+	}
+	m.mu.Lock()
+	m.makeRoomLocked(0, 0)
+	m.mu.Unlock()
+	return m, nil
+}
+
+// Dir returns the capture directory.
+func (m *Manager) Dir() string { return m.dir }
+
+// Save writes data as capture name, evicting the oldest finished captures as needed.
+// A capture that cannot fit (larger than the byte budget, or every other capture is
+// still being written) is refused with ErrOverBudget. Saving an existing name
+// replaces it.
+func (m *Manager) Save(name string, data []byte) error {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." || strings.HasSuffix(name, tmpSuffix) {
+		return fmt.Errorf("invalid capture name %q", name)
+	}
+	size := int64(len(data))
+	m.mu.Lock()
+	if old, ok := m.entries[name]; ok {
+		if old.pending {
+			m.mu.Unlock()
+			return fmt.Errorf("capture %q is being written", name)
+		}
+		m.total -= old.size
+		delete(m.entries, name)
+	}
+	if !m.makeRoomLocked(1, size) {
+		m.stats.Refused++
+		m.mu.Unlock()
+		return ErrOverBudget
+	}
+	m.seq++
+	e := &entry{name: name, size: size, seq: m.seq, pending: true}
+	m.entries[name] = e
+	m.total += size
+	m.mu.Unlock()
+
+	// Write outside the lock; the reservation keeps the budget honest meanwhile.
+	path := filepath.Join(m.dir, name)
+	err := os.WriteFile(path+tmpSuffix, data, 0o644)
+	if err == nil {
+		err = os.Rename(path+tmpSuffix, path)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		_ = os.Remove(path + tmpSuffix)
+		delete(m.entries, name)
+		m.total -= size
+		return err
+	}
+	e.pending = false
+	m.stats.Saved++
+	return nil
+}
+
+// makeRoomLocked evicts finished captures, oldest first, until files more captures
+// totalling size bytes fit, and reports false if they cannot.
+func (m *Manager) makeRoomLocked(files int, size int64) bool {
+	if m.limits.MaxTotalBytes > 0 && size > m.limits.MaxTotalBytes {
+		return false
+	}
+	fits := func() bool {
+		return (m.limits.MaxFiles <= 0 || len(m.entries)+files <= m.limits.MaxFiles) &&
+			(m.limits.MaxTotalBytes <= 0 || m.total+size <= m.limits.MaxTotalBytes)
+	}
+	for !fits() {
+		var oldest *entry
+		for _, e := range m.entries {
+			if !e.pending && (oldest == nil || e.seq < oldest.seq) {
+				oldest = e
+			}
+		}
+		if oldest == nil {
+			return false
+		}
+		if err := os.Remove(filepath.Join(m.dir, oldest.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false
+		}
+		delete(m.entries, oldest.name)
+		m.total -= oldest.size
+		m.stats.Evicted++
+		m.stats.EvictedBytes += oldest.size
+	}
+	return true
+}
+
+// Names returns the captures on disk, oldest first.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	es := make([]*entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		if !e.pending {
+			es = append(es, e)
+		}
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].seq < es[j].seq })
+	out := make([]string, len(es))
+	for i, e := range es {
+		out[i] = e.name
+	}
+	return out
+}
+
+// Stats reports current usage and counters.
+func (m *Manager) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.stats
+	st.Dir, st.MaxFiles, st.MaxTotalBytes = m.dir, m.limits.MaxFiles, m.limits.MaxTotalBytes
+	st.TotalBytes = m.total
+	for _, e := range m.entries {
+		if e.pending {
+			st.Pending++
+		} else {
+			st.Files++
+		}
+	}
+	return st
+}
@@ -0,0 +1,103 @@
+package capture
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+func dirSize(t *testing.T, dir string) (files int, total int64) {
+    des, err := os.ReadDir(dir)
+    if err != nil { t.Fatal(err) }
+    for _, de := range des {
+        fi, _ := de.Info()
+        files++
+        total += fi.Size()
+    }
+    return files, total
+}
+
+func TestEvictsOldestToStayWithinBytes(t *testing.T) {
+    dir := t.TempDir()
+    m, err := New(dir, Limits{MaxTotalBytes: 1000})
+    if err != nil { t.Fatal(err) }
+    for i := 0; i < 25; i++ {
+        if err := m.Save(fmt.Sprintf("c%02d.bin", i), bytes.Repeat([]byte{byte(i)}, 100)); err != nil { t.Fatalf("save %d: %v", i, err) }
+        if st := m.Stats(); st.TotalBytes > 1000 { t.Fatalf("after %d saves total=%d over budget", i+1, st.TotalBytes) }
+    }
+    names := m.Names()
+    if len(names) != 10 || names[0] != "c15.bin" || names[9] != "c24.bin" { t.Fatalf("kept %v, want c15..c24", names) }
+    if files, total := dirSize(t, dir); files != 10 || total != 1000 { t.Fatalf("disk holds %d files / %d bytes", files, total) }
+    st := m.Stats()
+    if st.Saved != 25 || st.Evicted != 15 || st.EvictedBytes != 1500 || st.Refused != 0 { t.Fatalf("stats %+v", st) }
+    // a bigger capture evicts as many of the oldest as it needs
+    if err := m.Save("big.bin", make([]byte, 350)); err != nil { t.Fatal(err) }
+    if names := m.Names(); names[0] != "c19.bin" || names[len(names)-1] != "big.bin" { t.Fatalf("after big save %v", names) }
+}
+
+func TestEvictsOldestToStayWithinFileCount(t *testing.T) {
+    m, _ := New(t.TempDir(), Limits{MaxFiles: 3})
+    for _, n := range []string{"a", "b", "c", "d", "e"} { m.Save(n, []byte(n)) }
+    if got := fmt.Sprint(m.Names()); got != "[c d e]" { t.Fatalf("kept %s", got) }
+    // re-saving a name makes it the newest
+    m.Save("c", []byte("cc"))
+    m.Save("f", []byte("f"))
+    if got := fmt.Sprint(m.Names()); got != "[e c f]" { t.Fatalf("kept %s", got) }
+}
+
+func TestRefusesWhatCannotFit(t *testing.T) {
+    m, _ := New(t.TempDir(), Limits{MaxTotalBytes: 100})
+    m.Save("keep", make([]byte, 60))
+    if err := m.Save("huge", make([]byte, 101)); !errors.Is(err, ErrOverBudget) { t.Fatalf("oversized capture: %v", err) }
+    if got := m.Names(); len(got) != 1 { t.Fatalf("refusal evicted existing captures: %v", got) }
+    // pending captures are not evictable: with one reserved, another cannot make room
+    m.mu.Lock()
+    m.entries["keep"].pending = true
+    m.mu.Unlock()
+    if err := m.Save("next", make([]byte, 50)); !errors.Is(err, ErrOverBudget) { t.Fatalf("evicted a capture being written: %v", err) }
+    if st := m.Stats(); st.Refused != 2 || st.Pending != 1 { t.Fatalf("stats %+v", st) }
+    for _, bad := range []string{"", "../x", "a/b", "x.tmp"} {
+        if err := m.Save(bad, nil); err == nil || errors.Is(err, ErrOverBudget) { t.Errorf("name %q accepted", bad) }
+    }
+}
+
+func TestConcurrentSavesStayBounded(t *testing.T) {
+    dir := t.TempDir()
+    m, _ := New(dir, Limits{MaxTotalBytes: 4096, MaxFiles: 20})
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int){
+            defer wg.Done()
+            for i := 0; i < 50; i++ {
+                m.Save(fmt.Sprintf("g%d-%02d.bin", g, i), make([]byte, 64+i))
+                if st := m.Stats(); st.TotalBytes > 4096 || st.Files+st.Pending > 20 { t.Errorf("over budget: %+v", st) }
+            }
+        }(g)
+    }
+    wg.Wait()
+    st := m.Stats()
+    files, total := dirSize(t, dir)
+    if files != st.Files || total != st.TotalBytes || total > 4096 || files > 20 { t.Fatalf("disk %d files / %d bytes, stats %+v", files, total, st) }
+    if st.Saved+st.Refused != 400 { t.Fatalf("saved %d + refused %d != 400", st.Saved, st.Refused) }
+}
+
+func TestNewAccountsForExistingCaptures(t *testing.T) {
+    dir := t.TempDir()
+    now := time.Now()
+    for i, n := range []string{"old", "mid", "new"} {
+        p := filepath.Join(dir, n)
+        os.WriteFile(p, make([]byte, 100), 0o644)
+        os.Chtimes(p, now, now.Add(time.Duration(i)*time.Minute))
+    }
+    os.WriteFile(filepath.Join(dir, "partial.tmp"), make([]byte, 999), 0o644)
+    m, err := New(dir, Limits{MaxTotalBytes: 250})
+    if err != nil { t.Fatal(err) }
+    if got := fmt.Sprint(m.Names()); got != "[mid new]" { t.Fatalf("after startup %s", got) }
+    if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) { t.Fatalf("oldest capture not deleted") }
+}
@@ -0,0 +1,225 @@
+// Package config reads PathLab's server config file (-config): the addresses, the
+// default impairment, rules, receipts settings and timeouts, in YAML or JSON. Flags
+// given on the command line override the file; the file overrides the flags'
+// defaults and environment variables. Apply makes a reloaded file's runtime settings
+// active and reports the changes that need a restart.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"pathlab/internal/impair"
+	"pathlab/internal/receipts"
+	"pathlab/internal/rules"
+)
+
+// Config is a config file. Fields left out keep the flag defaults.
+type Config struct {
+	Listen   string         `json:"listen,omitempty"`   // -listen
+	Upstream string         `json:"upstream,omitempty"` // -upstream
+	Admin    string         `json:"admin,omitempty"`    // -admin
+	Impair   *impair.Config `json:"impair,omitempty"`   // the impairment active at startup and after a reload that changes it
+	Rules    Rules          `json:"rules"`
+	Receipts Receipts       `json:"receipts"`
+	Timeouts Timeouts       `json:"timeouts"`
+}
+
+// Rules are the rules the file installs: rule text inline or a rules file (rule text,
+// or a JSON rule set when the name ends in .json), read again on every reload.
+type Rules struct {
+	Inline string `json:"inline,omitempty"`
+	File   string `json:"file,omitempty"` // relative to the config file's directory
+}
+
+// Receipts are the receipt settings; all take effect at startup only.
+type Receipts struct {
+	File    string    `json:"file,omitempty"`     // -receipts-file
+	DB      string    `json:"db,omitempty"`       // -receipts-db
+	Fsync   string    `json:"fsync,omitempty"`    // -receipts-fsync
+	Max     int       `json:"max,omitempty"`      // -receipts-max
+	MaxAge  *Duration `json:"max_age,omitempty"`  // -receipts-max-age
+	KeyFile string    `json:"key_file,omitempty"` // -keyfile
+}
+
+// Timeouts are the connection timeouts; all but Queue apply to new connections on
+// reload.
+type Timeouts struct {
+	Read          *Duration `json:"read,omitempty"`           // -read-timeout
+	HandshakePeek *Duration `json:"handshake_peek,omitempty"` // -handshake-peek-timeout
+	Idle          *Duration `json:"idle,omitempty"`           // -idle-timeout
+	Drain         *Duration `json:"drain,omitempty"`          // -drain-timeout
+	Dial          *Duration `json:"dial,omitempty"`           // -dial-timeout
+	Queue         *Duration `json:"queue,omitempty"`          // -queue-timeout
+}
+
+// Duration is a time.Duration written as a Go duration string ("30s", "1m30s") or a
+// number of seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case float64:
+		*d = Duration(x * float64(time.Second))
+	case string:
+		p, err := time.ParseDuration(x)
+		if err != nil {
+			return err
+		}
+		*d = Duration(p)
+	default:
+		return fmt.Errorf("duration must be a string like \"30s\" or a number of seconds, got %s", b)
+	}
+	return nil
+}
+
+// Setting is a config file value that stands for a command-line flag.
+type Setting struct {
+	Key     string // in the file, e.g. timeouts.idle
+	Flag    string // e.g. idle-timeout
+	Value   string // as the flag takes it; "" when the file leaves it out
+	Runtime bool   // a reload applies it to new connections; the others need a restart
+}
+
+// Settings returns every flag-backed setting, in a fixed order, with the file's value.
+func (c *Config) Settings() []Setting {
+	dur := func(d *Duration) string {
+		if d == nil {
+			return ""
+		}
+		return time.Duration(*d).String()
+	}
+	capacity := ""
+	if c.Receipts.Max != 0 {
+		capacity = strconv.Itoa(c.Receipts.Max)
+	}
+	return []Setting{
+		{"listen", "listen", c.Listen, false},
+		{"upstream", "upstream", c.Upstream, false},
+		{"admin", "admin", c.Admin, false},
+		{"receipts.file", "receipts-file", c.Receipts.File, false},
+		{"receipts.db", "receipts-db", c.Receipts.DB, false},
+		{"receipts.fsync", "receipts-fsync", c.Receipts.Fsync, false},
+		{"receipts.max", "receipts-max", capacity, false},
+		{"receipts.max_age", "receipts-max-age", dur(c.Receipts.MaxAge), false},
+		{"receipts.key_file", "keyfile", c.Receipts.KeyFile, false},
+		{"timeouts.read", "read-timeout", dur(c.Timeouts.Read), true},
+		{"timeouts.handshake_peek", "handshake-peek-timeout", dur(c.Timeouts.HandshakePeek), true},
+		{"timeouts.idle", "idle-timeout", dur(c.Timeouts.Idle), true},
+		{"timeouts.drain", "drain-timeout", dur(c.Timeouts.Drain), true},
+		{"timeouts.dial", "dial-timeout", dur(c.Timeouts.Dial), true},
+		{"timeouts.queue", "queue-timeout", dur(c.Timeouts.Queue), false},
+	}
+}
+
+// Load reads and validates the config file at path: JSON when it starts with "{",
+// YAML otherwise (see parseYAML for the subset understood). A relative rules.file is
+// resolved against the file's directory.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Rules.File != "" && !filepath.IsAbs(c.Rules.File) {
+		c.Rules.File = filepath.Join(filepath.Dir(path), c.Rules.File)
+	}
+	return c, nil
+}
+
+// Parse decodes and validates a config file's contents. Unknown fields are errors.
+func Parse(data []byte) (*Config, error) {
+	if t := bytes.TrimSpace(data); len(t) == 0 || t[0] != '{' {
+		v, err := parseYAML(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	var c Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("bad config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate checks the values a flag would reject, the impairment and inline rules,
+// and returns every problem found.
+func (c *Config) Validate() error {
+	var errs []error
+	bad := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	for _, s := range c.Settings()[:3] { // listen, upstream, admin
+		if _, _, err := net.SplitHostPort(s.Value); s.Value != "" && err != nil {
+			bad(s.Key, "%v", err)
+		}
+	}
+	if c.Impair != nil {
+		if err := c.Impair.Validate(); err != nil {
+			bad("impair", "%v", err)
+		}
+	}
+	if c.Rules.Inline != "" && c.Rules.File != "" {
+		bad("rules", "inline and file exclude each other")
+	}
+	if c.Rules.Inline != "" {
+		if _, err := rules.Parse(strings.NewReader(c.Rules.Inline)); err != nil {
+			bad("rules.inline", "%v", err)
+		}
+	}
+	switch c.Receipts.Fsync {
+	case "", receipts.FsyncAlways, receipts.FsyncInterval:
+	default:
+		bad("receipts.fsync", "must be %s or %s, got %q", receipts.FsyncAlways, receipts.FsyncInterval, c.Receipts.Fsync)
+	}
+	for _, s := range c.Settings() {
+		if strings.HasPrefix(s.Value, "-") {
+			bad(s.Key, "must not be negative, got %s", s.Value)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RuleSet returns the rules the file installs, reading rules.file; ok is false when
+// it configures none.
+func (c *Config) RuleSet() (set rules.Set, ok bool, err error) {
+	switch {
+	case c.Rules.Inline != "":
+		set, err = rules.Parse(strings.NewReader(c.Rules.Inline))
+	case c.Rules.File != "":
+		set, err = rules.LoadFile(c.Rules.File)
+	default:
+		return rules.Set{}, false, nil
+	}
+	if err != nil {
+		return rules.Set{}, false, fmt.Errorf("rules: %w", err)
+	}
+	return set, true, nil
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/rules"
+    "pathlab/internal/tlsinspect"
+)
+
+const sample = `
+listen: ":10443"
+upstream: 127.0.0.1:8443
+admin: 127.0.0.1:8080
+impair:
+  profile: MTU1300_BLACKHOLE
+  threshold_bytes: 1200
+rules:
+  inline: |
+    when sni_contains slow.test then LATENCY_50MS_JITTER_10
+    when ch_bytes > 1400 then ABORT_AFTER_CH
+receipts:
+  file: /var/lib/pathlab/receipts.ndjson
+  fsync: always
+  max: 4096
+  max_age: 24h
+timeouts:
+  read: 10s
+  idle: 90  # seconds
+`
+
+func writeFile(t *testing.T, dir, name, body string) string {
+    t.Helper()
+    p := filepath.Join(dir, name)
+    if err := os.WriteFile(p, []byte(body), 0o600); err != nil { t.Fatal(err) }
+    return p
+}
+
+func TestLoadSampleAndApply(t *testing.T) {
+    path := writeFile(t, t.TempDir(), "pathlab.yaml", sample)
+    c, err := Load(path)
+    if err != nil { t.Fatal(err) }
+    if c.Listen != ":10443" || c.Receipts.Max != 4096 || time.Duration(*c.Timeouts.Idle) != 90*time.Second || c.Timeouts.Dial != nil { t.Fatalf("loaded %+v", c) }
+    got := map[string]string{}
+    for _, s := range c.Settings() { if s.Value != "" { got[s.Flag] = s.Value } }
+    want := map[string]string{"listen": ":10443", "upstream": "127.0.0.1:8443", "admin": "127.0.0.1:8080", "receipts-file": "/var/lib/pathlab/receipts.ndjson", "receipts-fsync": "always", "receipts-max": "4096", "receipts-max-age": "24h0m0s", "read-timeout": "10s", "idle-timeout": "1m30s"}
+    if !reflect.DeepEqual(got, want) { t.Fatalf("flag values %v, want %v", got, want) }
+
+    st, store := &impair.State{}, &rules.Store{}
+    var recorded []string
+    rep, err := Apply(nil, c, Targets{Impair: st, Rules: store, Mutate: func(what string, fn func()){ recorded = append(recorded, what); fn() }})
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(rep.Applied, []string{"impair", "rules"}) || rep.Restart != nil || !reflect.DeepEqual(recorded, rep.Applied) { t.Fatalf("report %+v, recorded %v", rep, recorded) }
+    if cfg := st.Get(); cfg.Profile != impair.ProfileMTUBlackhole || cfg.ThresholdBytes != 1200 { t.Fatalf("impairment %+v", cfg) }
+    if p, ok := store.Load().Match(tlsinspect.Result{SNI: "a.slow.test"}); !ok || p != impair.ProfileLatencyJitter { t.Fatalf("rule match %s %v", p, ok) }
+    if src, _ := store.Origin(); src != rules.SourceConfig { t.Fatalf("rules source %q", src) }
+
+    // The same config as JSON.
+    j := writeFile(t, t.TempDir(), "pathlab.json", `{"listen":":10443","upstream":"127.0.0.1:8443","admin":"127.0.0.1:8080",
+        "impair":{"profile":"MTU1300_BLACKHOLE","threshold_bytes":1200},
+        "rules":{"inline":"when sni_contains slow.test then LATENCY_50MS_JITTER_10\nwhen ch_bytes > 1400 then ABORT_AFTER_CH\n"},
+        "receipts":{"file":"/var/lib/pathlab/receipts.ndjson","fsync":"always","max":4096,"max_age":"24h"},
+        "timeouts":{"read":"10s","idle":90}}`)
+    cj, err := Load(j)
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(cj, c) { t.Fatalf("JSON config %+v differs from YAML %+v", cj, c) }
+}
+
+func TestReloadAppliesRuntimeChanges(t *testing.T) {
+    dir := t.TempDir()
+    writeFile(t, dir, "rules.txt", "when sni_contains a.test then ABORT_AFTER_CH\n")
+    path := writeFile(t, dir, "pathlab.yaml", "impair:\n  profile: CLEAN\nrules:\n  file: rules.txt\ntimeouts:\n  idle: 5m\n")
+    prev, err := Load(path)
+    if err != nil { t.Fatal(err) }
+    st, store := &impair.State{}, &rules.Store{}
+    if _, err := Apply(nil, prev, Targets{Impair: st, Rules: store}); err != nil { t.Fatal(err) }
+
+    // Same file again: nothing to do.
+    rep, err := Apply(prev, prev, Targets{Impair: st, Rules: store})
+    if err != nil || rep.Applied != nil || rep.Restart != nil { t.Fatalf("no-op reload: %+v, %v", rep, err) }
+
+    writeFile(t, dir, "rules.txt", "when sni_contains b.test then ABORT_AFTER_CH\n")
+    writeFile(t, dir, "pathlab.yaml", "listen: :9443\nimpair:\n  profile: PACKET_LOSS\n  loss_percent: 20\nrules:\n  file: rules.txt\ntimeouts:\n  read: 3s\n")
+    next, err := Load(path)
+    if err != nil { t.Fatal(err) }
+    var settings []Setting
+    rep, err = Apply(prev, next, Targets{Impair: st, Rules: store, Settings: func(s []Setting){ settings = s }})
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(rep.Applied, []string{"timeouts.read", "timeouts.idle", "impair", "rules"}) || !reflect.DeepEqual(rep.Restart, []string{"listen"}) { t.Fatalf("report %+v", rep) }
+    if len(settings) != 2 || settings[0].Flag != "read-timeout" || settings[0].Value != "3s" || settings[1].Flag != "idle-timeout" || settings[1].Value != "" { t.Fatalf("settings %+v", settings) }
+    if cfg := st.Get(); cfg.Profile != impair.ProfileLoss || cfg.LossPercent != 20 { t.Fatalf("impairment after reload %+v", cfg) }
+    if _, ok := store.Load().Match(tlsinspect.Result{SNI: "b.test"}); !ok { t.Fatal("rules file not read again") }
+
+    // Rules that no longer load leave everything as it was.
+    writeFile(t, dir, "rules.txt", "when nonsense\n")
+    writeFile(t, dir, "pathlab.yaml", "impair:\n  profile: CLEAN\nrules:\n  file: rules.txt\n")
+    bad, err := Load(path)
+    if err != nil { t.Fatal(err) }
+    if _, err := Apply(next, bad, Targets{Impair: st, Rules: store}); err == nil || !strings.Contains(err.Error(), "rules") { t.Fatalf("got %v, want a rules error", err) }
+    if st.Get().Profile != impair.ProfileLoss { t.Fatal("impairment applied despite the rules error") }
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+    _, err := Parse([]byte("listen: nohostport\nimpair:\n  profile: NOPE\nrules:\n  inline: garbage\n  file: x.txt\nreceipts:\n  fsync: sometimes\ntimeouts:\n  drain: -1s\n"))
+    if err == nil { t.Fatal("invalid config accepted") }
+    for _, want := range []string{"listen:", "impair:", "rules: inline and file", "rules.inline:", "receipts.fsync:", "timeouts.drain: must not be negative"} {
+        if !strings.Contains(err.Error(), want) { t.Errorf("error %q does not mention %q", err, want) }
+    }
+    if _, err := Parse([]byte("lisen: :1\n")); err == nil || !strings.Contains(err.Error(), `unknown field "lisen"`) { t.Fatalf("typo accepted: %v", err) }
+    if _, err := Parse([]byte("timeouts:\n  read: soon\n")); err == nil { t.Fatal("bad duration accepted") }
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"reflect"
+
+	"pathlab/internal/impair"
+	"pathlab/internal/rules"
+)
+
+// Targets are what Apply changes while PathLab runs. A nil field is left alone (e.g.
+// Rules when -rules-file overrides the file's rules).
+type Targets struct {
+	Impair   *impair.State
+	Rules    *rules.Store
+	Settings func([]Setting)              // gets the runtime settings that changed; Value "" means back to the flag default
+	Mutate   func(what string, fn func()) // runs each change to Impair ("impair") or Rules ("rules"), e.g. to record it; nil = fn()
+}
+
+// Report says what Apply did.
+type Report struct {
+	Applied []string // keys made active: impair, rules, timeouts.*
+	Restart []string // keys that changed but take effect only after a restart
+}
+
+// Apply makes next's impairment and rules active and hands its changed runtime
+// settings to t.Settings. prev is the config applied before, nil at startup, when
+// the settings are left to flag parsing and only the impairment and rules are
+// applied. The impairment is applied when it changed, the rules when they differ from
+// the active ones (rules.file is read again); a file that leaves either out keeps
+// what is active. Rules that do not load are an error and nothing is applied.
+func Apply(prev, next *Config, t Targets) (Report, error) {
+	var rep Report
+	set, haveRules, err := next.RuleSet()
+	if err != nil {
+		return rep, err
+	}
+	mutate := t.Mutate
+	if mutate == nil {
+		mutate = func(_ string, fn func()) { fn() }
+	}
+	if prev != nil {
+		var changed []Setting
+		old := prev.Settings()
+		for i, s := range next.Settings() {
+			if s.Value == old[i].Value {
+				continue
+			}
+			if !s.Runtime {
+				rep.Restart = append(rep.Restart, s.Key)
+				continue
+			}
+			changed = append(changed, s)
+			rep.Applied = append(rep.Applied, s.Key)
+		}
+		if len(changed) > 0 && t.Settings != nil {
+			t.Settings(changed)
+		}
+	}
+	if next.Impair != nil && t.Impair != nil && (prev == nil || prev.Impair == nil || !reflect.DeepEqual(*prev.Impair, *next.Impair)) {
+		var err error
+		mutate("impair", func() { err = t.Impair.Apply(*next.Impair) })
+		if err != nil {
+			return rep, err
+		}
+		rep.Applied = append(rep.Applied, "impair")
+	}
+	if haveRules && t.Rules != nil && t.Rules.Load().Source() != set.Source() {
+		mutate("rules", func() { t.Rules.ReplaceFrom(set, rules.SourceConfig) })
+		rep.Applied = append(rep.Applied, "rules")
+	}
+	return rep, nil
+}
@@ -0,0 +1,316 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlNumber is a plain scalar read as a number.
+var yamlNumber = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+// yamlParser reads the YAML subset config files are written in.
+type yamlParser struct {
+	lines []string
+	i     int // next line
+}
+
+// parseYAML decodes the YAML subset config files use into the values encoding/json
+// produces (map[string]any, []any, string, float64, bool, nil): block mappings and
+// sequences nested by indentation with spaces, plain and quoted scalars, literal
+// block scalars (| and |-), comments and the empty flow collections [] and {}.
+// Anchors, aliases, tags, folded scalars, other flow collections and more than one
+// document are rejected.
+func parseYAML(src []byte) (any, error) {
+	p := &yamlParser{lines: strings.Split(strings.ReplaceAll(string(src), "\r\n", "\n"), "\n")}
+	p.skip()
+	if p.i < len(p.lines) && strings.TrimSpace(p.lines[p.i]) == "---" {
+		p.i++
+		p.skip()
+	}
+	if p.i == len(p.lines) {
+		return map[string]any{}, nil
+	}
+	ind, err := p.indent()
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.block(ind)
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.i < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("yaml line %d: %s", p.i+1, fmt.Sprintf(format, args...))
+}
+
+// skip moves past blank and comment lines.
+func (p *yamlParser) skip() {
+	for p.i < len(p.lines) {
+		if t := strings.TrimSpace(p.lines[p.i]); t != "" && !strings.HasPrefix(t, "#") {
+			return
+		}
+		p.i++
+	}
+}
+
+// indent returns the current line's indentation, which must be spaces.
+func (p *yamlParser) indent() (int, error) {
+	line := p.lines[p.i]
+	n := len(line) - len(strings.TrimLeft(line, " "))
+	if strings.HasPrefix(line[n:], "\t") {
+		return 0, p.errorf("tabs cannot indent")
+	}
+	return n, nil
+}
+
+// text is the current line without its indentation and comment.
+func (p *yamlParser) text(ind int) string {
+	return stripComment(p.lines[p.i][ind:])
+}
+
+func isItem(text string) bool { return text == "-" || strings.HasPrefix(text, "- ") }
+
+// block reads the mapping or sequence starting on the current line at indentation ind.
+func (p *yamlParser) block(ind int) (any, error) {
+	if isItem(p.text(ind)) {
+		return p.sequence(ind)
+	}
+	return p.mapping(ind)
+}
+
+func (p *yamlParser) mapping(ind int) (any, error) {
+	m := map[string]any{}
+	for p.skip(); p.i < len(p.lines); p.skip() {
+		in, err := p.indent()
+		if err != nil {
+			return nil, err
+		}
+		if in < ind {
+			break
+		}
+		if in > ind {
+			return nil, p.errorf("unexpected indentation")
+		}
+		text := p.text(ind)
+		if isItem(text) {
+			return nil, p.errorf("sequence item where a key was expected")
+		}
+		key, rest, err := p.splitKey(text)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		p.i++
+		if m[key], err = p.value(rest, ind, true); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(ind int) (any, error) {
+	out := []any{}
+	for p.skip(); p.i < len(p.lines); p.skip() {
+		in, err := p.indent()
+		if err != nil {
+			return nil, err
+		}
+		if in < ind {
+			break
+		}
+		if in > ind {
+			return nil, p.errorf("unexpected indentation")
+		}
+		text := p.text(ind)
+		if !isItem(text) {
+			break // the next key of a mapping the sequence is a value in
+		}
+		item := strings.TrimLeft(text[1:], " ")
+		if _, _, err := p.splitKey(item); err == nil && item != "" && item[0] != '"' && item[0] != '\'' {
+			// "- key: value" starts a mapping indented to where its key is.
+			col := ind + len(text) - len(item)
+			p.lines[p.i] = strings.Repeat(" ", col) + p.lines[p.i][col:]
+			v, err := p.mapping(col)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		p.i++
+		v, err := p.value(item, ind, false)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// value reads what follows a key or sequence dash at indentation ind: rest of the
+// line, or the block below it. A sequence may sit at the same indentation as the key
+// it is the value of.
+func (p *yamlParser) value(rest string, ind int, ofKey bool) (any, error) {
+	switch {
+	case rest == "":
+		if p.skip(); p.i == len(p.lines) {
+			return nil, nil
+		}
+		in, err := p.indent()
+		if err != nil {
+			return nil, err
+		}
+		if in > ind || (ofKey && in == ind && isItem(p.text(in))) {
+			return p.block(in)
+		}
+		return nil, nil
+	case rest == "|" || rest == "|-":
+		return p.literal(ind, rest == "|-"), nil
+	case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+		p.i--
+		return nil, p.errorf("only | and |- block scalars are supported")
+	}
+	v, err := scalar(rest)
+	if err != nil {
+		p.i--
+		return nil, p.errorf("%v", err)
+	}
+	return v, nil
+}
+
+// literal reads a literal block scalar's lines, indented more than ind. The text
+// ends in one newline, or none with strip (|-).
+func (p *yamlParser) literal(ind int, strip bool) string {
+	var lines []string
+	blockInd := -1
+	for ; p.i < len(p.lines); p.i++ {
+		line := p.lines[p.i]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " "))
+		if blockInd < 0 {
+			blockInd = n
+		}
+		if n <= ind || n < blockInd {
+			break
+		}
+		lines = append(lines, line[blockInd:])
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		p.i-- // blank lines after the block are not part of it
+	}
+	text := strings.Join(lines, "\n")
+	if !strip && text != "" {
+		text += "\n"
+	}
+	return text
+}
+
+// splitKey splits "key: rest" (the key plain or quoted).
+func (p *yamlParser) splitKey(text string) (key, rest string, err error) {
+	if text != "" && (text[0] == '"' || text[0] == '\'') {
+		end := closingQuote(text)
+		if end < 0 || !strings.HasPrefix(text[end+1:], ":") {
+			return "", "", p.errorf("expected \"key: value\"")
+		}
+		k, err := scalar(text[:end+1])
+		if err != nil {
+			return "", "", p.errorf("%v", err)
+		}
+		return k.(string), strings.TrimSpace(text[end+2:]), nil
+	}
+	i := strings.Index(text, ": ")
+	if i < 0 && strings.HasSuffix(text, ":") {
+		i = len(text) - 1
+	}
+	if i <= 0 {
+		return "", "", p.errorf("expected \"key: value\"")
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), nil
+}
+
+// closingQuote returns the index of the quote ending the quoted scalar s starts with,
+// or -1.
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment cuts a " #" comment that is not inside quotes, and trailing spaces.
+func stripComment(s string) string {
+	var q byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case q == 0 && (c == '"' || c == '\'') && (i == 0 || s[i-1] == ' ' || s[i-1] == '-' || s[i-1] == ':'):
+			q = c
+		case q == '"' && c == '\\':
+			i++
+		case q != 0 && c == q:
+			q = 0
+		case q == 0 && c == '#' && (i == 0 || s[i-1] == ' '):
+			return strings.TrimRight(s[:i], " ")
+		}
+	}
+	return strings.TrimRight(s, " ")
+}
+
+// scalar converts one plain or quoted scalar.
+func scalar(s string) (any, error) {
+	switch {
+	case s[0] == '"':
+		if closingQuote(s) != len(s)-1 {
+			return nil, fmt.Errorf("bad double-quoted string %s", s)
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad double-quoted string %s", s)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if closingQuote(s) != len(s)-1 {
+			return nil, fmt.Errorf("bad single-quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "[]":
+		return []any{}, nil
+	case s == "{}":
+		return map[string]any{}, nil
+	case strings.ContainsAny(s[:1], "[{&*!%@`"):
+		return nil, fmt.Errorf("%q: flow collections, anchors, aliases and tags are not supported", s)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if yamlNumber.MatchString(s) {
+		return strconv.ParseFloat(s, 64)
+	}
+	return s, nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseYAMLSubset(t *testing.T) {
+    src := `
+# comment
+---
+name: plain text   # trailing comment
+quoted: "a: #b\n"
+single: 'it''s'
+n: 1300
+f: -0.5
+on: true
+off: False
+none: ~
+empty:
+addr: 127.0.0.1:8443
+nested:
+  deeper:
+    k: v
+list:
+- one
+- "two"
+items:
+  - id: 1
+    tag: x
+  - id: 2
+flows: []
+block: |
+  line one
+
+  line two
+kept: after
+strip: |-
+  no newline
+`
+    got, err := parseYAML([]byte(src))
+    if err != nil { t.Fatal(err) }
+    want := map[string]any{
+        "name": "plain text", "quoted": "a: #b\n", "single": "it's", "n": 1300.0, "f": -0.5, "on": true, "off": false,
+        "none": nil, "empty": nil, "addr": "127.0.0.1:8443",
+        "nested": map[string]any{"deeper": map[string]any{"k": "v"}},
+        "list": []any{"one", "two"},
+        "items": []any{map[string]any{"id": 1.0, "tag": "x"}, map[string]any{"id": 2.0}},
+        "flows": []any{},
+        "block": "line one\n\nline two\n", "kept": "after", "strip": "no newline",
+    }
+    if !reflect.DeepEqual(got, want) { t.Fatalf("got  %#v\nwant %#v", got, want) }
+}
+
+func TestParseYAMLRejects(t *testing.T) {
+    for _, tc := range []struct{ src, msg string }{
+        {"a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+        {"a: 1\na: 2\n", `line 2: duplicate key "a"`},
+        {"a:\n\tb: 1\n", "line 2: tabs cannot indent"},
+        {"a: [1, 2]\n", "flow collections"},
+        {"a: &x 1\n", "anchors"},
+        {"a: >\n  folded\n", "line 1: only | and |- block scalars"},
+        {"just text\n", "line 1: expected \"key: value\""},
+        {"a: \"open\n", "bad double-quoted"},
+    } {
+        _, err := parseYAML([]byte(tc.src))
+        if err == nil || !strings.Contains(err.Error(), tc.msg) { t.Errorf("%q: got %v, want %q", tc.src, err, tc.msg) }
+    }
+}
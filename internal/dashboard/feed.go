@@ -0,0 +1,198 @@
+// Package dashboard serves the admin API's live feed (GET /ws): one WebSocket
+// carrying every new receipt, each impairment change and periodic connection stats,
+// so a lab UI does not have to poll three endpoints.
+package dashboard
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"pathlab/internal/impair"
+	"pathlab/internal/proxy"
+	"pathlab/internal/receipts"
+	"pathlab/internal/websocket"
+)
+
+// Message types, the "type" field of every message.
+const (
+	TypeReceipt = "receipt"
+	TypeImpair  = "impair"
+	TypeStats   = "stats"
+)
+
+// DefaultStatsInterval is how often a Feed sends stats when Interval is unset.
+const DefaultStatsInterval = 2 * time.Second
+
+// DefaultQueue is how many messages a Feed buffers per client when Queue is unset.
+// A client that falls that far behind is disconnected rather than holding up
+// receipts or impairment changes.
+const DefaultQueue = 256
+
+// writeTimeout bounds each message write.
+const writeTimeout = 10 * time.Second
+
+// Stats is the body of a "stats" message.
+type Stats struct {
+	Timestamp         time.Time      `json:"timestamp"`
+	ActiveConnections int            `json:"active_connections"`
+	ByProfile         map[string]int `json:"by_profile"`  // active connections per profile
+	Subscribers       int            `json:"subscribers"` // clients on the feed
+}
+
+// Feed is the GET /ws handler. Receipts, Impair and Conns may each be nil, which
+// leaves their messages out.
+type Feed struct {
+	Receipts *receipts.Manager
+	Impair   *impair.State
+	Conns    *proxy.ConnRegistry
+	Interval time.Duration // between stats messages; 0 = DefaultStatsInterval
+	Queue    int           // messages buffered per client; 0 = DefaultQueue
+	Logf     func(format string, args ...any)
+
+	mu      sync.Mutex
+	clients int
+}
+
+// message is a feed message: the type plus the fields of the body, flattened.
+func message(typ string, body any) []byte {
+	b, _ := json.Marshal(body)
+	t, _ := json.Marshal(typ)
+	if len(b) < 2 || b[0] != '{' {
+		return nil
+	}
+	out := append([]byte(`{"type":`), t...)
+	if len(b) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, b[1:]...)
+}
+
+// stats counts the live connections.
+func (f *Feed) stats() Stats {
+	st := Stats{Timestamp: time.Now().UTC(), ByProfile: map[string]int{}}
+	if f.Conns != nil {
+		for _, c := range f.Conns.List() {
+			st.ActiveConnections++
+			st.ByProfile[c.Profile]++
+		}
+	}
+	f.mu.Lock()
+	st.Subscribers = f.clients
+	f.mu.Unlock()
+	return st
+}
+
+func (f *Feed) logf(format string, args ...any) {
+	if f.Logf != nil {
+		f.Logf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// ServeHTTP upgrades the request and streams messages until the client goes away or
+// falls behind. The client gets the current impairment and stats first. Messages the
+// client sends are read and ignored.
+func (f *Feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.clients++
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.clients--
+		f.mu.Unlock()
+	}()
+
+	queue := f.Queue
+	if queue <= 0 {
+		queue = DefaultQueue
+	}
+	out := make(chan []byte, queue)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	slow := false
+	// push never blocks the producer: a full queue ends the connection, cutting short
+	// any write stuck on the client.
+	var pmu sync.Mutex
+	push := func(msg []byte) {
+		if msg == nil {
+			return
+		}
+		pmu.Lock()
+		defer pmu.Unlock()
+		select {
+		case <-done:
+		case out <- msg:
+		default:
+			slow = true
+			stop()
+			_ = conn.SetWriteDeadline(time.Now())
+		}
+	}
+
+	if f.Impair != nil {
+		push(message(TypeImpair, f.Impair.Status()))
+		remove := f.Impair.OnChange(func(impair.Config) { push(message(TypeImpair, f.Impair.Status())) })
+		defer remove()
+	}
+	push(message(TypeStats, f.stats()))
+	if f.Receipts != nil {
+		ch, cancel := f.Receipts.Subscribe(queue)
+		defer cancel()
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case rec := <-ch:
+					push(message(TypeReceipt, rec))
+				}
+			}
+		}()
+	}
+	go func() {
+		defer stop()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	interval := f.Interval
+	if interval <= 0 {
+		interval = DefaultStatsInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			pmu.Lock()
+			dropped := slow
+			pmu.Unlock()
+			if dropped {
+				f.logf("[ws] %s fell %d messages behind, disconnected", conn.RemoteAddr(), queue)
+				_ = conn.CloseWith(websocket.ClosePolicy, "too slow")
+			} else {
+				_ = conn.Close()
+			}
+			return
+		case <-tick.C:
+			push(message(TypeStats, f.stats()))
+		case msg := <-out:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(websocket.OpText, msg); err != nil {
+				stop()
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package dashboard
+
+import (
+    "crypto/ed25519"
+    "encoding/json"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/proxy"
+    "pathlab/internal/receipts"
+    "pathlab/internal/websocket"
+)
+
+func newFeed(t *testing.T, f *Feed) string {
+    t.Helper()
+    if f.Logf == nil { f.Logf = t.Logf }
+    srv := httptest.NewServer(f)
+    t.Cleanup(srv.Close)
+    return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// next reads messages until one of type typ arrives.
+func next(t *testing.T, c *websocket.Conn, typ string) map[string]any {
+    t.Helper()
+    c.SetReadDeadline(time.Now().Add(3 * time.Second))
+    for {
+        _, b, err := c.ReadMessage()
+        if err != nil { t.Fatalf("waiting for %s: %v", typ, err) }
+        var m map[string]any
+        if err := json.Unmarshal(b, &m); err != nil { t.Fatalf("bad message %s: %v", b, err) }
+        if m["type"] == typ { return m }
+    }
+}
+
+func TestFeedSendsReceiptsImpairAndStats(t *testing.T) {
+    rc := receipts.NewManager(16, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), receipts.ManagerOptions{})
+    st := &impair.State{}
+    st.Apply(impair.Config{Profile: impair.ProfileClean})
+    conns := proxy.NewConnRegistry()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    conns.Track(1, c2)
+    conns.Describe(1, "", string(impair.ProfileStall))
+    c, err := websocket.Dial(newFeed(t, &Feed{Receipts: rc, Impair: st, Conns: conns, Interval: 50 * time.Millisecond}), nil)
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+
+    if m := next(t, c, TypeImpair); m["profile"] != string(impair.ProfileClean) { t.Fatalf("first impair message %v", m) }
+    m := next(t, c, TypeStats)
+    if m["active_connections"] != 1.0 || m["subscribers"] != 1.0 { t.Fatalf("stats %v", m) }
+    if bp, _ := m["by_profile"].(map[string]any); bp[string(impair.ProfileStall)] != 1.0 { t.Fatalf("by_profile %v", m["by_profile"]) }
+
+    st.Apply(impair.Config{Profile: impair.ProfileMTUBlackhole})
+    if m := next(t, c, TypeImpair); m["profile"] != string(impair.ProfileMTUBlackhole) || m["threshold_bytes"] != 1300.0 { t.Fatalf("impair message %v", m) }
+    added := rc.Add(receipts.Receipt{Kind: receipts.KindConnection, SNI: "feed.test", Outcome: "closed"})
+    if m := next(t, c, TypeReceipt); m["id"] != float64(added.ID) || m["sni"] != "feed.test" || m["hash"] != added.Hash { t.Fatalf("receipt message %v", m) }
+
+    conns.Finish(1)
+    if m := next(t, c, TypeStats); m["active_connections"] != 0.0 { t.Fatalf("stats after the connection ended %v", m) }
+}
+
+func TestFeedDisconnectsSlowClient(t *testing.T) {
+    st := &impair.State{}
+    f := &Feed{Impair: st, Queue: 4, Interval: time.Hour}
+    c, err := websocket.Dial(newFeed(t, f), nil)
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    // The client reads nothing; the producer must not block on it.
+    start := time.Now()
+    for i := 0; i < 50000; i++ { st.Apply(impair.Config{Profile: impair.ProfileClean, Notes: strings.Repeat("n", 200)}) }
+    if d := time.Since(start); d > 5*time.Second { t.Fatalf("applies took %s with a stalled client", d) }
+    deadline := time.Now().Add(3 * time.Second)
+    for f.stats().Subscribers != 0 {
+        if time.Now().After(deadline) { t.Fatal("slow client still subscribed") }
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.SetReadDeadline(time.Now().Add(3 * time.Second))
+    for {
+        if _, _, err := c.ReadMessage(); err != nil { break }
+    }
+}
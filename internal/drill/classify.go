@@ -0,0 +1,79 @@
+package drill
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Attempt classes.
+const (
+	ClassSuccess  = "success"
+	ClassFastFail = "fast_fail"
+	ClassTimeout  = "timeout"
+	ClassOther    = "other"
+)
+
+// fastResetWindow is how quickly a connection reset must arrive to count as a fast fail.
+const fastResetWindow = 500 * time.Millisecond
+
+// Classifier maps the outcome of one attempt to a class.
+type Classifier interface {
+	Classify(err error, dur time.Duration) string
+}
+
+// ClassifierFunc adapts a function to Classifier.
+type ClassifierFunc func(err error, dur time.Duration) string
+
+func (f ClassifierFunc) Classify(err error, dur time.Duration) string { return f(err, dur) }
+
+// StringClassifier matches substrings of the error text. It is the drill's original
+// heuristic and works on any error, including ones flattened to strings; note that a
+// "TLS handshake timeout" counts as a fast fail because "handshake" matches first.
+type StringClassifier struct{}
+
+func (StringClassifier) Classify(err error, dur time.Duration) string {
+	if err == nil {
+		return ClassSuccess
+	}
+	es := err.Error()
+	switch {
+	case strings.Contains(es, "handshake") || strings.Contains(es, "remote error") || strings.Contains(es, "EOF"):
+		return ClassFastFail
+	case strings.Contains(es, "timeout") || strings.Contains(es, "deadline exceeded"):
+		return ClassTimeout
+	case dur < fastResetWindow && strings.Contains(es, "connection reset"):
+		return ClassFastFail
+	}
+	return ClassOther
+}
+
+// ErrorsClassifier inspects the error chain with errors.Is/errors.As. Timeouts are
+// checked first, so a handshake that times out is a timeout, not a fast fail.
+type ErrorsClassifier struct{}
+
+func (ErrorsClassifier) Classify(err error, dur time.Duration) string {
+	if err == nil {
+		return ClassSuccess
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &ne) && ne.Timeout()) {
+		return ClassTimeout
+	}
+	var oe *net.OpError
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ClassFastFail
+	case errors.As(err, &oe) && oe.Op == "remote error": // TLS alert from the peer
+		return ClassFastFail
+	case errors.Is(err, syscall.ECONNRESET) && dur < fastResetWindow:
+		return ClassFastFail
+	}
+	return ClassOther
+}
@@ -0,0 +1,59 @@
+package drill
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "os"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// timeoutErr is a net.Error that reports a timeout, like the client's own deadline errors.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func urlErr(err error) error { return &url.Error{Op: "Get", URL: "https://localhost:10443/", Err: err} }
+
+func TestStringClassifier(t *testing.T) {
+    cases := []struct{ name string; err error; dur time.Duration; want string }{
+        {"nil", nil, time.Millisecond, ClassSuccess},
+        {"eof", urlErr(io.EOF), time.Millisecond, ClassFastFail},
+        {"remote alert", urlErr(&net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}), time.Millisecond, ClassFastFail},
+        {"deadline", urlErr(context.DeadlineExceeded), time.Second, ClassTimeout},
+        {"handshake timeout", errors.New("net/http: TLS handshake timeout"), time.Second, ClassFastFail},
+        {"quick reset", urlErr(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), 10 * time.Millisecond, ClassFastFail},
+        {"slow reset", urlErr(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), time.Second, ClassOther},
+        {"refused", urlErr(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), time.Millisecond, ClassOther},
+    }
+    for _, c := range cases {
+        if got := (StringClassifier{}).Classify(c.err, c.dur); got != c.want { t.Errorf("%s: got %s want %s", c.name, got, c.want) }
+    }
+}
+
+func TestErrorsClassifier(t *testing.T) {
+    cases := []struct{ name string; err error; dur time.Duration; want string }{
+        {"nil", nil, time.Millisecond, ClassSuccess},
+        {"eof", urlErr(io.EOF), time.Millisecond, ClassFastFail},
+        {"unexpected eof", urlErr(fmt.Errorf("read body: %w", io.ErrUnexpectedEOF)), time.Millisecond, ClassFastFail},
+        {"remote alert", urlErr(&net.OpError{Op: "remote error", Err: tls.AlertError(40)}), time.Millisecond, ClassFastFail},
+        {"deadline", urlErr(context.DeadlineExceeded), time.Second, ClassTimeout},
+        {"os deadline", urlErr(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}), time.Second, ClassTimeout},
+        {"net timeout", urlErr(timeoutErr{}), time.Second, ClassTimeout},
+        {"quick reset", urlErr(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), 10 * time.Millisecond, ClassFastFail},
+        {"slow reset", urlErr(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), time.Second, ClassOther},
+        // text that fools substring matching but carries no matching error value
+        {"eof in text only", errors.New("unexpected EOF-like banner"), time.Millisecond, ClassOther},
+    }
+    for _, c := range cases {
+        if got := (ErrorsClassifier{}).Classify(c.err, c.dur); got != c.want { t.Errorf("%s: got %s want %s", c.name, got, c.want) }
+    }
+}
@@ -0,0 +1,260 @@
+package drill
+
+// Drill machinery shared by cmd/drill and other tools: a Runner issues HTTP attempts
+// through PathLab, classifies each outcome, tracks an EWMA of latency and can stop early
+// once a simulated breaker would open. It does NOT implement a breaker.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scenario describes what a run expects. Zero fields disable the matching behaviour.
+type Scenario struct {
+	Name string
+	// OpenAfter stops the run once this many classified fast fails are seen in a row.
+	OpenAfter int
+	// TimeoutSurrogate counts failures classified "other" that return within 50ms as
+	// timeouts, after waiting out the attempt timeout.
+	TimeoutSurrogate bool
+	// MaxFastLatency asserts the median fast-fail latency stays below this.
+	MaxFastLatency time.Duration
+	// MinTimeoutRate asserts at least this ratio of attempts time out.
+	MinTimeoutRate float64
+	// RequireOpen asserts the simulated breaker opened.
+	RequireOpen bool
+}
+
+// NamedScenario returns the defaults for fast-fail, slow-timeout or mixed.
+func NamedScenario(name string) (Scenario, error) {
+	switch name {
+	case "fast-fail":
+		return Scenario{Name: name, OpenAfter: 5, MaxFastLatency: 200 * time.Millisecond, RequireOpen: true}, nil
+	case "slow-timeout":
+		return Scenario{Name: name, TimeoutSurrogate: true, MinTimeoutRate: 0.8}, nil
+	case "mixed":
+		return Scenario{Name: name}, nil
+	}
+	return Scenario{}, fmt.Errorf("unknown scenario %q (want fast-fail|slow-timeout|mixed)", name)
+}
+
+// Result is the outcome of one attempt.
+type Result struct {
+	Attempt int
+	Dur     time.Duration
+	Err     error
+	Class   string // success|fast_fail|timeout|other
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	var es string
+	if r.Err != nil {
+		es = r.Err.Error()
+	}
+	return json.Marshal(struct {
+		Attempt int     `json:"attempt"`
+		Ms      float64 `json:"duration_ms"`
+		Class   string  `json:"class"`
+		Err     string  `json:"error,omitempty"`
+	}{r.Attempt, ms(r.Dur), r.Class, es})
+}
+
+// EWMA is an exponentially weighted moving average.
+type EWMA struct {
+	alpha float64
+	value float64
+	set   bool
+}
+
+func NewEWMA(alpha float64) *EWMA { return &EWMA{alpha: alpha} }
+
+func (e *EWMA) Update(v float64) {
+	if !e.set {
+		e.value = v
+		e.set = true
+		return
+	}
+	e.value = e.alpha*v + (1-e.alpha)*e.value
+}
+
+func (e *EWMA) Value() float64 { return e.value }
+
+// Runner issues Attempts GET requests to URL with Concurrency workers.
+type Runner struct {
+	Client      *http.Client
+	URL         string
+	Attempts    int
+	Concurrency int
+	// Timeout bounds each attempt; it is also the wait applied by TimeoutSurrogate.
+	Timeout    time.Duration
+	Classifier Classifier // default StringClassifier
+	Alpha      float64    // EWMA smoothing factor, default 0.2
+}
+
+// Report summarises a run.
+type Report struct {
+	Scenario       string
+	Total          time.Duration
+	Success        int
+	FastFail       int
+	Timeout        int
+	Other          int
+	EWMAMs         float64
+	OpenedAt       int // attempt at which the simulated breaker opened, 0 if never
+	FastFailMedian time.Duration
+	TimeoutRate    float64
+	Failures       []string // failed scenario assertions
+	Results        []Result // sorted by attempt
+}
+
+// Passed reports whether every scenario assertion held.
+func (r *Report) Passed() bool { return len(r.Failures) == 0 }
+
+func (r *Report) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Scenario         string   `json:"scenario"`
+		AttemptsRecorded int      `json:"attempts_recorded"`
+		TotalMs          float64  `json:"total_ms"`
+		Success          int      `json:"success"`
+		FastFail         int      `json:"fast_fail"`
+		Timeout          int      `json:"timeout"`
+		Other            int      `json:"other"`
+		EWMAMs           float64  `json:"ewma_ms"`
+		OpenedAt         int      `json:"opened_at_attempt,omitempty"`
+		FastFailMedianMs float64  `json:"fast_fail_median_ms"`
+		TimeoutRate      float64  `json:"timeout_rate"`
+		Passed           bool     `json:"passed"`
+		Failures         []string `json:"failures,omitempty"`
+		Results          []Result `json:"results"`
+	}{r.Scenario, len(r.Results), ms(r.Total), r.Success, r.FastFail, r.Timeout, r.Other, r.EWMAMs,
+		r.OpenedAt, ms(r.FastFailMedian), r.TimeoutRate, r.Passed(), r.Failures, r.Results})
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+// Run executes the attempts for sc. Once the simulated breaker opens no new attempts
+// start; attempts already in flight are still recorded. Cancelling ctx stops the run
+// the same way and returns ctx.Err() with the partial report.
+func (r *Runner) Run(ctx context.Context, sc Scenario) (*Report, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	classifier := r.Classifier
+	if classifier == nil {
+		classifier = StringClassifier{}
+	}
+	alpha := r.Alpha
+	if alpha <= 0 {
+		alpha = 0.2
+	}
+	workers := max(r.Concurrency, 1)
+
+	var (
+		mu        sync.Mutex
+		results   []Result
+		ewma      = NewEWMA(alpha)
+		consec    int
+		openedAt  int
+		next      atomic.Int64
+		stopped   atomic.Bool
+		startTime = time.Now()
+	)
+	attempt := func(n int) {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if r.Timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, r.Timeout)
+		}
+		defer cancel()
+		start := time.Now()
+		req, err := http.NewRequestWithContext(actx, http.MethodGet, r.URL, nil)
+		if err == nil {
+			var resp *http.Response
+			resp, err = client.Do(req)
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+		}
+		dur := time.Since(start)
+		class := classifier.Classify(err, dur)
+		if sc.TimeoutSurrogate && class == ClassOther && dur < 50*time.Millisecond && r.Timeout > 0 {
+			// an immediate failure stands in for waiting until the timeout boundary
+			select {
+			case <-time.After(r.Timeout - dur):
+			case <-ctx.Done():
+			}
+			dur, class = r.Timeout, ClassTimeout
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if class == ClassFastFail || class == ClassTimeout || class == ClassSuccess {
+			ewma.Update(float64(dur.Milliseconds()))
+		}
+		results = append(results, Result{Attempt: n, Dur: dur, Err: err, Class: class})
+		if class == ClassFastFail {
+			consec++
+		} else if class != ClassSuccess { // only other failure kinds break the streak
+			consec = 0
+		}
+		if sc.OpenAfter > 0 && consec >= sc.OpenAfter && openedAt == 0 {
+			openedAt = n
+			stopped.Store(true)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopped.Load() && ctx.Err() == nil {
+				n := int(next.Add(1))
+				if n > r.Attempts {
+					return
+				}
+				attempt(n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rep := &Report{Scenario: sc.Name, Total: time.Since(startTime), EWMAMs: ewma.Value(), OpenedAt: openedAt, Results: results}
+	sort.Slice(rep.Results, func(i, j int) bool { return rep.Results[i].Attempt < rep.Results[j].Attempt })
+	var fast []time.Duration
+	for _, res := range rep.Results {
+		switch res.Class {
+		case ClassSuccess:
+			rep.Success++
+		case ClassFastFail:
+			rep.FastFail++
+			fast = append(fast, res.Dur)
+		case ClassTimeout:
+			rep.Timeout++
+		default:
+			rep.Other++
+		}
+	}
+	if len(fast) > 0 {
+		sort.Slice(fast, func(i, j int) bool { return fast[i] < fast[j] })
+		rep.FastFailMedian = fast[len(fast)/2]
+	}
+	if len(rep.Results) > 0 {
+		rep.TimeoutRate = float64(rep.Timeout) / float64(len(rep.Results))
+	}
+	if sc.MaxFastLatency > 0 && rep.FastFailMedian > sc.MaxFastLatency {
+		rep.Failures = append(rep.Failures, fmt.Sprintf("median fast-fail latency %s above %s", rep.FastFailMedian, sc.MaxFastLatency))
+	}
+	if sc.RequireOpen && openedAt == 0 {
+		rep.Failures = append(rep.Failures, fmt.Sprintf("breaker did not open (simulated) after %d consecutive fast fails", sc.OpenAfter))
+	}
+	if sc.MinTimeoutRate > 0 && rep.TimeoutRate < sc.MinTimeoutRate {
+		rep.Failures = append(rep.Failures, fmt.Sprintf("timeout rate %.2f below %.2f", rep.TimeoutRate, sc.MinTimeoutRate))
+	}
+	return rep, ctx.Err()
+}
@@ -0,0 +1,105 @@
+package drill
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// fakeTransport answers every request via fn and tracks concurrency.
+type fakeTransport struct {
+    fn       func(n int64) error
+    calls    atomic.Int64
+    inflight atomic.Int64
+    peak     atomic.Int64
+    delay    time.Duration
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    n := f.calls.Add(1)
+    cur := f.inflight.Add(1)
+    defer f.inflight.Add(-1)
+    for { p := f.peak.Load(); if cur <= p || f.peak.CompareAndSwap(p, cur) { break } }
+    time.Sleep(f.delay)
+    if err := f.fn(n); err != nil { return nil, err }
+    return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok")), Request: req}, nil
+}
+
+func TestRunnerAllSuccess(t *testing.T) {
+    ft := &fakeTransport{fn: func(int64) error { return nil }, delay: 5 * time.Millisecond}
+    r := &Runner{Client: &http.Client{Transport: ft}, URL: "http://pathlab.test/", Attempts: 40, Concurrency: 4}
+    rep, err := r.Run(context.Background(), Scenario{Name: "mixed"})
+    if err != nil { t.Fatal(err) }
+    if rep.Success != 40 || len(rep.Results) != 40 || ft.calls.Load() != 40 { t.Fatalf("report %+v calls=%d", rep, ft.calls.Load()) }
+    if p := ft.peak.Load(); p > 4 || p < 2 { t.Fatalf("peak concurrency %d, want 2..4", p) }
+    for i, res := range rep.Results { if res.Attempt != i+1 { t.Fatalf("results not sorted by attempt: %d at %d", res.Attempt, i) } }
+    if !rep.Passed() { t.Fatalf("unexpected failures %v", rep.Failures) }
+}
+
+func TestRunnerStopsEarlyWhenOpen(t *testing.T) {
+    ft := &fakeTransport{fn: func(int64) error { return io.EOF }, delay: 2 * time.Millisecond}
+    r := &Runner{Client: &http.Client{Transport: ft}, URL: "http://pathlab.test/", Attempts: 1000, Concurrency: 3}
+    sc, _ := NamedScenario("fast-fail")
+    rep, err := r.Run(context.Background(), sc)
+    if err != nil { t.Fatal(err) }
+    if rep.OpenedAt == 0 { t.Fatalf("breaker did not open: %+v", rep) }
+    // only attempts already in flight when it opened may finish after it
+    if n := len(rep.Results); n < sc.OpenAfter || n > sc.OpenAfter+r.Concurrency { t.Fatalf("recorded %d attempts, want %d..%d", n, sc.OpenAfter, sc.OpenAfter+r.Concurrency) }
+    if int(ft.calls.Load()) != len(rep.Results) { t.Fatalf("calls=%d results=%d", ft.calls.Load(), len(rep.Results)) }
+    if !rep.Passed() { t.Fatalf("unexpected failures %v", rep.Failures) }
+}
+
+func TestRunnerOtherBreaksStreak(t *testing.T) {
+    // every third attempt fails with an unclassified error, so five fast fails never line up
+    ft := &fakeTransport{fn: func(n int64) error { if n%3 == 0 { return io.ErrClosedPipe }; return io.EOF }}
+    r := &Runner{Client: &http.Client{Transport: ft}, URL: "http://pathlab.test/", Attempts: 30, Concurrency: 1, Classifier: ErrorsClassifier{}}
+    sc, _ := NamedScenario("fast-fail")
+    rep, _ := r.Run(context.Background(), sc)
+    if rep.OpenedAt != 0 || len(rep.Results) != 30 { t.Fatalf("opened=%d results=%d", rep.OpenedAt, len(rep.Results)) }
+    if rep.Passed() || !strings.Contains(strings.Join(rep.Failures, ";"), "did not open") { t.Fatalf("failures %v", rep.Failures) }
+}
+
+func TestRunnerTimeoutSurrogate(t *testing.T) {
+    ft := &fakeTransport{fn: func(int64) error { return io.ErrClosedPipe }}
+    r := &Runner{Client: &http.Client{Transport: ft}, URL: "http://pathlab.test/", Attempts: 6, Concurrency: 6, Timeout: 30 * time.Millisecond}
+    sc, _ := NamedScenario("slow-timeout")
+    start := time.Now()
+    rep, _ := r.Run(context.Background(), sc)
+    if rep.Timeout != 6 || rep.TimeoutRate != 1 || !rep.Passed() { t.Fatalf("report %+v", rep) }
+    if time.Since(start) < 30*time.Millisecond { t.Fatalf("surrogate did not wait out the timeout") }
+}
+
+func TestRunnerContextCancel(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    var once sync.Once
+    ft := &fakeTransport{fn: func(n int64) error { if n >= 10 { once.Do(cancel) }; return nil }}
+    r := &Runner{Client: &http.Client{Transport: ft}, URL: "http://pathlab.test/", Attempts: 1000, Concurrency: 2}
+    rep, err := r.Run(ctx, Scenario{Name: "mixed"})
+    if err != context.Canceled { t.Fatalf("err=%v", err) }
+    if len(rep.Results) > 12 { t.Fatalf("kept going after cancel: %d results", len(rep.Results)) }
+}
+
+func TestReportJSON(t *testing.T) {
+    ft := &fakeTransport{fn: func(n int64) error { if n == 2 { return io.EOF }; return nil }}
+    r := &Runner{Client: &http.Client{Transport: ft}, URL: "http://pathlab.test/", Attempts: 3, Concurrency: 1}
+    rep, _ := r.Run(context.Background(), Scenario{Name: "mixed"})
+    b, err := json.Marshal(rep)
+    if err != nil { t.Fatal(err) }
+    var out struct {
+        Scenario string `json:"scenario"`
+        Recorded int    `json:"attempts_recorded"`
+        Success  int    `json:"success"`
+        FastFail int    `json:"fast_fail"`
+        Passed   bool   `json:"passed"`
+        Results  []struct{ Attempt int `json:"attempt"`; Class string `json:"class"`; Error string `json:"error"` } `json:"results"`
+    }
+    if err := json.Unmarshal(b, &out); err != nil { t.Fatal(err) }
+    if out.Scenario != "mixed" || out.Recorded != 3 || out.Success != 2 || out.FastFail != 1 || !out.Passed { t.Fatalf("json %s", b) }
+    if r2 := out.Results[1]; r2.Attempt != 2 || r2.Class != ClassFastFail || !strings.Contains(r2.Error, "EOF") { t.Fatalf("result 2 = %+v", r2) }
+}
@@ -0,0 +1,159 @@
+// Package health runs PathLab's readiness checks (GET /readyz): can the upstreams be
+// dialed, can the receipt key be loaded. A Prober runs them in the background and
+// keeps the last report, so asking for readiness does not dial anything unless that
+// report has gone stale.
+package health
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for a Prober's zero fields.
+const (
+	DefaultTimeout  = time.Second     // per check
+	DefaultInterval = 5 * time.Second // between background runs
+	// A report older than DefaultMaxAge is refreshed on demand. It outlives the gap
+	// between two background reports, up to an interval plus a run's timeout, with a
+	// timeout to spare, so with the prober running Ready never runs the checks itself.
+	DefaultMaxAge = DefaultInterval + 2*DefaultTimeout
+)
+
+// Check is one readiness check; Run returns nil when it passes.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// Report is the outcome of one run of every check.
+type Report struct {
+	Ready     bool      `json:"ready"`
+	CheckedAt time.Time `json:"checked_at"`
+	Failing   []string  `json:"failing,omitempty"` // names of the checks that failed
+	Checks    []Result  `json:"checks"`
+}
+
+// Prober runs Checks and keeps the last Report.
+type Prober struct {
+	Checks  []Check
+	Timeout time.Duration // bounds each check; 0 = DefaultTimeout
+	MaxAge  time.Duration // how long Ready reuses a report; 0 = DefaultMaxAge
+
+	run  sync.Mutex // one run at a time
+	mu   sync.Mutex
+	last Report
+	have bool
+}
+
+// DialCheck passes when a TCP connection to addr opens; the connection is closed at
+// once.
+func DialCheck(name, addr string) Check {
+	return Check{Name: name, Run: func(ctx context.Context) error {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}}
+}
+
+// Run runs every check at once, each bounded by the Timeout, and keeps the report.
+func (p *Prober) Run(ctx context.Context) Report {
+	p.run.Lock()
+	defer p.run.Unlock()
+	return p.runLocked(ctx)
+}
+
+func (p *Prober) runLocked(ctx context.Context) Report {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	rep := Report{Ready: true, Checks: make([]Result, len(p.Checks))}
+	var wg sync.WaitGroup
+	for i, c := range p.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := c.Run(cctx)
+			res := Result{Name: c.Name, OK: err == nil, LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			rep.Checks[i] = res
+		}()
+	}
+	wg.Wait()
+	for _, r := range rep.Checks {
+		if !r.OK {
+			rep.Ready = false
+			rep.Failing = append(rep.Failing, r.Name)
+		}
+	}
+	rep.CheckedAt = time.Now().UTC()
+	p.mu.Lock()
+	p.last, p.have = rep, true
+	p.mu.Unlock()
+	return rep
+}
+
+// Last returns the last report, or false before the first run.
+func (p *Prober) Last() (Report, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last, p.have
+}
+
+// Ready returns the last report while it is younger than MaxAge and runs the checks
+// otherwise. Callers arriving during a run share its report.
+func (p *Prober) Ready(ctx context.Context) Report {
+	maxAge := p.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	fresh := func() (Report, bool) {
+		rep, ok := p.Last()
+		return rep, ok && time.Since(rep.CheckedAt) < maxAge
+	}
+	if rep, ok := fresh(); ok {
+		return rep
+	}
+	p.run.Lock()
+	defer p.run.Unlock()
+	if rep, ok := fresh(); ok {
+		return rep
+	}
+	return p.runLocked(ctx)
+}
+
+// RunEvery runs the checks now and then every interval until ctx is done.
+func (p *Prober) RunEvery(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	p.Run(ctx)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.Run(ctx)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package health
+
+import (
+    "context"
+    "errors"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestDialCheckDegradesAndRecovers(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    addr := ln.Addr().String()
+    ln.Close() // the upstream is down
+    p := &Prober{Checks: []Check{DialCheck("upstream "+addr, addr), {Name: "keyfile", Run: func(context.Context) error { return nil }}}, Timeout: 500 * time.Millisecond}
+    rep := p.Run(context.Background())
+    if rep.Ready || len(rep.Failing) != 1 || rep.Failing[0] != "upstream "+addr || rep.Checks[0].Error == "" || !rep.Checks[1].OK { t.Fatalf("stopped upstream: %+v", rep) }
+
+    ln, err = net.Listen("tcp", addr)
+    if err != nil { t.Skipf("could not listen on %s again: %v", addr, err) }
+    defer ln.Close()
+    if cached := p.Ready(context.Background()); cached.Ready || !cached.CheckedAt.Equal(rep.CheckedAt) { t.Fatalf("fresh report not reused: %+v", cached) }
+    if rep = p.Run(context.Background()); !rep.Ready || len(rep.Failing) != 0 { t.Fatalf("restarted upstream: %+v", rep) }
+}
+
+func TestReadyRefreshesStaleReport(t *testing.T) {
+    runs := 0
+    p := &Prober{Checks: []Check{{Name: "count", Run: func(context.Context) error { runs++; return errors.New("down") }}}, MaxAge: 20 * time.Millisecond}
+    if _, ok := p.Last(); ok { t.Fatal("report before the first run") }
+    p.Ready(context.Background())
+    p.Ready(context.Background())
+    if runs != 1 { t.Fatalf("%d runs within MaxAge, want 1", runs) }
+    time.Sleep(30 * time.Millisecond)
+    if rep := p.Ready(context.Background()); rep.Ready || runs != 2 { t.Fatalf("stale report not refreshed: runs=%d %+v", runs, rep) }
+}
+
+func TestDefaultMaxAgeOutlivesBackgroundRuns(t *testing.T) {
+    // a background run finishes at most an interval plus a timeout after the last one
+    if DefaultMaxAge <= DefaultInterval+DefaultTimeout { t.Fatalf("DefaultMaxAge %s, background reports can be %s apart", DefaultMaxAge, DefaultInterval+DefaultTimeout) }
+}
+
+func TestCheckTimeout(t *testing.T) {
+    p := &Prober{Checks: []Check{{Name: "slow", Run: func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }}}, Timeout: 30 * time.Millisecond}
+    start := time.Now()
+    if rep := p.Run(context.Background()); rep.Ready || time.Since(start) > time.Second { t.Fatalf("slow check: %+v after %s", rep, time.Since(start)) }
+}
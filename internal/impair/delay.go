@@ -0,0 +1,68 @@
+package impair
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Jitter distributions for Config.JitterDistribution.
+const (
+	JitterUniform = "uniform" // base +/- jitter/2, evenly spread (default)
+	JitterNormal  = "normal"  // base + normal noise with standard deviation jitter
+	JitterPareto  = "pareto"  // base + heavy-tailed extra delay averaging jitter; never below base
+)
+
+// paretoShape is the tail index of the pareto distribution: finite mean and variance,
+// but occasional delays many times the mean, like a congested path.
+const paretoShape = 3.0
+
+// DelaySampler draws per-chunk delays of LATENCY_50MS_JITTER_10: a base latency plus
+// jitter from the configured distribution, clamped at zero. A non-zero seed makes the
+// sequence reproducible. Not safe for concurrent use; give each direction its own.
+type DelaySampler struct {
+	base   float64 // ms
+	jitter float64 // ms
+	dist   string
+	rng    *rand.Rand
+}
+
+// NewDelaySampler returns a sampler for base +/- jitter (ms) with distribution dist
+// (empty means uniform). seed 0 picks a random seed.
+func NewDelaySampler(baseMs, jitterMs int, dist string, seed int64) *DelaySampler {
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	if dist == "" {
+		dist = JitterUniform
+	}
+	return &DelaySampler{base: float64(baseMs), jitter: float64(jitterMs), dist: dist, rng: rand.New(rand.NewSource(seed))}
+}
+
+// DelaySampler returns the sampler for one direction of a connection under c.
+func (c Config) DelaySampler(up bool) *DelaySampler {
+	if up {
+		return NewDelaySampler(c.LatencyMs, c.JitterMs, c.JitterDistribution, c.JitterSeed)
+	}
+	return NewDelaySampler(c.LatencyDownMs, c.JitterDownMs, c.JitterDistribution, c.JitterSeed)
+}
+
+// Next returns the delay for the next chunk.
+func (s *DelaySampler) Next() time.Duration {
+	ms := s.base
+	if s.jitter > 0 {
+		switch s.dist {
+		case JitterNormal:
+			ms += s.rng.NormFloat64() * s.jitter
+		case JitterPareto:
+			// Lomax (Pareto II): scale (shape-1)*jitter gives a mean of jitter.
+			ms += (paretoShape - 1) * s.jitter * (math.Pow(1-s.rng.Float64(), -1/paretoShape) - 1)
+		default:
+			ms += (s.rng.Float64() - 0.5) * s.jitter
+		}
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -0,0 +1,82 @@
+package impair
+
+import (
+    "math"
+    "sort"
+    "testing"
+    "time"
+)
+
+// draw returns n samples in milliseconds, sorted.
+func draw(s *DelaySampler, n int) []float64 {
+    out := make([]float64, n)
+    for i := range out {
+        out[i] = float64(s.Next()) / float64(time.Millisecond)
+    }
+    sort.Float64s(out)
+    return out
+}
+
+func meanStd(xs []float64) (mean, std float64) {
+    for _, x := range xs { mean += x }
+    mean /= float64(len(xs))
+    for _, x := range xs { std += (x - mean) * (x - mean) }
+    return mean, math.Sqrt(std / float64(len(xs)))
+}
+
+const samples = 20000
+
+func TestDelayUniform(t *testing.T) {
+    xs := draw(NewDelaySampler(50, 10, JitterUniform, 1), samples)
+    if xs[0] < 45 || xs[len(xs)-1] > 55 { t.Fatalf("range [%.2f, %.2f], want within 50 +/- 5", xs[0], xs[len(xs)-1]) }
+    mean, std := meanStd(xs)
+    if math.Abs(mean-50) > 0.2 { t.Fatalf("mean %.3f, want ~50", mean) }
+    // uniform over a width of 10: std = 10/sqrt(12)
+    if want := 10 / math.Sqrt(12); math.Abs(std-want) > 0.1 { t.Fatalf("std %.3f, want ~%.3f", std, want) }
+    if q1 := xs[samples/4]; math.Abs(q1-47.5) > 0.3 { t.Fatalf("first quartile %.3f, want ~47.5", q1) }
+}
+
+func TestDelayNormal(t *testing.T) {
+    xs := draw(NewDelaySampler(50, 10, JitterNormal, 1), samples)
+    mean, std := meanStd(xs)
+    if math.Abs(mean-50) > 0.3 { t.Fatalf("mean %.3f, want ~50", mean) }
+    if math.Abs(std-10) > 0.3 { t.Fatalf("std %.3f, want ~10", std) }
+    within := 0
+    for _, x := range xs {
+        if math.Abs(x-50) <= 10 { within++ }
+    }
+    if share := float64(within) / samples; math.Abs(share-0.683) > 0.02 { t.Fatalf("%.3f within one std dev, want ~0.683", share) }
+}
+
+func TestDelayPareto(t *testing.T) {
+    xs := draw(NewDelaySampler(50, 10, JitterPareto, 1), samples)
+    if xs[0] < 50 { t.Fatalf("min %.3f below the base latency", xs[0]) }
+    mean, _ := meanStd(xs)
+    if math.Abs(mean-60) > 0.5 { t.Fatalf("mean %.3f, want ~60 (base + jitter)", mean) }
+    median, p999 := xs[samples/2], xs[samples*999/1000]
+    if median >= mean { t.Fatalf("median %.3f not below mean %.3f: not right-skewed", median, mean) }
+    // heavy tail: the 99.9th percentile extra is several times the mean extra
+    if p999-50 < 5*10 { t.Fatalf("p99.9 %.3f, want a tail beyond 100", p999) }
+}
+
+func TestDelayClampAndZeroJitter(t *testing.T) {
+    s := NewDelaySampler(0, 50, JitterNormal, 1)
+    for i := 0; i < 1000; i++ {
+        if d := s.Next(); d < 0 { t.Fatalf("negative delay %v", d) }
+    }
+    for _, dist := range []string{"", JitterUniform, JitterNormal, JitterPareto} {
+        if d := NewDelaySampler(30, 0, dist, 0).Next(); d != 30*time.Millisecond { t.Fatalf("%q without jitter: %v, want 30ms", dist, d) }
+    }
+}
+
+func TestDelaySeedReproducible(t *testing.T) {
+    for _, dist := range []string{JitterUniform, JitterNormal, JitterPareto} {
+        a, b := NewDelaySampler(50, 10, dist, 42), NewDelaySampler(50, 10, dist, 42)
+        for i := 0; i < 100; i++ {
+            if da, db := a.Next(), b.Next(); da != db { t.Fatalf("%s: sample %d differs: %v vs %v", dist, i, da, db) }
+        }
+    }
+    cfg := withDefaults(Config{Profile: ProfileLatencyJitter, JitterSeed: 7})
+    if cfg.JitterDistribution != JitterUniform { t.Fatalf("default distribution %q", cfg.JitterDistribution) }
+    if cfg.DelaySampler(true).Next() != cfg.DelaySampler(true).Next() { t.Fatal("seeded config should give every connection the same sequence") }
+}
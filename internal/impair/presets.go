@@ -0,0 +1,90 @@
+package impair
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrUnknownPreset is returned when a preset name is not stored.
+var ErrUnknownPreset = errors.New("unknown preset")
+
+// Preset is a named Config stored with PUT /impair/presets/{name}.
+type Preset struct {
+	Name      string    `json:"name"`
+	Config    Config    `json:"config"` // defaults filled in, as Apply would
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ValidPresetName reports whether name can be stored and referenced from a rule
+// (then preset:<name>): 1-64 of lowercase letters, digits, '-', '_' and '.'. Rule
+// text is matched case-insensitively, hence lowercase only.
+func ValidPresetName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetPreset validates cfg and stores it under name, replacing any preset of that name.
+func (s *State) SetPreset(name string, cfg Config) (Preset, error) {
+	if !ValidPresetName(name) {
+		return Preset{}, fmt.Errorf("invalid preset name %q: use 1-64 of a-z, 0-9, '-', '_', '.'", name)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Preset{}, err
+	}
+	p := Preset{Name: name, Config: withDefaults(cfg), UpdatedAt: time.Now().UTC()}
+	p.Config.UpdatedAt = p.UpdatedAt
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.presets == nil {
+		s.presets = map[string]Preset{}
+	}
+	s.presets[name] = p
+	return p, nil
+}
+
+// DeletePreset removes a preset and reports whether it existed.
+func (s *State) DeletePreset(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.presets[name]
+	delete(s.presets, name)
+	return ok
+}
+
+// Preset returns the stored preset name.
+func (s *State) Preset(name string) (Preset, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.presets[name]
+	return p, ok
+}
+
+// Presets lists the stored presets by name.
+func (s *State) Presets() []Preset {
+	s.mu.RLock()
+	out := make([]Preset, 0, len(s.presets))
+	for _, p := range s.presets {
+		out = append(out, p)
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// ApplyPreset makes the named preset the active config, as Apply.
+func (s *State) ApplyPreset(name string) error {
+	p, ok := s.Preset(name)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownPreset, name)
+	}
+	return s.Apply(p.Config)
+}
@@ -0,0 +1,40 @@
+package impair
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestPresetCRUD(t *testing.T) {
+    s := &State{}
+    if len(s.Presets()) != 0 { t.Fatal("presets on a new state") }
+    p, err := s.SetPreset("slow-eu", Config{Profile: ProfileLatencyJitter, LatencyMs: 120})
+    if err != nil { t.Fatal(err) }
+    if p.Config.LatencyMs != 120 || p.Config.JitterMs != 10 || p.Config.ThresholdBytes != 1300 { t.Fatalf("defaults not filled in: %+v", p.Config) }
+    s.SetPreset("abort", Config{Profile: ProfileAbortAfterCH})
+    if _, err := s.SetPreset("slow-eu", Config{Profile: ProfileLatencyJitter, LatencyMs: 200}); err != nil { t.Fatal(err) }
+    list := s.Presets()
+    if len(list) != 2 || list[0].Name != "abort" || list[1].Name != "slow-eu" || list[1].Config.LatencyMs != 200 { t.Fatalf("list %+v", list) }
+    if got, ok := s.Preset("slow-eu"); !ok || got.Config.LatencyMs != 200 { t.Fatalf("get %+v %v", got, ok) }
+    if !s.DeletePreset("abort") || s.DeletePreset("abort") { t.Fatal("delete did not report existence") }
+    if _, ok := s.Preset("abort"); ok { t.Fatal("deleted preset still stored") }
+}
+
+func TestPresetRejectsBadNamesAndConfigs(t *testing.T) {
+    s := &State{}
+    for _, name := range []string{"", "Slow", "a/b", "with space", string(make([]byte, 65))} {
+        if _, err := s.SetPreset(name, Config{}); err == nil { t.Errorf("name %q accepted", name) }
+    }
+    var verr *ValidationError
+    if _, err := s.SetPreset("lossy", Config{Profile: ProfileLoss, LossPercent: 500}); !errors.As(err, &verr) { t.Fatalf("invalid config: %v", err) }
+    if len(s.Presets()) != 0 { t.Fatal("rejected preset stored") }
+}
+
+func TestApplyPreset(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileClean})
+    if err := s.ApplyPreset("nope"); !errors.Is(err, ErrUnknownPreset) { t.Fatalf("unknown preset: %v", err) }
+    s.SetPreset("bh", Config{Profile: ProfileMTUBlackhole, ThresholdBytes: 900})
+    if err := s.ApplyPreset("bh"); err != nil { t.Fatal(err) }
+    if cfg := s.Get(); cfg.Profile != ProfileMTUBlackhole || cfg.ThresholdBytes != 900 { t.Fatalf("active %+v", cfg) }
+}
@@ -0,0 +1,187 @@
+package impair
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ProfileInfo describes one profile for the GET /impair/profiles catalog.
+type ProfileInfo struct {
+	Name        ProfileName `json:"name"`
+	Description string      `json:"description"`
+	Fields      []FieldInfo `json:"fields"`
+}
+
+// FieldInfo describes one Config field a profile reads. Default is the value Apply
+// fills in when the field is left unset (absent when there is no static default).
+type FieldInfo struct {
+	Name        string `json:"name"` // JSON / query parameter name
+	Type        string `json:"type"` // int, float, bool or string
+	Default     any    `json:"default,omitempty"`
+	Description string `json:"description"`
+}
+
+// profileRegistry lists every supported profile with the Config fields (by JSON name)
+// it uses. Handlers, defaults and the catalog all key off these names.
+var profileRegistry = []struct {
+	name   ProfileName
+	desc   string
+	fields []string
+}{
+	{ProfileClean, "Transparent passthrough; per-connection overrides can still shape it live.", nil},
+	{ProfileAbortAfterCH, "Forward the ClientHello, then reset both sides (middlebox intolerance, fast fail); abort_after_server_bytes lets the start of the server's flight through first.",
+		[]string{"abort_after_server_bytes"}},
+	{ProfileMTUBlackhole, "Forward only the first threshold_bytes of the ClientHello, then silently drop client bytes (PMTUD black hole, slow fail); blackhole_direction=down cuts the server's flight instead.",
+		[]string{"threshold_bytes", "blackhole_direction", "blackhole_seconds", "apply_to_retry_ch"}},
+	{ProfileLatencyJitter, "Delay each chunk by latency +/- jitter drawn from jitter_distribution, optionally with separate downstream values.",
+		[]string{"latency_ms", "jitter_ms", "latency_down_ms", "jitter_down_ms", "jitter_distribution", "jitter_seed"}},
+	{ProfileBandwidthLimit, "Token-bucket bandwidth cap per direction, per connection or shared by all.",
+		[]string{"bandwidth_kbps", "bandwidth_down_kbps", "burst_bytes", "global_bandwidth"}},
+	{ProfileRampDown, "Bandwidth cap that slides linearly from bandwidth_kbps to bandwidth_floor_kbps over ramp_seconds after apply (brownout).",
+		[]string{"bandwidth_kbps", "bandwidth_floor_kbps", "ramp_seconds", "bandwidth_down_kbps", "burst_bytes", "global_bandwidth"}},
+	{ProfileLoss, "Drop a share of client->upstream chunks after the ClientHello.", []string{"loss_percent"}},
+	{ProfileResetAfterBytes, "Relay until reset_after_bytes of server data were delivered, then reset both sides.", []string{"reset_after_bytes"}},
+	{ProfileFailureRamp, "Abort a rising share of new connections after the ClientHello (ABORT_AFTER_CH with a ramped probability).",
+		[]string{"max_pct", "ramp_minutes", "ramp_shape", "abort_after_server_bytes"}},
+	{ProfileReorder, "Swap adjacent client->upstream chunks after the ClientHello.", []string{"reorder_percent", "reorder_window_bytes"}},
+	{ProfileSlowDrip, "Trickle client->upstream bytes after the ClientHello (slowloris toward the upstream).", []string{"drip_bytes", "drip_interval_ms"}},
+	{ProfileCorrupt, "Flip a bit in a share of forwarded chunks after the ClientHello.", []string{"corrupt_percent", "corrupt_direction"}},
+	{ProfileStall, "Freeze both directions for stall_seconds once stall_after_bytes were proxied, then resume.", []string{"stall_after_bytes", "stall_seconds"}},
+	{ProfileHalfClose, "Half-close the upstream (TCP FIN toward the server) after half_close_after_bytes of client data and keep relaying the server's bytes until it closes.",
+		[]string{"half_close_after_bytes"}},
+	{ProfileInterceptTLS, "Terminate TLS with a certificate for another host and answer with a redirect (captive portal / interception box).",
+		[]string{"intercept_cn", "intercept_redirect"}},
+	{ProfileSlowHandshake, "Delay and/or cap both directions only until the upstream sends its first non-handshake TLS record, then relay unimpaired (handshake timeouts).",
+		[]string{"latency_ms", "jitter_ms", "jitter_distribution", "bandwidth_kbps", "burst_bytes"}},
+	{ProfileDelayFirstResponse, "Hold the upstream's first chunk for first_byte_delay_ms, then relay everything unimpaired (time-to-first-byte alerting).",
+		[]string{"first_byte_delay_ms"}},
+}
+
+// commonFields apply under every profile.
+var commonFields = []string{"duration_seconds", "apply_percent", "also_hold_ms", "idle_timeout_seconds", "max_conn_seconds", "keepalive_enabled", "keepalive_idle_seconds", "first_contact_key", "first_contact_ttl_seconds", "notes"}
+
+// fieldDocs are the one-line descriptions of catalogued fields.
+var fieldDocs = map[string]string{
+	"threshold_bytes":           "ClientHello bytes forwarded before the black hole",
+	"blackhole_direction":       "up (cut the ClientHello), down (forward it whole, cut upstream->client bytes past threshold_bytes) or both",
+	"blackhole_seconds":         "how long a black-holed connection is held before closing",
+	"apply_to_retry_ch":         "pass a first ClientHello that fits and apply the threshold to the retry after a HelloRetryRequest",
+	"latency_ms":                "client->upstream delay per chunk",
+	"jitter_ms":                 "client->upstream jitter (+/-)",
+	"latency_down_ms":           "upstream->client delay per chunk (0 = none)",
+	"jitter_down_ms":            "upstream->client jitter (+/-)",
+	"jitter_distribution":       "uniform (+/- jitter/2), normal (standard deviation jitter) or pareto (heavy tail averaging jitter, never below the latency)",
+	"jitter_seed":               "non-zero: the same delay sequence on every connection",
+	"bandwidth_kbps":            "client->upstream cap",
+	"bandwidth_down_kbps":       "upstream->client cap (0 = unshaped)",
+	"burst_bytes":               "token bucket size (0 = 100ms of the rate)",
+	"bandwidth_floor_kbps":      "client->upstream cap reached at the end of the ramp",
+	"ramp_seconds":              "time from apply to the floor; the downstream cap scales along",
+	"global_bandwidth":          "share one bucket per direction across all connections",
+	"loss_percent":              "chance (0-100) a chunk is dropped",
+	"reset_after_bytes":         "upstream->client bytes relayed before the reset",
+	"abort_after_server_bytes":  "upstream->client bytes relayed before the reset (0 = reset right after the ClientHello)",
+	"max_pct":                   "final abort probability (0-100)",
+	"ramp_minutes":              "time to reach max_pct from apply",
+	"ramp_shape":                "linear or exponential",
+	"reorder_percent":           "chance (0-100) a chunk is held behind the next one",
+	"reorder_window_bytes":      "chunk size reordering operates on",
+	"drip_bytes":                "bytes forwarded per interval",
+	"drip_interval_ms":          "pause between drips",
+	"corrupt_percent":           "chance (0-100) a chunk gets a bit flipped",
+	"corrupt_direction":         "down (upstream->client), up or both",
+	"stall_after_bytes":         "total bytes proxied (both directions) before the freeze",
+	"stall_seconds":             "how long nothing is forwarded",
+	"half_close_after_bytes":    "client bytes forwarded before the half-close (0 = right after the ClientHello)",
+	"intercept_cn":              "hostname on the presented certificate",
+	"intercept_redirect":        "Location of the canned 302 (empty = http://<intercept_cn>/)",
+	"first_byte_delay_ms":       "how long the upstream's first chunk is held before it reaches the client",
+	"apply_percent":             "share (0-100) of new connections that get the profile; the rest run CLEAN (0 = all)",
+	"duration_seconds":          "revert to the previous config after this long (0 = until changed)",
+	"also_hold_ms":              "keep the upstream open this long after the client closes",
+	"idle_timeout_seconds":      "close a connection with no bytes either way for this long (0 = -idle-timeout)",
+	"max_conn_seconds":          "close a connection this long after it started, holds included (0 = no limit)",
+	"keepalive_enabled":         "TCP keepalives on the client and upstream sockets: true or false (unset = -keepalive)",
+	"keepalive_idle_seconds":    "idle time before keepalive probes start, and between probes (0 = -keepalive-idle)",
+	"first_contact_key":         "ip or ja3: impair only a key's first connection",
+	"first_contact_ttl_seconds": "how long a key stays seen",
+	"notes":                     "free text kept with the config",
+}
+
+// LookupProfile reports whether name is a supported profile.
+func LookupProfile(name ProfileName) (ProfileInfo, bool) {
+	for _, p := range profileRegistry {
+		if p.name == name {
+			return profileInfo(p.name, p.desc, p.fields), true
+		}
+	}
+	return ProfileInfo{}, false
+}
+
+// ProfileNames returns the supported profile names in catalog order.
+func ProfileNames() []ProfileName {
+	out := make([]ProfileName, len(profileRegistry))
+	for i, p := range profileRegistry {
+		out[i] = p.name
+	}
+	return out
+}
+
+// Catalog is the GET /impair/profiles response.
+type Catalog struct {
+	Profiles     []ProfileInfo `json:"profiles"`
+	CommonFields []FieldInfo   `json:"common_fields"`
+}
+
+// ProfileCatalog describes every supported profile; defaults are taken from what
+// Apply fills in, so they cannot drift from the real behaviour.
+func ProfileCatalog() Catalog {
+	c := Catalog{Profiles: make([]ProfileInfo, 0, len(profileRegistry))}
+	for _, p := range profileRegistry {
+		c.Profiles = append(c.Profiles, profileInfo(p.name, p.desc, p.fields))
+	}
+	c.CommonFields = fieldInfos(withDefaults(Config{}), commonFields)
+	return c
+}
+
+func profileInfo(name ProfileName, desc string, fields []string) ProfileInfo {
+	return ProfileInfo{Name: name, Description: desc, Fields: fieldInfos(withDefaults(Config{Profile: name}), fields)}
+}
+
+// fieldInfos describes the named fields of def, reading each default by JSON tag.
+func fieldInfos(def Config, names []string) []FieldInfo {
+	out := []FieldInfo{}
+	v := reflect.ValueOf(def)
+	for _, name := range names {
+		f, ok := fieldByJSON(v, name)
+		if !ok {
+			continue
+		}
+		fi := FieldInfo{Name: name, Description: fieldDocs[name]}
+		switch f.Kind() {
+		case reflect.Int, reflect.Int64:
+			fi.Type = "int"
+		case reflect.Float64:
+			fi.Type = "float"
+		case reflect.Bool:
+			fi.Type = "bool"
+		default:
+			fi.Type = "string"
+		}
+		if !f.IsZero() {
+			fi.Default = f.Interface()
+		}
+		out = append(out, fi)
+	}
+	return out
+}
+
+func fieldByJSON(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,56 @@
+package impair
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestLookupProfileRejectsUnknown(t *testing.T) {
+    for _, name := range []ProfileName{"MTU1300_BLACKHOL", "clean", "", "LATENCY"} {
+        if _, ok := LookupProfile(name); ok { t.Errorf("LookupProfile(%q) accepted an unknown profile", name) }
+    }
+    if p, ok := LookupProfile(ProfileStall); !ok || p.Name != ProfileStall { t.Fatalf("STALL not found: %#v", p) }
+}
+
+func TestProfileRegistryCoversAllProfiles(t *testing.T) {
+    all := []ProfileName{ProfileClean, ProfileAbortAfterCH, ProfileMTUBlackhole, ProfileLatencyJitter, ProfileBandwidthLimit, ProfileRampDown, ProfileLoss,
+        ProfileResetAfterBytes, ProfileFailureRamp, ProfileReorder, ProfileSlowDrip, ProfileCorrupt, ProfileStall, ProfileHalfClose, ProfileInterceptTLS, ProfileSlowHandshake,
+        ProfileDelayFirstResponse}
+    if got := ProfileNames(); len(got) != len(all) { t.Fatalf("ProfileNames()=%v, want %d names", got, len(all)) }
+    for _, name := range all {
+        if _, ok := LookupProfile(name); !ok { t.Errorf("%s missing from the registry", name) }
+    }
+    for _, p := range ProfileCatalog().Profiles {
+        if p.Description == "" { t.Errorf("%s has no description", p.Name) }
+        for _, f := range p.Fields {
+            if f.Description == "" { t.Errorf("%s.%s has no description", p.Name, f.Name) }
+        }
+    }
+}
+
+func TestProfileCatalogShape(t *testing.T) {
+    b, err := json.Marshal(ProfileCatalog())
+    if err != nil { t.Fatal(err) }
+    var c struct {
+        Profiles []struct {
+            Name   string `json:"name"`
+            Description string `json:"description"`
+            Fields []struct { Name, Type, Description string; Default any } `json:"fields"`
+        } `json:"profiles"`
+        CommonFields []struct { Name, Type string } `json:"common_fields"`
+    }
+    if err := json.Unmarshal(b, &c); err != nil { t.Fatal(err) }
+    fields := map[string]map[string]struct{ typ string; def any }{}
+    for _, p := range c.Profiles {
+        fields[p.Name] = map[string]struct{ typ string; def any }{}
+        for _, f := range p.Fields { fields[p.Name][f.Name] = struct{ typ string; def any }{f.Type, f.Default} }
+    }
+    if f, ok := fields["MTU1300_BLACKHOLE"]["threshold_bytes"]; !ok || f.typ != "int" || f.def != float64(1300) { t.Errorf("threshold_bytes=%+v", f) }
+    if f := fields["MTU1300_BLACKHOLE"]["apply_to_retry_ch"]; f.typ != "bool" || f.def != nil { t.Errorf("apply_to_retry_ch=%+v", f) }
+    if f := fields["LATENCY_50MS_JITTER_10"]["latency_ms"]; f.typ != "int" || f.def != float64(50) { t.Errorf("latency_ms=%+v", f) }
+    if f := fields["PACKET_LOSS"]["loss_percent"]; f.typ != "float" { t.Errorf("loss_percent=%+v", f) }
+    if f := fields["CORRUPT"]["corrupt_direction"]; f.typ != "string" || f.def != CorruptDown { t.Errorf("corrupt_direction=%+v", f) }
+    if f := fields["INTERCEPT_TLS"]["intercept_cn"]; f.def != "captive.portal.local" { t.Errorf("intercept_cn=%+v", f) }
+    if len(fields["CLEAN"]) != 0 { t.Errorf("CLEAN fields=%v", fields["CLEAN"]) }
+    if len(c.CommonFields) == 0 || c.CommonFields[0].Name != "duration_seconds" { t.Errorf("common_fields=%+v", c.CommonFields) }
+}
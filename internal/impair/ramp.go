@@ -0,0 +1,61 @@
+package impair
+
+import (
+	"math"
+	"time"
+)
+
+// Failure ramp shapes for Config.RampShape.
+const (
+	RampLinear      = "linear"
+	RampExponential = "exponential"
+)
+
+// FailureRampPct returns the probability (0-100) that FAILURE_RAMP aborts a new
+// connection at now. It rises from 0 at UpdatedAt to MaxPct after RampMinutes and
+// then holds. The exponential shape stays low for most of the ramp and climbs late.
+func (c Config) FailureRampPct(now time.Time) float64 {
+	if c.Profile != ProfileFailureRamp {
+		return 0
+	}
+	ramp := time.Duration(c.RampMinutes * float64(time.Minute))
+	frac := 1.0
+	if ramp > 0 {
+		frac = float64(now.Sub(c.UpdatedAt)) / float64(ramp)
+	}
+	frac = math.Max(0, math.Min(1, frac))
+	if c.RampShape == RampExponential {
+		frac = (math.Pow(2, 10*frac) - 1) / (math.Pow(2, 10) - 1)
+	}
+	return frac * c.MaxPct
+}
+
+// FailureRampDecision resolves FAILURE_RAMP for one connection: roll is a uniform
+// sample in [0,1). It returns ABORT_AFTER_CH or CLEAN and the probability used.
+func FailureRampDecision(c Config, now time.Time, roll float64) (ProfileName, float64) {
+	pct := c.FailureRampPct(now)
+	if roll*100 < pct {
+		return ProfileAbortAfterCH, pct
+	}
+	return ProfileClean, pct
+}
+
+// RampDownRate returns the client->upstream cap (kbps) BANDWIDTH_RAMP_DOWN allows at
+// now: BandwidthKbps at UpdatedAt, falling linearly to BandwidthFloorKbps over
+// RampSeconds, then holding. With the floor equal to the start rate it is a fixed cap.
+func (c Config) RampDownRate(now time.Time) int {
+	frac := 1.0
+	if ramp := time.Duration(c.RampSeconds * float64(time.Second)); ramp > 0 {
+		frac = math.Max(0, math.Min(1, float64(now.Sub(c.UpdatedAt))/float64(ramp)))
+	}
+	return int(math.Round(float64(c.BandwidthKbps) + frac*float64(c.BandwidthFloorKbps-c.BandwidthKbps)))
+}
+
+// RampDownScale returns RampDownRate(now) as a fraction of the start rate, used to
+// scale the upstream->client cap along with it.
+func (c Config) RampDownScale(now time.Time) float64 {
+	if c.BandwidthKbps <= 0 {
+		return 1
+	}
+	return float64(c.RampDownRate(now)) / float64(c.BandwidthKbps)
+}
@@ -0,0 +1,65 @@
+package impair
+
+import (
+    "testing"
+    "time"
+)
+
+func TestFailureRampLinear(t *testing.T) {
+    start := time.Unix(1700000000, 0)
+    c := Config{Profile: ProfileFailureRamp, MaxPct: 40, RampMinutes: 10, UpdatedAt: start}
+    cases := []struct{ after time.Duration; want float64 }{
+        {0, 0}, {5 * time.Minute, 20}, {10 * time.Minute, 40}, {time.Hour, 40}, {-time.Minute, 0},
+    }
+    for _, tc := range cases {
+        if got := c.FailureRampPct(start.Add(tc.after)); got != tc.want { t.Errorf("after %v: pct=%v want %v", tc.after, got, tc.want) }
+    }
+}
+
+func TestFailureRampExponentialIsBackLoaded(t *testing.T) {
+    start := time.Unix(1700000000, 0)
+    c := Config{Profile: ProfileFailureRamp, MaxPct: 100, RampMinutes: 10, RampShape: RampExponential, UpdatedAt: start}
+    mid := c.FailureRampPct(start.Add(5 * time.Minute))
+    if mid <= 0 || mid >= 10 { t.Fatalf("exponential midpoint pct=%v, want small but positive", mid) }
+    if end := c.FailureRampPct(start.Add(10 * time.Minute)); end != 100 { t.Fatalf("exponential end pct=%v", end) }
+}
+
+func TestFailureRampDecision(t *testing.T) {
+    start := time.Unix(1700000000, 0)
+    c := Config{Profile: ProfileFailureRamp, MaxPct: 50, RampMinutes: 1, UpdatedAt: start}
+    now := start.Add(time.Minute)
+    if p, pct := FailureRampDecision(c, now, 0.49); p != ProfileAbortAfterCH || pct != 50 { t.Fatalf("roll below pct: %s %v", p, pct) }
+    if p, _ := FailureRampDecision(c, now, 0.51); p != ProfileClean { t.Fatalf("roll above pct: %s", p) }
+    if p, _ := FailureRampDecision(c, start, 0); p != ProfileClean { t.Fatalf("ramp start must never abort: %s", p) }
+}
+
+func TestStatusReportsRampPct(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileFailureRamp})
+    st := s.Status()
+    if st.RampAbortPct == nil || st.MaxPct != 100 || st.RampMinutes != 10 || st.RampShape != RampLinear { t.Fatalf("unexpected status %#v", st) }
+    s.Apply(Config{Profile: ProfileClean})
+    if s.Status().RampAbortPct != nil { t.Fatalf("ramp pct reported for CLEAN") }
+}
+
+func TestRampDownRate(t *testing.T) {
+    start := time.Unix(1700000000, 0)
+    c := Config{Profile: ProfileRampDown, BandwidthKbps: 1000, BandwidthFloorKbps: 200, RampSeconds: 10, UpdatedAt: start}
+    cases := []struct{ after time.Duration; want int }{
+        {-time.Second, 1000}, {0, 1000}, {5 * time.Second, 600}, {10 * time.Second, 200}, {time.Hour, 200},
+    }
+    for _, tc := range cases {
+        if got := c.RampDownRate(start.Add(tc.after)); got != tc.want { t.Errorf("after %v: kbps=%d want %d", tc.after, got, tc.want) }
+    }
+    if s := c.RampDownScale(start.Add(5 * time.Second)); s != 0.6 { t.Errorf("scale=%v want 0.6", s) }
+    flat := Config{Profile: ProfileRampDown, BandwidthKbps: 500, BandwidthFloorKbps: 500, RampSeconds: 10, UpdatedAt: start}
+    if got := flat.RampDownRate(start.Add(7 * time.Second)); got != 500 { t.Errorf("floor == start: kbps=%d", got) }
+}
+
+func TestRampDownDefaultsAndStatus(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileRampDown, BandwidthKbps: 2000})
+    st := s.Status()
+    if st.BandwidthFloorKbps != 200 || st.RampSeconds != 60 { t.Fatalf("defaults floor=%d ramp=%v", st.BandwidthFloorKbps, st.RampSeconds) }
+    if st.RampDownKbps == nil || *st.RampDownKbps > 2000 || *st.RampDownKbps < 1990 { t.Fatalf("status ramp_down_kbps=%v", st.RampDownKbps) }
+}
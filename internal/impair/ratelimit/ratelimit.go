@@ -0,0 +1,82 @@
+// Package ratelimit provides the byte-rate token bucket used to shape bandwidth.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket: tokens (bytes) accrue at Rate per second up to Burst.
+// It is safe for concurrent use, so one Limiter can cap the aggregate throughput of
+// many connections.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter allowing rate bytes/second with bursts of up to burst bytes.
+// The bucket starts full. burst < 1 is treated as 1.
+func New(rate float64, burst int) *Limiter {
+	burst = max(burst, 1)
+	return &Limiter{rate: rate, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Rate returns the refill rate in bytes per second.
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the refill rate. Tokens accrued so far are credited at the old rate;
+// callers already waiting keep their wake-up time, later ones are paced at the new rate.
+func (l *Limiter) SetRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	l.last = now
+	l.rate = rate
+}
+
+// Burst returns the bucket size in bytes.
+func (l *Limiter) Burst() int { return l.burst }
+
+// WaitN blocks until n bytes may be sent or ctx is done. n may exceed Burst: the
+// bucket goes into debt and later callers wait for it to be repaid, so the long-run
+// rate holds either way. Waiters are served in the order they called WaitN.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if n <= 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// give back the reservation so other waiters are not charged for it
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
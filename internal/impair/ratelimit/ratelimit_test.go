@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+    "context"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestWaitNPacesToRate(t *testing.T) {
+    l := New(10000, 1000) // 10 KB/s
+    start := time.Now()
+    for i := 0; i < 6; i++ { if err := l.WaitN(context.Background(), 1000); err != nil { t.Fatal(err) } }
+    // first 1000 bytes ride the full bucket, the other 5000 take 500ms
+    if d := time.Since(start); d < 450*time.Millisecond || d > 650*time.Millisecond { t.Fatalf("6000 bytes at 10KB/s took %v, want ~500ms", d) }
+}
+
+func TestWaitNLargerThanBurst(t *testing.T) {
+    l := New(10000, 100)
+    start := time.Now()
+    if err := l.WaitN(context.Background(), 100); err != nil { t.Fatal(err) }
+    if err := l.WaitN(context.Background(), 2000); err != nil { t.Fatal(err) }
+    if d := time.Since(start); d < 180*time.Millisecond { t.Fatalf("2000 bytes over a 100 byte bucket took %v, want ~200ms", d) }
+}
+
+func TestWaitNSharedAcrossGoroutines(t *testing.T) {
+    l := New(20000, 500)
+    start := time.Now()
+    var wg sync.WaitGroup
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func(){ defer wg.Done(); for i := 0; i < 5; i++ { l.WaitN(context.Background(), 500) } }()
+    }
+    wg.Wait()
+    // 10000 bytes in aggregate at 20KB/s, minus the initial burst
+    if d := time.Since(start); d < 420*time.Millisecond { t.Fatalf("aggregate not capped: 10000 bytes in %v", d) }
+}
+
+func TestWaitNCancel(t *testing.T) {
+    l := New(1000, 10)
+    l.WaitN(context.Background(), 10)
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    if err := l.WaitN(ctx, 5000); err == nil { t.Fatalf("WaitN ignored cancellation") }
+    if d := time.Since(start); d > 500*time.Millisecond { t.Fatalf("cancelled wait took %v", d) }
+    // the cancelled reservation was refunded: a small request does not inherit its 5s debt
+    start = time.Now()
+    l.WaitN(context.Background(), 10)
+    if d := time.Since(start); d > 200*time.Millisecond { t.Fatalf("refund missing, small wait took %v", d) }
+}
+
+func TestSetRateRepacesLaterWaits(t *testing.T) {
+    l := New(10000, 100)
+    l.WaitN(context.Background(), 100)
+    l.SetRate(2000) // 5x slower
+    start := time.Now()
+    if err := l.WaitN(context.Background(), 400); err != nil { t.Fatal(err) }
+    if d := time.Since(start); d < 180*time.Millisecond || d > 320*time.Millisecond { t.Fatalf("400 bytes at 2KB/s took %v, want ~200ms", d) }
+    if l.Rate() != 2000 { t.Fatalf("Rate()=%v", l.Rate()) }
+}
@@ -1,6 +1,7 @@
 package impair
 
 import (
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -13,6 +14,32 @@ const (
 	ProfileMTUBlackhole   ProfileName = "MTU1300_BLACKHOLE"
 	ProfileLatencyJitter  ProfileName = "LATENCY_50MS_JITTER_10" // placeholder
 	ProfileBandwidthLimit ProfileName = "BANDWIDTH_1MBPS"        // placeholder
+	ProfileRampDown       ProfileName = "BANDWIDTH_RAMP_DOWN" // bandwidth cap sliding from BandwidthKbps to BandwidthFloorKbps (brownout)
+	ProfileLoss           ProfileName = "PACKET_LOSS"
+	ProfileResetAfterBytes ProfileName = "RESET_AFTER_BYTES"
+	ProfileFailureRamp    ProfileName = "FAILURE_RAMP" // per-connection ABORT_AFTER_CH with rising probability
+	ProfileReorder        ProfileName = "REORDER"      // swap adjacent client->upstream chunks after the ClientHello
+	ProfileSlowDrip       ProfileName = "SLOW_DRIP"    // trickle client->upstream bytes after the ClientHello (slowloris)
+	ProfileCorrupt        ProfileName = "CORRUPT"      // flip bits in forwarded chunks after the ClientHello
+	ProfileStall          ProfileName = "STALL"        // freeze both directions for a while mid-stream
+	ProfileHalfClose      ProfileName = "HALF_CLOSE"   // half-close the upstream after some client bytes, keep relaying responses
+	ProfileInterceptTLS   ProfileName = "INTERCEPT_TLS" // terminate TLS with a cert for another host and redirect (captive portal / MITM box)
+	ProfileSlowHandshake  ProfileName = "SLOW_HANDSHAKE" // latency/bandwidth only until the TLS handshake completes, then passthrough
+	ProfileDelayFirstResponse ProfileName = "DELAY_FIRST_RESPONSE" // hold only the upstream's first chunk (time to first byte)
+)
+
+// MTU1300_BLACKHOLE directions.
+const (
+	BlackholeUp   = "up"   // client->upstream: the ClientHello is cut at the threshold (default)
+	BlackholeDown = "down" // upstream->client: the server's flight is cut at the threshold
+	BlackholeBoth = "both"
+)
+
+// CORRUPT directions.
+const (
+	CorruptUp   = "up"
+	CorruptDown = "down"
+	CorruptBoth = "both"
 )
 
 type Config struct {
@@ -20,9 +47,46 @@ type Config struct {
 	ThresholdBytes int        `json:"threshold_bytes,omitempty"`
 	LatencyMs     int         `json:"latency_ms,omitempty"`
 	JitterMs      int         `json:"jitter_ms,omitempty"`
+	LatencyDownMs int         `json:"latency_down_ms,omitempty"` // upstream->client delay per chunk (0 = no downstream delay)
+	JitterDownMs  int         `json:"jitter_down_ms,omitempty"`  // upstream->client jitter per chunk
+	JitterDistribution string `json:"jitter_distribution,omitempty"` // LATENCY: "uniform" (+/- jitter/2, default), "normal" (std dev jitter) or "pareto" (heavy tail averaging jitter)
+	JitterSeed    int64       `json:"jitter_seed,omitempty"`         // LATENCY: non-zero makes each connection's delay sequence reproducible
 	BandwidthKbps int         `json:"bandwidth_kbps,omitempty"` // client->upstream cap
 	BandwidthDownKbps int     `json:"bandwidth_down_kbps,omitempty"` // upstream->client cap
+	BurstBytes    int         `json:"burst_bytes,omitempty"`      // BANDWIDTH: token bucket size (default 100ms of the rate)
+	GlobalBandwidth bool      `json:"global_bandwidth,omitempty"` // BANDWIDTH: one bucket per direction shared by all connections
+	BandwidthFloorKbps int    `json:"bandwidth_floor_kbps,omitempty"` // BANDWIDTH_RAMP_DOWN: rate reached after RampSeconds (default BandwidthKbps/10)
+	RampSeconds   float64     `json:"ramp_seconds,omitempty"`         // BANDWIDTH_RAMP_DOWN: time from apply to the floor (default 60)
 	BlackholeSeconds int      `json:"blackhole_seconds,omitempty"`
+	BlackholeDirection string `json:"blackhole_direction,omitempty"` // MTU1300_BLACKHOLE: "up" (client->upstream, default), "down" or "both"
+	ApplyToRetryCH bool       `json:"apply_to_retry_ch,omitempty"` // MTU1300_BLACKHOLE: pass a first CH that fits and apply the threshold to the retried CH after an HRR
+	LossPercent   float64     `json:"loss_percent,omitempty"` // PACKET_LOSS: chance (0-100) each client->upstream chunk is dropped
+	ResetAfterBytes int       `json:"reset_after_bytes,omitempty"` // RESET_AFTER_BYTES: upstream->client bytes relayed before RST (default 64KB)
+	AbortAfterServerBytes int `json:"abort_after_server_bytes,omitempty"` // ABORT_AFTER_CH: upstream->client bytes (e.g. the ServerHello) relayed before the reset (0 = none)
+	MaxPct        float64     `json:"max_pct,omitempty"`      // FAILURE_RAMP: final abort probability (0-100, default 100)
+	RampMinutes   float64     `json:"ramp_minutes,omitempty"` // FAILURE_RAMP: time to reach MaxPct from apply (default 10)
+	RampShape     string      `json:"ramp_shape,omitempty"`   // FAILURE_RAMP: "linear" (default) or "exponential"
+	ReorderPercent float64    `json:"reorder_percent,omitempty"`      // REORDER: chance (0-100) a chunk is held back behind the next one (default 10)
+	ReorderWindowBytes int    `json:"reorder_window_bytes,omitempty"` // REORDER: chunk size reordering operates on (default 1460)
+	DripBytes     int         `json:"drip_bytes,omitempty"`       // SLOW_DRIP: bytes forwarded per interval (default 1)
+	DripIntervalMs int        `json:"drip_interval_ms,omitempty"` // SLOW_DRIP: pause between drips (default 100)
+	CorruptPercent float64    `json:"corrupt_percent,omitempty"`   // CORRUPT: chance (0-100) a forwarded chunk gets a bit flipped (default 1)
+	CorruptDirection string   `json:"corrupt_direction,omitempty"` // CORRUPT: "down" (upstream->client, default), "up" or "both"
+	StallAfterBytes int       `json:"stall_after_bytes,omitempty"` // STALL: total bytes proxied (both directions) before the freeze (default 16KB)
+	StallSeconds  float64     `json:"stall_seconds,omitempty"`     // STALL: how long nothing is forwarded either way (default 5)
+	HalfCloseAfterBytes int   `json:"half_close_after_bytes,omitempty"` // HALF_CLOSE: client bytes forwarded before the upstream write side is closed (the ClientHello always goes whole)
+	InterceptCN   string      `json:"intercept_cn,omitempty"`       // INTERCEPT_TLS: hostname on the presented cert (default captive.portal.local)
+	InterceptRedirect string  `json:"intercept_redirect,omitempty"` // INTERCEPT_TLS: Location of the canned 302 (default http://<intercept_cn>/)
+	FirstByteDelayMs int      `json:"first_byte_delay_ms,omitempty"` // DELAY_FIRST_RESPONSE: how long the upstream's first chunk is held (default 1000)
+	KeepAliveEnabled *bool    `json:"keepalive_enabled,omitempty"` // TCP keepalives on both legs: true forces them on, false off (unset = -keepalive)
+	KeepAliveIdleSeconds float64 `json:"keepalive_idle_seconds,omitempty"` // idle time before keepalive probes, and between them (0 = -keepalive-idle)
+	AlsoHoldMs    int         `json:"also_hold_ms,omitempty"` // keep the upstream socket open this long after the client closes
+	IdleTimeoutSeconds float64 `json:"idle_timeout_seconds,omitempty"` // close a connection idle (no byte either way) this long (0 = the -idle-timeout flag)
+	MaxConnSeconds float64    `json:"max_conn_seconds,omitempty"` // close a connection this long after it started, whatever it is doing (0 = no limit)
+	FirstContactKey string    `json:"first_contact_key,omitempty"` // FIRST_CONTACT modifier: "ip" or "ja3"; impair only a key's first connection
+	FirstContactTTLSeconds int `json:"first_contact_ttl_seconds,omitempty"` // how long a key stays "seen" (default 300)
+	ApplyPercent  float64     `json:"apply_percent,omitempty"` // share (0-100) of new connections that get the profile, the rest run CLEAN (0 = all)
+	DurationSeconds float64   `json:"duration_seconds,omitempty"` // revert to the previously active config after this long (0 = until changed)
 	Notes         string      `json:"notes,omitempty"`
 	UpdatedAt     time.Time   `json:"updated_at,omitempty"`
 }
@@ -30,13 +94,26 @@ type Config struct {
 type State struct {
 	mu   sync.RWMutex
 	curr Config
+	// Pending scheduled revert (DurationSeconds). gen invalidates a timer that fired
+	// but lost the race for mu against a newer Apply.
+	revert    *time.Timer
+	revertTo  Config
+	expiresAt time.Time
+	gen       uint64
+	presets   map[string]Preset // named configs (PUT /impair/presets/{name}), in memory only
+	rng       *rand.Rand        // ApplyPercent rolls; nil = math/rand's global source
+	watchers  map[int]watcher // OnChange and OnRevert hooks
+	nextWatch int
 }
 
-func (s *State) Apply(cfg Config) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	cfg.UpdatedAt = time.Now().UTC()
-	// sensible defaults
+// NewState returns a State holding cfg exactly as given (no defaults are filled in);
+// used for per-connection state seeded from an already resolved config.
+func NewState(cfg Config) *State {
+	return &State{curr: cfg}
+}
+
+// withDefaults fills in the defaults Apply uses for fields left at zero.
+func withDefaults(cfg Config) Config {
 	if cfg.Profile == "" {
 		cfg.Profile = ProfileClean
 	}
@@ -51,17 +128,216 @@ func (s *State) Apply(cfg Config) {
 		if cfg.JitterMs == 0 {
 			cfg.JitterMs = 10
 		}
+		if cfg.JitterDistribution == "" {
+			cfg.JitterDistribution = JitterUniform
+		}
+	}
+	if cfg.Profile == ProfileSlowHandshake && cfg.LatencyMs == 0 && cfg.BandwidthKbps == 0 {
+		cfg.LatencyMs = 200
 	}
 	// Bandwidth default (approx 1 Mbps) if not specified
-	if cfg.Profile == ProfileBandwidthLimit {
+	if cfg.Profile == ProfileBandwidthLimit || cfg.Profile == ProfileRampDown {
 		if cfg.BandwidthKbps == 0 {
 			cfg.BandwidthKbps = 1000
 		}
 	}
+	if cfg.Profile == ProfileRampDown {
+		if cfg.BandwidthFloorKbps <= 0 {
+			cfg.BandwidthFloorKbps = max(cfg.BandwidthKbps/10, 1)
+		}
+		if cfg.RampSeconds <= 0 {
+			cfg.RampSeconds = 60
+		}
+	}
+	if cfg.Profile == ProfileDelayFirstResponse && cfg.FirstByteDelayMs <= 0 {
+		cfg.FirstByteDelayMs = 1000
+	}
+	if cfg.Profile == ProfileResetAfterBytes && cfg.ResetAfterBytes <= 0 {
+		cfg.ResetAfterBytes = 64 * 1024
+	}
+	if cfg.Profile == ProfileFailureRamp {
+		if cfg.MaxPct <= 0 {
+			cfg.MaxPct = 100
+		}
+		if cfg.RampMinutes <= 0 {
+			cfg.RampMinutes = 10
+		}
+		if cfg.RampShape == "" {
+			cfg.RampShape = RampLinear
+		}
+	}
+	if cfg.Profile == ProfileReorder {
+		if cfg.ReorderPercent <= 0 {
+			cfg.ReorderPercent = 10
+		}
+		if cfg.ReorderWindowBytes <= 0 {
+			cfg.ReorderWindowBytes = 1460
+		}
+	}
+	// Slow drip defaults to 1 byte every 100ms (10 B/s) if not specified
+	if cfg.Profile == ProfileSlowDrip {
+		if cfg.DripBytes <= 0 {
+			cfg.DripBytes = 1
+		}
+		if cfg.DripIntervalMs <= 0 {
+			cfg.DripIntervalMs = 100
+		}
+	}
+	if cfg.Profile == ProfileCorrupt {
+		if cfg.CorruptPercent <= 0 {
+			cfg.CorruptPercent = 1
+		}
+		if cfg.CorruptDirection == "" {
+			cfg.CorruptDirection = CorruptDown
+		}
+	}
+	if cfg.Profile == ProfileStall {
+		if cfg.StallAfterBytes <= 0 {
+			cfg.StallAfterBytes = 16 * 1024
+		}
+		if cfg.StallSeconds <= 0 {
+			cfg.StallSeconds = 5
+		}
+	}
+	if cfg.Profile == ProfileInterceptTLS && cfg.InterceptCN == "" {
+		cfg.InterceptCN = "captive.portal.local"
+	}
+	if cfg.Profile == ProfileMTUBlackhole && cfg.BlackholeDirection == "" {
+		cfg.BlackholeDirection = BlackholeUp
+	}
 	if cfg.BlackholeSeconds <= 0 {
 		cfg.BlackholeSeconds = 30
 	}
+	if cfg.FirstContactKey != "" && cfg.FirstContactTTLSeconds <= 0 {
+		cfg.FirstContactTTLSeconds = 300
+	}
+	return cfg
+}
+
+// Apply validates cfg, fills in defaults and makes it the active config. An invalid
+// config is rejected with a *ValidationError and the active config is left as it was.
+func (s *State) Apply(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	cfg.UpdatedAt = time.Now().UTC()
+	cfg = withDefaults(cfg)
+	// A timed apply reverts to whatever was active before it; if another timed apply is
+	// still pending, that means the config before the first one, not the interim one.
+	base := s.curr
+	if s.revert != nil {
+		base = s.revertTo
+	}
+	s.cancelRevertLocked()
+	if cfg.DurationSeconds > 0 {
+		d := time.Duration(cfg.DurationSeconds * float64(time.Second))
+		gen := s.gen
+		s.revertTo = base
+		s.expiresAt = cfg.UpdatedAt.Add(d)
+		s.revert = time.AfterFunc(d, func() { s.expire(gen) })
+	}
 	s.curr = cfg
+	s.notifyAndUnlock(cfg, false)
+	return nil
+}
+
+// watcher is a registered OnChange (every change) or OnRevert (reverts only) hook.
+type watcher struct {
+	fn          func(Config)
+	revertsOnly bool
+}
+
+// OnChange registers fn to be called with the new config after each Apply and each
+// scheduled revert, on the goroutine making the change, until the returned function
+// is called. fn must return quickly and must not change s.
+func (s *State) OnChange(fn func(Config)) (remove func()) {
+	return s.watch(watcher{fn: fn})
+}
+
+// OnRevert is OnChange for scheduled reverts only: the changes no caller of Apply
+// sees happen.
+func (s *State) OnRevert(fn func(Config)) (remove func()) {
+	return s.watch(watcher{fn: fn, revertsOnly: true})
+}
+
+func (s *State) watch(w watcher) (remove func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers == nil {
+		s.watchers = map[int]watcher{}
+	}
+	id := s.nextWatch
+	s.nextWatch++
+	s.watchers[id] = w
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.watchers, id)
+	}
+}
+
+// notifyAndUnlock releases s.mu, which the caller holds, and calls the OnChange
+// hooks with cfg, and the OnRevert hooks too when the change is a revert.
+func (s *State) notifyAndUnlock(cfg Config, revert bool) {
+	hooks := make([]func(Config), 0, len(s.watchers))
+	for _, w := range s.watchers {
+		if revert || !w.revertsOnly {
+			hooks = append(hooks, w.fn)
+		}
+	}
+	s.mu.Unlock()
+	for _, fn := range hooks {
+		fn(cfg)
+	}
+}
+
+// cancelRevertLocked stops any pending scheduled revert. Callers hold s.mu.
+func (s *State) cancelRevertLocked() {
+	if s.revert != nil {
+		s.revert.Stop()
+	}
+	s.revert = nil
+	s.revertTo = Config{}
+	s.expiresAt = time.Time{}
+	s.gen++
+}
+
+// expire restores the config saved by the timed Apply that scheduled generation gen.
+func (s *State) expire(gen uint64) {
+	s.mu.Lock()
+	if gen != s.gen {
+		s.mu.Unlock()
+		return
+	}
+	prev := s.revertTo
+	s.cancelRevertLocked()
+	s.curr = prev
+	s.notifyAndUnlock(prev, true)
+}
+
+// SetRand makes ApplyPercent roll with r, for deterministic tests.
+func (s *State) SetRand(r *rand.Rand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rng = r
+}
+
+// RollApply decides, once per new connection, whether cfg's impairment applies to it:
+// with ApplyPercent set, it does with that probability; otherwise always.
+func (s *State) RollApply(cfg Config) bool {
+	if cfg.ApplyPercent <= 0 || cfg.ApplyPercent >= 100 {
+		return true
+	}
+	s.mu.Lock()
+	var roll float64
+	if s.rng != nil {
+		roll = s.rng.Float64()
+	} else {
+		roll = rand.Float64()
+	}
+	s.mu.Unlock()
+	return roll*100 < cfg.ApplyPercent
 }
 
 func (s *State) Get() Config {
@@ -73,3 +349,31 @@ func (s *State) Get() Config {
 func (s *State) Snapshot() Config {
 	return s.Get()
 }
+
+// Status is the /impair/status view: the active config plus values derived at read time.
+type Status struct {
+	Config
+	RampAbortPct *float64 `json:"failure_ramp_pct,omitempty"` // current FAILURE_RAMP abort probability
+	RampDownKbps *int `json:"ramp_down_kbps,omitempty"` // current BANDWIDTH_RAMP_DOWN client->upstream rate
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // when a DurationSeconds apply reverts
+}
+
+// Status returns the active config with derived runtime values.
+func (s *State) Status() Status {
+	s.mu.RLock()
+	st := Status{Config: s.curr}
+	if !s.expiresAt.IsZero() {
+		exp := s.expiresAt
+		st.ExpiresAt = &exp
+	}
+	s.mu.RUnlock()
+	if st.Profile == ProfileFailureRamp {
+		pct := st.FailureRampPct(time.Now())
+		st.RampAbortPct = &pct
+	}
+	if st.Profile == ProfileRampDown {
+		kbps := st.RampDownRate(time.Now())
+		st.RampDownKbps = &kbps
+	}
+	return st
+}
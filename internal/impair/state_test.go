@@ -1,8 +1,10 @@
 package impair
 
 import (
+    "math/rand"
     "sync"
     "testing"
+    "time"
 )
 
 func TestApplyAndSnapshot(t *testing.T) {
@@ -27,3 +29,101 @@ func TestConcurrentSnapshot(t *testing.T) {
     for i:=0;i<50;i++ { _ = s.Snapshot() }
     wg.Wait()
 }
+
+func TestDurationRevertsToPrevious(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileLatencyJitter, LatencyMs: 80})
+    s.Apply(Config{Profile: ProfileMTUBlackhole, DurationSeconds: 0.05})
+    st := s.Status()
+    if st.Profile != ProfileMTUBlackhole || st.ExpiresAt == nil { t.Fatalf("timed apply status %#v", st) }
+    if d := st.ExpiresAt.Sub(st.UpdatedAt); d != 50*time.Millisecond { t.Fatalf("expires_at - updated_at = %v", d) }
+    time.Sleep(150 * time.Millisecond)
+    st = s.Status()
+    if st.Profile != ProfileLatencyJitter || st.LatencyMs != 80 || st.ExpiresAt != nil {
+        t.Fatalf("not reverted to previous config: %#v", st)
+    }
+}
+
+func TestDurationRescheduleKeepsOriginalBase(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileClean})
+    s.Apply(Config{Profile: ProfileMTUBlackhole, DurationSeconds: 0.05})
+    s.Apply(Config{Profile: ProfileAbortAfterCH, DurationSeconds: 0.2})
+    time.Sleep(100 * time.Millisecond) // first revert would have fired by now
+    if p := s.Get().Profile; p != ProfileAbortAfterCH { t.Fatalf("earlier revert not cancelled, profile=%s", p) }
+    time.Sleep(200 * time.Millisecond)
+    if p := s.Get().Profile; p != ProfileClean { t.Fatalf("want revert to CLEAN, got %s", p) }
+}
+
+func TestPlainApplyCancelsRevert(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileMTUBlackhole, DurationSeconds: 0.05})
+    s.Apply(Config{Profile: ProfileLatencyJitter})
+    if s.Status().ExpiresAt != nil { t.Fatalf("expires_at still set after untimed apply") }
+    time.Sleep(100 * time.Millisecond)
+    if p := s.Get().Profile; p != ProfileLatencyJitter { t.Fatalf("cancelled revert fired, profile=%s", p) }
+}
+
+func TestConcurrentTimedApplies(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileClean})
+    wg := sync.WaitGroup{}
+    for i:=0;i<50;i++ { wg.Add(1); go func(){ defer wg.Done(); s.Apply(Config{Profile: ProfileAbortAfterCH, DurationSeconds: 0.02}) }() }
+    wg.Wait()
+    time.Sleep(100 * time.Millisecond)
+    if p := s.Get().Profile; p != ProfileClean { t.Fatalf("want CLEAN after all reverts, got %s", p) }
+    s.mu.RLock(); defer s.mu.RUnlock()
+    if s.revert != nil { t.Fatalf("timer still pending after expiry") }
+}
+
+func TestSlowDripDefaults(t *testing.T) {
+    s := &State{}
+    s.Apply(Config{Profile: ProfileSlowDrip})
+    if c := s.Get(); c.DripBytes != 1 || c.DripIntervalMs != 100 { t.Fatalf("slow drip defaults not applied: %#v", c) }
+    s.Apply(Config{Profile: ProfileSlowDrip, DripBytes: 16, DripIntervalMs: 250})
+    if c := s.Get(); c.DripBytes != 16 || c.DripIntervalMs != 250 { t.Fatalf("explicit drip settings overwritten: %#v", c) }
+}
+
+func TestRollApplyPercent(t *testing.T) {
+    s := &State{}
+    s.SetRand(rand.New(rand.NewSource(1)))
+    cfg := Config{Profile: ProfileAbortAfterCH, ApplyPercent: 25}
+    applied := 0
+    for i := 0; i < 10000; i++ { if s.RollApply(cfg) { applied++ } }
+    if applied < 2300 || applied > 2700 { t.Fatalf("%d of 10000 connections impaired at apply_percent=25", applied) }
+    // the same seed gives the same decisions
+    a, b := &State{}, &State{}
+    a.SetRand(rand.New(rand.NewSource(7))); b.SetRand(rand.New(rand.NewSource(7)))
+    for i := 0; i < 100; i++ { if a.RollApply(cfg) != b.RollApply(cfg) { t.Fatalf("roll %d differs under the same seed", i) } }
+    for _, pct := range []float64{0, 100} {
+        for i := 0; i < 100; i++ { if !s.RollApply(Config{Profile: ProfileAbortAfterCH, ApplyPercent: pct}) { t.Fatalf("apply_percent=%v skipped a connection", pct) } }
+    }
+}
+
+func TestOnChangeSeesAppliesAndReverts(t *testing.T) {
+    s := &State{}
+    got := make(chan ProfileName, 4)
+    remove := s.OnChange(func(c Config){ got <- c.Profile })
+    reverts := make(chan ProfileName, 4)
+    removeRevert := s.OnRevert(func(c Config){ reverts <- c.Profile })
+    if err := s.Apply(Config{Profile: ProfileAbortAfterCH}); err != nil { t.Fatal(err) }
+    if p := <-got; p != ProfileAbortAfterCH { t.Fatalf("hook saw %s", p) }
+    s.Apply(Config{Profile: ProfileStall, DurationSeconds: 0.05})
+    if p := <-got; p != ProfileStall { t.Fatalf("hook saw %s", p) }
+    select {
+    case p := <-got:
+        if p != ProfileAbortAfterCH { t.Fatalf("revert reported %s", p) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("no hook call for the revert")
+    }
+    select {
+    case p := <-reverts:
+        if p != ProfileAbortAfterCH || len(reverts) != 0 { t.Fatalf("OnRevert hook saw %s, then %d more", p, len(reverts)) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("no OnRevert hook call for the revert")
+    }
+    if err := s.Apply(Config{Profile: "NOPE"}); err == nil { t.Fatal("bad profile applied") }
+    remove(); removeRevert()
+    s.Apply(Config{Profile: ProfileClean})
+    if len(got) != 0 { t.Fatalf("hook called after a rejected apply or after remove: %s", <-got) }
+}
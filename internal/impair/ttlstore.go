@@ -0,0 +1,78 @@
+package impair
+
+import (
+	"sync"
+	"time"
+)
+
+// TTLStore remembers string keys for a limited time. Safe for concurrent use.
+type TTLStore struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+	touches int
+	Now     func() time.Time // injectable clock; defaults to time.Now
+}
+
+// NewTTLStore returns an empty store using the wall clock.
+func NewTTLStore() *TTLStore {
+	return &TTLStore{expires: make(map[string]time.Time), Now: time.Now}
+}
+
+// Touch reports whether key is absent (or expired) and, if so, records it for ttl.
+// A key that is still live is left untouched, so the window starts at first sight.
+func (s *TTLStore) Touch(key string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	s.touches++
+	if s.touches%256 == 0 {
+		for k, exp := range s.expires {
+			if !now.Before(exp) {
+				delete(s.expires, k)
+			}
+		}
+	}
+	if exp, ok := s.expires[key]; ok && now.Before(exp) {
+		return false
+	}
+	s.expires[key] = now.Add(ttl)
+	return true
+}
+
+// Len returns the number of keys currently stored (including not yet swept expired ones).
+func (s *TTLStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.expires)
+}
+
+// First-contact key sources for Config.FirstContactKey.
+const (
+	FirstContactByIP  = "ip"
+	FirstContactByJA3 = "ja3"
+)
+
+// FirstContact decides, for a config carrying the FIRST_CONTACT modifier, whether this
+// connection is the first from its key within the TTL and should therefore be impaired.
+// enabled is false when the modifier is not configured. A connection without a JA3
+// (its ClientHello did not parse) is keyed by its client address under "ja3", so
+// unparsed hellos from different clients are not lumped together.
+func FirstContact(store *TTLStore, cfg Config, clientIP, ja3 string) (first, enabled bool) {
+	var key string
+	switch cfg.FirstContactKey {
+	case FirstContactByIP:
+		key = "ip:" + clientIP
+	case FirstContactByJA3:
+		key = "ja3:" + ja3
+		if ja3 == "" {
+			key = "ip:" + clientIP
+		}
+	default:
+		return false, false
+	}
+	ttl := time.Duration(cfg.FirstContactTTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return store.Touch(key, ttl), true
+}
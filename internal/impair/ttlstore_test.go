@@ -0,0 +1,40 @@
+package impair
+
+import (
+    "testing"
+    "time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) now() time.Time { return f.t }
+
+func TestFirstContactExpiryReapplies(t *testing.T) {
+    clk := &fakeClock{t: time.Unix(1700000000, 0)}
+    store := NewTTLStore()
+    store.Now = clk.now
+    cfg := Config{Profile: ProfileAbortAfterCH, FirstContactKey: FirstContactByIP, FirstContactTTLSeconds: 60}
+    if first, on := FirstContact(store, cfg, "10.0.0.1", ""); !on || !first { t.Fatalf("first connection not penalized: first=%v enabled=%v", first, on) }
+    clk.t = clk.t.Add(30 * time.Second)
+    if first, _ := FirstContact(store, cfg, "10.0.0.1", ""); first { t.Fatalf("repeat connection inside TTL treated as first contact") }
+    if first, _ := FirstContact(store, cfg, "10.0.0.2", ""); !first { t.Fatalf("other client not treated as first contact") }
+    // The window starts at first sight; the repeat above must not have extended it.
+    clk.t = clk.t.Add(31 * time.Second)
+    if first, _ := FirstContact(store, cfg, "10.0.0.1", ""); !first { t.Fatalf("penalty did not re-apply after TTL expiry") }
+}
+
+func TestFirstContactByJA3AndDisabled(t *testing.T) {
+    store := NewTTLStore()
+    cfg := Config{FirstContactKey: FirstContactByJA3}
+    if first, _ := FirstContact(store, cfg, "10.0.0.1", "aaaa"); !first { t.Fatalf("first ja3 not first contact") }
+    if first, _ := FirstContact(store, cfg, "10.0.0.9", "aaaa"); first { t.Fatalf("same ja3 from another IP should not be first contact") }
+    if _, on := FirstContact(store, Config{}, "10.0.0.1", "aaaa"); on { t.Fatalf("modifier enabled without first_contact_key") }
+}
+
+func TestFirstContactByJA3WithoutJA3FallsBackToIP(t *testing.T) {
+    store := NewTTLStore()
+    cfg := Config{FirstContactKey: FirstContactByJA3}
+    if first, _ := FirstContact(store, cfg, "10.0.0.1", ""); !first { t.Fatalf("first unparsed hello not first contact") }
+    if first, _ := FirstContact(store, cfg, "10.0.0.2", ""); !first { t.Fatalf("unparsed hello from another client shared the empty ja3 key") }
+    if first, _ := FirstContact(store, cfg, "10.0.0.1", ""); first { t.Fatalf("repeat unparsed hello from the same client treated as first contact") }
+}
@@ -0,0 +1,126 @@
+package impair
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// MaxTLSRecordBytes is the largest TLS record on the wire: a 5-byte header and 2^14
+// bytes of plaintext. A ThresholdBytes above it never cuts a ClientHello record.
+const MaxTLSRecordBytes = 5 + 1<<14
+
+// FieldError describes one invalid Config field, named by its JSON key.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string { return e.Field + ": " + e.Message }
+
+// ValidationError lists every invalid field of a Config.
+type ValidationError struct {
+	Fields []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "invalid impairment config: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks cfg as given, before defaults are filled in (zero still means
+// "use the default"). It returns a *ValidationError naming every invalid field, or nil.
+func (c Config) Validate() error {
+	var v validator
+	if c.Profile != "" {
+		if _, ok := LookupProfile(c.Profile); !ok {
+			v.add("profile", "unknown profile %q", c.Profile)
+		}
+	}
+	if c.ThresholdBytes < 0 || c.ThresholdBytes > MaxTLSRecordBytes {
+		v.add("threshold_bytes", "must be between 0 and %d (the largest TLS record), got %d", MaxTLSRecordBytes, c.ThresholdBytes)
+	}
+	v.nonNegative("latency_ms", c.LatencyMs)
+	v.nonNegative("jitter_ms", c.JitterMs)
+	v.nonNegative("latency_down_ms", c.LatencyDownMs)
+	v.nonNegative("jitter_down_ms", c.JitterDownMs)
+	v.oneOf("jitter_distribution", c.JitterDistribution, JitterUniform, JitterNormal, JitterPareto)
+	v.nonNegative("bandwidth_kbps", c.BandwidthKbps)
+	v.nonNegative("bandwidth_down_kbps", c.BandwidthDownKbps)
+	v.nonNegative("burst_bytes", c.BurstBytes)
+	v.nonNegative("bandwidth_floor_kbps", c.BandwidthFloorKbps)
+	if c.BandwidthKbps > 0 && c.BandwidthFloorKbps > c.BandwidthKbps {
+		v.add("bandwidth_floor_kbps", "must not exceed bandwidth_kbps (%d), got %d", c.BandwidthKbps, c.BandwidthFloorKbps)
+	}
+	v.duration("ramp_seconds", c.RampSeconds)
+	v.nonNegative("blackhole_seconds", c.BlackholeSeconds)
+	v.oneOf("blackhole_direction", c.BlackholeDirection, BlackholeUp, BlackholeDown, BlackholeBoth)
+	v.percent("loss_percent", c.LossPercent)
+	v.nonNegative("reset_after_bytes", c.ResetAfterBytes)
+	v.nonNegative("abort_after_server_bytes", c.AbortAfterServerBytes)
+	v.percent("max_pct", c.MaxPct)
+	v.duration("ramp_minutes", c.RampMinutes)
+	v.oneOf("ramp_shape", c.RampShape, RampLinear, RampExponential)
+	v.percent("reorder_percent", c.ReorderPercent)
+	v.nonNegative("reorder_window_bytes", c.ReorderWindowBytes)
+	v.nonNegative("drip_bytes", c.DripBytes)
+	v.nonNegative("drip_interval_ms", c.DripIntervalMs)
+	v.percent("corrupt_percent", c.CorruptPercent)
+	v.oneOf("corrupt_direction", c.CorruptDirection, CorruptDown, CorruptUp, CorruptBoth)
+	v.nonNegative("stall_after_bytes", c.StallAfterBytes)
+	v.duration("stall_seconds", c.StallSeconds)
+	v.nonNegative("half_close_after_bytes", c.HalfCloseAfterBytes)
+	v.nonNegative("first_byte_delay_ms", c.FirstByteDelayMs)
+	v.nonNegative("also_hold_ms", c.AlsoHoldMs)
+	v.duration("keepalive_idle_seconds", c.KeepAliveIdleSeconds)
+	v.duration("max_conn_seconds", c.MaxConnSeconds)
+	v.duration("idle_timeout_seconds", c.IdleTimeoutSeconds)
+	v.oneOf("first_contact_key", c.FirstContactKey, FirstContactByIP, FirstContactByJA3)
+	v.nonNegative("first_contact_ttl_seconds", c.FirstContactTTLSeconds)
+	v.percent("apply_percent", c.ApplyPercent)
+	v.duration("duration_seconds", c.DurationSeconds)
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.errs}
+}
+
+type validator struct{ errs []FieldError }
+
+func (v *validator) add(field, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) nonNegative(field string, n int) {
+	if n < 0 {
+		v.add(field, "must be >= 0, got %d", n)
+	}
+}
+
+func (v *validator) duration(field string, f float64) {
+	if f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		v.add(field, "must be a finite number >= 0, got %g", f)
+	}
+}
+
+func (v *validator) percent(field string, f float64) {
+	if !(f >= 0 && f <= 100) {
+		v.add(field, "must be between 0 and 100, got %g", f)
+	}
+}
+
+// oneOf accepts s if it is empty (the default) or one of allowed.
+func (v *validator) oneOf(field, s string, allowed ...string) {
+	if s == "" {
+		return
+	}
+	for _, a := range allowed {
+		if s == a {
+			return
+		}
+	}
+	v.add(field, "must be one of %s, got %q", strings.Join(allowed, ", "), s)
+}
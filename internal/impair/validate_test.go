@@ -0,0 +1,111 @@
+package impair
+
+import (
+    "errors"
+    "math"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestValidateFieldBoundaries(t *testing.T) {
+    cases := []struct {
+        name  string
+        cfg   Config
+        field string // "" = valid
+    }{
+        {"empty", Config{}, ""},
+        {"unknown profile", Config{Profile: "WARP_SPEED"}, "profile"},
+        {"threshold zero", Config{ThresholdBytes: 0}, ""},
+        {"threshold max record", Config{ThresholdBytes: MaxTLSRecordBytes}, ""},
+        {"threshold over record", Config{ThresholdBytes: MaxTLSRecordBytes + 1}, "threshold_bytes"},
+        {"threshold negative", Config{ThresholdBytes: -1}, "threshold_bytes"},
+        {"latency zero", Config{Profile: ProfileLatencyJitter, LatencyMs: 0}, ""},
+        {"latency negative", Config{Profile: ProfileLatencyJitter, LatencyMs: -1}, "latency_ms"},
+        {"jitter negative", Config{JitterMs: -5}, "jitter_ms"},
+        {"latency down negative", Config{LatencyDownMs: -1}, "latency_down_ms"},
+        {"jitter down negative", Config{JitterDownMs: -1}, "jitter_down_ms"},
+        {"jitter distribution", Config{JitterDistribution: JitterPareto}, ""},
+        {"jitter distribution unknown", Config{JitterDistribution: "gamma"}, "jitter_distribution"},
+        {"bandwidth negative", Config{BandwidthKbps: -1}, "bandwidth_kbps"},
+        {"bandwidth down negative", Config{BandwidthDownKbps: -1}, "bandwidth_down_kbps"},
+        {"burst negative", Config{BurstBytes: -1}, "burst_bytes"},
+        {"floor equals start", Config{Profile: ProfileRampDown, BandwidthKbps: 500, BandwidthFloorKbps: 500}, ""},
+        {"floor above start", Config{Profile: ProfileRampDown, BandwidthKbps: 500, BandwidthFloorKbps: 501}, "bandwidth_floor_kbps"},
+        {"floor negative", Config{BandwidthFloorKbps: -1}, "bandwidth_floor_kbps"},
+        {"ramp seconds negative", Config{RampSeconds: -0.5}, "ramp_seconds"},
+        {"ramp seconds NaN", Config{RampSeconds: math.NaN()}, "ramp_seconds"},
+        {"blackhole negative", Config{BlackholeSeconds: -1}, "blackhole_seconds"},
+        {"blackhole down", Config{BlackholeDirection: BlackholeDown}, ""},
+        {"blackhole sideways", Config{BlackholeDirection: "sideways"}, "blackhole_direction"},
+        {"loss 0", Config{LossPercent: 0}, ""},
+        {"loss 100", Config{LossPercent: 100}, ""},
+        {"loss 500", Config{LossPercent: 500}, "loss_percent"},
+        {"loss negative", Config{LossPercent: -0.1}, "loss_percent"},
+        {"loss NaN", Config{LossPercent: math.NaN()}, "loss_percent"},
+        {"reset negative", Config{ResetAfterBytes: -1}, "reset_after_bytes"},
+        {"max pct 100", Config{MaxPct: 100}, ""},
+        {"max pct 101", Config{MaxPct: 101}, "max_pct"},
+        {"ramp minutes inf", Config{RampMinutes: math.Inf(1)}, "ramp_minutes"},
+        {"ramp shape exponential", Config{RampShape: RampExponential}, ""},
+        {"ramp shape unknown", Config{RampShape: "cubic"}, "ramp_shape"},
+        {"reorder 101", Config{ReorderPercent: 101}, "reorder_percent"},
+        {"reorder window negative", Config{ReorderWindowBytes: -1}, "reorder_window_bytes"},
+        {"drip bytes negative", Config{DripBytes: -1}, "drip_bytes"},
+        {"drip interval negative", Config{DripIntervalMs: -1}, "drip_interval_ms"},
+        {"corrupt 100", Config{CorruptPercent: 100}, ""},
+        {"corrupt 100.5", Config{CorruptPercent: 100.5}, "corrupt_percent"},
+        {"corrupt direction both", Config{CorruptDirection: CorruptBoth}, ""},
+        {"corrupt direction sideways", Config{CorruptDirection: "sideways"}, "corrupt_direction"},
+        {"stall after negative", Config{StallAfterBytes: -1}, "stall_after_bytes"},
+        {"stall seconds negative", Config{StallSeconds: -1}, "stall_seconds"},
+        {"half close negative", Config{HalfCloseAfterBytes: -1}, "half_close_after_bytes"},
+        {"also hold negative", Config{AlsoHoldMs: -1}, "also_hold_ms"},
+        {"first contact ja3", Config{FirstContactKey: FirstContactByJA3}, ""},
+        {"first contact mac", Config{FirstContactKey: "mac"}, "first_contact_key"},
+        {"first contact ttl negative", Config{FirstContactTTLSeconds: -1}, "first_contact_ttl_seconds"},
+        {"apply percent 100", Config{ApplyPercent: 100}, ""},
+        {"apply percent 120", Config{ApplyPercent: 120}, "apply_percent"},
+        {"duration negative", Config{DurationSeconds: -1}, "duration_seconds"},
+    }
+    for _, tc := range cases {
+        err := tc.cfg.Validate()
+        if tc.field == "" {
+            if err != nil { t.Errorf("%s: unexpected error %v", tc.name, err) }
+            continue
+        }
+        var verr *ValidationError
+        if !errors.As(err, &verr) { t.Errorf("%s: got %v, want a ValidationError", tc.name, err); continue }
+        if len(verr.Fields) != 1 || verr.Fields[0].Field != tc.field { t.Errorf("%s: fields %+v, want only %s", tc.name, verr.Fields, tc.field) }
+    }
+}
+
+func TestValidateReportsEveryField(t *testing.T) {
+    err := Config{Profile: ProfileLoss, LatencyMs: -10, LossPercent: 500, ThresholdBytes: 20000}.Validate()
+    var verr *ValidationError
+    if !errors.As(err, &verr) { t.Fatalf("got %v", err) }
+    var got []string
+    for _, f := range verr.Fields { got = append(got, f.Field) }
+    if strings.Join(got, ",") != "threshold_bytes,latency_ms,loss_percent" { t.Fatalf("fields %v", got) }
+    if msg := err.Error(); !strings.Contains(msg, "loss_percent: must be between 0 and 100, got 500") { t.Fatalf("message %q", msg) }
+}
+
+func TestApplyRejectsInvalidConfig(t *testing.T) {
+    s := &State{}
+    if err := s.Apply(Config{Profile: ProfileLatencyJitter, LatencyMs: 80}); err != nil { t.Fatal(err) }
+    before := s.Get()
+    if err := s.Apply(Config{Profile: ProfileLoss, LossPercent: 500, DurationSeconds: 0.01}); err == nil { t.Fatal("invalid config accepted") }
+    if got := s.Get(); got != before { t.Fatalf("active config changed to %#v", got) }
+    if st := s.Status(); st.ExpiresAt != nil { t.Fatal("rejected timed apply scheduled a revert") }
+}
+
+func TestApplyValidConfigFillsDefaultsAsBefore(t *testing.T) {
+    for _, name := range ProfileNames() {
+        s := &State{}
+        if err := s.Apply(Config{Profile: name}); err != nil { t.Fatalf("%s: %v", name, err) }
+        got := s.Get()
+        want := withDefaults(Config{Profile: name, UpdatedAt: got.UpdatedAt})
+        if !reflect.DeepEqual(got, want) { t.Errorf("%s: applied %#v, want %#v", name, got, want) }
+        if err := got.Validate(); err != nil { t.Errorf("%s: defaults do not validate: %v", name, err) }
+    }
+}
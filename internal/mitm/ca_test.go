@@ -0,0 +1,41 @@
+package mitm
+
+import (
+    "crypto/x509"
+    "os"
+    "path/filepath"
+    "encoding/pem"
+    "crypto/x509/pkix"
+    "testing"
+)
+
+func TestLeafChainsToCA(t *testing.T) {
+    ca, err := NewCA()
+    if err != nil { t.Fatal(err) }
+    leaf, err := ca.Leaf("captive.portal.local")
+    if err != nil { t.Fatal(err) }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(ca.CertPEM()) { t.Fatalf("CA PEM not parseable") }
+    if _, err := leaf.Leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "captive.portal.local"}); err != nil { t.Fatalf("leaf does not verify: %v", err) }
+    if _, err := leaf.Leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "example.com"}); err == nil { t.Fatalf("leaf verified for another hostname") }
+    again, _ := ca.Leaf("captive.portal.local")
+    if again != leaf { t.Fatalf("leaf not cached") }
+    ip, err := ca.Leaf("10.0.0.1")
+    if err != nil || len(ip.Leaf.IPAddresses) != 1 { t.Fatalf("IP leaf: %v %#v", err, ip.Leaf.IPAddresses) }
+}
+
+func TestLoadCA(t *testing.T) {
+    ca, err := NewCA()
+    if err != nil { t.Fatal(err) }
+    dir := t.TempDir()
+    keyDER, err := x509.MarshalPKCS8PrivateKey(ca.key)
+    if err != nil { t.Fatal(err) }
+    certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+    os.WriteFile(certFile, ca.CertPEM(), 0600)
+    os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+    loaded, err := LoadCA(certFile, keyFile)
+    if err != nil { t.Fatalf("load: %v", err) }
+    if loaded.cert.Subject.String() != (pkix.Name{CommonName: "PathLab Interception CA", Organization: []string{"PathLab"}}).String() { t.Fatalf("subject %s", loaded.cert.Subject) }
+    if _, err := loaded.Leaf("a.example"); err != nil { t.Fatalf("leaf from loaded CA: %v", err) }
+    if _, err := LoadCA(filepath.Join(dir, "missing.pem"), keyFile); err == nil { t.Fatalf("missing file accepted") }
+}
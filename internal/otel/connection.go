@@ -0,0 +1,156 @@
+package otel
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	"pathlab/internal/impair"
+	"pathlab/internal/receipts"
+	"pathlab/internal/trace"
+)
+
+// Span names of a connection's trace.
+const (
+	SpanConnection       = "connection"
+	SpanClientHelloParse = "clienthello_parse"
+	SpanUpstreamDial     = "upstream_dial"
+	SpanImpairment       = "impairment"
+)
+
+// Connection is what a proxied connection's spans are made of.
+type Connection struct {
+	Events  []trace.Event    // its timeline
+	Receipt receipts.Receipt // the receipt it ended with
+	Impair  *impair.Config   // the impairment it ran under; nil when it did not get that far
+}
+
+// ConnectionSpans returns the connection's trace: a root "connection" span from accept
+// to close carrying the receipt's outline, and a child span for each step its
+// timeline shows. clienthello_parse runs from the accept to ch_parsed, upstream_dial
+// from the event before upstream_dialed to it, and impairment from
+// impairment_applied to the close, with the profile and its parameters.
+func ConnectionSpans(c Connection) []Span {
+	if len(c.Events) == 0 {
+		return nil
+	}
+	r := c.Receipt
+	first, last := c.Events[0].At, c.Events[len(c.Events)-1].At
+	at := func(name string) (int, bool) {
+		for i, e := range c.Events {
+			if e.Name == name {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	tid := NewTraceID()
+	root := Span{TraceID: tid, SpanID: NewSpanID(), Name: SpanConnection, Kind: KindServer, Start: first, End: last, Attrs: []Attr{
+		{"pathlab.conn_id", r.ConnID},
+		{"client.address", r.ClientAddr},
+		{"pathlab.outcome", r.Outcome},
+	}}
+	optional := []Attr{
+		{"server.address", r.UpstreamAddr},
+		{"tls.server_name", r.SNI},
+		{"pathlab.profile", r.AppliedProfile},
+		{"pathlab.global_profile", r.GlobalProfile},
+		{"pathlab.rule", r.RuleMatched},
+		{"pathlab.bytes_up", r.BytesUp},
+		{"pathlab.bytes_down", r.BytesDown},
+	}
+	root.Attrs = appendSet(root.Attrs, optional...)
+	if r.Error != "" {
+		root.Status, root.Message = StatusError, r.Error
+	}
+	spans := []Span{root}
+	child := func(name string, start, end time.Time, attrs ...Attr) *Span {
+		spans = append(spans, Span{TraceID: tid, SpanID: NewSpanID(), Parent: root.SpanID, Name: name, Kind: KindInternal, Start: start, End: end, Attrs: appendSet(nil, attrs...)})
+		return &spans[len(spans)-1]
+	}
+
+	if i, ok := at(trace.CHParsed); ok {
+		s := child(SpanClientHelloParse, first, c.Events[i].At,
+			Attr{"tls.server_name", r.SNI},
+			Attr{"pathlab.ch_bytes", r.HandshakeBytes},
+			Attr{"pathlab.pqc_hint", r.PQCHint},
+			Attr{"pathlab.ja3", r.JA3})
+		if r.CHParseError != "" {
+			s.Status, s.Message = StatusError, r.CHParseError
+		}
+	}
+	if i, ok := at(trace.UpstreamDialed); ok && i > 0 {
+		child(SpanUpstreamDial, c.Events[i-1].At, c.Events[i].At,
+			Attr{"server.address", r.UpstreamAddr},
+			Attr{"pathlab.served_by", r.ServedBy},
+			Attr{"pathlab.dial_attempts", r.DialAttempts})
+	}
+	if i, ok := at(trace.ImpairmentApplied); ok {
+		attrs := []Attr{{"pathlab.profile", c.Events[i].Detail}}
+		if c.Impair != nil {
+			attrs = append(attrs, ImpairAttrs(*c.Impair)...)
+		}
+		child(SpanImpairment, c.Events[i].At, last, attrs...)
+	}
+	return spans
+}
+
+// ImpairAttrs returns cfg's parameters, each set field but the profile, notes and
+// update time, as pathlab.impair.<field> attributes in name order.
+func ImpairAttrs(cfg impair.Config) []Attr {
+	b, _ := json.Marshal(cfg)
+	var fields map[string]any
+	if json.Unmarshal(b, &fields) != nil {
+		return nil
+	}
+	delete(fields, "profile")
+	delete(fields, "notes")
+	delete(fields, "updated_at")
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out []Attr
+	for _, k := range keys {
+		v := fields[k]
+		if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			v = int64(f)
+		}
+		out = appendSet(out, Attr{"pathlab.impair." + k, v})
+	}
+	return out
+}
+
+// appendSet appends the attributes whose values are not zero: "", 0 or false.
+func appendSet(dst []Attr, attrs ...Attr) []Attr {
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+		case bool:
+			if !v {
+				continue
+			}
+		case int:
+			if v == 0 {
+				continue
+			}
+		case int64:
+			if v == 0 {
+				continue
+			}
+		case float64:
+			if v == 0 {
+				continue
+			}
+		case nil:
+			continue
+		}
+		dst = append(dst, a)
+	}
+	return dst
+}
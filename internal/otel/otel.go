@@ -0,0 +1,378 @@
+// Package otel exports PathLab's connections as traces over OTLP/HTTP with the JSON
+// encoding (-otlp-endpoint), built by hand rather than with the OpenTelemetry SDK.
+// Spans are queued and posted in batches by one goroutine; a collector that is down
+// or slow costs dropped spans and a log line, never a stalled connection.
+package otel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for an Exporter's zero Options.
+const (
+	DefaultService  = "pathlab"
+	DefaultBatch    = 512              // spans per request
+	DefaultInterval = 5 * time.Second  // longest a span waits for its batch
+	DefaultQueue    = 8192             // spans waiting to be sent; more are dropped
+	DefaultTimeout  = 10 * time.Second // per request
+	tracesPath      = "/v1/traces"
+	instrumentation = "pathlab/internal/otel"
+)
+
+// Span kinds and status codes, as OTLP numbers them.
+const (
+	KindInternal = 1
+	KindServer   = 2
+
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// TraceID and SpanID identify spans; they are written as hex.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+// NewTraceID returns a random trace id.
+func NewTraceID() (id TraceID) {
+	rand.Read(id[:])
+	return id
+}
+
+// NewSpanID returns a random span id.
+func NewSpanID() (id SpanID) {
+	rand.Read(id[:])
+	return id
+}
+
+// Attr is a span attribute; Value is a string, bool, an integer or a float64.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// Span is one finished span.
+type Span struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Parent  SpanID // zero for a root span
+	Name    string
+	Kind    int
+	Start   time.Time
+	End     time.Time
+	Attrs   []Attr
+	Status  int
+	Message string // with StatusError
+}
+
+// Options configure an Exporter.
+type Options struct {
+	Service  string        // service.name resource attribute; "" = DefaultService
+	Batch    int           // 0 = DefaultBatch
+	Interval time.Duration // 0 = DefaultInterval
+	Queue    int           // 0 = DefaultQueue
+	Timeout  time.Duration // 0 = DefaultTimeout
+	Client   *http.Client  // nil = a client with Timeout
+	Logf     func(format string, args ...any)
+}
+
+// Exporter posts spans to an OTLP/HTTP collector.
+type Exporter struct {
+	url    string
+	opts   Options
+	queue  chan Span
+	flush  chan chan struct{}
+	done   chan struct{}
+	closed sync.Once
+	exited chan struct{}
+
+	dropped  atomic.Int64 // spans the full queue turned away
+	exported atomic.Int64
+	failed   atomic.Int64 // spans in requests that failed
+}
+
+// Endpoint returns the traces URL for endpoint: a collector's base URL
+// (http://collector:4318) gets the OTLP path /v1/traces; a URL with a path is used
+// as it is.
+func Endpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q: want an http:// or https:// URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = tracesPath
+	}
+	return u.String(), nil
+}
+
+// NewExporter starts an Exporter posting to endpoint (see Endpoint).
+func NewExporter(endpoint string, opts Options) (*Exporter, error) {
+	u, err := Endpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Service == "" {
+		opts.Service = DefaultService
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = DefaultBatch
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = DefaultQueue
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	if opts.Logf == nil {
+		opts.Logf = log.Printf
+	}
+	e := &Exporter{url: u, opts: opts, queue: make(chan Span, opts.Queue), flush: make(chan chan struct{}), done: make(chan struct{}), exited: make(chan struct{})}
+	go e.run()
+	return e, nil
+}
+
+// Export queues spans without blocking; those that do not fit are dropped. A nil
+// Exporter exports nothing.
+func (e *Exporter) Export(spans ...Span) {
+	if e == nil {
+		return
+	}
+	for _, s := range spans {
+		select {
+		case <-e.done:
+			return
+		default:
+		}
+		select {
+		case e.queue <- s:
+		default:
+			e.dropped.Add(1)
+		}
+	}
+}
+
+// Flush sends the queued spans and waits for the request.
+func (e *Exporter) Flush() {
+	if e == nil {
+		return
+	}
+	ack := make(chan struct{})
+	select {
+	case e.flush <- ack:
+		<-ack
+	case <-e.exited:
+	}
+}
+
+// Close sends what is queued and stops the Exporter.
+func (e *Exporter) Close() {
+	if e == nil {
+		return
+	}
+	e.closed.Do(func() { close(e.done) })
+	<-e.exited
+}
+
+// Stats returns how many spans were exported, lost to failed requests and dropped
+// for want of queue space.
+func (e *Exporter) Stats() (exported, failed, dropped int64) {
+	return e.exported.Load(), e.failed.Load(), e.dropped.Load()
+}
+
+func (e *Exporter) run() {
+	defer close(e.exited)
+	t := time.NewTicker(e.opts.Interval)
+	defer t.Stop()
+	batch := make([]Span, 0, e.opts.Batch)
+	var reportedDrops int64
+	send := func() {
+		if n := e.dropped.Load(); n > reportedDrops {
+			e.opts.Logf("[otlp] queue full: %d spans dropped", n-reportedDrops)
+			reportedDrops = n
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil {
+			e.failed.Add(int64(len(batch)))
+			e.opts.Logf("[otlp] export of %d spans to %s failed: %v", len(batch), e.url, err)
+		} else {
+			e.exported.Add(int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-e.queue:
+				if batch = append(batch, s); len(batch) == e.opts.Batch {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) == e.opts.Batch {
+				send()
+			}
+		case <-t.C:
+			send()
+		case ack := <-e.flush:
+			drain()
+			close(ack)
+		case <-e.done:
+			drain()
+			return
+		}
+	}
+}
+
+// post sends one batch.
+func (e *Exporter) post(spans []Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The OTLP/JSON request body (ExportTraceServiceRequest).
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []jsonSpan `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	jsonSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            status     `json:"status"`
+	}
+	status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"` // int64 as a decimal string, per the proto3 JSON mapping
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+func (e *Exporter) request(spans []Span) exportRequest {
+	out := make([]jsonSpan, len(spans))
+	for i, s := range spans {
+		js := jsonSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        keyValues(s.Attrs),
+			Status:            status{Code: s.Status, Message: s.Message},
+		}
+		if s.Parent != (SpanID{}) {
+			js.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		out[i] = js
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: keyValues([]Attr{{"service.name", e.opts.Service}})},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: instrumentation}, Spans: out}},
+	}}}
+}
+
+func keyValues(attrs []Attr) []keyValue {
+	out := make([]keyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v anyValue
+		switch x := a.Value.(type) {
+		case string:
+			v.StringValue = &x
+		case bool:
+			v.BoolValue = &x
+		case int:
+			s := strconv.Itoa(x)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		out = append(out, keyValue{Key: a.Key, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,130 @@
+package otel
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/receipts"
+    "pathlab/internal/trace"
+)
+
+// collector is an OTLP/HTTP endpoint keeping the request bodies it gets.
+type collector struct {
+    mu     sync.Mutex
+    bodies []exportRequest
+    status int
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    c.mu.Lock(); defer c.mu.Unlock()
+    if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" { w.WriteHeader(404); return }
+    if c.status != 0 { w.WriteHeader(c.status); io.WriteString(w, "collector down"); return }
+    var req exportRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil { w.WriteHeader(400); return }
+    c.bodies = append(c.bodies, req)
+}
+
+func abortAfterCHConnection() Connection {
+    rec := trace.NewRecorder()
+    for _, step := range []struct{ name, detail string }{
+        {trace.CHParsed, `sni="a.test" ch_bytes=512`}, {trace.RuleMatched, "sni=a.test -> ABORT_AFTER_CH"},
+        {trace.UpstreamDialed, "127.0.0.1:9443, 1 attempts"}, {trace.ImpairmentApplied, "ABORT_AFTER_CH"}, {trace.Closed, "closed"},
+    } {
+        time.Sleep(time.Millisecond)
+        rec.Record(step.name, step.detail)
+    }
+    cfg := impair.Config{Profile: impair.ProfileAbortAfterCH, AbortAfterServerBytes: 120, Notes: "lab", UpdatedAt: time.Now()}
+    return Connection{Events: rec.Events(), Impair: &cfg, Receipt: receipts.Receipt{
+        ConnID: 7, ClientAddr: "10.0.0.9:50000", UpstreamAddr: "127.0.0.1:9443", ServedBy: "127.0.0.1:9443", DialAttempts: 1,
+        SNI: "a.test", HandshakeBytes: 512, AppliedProfile: "ABORT_AFTER_CH", Outcome: "closed",
+    }}
+}
+
+func attrs(kvs []keyValue) map[string]string {
+    out := map[string]string{}
+    for _, kv := range kvs {
+        v := kv.Value
+        switch {
+        case v.StringValue != nil: out[kv.Key] = *v.StringValue
+        case v.IntValue != nil: out[kv.Key] = "int:" + *v.IntValue
+        case v.BoolValue != nil: out[kv.Key] = fmt.Sprint(*v.BoolValue)
+        case v.DoubleValue != nil: out[kv.Key] = fmt.Sprint(*v.DoubleValue)
+        }
+    }
+    return out
+}
+
+func TestExportConnectionSpans(t *testing.T) {
+    col := &collector{}
+    srv := httptest.NewServer(col); defer srv.Close()
+    e, err := NewExporter(srv.URL, Options{Service: "lab-proxy", Interval: time.Hour})
+    if err != nil { t.Fatal(err) }
+    defer e.Close()
+    e.Export(ConnectionSpans(abortAfterCHConnection())...)
+    e.Flush()
+
+    col.mu.Lock(); defer col.mu.Unlock()
+    if len(col.bodies) != 1 || len(col.bodies[0].ResourceSpans) != 1 { t.Fatalf("collector got %+v", col.bodies) }
+    rs := col.bodies[0].ResourceSpans[0]
+    if attrs(rs.Resource.Attributes)["service.name"] != "lab-proxy" { t.Fatalf("resource %+v", rs.Resource) }
+    spans := rs.ScopeSpans[0].Spans
+    byName := map[string]jsonSpan{}
+    for _, s := range spans { byName[s.Name] = s }
+    if len(spans) != 4 || len(byName) != 4 { t.Fatalf("got %d spans: %+v", len(spans), spans) }
+    root := byName[SpanConnection]
+    if root.ParentSpanID != "" || root.Kind != KindServer || len(root.TraceID) != 32 || len(root.SpanID) != 16 { t.Fatalf("root span %+v", root) }
+    for _, name := range []string{SpanClientHelloParse, SpanUpstreamDial, SpanImpairment} {
+        s := byName[name]
+        if s.TraceID != root.TraceID || s.ParentSpanID != root.SpanID || s.Kind != KindInternal { t.Fatalf("%s not a child of the root: %+v", name, s) }
+        if s.StartTimeUnixNano < root.StartTimeUnixNano || s.EndTimeUnixNano > root.EndTimeUnixNano || s.EndTimeUnixNano < s.StartTimeUnixNano { t.Fatalf("%s outside the root: %+v vs %+v", name, s, root) }
+    }
+    if a := attrs(root.Attributes); a["pathlab.conn_id"] != "int:7" || a["client.address"] != "10.0.0.9:50000" || a["pathlab.outcome"] != "closed" || a["tls.server_name"] != "a.test" { t.Fatalf("root attributes %v", a) }
+    if a := attrs(byName[SpanClientHelloParse].Attributes); a["pathlab.ch_bytes"] != "int:512" { t.Fatalf("clienthello_parse attributes %v", a) }
+    if a := attrs(byName[SpanUpstreamDial].Attributes); a["server.address"] != "127.0.0.1:9443" || a["pathlab.dial_attempts"] != "int:1" { t.Fatalf("upstream_dial attributes %v", a) }
+    imp := attrs(byName[SpanImpairment].Attributes)
+    if imp["pathlab.profile"] != "ABORT_AFTER_CH" || imp["pathlab.impair.abort_after_server_bytes"] != "int:120" { t.Fatalf("impairment attributes %v", imp) }
+    for _, k := range []string{"pathlab.impair.notes", "pathlab.impair.updated_at", "pathlab.impair.profile"} {
+        if _, ok := imp[k]; ok { t.Fatalf("%s exported as a parameter", k) }
+    }
+    if exported, failed, dropped := e.Stats(); exported != 4 || failed != 0 || dropped != 0 { t.Fatalf("stats %d %d %d", exported, failed, dropped) }
+}
+
+func TestExportFailureIsLoggedNotBlocking(t *testing.T) {
+    col := &collector{status: 503}
+    srv := httptest.NewServer(col); defer srv.Close()
+    var mu sync.Mutex
+    var logged []string
+    logf := func(format string, args ...any) { mu.Lock(); logged = append(logged, fmt.Sprintf(format, args...)); mu.Unlock() }
+    e, err := NewExporter(srv.URL+"/v1/traces", Options{Interval: time.Hour, Queue: 4, Logf: logf})
+    if err != nil { t.Fatal(err) }
+    spans := ConnectionSpans(abortAfterCHConnection())
+    done := make(chan struct{})
+    go func(){ for i := 0; i < 100; i++ { e.Export(spans...) }; close(done) }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("Export blocked on a full queue")
+    }
+    e.Close()
+    exported, failed, dropped := e.Stats()
+    if exported != 0 || failed == 0 || dropped == 0 || failed+dropped != 400 { t.Fatalf("stats exported=%d failed=%d dropped=%d", exported, failed, dropped) }
+    mu.Lock(); defer mu.Unlock()
+    if all := strings.Join(logged, "\n"); !strings.Contains(all, "503") || !strings.Contains(all, "dropped") { t.Fatalf("logged %q", all) }
+}
+
+func TestEndpoint(t *testing.T) {
+    for in, want := range map[string]string{"http://c:4318": "http://c:4318/v1/traces", "https://c/": "https://c/v1/traces", "http://c:4318/custom": "http://c:4318/custom"} {
+        if got, err := Endpoint(in); err != nil || got != want { t.Errorf("Endpoint(%q) = %q, %v; want %q", in, got, err, want) }
+    }
+    for _, bad := range []string{"c:4318", "ftp://c/", "http://"} {
+        if _, err := Endpoint(bad); err == nil { t.Errorf("Endpoint(%q) accepted", bad) }
+    }
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+    "io"
+    "log"
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+// startCountingUpstream reads a ClientHello of chLen bytes and then want bytes per
+// connection, reporting when each connection's payload was complete.
+func startCountingUpstream(t *testing.T, chLen, want int) (addr string, done <-chan time.Time, closeFn func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    out := make(chan time.Time, 8)
+    go func(){
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func(c net.Conn){
+                defer c.Close()
+                if _, err := io.ReadFull(c, make([]byte, chLen+want)); err == nil { out <- time.Now() }
+            }(c)
+        }
+    }()
+    return ln.Addr().String(), out, func(){ ln.Close() }
+}
+
+// within asserts got is within 20% of want.
+func within(t *testing.T, got, want time.Duration) {
+    t.Helper()
+    if got < want*8/10 || got > want*12/10 { t.Fatalf("transfer took %v, want %v ±20%%", got, want) }
+}
+
+func TestBandwidthUp64KBAt64kbps(t *testing.T) {
+    t.Parallel()
+    ch := minimalClientHello()
+    upstream, done, closeUp := startCountingUpstream(t, len(ch), 64*1024); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    cfg := impair.Config{Profile: impair.ProfileBandwidthLimit, BandwidthKbps: 64}
+    go HandleConnection(c2, upstream, cfg, 20, log.New(io.Discard, "", 0))
+    c1.Write(ch)
+    start := time.Now()
+    go c1.Write(make([]byte, 64*1024))
+    select {
+    case at := <-done:
+        within(t, at.Sub(start), 65536*time.Second/8000)
+    case <-time.After(20 * time.Second):
+        t.Fatalf("upstream never received the payload")
+    }
+}
+
+func TestBandwidthDown64KBAt64kbps(t *testing.T) {
+    t.Parallel()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    ch := minimalClientHello()
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        io.ReadFull(c, make([]byte, len(ch)))
+        c.Write(make([]byte, 64*1024))
+        io.Copy(io.Discard, c)
+    }()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    cfg := impair.Config{Profile: impair.ProfileBandwidthLimit, BandwidthKbps: 1000, BandwidthDownKbps: 64}
+    go HandleConnection(c2, ln.Addr().String(), cfg, 21, log.New(io.Discard, "", 0))
+    start := time.Now()
+    c1.Write(ch)
+    _ = c1.SetReadDeadline(time.Now().Add(20 * time.Second))
+    if _, err := io.ReadFull(c1, make([]byte, 64*1024)); err != nil { t.Fatalf("read: %v", err) }
+    within(t, time.Since(start), 65536*time.Second/8000)
+}
+
+func TestBandwidthGlobalCapsAggregate(t *testing.T) {
+    t.Parallel()
+    ch := minimalClientHello()
+    const per = 16 * 1024
+    upstream, done, closeUp := startCountingUpstream(t, len(ch), per); defer closeUp()
+    // 256kbps = 32000 B/s shared: 32KB in aggregate takes ~1s, versus ~0.5s per connection alone
+    cfg := impair.Config{Profile: impair.ProfileBandwidthLimit, BandwidthKbps: 256, GlobalBandwidth: true, UpdatedAt: time.Now()}
+    start := time.Now()
+    var wg sync.WaitGroup
+    for i := 0; i < 2; i++ {
+        c1, c2 := net.Pipe()
+        defer c1.Close()
+        go HandleConnection(c2, upstream, cfg, int64(22+i), log.New(io.Discard, "", 0))
+        wg.Add(1)
+        go func(){ defer wg.Done(); c1.Write(ch); c1.Write(make([]byte, per)) }()
+    }
+    var last time.Time
+    for i := 0; i < 2; i++ {
+        select {
+        case last = <-done:
+        case <-time.After(10 * time.Second):
+            t.Fatalf("upstream never received both payloads")
+        }
+    }
+    within(t, last.Sub(start), 2*per*time.Second/32000)
+    wg.Wait()
+}
+
+func TestSharedLimitersPerOverlayRate(t *testing.T) {
+    // Two rules overlay the same global apply with different rates.
+    base := impair.Config{Profile: impair.ProfileBandwidthLimit, GlobalBandwidth: true, UpdatedAt: time.Now()}
+    slow, fast := base, base
+    slow.BandwidthKbps, fast.BandwidthKbps = 256, 2048
+    s1, s2 := bandwidthLimiter(slow, "up", 256), bandwidthLimiter(slow, "up", 256)
+    f1 := bandwidthLimiter(fast, "up", 2048)
+    if s1 != s2 { t.Fatalf("connections under the same overlay got separate buckets") }
+    if f1 == s1 { t.Fatalf("overlays at 256 and 2048 kbps share one bucket") }
+    if s1.Rate() != 32000 || f1.Rate() != 256000 { t.Fatalf("rates %g and %g, want 32000 and 256000", s1.Rate(), f1.Rate()) }
+    if bandwidthLimiter(slow, "down", 256) == s1 { t.Fatalf("directions share a bucket") }
+    burst := slow
+    burst.BurstBytes = 1000
+    if bandwidthLimiter(burst, "up", 256) == s1 { t.Fatalf("different burst_bytes share a bucket") }
+    // the slow overlay still has its bucket after the fast one was made
+    if bandwidthLimiter(slow, "up", 256) != s1 { t.Fatalf("slow overlay's bucket was replaced") }
+    next := slow
+    next.UpdatedAt = base.UpdatedAt.Add(time.Second)
+    if bandwidthLimiter(next, "up", 256) == s1 { t.Fatalf("a new apply reused the previous apply's bucket") }
+}
+
+// rampUpload sends 16KB through cfg and returns how long the upstream took to get it
+// and the Stats of the connection.
+func rampUpload(t *testing.T, cfg impair.Config, id int64) (time.Duration, Stats) {
+    ch := minimalClientHello()
+    const per = 16 * 1024
+    upstream, done, closeUp := startCountingUpstream(t, len(ch), per); defer closeUp()
+    c1, c2 := net.Pipe()
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, cfg, id, log.New(io.Discard, "", 0)); statsc <- st }()
+    c1.Write(ch)
+    start := time.Now()
+    go c1.Write(make([]byte, per))
+    var took time.Duration
+    select {
+    case at := <-done:
+        took = at.Sub(start)
+    case <-time.After(20 * time.Second):
+        t.Fatalf("upstream never received the payload")
+    }
+    c1.Close()
+    return took, <-statsc
+}
+
+func TestBandwidthRampDownSlowsTheLink(t *testing.T) {
+    t.Parallel()
+    // 256kbps (32KB/s) falling to 16kbps (2KB/s) within 0.5s: ~11.7KB make it before the
+    // floor, the rest crawls at 2KB/s, ~2.6s in all versus ~0.4s at the start rate
+    cfg := impair.Config{Profile: impair.ProfileRampDown, BandwidthKbps: 256, BandwidthFloorKbps: 16, RampSeconds: 0.5, UpdatedAt: time.Now()}
+    took, st := rampUpload(t, cfg, 24)
+    if took < 1500*time.Millisecond || took > 4*time.Second { t.Fatalf("ramped upload took %v, want ~2.6s", took) }
+    if st.FinalKbps != 16 { t.Fatalf("FinalKbps = %d, want the 16kbps floor", st.FinalKbps) }
+}
+
+func TestBandwidthRampDownFloorEqualsStartIsFixedCap(t *testing.T) {
+    t.Parallel()
+    fixed := impair.Config{Profile: impair.ProfileBandwidthLimit, BandwidthKbps: 64, UpdatedAt: time.Now()}
+    flat := impair.Config{Profile: impair.ProfileRampDown, BandwidthKbps: 64, BandwidthFloorKbps: 64, RampSeconds: 1, UpdatedAt: time.Now()}
+    want, _ := rampUpload(t, fixed, 25)
+    got, st := rampUpload(t, flat, 26)
+    within(t, got, want)
+    if st.FinalKbps != 64 { t.Fatalf("FinalKbps = %d, want 64", st.FinalKbps) }
+}
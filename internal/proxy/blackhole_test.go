@@ -0,0 +1,75 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/rules"
+    "pathlab/internal/tlsinspect"
+)
+
+// blackholeRun sends ch through MTU1300_BLACKHOLE to an upstream that answers the first
+// ch-sized read with a 5000-byte flight; it returns what each side received and the stats.
+func blackholeRun(t *testing.T, ch []byte, cfg impair.Config) (upGot, clientGot []byte, st Stats) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    upc := make(chan []byte, 1)
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        _ = c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+        b, _ := io.ReadAll(c) // until the deadline: whatever made it through
+        c.Write(bytes.Repeat([]byte("s"), 5000))
+        upc <- b
+    }()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, ln.Addr().String(), cfg, 40, log.New(io.Discard, "", 0)); statsc <- st }()
+    go c1.Write(ch)
+    _ = c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+    clientGot, _ = io.ReadAll(c1)
+    return <-upc, clientGot, <-statsc
+}
+
+func TestMTUBlackholeDown(t *testing.T) {
+    ch := minimalClientHello()
+    up, down, st := blackholeRun(t, ch, impair.Config{Profile: impair.ProfileMTUBlackhole, BlackholeDirection: impair.BlackholeDown, ThresholdBytes: 1300, BlackholeSeconds: 1})
+    if !bytes.Equal(up, ch) { t.Fatalf("upstream got %d bytes, want the whole %d-byte ClientHello", len(up), len(ch)) }
+    if len(down) != 1300 { t.Fatalf("client got %d bytes of the server flight, want 1300", len(down)) }
+    if st.BlackholeDir != impair.BlackholeDown || st.DroppedDown != 3700 { t.Fatalf("stats dir=%q dropped_down=%d", st.BlackholeDir, st.DroppedDown) }
+}
+
+func TestMTUBlackholeBoth(t *testing.T) {
+    ch := minimalClientHello()
+    up, down, st := blackholeRun(t, ch, impair.Config{Profile: impair.ProfileMTUBlackhole, BlackholeDirection: impair.BlackholeBoth, ThresholdBytes: 20, BlackholeSeconds: 1})
+    if len(up) != 20 || len(down) != 20 { t.Fatalf("upstream got %d, client got %d, want 20 each", len(up), len(down)) }
+    if st.BlackholeDir != impair.BlackholeBoth || st.DroppedDown != 4980 { t.Fatalf("stats dir=%q dropped_down=%d", st.BlackholeDir, st.DroppedDown) }
+}
+
+func TestMTUBlackholeUpLeavesServerFlight(t *testing.T) {
+    up, down, st := blackholeRun(t, minimalClientHello(), impair.Config{Profile: impair.ProfileMTUBlackhole, ThresholdBytes: 20, BlackholeSeconds: 1})
+    if len(up) != 20 || len(down) != 5000 { t.Fatalf("upstream got %d, client got %d, want 20 and 5000", len(up), len(down)) }
+    if st.BlackholeDir != impair.BlackholeUp || st.DroppedDown != 0 { t.Fatalf("stats dir=%q dropped_down=%d", st.BlackholeDir, st.DroppedDown) }
+}
+
+func TestRuleParamsReachHandler(t *testing.T) {
+    // the threshold comes from the rule, not the base config, as main.go resolves it
+    set, err := rules.Parse(bytes.NewReader([]byte("when ch_bytes > 10 then MTU1300_BLACKHOLE threshold_bytes=20 blackhole_seconds=1")))
+    if err != nil { t.Fatal(err) }
+    ch := minimalClientHello()
+    _, res, err := tlsinspect.ParseClientHello(bytes.NewReader(ch))
+    if err != nil { t.Fatal(err) }
+    ru, ok := set.MatchRule(res)
+    if !ok { t.Fatalf("rule did not match") }
+    cfg, _ := ru.Config(impair.Config{Profile: impair.ProfileClean, ThresholdBytes: 1300, BlackholeSeconds: 30}, nil)
+    up, down, _ := blackholeRun(t, ch, cfg)
+    if len(up) != 20 || len(down) != 5000 { t.Fatalf("upstream got %d, client got %d, want 20 and 5000", len(up), len(down)) }
+}
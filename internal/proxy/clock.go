@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeClock times a relay's first round trip: from the first write toward the
+// upstream (the ClientHello) to the first byte read back from it.
+type handshakeClock struct {
+	sent atomic.Int64 // unix nanos of the first completed upstream write
+	resp atomic.Int64 // unix nanos of the first upstream byte
+}
+
+type clockWriter struct {
+	io.Writer
+	c *handshakeClock
+}
+
+func (w clockWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.c.sent.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+type clockReader struct {
+	io.Reader
+	c *handshakeClock
+}
+
+func (r clockReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.c.resp.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *handshakeClock) sentWriter(w io.Writer) io.Writer { return clockWriter{Writer: w, c: c} }
+func (c *handshakeClock) respReader(r io.Reader) io.Reader { return clockReader{Reader: r, c: c} }
+
+// elapsed returns the measured round trip, or 0 if the upstream never answered a
+// forwarded ClientHello (or spoke first).
+func (c *handshakeClock) elapsed() time.Duration {
+	sent, resp := c.sent.Load(), c.resp.Load()
+	if sent == 0 || resp < sent {
+		return 0
+	}
+	return time.Duration(resp - sent)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Overflow policies for a ConnLimiter at its limit.
+const (
+	OverflowReject = "reject" // reset the new connection at once
+	OverflowQueue  = "queue"  // hold it until a slot frees or the queue timeout passes
+)
+
+// Errors returned by ConnLimiter.Admit; the connection has been reset when they are.
+var (
+	ErrConnRejected  = errors.New("connection limit reached")
+	ErrQueueTimedOut = errors.New("timed out waiting for a connection slot")
+)
+
+// ConnLimiter caps the connections proxied at once (-max-conns). A nil *ConnLimiter
+// admits everything.
+type ConnLimiter struct {
+	slots        chan struct{}
+	overflow     string
+	queueTimeout time.Duration
+}
+
+// NewConnLimiter returns a limiter for max concurrent connections with the given
+// overflow policy, or nil when max <= 0 (unlimited). queueTimeout bounds how long
+// OverflowQueue holds a connection.
+func NewConnLimiter(max int, overflow string, queueTimeout time.Duration) *ConnLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &ConnLimiter{slots: make(chan struct{}, max), overflow: overflow, queueTimeout: queueTimeout}
+}
+
+// Admit takes a slot for c, waiting under OverflowQueue, and reports how long it
+// waited. When no slot is had it resets c (RST) and returns ErrConnRejected or
+// ErrQueueTimedOut. Every successful Admit must be paired with Release.
+func (l *ConnLimiter) Admit(c net.Conn) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return 0, nil
+	default:
+	}
+	if l.overflow != OverflowQueue {
+		abortConn(c)
+		return 0, ErrConnRejected
+	}
+	start := time.Now()
+	t := time.NewTimer(l.queueTimeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return time.Since(start), nil
+	case <-t.C:
+		abortConn(c)
+		return time.Since(start), ErrQueueTimedOut
+	}
+}
+
+// Release frees the slot taken by a successful Admit.
+func (l *ConnLimiter) Release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// InUse returns the number of slots taken.
+func (l *ConnLimiter) InUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+    "errors"
+    "net"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// limitedServer accepts on a loopback listener, admitting each connection through l
+// and reporting Admit's result; admitted connections stay open until the test ends.
+func limitedServer(t *testing.T, l *ConnLimiter) (string, chan error) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    t.Cleanup(func(){ ln.Close() })
+    results := make(chan error, 16)
+    go func(){
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func(){
+                _, err := l.Admit(c)
+                if err == nil { t.Cleanup(func(){ c.Close() }) }
+                results <- err
+            }()
+        }
+    }()
+    return ln.Addr().String(), results
+}
+
+func TestConnLimiterRejectsOverLimit(t *testing.T) {
+    const limit = 3
+    l := NewConnLimiter(limit, OverflowReject, 0)
+    addr, results := limitedServer(t, l)
+    for i := 0; i < limit; i++ {
+        c, err := net.Dial("tcp", addr)
+        if err != nil { t.Fatalf("dial %d: %v", i, err) }
+        defer c.Close()
+        if err := <-results; err != nil { t.Fatalf("conn %d not admitted: %v", i, err) }
+    }
+    extra, err := net.Dial("tcp", addr)
+    if err != nil { t.Fatalf("dial extra: %v", err) }
+    defer extra.Close()
+    start := time.Now()
+    if err := <-results; !errors.Is(err, ErrConnRejected) { t.Fatalf("extra conn: %v, want ErrConnRejected", err) }
+    _ = extra.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, err = extra.Read(make([]byte, 1))
+    if !errors.Is(err, syscall.ECONNRESET) { t.Fatalf("extra conn read: %v, want connection reset", err) }
+    if d := time.Since(start); d > 500*time.Millisecond { t.Fatalf("reset took %v", d) }
+    if n := l.InUse(); n != limit { t.Fatalf("in use %d, want %d", n, limit) }
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+    l := NewConnLimiter(1, OverflowQueue, 200*time.Millisecond)
+    a, b := net.Pipe()
+    defer a.Close(); defer b.Close()
+    if _, err := l.Admit(a); err != nil { t.Fatalf("first admit: %v", err) }
+    // queued until the slot frees
+    go func(){ time.Sleep(50 * time.Millisecond); l.Release() }()
+    waited, err := l.Admit(b)
+    if err != nil { t.Fatalf("queued admit: %v", err) }
+    if waited < 40*time.Millisecond { t.Fatalf("waited %v, want ~50ms", waited) }
+    // nobody releases: the queue times out
+    c, d := net.Pipe()
+    defer d.Close()
+    waited, err = l.Admit(c)
+    if !errors.Is(err, ErrQueueTimedOut) { t.Fatalf("admit: %v, want ErrQueueTimedOut", err) }
+    if waited < 200*time.Millisecond { t.Fatalf("gave up after %v, want the 200ms queue timeout", waited) }
+}
+
+func TestConnLimiterNilUnlimited(t *testing.T) {
+    l := NewConnLimiter(0, OverflowReject, 0)
+    if l != nil { t.Fatal("max 0 should mean no limiter") }
+    if _, err := l.Admit(nil); err != nil { t.Fatalf("nil limiter admit: %v", err) }
+    l.Release()
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// countingConn counts the bytes written through it, so every profile handler gets
+// byte counts (Stats.BytesUp, BytesDown) without doing its own bookkeeping, copies
+// them to an optional tee and a Tracker (through track) and reports each successful
+// read and write to an optional idleWatch.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+	first   atomic.Int64  // unix nanos of the first byte written (0 = none yet)
+	idle    *idleWatch    // set before the handler starts (nil = no idle timeout)
+	tee     io.Writer     // also gets every byte written (-mirror; nil = none)
+	cut     chan struct{} // client side: closed when MaxConnSeconds ends the connection (nil = no limit)
+	track   func(int64)   // Tracker.AddUp or AddDown for the connection (nil = untracked)
+	onFirst func()        // called after the first byte is written (nil = none)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.idle != nil {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		if c.tee != nil {
+			_, _ = c.tee.Write(b[:n])
+		}
+		if c.track != nil {
+			c.track(int64(n))
+		}
+		if c.written.Add(int64(n)) == int64(n) {
+			c.first.Store(time.Now().UnixNano())
+			if c.onFirst != nil {
+				c.onFirst()
+			}
+		}
+		if c.idle != nil {
+			c.idle.touch()
+		}
+	}
+	return n, err
+}
+
+// firstWriteAfter returns how long after start the first byte was written through
+// c, or 0 when nothing was.
+func (c *countingConn) firstWriteAfter(start time.Time) time.Duration {
+	f := c.first.Load()
+	if f == 0 {
+		return 0
+	}
+	return time.Unix(0, f).Sub(start)
+}
+
+// baseConn returns the connection under PathLab's pass-through wrappers
+// (countingConn, PeekedConn, and anything with a NetConn method such as a PROXY
+// protocol conn or holdConn), so socket options, half-closes and resets reach the
+// socket. Only a plain Close through holdConn is deferred.
+func baseConn(c net.Conn) net.Conn {
+	for {
+		switch w := c.(type) {
+		case *countingConn:
+			c = w.Conn
+		case *PeekedConn:
+			c = w.Conn
+		case interface{ NetConn() net.Conn }:
+			c = w.NetConn()
+		default:
+			return c
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+
+    "pathlab/internal/impair"
+)
+
+// startRequestResponseUpstream reads exactly reqLen bytes, answers with resp and closes.
+func startRequestResponseUpstream(t *testing.T, reqLen int, resp []byte) (addr string, closeFn func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        if _, err := io.ReadFull(c, make([]byte, reqLen)); err != nil { return }
+        c.Write(resp)
+    }()
+    return ln.Addr().String(), func(){ ln.Close() }
+}
+
+func TestStatsCountBytesBothWays(t *testing.T) {
+    ch := minimalClientHello()
+    up := bytes.Repeat([]byte("u"), 3000)
+    down := bytes.Repeat([]byte("d"), 5000)
+    for _, cfg := range []impair.Config{
+        {Profile: impair.ProfileClean},
+        {Profile: impair.ProfileBandwidthLimit, BandwidthKbps: 4000},
+    } {
+        upstream, closeUp := startRequestResponseUpstream(t, len(ch)+len(up), down)
+        c1, c2 := net.Pipe()
+        statsc := make(chan Stats, 1)
+        go func(){ st, _ := HandleConnection(c2, upstream, cfg, 1, log.New(io.Discard, "", 0)); statsc <- st }()
+        c1.Write(ch)
+        c1.Write(up)
+        got, _ := io.ReadAll(c1)
+        c1.Close()
+        st := <-statsc
+        closeUp()
+        if !bytes.Equal(got, down) { t.Fatalf("%s: client got %d bytes, want %d", cfg.Profile, len(got), len(down)) }
+        if st.BytesUp != int64(len(ch)+len(up)) || st.BytesDown != int64(len(down)) {
+            t.Fatalf("%s: bytes up/down = %d/%d, want %d/%d", cfg.Profile, st.BytesUp, st.BytesDown, len(ch)+len(up), len(down))
+        }
+        if st.FirstByteLatency <= 0 || st.Duration < st.FirstByteLatency {
+            t.Fatalf("%s: first byte %s, duration %s", cfg.Profile, st.FirstByteLatency, st.Duration)
+        }
+    }
+}
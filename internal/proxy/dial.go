@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for a zero DialConfig.
+const (
+	DefaultDialTimeout = 5 * time.Second
+	DefaultDialBackoff = 100 * time.Millisecond
+)
+
+// DialConfig controls how HandleConnection reaches the upstream (-dial-timeout,
+// -dial-retries, -dial-fallback).
+type DialConfig struct {
+	Timeout  time.Duration // per attempt (0 = DefaultDialTimeout)
+	Retries  int           // further attempts on the upstream after the first fails
+	Backoff  time.Duration // wait before the first retry, doubled before each next one (0 = DefaultDialBackoff)
+	Fallback string        // host:port tried once the upstream's attempts are used up ("" = none)
+}
+
+var dialConfig struct {
+	sync.Mutex
+	c DialConfig
+}
+
+// SetDialConfig sets how upstream connections are dialed.
+func SetDialConfig(c DialConfig) {
+	dialConfig.Lock()
+	dialConfig.c = c
+	dialConfig.Unlock()
+}
+
+func currentDialConfig() DialConfig {
+	dialConfig.Lock()
+	defer dialConfig.Unlock()
+	c := dialConfig.c
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultDialTimeout
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = DefaultDialBackoff
+	}
+	return c
+}
+
+// dialUpstream dials addr with keepalives ka, retrying with backoff, then the
+// fallback. It returns the connection, the address that answered and the attempts
+// made in all.
+func dialUpstream(addr string, ka KeepAlive) (net.Conn, string, int, error) {
+	c := currentDialConfig()
+	d := net.Dialer{Timeout: c.Timeout, KeepAlive: ka.dialerKeepAlive()}
+	attempts := 0
+	backoff := c.Backoff
+	var err error
+	for i := 0; i <= c.Retries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		attempts++
+		var conn net.Conn
+		if conn, err = d.Dial("tcp", addr); err == nil {
+			return conn, addr, attempts, nil
+		}
+	}
+	if c.Fallback != "" && c.Fallback != addr {
+		attempts++
+		conn, ferr := d.Dial("tcp", c.Fallback)
+		if ferr == nil {
+			return conn, c.Fallback, attempts, nil
+		}
+		err = fmt.Errorf("%w; fallback %s: %w", err, c.Fallback, ferr)
+	}
+	return nil, "", attempts, err
+}
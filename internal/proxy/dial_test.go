@@ -0,0 +1,41 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+// deadAddr returns a loopback address nothing listens on.
+func deadAddr(t *testing.T) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    addr := ln.Addr().String()
+    ln.Close()
+    return addr
+}
+
+func TestDialRetriesThenFallback(t *testing.T) {
+    fallback, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    SetDialConfig(DialConfig{Timeout: time.Second, Retries: 2, Backoff: time.Millisecond, Fallback: fallback}); defer SetDialConfig(DialConfig{})
+    c1, c2 := net.Pipe()
+    ch := minimalClientHello()
+    go func(){ c1.Write(ch); c1.Close() }()
+    st, _ := HandleConnection(c2, deadAddr(t), impair.Config{Profile: impair.ProfileClean}, 1, log.New(io.Discard, "", 0))
+    if st.DialAttempts != 4 || st.Upstream != fallback { t.Fatalf("attempts=%d upstream=%q, want 4 via %s", st.DialAttempts, st.Upstream, fallback) }
+    if b := <-got; !bytes.Equal(b, ch) { t.Fatalf("fallback got %d bytes, want the ClientHello", len(b)) }
+}
+
+func TestDialGivesUpWhenFallbackFails(t *testing.T) {
+    SetDialConfig(DialConfig{Timeout: time.Second, Retries: 1, Backoff: time.Millisecond, Fallback: deadAddr(t)}); defer SetDialConfig(DialConfig{})
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    st, err := HandleConnection(c2, deadAddr(t), impair.Config{Profile: impair.ProfileClean}, 1, log.New(io.Discard, "", 0))
+    if err == nil || !strings.Contains(err.Error(), "fallback") || st.DialAttempts != 3 || st.Upstream != "" { t.Fatalf("err=%v attempts=%d upstream=%q", err, st.DialAttempts, st.Upstream) }
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"pathlab/internal/impair"
+)
+
+// handleDelayFirstResponse relays the client's bytes untouched but holds the first
+// upstream->client chunk for FirstByteDelayMs before delivering it; everything after
+// it flows normally. Unlike LATENCY only the time to first byte grows.
+func handleDelayFirstResponse(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	delay := time.Duration(cfg.FirstByteDelayMs) * time.Millisecond
+	logger.Printf("[conn %d] DELAY_FIRST_RESPONSE: delay=%s ch_len=%d", id, delay, res.HandshakeBytes)
+	if _, err := upstream.Write(records); err != nil {
+		return fmt.Errorf("write CH to upstream: %w", err)
+	}
+	sent := time.Now()
+
+	stop := make(chan struct{})
+	errc := make(chan error, 2)
+	go func() { _, er := io.Copy(upstream, cbr); errc <- er }()
+	go func() {
+		buf := make([]byte, 32*1024)
+		n, er := upstream.Read(buf)
+		if n > 0 {
+			st.UpstreamTTFB = time.Since(sent)
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+				st.FirstByteDelay = delay
+			case <-stop:
+				t.Stop()
+				errc <- nil
+				return
+			}
+			if _, ew := client.Write(buf[:n]); ew != nil {
+				errc <- ew
+				return
+			}
+		}
+		if er == nil {
+			_, er = io.Copy(client, upstream)
+		}
+		errc <- er
+	}()
+	err1 := <-errc
+	close(stop)
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		return err2
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func TestDelayFirstResponseHoldsOnlyTheFirstChunk(t *testing.T) {
+    ch := minimalClientHello()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        io.ReadFull(c, make([]byte, len(ch)))
+        c.Write([]byte("first"))
+        time.Sleep(100 * time.Millisecond)
+        c.Write([]byte("second"))
+    }()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    statsc := make(chan Stats, 1)
+    go func(){
+        st, _ := HandleConnection(c2, ln.Addr().String(), impair.Config{Profile: impair.ProfileDelayFirstResponse, FirstByteDelayMs: 300}, 1, log.New(io.Discard, "", 0))
+        statsc <- st
+    }()
+    start := time.Now()
+    c1.Write(ch)
+    buf := make([]byte, 16)
+    n, _ := c1.Read(buf)
+    first := time.Since(start)
+    if string(buf[:n]) != "first" || first < 300*time.Millisecond || first > time.Second { t.Fatalf("got %q after %s, want \"first\" after ~300ms", buf[:n], first) }
+    // the second chunk was sent 100ms after the first and is not held again
+    n, _ = c1.Read(buf)
+    if string(buf[:n]) != "second" || time.Since(start) > first+150*time.Millisecond { t.Fatalf("got %q after %s", buf[:n], time.Since(start)) }
+    c1.Close()
+    st := <-statsc
+    if st.FirstByteDelay != 300*time.Millisecond || st.UpstreamTTFB <= 0 || st.UpstreamTTFB > 200*time.Millisecond { t.Fatalf("delay %s, upstream ttfb %s", st.FirstByteDelay, st.UpstreamTTFB) }
+}
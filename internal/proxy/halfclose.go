@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"pathlab/internal/impair"
+)
+
+// closeWrite half-closes c (shutdown of its write side) when it is a TCP connection,
+// looking through holdConn and the other wrappers, and reports whether it did.
+func closeWrite(c net.Conn) bool {
+	c = baseConn(c)
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite() == nil
+	}
+	return false
+}
+
+// handleHalfClose forwards client data until HalfCloseAfterBytes have gone upstream
+// (the ClientHello always goes whole), then half-closes the upstream connection so the
+// server reads EOF, while upstream->client bytes keep being relayed until the server
+// closes too. Client data sent after the half-close is read and dropped. Connections
+// that cannot be half-closed (not TCP) are fully closed instead.
+func handleHalfClose(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	after := max(int64(cfg.HalfCloseAfterBytes), int64(len(records)))
+	logger.Printf("[conn %d] HALF_CLOSE: close upstream write side after %d client bytes ch_len=%d", id, after, res.HandshakeBytes)
+	if _, err := upstream.Write(records); err != nil {
+		return fmt.Errorf("write CH to upstream: %w", err)
+	}
+	var halfClosed atomic.Bool
+	var afterBytes, dropped int64
+	var wg sync.WaitGroup
+	errc := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 16*1024)
+		for sent := int64(len(records)); sent < after; {
+			n, er := cbr.Read(buf[:min(int64(len(buf)), after-sent)])
+			if n > 0 {
+				if _, ew := upstream.Write(buf[:n]); ew != nil {
+					errc <- ew
+					return
+				}
+				sent += int64(n)
+			}
+			if er != nil {
+				errc <- er
+				return
+			}
+		}
+		if !closeWrite(upstream) {
+			logger.Printf("[conn %d] HALF_CLOSE: upstream cannot half-close, closing fully", id)
+			errc <- nil
+			return
+		}
+		halfClosed.Store(true)
+		logger.Printf("[conn %d] HALF_CLOSE: upstream write side closed after %d bytes", id, after)
+		// Only the upstream ending finishes the connection from here; the client's
+		// further data has nowhere to go.
+		dropped, _ = io.Copy(io.Discard, cbr)
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 16*1024)
+		for {
+			n, er := upstream.Read(buf)
+			if n > 0 {
+				if halfClosed.Load() {
+					afterBytes += int64(n)
+				}
+				if _, ew := client.Write(buf[:n]); ew != nil {
+					errc <- ew
+					return
+				}
+			}
+			if er != nil {
+				errc <- er
+				return
+			}
+		}
+	}()
+	err1 := <-errc
+	_ = client.Close()
+	_ = upstream.Close()
+	wg.Wait()
+	st.HalfClosed = halfClosed.Load()
+	st.HalfClosedBytes = afterBytes
+	st.DroppedBytes += dropped
+	if st.HalfClosed {
+		logger.Printf("[conn %d] HALF_CLOSE: %d upstream bytes after the half-close, %d client bytes dropped", id, afterBytes, dropped)
+	}
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	return nil
+}
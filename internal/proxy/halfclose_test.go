@@ -0,0 +1,62 @@
+package proxy
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func TestHalfCloseKeepsRelayingResponses(t *testing.T) {
+    ch := minimalClientHello()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    got := make(chan []byte, 1)
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        // read until the proxy's FIN, then answer: only possible if just the write side was closed
+        b, _ := io.ReadAll(c)
+        got <- b
+        c.Write(bytes.Repeat([]byte("r"), 5000))
+    }()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    cfg := impair.Config{Profile: impair.ProfileHalfClose, HalfCloseAfterBytes: len(ch) + 50}
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, ln.Addr().String(), cfg, 30, log.New(io.Discard, "", 0)); statsc <- st }()
+    go func(){ c1.Write(ch); c1.Write(make([]byte, 120)) }()
+    _ = c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+    resp, err := io.ReadAll(c1)
+    if len(resp) != 5000 { t.Fatalf("client got %d response bytes (err %v), want 5000", len(resp), err) }
+    if b := <-got; len(b) != len(ch)+50 { t.Fatalf("upstream got %d bytes before EOF, want %d", len(b), len(ch)+50) }
+    st := <-statsc
+    if !st.HalfClosed || st.HalfClosedBytes != 5000 || st.DroppedBytes != 70 { t.Fatalf("stats half_closed=%v after=%d dropped=%d", st.HalfClosed, st.HalfClosedBytes, st.DroppedBytes) }
+}
+
+func TestHalfCloseFallsBackToFullCloseOffTCP(t *testing.T) {
+    ch := minimalClientHello()
+    c1, c2 := net.Pipe()
+    u1, u2 := net.Pipe()
+    defer c1.Close()
+    defer u2.Close()
+    go io.Copy(io.Discard, u2)
+    st := &Stats{}
+    done := make(chan error, 1)
+    go func(){ done <- handleHalfClose(bufio.NewReader(c2), c2, u1, impair.Config{Profile: impair.ProfileHalfClose}, 31, log.New(io.Discard, "", 0), st) }()
+    c1.Write(ch)
+    select {
+    case err := <-done:
+        if err != nil { t.Fatalf("handler: %v", err) }
+    case <-time.After(3 * time.Second):
+        t.Fatalf("handler did not close a connection it cannot half-close")
+    }
+    if st.HalfClosed { t.Fatalf("HalfClosed reported on a net.Pipe") }
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// HoldRegistry tracks connections whose upstream is held open past client close
+// (rule modifier also_hold) so a retrying client's new connection can be paired
+// with the original one. Entries are keyed by JA3+SNI.
+type HoldRegistry struct {
+	mu      sync.Mutex
+	entries map[int64]*holdEntry
+}
+
+type holdEntry struct {
+	key     string
+	partner int64
+}
+
+// NewHoldRegistry returns an empty registry.
+func NewHoldRegistry() *HoldRegistry {
+	return &HoldRegistry{entries: make(map[int64]*holdEntry)}
+}
+
+// HoldKey builds the overlap matching key for a ClientHello fingerprint.
+func HoldKey(ja3, sni string) string { return ja3 + "|" + sni }
+
+// Begin registers connection id as held under key until End is called.
+func (h *HoldRegistry) Begin(id int64, key string) {
+	h.mu.Lock()
+	h.entries[id] = &holdEntry{key: key}
+	h.mu.Unlock()
+}
+
+// Pair looks for a held connection (other than id) registered under key. The first
+// connection to pair with a held entry becomes its partner. Returns 0 when none.
+func (h *HoldRegistry) Pair(key string, id int64) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var best int64
+	for hid, e := range h.entries {
+		if hid == id || e.key != key {
+			continue
+		}
+		if best == 0 || hid < best {
+			best = hid
+		}
+	}
+	if best != 0 && h.entries[best].partner == 0 {
+		h.entries[best].partner = id
+	}
+	return best
+}
+
+// End removes the hold for id and returns the partner recorded during the window.
+func (h *HoldRegistry) End(id int64) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entries[id]
+	if !ok {
+		return 0
+	}
+	delete(h.entries, id)
+	return e.partner
+}
+
+// holdConn keeps the upstream socket open when handlers close it: Close only
+// interrupts pending I/O so the copy loops can finish, and HandleConnection
+// performs the real close once the hold period is over. An abort still resets the
+// socket: abortConn reaches it through NetConn.
+type holdConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// NetConn returns the held connection.
+func (h *holdConn) NetConn() net.Conn { return h.Conn }
+
+func (h *holdConn) Close() error {
+	h.once.Do(func() { _ = h.Conn.SetDeadline(time.Now()) })
+	return nil
+}
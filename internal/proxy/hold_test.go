@@ -0,0 +1,82 @@
+package proxy
+
+import (
+    "errors"
+    "io"
+    "log"
+    "net"
+    "syscall"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func TestHoldRegistryPairing(t *testing.T) {
+    h := NewHoldRegistry()
+    key := HoldKey("abc", "example.com")
+    if p := h.Pair(key, 1); p != 0 { t.Fatalf("unexpected partner %d on empty registry", p) }
+    h.Begin(1, key)
+    if p := h.Pair(HoldKey("abc", "other.com"), 2); p != 0 { t.Fatalf("paired across SNI: %d", p) }
+    if p := h.Pair(key, 3); p != 1 { t.Fatalf("retry not paired with held conn: %d", p) }
+    if p := h.Pair(key, 4); p != 1 { t.Fatalf("second retry not paired: %d", p) }
+    if p := h.End(1); p != 3 { t.Fatalf("held conn partner = %d, want first retry 3", p) }
+    if p := h.Pair(key, 5); p != 0 { t.Fatalf("paired after hold ended: %d", p) }
+}
+
+func TestHandleConnectionAlsoHoldKeepsUpstreamOpen(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    eof := make(chan time.Time, 1)
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        io.Copy(io.Discard, c)
+        eof <- time.Now()
+        c.Close()
+    }()
+    c1, c2 := net.Pipe()
+    cfg := impair.Config{Profile: impair.ProfileClean, AlsoHoldMs: 300}
+    logger := log.New(io.Discard, "", 0)
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, ln.Addr().String(), cfg, 4, logger); statsc <- st }()
+    if _, err := c1.Write([]byte("ping")); err != nil { t.Fatalf("write: %v", err) }
+    closedAt := time.Now()
+    c1.Close()
+    select {
+    case at := <-eof:
+        if held := at.Sub(closedAt); held < 250*time.Millisecond { t.Fatalf("upstream closed after %v, want >= hold", held) }
+    case <-time.After(3 * time.Second):
+        t.Fatalf("upstream never closed")
+    }
+    if st := <-statsc; st.HeldMs != 300 { t.Fatalf("HeldMs = %d, want 300", st.HeldMs) }
+}
+
+func TestAbortAfterCHResetsHeldUpstream(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    readErr := make(chan error, 1)
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { readErr <- err; return }
+        defer c.Close()
+        _, err = io.Copy(io.Discard, c)
+        readErr <- err
+    }()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    go io.Copy(io.Discard, c1)
+    cfg := impair.Config{Profile: impair.ProfileAbortAfterCH, AlsoHoldMs: 200}
+    done := make(chan struct{})
+    go func(){ HandleConnection(c2, ln.Addr().String(), cfg, 5, log.New(io.Discard, "", 0)); close(done) }()
+    c1.Write(minimalClientHello())
+    select {
+    case err := <-readErr:
+        if !errors.Is(err, syscall.ECONNRESET) { t.Fatalf("held upstream saw %v, want a reset", err) }
+    case <-time.After(3 * time.Second):
+        t.Fatal("upstream never closed")
+    }
+    <-done
+}
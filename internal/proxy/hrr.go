@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"pathlab/internal/tlsinspect"
+)
+
+// TLS 1.3 HelloRetryRequest handling. When the upstream answers the first ClientHello
+// with an HRR, the client sends a second ClientHello (usually with a new key_share) on
+// the same connection. serverHelloTap spots the HRR in the server flight; handlers then
+// pick up the retried ClientHello either passively (clientHelloTap, for relays that do
+// not touch the bytes) or actively (readRetryClientHello, for handlers that impair it).
+
+const (
+	recordChangeCipherSpec = 0x14
+	recordHandshake        = 0x16
+	// tapLimit bounds how many bytes a tap buffers before giving up on a stream.
+	tapLimit = 64 * 1024
+)
+
+// recordTap reassembles TLS records from a stream it observes as an io.Writer and
+// hands each complete record to onRecord until onRecord returns false. A stream that
+// is not TLS, or runs past tapLimit, ends the tap; writes never fail.
+type recordTap struct {
+	buf      []byte
+	seen     int
+	done     bool
+	onRecord func(typ byte, body, record []byte) bool
+}
+
+func (t *recordTap) Write(p []byte) (int, error) {
+	if t.done {
+		return len(p), nil
+	}
+	t.buf = append(t.buf, p...)
+	for !t.done && len(t.buf) >= 5 {
+		n := int(binary.BigEndian.Uint16(t.buf[3:5]))
+		if t.buf[0] < 0x14 || t.buf[0] > 0x18 || n == 0 || n > 1<<14+256 {
+			t.done = true
+			break
+		}
+		if len(t.buf) < 5+n {
+			break
+		}
+		rec := t.buf[:5+n]
+		t.seen += len(rec)
+		if !t.onRecord(rec[0], rec[5:], rec) || t.seen > tapLimit {
+			t.done = true
+		}
+		t.buf = t.buf[5+n:]
+	}
+	if t.done {
+		t.buf = nil
+	}
+	return len(p), nil
+}
+
+// serverHelloTap observes upstream->client bytes, records whether the first server
+// handshake message is a HelloRetryRequest, and parses the ServerHello (the one after
+// the HRR, if any). An upstream that does not speak TLS ends the tap with neither.
+type serverHelloTap struct {
+	recordTap
+	records []byte
+	hrr     atomic.Bool
+	sh      atomic.Pointer[tlsinspect.ServerHello]
+}
+
+func newServerHelloTap() *serverHelloTap {
+	t := &serverHelloTap{}
+	t.onRecord = func(typ byte, _, record []byte) bool {
+		if typ != recordHandshake && typ != recordChangeCipherSpec {
+			return false
+		}
+		t.records = append(t.records, record...)
+		sh, err := tlsinspect.ParseServerHello(bytes.NewReader(t.records))
+		if sh.HRR {
+			t.hrr.Store(true)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return true // the ServerHello continues in the next record
+		}
+		if err == nil {
+			t.sh.Store(&sh)
+		}
+		return false
+	}
+	return t
+}
+
+// HRR reports whether the server's first handshake message was a HelloRetryRequest.
+func (t *serverHelloTap) HRR() bool { return t.hrr.Load() }
+
+// ServerHello returns the parsed ServerHello, once one was seen.
+func (t *serverHelloTap) ServerHello() (tlsinspect.ServerHello, bool) {
+	if sh := t.sh.Load(); sh != nil {
+		return *sh, true
+	}
+	return tlsinspect.ServerHello{}, false
+}
+
+// recordServerHello copies what t saw into st.
+func (st *Stats) recordServerHello(t *serverHelloTap) {
+	st.HRR = t.HRR()
+	if sh, ok := t.ServerHello(); ok {
+		st.ServerVersion, st.ServerCipher, st.ServerGroup = sh.Version, sh.CipherSuite, sh.Group
+	}
+}
+
+// clientHelloTap observes client->upstream bytes. It skips the first ClientHello and
+// any ChangeCipherSpec records, then, if server has seen an HRR, parses the retried
+// ClientHello. Read Retry only after the observed copy has finished.
+type clientHelloTap struct {
+	recordTap
+	server   *serverHelloTap
+	hs       []byte // handshake bytes of the first ClientHello
+	firstLen int    // full length of the first ClientHello message (-1 = unknown)
+	retry    []byte // records of the retried ClientHello so far
+	ok       bool
+	res      tlsinspect.Result
+}
+
+func newClientHelloTap(server *serverHelloTap) *clientHelloTap {
+	t := &clientHelloTap{server: server, firstLen: -1}
+	t.onRecord = t.record
+	return t
+}
+
+func (t *clientHelloTap) record(typ byte, body, record []byte) bool {
+	if t.firstLen < 0 || len(t.hs) < t.firstLen {
+		if typ != recordHandshake {
+			return false
+		}
+		t.hs = append(t.hs, body...)
+		if t.firstLen < 0 && len(t.hs) >= 4 {
+			t.firstLen = 4 + (int(t.hs[1])<<16 | int(t.hs[2])<<8 | int(t.hs[3]))
+		}
+		return true
+	}
+	if typ == recordChangeCipherSpec && t.retry == nil {
+		return true
+	}
+	if typ != recordHandshake || !t.server.HRR() {
+		return false
+	}
+	t.retry = append(t.retry, record...)
+	_, res, err := tlsinspect.ParseClientHelloOpts(bytes.NewReader(t.retry), clientHelloOpts())
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true // retried ClientHello continues in the next record
+	}
+	t.ok, t.res = err == nil, res
+	return false
+}
+
+// Retry returns the parsed retried ClientHello, if one followed an HRR.
+func (t *clientHelloTap) Retry() (tlsinspect.Result, bool) { return t.res, t.ok }
+
+// readRetryClientHello is the active counterpart of clientHelloTap for handlers that
+// must inspect the retried ClientHello before it reaches the upstream. Called right
+// after the first ClientHello was forwarded, it relays ChangeCipherSpec records and,
+// if the server sent an HRR, consumes the next ClientHello and returns its records
+// (not yet forwarded). ok is false when no retry follows; nothing past the relayed
+// ChangeCipherSpec records has then been consumed from cbr.
+func readRetryClientHello(cbr *bufio.Reader, upstream io.Writer, server *serverHelloTap) (records []byte, res tlsinspect.Result, ok bool, err error) {
+	for {
+		hdr, err := cbr.Peek(5)
+		if err != nil {
+			return nil, res, false, err
+		}
+		switch {
+		case hdr[0] == recordChangeCipherSpec:
+			rec := make([]byte, 5+int(binary.BigEndian.Uint16(hdr[3:5])))
+			if _, err := io.ReadFull(cbr, rec); err != nil {
+				return nil, res, false, err
+			}
+			if _, err := upstream.Write(rec); err != nil {
+				return nil, res, false, err
+			}
+		case hdr[0] == recordHandshake && server.HRR():
+			records, _, res, err = tlsinspect.ReadClientHelloOpts(cbr, clientHelloOpts())
+			return records, res, err == nil, err
+		default:
+			return nil, res, false, nil
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "io"
+    "log"
+    "math/big"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+// startTLSEchoUpstream runs a TLS 1.3 echo server that only accepts the given curves.
+// Go clients send an X25519 key_share first, so requiring P-256 forces a HelloRetryRequest.
+func startTLSEchoUpstream(t *testing.T, curves ...tls.CurveID) string {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatalf("key: %v", err) }
+    tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "upstream.test"}, DNSNames: []string{"upstream.test"},
+        NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil { t.Fatalf("cert: %v", err) }
+    cfg := &tls.Config{
+        Certificates:     []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+        MinVersion:       tls.VersionTLS13,
+        CurvePreferences: curves,
+    }
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+    if err != nil { t.Fatalf("listen: %v", err) }
+    t.Cleanup(func(){ ln.Close() })
+    go func(){
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func(){ io.Copy(c, c); c.Close() }()
+        }
+    }()
+    return ln.Addr().String()
+}
+
+// tlsThroughProxy runs a TLS client through HandleConnection and returns the handler's
+// Stats and log output with the client error (nil if an echo round trip succeeded).
+func tlsThroughProxy(t *testing.T, upstream string, cfg impair.Config) (Stats, string, error) {
+    c1, c2 := net.Pipe()
+    var logs bytes.Buffer
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, cfg, 9, log.New(&logs, "", 0)); statsc <- st }()
+    tc := tls.Client(c1, &tls.Config{ServerName: "upstream.test", InsecureSkipVerify: true})
+    _ = tc.SetDeadline(time.Now().Add(500 * time.Millisecond))
+    err := tc.Handshake()
+    if err == nil {
+        buf := make([]byte, 4)
+        if _, err = tc.Write([]byte("ping")); err == nil { _, err = io.ReadFull(tc, buf) }
+    }
+    tc.Close()
+    select {
+    case st := <-statsc:
+        return st, logs.String(), err
+    case <-time.After(5 * time.Second):
+        t.Fatalf("handler did not return")
+    }
+    return Stats{}, "", err
+}
+
+func TestCleanPassthroughSeesHRR(t *testing.T) {
+    st, _, err := tlsThroughProxy(t, startTLSEchoUpstream(t, tls.CurveP256), impair.Config{Profile: impair.ProfileClean})
+    if err != nil { t.Fatalf("handshake through CLEAN failed: %v", err) }
+    if !st.HRR || st.RetryCH == nil { t.Fatalf("HRR not recorded: hrr=%v retry=%v", st.HRR, st.RetryCH) }
+    if st.RetryCH.SNI != "upstream.test" || st.RetryCH.HandshakeBytes == 0 { t.Fatalf("unexpected retry CH %+v", *st.RetryCH) }
+    // the ServerHello recorded is the one answering the retry
+    if st.ServerVersion != tls.VersionTLS13 || st.ServerGroup != uint16(tls.CurveP256) || st.ServerCipher == 0 { t.Fatalf("server hello version=%#x group=%#x cipher=%#x", st.ServerVersion, st.ServerGroup, st.ServerCipher) }
+}
+
+func TestCleanPassthroughWithoutHRR(t *testing.T) {
+    st, _, err := tlsThroughProxy(t, startTLSEchoUpstream(t, tls.X25519), impair.Config{Profile: impair.ProfileClean})
+    if err != nil { t.Fatalf("handshake through CLEAN failed: %v", err) }
+    if st.HRR || st.RetryCH != nil { t.Fatalf("HRR reported without one: hrr=%v retry=%v", st.HRR, st.RetryCH) }
+    if st.ServerVersion != tls.VersionTLS13 || st.ServerGroup != uint16(tls.X25519) { t.Fatalf("server hello version=%#x group=%#x", st.ServerVersion, st.ServerGroup) }
+}
+
+func TestMTUBlackholeApplyToRetryCH(t *testing.T) {
+    upstream := startTLSEchoUpstream(t, tls.CurveP256)
+    cfg := impair.Config{Profile: impair.ProfileMTUBlackhole, ApplyToRetryCH: true, ThresholdBytes: 1 << 16, BlackholeSeconds: 1}
+    // Both ClientHellos fit: the handshake completes and the retry is recorded.
+    st, _, err := tlsThroughProxy(t, upstream, cfg)
+    if err != nil { t.Fatalf("handshake under a threshold nothing exceeds failed: %v", err) }
+    if !st.HRR || st.RetryCH == nil { t.Fatalf("HRR not recorded: hrr=%v retry=%v", st.HRR, st.RetryCH) }
+    // The retried CH carries the larger P-256 share; a threshold just below it lets the
+    // first CH through and blackholes the retry.
+    cfg.ThresholdBytes = st.RetryCH.RecordsBytes - 1
+    st, logs, err := tlsThroughProxy(t, upstream, cfg)
+    if err == nil { t.Fatalf("handshake completed although the retried ClientHello exceeds the threshold") }
+    if !strings.Contains(logs, "retried ClientHello") { t.Fatalf("blackhole did not engage on the retried CH; log:\n%s", logs) }
+    if !st.HRR || st.RetryCH == nil { t.Fatalf("HRR not recorded under blackhole: hrr=%v retry=%v", st.HRR, st.RetryCH) }
+}
+
+func TestLatencyRecordsServerHello(t *testing.T) {
+    for _, cfg := range []impair.Config{
+        {Profile: impair.ProfileLatencyJitter, LatencyMs: 1},
+        {Profile: impair.ProfileLatencyJitter, LatencyMs: 1, LatencyDownMs: 1},
+    } {
+        st, _, err := tlsThroughProxy(t, startTLSEchoUpstream(t, tls.CurveP256), cfg)
+        if err != nil { t.Fatalf("handshake through LATENCY failed: %v", err) }
+        if !st.HRR || st.ServerVersion != tls.VersionTLS13 || st.ServerGroup != uint16(tls.CurveP256) || st.ServerCipher == 0 { t.Fatalf("down=%dms: hrr=%v version=%#x group=%#x cipher=%#x", cfg.LatencyDownMs, st.HRR, st.ServerVersion, st.ServerGroup, st.ServerCipher) }
+    }
+}
+
+func TestServerHelloFromNonTLSUpstream(t *testing.T) {
+    ch := minimalClientHello()
+    upstream, closeUp := startRequestResponseUpstream(t, len(ch), []byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+    defer closeUp()
+    c1, c2 := net.Pipe()
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, impair.Config{Profile: impair.ProfileClean}, 1, log.New(io.Discard, "", 0)); statsc <- st }()
+    c1.Write(ch)
+    got, _ := io.ReadAll(c1)
+    c1.Close()
+    st := <-statsc
+    if !strings.HasPrefix(string(got), "HTTP/1.1 400") { t.Fatalf("non-TLS upstream: client got %q", got) }
+    if st.ServerVersion != 0 || st.ServerCipher != 0 || st.HRR { t.Fatalf("server hello reported for a non-TLS upstream: %+v", st) }
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleWatch closes a client/upstream pair once neither has moved a byte, in either
+// direction, for timeout (Config.IdleTimeoutSeconds). Handlers need not cooperate:
+// the close ends their copy loops like a peer going away would.
+type idleWatch struct {
+	timeout time.Duration
+	last    atomic.Int64 // unix nanos of the last byte read or written
+	fired   atomic.Bool
+	done    chan struct{}
+}
+
+// startIdleWatch makes the traffic of client and upstream count as activity and
+// starts the watch. Call stop when the handler returns.
+func startIdleWatch(timeout time.Duration, client, upstream *countingConn) *idleWatch {
+	w := &idleWatch{timeout: timeout, done: make(chan struct{})}
+	w.touch()
+	client.idle, upstream.idle = w, w
+	go func() {
+		t := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+		defer t.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case now := <-t.C:
+				if now.Sub(time.Unix(0, w.last.Load())) >= timeout {
+					w.fired.Store(true)
+					_ = client.Close()
+					_ = upstream.Close()
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *idleWatch) touch() { w.last.Store(time.Now().UnixNano()) }
+
+// stop ends the watch and reports whether it closed the connection.
+func (w *idleWatch) stop() bool {
+	close(w.done)
+	return w.fired.Load()
+}
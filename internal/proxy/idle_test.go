@@ -0,0 +1,43 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func TestIdleTimeoutSparesSlowButActiveStream(t *testing.T) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    ch := minimalClientHello()
+    want := append(append([]byte{}, ch...), "0123456789"...)
+    go func(){
+        c1.Write(ch)
+        // one byte every 60ms for 600ms: three times the idle timeout, never idle for it
+        for _, b := range want[len(ch):] {
+            time.Sleep(60 * time.Millisecond)
+            c1.Write([]byte{b})
+        }
+        c1.Close()
+    }()
+    st, _ := HandleConnection(c2, upstream, impair.Config{Profile: impair.ProfileClean, IdleTimeoutSeconds: 0.2}, 1, log.New(io.Discard, "", 0))
+    if st.IdleTimedOut { t.Fatal("active stream closed as idle") }
+    if b := <-got; !bytes.Equal(b, want) { t.Fatalf("upstream got %q, want %q", b, want) }
+}
+
+func TestIdleTimeoutClosesQuietConnection(t *testing.T) {
+    upstream, closeUp := startDummyUpstream(t); defer closeUp()
+    for _, profile := range []impair.ProfileName{impair.ProfileClean, impair.ProfileLatencyJitter} {
+        c1, c2 := net.Pipe()
+        go func(){ c1.Write(minimalClientHello()); io.Copy(io.Discard, c1) }()
+        start := time.Now()
+        st, _ := HandleConnection(c2, upstream, impair.Config{Profile: profile, LatencyMs: 1, IdleTimeoutSeconds: 0.1}, 1, log.New(io.Discard, "", 0))
+        c1.Close()
+        if !st.IdleTimedOut || time.Since(start) > 2*time.Second { t.Fatalf("%s: idle=%v after %s", profile, st.IdleTimedOut, time.Since(start)) }
+    }
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"pathlab/internal/impair"
+	"pathlab/internal/mitm"
+)
+
+// Intercept results recorded in Stats.InterceptResult.
+const (
+	InterceptCompleted      = "completed"       // client accepted the certificate and got the redirect
+	InterceptClientRejected = "client_rejected" // client aborted the handshake after seeing the certificate (cert validation/pinning)
+	InterceptClientClosed   = "client_closed"   // handshake completed, then the client hung up without a request (post-handshake hostname/pin checks)
+	InterceptHandshakeError = "handshake_error" // handshake failed before the certificate was sent (not TLS, no common parameters)
+)
+
+// interceptIOTimeout bounds the handshake and request read of an intercepted connection.
+const interceptIOTimeout = 10 * time.Second
+
+var interceptCA struct {
+	sync.Mutex
+	ca *mitm.CA
+}
+
+// SetInterceptCA sets the CA INTERCEPT_TLS mints certificates from. Without one, an
+// in-memory CA is generated on first use.
+func SetInterceptCA(ca *mitm.CA) {
+	interceptCA.Lock()
+	interceptCA.ca = ca
+	interceptCA.Unlock()
+}
+
+// InterceptCA returns the CA used by INTERCEPT_TLS, generating one if none was set.
+func InterceptCA() (*mitm.CA, error) {
+	interceptCA.Lock()
+	defer interceptCA.Unlock()
+	if interceptCA.ca == nil {
+		ca, err := mitm.NewCA()
+		if err != nil {
+			return nil, err
+		}
+		interceptCA.ca = ca
+	}
+	return interceptCA.ca, nil
+}
+
+// readerConn is a net.Conn whose reads come from r (which wraps the same conn), so
+// bytes already buffered while inspecting the ClientHello are not lost. It notes
+// whether anything was written, i.e. whether the server flight went out.
+type readerConn struct {
+	net.Conn
+	r     *bufio.Reader
+	wrote bool
+}
+
+func (c *readerConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *readerConn) Write(p []byte) (int, error) {
+	c.wrote = true
+	return c.Conn.Write(p)
+}
+
+// handleInterceptTLS plays a captive portal / TLS-intercepting middlebox: instead of
+// contacting the upstream it completes the client handshake itself with a certificate
+// for InterceptCN rather than the requested SNI, then answers the first HTTP request
+// with a redirect to InterceptRedirect. Clients that validate certificates should bail
+// during the handshake.
+func handleInterceptTLS(cbr *bufio.Reader, client net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	cn := cfg.InterceptCN
+	if cn == "" {
+		cn = "captive.portal.local"
+	}
+	redirect := cfg.InterceptRedirect
+	if redirect == "" {
+		redirect = "http://" + cn + "/"
+	}
+	ca, err := InterceptCA()
+	if err != nil {
+		return fmt.Errorf("intercept CA: %w", err)
+	}
+	leaf, err := ca.Leaf(cn)
+	if err != nil {
+		return fmt.Errorf("mint %s: %w", cn, err)
+	}
+	st.InterceptCN = cn
+	var sni string
+	rc := &readerConn{Conn: client, r: cbr}
+	conn := tls.Server(rc, &tls.Config{
+		Certificates: []tls.Certificate{*leaf},
+		NextProtos:   []string{"http/1.1"}, // keep h2 clients on the canned HTTP/1.1 reply
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, nil
+		},
+	})
+	_ = client.SetDeadline(time.Now().Add(interceptIOTimeout))
+	herr := conn.Handshake()
+	switch {
+	case herr == nil:
+		st.InterceptResult = InterceptCompleted
+	case rc.wrote:
+		// Whatever the client did after our certificate went out (an alert, which some
+		// stacks send unencrypted and Go reports as a bad record MAC, or a bare close)
+		// is the client bailing on it.
+		st.InterceptResult = InterceptClientRejected
+	default:
+		st.InterceptResult = InterceptHandshakeError
+	}
+	logger.Printf("[conn %d] INTERCEPT_TLS presented cn=%s for sni=%q: %s", id, cn, sni, st.InterceptResult)
+	if herr != nil {
+		logger.Printf("[conn %d] INTERCEPT_TLS handshake: %v", id, herr)
+		if st.InterceptResult == InterceptClientRejected {
+			return nil // the outcome being tested, not a proxy failure
+		}
+		return fmt.Errorf("intercept handshake: %w", herr)
+	}
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || isRemoteAlert(err) {
+			st.InterceptResult = InterceptClientClosed
+			logger.Printf("[conn %d] INTERCEPT_TLS client closed after the handshake without a request", id)
+			return nil
+		}
+		// not HTTP or too slow: still answer with the redirect
+		logger.Printf("[conn %d] INTERCEPT_TLS reading request: %v", id, err)
+	} else {
+		logger.Printf("[conn %d] INTERCEPT_TLS redirecting %s %s -> %s", id, req.Method, req.URL, redirect)
+	}
+	resp := "HTTP/1.1 302 Found\r\nLocation: " + redirect + "\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return fmt.Errorf("write redirect: %w", err)
+	}
+	return nil
+}
+
+// isRemoteAlert reports whether err is a TLS alert sent by the peer.
+func isRemoteAlert(err error) bool {
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "remote error" {
+		return true
+	}
+	return strings.Contains(err.Error(), "remote error")
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+    "bufio"
+    "crypto/tls"
+    "crypto/x509"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+
+    "pathlab/internal/impair"
+)
+
+// interceptThroughProxy runs a TLS client against INTERCEPT_TLS (no upstream is dialed).
+func interceptThroughProxy(t *testing.T, ccfg *tls.Config, cfg impair.Config) (Stats, *http.Response, error) {
+    // a TCP pair rather than net.Pipe: both ends send close_notify on Close, which an unbuffered pipe would stall
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    c1, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil { t.Fatalf("dial: %v", err) }
+    c2, err := ln.Accept()
+    if err != nil { t.Fatalf("accept: %v", err) }
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, "127.0.0.1:1", cfg, 30, log.New(io.Discard, "", 0)); c2.Close(); statsc <- st }()
+    conn := tls.Client(c1, ccfg)
+    defer conn.Close()
+    if err := conn.Handshake(); err != nil { c1.Close(); return <-statsc, nil, err }
+    req, _ := http.NewRequest("GET", "https://"+ccfg.ServerName+"/login", nil)
+    req.Write(conn)
+    resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+    conn.Close()
+    return <-statsc, resp, err
+}
+
+func TestInterceptTLSRejectedByValidatingClient(t *testing.T) {
+    ca, err := InterceptCA()
+    if err != nil { t.Fatal(err) }
+    roots := x509.NewCertPool()
+    roots.AppendCertsFromPEM(ca.CertPEM())
+    // even trusting the interception CA, the hostname does not match the SNI
+    st, _, err := interceptThroughProxy(t, &tls.Config{ServerName: "bank.example", RootCAs: roots}, impair.Config{Profile: impair.ProfileInterceptTLS})
+    if err == nil || !strings.Contains(err.Error(), "captive.portal.local") { t.Fatalf("client error = %v, want hostname mismatch naming the portal cert", err) }
+    if st.InterceptCN != "captive.portal.local" || st.InterceptResult != InterceptClientRejected { t.Fatalf("stats %+v", st) }
+}
+
+func TestInterceptTLSRedirectsNonValidatingClient(t *testing.T) {
+    cfg := impair.Config{Profile: impair.ProfileInterceptTLS, InterceptCN: "wifi.hotel.test", InterceptRedirect: "http://wifi.hotel.test/accept"}
+    st, resp, err := interceptThroughProxy(t, &tls.Config{ServerName: "bank.example", InsecureSkipVerify: true}, cfg)
+    if err != nil { t.Fatalf("intercepted exchange failed: %v", err) }
+    if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "http://wifi.hotel.test/accept" { t.Fatalf("response %d Location=%q", resp.StatusCode, resp.Header.Get("Location")) }
+    if st.InterceptCN != "wifi.hotel.test" || st.InterceptResult != InterceptCompleted { t.Fatalf("stats %+v", st) }
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"pathlab/internal/impair"
+)
+
+// KeepAlive are the TCP keepalive settings forced on both legs of a connection
+// (-keepalive, -keepalive-idle, or the config's keepalive_* fields).
+type KeepAlive struct {
+	Enabled *bool         // nil = leave Go's default (on, 15s)
+	Idle    time.Duration // idle time before the first probe and between probes (0 = default)
+}
+
+// keepAliveFromConfig returns the keepalive settings cfg asks for.
+func keepAliveFromConfig(cfg impair.Config) KeepAlive {
+	return KeepAlive{Enabled: cfg.KeepAliveEnabled, Idle: time.Duration(cfg.KeepAliveIdleSeconds * float64(time.Second))}
+}
+
+// isSet reports whether ka changes anything.
+func (ka KeepAlive) isSet() bool { return ka.Enabled != nil || ka.Idle > 0 }
+
+// dialerKeepAlive returns ka as a net.Dialer.KeepAlive value.
+func (ka KeepAlive) dialerKeepAlive() time.Duration {
+	if ka.Enabled != nil && !*ka.Enabled {
+		return -1
+	}
+	return ka.Idle
+}
+
+// keepAliveSetter is the part of *net.TCPConn keepalives are set through.
+type keepAliveSetter interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// applyKeepAlive sets ka on the socket under c. Connections that are not TCP
+// (pipes, in-process upstreams) are left alone.
+func applyKeepAlive(c net.Conn, ka KeepAlive) error {
+	s, ok := baseConn(c).(keepAliveSetter)
+	if !ok || !ka.isSet() {
+		return nil
+	}
+	if ka.Enabled != nil && !*ka.Enabled {
+		return s.SetKeepAlive(false)
+	}
+	if err := s.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if ka.Idle > 0 {
+		return s.SetKeepAlivePeriod(ka.Idle)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "reflect"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+// keepAliveRecorder stands in for a *net.TCPConn and records the keepalive setters called.
+type keepAliveRecorder struct {
+    net.Conn
+    calls []string
+}
+
+func (r *keepAliveRecorder) SetKeepAlive(on bool) error { r.calls = append(r.calls, fmt.Sprintf("keepalive=%v", on)); return nil }
+func (r *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error { r.calls = append(r.calls, "period="+d.String()); return nil }
+
+func TestApplyKeepAlive(t *testing.T) {
+    on, off := true, false
+    cases := []struct {
+        ka   KeepAlive
+        want []string
+    }{
+        {KeepAlive{}, nil},
+        {KeepAlive{Enabled: &off, Idle: time.Minute}, []string{"keepalive=false"}},
+        {KeepAlive{Enabled: &on}, []string{"keepalive=true"}},
+        {KeepAlive{Idle: 30 * time.Second}, []string{"keepalive=true", "period=30s"}},
+    }
+    for _, c := range cases {
+        rec := &keepAliveRecorder{}
+        // wrappers in front of the socket are looked through
+        if err := applyKeepAlive(&countingConn{Conn: rec}, c.ka); err != nil { t.Fatal(err) }
+        if !reflect.DeepEqual(rec.calls, c.want) { t.Errorf("%+v: calls %v, want %v", c.ka, rec.calls, c.want) }
+    }
+    if d := (KeepAlive{Enabled: &off}).dialerKeepAlive(); d >= 0 { t.Errorf("disabled: dialer keepalive %s, want negative", d) }
+    if d := (KeepAlive{Idle: time.Minute}).dialerKeepAlive(); d != time.Minute { t.Errorf("dialer keepalive %s, want 1m", d) }
+}
+
+func TestHandleConnectionSetsClientKeepAlive(t *testing.T) {
+    upstream, closeUp := startDummyUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    rec := &keepAliveRecorder{Conn: c2}
+    go func(){ c1.Write(minimalClientHello()); c1.Close() }()
+    off := false
+    HandleConnection(rec, upstream, impair.Config{Profile: impair.ProfileClean, KeepAliveEnabled: &off}, 1, log.New(io.Discard, "", 0))
+    if !reflect.DeepEqual(rec.calls, []string{"keepalive=false"}) { t.Fatalf("calls %v", rec.calls) }
+}
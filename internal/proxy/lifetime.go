@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// lifetime closes a client/upstream pair once it has been open for
+// Config.MaxConnSeconds, whatever the profile handler is doing. Handlers that hold a
+// connection on a timer select on lifetimeSignal so the shorter of the two wins.
+type lifetime struct {
+	t       *time.Timer
+	cut     chan struct{}
+	expired atomic.Bool
+}
+
+// startLifetime arms the limit for client and upstream. Call stop when
+// HandleConnection is done with the connection.
+func startLifetime(max time.Duration, client, upstream *countingConn) *lifetime {
+	l := &lifetime{cut: make(chan struct{})}
+	client.cut = l.cut
+	l.t = time.AfterFunc(max, func() {
+		l.expired.Store(true)
+		close(l.cut)
+		_ = client.Close()
+		_ = upstream.Close()
+	})
+	return l
+}
+
+// stop cancels the timer and reports whether it had already closed the connection.
+func (l *lifetime) stop() bool {
+	l.t.Stop()
+	return l.expired.Load()
+}
+
+// lifetimeSignal returns a channel closed when MaxConnSeconds ends c's connection,
+// or nil when no limit applies to c.
+func lifetimeSignal(c net.Conn) <-chan struct{} {
+	if cc, ok := c.(*countingConn); ok {
+		return cc.cut
+	}
+	return nil
+}
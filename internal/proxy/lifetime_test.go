@@ -0,0 +1,42 @@
+package proxy
+
+import (
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func lifetimeRun(t *testing.T, cfg impair.Config) (Stats, time.Duration) {
+    upstream, closeUp := startDummyUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    go func(){
+        c1.Write(minimalClientHello())
+        // keep talking so only the lifetime limit can end the connection
+        for { if _, err := c1.Write([]byte("x")); err != nil { return }; time.Sleep(20 * time.Millisecond) }
+    }()
+    go io.Copy(io.Discard, c1)
+    start := time.Now()
+    st, _ := HandleConnection(c2, upstream, cfg, 1, log.New(io.Discard, "", 0))
+    return st, time.Since(start)
+}
+
+func TestMaxConnSecondsClosesBusyConnection(t *testing.T) {
+    for _, cfg := range []impair.Config{
+        {Profile: impair.ProfileClean, MaxConnSeconds: 0.2},
+        {Profile: impair.ProfileMTUBlackhole, BlackholeSeconds: 30, MaxConnSeconds: 0.2},
+        {Profile: impair.ProfileClean, AlsoHoldMs: 30000, MaxConnSeconds: 0.2},
+    } {
+        st, took := lifetimeRun(t, cfg)
+        if !st.MaxLifetime || took < 200*time.Millisecond || took > 2*time.Second { t.Errorf("%s hold=%d: max_lifetime=%v after %s", cfg.Profile, cfg.AlsoHoldMs, st.MaxLifetime, took) }
+    }
+}
+
+func TestMaxConnSecondsLongerThanBlackholeHold(t *testing.T) {
+    st, took := lifetimeRun(t, impair.Config{Profile: impair.ProfileMTUBlackhole, BlackholeSeconds: 1, MaxConnSeconds: 10})
+    if st.MaxLifetime || took < time.Second || took > 3*time.Second { t.Fatalf("max_lifetime=%v after %s, want the 1s blackhole hold to win", st.MaxLifetime, took) }
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Upstream modes (-upstream-mode). In echo and sink mode no upstream is dialed:
+// profile handlers talk to an in-process peer instead, so impairments apply to its
+// traffic exactly as they would to a real upstream's.
+const (
+	UpstreamProxy = "proxy" // dial the upstream (default)
+	UpstreamEcho  = "echo"  // send back whatever the client sends
+	UpstreamSink  = "sink"  // read and discard everything, never respond
+)
+
+var upstreamMode struct {
+	sync.Mutex
+	mode string
+}
+
+// SetUpstreamMode selects what HandleConnection connects clients to. An empty mode
+// is UpstreamProxy.
+func SetUpstreamMode(mode string) {
+	upstreamMode.Lock()
+	upstreamMode.mode = mode
+	upstreamMode.Unlock()
+}
+
+func currentUpstreamMode() string {
+	upstreamMode.Lock()
+	defer upstreamMode.Unlock()
+	if upstreamMode.mode == "" {
+		return UpstreamProxy
+	}
+	return upstreamMode.mode
+}
+
+// localUpstream returns the handler side of an in-process echo or sink peer. The
+// peer exits once that side is closed.
+func localUpstream(mode string) net.Conn {
+	handlerSide, peer := net.Pipe()
+	go func() {
+		defer peer.Close()
+		if mode == UpstreamEcho {
+			_, _ = io.Copy(peer, peer)
+		} else {
+			_, _ = io.Copy(io.Discard, peer)
+		}
+	}()
+	return handlerSide
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func TestEchoModeAppliesProfile(t *testing.T) {
+    SetUpstreamMode(UpstreamEcho); defer SetUpstreamMode("")
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    done := make(chan Stats, 1)
+    go func(){
+        st, _ := HandleConnection(c2, "127.0.0.1:1", impair.Config{Profile: impair.ProfileBandwidthLimit, BandwidthKbps: 80}, 1, log.New(io.Discard, "", 0))
+        done <- st
+    }()
+    sent := append(minimalClientHello(), bytes.Repeat([]byte("e"), 4000)...)
+    start := time.Now()
+    go c1.Write(sent)
+    got := make([]byte, len(sent))
+    if _, err := io.ReadFull(c1, got); err != nil { t.Fatalf("read echo: %v", err) }
+    if !bytes.Equal(got, sent) { t.Fatal("echo differs from what was sent") }
+    // 80kbps is 10KB/s: ~4KB past the initial burst takes a few hundred ms
+    if d := time.Since(start); d < 250*time.Millisecond { t.Fatalf("echo took %s, the bandwidth cap did not apply", d) }
+    c1.Close()
+    if st := <-done; st.UpstreamMode != UpstreamEcho || st.DialAttempts != 0 { t.Fatalf("stats %+v", st) }
+}
+
+func TestSinkModeNeverResponds(t *testing.T) {
+    SetUpstreamMode(UpstreamSink); defer SetUpstreamMode("")
+    c1, c2 := net.Pipe()
+    done := make(chan Stats, 1)
+    go func(){
+        st, _ := HandleConnection(c2, "127.0.0.1:1", impair.Config{Profile: impair.ProfileClean}, 1, log.New(io.Discard, "", 0))
+        done <- st
+    }()
+    c1.Write(append(minimalClientHello(), "more"...))
+    c1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+    if n, err := c1.Read(make([]byte, 10)); n != 0 || err == nil { t.Fatalf("sink answered: n=%d err=%v", n, err) }
+    c1.Close()
+    if st := <-done; st.UpstreamMode != UpstreamSink { t.Fatalf("stats %+v", st) }
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMirrorBufferBytes bounds how much client data a MirrorWriter queues for a
+// mirror that is slow or not connected yet.
+const DefaultMirrorBufferBytes = 1 << 20
+
+// mirrorWriteTimeout bounds each write to the mirror, so a stuck mirror only costs
+// its own goroutine.
+const mirrorWriteTimeout = 5 * time.Second
+
+// mirrorFinishWait bounds how long a closing connection waits for its mirror to send
+// or drop what is still queued before the drop count goes into its Stats.
+const mirrorFinishWait = time.Second
+
+var mirrorAddr struct {
+	sync.Mutex
+	addr string
+}
+
+// SetMirror makes HandleConnection copy each connection's client->upstream bytes to
+// a connection of its own to addr (-mirror), or stops mirroring when addr is empty.
+func SetMirror(addr string) {
+	mirrorAddr.Lock()
+	mirrorAddr.addr = addr
+	mirrorAddr.Unlock()
+}
+
+func currentMirror() string {
+	mirrorAddr.Lock()
+	defer mirrorAddr.Unlock()
+	return mirrorAddr.addr
+}
+
+// MirrorStats are the mirror totals across all connections, for /impair/status.
+type MirrorStats struct {
+	Addr         string `json:"addr"`
+	Connections  int64  `json:"connections"`   // mirror connections opened
+	DialFailures int64  `json:"dial_failures"` // mirror dials that failed (their bytes count as dropped)
+	SentBytes    int64  `json:"sent_bytes"`
+	DroppedBytes int64  `json:"dropped_bytes"` // bytes not mirrored: buffer full, dial or write failed
+}
+
+var mirrorTotals struct {
+	connections, dialFailures, sent, dropped atomic.Int64
+}
+
+// MirrorTotals returns the mirror counters since start.
+func MirrorTotals() MirrorStats {
+	return MirrorStats{
+		Addr:         currentMirror(),
+		Connections:  mirrorTotals.connections.Load(),
+		DialFailures: mirrorTotals.dialFailures.Load(),
+		SentBytes:    mirrorTotals.sent.Load(),
+		DroppedBytes: mirrorTotals.dropped.Load(),
+	}
+}
+
+// MirrorWriter copies what is written to it to a mirror connection on a best-effort
+// basis: Write never blocks and never fails. The mirror is dialed in the background;
+// data it cannot take (the buffer is full, the dial or a write failed) is dropped
+// and counted. Whatever the mirror sends back is discarded.
+type MirrorWriter struct {
+	mu      sync.Mutex
+	queue   chan []byte
+	queued  int // bytes in queue
+	limit   int
+	closed  bool
+	done    chan struct{} // closed when run has sent or dropped everything
+	sent    atomic.Int64
+	dropped atomic.Int64
+}
+
+// NewMirrorWriter starts mirroring to addr, queueing at most limit bytes
+// (0 = DefaultMirrorBufferBytes). Close it when the mirrored stream ends.
+func NewMirrorWriter(addr string, dialTimeout time.Duration, limit int) *MirrorWriter {
+	if limit <= 0 {
+		limit = DefaultMirrorBufferBytes
+	}
+	m := &MirrorWriter{queue: make(chan []byte, 1024), limit: limit, done: make(chan struct{})}
+	go m.run(addr, dialTimeout)
+	return m
+}
+
+// Write queues a copy of b for the mirror, or drops it when the buffer is full.
+func (m *MirrorWriter) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || m.queued+len(b) > m.limit {
+		m.drop(len(b))
+		return len(b), nil
+	}
+	select {
+	case m.queue <- append([]byte(nil), b...):
+		m.queued += len(b)
+	default:
+		m.drop(len(b))
+	}
+	return len(b), nil
+}
+
+// Close stops accepting data. What is already queued is still sent in the
+// background, then the mirror connection is closed.
+func (m *MirrorWriter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	return nil
+}
+
+// Wait waits up to d for the data queued before Close to be sent or dropped, and
+// reports whether it was; after that Sent and Dropped are final.
+func (m *MirrorWriter) Wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-m.done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Sent returns the bytes written to the mirror so far.
+func (m *MirrorWriter) Sent() int64 { return m.sent.Load() }
+
+// Dropped returns the bytes that will not reach the mirror.
+func (m *MirrorWriter) Dropped() int64 { return m.dropped.Load() }
+
+func (m *MirrorWriter) drop(n int) {
+	m.dropped.Add(int64(n))
+	mirrorTotals.dropped.Add(int64(n))
+}
+
+func (m *MirrorWriter) dequeued(n int) {
+	m.mu.Lock()
+	m.queued -= n
+	m.mu.Unlock()
+}
+
+func (m *MirrorWriter) run(addr string, dialTimeout time.Duration) {
+	defer close(m.done)
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		mirrorTotals.dialFailures.Add(1)
+	} else {
+		mirrorTotals.connections.Add(1)
+		defer conn.Close()
+		go func() { _, _ = io.Copy(io.Discard, conn) }()
+	}
+	for b := range m.queue {
+		m.dequeued(len(b))
+		if conn == nil {
+			m.drop(len(b))
+			continue
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		n, err := conn.Write(b)
+		m.sent.Add(int64(n))
+		mirrorTotals.sent.Add(int64(n))
+		if err != nil {
+			m.drop(len(b) - n)
+			_ = conn.Close()
+			conn = nil
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func mirrorRun(t *testing.T, upstream string, sent []byte) Stats {
+    c1, c2 := net.Pipe()
+    go func(){ c1.Write(sent); c1.Close() }()
+    st, _ := HandleConnection(c2, upstream, impair.Config{Profile: impair.ProfileClean}, 1, log.New(io.Discard, "", 0))
+    return st
+}
+
+func TestMirrorGetsWhatTheUpstreamGets(t *testing.T) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    mirror, mirrored, closeMirror := startRecordingUpstream(t); defer closeMirror()
+    SetMirror(mirror); defer SetMirror("")
+    sent := append(minimalClientHello(), bytes.Repeat([]byte("m"), 10000)...)
+    st := mirrorRun(t, upstream, sent)
+    if b := <-got; !bytes.Equal(b, sent) { t.Fatalf("upstream got %d bytes, want %d", len(b), len(sent)) }
+    select {
+    case b := <-mirrored:
+        if !bytes.Equal(b, sent) { t.Fatalf("mirror got %d bytes, want %d", len(b), len(sent)) }
+    case <-time.After(5 * time.Second):
+        t.Fatal("mirror never got the stream")
+    }
+    if st.MirrorDropped != 0 { t.Fatalf("dropped %d", st.MirrorDropped) }
+}
+
+func TestMirrorDownLeavesPrimaryPathAlone(t *testing.T) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    SetMirror(deadAddr(t)); defer SetMirror("")
+    before := MirrorTotals()
+    sent := append(minimalClientHello(), "payload"...)
+    st := mirrorRun(t, upstream, sent)
+    if b := <-got; !bytes.Equal(b, sent) { t.Fatalf("upstream got %q", b) }
+    // the connection's Stats wait for the mirror to give up on what it queued
+    if st.MirrorDropped != int64(len(sent)) { t.Fatalf("mirror_dropped %d, want %d", st.MirrorDropped, len(sent)) }
+    deadline := time.Now().Add(5 * time.Second)
+    for MirrorTotals().DroppedBytes-before.DroppedBytes < int64(len(sent)) {
+        if time.Now().After(deadline) { t.Fatalf("totals %+v, want %d more dropped", MirrorTotals(), len(sent)) }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if MirrorTotals().DialFailures == before.DialFailures { t.Fatal("dial failure not counted") }
+}
+
+func TestMirrorWriterDropsPastItsBuffer(t *testing.T) {
+    // no run goroutine: nothing drains the queue
+    m := &MirrorWriter{queue: make(chan []byte, 1024), limit: 100}
+    for i := 0; i < 3; i++ {
+        if n, err := m.Write(make([]byte, 40)); n != 40 || err != nil { t.Fatalf("write: %d %v", n, err) }
+    }
+    if m.Dropped() != 40 { t.Fatalf("dropped %d, want 40", m.Dropped()) }
+    m.Close()
+    if m.Write(make([]byte, 5)); m.Dropped() != 45 { t.Fatalf("write after close: dropped %d, want 45", m.Dropped()) }
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"pathlab/internal/tlsinspect"
+)
+
+// chOpts are the ClientHello parse options, set by SetMaxHandshakeBytes.
+var chOpts atomic.Pointer[tlsinspect.Options]
+
+// SetMaxHandshakeBytes sets the ClientHello size limit (-max-handshake-bytes; 0 =
+// tlsinspect.DefaultMaxHandshakeBytes). A larger ClientHello fails its parse with
+// tlsinspect.ErrHandshakeTooLarge as soon as its header arrives.
+func SetMaxHandshakeBytes(n int) {
+	chOpts.Store(&tlsinspect.Options{MaxHandshakeBytes: n})
+}
+
+func clientHelloOpts() tlsinspect.Options {
+	if o := chOpts.Load(); o != nil {
+		return *o
+	}
+	return tlsinspect.Options{}
+}
+
+// peekLimit bounds the bytes NewPeekedConn buffers while peeking at a ClientHello of
+// up to limit handshake bytes: room for the message in records of 1KB or more, and
+// at least 64KB. A ClientHello fragmented into smaller records may not fit; it fails
+// the parse with tlsinspect.ErrHandshakeTooLarge too.
+func peekLimit(limit int) int {
+	if limit <= 0 {
+		limit = tlsinspect.DefaultMaxHandshakeBytes
+	}
+	return max(64<<10, limit+(limit/1024+1)*5)
+}
+
+// DefaultHandshakePeekTimeout is how long PeekClientHello waits for a whole
+// ClientHello by default (-handshake-peek-timeout).
+const DefaultHandshakePeekTimeout = 3 * time.Second
+
+// ErrNotTLS is the parse error of a PeekedConn whose first byte is not a TLS
+// handshake record.
+var ErrNotTLS = errors.New("not a TLS handshake record")
+
+// ErrPeekTimeout is the parse error of a PeekedConn whose ClientHello was not
+// complete within PeekClientHello's timeout.
+var ErrPeekTimeout = errors.New("clienthello peek timed out")
+
+// PeekedConn is a client connection whose first ClientHello was peeked at and parsed
+// up front (for rule matching and captures). Nothing is consumed: reads return the
+// stream from its first byte, so relays see the connection unchanged, and handlers
+// passed a PeekedConn by HandleConnection reuse the parse instead of repeating it.
+type PeekedConn struct {
+	net.Conn
+	r       *bufio.Reader
+	records []byte
+	raw     []byte
+	res     tlsinspect.Result
+	err     error
+}
+
+// NewPeekedConn peeks at the ClientHello of c, reading no further than its last record
+// (and at most peekLimit bytes, see SetMaxHandshakeBytes). A stream that does not
+// start with a handshake record is not waited on: the error is ErrNotTLS as soon as
+// the first byte arrives. A failed parse is kept (see ClientHello) and the stream is
+// still replayed byte for byte.
+func NewPeekedConn(c net.Conn) *PeekedConn {
+	opts := clientHelloOpts()
+	limit := peekLimit(opts.MaxHandshakeBytes)
+	p := &PeekedConn{Conn: c, r: bufio.NewReaderSize(c, limit)}
+	b, err := p.r.Peek(1)
+	if err != nil {
+		p.err = err
+		return p
+	}
+	if b[0] != recordHandshake {
+		p.err = fmt.Errorf("%w (first byte 0x%02x)", ErrNotTLS, b[0])
+		return p
+	}
+	parser := tlsinspect.NewCHParserOpts(opts)
+	off := 0
+	for {
+		need := parser.Need()
+		if off+need > limit {
+			p.err = fmt.Errorf("%w: records exceed the %d byte peek limit", tlsinspect.ErrHandshakeTooLarge, limit)
+			break
+		}
+		// feed what has arrived rather than wait for whole records, so the parser
+		// sees the handshake header (and can reject an oversized one) right away
+		step := need
+		if avail := p.r.Buffered() - off; avail < need {
+			step = max(avail, 1)
+		}
+		var rerr error
+		b, rerr = p.r.Peek(off + step)
+		done, ferr := parser.Feed(b[off:])
+		off = len(b)
+		if ferr != nil {
+			p.err = ferr
+			break
+		}
+		if done {
+			p.raw = parser.Raw()
+			break
+		}
+		if rerr != nil {
+			p.err = fmt.Errorf("read clienthello: %w", rerr)
+			break
+		}
+	}
+	p.records = append([]byte(nil), b[:off]...)
+	p.res = parser.Partial()
+	return p
+}
+
+// PeekClientHello is NewPeekedConn bounded by timeout (0 = by c's current read
+// deadline only). A ClientHello still incomplete by then, e.g. split across segments
+// by a client that paused, fails the parse with ErrPeekTimeout rather than the
+// connection: the stream, bytes received so far included, is replayed as it is. c's
+// read deadline is cleared on return.
+func PeekClientHello(c net.Conn, timeout time.Duration) *PeekedConn {
+	if timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	p := NewPeekedConn(c)
+	_ = c.SetReadDeadline(time.Time{})
+	if errors.Is(p.err, os.ErrDeadlineExceeded) {
+		p.err = fmt.Errorf("%w after %s (%d bytes received)", ErrPeekTimeout, timeout, len(p.records))
+	}
+	return p
+}
+
+func (p *PeekedConn) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+// Abort resets the connection (RST where the platform allows), for a client whose
+// ClientHello is not worth relaying.
+func (p *PeekedConn) Abort() { abortConn(p.Conn) }
+
+// ClientHello returns the ClientHello records exactly as read (headers included), the
+// parse result and the parse error, if any. On error res and records describe how far
+// the ClientHello got.
+func (p *PeekedConn) ClientHello() (records []byte, res tlsinspect.Result, err error) {
+	return p.records, p.res, p.err
+}
+
+// readClientHello reads the client's first ClientHello from cbr, a fresh reader over
+// client. For a *PeekedConn the earlier parse is returned and its records are skipped
+// in cbr rather than parsed again; for a terminated connection it is returned with no
+// records, as the plaintext stream carries none.
+func readClientHello(cbr *bufio.Reader, client net.Conn) (records, raw []byte, res tlsinspect.Result, err error) {
+	if ic, ok := client.(*countingConn); ok {
+		client = ic.Conn
+	}
+	if tc, ok := client.(*terminatedConn); ok {
+		return nil, nil, tc.res, nil
+	}
+	pc, ok := client.(*PeekedConn)
+	if !ok {
+		return tlsinspect.ReadClientHelloOpts(cbr, clientHelloOpts())
+	}
+	if pc.err != nil {
+		return pc.records, pc.raw, pc.res, pc.err
+	}
+	if _, err := cbr.Discard(len(pc.records)); err != nil {
+		return nil, nil, pc.res, err
+	}
+	return pc.records, pc.raw, pc.res, nil
+}
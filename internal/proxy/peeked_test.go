@@ -0,0 +1,154 @@
+package proxy
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/tlsinspect"
+)
+
+// peekedRun sends first (ClientHello and anything after it, in one write) through a
+// PeekedConn and HandleConnection under cfg, and returns what the upstream received.
+func peekedRun(t *testing.T, first []byte, cfg impair.Config) (*PeekedConn, []byte) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    pcc := make(chan *PeekedConn, 1)
+    done := make(chan struct{})
+    go func(){
+        defer close(done)
+        pc := NewPeekedConn(c2)
+        pcc <- pc
+        HandleConnection(pc, upstream, cfg, 5, log.New(io.Discard, "", 0))
+    }()
+    if _, err := c1.Write(first); err != nil { t.Fatalf("write: %v", err) }
+    // a parse that wants more than was sent only ends at EOF
+    c1.Close()
+    pc := <-pcc
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("%s: handler did not return", cfg.Profile)
+    }
+    select {
+    case b := <-got:
+        return pc, b
+    case <-time.After(3 * time.Second):
+        t.Fatalf("%s: upstream never saw close", cfg.Profile)
+    }
+    return pc, nil
+}
+
+func TestPeekedConnClientHelloReachesUpstreamOnce(t *testing.T) {
+    ch := minimalClientHello()
+    want := append(append([]byte{}, ch...), []byte("application data right behind the ClientHello")...)
+    for _, cfg := range []impair.Config{
+        {Profile: impair.ProfileClean},
+        {Profile: impair.ProfileLatencyJitter, LatencyMs: 1},
+        {Profile: impair.ProfileBandwidthLimit, BandwidthKbps: 10000},
+        {Profile: impair.ProfileLoss},
+        {Profile: impair.ProfileReorder},
+        {Profile: impair.ProfileSlowDrip, DripBytes: 64, DripIntervalMs: 1},
+        {Profile: impair.ProfileCorrupt},
+        {Profile: impair.ProfileStall, StallAfterBytes: 1 << 20, StallSeconds: 1},
+        {Profile: impair.ProfileHalfClose, HalfCloseAfterBytes: 1 << 20},
+        {Profile: impair.ProfileSlowHandshake, LatencyMs: 1},
+    } {
+        pc, got := peekedRun(t, want, cfg)
+        if _, res, err := pc.ClientHello(); err != nil || res.HandshakeBytes == 0 { t.Fatalf("%s: peek res=%+v err=%v", cfg.Profile, res, err) }
+        if !bytes.Equal(got, want) { t.Errorf("%s: upstream got %d bytes (%d ClientHellos), want the ClientHello once and the data", cfg.Profile, len(got), bytes.Count(got, ch)) }
+    }
+}
+
+func TestPeekedConnKeepsParseErrorAndReplays(t *testing.T) {
+    first := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+    pc, got := peekedRun(t, first, impair.Config{Profile: impair.ProfileClean})
+    if _, _, err := pc.ClientHello(); err == nil { t.Fatal("plain HTTP parsed as a ClientHello") }
+    if !bytes.Equal(got, first) { t.Fatalf("upstream got %q, want the bytes replayed once", got) }
+    // handlers that need a ClientHello fail with the kept error instead of reading on
+    _, got = peekedRun(t, first, impair.Config{Profile: impair.ProfileReorder})
+    if len(got) != 0 { t.Fatalf("REORDER forwarded %q after a failed parse", got) }
+}
+
+func TestPeekedConnPassesPlainHTTPThrough(t *testing.T) {
+    req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    pcc := make(chan *PeekedConn, 1)
+    go func(){
+        pc := NewPeekedConn(c2)
+        pcc <- pc
+        HandleConnection(pc, upstream, impair.Config{Profile: impair.ProfileClean}, 6, log.New(io.Discard, "", 0))
+    }()
+    if _, err := c1.Write(req); err != nil { t.Fatalf("write: %v", err) }
+    // the client keeps the connection open: the peek must not wait for a TLS record body
+    select {
+    case pc := <-pcc:
+        if _, _, err := pc.ClientHello(); !errors.Is(err, ErrNotTLS) { t.Fatalf("peek err = %v, want ErrNotTLS", err) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("NewPeekedConn blocked on plain HTTP")
+    }
+    c1.Close()
+    select {
+    case b := <-got:
+        if !bytes.Equal(b, req) { t.Fatalf("upstream got %q, want %q", b, req) }
+    case <-time.After(3 * time.Second):
+        t.Fatal("upstream never saw close")
+    }
+}
+
+// slowClientHello writes the ClientHello in three segments (record header, part of
+// the body, the rest), pausing gap before each after the first, then tail.
+func slowClientHello(c net.Conn, gap time.Duration, tail []byte) {
+    ch := minimalClientHello()
+    for i, seg := range [][]byte{ch[:5], ch[5:20], ch[20:]} {
+        if i > 0 { time.Sleep(gap) }
+        if _, err := c.Write(seg); err != nil { return }
+    }
+    c.Write(tail)
+    c.Close()
+}
+
+func TestPeekClientHelloWaitsForSplitRecords(t *testing.T) {
+    c1, c2 := net.Pipe()
+    defer c2.Close()
+    go slowClientHello(c1, 100*time.Millisecond, nil)
+    pc := PeekClientHello(c2, time.Second)
+    if records, res, err := pc.ClientHello(); err != nil || !bytes.Equal(records, minimalClientHello()) || res.HandshakeBytes == 0 { t.Fatalf("err=%v records=%d res=%+v", err, len(records), res) }
+}
+
+func TestPeekClientHelloTimeoutPassesThrough(t *testing.T) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    tail := []byte("bytes sent after the pause")
+    go slowClientHello(c1, 300*time.Millisecond, tail)
+    start := time.Now()
+    pc := PeekClientHello(c2, 200*time.Millisecond)
+    _, res, err := pc.ClientHello()
+    if !errors.Is(err, ErrPeekTimeout) || time.Since(start) > time.Second { t.Fatalf("err=%v after %s", err, time.Since(start)) }
+    if res.BytesReceived != 5 { t.Fatalf("partial parse %+v, want the 5 byte record header", res) }
+    // the deadline is gone: the rest of the stream is relayed untouched
+    HandleConnection(pc, upstream, impair.Config{Profile: impair.ProfileClean}, 1, log.New(io.Discard, "", 0))
+    if b := <-got; !bytes.Equal(b, append(minimalClientHello(), tail...)) { t.Fatalf("upstream got %q", b) }
+}
+
+func TestPeekClientHelloRejectsOversized(t *testing.T) {
+    SetMaxHandshakeBytes(1024)
+    defer SetMaxHandshakeBytes(0)
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    // a header declaring 1MB, then nothing: the peek must not wait for the rest
+    go c1.Write([]byte{0x16, 0x03, 0x01, 0x40, 0x00, 0x01, 0x10, 0x00, 0x00})
+    start := time.Now()
+    pc := PeekClientHello(c2, 2*time.Second)
+    if _, res, err := pc.ClientHello(); !errors.Is(err, tlsinspect.ErrHandshakeTooLarge) || !res.HeaderSeen || time.Since(start) > time.Second { t.Fatalf("err=%v res=%+v after %s", err, res, time.Since(start)) }
+    pc.Abort()
+    if _, err := c1.Read(make([]byte, 1)); err == nil { t.Fatalf("connection still open after Abort") }
+}
@@ -2,70 +2,308 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"pathlab/internal/impair"
+	"pathlab/internal/impair/ratelimit"
+	"pathlab/internal/proxyproto"
 	"pathlab/internal/tlsinspect"
+	"pathlab/internal/trace"
 )
 
+// Stats reports what a profile handler did to a connection. Handlers only write it
+// from their own goroutines, which have all finished by the time HandleConnection returns.
+type Stats struct {
+	DroppedBytes    int64              // client->upstream bytes discarded by PACKET_LOSS, or sent after HALF_CLOSE
+	HeldMs          int64              // how long the upstream was held open after the handler finished (also_hold)
+	ResetAtBytes    int64              // upstream->client bytes delivered when RESET_AFTER_BYTES fired (0 = never fired)
+	ServerBytes     int64              // ABORT_AFTER_CH with AbortAfterServerBytes: upstream->client bytes delivered before the reset
+	ReorderedChunks int64              // client->upstream chunks REORDER delivered after their successor
+	CorruptedChunks int64              // forwarded chunks CORRUPT flipped a bit in
+	FinalKbps       int                // BANDWIDTH profiles: client->upstream cap in effect when the connection ended
+	StallAtBytes    int64              // total bytes proxied when STALL froze the connection (0 = never stalled)
+	StallMs         int64              // how long the STALL freeze lasted
+	HalfClosed      bool               // HALF_CLOSE: the upstream write side was shut down (false: fell back to a full close)
+	HalfClosedBytes int64              // HALF_CLOSE: upstream->client bytes relayed after the half-close
+	BlackholeDir    string             // MTU1300_BLACKHOLE: direction black-holed (up, down or both)
+	DroppedDown     int64              // MTU1300_BLACKHOLE down/both: upstream->client bytes discarded past the threshold
+	InterceptCN     string             // INTERCEPT_TLS: hostname on the certificate presented to the client
+	InterceptResult string             // INTERCEPT_TLS: completed, client_rejected, client_closed or handshake_error
+	HandshakeTime   time.Duration      // CLEAN: ClientHello forwarded to first upstream byte (0 = no response)
+	HRR             bool               // upstream answered the first ClientHello with a HelloRetryRequest (CLEAN, LATENCY, MTU1300_BLACKHOLE)
+	RetryCH         *tlsinspect.Result // the client's second ClientHello after an HRR, when one was seen
+	ServerVersion   uint16             // version the upstream's ServerHello selected (CLEAN, LATENCY, MTU1300_BLACKHOLE; 0 = none seen)
+	ServerCipher    uint16             // cipher suite the upstream's ServerHello selected
+	ServerGroup     uint16             // key_share group the upstream's ServerHello selected (TLS 1.3)
+	SlowHandshake   time.Duration      // SLOW_HANDSHAKE: how long the shaped handshake phase lasted
+	FirstByteDelay  time.Duration      // DELAY_FIRST_RESPONSE: hold put on the upstream's first chunk (0 = never delivered)
+	UpstreamTTFB    time.Duration      // DELAY_FIRST_RESPONSE: ClientHello forwarded to the upstream's first byte
+	DialAttempts    int                // upstream dials made, retries and fallback included (0 = none, INTERCEPT_TLS)
+	Upstream        string             // address that accepted the dial: the upstream or the fallback
+	UpstreamMode    string             // proxy, or echo/sink when no upstream was dialed (-upstream-mode)
+	IdleTimedOut    bool               // closed after IdleTimeoutSeconds without a byte either way
+	MaxLifetime     bool               // closed on reaching MaxConnSeconds
+	Terminated      bool               // -terminate-tls: handlers ran on plaintext between two TLS sessions
+	ClientTLS       string             // -terminate-tls: version negotiated with the client
+	UpstreamTLS     string             // -terminate-tls: version negotiated with the upstream
+	BytesUp         int64              // bytes written to the upstream, ClientHello included (after impairment: dropped bytes are not counted)
+	BytesDown       int64              // bytes written to the client
+	FirstByteLatency time.Duration     // handler start to the first byte written to the client (0 = none)
+	Duration        time.Duration      // handler start to return, also_hold included
+	MirrorDropped   int64              // -mirror: client->upstream bytes the mirror did not get (waits briefly for its queue to drain)
+}
+
+// sendProxyHeader is set by SetSendProxyProtocol.
+var sendProxyHeader atomic.Bool
+
+// SetSendProxyProtocol makes HandleConnection start every upstream connection with a
+// PROXY protocol v2 header carrying the client connection's addresses.
+func SetSendProxyProtocol(on bool) { sendProxyHeader.Store(on) }
+
 // HandleConnection proxies a single connection with optional impairment profile
-func HandleConnection(client net.Conn, upstreamAddr string, cfg impair.Config, id int64, logger *log.Logger) error {
-	upstream, err := net.DialTimeout("tcp", upstreamAddr, 5*time.Second)
-	if err != nil {
-		return fmt.Errorf("dial upstream: %w", err)
+func HandleConnection(client net.Conn, upstreamAddr string, cfg impair.Config, id int64, logger *log.Logger) (Stats, error) {
+	return HandleConnectionLive(client, upstreamAddr, impair.NewState(cfg), id, logger)
+}
+
+// HandleConnectionLive is HandleConnection driven by a per-connection State. The
+// profile handler is chosen from its config at start; CLEAN passthrough re-reads it
+// for every chunk so overrides applied mid-stream (latency, bandwidth, loss) take
+// effect. Other handlers ignore later changes: see CanOverride.
+func HandleConnectionLive(client net.Conn, upstreamAddr string, live *impair.State, id int64, logger *log.Logger) (Stats, error) {
+	return HandleConnectionTraced(client, upstreamAddr, live, id, logger, nil)
+}
+
+// HandleConnectionTraced is HandleConnectionLive recording the upstream dial, the
+// start of the profile's impairment and the first upstream byte to reach the client
+// on rec (nil = not traced).
+func HandleConnectionTraced(client net.Conn, upstreamAddr string, live *impair.State, id int64, logger *log.Logger, rec *trace.Recorder) (Stats, error) {
+	return handleConnection(client, upstreamAddr, nil, live, id, logger, rec)
+}
+
+// Upstream is an upstream connection dialed ahead of HandleConnectionDialed.
+type Upstream struct {
+	Conn     net.Conn
+	Addr     string // the address asked for
+	ServedBy string // the address that answered: Addr or the fallback
+	Attempts int
+}
+
+// DialUpstream dials addr the way HandleConnection would for cfg: with the
+// -dial-* settings and cfg's keepalives. Attempts is set on failure too.
+func DialUpstream(addr string, cfg impair.Config) (Upstream, error) {
+	conn, servedBy, attempts, err := dialUpstream(addr, keepAliveFromConfig(cfg))
+	return Upstream{Conn: conn, Addr: addr, ServedBy: servedBy, Attempts: attempts}, err
+}
+
+// HandleConnectionDialed is HandleConnectionTraced over an upstream the caller has
+// already dialed with DialUpstream, as a SOCKS5 CONNECT must before it replies. The
+// upstream is closed when the connection ends, or at once when the upstream mode or
+// profile does not use it.
+func HandleConnectionDialed(client net.Conn, up Upstream, live *impair.State, id int64, logger *log.Logger, rec *trace.Recorder) (Stats, error) {
+	return handleConnection(client, up.Addr, &up, live, id, logger, rec)
+}
+
+func handleConnection(client net.Conn, upstreamAddr string, dialed *Upstream, live *impair.State, id int64, logger *log.Logger, rec *trace.Recorder) (Stats, error) {
+	var st Stats
+	cfg := live.Get()
+	ka := keepAliveFromConfig(cfg)
+	if dialed != nil {
+		defer dialed.Conn.Close()
+	}
+	if err := applyKeepAlive(client, ka); err != nil {
+		logger.Printf("[conn %d] client keepalive: %v", id, err)
+	}
+	if cfg.Profile == impair.ProfileInterceptTLS {
+		// PathLab answers as the server itself; the upstream is never contacted.
+		return st, handleInterceptTLS(bufio.NewReader(client), client, cfg, id, logger, &st)
+	}
+	st.UpstreamMode = currentUpstreamMode()
+	var upstream net.Conn
+	var err error
+	if st.UpstreamMode != UpstreamProxy {
+		upstream = localUpstream(st.UpstreamMode)
+	} else {
+		var servedBy string
+		var attempts int
+		if dialed != nil {
+			// dialed under the config before the rules ran: take this one's keepalives
+			upstream, servedBy, attempts = dialed.Conn, dialed.ServedBy, dialed.Attempts
+			if err := applyKeepAlive(upstream, ka); err != nil {
+				logger.Printf("[conn %d] upstream keepalive: %v", id, err)
+			}
+		} else {
+			upstream, servedBy, attempts, err = dialUpstream(upstreamAddr, ka)
+		}
+		st.DialAttempts, st.Upstream = attempts, servedBy
+		if err != nil {
+			return st, fmt.Errorf("dial upstream: %w", err)
+		}
+		if servedBy != upstreamAddr {
+			logger.Printf("[conn %d] upstream %s unreachable after %d attempts, using fallback %s", id, upstreamAddr, attempts-1, servedBy)
+		}
+		if dialed == nil {
+			rec.Record(trace.UpstreamDialed, fmt.Sprintf("%s, %d attempts", servedBy, attempts))
+		}
 	}
 	defer upstream.Close()
+	if st.UpstreamMode == UpstreamProxy && sendProxyHeader.Load() {
+		// -send-proxy-protocol: the upstream sees the client's (or the balancer-reported) address.
+		if _, err := upstream.Write(proxyproto.HeaderFor(client.RemoteAddr(), client.LocalAddr()).AppendV2(nil)); err != nil {
+			return st, fmt.Errorf("write proxy protocol header: %w", err)
+		}
+	}
+	if tc := tlsTermination(); tc != nil && st.UpstreamMode == UpstreamProxy {
+		pc, ok := client.(*PeekedConn)
+		if !ok {
+			pc = NewPeekedConn(client)
+		}
+		// Streams that are not TLS are relayed as they are.
+		if _, _, perr := pc.ClientHello(); perr == nil {
+			if client, upstream, err = terminateTLS(tc, pc, upstream, upstreamAddr, id, logger, &st); err != nil {
+				return st, err
+			}
+			defer upstream.Close()
+		} else {
+			client = pc
+		}
+	}
+	hold := time.Duration(cfg.AlsoHoldMs) * time.Millisecond
+	if hold > 0 {
+		upstream = &holdConn{Conn: upstream}
+	}
+
+	cc, uc := &countingConn{Conn: client}, &countingConn{Conn: upstream}
+	if t := trackerOf(client); t != nil {
+		cc.track, uc.track = t.AddDown, t.AddUp
+	}
+	if rec != nil {
+		cc.onFirst = func() { rec.Record(trace.FirstUpstreamByte, "") }
+	}
+	client, upstream = cc, uc
+	var mirror *MirrorWriter
+	if addr := currentMirror(); addr != "" {
+		// The mirror gets what the upstream gets; it can drop data but never slow the primary path.
+		mirror = NewMirrorWriter(addr, currentDialConfig().Timeout, 0)
+		uc.tee = mirror
+	}
+	var idle *idleWatch
+	if d := time.Duration(cfg.IdleTimeoutSeconds * float64(time.Second)); d > 0 {
+		idle = startIdleWatch(d, cc, uc)
+	}
+	var life *lifetime
+	if d := time.Duration(cfg.MaxConnSeconds * float64(time.Second)); d > 0 {
+		life = startLifetime(d, cc, uc)
+	}
+	start := time.Now()
 
 	// Buffer the client reader so we can parse first flight without consuming more than needed
 	cbr := bufio.NewReader(client)
+	if cfg.Profile != impair.ProfileClean && cfg.Profile != "" {
+		rec.Record(trace.ImpairmentApplied, string(cfg.Profile))
+	}
 
 	switch cfg.Profile {
 	case impair.ProfileAbortAfterCH:
-		return handleAbortAfterCH(cbr, client, upstream, cfg, id, logger)
+		err = handleAbortAfterCH(cbr, client, upstream, cfg, id, logger, &st)
 	case impair.ProfileMTUBlackhole:
-		return handleMTUBlackhole(cbr, client, upstream, cfg, id, logger)
+		err = handleMTUBlackhole(cbr, client, upstream, cfg, id, logger, &st)
 	case impair.ProfileLatencyJitter:
-		return handleLatencyJitter(cbr, client, upstream, cfg, id, logger)
-	case impair.ProfileBandwidthLimit:
-		return handleBandwidthLimit(cbr, client, upstream, cfg, id, logger)
+		err = handleLatencyJitter(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileBandwidthLimit, impair.ProfileRampDown:
+		err = handleBandwidthLimit(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileLoss:
+		err = handleLoss(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileResetAfterBytes:
+		err = handleResetAfterBytes(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileReorder:
+		err = handleReorder(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileSlowDrip:
+		err = handleSlowDrip(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileCorrupt:
+		err = handleCorrupt(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileStall:
+		err = handleStall(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileHalfClose:
+		err = handleHalfClose(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileSlowHandshake:
+		err = handleSlowHandshake(cbr, client, upstream, cfg, id, logger, &st)
+	case impair.ProfileDelayFirstResponse:
+		err = handleDelayFirstResponse(cbr, client, upstream, cfg, id, logger, &st)
 	default:
-		return handleCleanPassthrough(cbr, client, upstream, cfg, id, logger)
+		err = handleCleanPassthrough(cbr, client, upstream, live, id, logger, &st)
 	}
-}
-
-func handleCleanPassthrough(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger) error {
-	// Start copying both directions. First feed any buffered bytes to upstream.
-	// Peek to see if there are buffered bytes (without consuming)
-	if cbr.Buffered() > 0 {
-		buf, _ := cbr.Peek(cbr.Buffered())
-		if len(buf) > 0 {
-			if _, err := upstream.Write(buf); err != nil {
-				return err
-			}
-			// discard from reader
-			_, _ = cbr.Discard(len(buf))
+	st.BytesUp, st.BytesDown = uc.written.Load(), cc.written.Load()
+	st.FirstByteLatency = cc.firstWriteAfter(start)
+	if mirror != nil {
+		_ = mirror.Close()
+		if !mirror.Wait(mirrorFinishWait) {
+			logger.Printf("[conn %d] mirror still sending after %s; mirror_dropped may undercount", id, mirrorFinishWait)
+		}
+		st.MirrorDropped = mirror.Dropped()
+	}
+	if idle != nil && idle.stop() {
+		st.IdleTimedOut = true
+		logger.Printf("[conn %d] idle for %gs, closed", id, cfg.IdleTimeoutSeconds)
+	}
+	if hold > 0 {
+		// Deadline errors are how holdConn unblocked the copy loops, not failures.
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = nil
+		}
+		logger.Printf("[conn %d] holding upstream open for %s after client close", id, hold)
+		held := time.Now()
+		t := time.NewTimer(hold)
+		select {
+		case <-t.C:
+		case <-drainSignal(client):
+			t.Stop()
+		case <-lifetimeSignal(client):
+			t.Stop()
 		}
+		st.HeldMs = time.Since(held).Milliseconds()
+	}
+	if life != nil && life.stop() {
+		st.MaxLifetime = true
+		logger.Printf("[conn %d] open for %gs, closed (max_conn_seconds)", id, cfg.MaxConnSeconds)
 	}
+	st.Duration = time.Since(start)
+	return st, err
+}
+
+func handleCleanPassthrough(cbr *bufio.Reader, client net.Conn, upstream net.Conn, live *impair.State, id int64, logger *log.Logger, st *Stats) error {
+	// Relay both directions; buffered first-flight bytes are drained from cbr first.
+	// The taps only observe, recording an HRR, the retried ClientHello and the
+	// ServerHello for the receipt.
+	stap := newServerHelloTap()
+	ctap := newClientHelloTap(stap)
+	clk := &handshakeClock{}
 	errc := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(upstream, cbr)
-		errc <- err
+		errc <- liveCopy(clk.sentWriter(upstream), io.TeeReader(cbr, ctap), live, true, st)
 	}()
 	go func() {
-		_, err := io.Copy(client, upstream)
-		errc <- err
+		errc <- liveCopy(client, io.TeeReader(clk.respReader(upstream), stap), live, false, nil)
 	}()
 	// wait for one side to finish
 	err1 := <-errc
 	_ = client.Close()
 	_ = upstream.Close()
 	err2 := <-errc
+	st.recordServerHello(stap)
+	st.HandshakeTime = clk.elapsed()
+	if r, ok := ctap.Retry(); ok {
+		st.RetryCH = &r
+	}
 	if err1 != nil && !errors.Is(err1, io.EOF) {
 		return err1
 	}
@@ -75,16 +313,94 @@ func handleCleanPassthrough(cbr *bufio.Reader, client net.Conn, upstream net.Con
 	return nil
 }
 
-func handleAbortAfterCH(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger) error {
+// CanOverride reports whether a connection whose handler was chosen for profile
+// started takes profile to mid-stream. Only the CLEAN relay re-reads its State, and
+// only for the profiles liveCopy shapes.
+func CanOverride(started, to impair.ProfileName) error {
+	if started != impair.ProfileClean && started != "" {
+		return fmt.Errorf("connection runs %s, which does not take overrides mid-stream (only CLEAN connections do)", started)
+	}
+	switch to {
+	case impair.ProfileClean, impair.ProfileLatencyJitter, impair.ProfileBandwidthLimit, impair.ProfileRampDown, impair.ProfileLoss:
+		return nil
+	}
+	return fmt.Errorf("%s only acts at connection start; a live connection can be switched to CLEAN, %s, %s, %s or %s",
+		to, impair.ProfileLatencyJitter, impair.ProfileBandwidthLimit, impair.ProfileRampDown, impair.ProfileLoss)
+}
+
+// liveCopy relays src to dst, re-reading the connection's live config for every chunk
+// so admin overrides apply mid-stream. It shapes latency and bandwidth in both
+// directions and loss on the upstream path (st may be nil downstream); profiles that
+// only act at connection start (abort, blackhole) do not change an established relay.
+func liveCopy(dst io.Writer, src io.Reader, live *impair.State, up bool, st *Stats) error {
+	buf := make([]byte, 16*1024)
+	// Rebuilt only when the latency settings change, so a seeded sequence carries on.
+	var delay *impair.DelaySampler
+	var delayCfg impair.Config
+	for {
+		chunk := buf
+		if kbps := liveKbps(live.Get(), up); kbps > 0 && kbps*125/10 < len(chunk) {
+			// keep chunks to ~100ms of budget so pacing stays smooth
+			chunk = buf[:max(kbps*125/10, 1)]
+		}
+		n, er := src.Read(chunk)
+		if n > 0 {
+			// Re-read after the (possibly long) blocking read so a new override applies to this chunk.
+			cfg := live.Get()
+			if cfg.Profile == impair.ProfileLatencyJitter {
+				if delay == nil || !sameLatency(cfg, delayCfg) {
+					delay, delayCfg = cfg.DelaySampler(up), cfg
+				}
+				time.Sleep(delay.Next())
+			}
+			if up && cfg.Profile == impair.ProfileLoss && rand.Float64()*100 < cfg.LossPercent {
+				st.DroppedBytes += int64(n)
+			} else if _, ew := dst.Write(chunk[:n]); ew != nil {
+				return ew
+			}
+			if kbps := liveKbps(cfg, up); kbps > 0 {
+				time.Sleep(time.Duration(n) * time.Second / time.Duration(kbps*125))
+			}
+		}
+		if er != nil {
+			if errors.Is(er, io.EOF) {
+				return nil
+			}
+			return er
+		}
+	}
+}
+
+// liveKbps returns the bandwidth cap liveCopy enforces for a direction (0 = unlimited).
+func liveKbps(cfg impair.Config, up bool) int {
+	if cfg.Profile == impair.ProfileRampDown {
+		if !up {
+			return int(float64(cfg.BandwidthDownKbps) * cfg.RampDownScale(time.Now()))
+		}
+		return max(cfg.RampDownRate(time.Now()), 1)
+	}
+	if cfg.Profile != impair.ProfileBandwidthLimit {
+		return 0
+	}
+	if !up {
+		return cfg.BandwidthDownKbps
+	}
+	if cfg.BandwidthKbps <= 0 {
+		return 1000
+	}
+	return cfg.BandwidthKbps
+}
+
+func handleAbortAfterCH(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
 	// Parse ClientHello from client
-	raw, res, err := tlsinspect.ParseClientHello(cbr)
+	records, _, res, err := readClientHello(cbr, client)
 	if err != nil {
 		return fmt.Errorf("parse clienthello: %w", err)
 	}
 	logger.Printf("[conn %d] ABORT_AFTER_CH: ch_len=%d records_bytes=%d pqc_hint=%v", id, res.HandshakeBytes, res.RecordsBytes, res.PQCHint)
 
 	// Forward the ClientHello to upstream, then immediately abort both sides
-	if _, err := upstream.Write(raw); err != nil {
+	if _, err := upstream.Write(records); err != nil {
 		return fmt.Errorf("write CH to upstream: %w", err)
 	}
 
@@ -98,16 +414,47 @@ func handleAbortAfterCH(cbr *bufio.Reader, client net.Conn, upstream net.Conn, c
 		}
 	}
 
-	// small delay to increase likelihood upstream receives data
-	time.Sleep(5 * time.Millisecond)
+	if n := cfg.AbortAfterServerBytes; n > 0 {
+		st.ServerBytes = relayServerBytes(client, upstream, n)
+		logger.Printf("[conn %d] ABORT_AFTER_CH: delivered %d/%d server bytes before the reset", id, st.ServerBytes, n)
+	} else {
+		// small delay to increase likelihood upstream receives data
+		time.Sleep(5 * time.Millisecond)
+	}
 	abortConn(client)
 	abortConn(upstream)
 	return nil
 }
 
-func handleMTUBlackhole(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger) error {
+// abortServerWait bounds how long ABORT_AFTER_CH waits for abort_after_server_bytes
+// of server data before resetting with whatever arrived.
+const abortServerWait = time.Second
+
+// relayServerBytes copies up to n upstream bytes to the client, giving up after
+// abortServerWait, and returns how many reached the client.
+func relayServerBytes(client, upstream net.Conn, n int) int64 {
+	_ = upstream.SetReadDeadline(time.Now().Add(abortServerWait))
+	var done int64
+	buf := make([]byte, min(n, 32*1024))
+	for done < int64(n) {
+		r, err := upstream.Read(buf[:min(int64(len(buf)), int64(n)-done)])
+		if r > 0 {
+			w, werr := client.Write(buf[:r])
+			done += int64(w)
+			if werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return done
+}
+
+func handleMTUBlackhole(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
 	// Read the first TLS record(s) to get the ClientHello
-	raw, res, err := tlsinspect.ParseClientHello(cbr)
+	records, _, res, err := readClientHello(cbr, client)
 	if err != nil {
 		return fmt.Errorf("parse clienthello: %w", err)
 	}
@@ -115,10 +462,95 @@ func handleMTUBlackhole(cbr *bufio.Reader, client net.Conn, upstream net.Conn, c
 	if th <= 0 {
 		th = 1300
 	}
-	logger.Printf("[conn %d] MTU1300_BLACKHOLE: threshold=%d ch_len=%d pqc_hint=%v", id, th, res.HandshakeBytes, res.PQCHint)
+	dir := cfg.BlackholeDirection
+	if dir == "" {
+		dir = impair.BlackholeUp
+	}
+	st.BlackholeDir = dir
+	logger.Printf("[conn %d] MTU1300_BLACKHOLE: direction=%s threshold=%d ch_len=%d pqc_hint=%v", id, dir, th, res.HandshakeBytes, res.PQCHint)
+
+	// Server->client flows throughout (the server will likely time out), cut at the
+	// threshold when the down direction is black-holed. Watching it lets
+	// apply_to_retry_ch notice a HelloRetryRequest before the retried CH arrives.
+	stap := newServerHelloTap()
+	downDone := make(chan struct{})
+	go func() {
+		defer close(downDone)
+		var dst io.Writer = client
+		if dir == impair.BlackholeDown || dir == impair.BlackholeBoth {
+			dst = &thresholdWriter{w: client, left: int64(th), dropped: &st.DroppedDown}
+		}
+		io.Copy(dst, io.TeeReader(upstream, stap))
+	}()
+
+	// hold keeps the black-holed connection open to mimic the hang, then closes it
+	// (configurable) and waits for the relay goroutines.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	hold := func() error {
+		dur := time.Duration(cfg.BlackholeSeconds) * time.Second
+		if dur <= 0 { dur = 30 * time.Second }
+		t := time.NewTimer(dur)
+		select {
+		case <-t.C:
+		case <-drainSignal(client):
+			t.Stop()
+		case <-lifetimeSignal(client):
+			t.Stop()
+		}
+		close(stop)
+		_ = client.Close()
+		_ = upstream.Close()
+		wg.Wait()
+		<-downDone
+		st.recordServerHello(stap)
+		return nil
+	}
+
+	if dir == impair.BlackholeDown {
+		// The whole ClientHello and what follows reach the upstream; only its reply is cut.
+		if _, err := upstream.Write(records); err != nil {
+			return fmt.Errorf("write CH: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(upstream, cbr)
+		}()
+		return hold()
+	}
+
+	if cfg.ApplyToRetryCH && len(records) <= th {
+		// The first ClientHello fits the path: pass it whole and judge the retried one instead.
+		if _, err := upstream.Write(records); err != nil {
+			return fmt.Errorf("write CH: %w", err)
+		}
+		retry, rres, ok, err := readRetryClientHello(cbr, upstream, stap)
+		if ok {
+			st.RetryCH = &rres
+		}
+		if !ok || len(retry) <= th {
+			if ok {
+				_, err = upstream.Write(retry)
+			}
+			if err == nil {
+				_, err = io.Copy(upstream, cbr)
+			}
+			_ = client.Close()
+			_ = upstream.Close()
+			<-downDone
+			st.recordServerHello(stap)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			return nil
+		}
+		logger.Printf("[conn %d] MTU1300_BLACKHOLE: retried ClientHello after HRR is %d bytes (pqc_hint=%v), over threshold", id, len(retry), rres.PQCHint)
+		records = retry
+	}
 
 	// Forward only the first 'threshold' bytes to upstream; silently drop the rest
-	toSend := raw
+	toSend := records
 	if len(toSend) > th {
 		toSend = toSend[:th]
 	}
@@ -126,11 +558,6 @@ func handleMTUBlackhole(cbr *bufio.Reader, client net.Conn, upstream net.Conn, c
 	if _, err := upstream.Write(toSend); err != nil {
 		return fmt.Errorf("write partial CH: %w", err)
 	}
-	// Discard any remaining buffered bytes (beyond threshold) for this first flight
-	remaining := len(raw) - len(toSend)
-	if remaining > 0 {
-		// already not forwarded
-	}
 
 	if cbr.Buffered() > 0 {
 		// There may be extra bytes (after the CH) already read; drop them
@@ -138,9 +565,6 @@ func handleMTUBlackhole(cbr *bufio.Reader, client net.Conn, upstream net.Conn, c
 	}
 
 	// Now, simulate blackhole by discarding further client->server bytes for some time
-	var wg sync.WaitGroup
-	stop := make(chan struct{})
-
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -167,42 +591,51 @@ func handleMTUBlackhole(cbr *bufio.Reader, client net.Conn, upstream net.Conn, c
 		}
 	}()
 
-	// Meanwhile, allow server->client to flow (server will likely time out)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		io.Copy(client, upstream)
-	}()
+	// Hold connection open to mimic hang, then close
+	return hold()
+}
 
-	// Hold connection open to mimic hang, then close (configurable)
-	dur := time.Duration(cfg.BlackholeSeconds) * time.Second
-	if dur <= 0 { dur = 30 * time.Second }
-	time.Sleep(dur)
-	close(stop)
-	_ = client.Close()
-	_ = upstream.Close()
-	wg.Wait()
-	return nil
+// thresholdWriter passes the first left bytes to w and silently discards the rest,
+// counting them in *dropped.
+type thresholdWriter struct {
+	w       io.Writer
+	left    int64
+	dropped *int64
+}
+
+func (t *thresholdWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if t.left > 0 {
+		k := min(t.left, int64(len(p)))
+		if _, err := t.w.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		t.left -= k
+		p = p[k:]
+	}
+	*t.dropped += int64(len(p))
+	return n, nil
+}
+
+// sameLatency reports whether a and b configure the same per-chunk delays.
+func sameLatency(a, b impair.Config) bool {
+	return a.LatencyMs == b.LatencyMs && a.JitterMs == b.JitterMs && a.LatencyDownMs == b.LatencyDownMs &&
+		a.JitterDownMs == b.JitterDownMs && a.JitterDistribution == b.JitterDistribution && a.JitterSeed == b.JitterSeed
 }
 
 // handleLatencyJitter introduces an added one-way latency with optional jitter before proxying data.
-func handleLatencyJitter(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger) error {
+// When LatencyDownMs/JitterDownMs are set the upstream->client path is delayed per chunk as well.
+func handleLatencyJitter(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
 	// Parse ClientHello once to keep behavior consistent (still full pass through after delay)
-	raw, res, err := tlsinspect.ParseClientHello(cbr)
+	records, _, res, err := readClientHello(cbr, client)
  	if err != nil {
  		return fmt.Errorf("parse clienthello: %w", err)
  	}
- 	logger.Printf("[conn %d] LATENCY profile base=%dms jitter=%dms ch_len=%d", id, cfg.LatencyMs, cfg.JitterMs, res.HandshakeBytes)
- 	// Apply latency + jitter (best-effort)
- 	delay := time.Duration(cfg.LatencyMs) * time.Millisecond
- 	if cfg.JitterMs > 0 {
- 		// simple symmetrical jitter: +/- JitterMs/2
- 		j := time.Duration(cfg.JitterMs) * time.Millisecond
- 		delay += (time.Duration(time.Now().UnixNano()) % j) - (j / 2)
- 		if delay < 0 { delay = 0 }
- 	}
- 	time.Sleep(delay)
- 	if _, err := upstream.Write(raw); err != nil { return err }
+ 	logger.Printf("[conn %d] LATENCY profile base=%dms jitter=%dms down=%dms down_jitter=%dms ch_len=%d", id, cfg.LatencyMs, cfg.JitterMs, cfg.LatencyDownMs, cfg.JitterDownMs, res.HandshakeBytes)
+ 	// Apply latency + jitter (best-effort), drawn afresh for every chunk
+ 	upDelay := cfg.DelaySampler(true)
+ 	time.Sleep(upDelay.Next())
+ 	if _, err := upstream.Write(records); err != nil { return err }
  	// Flush any extra buffered bytes already read
  	if cbr.Buffered() > 0 {
  		buf, _ := cbr.Peek(cbr.Buffered())
@@ -210,118 +643,437 @@ func handleLatencyJitter(cbr *bufio.Reader, client net.Conn, upstream net.Conn,
  	}
  	// Continue bidirectional copy with per-chunk latency on client->upstream path only
  	errc := make(chan error, 2)
+ 	stap := newServerHelloTap()
+ 	down := io.TeeReader(upstream, stap)
  	go func() {
  		// client -> upstream (after initial handshake) with delay per chunk
  		buf := make([]byte, 16*1024)
  		for {
  			n, er := cbr.Read(buf)
  			if n > 0 {
- 				if delay > 0 { time.Sleep(delay) }
+ 				if d := upDelay.Next(); d > 0 { time.Sleep(d) }
  				if _, ew := upstream.Write(buf[:n]); ew != nil { er = ew }
  			}
  			if er != nil { errc <- er; return }
  		}
  	}()
- 	go func() { _, er := io.Copy(client, upstream); errc <- er }()
+ 	if cfg.LatencyDownMs > 0 || cfg.JitterDownMs > 0 {
+ 		go func() {
+ 			// upstream -> client with its own per-chunk delay and jitter
+ 			downDelay := cfg.DelaySampler(false)
+ 			buf := make([]byte, 16*1024)
+ 			for {
+ 				n, er := down.Read(buf)
+ 				if n > 0 {
+ 					if d := downDelay.Next(); d > 0 { time.Sleep(d) }
+ 					if _, ew := client.Write(buf[:n]); ew != nil { er = ew }
+ 				}
+ 				if er != nil { errc <- er; return }
+ 			}
+ 		}()
+ 	} else {
+ 		go func() { _, er := io.Copy(client, down); errc <- er }()
+ 	}
  	err1 := <-errc
  	_ = client.Close(); _ = upstream.Close()
  	err2 := <-errc
+ 	st.recordServerHello(stap)
  	if err1 != nil && !errors.Is(err1, io.EOF) { return err1 }
  	if err2 != nil && !errors.Is(err2, io.EOF) { return err2 }
  	return nil
 }
 
-// handleBandwidthLimit applies a simple token bucket style throttle on client->upstream direction.
-func handleBandwidthLimit(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger) error {
- 	raw, res, err := tlsinspect.ParseClientHello(cbr)
- 	if err != nil { return fmt.Errorf("parse clienthello: %w", err) }
- 	limitKbps := cfg.BandwidthKbps
- 	if limitKbps <= 0 { limitKbps = 1000 }
- 	logger.Printf("[conn %d] BANDWIDTH limit=%dkbps ch_len=%d", id, limitKbps, res.HandshakeBytes)
- 	if _, err := upstream.Write(raw); err != nil { return err }
- 	if cbr.Buffered() > 0 { buf, _ := cbr.Peek(cbr.Buffered()); if len(buf)>0 { _, _ = upstream.Write(buf); _, _ = cbr.Discard(len(buf)) } }
- 	bytesPerSec := limitKbps * 125 // kbps -> bytes/sec (1000/8)
- 	if bytesPerSec <= 0 { bytesPerSec = 125000 }
- 	chunk := 8 * 1024
- 	if chunk > bytesPerSec { chunk = bytesPerSec }
- 	tick := time.NewTicker(200 * time.Millisecond) // 5 intervals per second
- 	defer tick.Stop()
- 	bucketCap := bytesPerSec / 5
- 	bucket := bucketCap
- 	errc := make(chan error, 2)
- 	go func() {
- 		buf := make([]byte, chunk)
- 		for {
- 			if bucket <= 0 { <-tick.C; bucket = bucketCap }
- 			n, er := cbr.Read(buf)
- 			if n > 0 {
- 				if n > bucket { // if read more than allowance, send partial then sleep
- 					toSend := bucket
- 					if toSend > 0 { _, _ = upstream.Write(buf[:toSend]); n -= toSend }
- 					bucket = 0
- 					// put remainder back is non-trivial; fallback: short sleep and write rest next loop
- 					// simplistic approach: write remainder after refill
- 					for n > 0 {
- 						<-tick.C; bucket = bucketCap
- 						w := n
- 						if w > bucket { w = bucket }
- 						_, _ = upstream.Write(buf[toSend:toSend+w])
- 						bucket -= w; n -= w; toSend += w
- 					}
- 				} else {
- 					_, _ = upstream.Write(buf[:n]); bucket -= n
- 				}
- 			}
- 			if er != nil { errc <- er; return }
- 		}
- 	}()
-	// Downstream (upstream -> client) shaping if configured
-	downLimit := cfg.BandwidthDownKbps
-	if downLimit > 0 {
+// rampInterval is how often BANDWIDTH_RAMP_DOWN recomputes its bucket refill rates.
+const rampInterval = 100 * time.Millisecond
+
+// handleBandwidthLimit shapes client->upstream to BandwidthKbps and, when set,
+// upstream->client to BandwidthDownKbps using token buckets of BurstBytes. With
+// GlobalBandwidth the buckets are shared by every connection under the same apply, so
+// the aggregate rather than each connection is capped. Under BANDWIDTH_RAMP_DOWN the
+// refill rates are recomputed every rampInterval from the ramp (the downstream cap
+// scaled by the same fraction), so the link degrades gradually.
+func handleBandwidthLimit(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	ramp := cfg.Profile == impair.ProfileRampDown
+	limitKbps := cfg.BandwidthKbps
+	if limitKbps <= 0 {
+		limitKbps = 1000
+	}
+	downKbps := cfg.BandwidthDownKbps
+	if ramp {
+		now := time.Now()
+		limitKbps = max(cfg.RampDownRate(now), 1)
+		if downKbps > 0 {
+			downKbps = max(int(float64(downKbps)*cfg.RampDownScale(now)), 1)
+		}
+	}
+	up := bandwidthLimiter(cfg, "up", limitKbps)
+	if ramp {
+		logger.Printf("[conn %d] BANDWIDTH_RAMP_DOWN %d->%dkbps over %gs, now=%dkbps down=%dkbps burst=%dB global=%v ch_len=%d", id, cfg.BandwidthKbps, cfg.BandwidthFloorKbps, cfg.RampSeconds, limitKbps, downKbps, up.Burst(), cfg.GlobalBandwidth, res.HandshakeBytes)
+	} else {
+		logger.Printf("[conn %d] BANDWIDTH limit=%dkbps down=%dkbps burst=%dB global=%v ch_len=%d", id, limitKbps, cfg.BandwidthDownKbps, up.Burst(), cfg.GlobalBandwidth, res.HandshakeBytes)
+	}
+	st.FinalKbps = limitKbps
+	if _, err := upstream.Write(records); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 2)
+	go func() { errc <- shapedCopy(ctx, upstream, cbr, up) }()
+	var down *ratelimit.Limiter
+	if downKbps > 0 {
+		down = bandwidthLimiter(cfg, "down", downKbps)
+		go func() { errc <- shapedCopy(ctx, client, upstream, down) }()
+	} else {
+		go func() { _, er := io.Copy(client, upstream); errc <- er }()
+	}
+	rampDone := make(chan struct{})
+	if ramp {
 		go func() {
-			bytesPerSecDown := downLimit * 125
-			if bytesPerSecDown <= 0 { bytesPerSecDown = 125000 }
-			chunkDown := 8 * 1024
-			if chunkDown > bytesPerSecDown { chunkDown = bytesPerSecDown }
-			intervals := 5
-			bucketCapDown := bytesPerSecDown / intervals
-			if bucketCapDown <= 0 { bucketCapDown = bytesPerSecDown }
-			tickDown := time.NewTicker(time.Second / time.Duration(intervals))
-			defer tickDown.Stop()
-			bucketDown := bucketCapDown
-			bufDown := make([]byte, chunkDown)
+			defer close(rampDone)
+			t := time.NewTicker(rampInterval)
+			defer t.Stop()
 			for {
-				if bucketDown <= 0 { <-tickDown.C; bucketDown = bucketCapDown }
-				n, er := upstream.Read(bufDown)
-				if n > 0 {
-					toSend := n
-					off := 0
-					for toSend > 0 {
-						if bucketDown <= 0 { <-tickDown.C; bucketDown = bucketCapDown }
-						w := toSend
-						if w > bucketDown { w = bucketDown }
-						_, _ = client.Write(bufDown[off:off+w])
-						bucketDown -= w
-						off += w
-						toSend -= w
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-t.C:
+					kbps := max(cfg.RampDownRate(now), 1)
+					up.SetRate(float64(kbps) * 125)
+					if down != nil {
+						down.SetRate(max(float64(cfg.BandwidthDownKbps)*cfg.RampDownScale(now), 1) * 125)
 					}
+					st.FinalKbps = kbps
 				}
-				if er != nil { errc <- er; return }
 			}
 		}()
 	} else {
-		go func() { _, er := io.Copy(client, upstream); errc <- er }()
+		close(rampDone)
+	}
+	err1 := <-errc
+	cancel()
+	<-rampDone
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	if err1 != nil && !errors.Is(err1, io.EOF) && !errors.Is(err1, context.Canceled) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) && !errors.Is(err2, context.Canceled) {
+		return err2
+	}
+	return nil
+}
+
+// sharedLimiters holds the GlobalBandwidth buckets: one per apply, rate, burst and
+// direction, so connections under rule overlays of the same apply with different
+// rates do not share a bucket. Buckets no connection has taken for sharedLimiterIdle
+// are dropped; connections started earlier keep the buckets they took.
+var sharedLimiters struct {
+	sync.Mutex
+	byKey map[sharedLimiterKey]*sharedLimiter
+}
+
+type sharedLimiterKey struct {
+	applied time.Time
+	rate    float64
+	burst   int
+	dir     string
+}
+
+type sharedLimiter struct {
+	l     *ratelimit.Limiter
+	taken time.Time
+}
+
+const sharedLimiterIdle = time.Minute
+
+// bandwidthLimiter returns the token bucket for one direction: a fresh one per
+// connection, or the shared one when cfg.GlobalBandwidth is set.
+func bandwidthLimiter(cfg impair.Config, dir string, kbps int) *ratelimit.Limiter {
+	rate := float64(kbps) * 125 // kbps -> bytes/sec (1000/8)
+	burst := cfg.BurstBytes
+	if burst <= 0 {
+		burst = max(int(rate/10), 1) // 100ms worth
+	}
+	if !cfg.GlobalBandwidth {
+		return ratelimit.New(rate, burst)
+	}
+	now := time.Now()
+	key := sharedLimiterKey{applied: cfg.UpdatedAt.UTC(), rate: rate, burst: burst, dir: dir}
+	sharedLimiters.Lock()
+	defer sharedLimiters.Unlock()
+	if sharedLimiters.byKey == nil {
+		sharedLimiters.byKey = map[sharedLimiterKey]*sharedLimiter{}
+	}
+	sl, ok := sharedLimiters.byKey[key]
+	if !ok {
+		for k, old := range sharedLimiters.byKey {
+			if now.Sub(old.taken) > sharedLimiterIdle {
+				delete(sharedLimiters.byKey, k)
+			}
+		}
+		sl = &sharedLimiter{l: ratelimit.New(rate, burst)}
+		sharedLimiters.byKey[key] = sl
+	}
+	sl.taken = now
+	return sl.l
+}
+
+// shapedCopy relays src to dst, writing at most l.Burst() bytes at a time and waiting
+// on l before each write.
+func shapedCopy(ctx context.Context, dst io.Writer, src io.Reader, l *ratelimit.Limiter) error {
+	buf := make([]byte, 16*1024)
+	step := min(l.Burst(), len(buf))
+	for {
+		n, er := src.Read(buf)
+		for off := 0; off < n; off += step {
+			end := min(off+step, n)
+			if err := l.WaitN(ctx, end-off); err != nil {
+				return err
+			}
+			if _, ew := dst.Write(buf[off:end]); ew != nil {
+				return ew
+			}
+		}
+		if er != nil {
+			return er
+		}
+	}
+}
+
+// handleLoss forwards the ClientHello intact, then drops each client->upstream chunk
+// with probability LossPercent/100. 0 behaves like CLEAN; 100 blackholes everything
+// after the ClientHello while still relaying upstream->client.
+func handleLoss(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	if cfg.LossPercent <= 0 {
+		return handleCleanPassthrough(cbr, client, upstream, impair.NewState(cfg), id, logger, st)
+	}
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	logger.Printf("[conn %d] PACKET_LOSS loss=%.1f%% ch_len=%d", id, cfg.LossPercent, res.HandshakeBytes)
+	if _, err := upstream.Write(records); err != nil {
+		return fmt.Errorf("write CH to upstream: %w", err)
+	}
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 16*1024)
+		for {
+			n, er := cbr.Read(buf)
+			if n > 0 {
+				if rand.Float64()*100 < cfg.LossPercent {
+					st.DroppedBytes += int64(n)
+				} else if _, ew := upstream.Write(buf[:n]); ew != nil {
+					er = ew
+				}
+			}
+			if er != nil {
+				errc <- er
+				return
+			}
+		}
+	}()
+	go func() { _, er := io.Copy(client, upstream); errc <- er }()
+	err1 := <-errc
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		return err2
+	}
+	return nil
+}
+
+// handleResetAfterBytes relays both directions untouched until ResetAfterBytes of
+// upstream->client data have been delivered, then resets both sides.
+func handleResetAfterBytes(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	limit := int64(cfg.ResetAfterBytes)
+	if limit <= 0 {
+		limit = 64 * 1024
+	}
+	logger.Printf("[conn %d] RESET_AFTER_BYTES: reset after %d upstream bytes", id, limit)
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, cbr)
+		errc <- err
+	}()
+	reset := make(chan struct{})
+	go func() {
+		buf := make([]byte, 16*1024)
+		var total int64
+		for {
+			n, er := upstream.Read(buf)
+			if n > 0 {
+				w := int64(n)
+				if total+w > limit {
+					w = limit - total
+				}
+				if _, ew := client.Write(buf[:w]); ew != nil {
+					errc <- ew
+					return
+				}
+				total += w
+				if total >= limit {
+					st.ResetAtBytes = total
+					logger.Printf("[conn %d] RESET_AFTER_BYTES: resetting after %d bytes", id, total)
+					close(reset)
+					abortConn(client)
+					abortConn(upstream)
+					errc <- nil
+					return
+				}
+			}
+			if er != nil {
+				errc <- er
+				return
+			}
+		}
+	}()
+	err1 := <-errc
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	select {
+	case <-reset:
+		// errors after the deliberate reset are expected
+		return nil
+	default:
+	}
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		return err2
+	}
+	return nil
+}
+
+// handleSlowDrip forwards the ClientHello whole so the handshake completes, then
+// trickles client->upstream data at most DripBytes every DripIntervalMs, independent
+// of the BANDWIDTH profile. upstream->client is relayed untouched.
+func handleSlowDrip(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	step := cfg.DripBytes
+	if step <= 0 {
+		step = 1
+	}
+	interval := time.Duration(cfg.DripIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	logger.Printf("[conn %d] SLOW_DRIP %d byte(s) every %s ch_len=%d", id, step, interval, res.HandshakeBytes)
+	if _, err := upstream.Write(records); err != nil {
+		return fmt.Errorf("write CH to upstream: %w", err)
+	}
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 16*1024)
+		for {
+			n, er := cbr.Read(buf)
+			for off := 0; off < n; off += step {
+				end := min(off+step, n)
+				if _, ew := upstream.Write(buf[off:end]); ew != nil {
+					errc <- ew
+					return
+				}
+				time.Sleep(interval)
+			}
+			if er != nil {
+				errc <- er
+				return
+			}
+		}
+	}()
+	go func() { _, er := io.Copy(client, upstream); errc <- er }()
+	err1 := <-errc
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		return err2
+	}
+	return nil
+}
+
+// handleCorrupt forwards the ClientHello untouched, then flips one random bit in a
+// CorruptPercent share of forwarded chunks in the CorruptDirection copy loop(s), so
+// clients (or servers) should fail the TLS record MAC check and close.
+func handleCorrupt(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	dir := cfg.CorruptDirection
+	if dir == "" {
+		dir = impair.CorruptDown
+	}
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	logger.Printf("[conn %d] CORRUPT pct=%.1f%% direction=%s ch_len=%d", id, cfg.CorruptPercent, dir, res.HandshakeBytes)
+	if _, err := upstream.Write(records); err != nil {
+		return fmt.Errorf("write CH to upstream: %w", err)
+	}
+	upPct, downPct := 0.0, 0.0
+	if dir == impair.CorruptUp || dir == impair.CorruptBoth {
+		upPct = cfg.CorruptPercent
+	}
+	if dir == impair.CorruptDown || dir == impair.CorruptBoth {
+		downPct = cfg.CorruptPercent
+	}
+	var upHits, downHits int64
+	errc := make(chan error, 2)
+	go func() { errc <- corruptCopy(upstream, cbr, upPct, &upHits) }()
+	go func() { errc <- corruptCopy(client, upstream, downPct, &downHits) }()
+	err1 := <-errc
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	st.CorruptedChunks = upHits + downHits
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		return err2
+	}
+	return nil
+}
+
+// corruptCopy relays src to dst, flipping one random bit in each chunk with probability
+// pct/100 and counting the corrupted chunks in hits.
+func corruptCopy(dst io.Writer, src io.Reader, pct float64, hits *int64) error {
+	buf := make([]byte, 16*1024)
+	for {
+		n, er := src.Read(buf)
+		if n > 0 {
+			if pct > 0 && rand.Float64()*100 < pct {
+				buf[rand.Intn(n)] ^= 1 << rand.Intn(8)
+				*hits++
+			}
+			if _, ew := dst.Write(buf[:n]); ew != nil {
+				return ew
+			}
+		}
+		if er != nil {
+			return er
+		}
 	}
- 	err1 := <-errc
- 	_ = client.Close(); _ = upstream.Close()
- 	err2 := <-errc
- 	if err1 != nil && !errors.Is(err1, io.EOF) { return err1 }
- 	if err2 != nil && !errors.Is(err2, io.EOF) { return err2 }
- 	return nil
 }
 
 func abortConn(c net.Conn) {
-	if tcp, ok := c.(*net.TCPConn); ok {
+	if tcp, ok := baseConn(c).(*net.TCPConn); ok {
 		// SetLinger(0) generally results in an RST on close (Unix, Windows).
 		_ = tcp.SetLinger(0)
 		_ = tcp.Close()
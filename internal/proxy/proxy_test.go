@@ -1,12 +1,15 @@
 package proxy
 
 import (
+    "bytes"
     "io"
+    "crypto/tls"
     "net"
     "sync"
     "testing"
     "time"
     "pathlab/internal/impair"
+    "pathlab/internal/proxyproto"
     "log"
 )
 
@@ -43,6 +46,31 @@ func TestHandleConnectionAbortAfterCH(t *testing.T) {
     wg.Wait()
 }
 
+func abortAfterServerBytes(t *testing.T, upstream string, n int) (Stats, []byte, time.Duration) {
+    c1, c2 := net.Pipe()
+    statsc := make(chan Stats, 1)
+    start := time.Now()
+    go func(){ st, _ := HandleConnection(c2, upstream, impair.Config{Profile: impair.ProfileAbortAfterCH, AbortAfterServerBytes: n}, 1, log.New(io.Discard, "", 0)); statsc <- st }()
+    c1.Write(minimalClientHello())
+    got, _ := io.ReadAll(c1)
+    c1.Close()
+    return <-statsc, got, time.Since(start)
+}
+
+func TestAbortAfterCHRelaysServerBytesFirst(t *testing.T) {
+    flight := bytes.Repeat([]byte{0x16}, 300)
+    upstream, closeUp := startRequestResponseUpstream(t, len(minimalClientHello()), flight); defer closeUp()
+    st, got, _ := abortAfterServerBytes(t, upstream, 120)
+    if !bytes.Equal(got, flight[:120]) || st.ServerBytes != 120 { t.Fatalf("client got %d bytes, stats %d; want 120", len(got), st.ServerBytes) }
+}
+
+func TestAbortAfterCHSilentUpstreamStillAborts(t *testing.T) {
+    upstream, closeUp := startDummyUpstream(t); defer closeUp()
+    st, got, took := abortAfterServerBytes(t, upstream, 120)
+    if len(got) != 0 || st.ServerBytes != 0 { t.Fatalf("client got %d bytes, stats %d; want none", len(got), st.ServerBytes) }
+    if took < abortServerWait || took > abortServerWait+time.Second { t.Fatalf("aborted after %s, want about %s", took, abortServerWait) }
+}
+
 func TestHandleConnectionBandwidthLimit(t *testing.T) {
     upstream, closeUp := startDummyUpstream(t); defer closeUp()
     c1, c2 := net.Pipe()
@@ -63,3 +91,304 @@ func TestHandleConnectionBandwidthLimit(t *testing.T) {
     if elapsed > 3*time.Second { t.Fatalf("took too long: %v", elapsed) }
     wg.Wait()
 }
+
+// minimalClientHello returns a single TLS record carrying a ClientHello without extensions.
+func minimalClientHello() []byte {
+    body := []byte{0x03, 0x03}
+    body = append(body, make([]byte, 32)...) // random
+    body = append(body, 0x00)                // session_id
+    body = append(body, 0x00, 0x02, 0x13, 0x01) // one cipher suite
+    body = append(body, 0x01, 0x00)          // compression methods
+    body = append(body, 0x00, 0x00)          // extensions
+    hs := append([]byte{0x01, 0x00, byte(len(body) >> 8), byte(len(body))}, body...)
+    return append([]byte{0x16, 0x03, 0x01, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+// startRecordingUpstream accepts a single connection and delivers everything it read once the peer closes.
+func startRecordingUpstream(t *testing.T) (addr string, got <-chan []byte, closeFn func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    out := make(chan []byte, 1)
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        b, _ := io.ReadAll(c)
+        c.Close()
+        out <- b
+    }()
+    return ln.Addr().String(), out, func(){ ln.Close() }
+}
+
+func runLoss(t *testing.T, lossPercent float64, payload []byte) (Stats, []byte) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    cfg := impair.Config{Profile: impair.ProfileLoss, LossPercent: lossPercent}
+    logger := log.New(io.Discard, "", 0)
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, cfg, 3, logger); statsc <- st }()
+    if _, err := c1.Write(minimalClientHello()); err != nil { t.Fatalf("write CH: %v", err) }
+    if _, err := c1.Write(payload); err != nil { t.Fatalf("write payload: %v", err) }
+    c1.Close()
+    var st Stats
+    select {
+    case st = <-statsc:
+    case <-time.After(3 * time.Second):
+        t.Fatalf("handler did not return")
+    }
+    select {
+    case b := <-got:
+        return st, b
+    case <-time.After(3 * time.Second):
+        t.Fatalf("upstream never saw close")
+    }
+    return st, nil
+}
+
+func TestHandleConnectionLossFull(t *testing.T) {
+    payload := []byte("application data that must never arrive")
+    st, got := runLoss(t, 100, payload)
+    if string(got) != string(minimalClientHello()) { t.Fatalf("upstream got %q, want only the ClientHello", got) }
+    if st.DroppedBytes != int64(len(payload)) { t.Fatalf("dropped %d bytes, want %d", st.DroppedBytes, len(payload)) }
+}
+
+func TestHandleConnectionLossZeroIsClean(t *testing.T) {
+    payload := []byte("application data passes untouched")
+    st, got := runLoss(t, 0, payload)
+    want := append(minimalClientHello(), payload...)
+    if string(got) != string(want) { t.Fatalf("upstream got %q, want %q", got, want) }
+    if st.DroppedBytes != 0 { t.Fatalf("dropped %d bytes with loss 0", st.DroppedBytes) }
+}
+
+// startEchoUpstream echoes everything each connection sends.
+func startEchoUpstream(t *testing.T) (addr string, closeFn func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    go func(){
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func(conn net.Conn){ io.Copy(conn, conn); conn.Close() }(c)
+        }
+    }()
+    return ln.Addr().String(), func(){ ln.Close() }
+}
+
+// firstEchoDelay sends a ClientHello through the proxy and times the first echoed byte.
+func firstEchoDelay(t *testing.T, cfg impair.Config) time.Duration {
+    upstream, closeUp := startEchoUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    logger := log.New(io.Discard, "", 0)
+    done := make(chan struct{})
+    go func(){ HandleConnection(c2, upstream, cfg, 5, logger); close(done) }()
+    start := time.Now()
+    if _, err := c1.Write(minimalClientHello()); err != nil { t.Fatalf("write CH: %v", err) }
+    _ = c1.SetReadDeadline(time.Now().Add(3 * time.Second))
+    buf := make([]byte, 1)
+    if _, err := c1.Read(buf); err != nil { t.Fatalf("read echo: %v", err) }
+    elapsed := time.Since(start)
+    c1.Close()
+    <-done
+    return elapsed
+}
+
+func TestLatencyDownDelaysUpstreamToClient(t *testing.T) {
+    up := firstEchoDelay(t, impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 10})
+    if up > 150*time.Millisecond { t.Fatalf("up-only latency delayed echo by %v", up) }
+    down := firstEchoDelay(t, impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 10, LatencyDownMs: 200})
+    if down < 200*time.Millisecond { t.Fatalf("downstream latency not applied; echo after %v", down) }
+}
+
+func TestHandleConnectionResetAfterBytes(t *testing.T) {
+    upstream, closeUp := startEchoUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    cfg := impair.Config{Profile: impair.ProfileResetAfterBytes, ResetAfterBytes: 100}
+    logger := log.New(io.Discard, "", 0)
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, cfg, 6, logger); statsc <- st }()
+    go func(){ c1.Write(make([]byte, 300)) }()
+    _ = c1.SetReadDeadline(time.Now().Add(3 * time.Second))
+    got, err := io.ReadAll(c1)
+    if err != nil && err != io.ErrClosedPipe { t.Logf("read ended with %v", err) }
+    if len(got) != 100 { t.Fatalf("client received %d bytes before reset, want 100", len(got)) }
+    if st := <-statsc; st.ResetAtBytes != 100 { t.Fatalf("ResetAtBytes = %d, want 100", st.ResetAtBytes) }
+}
+
+func TestHandleConnectionLiveOverrideMidStream(t *testing.T) {
+    upstream, closeUp := startEchoUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    live := impair.NewState(impair.Config{Profile: impair.ProfileClean})
+    logger := log.New(io.Discard, "", 0)
+    done := make(chan struct{})
+    go func(){ HandleConnectionLive(c2, upstream, live, 7, logger); close(done) }()
+    roundTrip := func() time.Duration {
+        start := time.Now()
+        if _, err := c1.Write([]byte("ping")); err != nil { t.Fatalf("write: %v", err) }
+        _ = c1.SetReadDeadline(time.Now().Add(3 * time.Second))
+        buf := make([]byte, 4)
+        if _, err := io.ReadFull(c1, buf); err != nil { t.Fatalf("read echo: %v", err) }
+        return time.Since(start)
+    }
+    if d := roundTrip(); d > 150*time.Millisecond { t.Fatalf("clean round trip took %v", d) }
+    live.Apply(impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 200, JitterMs: 1})
+    if d := roundTrip(); d < 190*time.Millisecond { t.Fatalf("override not applied mid-stream; round trip %v", d) }
+    c1.Close()
+    <-done
+}
+
+func TestCanOverride(t *testing.T) {
+    for _, c := range []struct{ started, to impair.ProfileName; ok bool }{
+        {impair.ProfileClean, impair.ProfileLatencyJitter, true},
+        {"", impair.ProfileLoss, true},
+        {impair.ProfileClean, impair.ProfileBandwidthLimit, true},
+        {impair.ProfileClean, impair.ProfileClean, true},
+        {impair.ProfileClean, impair.ProfileAbortAfterCH, false},
+        {impair.ProfileClean, impair.ProfileStall, false},
+        {impair.ProfileLatencyJitter, impair.ProfileLatencyJitter, false},
+        {impair.ProfileMTUBlackhole, impair.ProfileClean, false},
+    } {
+        if err := CanOverride(c.started, c.to); (err == nil) != c.ok { t.Errorf("%s -> %s: %v, want ok=%v", c.started, c.to, err, c.ok) }
+    }
+}
+
+func TestHandleConnectionSlowDrip(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    ch := minimalClientHello()
+    type arrival struct{ n int; at time.Time }
+    arrivals := make(chan []arrival, 1)
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        io.ReadFull(c, make([]byte, len(ch)))
+        var got []arrival
+        buf := make([]byte, 64)
+        for {
+            n, err := c.Read(buf)
+            if n > 0 { got = append(got, arrival{n, time.Now()}) }
+            if err != nil { break }
+        }
+        arrivals <- got
+    }()
+    c1, c2 := net.Pipe()
+    cfg := impair.Config{Profile: impair.ProfileSlowDrip, DripBytes: 2, DripIntervalMs: 30}
+    done := make(chan struct{})
+    go func(){ HandleConnection(c2, ln.Addr().String(), cfg, 8, log.New(io.Discard, "", 0)); close(done) }()
+    c1.Write(ch)
+    start := time.Now()
+    c1.Write([]byte("0123456789"))
+    c1.Close() // the handler drips out what it already read before acting on EOF
+    var got []arrival
+    select {
+    case got = <-arrivals:
+    case <-time.After(3 * time.Second):
+        t.Fatalf("upstream never saw close")
+    }
+    <-done
+    total := 0
+    for _, a := range got {
+        if a.n > 2 { t.Fatalf("upstream read %d bytes at once, want at most 2", a.n) }
+        total += a.n
+    }
+    if total != 10 { t.Fatalf("upstream got %d bytes, want 10", total) }
+    if d := got[len(got)-1].at.Sub(start); d < 4*30*time.Millisecond { t.Fatalf("10 bytes arrived after %v, want >= 120ms at 2B/30ms", d) }
+}
+
+func TestHandleConnectionCorruptDownFailsTLS(t *testing.T) {
+    cfg := impair.Config{Profile: impair.ProfileCorrupt, CorruptPercent: 100, CorruptDirection: impair.CorruptDown}
+    st, _, err := tlsThroughProxy(t, startTLSEchoUpstream(t, tls.X25519), cfg)
+    if err == nil { t.Fatalf("TLS handshake succeeded through 100%% downstream corruption") }
+    if st.CorruptedChunks == 0 { t.Fatalf("no corrupted chunks recorded") }
+}
+
+func TestHandleConnectionCorruptUpOnly(t *testing.T) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    cfg := impair.Config{Profile: impair.ProfileCorrupt, CorruptPercent: 100, CorruptDirection: impair.CorruptUp}
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, cfg, 10, log.New(io.Discard, "", 0)); statsc <- st }()
+    ch := minimalClientHello()
+    payload := make([]byte, 64)
+    c1.Write(ch)
+    c1.Write(payload)
+    c1.Close()
+    st := <-statsc
+    b := <-got
+    if len(b) != len(ch)+len(payload) { t.Fatalf("upstream got %d bytes, want %d", len(b), len(ch)+len(payload)) }
+    if string(b[:len(ch)]) != string(ch) { t.Fatalf("ClientHello was corrupted") }
+    flipped := 0
+    for i, c := range b[len(ch):] { if c != payload[i] { flipped++ } }
+    if flipped != 1 || st.CorruptedChunks != 1 { t.Fatalf("flipped %d bytes, %d chunks counted; want exactly one", flipped, st.CorruptedChunks) }
+}
+
+func TestHandleConnectionStall(t *testing.T) {
+    upstream, closeUp := startEchoUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    // a caller deadline that would expire mid-stall must be pushed past it
+    _ = c2.SetDeadline(time.Now().Add(150 * time.Millisecond))
+    // 150 bytes up plus the first 50 echoed back reach the threshold
+    cfg := impair.Config{Profile: impair.ProfileStall, StallAfterBytes: 200, StallSeconds: 0.3}
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, cfg, 11, log.New(io.Discard, "", 0)); statsc <- st }()
+    start := time.Now()
+    go func(){ c1.Write(make([]byte, 150)) }()
+    _ = c1.SetReadDeadline(time.Now().Add(3 * time.Second))
+    buf := make([]byte, 150)
+    if _, err := io.ReadFull(c1, buf[:50]); err != nil { t.Fatalf("read before stall: %v", err) }
+    if d := time.Since(start); d > 150*time.Millisecond { t.Fatalf("bytes before the threshold delayed %v", d) }
+    if _, err := io.ReadFull(c1, buf[50:]); err != nil { t.Fatalf("read after stall: %v", err) }
+    if d := time.Since(start); d < 300*time.Millisecond { t.Fatalf("all 150 bytes echoed after %v, want a 300ms stall", d) }
+    c1.Close()
+    st := <-statsc
+    if st.StallAtBytes != 200 || st.StallMs < 250 { t.Fatalf("stall not recorded: at=%d ms=%d", st.StallAtBytes, st.StallMs) }
+}
+
+func TestCleanPassthroughTimesHandshake(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        buf := make([]byte, 1024)
+        if _, err := c.Read(buf); err != nil { return }
+        time.Sleep(80 * time.Millisecond) // a slow upstream
+        c.Write([]byte("server hello"))
+        io.Copy(io.Discard, c)
+    }()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, ln.Addr().String(), impair.Config{Profile: impair.ProfileClean}, 14, log.New(io.Discard, "", 0)); statsc <- st }()
+    if _, err := c1.Write(minimalClientHello()); err != nil { t.Fatalf("write CH: %v", err) }
+    _ = c1.SetReadDeadline(time.Now().Add(3 * time.Second))
+    if _, err := c1.Read(make([]byte, 64)); err != nil { t.Fatalf("read: %v", err) }
+    c1.Close()
+    if st := <-statsc; st.HandshakeTime < 80*time.Millisecond || st.HandshakeTime > time.Second { t.Fatalf("HandshakeTime = %v, want ~80ms", st.HandshakeTime) }
+}
+
+func TestSendProxyProtocolPrefixesUpstream(t *testing.T) {
+    SetSendProxyProtocol(true); defer SetSendProxyProtocol(false)
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    cc, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil { t.Fatalf("dial: %v", err) }
+    sc, err := ln.Accept()
+    if err != nil { t.Fatalf("accept: %v", err) }
+    ch := minimalClientHello()
+    go func(){ cc.Write(ch); cc.Close() }()
+    HandleConnection(sc, upstream, impair.Config{Profile: impair.ProfileClean}, 1, log.New(io.Discard, "", 0))
+    b := <-got
+    h, n, err := proxyproto.Parse(b)
+    if err != nil || h.Source.String() != cc.LocalAddr().String() || h.Destination.String() != ln.Addr().String() { t.Fatalf("header %+v, %v", h, err) }
+    if !bytes.Equal(b[n:], ch) { t.Fatalf("after the header upstream got %d bytes, want the ClientHello", len(b)-n) }
+}
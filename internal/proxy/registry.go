@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnRegistry tracks the client connections being proxied, by connection id, so
+// shutdown can drain them (-drain-timeout) and the admin API can list and close
+// them (GET /connections, DELETE /connections/{id}).
+type ConnRegistry struct {
+	mu       sync.Mutex
+	conns    map[int64]*trackedConn
+	draining bool
+}
+
+// NewConnRegistry returns an empty registry.
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: map[int64]*trackedConn{}}
+}
+
+// Why a tracked connection was closed from outside its handler (ConnRegistry.Finish).
+const (
+	ClosedByDrain = "drained"      // Drain closed it at shutdown
+	ClosedByAdmin = "admin_killed" // Kill closed it
+)
+
+// Tracker is told about the bytes a connection moves as its handler's copy loops
+// write them. HandleConnection finds it by unwrapping the client connection, so a
+// registered connection's counts are live while it is open.
+type Tracker interface {
+	AddUp(n int64)   // written to the upstream
+	AddDown(n int64) // written to the client
+}
+
+// ConnInfo is a live connection in ConnRegistry.List.
+type ConnInfo struct {
+	ID         int64     `json:"id"`
+	ClientAddr string    `json:"client_addr"`
+	Profile    string    `json:"profile,omitempty"`
+	Started    time.Time `json:"started"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+}
+
+// trackedConn is a registered client connection. drained is closed when Drain or
+// Kill force-closes it, which also ends the timed holds of profile handlers (see
+// drainSignal); closedBy says which, and is set under the registry's lock.
+type trackedConn struct {
+	net.Conn
+	drained  chan struct{}
+	closedBy string
+	started  time.Time
+	client   string
+	profile  string
+	up, down atomic.Int64
+}
+
+func (c *trackedConn) AddUp(n int64)   { c.up.Add(n) }
+func (c *trackedConn) AddDown(n int64) { c.down.Add(n) }
+
+// forceClose closes c for why unless it was already force-closed; called with the
+// registry's lock held.
+func (c *trackedConn) forceClose(why string) {
+	if c.closedBy == "" {
+		c.closedBy = why
+		close(c.drained)
+	}
+	_ = c.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *trackedConn) NetConn() net.Conn { return c.Conn }
+
+// Track registers c under id and returns the connection to proxy in its place.
+// Once Drain has started it closes c and returns false instead.
+func (r *ConnRegistry) Track(id int64, c net.Conn) (net.Conn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		_ = c.Close()
+		return nil, false
+	}
+	tc := &trackedConn{Conn: c, drained: make(chan struct{}), started: time.Now(), client: c.RemoteAddr().String()}
+	r.conns[id] = tc
+	return tc, true
+}
+
+// Describe records, for List, the client address id reports (after a PROXY
+// protocol header; "" keeps the socket's peer) and the profile it is proxied with.
+func (r *ConnRegistry) Describe(id int64, clientAddr, profile string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tc, ok := r.conns[id]; ok {
+		if clientAddr != "" {
+			tc.client = clientAddr
+		}
+		tc.profile = profile
+	}
+}
+
+// Untrack removes id and reports whether Drain or Kill force-closed it. Further
+// calls for the same id return false.
+func (r *ConnRegistry) Untrack(id int64) bool {
+	return r.Finish(id) != ""
+}
+
+// Finish removes id and returns why it was force-closed: ClosedByDrain,
+// ClosedByAdmin, or "" when it ended on its own (or is not tracked).
+func (r *ConnRegistry) Finish(id int64) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tc, ok := r.conns[id]
+	if !ok {
+		return ""
+	}
+	delete(r.conns, id)
+	return tc.closedBy
+}
+
+// Kill closes the client connection id, ending any hold its handler is in; the
+// handler then closes the upstream leg and returns, and Finish reports
+// ClosedByAdmin. It returns false when id is not tracked.
+func (r *ConnRegistry) Kill(id int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tc, ok := r.conns[id]
+	if ok {
+		tc.forceClose(ClosedByAdmin)
+	}
+	return ok
+}
+
+// List returns the tracked connections in id order.
+func (r *ConnRegistry) List() []ConnInfo {
+	r.mu.Lock()
+	out := make([]ConnInfo, 0, len(r.conns))
+	for id, tc := range r.conns {
+		out = append(out, ConnInfo{ID: id, ClientAddr: tc.client, Profile: tc.profile, Started: tc.started, BytesUp: tc.up.Load(), BytesDown: tc.down.Load()})
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Len returns the number of tracked connections.
+func (r *ConnRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// Drain stops tracking new connections, waits up to timeout for the tracked ones to
+// finish, then closes those left and returns how many it closed. Their handlers
+// return shortly after; Untrack reports them as forced.
+func (r *ConnRegistry) Drain(timeout time.Duration) int {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+	deadline := time.Now().Add(timeout)
+	for r.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(min(20*time.Millisecond, time.Until(deadline)))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, tc := range r.conns {
+		tc.forceClose(ClosedByDrain)
+	}
+	return len(r.conns)
+}
+
+// drainSignal returns a channel closed when Drain or Kill force-closes c (or the tracked
+// connection under its wrappers), or nil when c is not tracked. Handlers holding a
+// connection on a timer select on it to let go early.
+func drainSignal(c net.Conn) <-chan struct{} {
+	for {
+		switch w := c.(type) {
+		case *trackedConn:
+			return w.drained
+		case *countingConn:
+			c = w.Conn
+		case *PeekedConn:
+			c = w.Conn
+		case interface{ NetConn() net.Conn }:
+			c = w.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// trackerOf returns the Tracker under c's wrappers, or nil when there is none.
+func trackerOf(c net.Conn) Tracker {
+	for {
+		if t, ok := c.(Tracker); ok {
+			return t
+		}
+		switch w := c.(type) {
+		case *countingConn:
+			c = w.Conn
+		case *PeekedConn:
+			c = w.Conn
+		case interface{ NetConn() net.Conn }:
+			c = w.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+    "io"
+    "log"
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func TestDrainClosesHeldBlackholeConnection(t *testing.T) {
+    upstream, closeUp := startDummyUpstream(t); defer closeUp()
+    reg := NewConnRegistry()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    tc, ok := reg.Track(7, c2)
+    if !ok { t.Fatal("Track refused before Drain") }
+    done := make(chan struct{})
+    go func(){
+        defer close(done)
+        HandleConnection(tc, upstream, impair.Config{Profile: impair.ProfileMTUBlackhole, ThresholdBytes: 10, BlackholeSeconds: 30}, 7, log.New(io.Discard, "", 0))
+    }()
+    go io.Copy(io.Discard, c1)
+    c1.Write(minimalClientHello())
+    start := time.Now()
+    if n := reg.Drain(200 * time.Millisecond); n != 1 { t.Fatalf("Drain forced %d connections, want 1", n) }
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatal("blackhole handler still holding after the drain window")
+    }
+    if d := time.Since(start); d < 200*time.Millisecond || d > time.Second { t.Fatalf("drained after %s, want about the 200ms window", d) }
+    if !reg.Untrack(7) { t.Fatal("Untrack did not report the forced close") }
+    if _, ok := reg.Track(8, c1); ok { t.Fatal("Track accepted a connection while draining") }
+}
+
+func TestDrainWaitsForFinishingConnections(t *testing.T) {
+    reg := NewConnRegistry()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    reg.Track(1, c2)
+    time.AfterFunc(50*time.Millisecond, func(){ reg.Untrack(1) })
+    start := time.Now()
+    if n := reg.Drain(5 * time.Second); n != 0 || time.Since(start) > time.Second { t.Fatalf("forced %d after %s", n, time.Since(start)) }
+}
+
+func TestKillClosesListedBlackholeConnection(t *testing.T) {
+    upstream, closeUp := startDummyUpstream(t); defer closeUp()
+    reg := NewConnRegistry()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    tc, _ := reg.Track(3, c2)
+    reg.Describe(3, "192.0.2.7:4433", string(impair.ProfileMTUBlackhole))
+    done := make(chan struct{})
+    go func(){
+        defer close(done)
+        HandleConnection(tc, upstream, impair.Config{Profile: impair.ProfileMTUBlackhole, ThresholdBytes: 10, BlackholeSeconds: 30}, 3, log.New(io.Discard, "", 0))
+    }()
+    go io.Copy(io.Discard, c1)
+    ch := minimalClientHello()
+    c1.Write(ch)
+    deadline := time.Now().Add(2 * time.Second)
+    var list []ConnInfo
+    for time.Now().Before(deadline) {
+        if list = reg.List(); len(list) == 1 && list[0].BytesUp > 0 { break }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if len(list) != 1 { t.Fatalf("List = %+v, want the one connection", list) }
+    if c := list[0]; c.ID != 3 || c.ClientAddr != "192.0.2.7:4433" || c.Profile != string(impair.ProfileMTUBlackhole) || c.BytesUp != 10 || c.Started.IsZero() { t.Fatalf("listed %+v", c) }
+    if reg.Kill(4) { t.Fatal("Kill reported an unknown connection") }
+    if !reg.Kill(3) { t.Fatal("Kill did not find the connection") }
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatal("blackhole handler still holding after Kill")
+    }
+    if why := reg.Finish(3); why != ClosedByAdmin { t.Fatalf("Finish = %q, want %q", why, ClosedByAdmin) }
+    if n := len(reg.List()); n != 0 { t.Fatalf("%d connections listed after Finish", n) }
+}
+
+func TestRegistryChurn(t *testing.T) {
+    reg := NewConnRegistry()
+    var wg sync.WaitGroup
+    for i := int64(1); i <= 200; i++ {
+        wg.Add(1)
+        go func(id int64){
+            defer wg.Done()
+            c1, c2 := net.Pipe()
+            defer c1.Close()
+            tc, _ := reg.Track(id, c2)
+            reg.Describe(id, "", "CLEAN")
+            tc.(Tracker).AddUp(1)
+            if id%3 == 0 { reg.Kill(id) }
+            reg.List()
+            if why := reg.Finish(id); (id%3 == 0) != (why == ClosedByAdmin) { t.Errorf("conn %d: Finish = %q", id, why) }
+        }(i)
+    }
+    wg.Wait()
+    if n := reg.Len(); n != 0 { t.Fatalf("%d connections left after churn", n) }
+}
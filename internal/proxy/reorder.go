@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"pathlab/internal/impair"
+)
+
+// reorderFlushAfter bounds how long a held-back chunk waits for a successor; a client
+// that sends one request and waits for the reply must not stall on its own data.
+const reorderFlushAfter = 50 * time.Millisecond
+
+// handleReorder forwards the ClientHello intact, then reads client->upstream data in
+// ReorderWindowBytes chunks and, with probability ReorderPercent/100, holds a chunk
+// back and sends it after the next one. Bytes are never dropped or duplicated.
+func handleReorder(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	window := cfg.ReorderWindowBytes
+	if window <= 0 {
+		window = 1460
+	}
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	logger.Printf("[conn %d] REORDER pct=%.1f%% window=%d ch_len=%d", id, cfg.ReorderPercent, window, res.HandshakeBytes)
+	if _, err := upstream.Write(records); err != nil {
+		return fmt.Errorf("write CH to upstream: %w", err)
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- reorderCopy(upstream, cbr, client, cfg.ReorderPercent, window, st) }()
+	go func() { _, er := io.Copy(client, upstream); errc <- er }()
+	err1 := <-errc
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		return err2
+	}
+	return nil
+}
+
+// reorderCopy relays src to dst in window-sized chunks, swapping a chunk with its
+// successor with probability pct/100. While a chunk is held, reads on conn (the
+// connection behind src) carry a deadline so the chunk is flushed in order if no
+// successor arrives within reorderFlushAfter.
+func reorderCopy(dst io.Writer, src io.Reader, conn net.Conn, pct float64, window int, st *Stats) error {
+	buf := make([]byte, window)
+	var held []byte
+	flush := func() error {
+		if held == nil {
+			return nil
+		}
+		_, err := dst.Write(held)
+		held = nil
+		return err
+	}
+	for {
+		if held != nil {
+			_ = conn.SetReadDeadline(time.Now().Add(reorderFlushAfter))
+		}
+		n, er := src.Read(buf)
+		if held != nil {
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+		if n > 0 {
+			switch {
+			case held != nil:
+				if _, ew := dst.Write(buf[:n]); ew != nil {
+					return ew
+				}
+				if ew := flush(); ew != nil {
+					return ew
+				}
+				st.ReorderedChunks++
+			case rand.Float64()*100 < pct:
+				held = append([]byte(nil), buf[:n]...)
+			default:
+				if _, ew := dst.Write(buf[:n]); ew != nil {
+					return ew
+				}
+			}
+		}
+		if errors.Is(er, os.ErrDeadlineExceeded) {
+			if ew := flush(); ew != nil {
+				return ew
+			}
+			continue
+		}
+		if er != nil {
+			if ew := flush(); ew != nil {
+				return ew
+			}
+			return er
+		}
+	}
+}
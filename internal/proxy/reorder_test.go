@@ -0,0 +1,64 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "sort"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+func TestHandleConnectionReorderPreservesBytes(t *testing.T) {
+    upstream, got, closeUp := startRecordingUpstream(t); defer closeUp()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    cfg := impair.Config{Profile: impair.ProfileReorder, ReorderPercent: 100, ReorderWindowBytes: 256}
+    logger := log.New(io.Discard, "", 0)
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, upstream, cfg, 4, logger); statsc <- st }()
+    ch := minimalClientHello()
+    if _, err := c1.Write(ch); err != nil { t.Fatalf("write CH: %v", err) }
+    var payload []byte
+    for i := 0; i < 16; i++ { payload = append(payload, bytes.Repeat([]byte{byte('a' + i)}, 256)...) }
+    // one window per write so the handler sees distinct chunks
+    for i := 0; i < len(payload); i += 256 {
+        if _, err := c1.Write(payload[i:i+256]); err != nil { t.Fatalf("write payload: %v", err) }
+    }
+    c1.Close()
+    var st Stats
+    select {
+    case st = <-statsc:
+    case <-time.After(3 * time.Second):
+        t.Fatalf("handler did not return")
+    }
+    var b []byte
+    select {
+    case b = <-got:
+    case <-time.After(3 * time.Second):
+        t.Fatalf("upstream never saw close")
+    }
+    if len(b) != len(ch)+len(payload) { t.Fatalf("upstream got %d bytes, want %d", len(b), len(ch)+len(payload)) }
+    if !bytes.Equal(b[:len(ch)], ch) { t.Fatalf("ClientHello was not forwarded intact") }
+    rest := b[len(ch):]
+    if bytes.Equal(rest, payload) || st.ReorderedChunks == 0 { t.Fatalf("no reordering happened (reordered=%d)", st.ReorderedChunks) }
+    sorted := func(p []byte) []byte { q := append([]byte(nil), p...); sort.Slice(q, func(i, j int) bool { return q[i] < q[j] }); return q }
+    if !bytes.Equal(sorted(rest), sorted(payload)) { t.Fatalf("reordered stream does not contain the same bytes") }
+}
+
+func TestReorderFlushesHeldChunkWithoutSuccessor(t *testing.T) {
+    c1, c2 := net.Pipe()
+    defer c1.Close(); defer c2.Close()
+    var out bytes.Buffer
+    var st Stats
+    done := make(chan error, 1)
+    go func(){ done <- reorderCopy(&out, c2, c2, 100, 64, &st) }()
+    if _, err := c1.Write([]byte("lonely request")); err != nil { t.Fatalf("write: %v", err) }
+    time.Sleep(4 * reorderFlushAfter)
+    c1.Close()
+    if err := <-done; err != nil && err != io.EOF { t.Fatalf("reorderCopy: %v", err) }
+    if out.String() != "lonely request" { t.Fatalf("held chunk not flushed, got %q", out.String()) }
+}
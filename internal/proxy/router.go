@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Router picks the upstream for a connection by its ClientHello SNI (-route). Names
+// match case-insensitively, exactly or, for a "*.example.com" route, any subdomain
+// (the longest wildcard wins). Anything else, including no SNI, goes to the default.
+type Router struct {
+	def      string
+	exact    map[string]string
+	wildcard map[string]string // suffix including the leading dot -> upstream
+}
+
+// NewRouter returns a Router sending everything to def until routes are added.
+func NewRouter(def string) *Router {
+	return &Router{def: def, exact: map[string]string{}, wildcard: map[string]string{}}
+}
+
+// Add parses and adds a route "sni=host:port" (sni may be "*.example.com"). A later
+// route for the same name replaces the earlier one.
+func (r *Router) Add(spec string) error {
+	sni, addr, ok := strings.Cut(spec, "=")
+	sni = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(sni), "."))
+	addr = strings.TrimSpace(addr)
+	if !ok || sni == "" || addr == "" {
+		return fmt.Errorf("route %q: want sni=host:port", spec)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("route %q: %w", spec, err)
+	}
+	if suffix, ok := strings.CutPrefix(sni, "*."); ok {
+		r.wildcard["."+suffix] = addr
+	} else {
+		r.exact[sni] = addr
+	}
+	return nil
+}
+
+// Resolve returns the upstream for sni.
+func (r *Router) Resolve(sni string) string {
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	if sni == "" {
+		return r.def
+	}
+	if addr, ok := r.exact[sni]; ok {
+		return addr
+	}
+	best, addr := "", r.def
+	for suffix, a := range r.wildcard {
+		if strings.HasSuffix(sni, suffix) && len(suffix) > len(best) {
+			best, addr = suffix, a
+		}
+	}
+	return addr
+}
+
+// Default returns the upstream for connections no route matches.
+func (r *Router) Default() string { return r.def }
+
+// Upstreams returns every upstream the Router can pick, the default first, each once.
+func (r *Router) Upstreams() []string {
+	out := []string{r.def}
+	seen := map[string]bool{r.def: true}
+	var routed []string
+	for _, m := range []map[string]string{r.exact, r.wildcard} {
+		for _, addr := range m {
+			if !seen[addr] {
+				seen[addr] = true
+				routed = append(routed, addr)
+			}
+		}
+	}
+	sort.Strings(routed)
+	return append(out, routed...)
+}
+
+// Len returns the number of routes.
+func (r *Router) Len() int { return len(r.exact) + len(r.wildcard) }
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestRouterResolve(t *testing.T) {
+    r := NewRouter("127.0.0.1:8443")
+    for _, spec := range []string{"example.com=10.0.0.5:8443", "*.example.com=10.0.0.6:8443", "*.api.example.com=10.0.0.7:8443", "Other.TEST.=[::1]:9443"} {
+        if err := r.Add(spec); err != nil { t.Fatalf("Add(%q): %v", spec, err) }
+    }
+    cases := map[string]string{
+        "example.com":        "10.0.0.5:8443",
+        "EXAMPLE.com.":       "10.0.0.5:8443",
+        "www.example.com":    "10.0.0.6:8443",
+        "v1.api.example.com": "10.0.0.7:8443",
+        "other.test":         "[::1]:9443",
+        "notexample.com":     "127.0.0.1:8443",
+        "":                   "127.0.0.1:8443",
+    }
+    for sni, want := range cases {
+        if got := r.Resolve(sni); got != want { t.Errorf("Resolve(%q)=%q, want %q", sni, got, want) }
+    }
+    if r.Len() != 4 || r.Default() != "127.0.0.1:8443" { t.Fatalf("len=%d default=%q", r.Len(), r.Default()) }
+    r.Add("www.other.test=10.0.0.5:8443")
+    if got := fmt.Sprint(r.Upstreams()); got != "[127.0.0.1:8443 10.0.0.5:8443 10.0.0.6:8443 10.0.0.7:8443 [::1]:9443]" { t.Fatalf("Upstreams()=%s", got) }
+}
+
+func TestRouterAddRejectsMalformed(t *testing.T) {
+    r := NewRouter("127.0.0.1:8443")
+    for _, spec := range []string{"example.com", "=10.0.0.5:8443", "example.com=", "example.com=10.0.0.5"} {
+        if err := r.Add(spec); err == nil { t.Errorf("Add(%q) accepted", spec) }
+    }
+}
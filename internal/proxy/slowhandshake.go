@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pathlab/internal/impair"
+	"pathlab/internal/impair/ratelimit"
+)
+
+// handshakePhase tracks the shaped phase of a SLOW_HANDSHAKE connection. It frames the
+// upstream->client stream as TLS records and ends the phase at the first record that
+// is neither handshake nor ChangeCipherSpec (application data or an alert). Under TLS
+// 1.3 that is the server's first encrypted record, right after the ServerHello.
+type handshakePhase struct {
+	tap      recordTap
+	pos      int64 // upstream->client bytes fed to tap
+	boundary int64 // stream offset of the first non-handshake record (-1 = not seen)
+	start    time.Time
+	over     atomic.Bool
+
+	mu  sync.Mutex
+	dur time.Duration
+}
+
+func newHandshakePhase() *handshakePhase {
+	p := &handshakePhase{boundary: -1, start: time.Now()}
+	p.tap.onRecord = func(typ byte, _, record []byte) bool {
+		if typ == recordHandshake || typ == recordChangeCipherSpec {
+			return true
+		}
+		p.boundary = int64(p.tap.seen - len(record))
+		return false
+	}
+	return p
+}
+
+// split feeds an upstream->client chunk to the framer and returns the part still in
+// the handshake phase and the part after it. A stream the framer gives up on (not
+// TLS, or past tapLimit) ends the phase after the chunk.
+func (p *handshakePhase) split(b []byte) (shaped, rest []byte) {
+	if p.over.Load() {
+		return nil, b
+	}
+	before := p.pos
+	_, _ = p.tap.Write(b)
+	p.pos += int64(len(b))
+	if t := &p.tap; !t.done && len(t.buf) > 0 && t.buf[0] != recordHandshake && t.buf[0] != recordChangeCipherSpec {
+		// the next record's header already says it is not handshake
+		p.boundary, t.done, t.buf = p.pos-int64(len(t.buf)), true, nil
+	}
+	if !p.tap.done {
+		return b, nil
+	}
+	off := len(b)
+	if p.boundary >= 0 {
+		off = int(min(max(p.boundary-before, 0), int64(len(b))))
+	}
+	p.end()
+	return b[:off], b[off:]
+}
+
+// end closes the phase (once) and records how long it lasted.
+func (p *handshakePhase) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.over.Load() {
+		p.dur = time.Since(p.start)
+		p.over.Store(true)
+	}
+}
+
+// duration returns how long the phase lasted, or has lasted so far.
+func (p *handshakePhase) duration() time.Duration {
+	p.end()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dur
+}
+
+// throttler applies SLOW_HANDSHAKE shaping to one direction: a per-chunk delay of
+// LatencyMs (+/- jitter) and, with BandwidthKbps, a token bucket.
+type throttler struct {
+	delay *impair.DelaySampler
+	limit *ratelimit.Limiter // nil = no bandwidth cap
+}
+
+func (t throttler) write(ctx context.Context, dst io.Writer, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if d := t.delay.Next(); d > 0 {
+		time.Sleep(d)
+	}
+	step := len(b)
+	if t.limit != nil {
+		step = t.limit.Burst()
+	}
+	for off := 0; off < len(b); off += step {
+		end := min(off+step, len(b))
+		if t.limit != nil {
+			if err := t.limit.WaitN(ctx, end-off); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Write(b[off:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleSlowHandshake shapes both directions (LatencyMs per chunk, BandwidthKbps) only
+// while the TLS handshake is in flight, then relays unimpaired, so handshake timeouts
+// can be tested without slowing the application data that follows. The phase ends at
+// the first upstream record that is not handshake or ChangeCipherSpec; its length is
+// reported in Stats.SlowHandshake.
+func handleSlowHandshake(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	records, _, res, err := readClientHello(cbr, client)
+	if err != nil {
+		return fmt.Errorf("parse clienthello: %w", err)
+	}
+	logger.Printf("[conn %d] SLOW_HANDSHAKE latency=%dms jitter=%dms bandwidth=%dkbps until the handshake completes, ch_len=%d", id, cfg.LatencyMs, cfg.JitterMs, cfg.BandwidthKbps, res.HandshakeBytes)
+	phase := newHandshakePhase()
+	newThrottler := func(dir string) throttler {
+		t := throttler{delay: impair.NewDelaySampler(cfg.LatencyMs, cfg.JitterMs, cfg.JitterDistribution, cfg.JitterSeed)}
+		if cfg.BandwidthKbps > 0 {
+			t.limit = bandwidthLimiter(cfg, dir, cfg.BandwidthKbps)
+		}
+		return t
+	}
+	up, down := newThrottler("up"), newThrottler("down")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := up.write(ctx, upstream, records); err != nil {
+		return err
+	}
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 16*1024)
+		for {
+			n, er := cbr.Read(buf)
+			if n > 0 {
+				var ew error
+				if phase.over.Load() {
+					_, ew = upstream.Write(buf[:n])
+				} else {
+					ew = up.write(ctx, upstream, buf[:n])
+				}
+				if ew != nil {
+					er = ew
+				}
+			}
+			if er != nil {
+				errc <- er
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 16*1024)
+		for {
+			n, er := upstream.Read(buf)
+			if n > 0 {
+				shaped, rest := phase.split(buf[:n])
+				ew := down.write(ctx, client, shaped)
+				if ew == nil && len(rest) > 0 {
+					_, ew = client.Write(rest)
+				}
+				if ew != nil {
+					er = ew
+				}
+			}
+			if er != nil {
+				errc <- er
+				return
+			}
+		}
+	}()
+	err1 := <-errc
+	cancel()
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	st.SlowHandshake = phase.duration()
+	logger.Printf("[conn %d] SLOW_HANDSHAKE: handshake phase lasted %dms", id, st.SlowHandshake.Milliseconds())
+	if err1 != nil && !errors.Is(err1, io.EOF) && !errors.Is(err1, context.Canceled) {
+		return err1
+	}
+	// err2 is usually the other direction noticing the close above
+	if err2 != nil && !errors.Is(err2, io.EOF) && !errors.Is(err2, context.Canceled) && !errors.Is(err2, net.ErrClosed) {
+		return err2
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+// tlsRecord frames body as one TLS record of type typ.
+func tlsRecord(typ byte, body []byte) []byte {
+    return append([]byte{typ, 0x03, 0x03, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestSlowHandshakeShapesOnlyTheHandshake(t *testing.T) {
+    ch := minimalClientHello()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    flight := append(tlsRecord(recordHandshake, bytes.Repeat([]byte{2}, 300)), tlsRecord(recordChangeCipherSpec, []byte{1})...)
+    appData := tlsRecord(0x17, bytes.Repeat([]byte{7}, 100))
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        if _, err := io.ReadFull(c, make([]byte, len(ch))); err != nil { return }
+        c.Write(flight)
+        // the rest of the connection: echo application data back
+        buf := make([]byte, 1024)
+        for {
+            if _, err := c.Read(buf); err != nil { return }
+            c.Write(appData[:5]); c.Write(appData[5:])
+        }
+    }()
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    statsc := make(chan Stats, 1)
+    go func(){ st, _ := HandleConnection(c2, ln.Addr().String(), impair.Config{Profile: impair.ProfileSlowHandshake, LatencyMs: 150}, 12, log.New(io.Discard, "", 0)); statsc <- st }()
+    _ = c1.SetDeadline(time.Now().Add(5 * time.Second))
+    start := time.Now()
+    go c1.Write(ch)
+    got := make([]byte, len(flight))
+    if _, err := io.ReadFull(c1, got); err != nil { t.Fatalf("read server flight: %v", err) }
+    // the ClientHello and the server flight are each delayed
+    if d := time.Since(start); d < 300*time.Millisecond { t.Fatalf("handshake took %v, want >= 300ms of added latency", d) }
+    if !bytes.Equal(got, flight) { t.Fatal("server flight altered") }
+    // first round trip: the ping is still in the phase (the proxy has not seen app data yet)
+    go c1.Write([]byte("ping"))
+    if _, err := io.ReadFull(c1, make([]byte, len(appData))); err != nil { t.Fatalf("read app data: %v", err) }
+    // the phase ended at the server's application data: the next round trip is unshaped
+    rt := time.Now()
+    go c1.Write([]byte("ping"))
+    if _, err := io.ReadFull(c1, make([]byte, len(appData))); err != nil { t.Fatalf("read app data: %v", err) }
+    if d := time.Since(rt); d > 100*time.Millisecond { t.Fatalf("round trip after the handshake took %v, want no added latency", d) }
+    c1.Close()
+    st := <-statsc
+    if st.SlowHandshake < 300*time.Millisecond || st.SlowHandshake > time.Since(start) { t.Fatalf("handshake phase %v, want between 300ms and the connection time %v", st.SlowHandshake, time.Since(start)) }
+}
+
+func TestHandshakePhaseSplitsAtFirstNonHandshakeRecord(t *testing.T) {
+    hs, app := tlsRecord(recordHandshake, []byte("hello")), tlsRecord(0x17, []byte("data"))
+    p := newHandshakePhase()
+    stream := append(append([]byte{}, hs...), app...)
+    // the boundary falls inside the second chunk, which ends mid-record: the header is enough
+    shaped, rest := p.split(stream[:3])
+    if len(shaped) != 3 || len(rest) != 0 { t.Fatalf("first chunk: shaped %d rest %d", len(shaped), len(rest)) }
+    shaped, rest = p.split(stream[3:len(hs)+7])
+    if len(shaped) != len(hs)-3 || !bytes.Equal(rest, app[:7]) { t.Fatalf("second chunk: shaped %d rest %q", len(shaped), rest) }
+    if !p.over.Load() { t.Fatal("phase should be over after application data") }
+    if shaped, rest := p.split([]byte("more")); shaped != nil || string(rest) != "more" { t.Fatal("chunks after the phase must pass unshaped") }
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pathlab/internal/impair"
+)
+
+// stallDeadlineSlack is how far past the end of a stall the conns' deadlines are
+// pushed, so a deadline set by the caller does not expire while the proxy is frozen.
+const stallDeadlineSlack = 30 * time.Second
+
+// stallGate is shared by both copy directions of a STALL connection. It counts bytes
+// proxied in either direction and, once the threshold is crossed, freezes both
+// directions until the stall ends. The stall fires at most once per connection.
+type stallGate struct {
+	after int64
+	dur   time.Duration
+	conns []net.Conn
+	done  atomic.Bool
+	quit  chan struct{} // closed when the connection is torn down; ends a pending wait
+
+	mu      sync.Mutex
+	total   int64
+	started bool
+	atBytes int64
+	at      time.Time
+	until   time.Time
+}
+
+// take reports how many of n pending bytes may be written now and how long to wait
+// afterwards before writing the rest.
+func (g *stallGate) take(n int) (int, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if wait := time.Until(g.until); g.started && wait > 0 {
+		return 0, wait
+	}
+	if g.started || g.total+int64(n) < g.after {
+		g.total += int64(n)
+		return n, 0
+	}
+	k := int(g.after - g.total)
+	g.total = g.after
+	g.started, g.atBytes = true, g.after
+	g.at = time.Now()
+	g.until = g.at.Add(g.dur)
+	if !g.done.Load() {
+		for _, c := range g.conns {
+			_ = c.SetDeadline(g.until.Add(stallDeadlineSlack))
+		}
+	}
+	return k, g.dur
+}
+
+// copy relays src to dst through the gate.
+func (g *stallGate) copy(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 16*1024)
+	for {
+		n, er := src.Read(buf)
+		data := buf[:n]
+		for len(data) > 0 {
+			k, wait := g.take(len(data))
+			if k > 0 {
+				if _, ew := dst.Write(data[:k]); ew != nil {
+					return ew
+				}
+				data = data[k:]
+			}
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-g.quit:
+					return nil
+				}
+			}
+		}
+		if er != nil {
+			return er
+		}
+	}
+}
+
+// handleStall relays both directions untouched until StallAfterBytes have been proxied
+// in total (ClientHello included), then forwards nothing either way for StallSeconds
+// before resuming. Bytes read during the stall are held, not dropped, and TCP is left
+// alone, modelling a transient freeze rather than a reset.
+func handleStall(cbr *bufio.Reader, client net.Conn, upstream net.Conn, cfg impair.Config, id int64, logger *log.Logger, st *Stats) error {
+	after := int64(cfg.StallAfterBytes)
+	if after <= 0 {
+		after = 16 * 1024
+	}
+	dur := time.Duration(cfg.StallSeconds * float64(time.Second))
+	if dur <= 0 {
+		dur = 5 * time.Second
+	}
+	logger.Printf("[conn %d] STALL: freeze both directions for %s after %d bytes", id, dur, after)
+	g := &stallGate{after: after, dur: dur, conns: []net.Conn{client, upstream}, quit: make(chan struct{})}
+	errc := make(chan error, 2)
+	go func() { errc <- g.copy(upstream, cbr) }()
+	go func() { errc <- g.copy(client, upstream) }()
+	err1 := <-errc
+	g.done.Store(true)
+	close(g.quit)
+	_ = client.Close()
+	_ = upstream.Close()
+	err2 := <-errc
+	g.mu.Lock()
+	if g.started {
+		st.StallAtBytes = g.atBytes
+		// a connection that ends mid-stall only stalled until then
+		st.StallMs = min(time.Since(g.at), dur).Milliseconds()
+		logger.Printf("[conn %d] STALL: froze at %d bytes for %dms", id, g.atBytes, st.StallMs)
+	}
+	g.mu.Unlock()
+	if err1 != nil && !errors.Is(err1, io.EOF) {
+		return err1
+	}
+	if err2 != nil && !errors.Is(err2, io.EOF) {
+		return err2
+	}
+	return nil
+}
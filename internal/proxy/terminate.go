@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"pathlab/internal/tlsinspect"
+)
+
+// terminateIOTimeout bounds each leg's handshake under TLS termination.
+const terminateIOTimeout = 10 * time.Second
+
+// TerminateConfig turns on TLS termination (-terminate-tls): PathLab completes the
+// client's handshake with Certificate, opens its own TLS session to the upstream and
+// runs the profile handlers on the plaintext between them.
+type TerminateConfig struct {
+	Certificate      tls.Certificate
+	InsecureUpstream bool // do not verify the upstream's certificate (-upstream-tls-insecure)
+}
+
+var terminate struct {
+	sync.Mutex
+	cfg *TerminateConfig
+}
+
+// SetTLSTermination enables TLS termination with cfg, or disables it when cfg is nil.
+func SetTLSTermination(cfg *TerminateConfig) {
+	terminate.Lock()
+	terminate.cfg = cfg
+	terminate.Unlock()
+}
+
+func tlsTermination() *TerminateConfig {
+	terminate.Lock()
+	defer terminate.Unlock()
+	return terminate.cfg
+}
+
+// terminatedConn is the plaintext side of a terminated client connection. Handlers
+// asking it for the ClientHello get the one peeked before the handshake and no
+// records to forward: the upstream leg made its own.
+type terminatedConn struct {
+	*tls.Conn
+	res tlsinspect.Result
+}
+
+// terminateTLS completes both handshakes: first with the upstream (offering the
+// client's SNI and ALPN), then with the client, which is offered only the protocol
+// the upstream picked. It returns the plaintext client and upstream connections.
+func terminateTLS(tc *TerminateConfig, client *PeekedConn, upstream net.Conn, upstreamAddr string, id int64, logger *log.Logger, st *Stats) (net.Conn, net.Conn, error) {
+	_, res, _ := client.ClientHello()
+	serverName := res.SNI
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(upstreamAddr)
+	}
+	up := tls.Client(upstream, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         res.ALPN,
+		InsecureSkipVerify: tc.InsecureUpstream,
+	})
+	_ = upstream.SetDeadline(time.Now().Add(terminateIOTimeout))
+	if err := up.Handshake(); err != nil {
+		return nil, nil, fmt.Errorf("terminate tls: upstream handshake: %w", err)
+	}
+	_ = upstream.SetDeadline(time.Time{})
+	ups := up.ConnectionState()
+	var protos []string
+	if ups.NegotiatedProtocol != "" {
+		protos = []string{ups.NegotiatedProtocol}
+	}
+	down := tls.Server(client, &tls.Config{
+		Certificates: []tls.Certificate{tc.Certificate},
+		NextProtos:   protos,
+	})
+	_ = client.SetDeadline(time.Now().Add(terminateIOTimeout))
+	if err := down.Handshake(); err != nil {
+		_ = up.Close()
+		return nil, nil, fmt.Errorf("terminate tls: client handshake: %w", err)
+	}
+	_ = client.SetDeadline(time.Time{})
+	st.Terminated = true
+	st.ClientTLS = tls.VersionName(down.ConnectionState().Version)
+	st.UpstreamTLS = tls.VersionName(ups.Version)
+	logger.Printf("[conn %d] terminated TLS: client %s, upstream %s (alpn=%q)", id, st.ClientTLS, st.UpstreamTLS, ups.NegotiatedProtocol)
+	return &terminatedConn{Conn: down, res: res}, up, nil
+}
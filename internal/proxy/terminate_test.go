@@ -0,0 +1,62 @@
+package proxy
+
+import (
+    "bufio"
+    "crypto/tls"
+    "crypto/x509"
+    "io"
+    "log"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/mitm"
+)
+
+func TestTerminateTLSImpairsPlaintext(t *testing.T) {
+    ca, err := mitm.NewCA()
+    if err != nil { t.Fatalf("ca: %v", err) }
+    upCert, err := ca.Leaf("upstream.test")
+    if err != nil { t.Fatalf("leaf: %v", err) }
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*upCert}, NextProtos: []string{"http/1.1"}})
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer ln.Close()
+    // upstream: uppercase each line back
+    go func(){
+        c, err := ln.Accept()
+        if err != nil { return }
+        defer c.Close()
+        r := bufio.NewReader(c)
+        for {
+            line, err := r.ReadString('\n')
+            if err != nil { return }
+            io.WriteString(c, strings.ToUpper(line))
+        }
+    }()
+    front, err := ca.Leaf("pathlab.test")
+    if err != nil { t.Fatalf("leaf: %v", err) }
+    SetTLSTermination(&TerminateConfig{Certificate: *front, InsecureUpstream: true}); defer SetTLSTermination(nil)
+
+    c1, c2 := net.Pipe()
+    type result struct{ st Stats; err error }
+    done := make(chan result, 1)
+    go func(){
+        st, err := HandleConnection(NewPeekedConn(c2), ln.Addr().String(), impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 50, JitterMs: 1}, 1, log.New(io.Discard, "", 0))
+        done <- result{st, err}
+    }()
+    roots := x509.NewCertPool()
+    roots.AppendCertsFromPEM(ca.CertPEM())
+    cc := tls.Client(c1, &tls.Config{ServerName: "pathlab.test", RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+    if err := cc.Handshake(); err != nil { t.Fatalf("client handshake: %v", err) }
+    if p := cc.ConnectionState().NegotiatedProtocol; p != "http/1.1" { t.Fatalf("client got alpn %q, want the upstream's choice", p) }
+    start := time.Now()
+    io.WriteString(cc, "hello\n")
+    line, err := bufio.NewReader(cc).ReadString('\n')
+    if err != nil || line != "HELLO\n" { t.Fatalf("read %q, %v", line, err) }
+    if d := time.Since(start); d < 40*time.Millisecond { t.Fatalf("plaintext round trip took %s, want the 50ms latency", d) }
+    cc.Close()
+    r := <-done
+    if !r.st.Terminated || r.st.ClientTLS == "" || r.st.UpstreamTLS == "" { t.Fatalf("stats %+v err=%v", r.st, r.err) }
+}
@@ -0,0 +1,264 @@
+// Package proxyproto reads and writes HAProxy PROXY protocol headers (v1 text and v2
+// binary), which a load balancer puts in front of a TCP stream to pass on the
+// original client and destination addresses.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Len is the longest v1 header, CRLF included.
+const maxV1Len = 107
+
+// v2 command and address family bytes.
+const (
+	v2Local = 0x20
+	v2Proxy = 0x21
+	v2TCP4  = 0x11
+	v2TCP6  = 0x21
+	v2UDP4  = 0x12
+	v2UDP6  = 0x22
+)
+
+// Errors returned by Parse and Read.
+var (
+	ErrNoHeader  = errors.New("proxyproto: no PROXY protocol header")
+	ErrTruncated = errors.New("proxyproto: truncated header")
+)
+
+// Header is a parsed PROXY protocol header. A Local header (v2 LOCAL, v1 UNKNOWN, or
+// an address family without IP addresses) carries no addresses: the connection is the
+// balancer's own, e.g. a health check, and its socket addresses stand.
+type Header struct {
+	Version     int // 1 or 2
+	Local       bool
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// HeaderFor returns the header describing a connection from src to dst. Addresses
+// other than *net.TCPAddr give a Local header.
+func HeaderFor(src, dst net.Addr) Header {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return Header{Version: 2, Local: true}
+	}
+	return Header{Version: 2, Source: s.AddrPort(), Destination: d.AddrPort()}
+}
+
+// Parse parses the header at the start of b and returns it with its length in bytes.
+// It returns ErrNoHeader when b does not start like a header and ErrTruncated when b
+// ends before the header does.
+func Parse(b []byte) (Header, int, error) {
+	switch {
+	case len(b) >= len(v2Signature) && bytes.Equal(b[:len(v2Signature)], v2Signature):
+		return parseV2(b)
+	case bytes.HasPrefix(v2Signature, b) && len(b) > 0:
+		return Header{}, 0, ErrTruncated
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		return parseV1(b)
+	case bytes.HasPrefix([]byte("PROXY "), b) && len(b) > 0:
+		return Header{}, 0, ErrTruncated
+	}
+	return Header{}, 0, ErrNoHeader
+}
+
+func parseV1(b []byte) (Header, int, error) {
+	end := bytes.Index(b[:min(len(b), maxV1Len)], []byte("\r\n"))
+	if end < 0 {
+		if len(b) < maxV1Len {
+			return Header{}, 0, ErrTruncated
+		}
+		return Header{}, 0, fmt.Errorf("proxyproto: v1 header longer than %d bytes", maxV1Len)
+	}
+	n := end + 2
+	f := strings.Split(string(b[len("PROXY "):end]), " ")
+	h := Header{Version: 1}
+	switch f[0] {
+	case "UNKNOWN":
+		h.Local = true
+		return h, n, nil
+	case "TCP4", "TCP6":
+	default:
+		return Header{}, 0, fmt.Errorf("proxyproto: unknown v1 protocol %q", f[0])
+	}
+	if len(f) != 5 {
+		return Header{}, 0, fmt.Errorf("proxyproto: v1 header has %d fields, want 5", len(f)+1)
+	}
+	var err error
+	if h.Source, err = v1AddrPort(f[1], f[3], f[0] == "TCP4"); err != nil {
+		return Header{}, 0, err
+	}
+	if h.Destination, err = v1AddrPort(f[2], f[4], f[0] == "TCP4"); err != nil {
+		return Header{}, 0, err
+	}
+	return h, n, nil
+}
+
+func v1AddrPort(addr, port string, v4 bool) (netip.AddrPort, error) {
+	a, err := netip.ParseAddr(addr)
+	if err != nil || a.Zone() != "" || a.Is4() != v4 {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: bad v1 address %q", addr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: bad v1 port %q", port)
+	}
+	return netip.AddrPortFrom(a, uint16(p)), nil
+}
+
+func parseV2(b []byte) (Header, int, error) {
+	if len(b) < 16 {
+		return Header{}, 0, ErrTruncated
+	}
+	n := 16 + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return Header{}, 0, ErrTruncated
+	}
+	body := b[16:n]
+	h := Header{Version: 2}
+	switch b[12] {
+	case v2Local:
+		h.Local = true
+		return h, n, nil
+	case v2Proxy:
+	default:
+		return Header{}, 0, fmt.Errorf("proxyproto: bad v2 version/command 0x%02x", b[12])
+	}
+	// TLVs after the addresses are skipped.
+	switch b[13] {
+	case v2TCP4, v2UDP4:
+		if len(body) < 12 {
+			return Header{}, 0, fmt.Errorf("proxyproto: v2 IPv4 addresses need 12 bytes, got %d", len(body))
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:10]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[4:8])), binary.BigEndian.Uint16(body[10:12]))
+	case v2TCP6, v2UDP6:
+		if len(body) < 36 {
+			return Header{}, 0, fmt.Errorf("proxyproto: v2 IPv6 addresses need 36 bytes, got %d", len(body))
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[0:16])), binary.BigEndian.Uint16(body[32:34]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[16:32])), binary.BigEndian.Uint16(body[34:36]))
+	default:
+		// UNSPEC or UNIX: nothing to report
+		h.Local = true
+	}
+	return h, n, nil
+}
+
+// Read reads one header from r, consuming exactly its bytes. When r does not start
+// with a header (ErrNoHeader) nothing is consumed.
+func Read(r *bufio.Reader) (Header, error) {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return Header{}, fmt.Errorf("proxyproto: read header: %w", err)
+		}
+		h, hlen, perr := Parse(b)
+		switch {
+		case perr == nil:
+			_, err = r.Discard(hlen)
+			return h, err
+		case perr != ErrTruncated:
+			return Header{}, perr
+		case n == 16 && b[0] == v2Signature[0]:
+			// a v2 header may be longer than r's buffer: read it whole
+			buf := make([]byte, 16+int(binary.BigEndian.Uint16(b[14:16])))
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return Header{}, fmt.Errorf("proxyproto: read v2 header: %w", err)
+			}
+			h, _, perr := Parse(buf)
+			return h, perr
+		}
+	}
+}
+
+// AppendV1 appends h as a v1 text header. v1 has no room for mixed address families;
+// such a header is written as IPv6 with IPv4-mapped addresses.
+func (h Header) AppendV1(b []byte) []byte {
+	if h.Local || !h.Source.IsValid() || !h.Destination.IsValid() {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	src, dst := h.Source.Addr().Unmap(), h.Destination.Addr().Unmap()
+	proto := "TCP4"
+	if !src.Is4() || !dst.Is4() {
+		proto = "TCP6"
+		src, dst = netip.AddrFrom16(src.As16()), netip.AddrFrom16(dst.As16())
+	}
+	return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n", proto, src.WithZone(""), dst.WithZone(""), h.Source.Port(), h.Destination.Port())
+}
+
+// AppendV2 appends h as a v2 binary header (TCP, no TLVs).
+func (h Header) AppendV2(b []byte) []byte {
+	b = append(b, v2Signature...)
+	if h.Local || !h.Source.IsValid() || !h.Destination.IsValid() {
+		return append(b, v2Local, 0x00, 0x00, 0x00)
+	}
+	src, dst := h.Source.Addr().Unmap(), h.Destination.Addr().Unmap()
+	if src.Is4() && dst.Is4() {
+		s, d := src.As4(), dst.As4()
+		b = append(b, v2Proxy, v2TCP4, 0x00, 12)
+		b = append(append(b, s[:]...), d[:]...)
+	} else {
+		s, d := src.As16(), dst.As16()
+		b = append(b, v2Proxy, v2TCP6, 0x00, 36)
+		b = append(append(b, s[:]...), d[:]...)
+	}
+	b = binary.BigEndian.AppendUint16(b, h.Source.Port())
+	return binary.BigEndian.AppendUint16(b, h.Destination.Port())
+}
+
+// Conn is a connection whose PROXY header has been read. RemoteAddr and LocalAddr
+// report the header's addresses unless it is Local.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+	h Header
+}
+
+// Accept reads the PROXY header c must start with and returns c with it stripped.
+func Accept(c net.Conn) (*Conn, error) {
+	r := bufio.NewReader(c)
+	h, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, r: r, h: h}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+
+// Header returns the header the connection started with.
+func (c *Conn) Header() Header { return c.h }
+
+// RemoteAddr returns the header's source address.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.h.Local {
+		return c.Conn.RemoteAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.h.Source)
+}
+
+// LocalAddr returns the header's destination address.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.h.Local {
+		return c.Conn.LocalAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.h.Destination)
+}
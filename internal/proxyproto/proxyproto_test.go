@@ -0,0 +1,128 @@
+package proxyproto
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "io"
+    "net"
+    "net/netip"
+    "strings"
+    "testing"
+)
+
+func TestParseV1(t *testing.T) {
+    cases := []struct {
+        in   string
+        want Header
+        n    int
+    }{
+        {"PROXY TCP4 192.0.2.1 198.51.100.2 51234 443\r\nrest", Header{Version: 1, Source: netip.MustParseAddrPort("192.0.2.1:51234"), Destination: netip.MustParseAddrPort("198.51.100.2:443")}, 45},
+        {"PROXY TCP6 2001:db8::1 2001:db8::2 1 65535\r\n", Header{Version: 1, Source: netip.MustParseAddrPort("[2001:db8::1]:1"), Destination: netip.MustParseAddrPort("[2001:db8::2]:65535")}, 44},
+        {"PROXY UNKNOWN\r\n", Header{Version: 1, Local: true}, 15},
+        {"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", Header{Version: 1, Local: true}, 35},
+    }
+    for _, c := range cases {
+        h, n, err := Parse([]byte(c.in))
+        if err != nil || h != c.want || n != c.n { t.Errorf("Parse(%q) = %+v, %d, %v; want %+v, %d", c.in, h, n, err, c.want, c.n) }
+    }
+    for _, in := range []string{
+        "PROXY TCP4 192.0.2.1 198.51.100.2 51234\r\n",
+        "PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n",
+        "PROXY TCP6 192.0.2.1 198.51.100.2 1 2\r\n",
+        "PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n",
+        "PROXY TCP4 192.0.2.1 198.51.100.2 0443 443\r\n",
+        "PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n",
+        "PROXY " + strings.Repeat("x", 120),
+    } {
+        if _, _, err := Parse([]byte(in)); err == nil || errors.Is(err, ErrTruncated) || errors.Is(err, ErrNoHeader) { t.Errorf("Parse(%q) err = %v, want a malformed-header error", in, err) }
+    }
+    for _, in := range []string{"P", "PROXY", "PROXY TCP4 192.0.2.1", "\r\n\r\n\x00"} {
+        if _, _, err := Parse([]byte(in)); err != ErrTruncated { t.Errorf("Parse(%q) err = %v, want ErrTruncated", in, err) }
+    }
+    for _, in := range []string{"", "GET / HTTP/1.1\r\n", "\x16\x03\x01\x00\x10", "PROXYTCP4"} {
+        if _, _, err := Parse([]byte(in)); err != ErrNoHeader { t.Errorf("Parse(%q) err = %v, want ErrNoHeader", in, err) }
+    }
+}
+
+func TestV2RoundTrip(t *testing.T) {
+    for _, h := range []Header{
+        {Version: 2, Source: netip.MustParseAddrPort("192.0.2.1:51234"), Destination: netip.MustParseAddrPort("198.51.100.2:443")},
+        {Version: 2, Source: netip.MustParseAddrPort("[2001:db8::1]:5"), Destination: netip.MustParseAddrPort("[2001:db8::2]:443")},
+        {Version: 2, Local: true},
+    } {
+        b := h.AppendV2([]byte("x"))[1:]
+        got, n, err := Parse(append(b, "trailing"...))
+        if err != nil || got != h || n != len(b) { t.Errorf("%+v: parsed %+v, %d, %v (header %d bytes)", h, got, n, err, len(b)) }
+        v1 := h.AppendV1(nil)
+        got, _, err = Parse(v1)
+        h.Version = 1
+        if err != nil || got != h { t.Errorf("v1 %q: parsed %+v, %v, want %+v", v1, got, err, h) }
+    }
+    // mixed families go out as IPv6
+    h := Header{Version: 2, Source: netip.MustParseAddrPort("192.0.2.1:1"), Destination: netip.MustParseAddrPort("[2001:db8::2]:2")}
+    got, _, err := Parse(h.AppendV2(nil))
+    if err != nil || got.Source.Addr().Unmap() != h.Source.Addr() || got.Destination != h.Destination { t.Fatalf("mixed: %+v, %v", got, err) }
+}
+
+func TestParseV2SkipsTLVsAndRejectsBadCommand(t *testing.T) {
+    h := Header{Version: 2, Source: netip.MustParseAddrPort("192.0.2.1:1"), Destination: netip.MustParseAddrPort("192.0.2.2:2")}
+    b := h.AppendV2(nil)
+    b[15] += 7
+    b = append(b, 0x04, 0x00, 0x04, 't', 'l', 'v', '!') // PP2_TYPE_NOOP
+    got, n, err := Parse(b)
+    if err != nil || got != h || n != len(b) { t.Fatalf("with TLV: %+v, %d, %v", got, n, err) }
+    b[12] = 0x22
+    if _, _, err := Parse(b); err == nil { t.Fatal("accepted command 0x22") }
+    b[12], b[15] = 0x21, 4
+    if _, _, err := Parse(b[:20]); err == nil || err == ErrTruncated { t.Fatalf("short IPv4 block: %v", err) }
+}
+
+func TestReadConsumesOnlyTheHeader(t *testing.T) {
+    h := Header{Version: 2, Source: netip.MustParseAddrPort("192.0.2.1:51234"), Destination: netip.MustParseAddrPort("198.51.100.2:443")}
+    long := h.AppendV2(nil)
+    long[14], long[15] = 0x20, 0x0c // 8192 bytes of TLVs: more than the reader's buffer
+    long = append(long, make([]byte, 8192)...)
+    for name, in := range map[string][]byte{
+        "v1":      []byte("PROXY TCP4 192.0.2.1 198.51.100.2 51234 443\r\n"),
+        "v2":      h.AppendV2(nil),
+        "v2 long": long,
+    } {
+        r := bufio.NewReader(io.MultiReader(bytes.NewReader(in), strings.NewReader("\x16\x03\x01")))
+        got, err := Read(r)
+        if err != nil || got.Source != h.Source || got.Destination != h.Destination { t.Errorf("%s: %+v, %v", name, got, err) }
+        if rest, _ := io.ReadAll(r); string(rest) != "\x16\x03\x01" { t.Errorf("%s: left %q", name, rest) }
+    }
+    r := bufio.NewReader(strings.NewReader("\x16\x03\x01"))
+    if _, err := Read(r); err != ErrNoHeader { t.Fatalf("no header: %v", err) }
+    if rest, _ := io.ReadAll(r); string(rest) != "\x16\x03\x01" { t.Fatalf("no header consumed %q", rest) }
+}
+
+func TestAcceptReportsHeaderAddresses(t *testing.T) {
+    c1, c2 := net.Pipe()
+    defer c1.Close()
+    go c1.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 51234 443\r\nhello"))
+    pc, err := Accept(c2)
+    if err != nil { t.Fatalf("Accept: %v", err) }
+    if pc.RemoteAddr().String() != "192.0.2.1:51234" || pc.LocalAddr().String() != "198.51.100.2:443" { t.Fatalf("addrs %s -> %s", pc.RemoteAddr(), pc.LocalAddr()) }
+    b := make([]byte, 5)
+    if _, err := io.ReadFull(pc, b); err != nil || string(b) != "hello" { t.Fatalf("read %q, %v", b, err) }
+}
+
+func FuzzParse(f *testing.F) {
+    f.Add([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 51234 443\r\n"))
+    f.Add([]byte("PROXY UNKNOWN\r\n"))
+    f.Add(Header{Version: 2, Source: netip.MustParseAddrPort("[2001:db8::1]:5"), Destination: netip.MustParseAddrPort("[2001:db8::2]:443")}.AppendV2(nil))
+    f.Add(Header{Local: true}.AppendV2(nil))
+    f.Fuzz(func(t *testing.T, b []byte) {
+        h, n, err := Parse(b)
+        if err != nil { return }
+        if n <= 0 || n > len(b) { t.Fatalf("length %d of %d bytes", n, len(b)) }
+        // a parsed header re-encodes to one that parses the same
+        var out []byte
+        if h.Version == 1 { out = h.AppendV1(nil) } else { out = h.AppendV2(nil) }
+        h2, _, err := Parse(out)
+        if err != nil { t.Fatalf("re-encoded %q: %v", out, err) }
+        if h2.Local != h.Local || (!h.Local && (h2.Source.Port() != h.Source.Port() || h2.Source.Addr().Unmap() != h.Source.Addr().Unmap())) { t.Fatalf("%+v re-parsed as %+v", h, h2) }
+    })
+}
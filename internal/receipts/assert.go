@@ -0,0 +1,304 @@
+package receipts
+
+// Declarative assertions for POST /assert: a CI job states what an experiment should
+// have produced (connection counts, outcome/profile/rule rates, latency percentiles,
+// fields present) and gets pass/fail per expectation, evaluated over the retained
+// connection receipts, instead of scraping receipts and computing it in shell.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Assertion scopes the connection receipts to judge and lists the expectations.
+// Receipts carry no run id, so a run is scoped by time (since/until) and filters;
+// RunID only labels the result for the CI log.
+type Assertion struct {
+	RunID          string    `json:"run_id,omitempty"`
+	Since          time.Time `json:"since,omitempty"`
+	Until          time.Time `json:"until,omitempty"`
+	SNI            string    `json:"sni,omitempty"`
+	GlobalProfile  string    `json:"global_profile,omitempty"`
+	AppliedProfile string    `json:"applied_profile,omitempty"`
+	RuleMatched    string    `json:"rule_matched,omitempty"` // the rule's text or its rule_id
+	Expect         Expect    `json:"expect"`
+}
+
+// Expect holds the supported expectations; unset ones are not checked. Rates are
+// shares (0-1) of the connections in scope and, like percentiles, are compared with a
+// condition string such as ">0.9", ">=0.5", "<200" or "==0".
+type Expect struct {
+	MinConnections         *int              `json:"min_connections,omitempty"`
+	MaxConnections         *int              `json:"max_connections,omitempty"`
+	OutcomeRates           map[string]string `json:"outcome_rates,omitempty"`  // outcome -> condition
+	ProfileRates           map[string]string `json:"profile_rates,omitempty"`  // applied_profile -> condition
+	RuleRates              map[string]string `json:"rule_rates,omitempty"`     // rule_id or rule_matched -> condition
+	Percentiles            map[string]string `json:"percentiles,omitempty"`    // "<field>.<agg>" -> condition, e.g. "handshake_ms.p95"
+	FieldsPresent          map[string]string `json:"fields_present,omitempty"` // receipt JSON field -> condition on the share carrying it
+	MaxCleanHandshakeP95Ms *float64          `json:"max_clean_handshake_p95_ms,omitempty"`
+}
+
+// ExpectResult is the verdict on one expectation.
+type ExpectResult struct {
+	Expectation string  `json:"expectation"` // e.g. outcome_rates.error
+	Want        string  `json:"want"`
+	Got         float64 `json:"got"`
+	Pass        bool    `json:"pass"`
+	Detail      string  `json:"detail,omitempty"`
+}
+
+// AssertResult is the POST /assert response.
+type AssertResult struct {
+	RunID       string         `json:"run_id,omitempty"` // the assertion's, echoed
+	Pass        bool           `json:"pass"`
+	Connections int            `json:"connections"`
+	Results     []ExpectResult `json:"results"`
+}
+
+// ParseAssertion decodes and checks an assertion document. Unknown keys, unsupported
+// percentile fields or aggregates, unknown receipt fields and malformed conditions are
+// all reported together.
+func ParseAssertion(r io.Reader) (Assertion, error) {
+	var a Assertion
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&a); err != nil {
+		if strings.Contains(err.Error(), "unknown field") {
+			return a, fmt.Errorf("%w; supported top-level keys: run_id, since, until, sni, global_profile, applied_profile, rule_matched, expect; supported expectations: %s",
+				err, strings.Join(expectationNames, ", "))
+		}
+		return a, fmt.Errorf("bad json: %w", err)
+	}
+	var errs []error
+	e := a.Expect
+	if reflect.ValueOf(e).IsZero() {
+		errs = append(errs, errors.New("expect: no expectations given"))
+	}
+	for _, group := range []struct {
+		name  string
+		conds map[string]string
+	}{{"outcome_rates", e.OutcomeRates}, {"profile_rates", e.ProfileRates}, {"rule_rates", e.RuleRates}, {"fields_present", e.FieldsPresent}, {"percentiles", e.Percentiles}} {
+		for key, cond := range group.conds {
+			if _, err := parseCondition(cond); err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s: %w", group.name, key, err))
+			}
+		}
+	}
+	for key := range e.Percentiles {
+		if _, _, err := percentileKey(key); err != nil {
+			errs = append(errs, fmt.Errorf("percentiles.%s: %w", key, err))
+		}
+	}
+	for field := range e.FieldsPresent {
+		if !receiptFields[field] {
+			errs = append(errs, fmt.Errorf("fields_present.%s: not a receipt field", field))
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return a, errors.Join(errs...)
+}
+
+// expectationNames lists the expect keys, for error messages.
+var expectationNames = jsonNames(reflect.TypeOf(Expect{}))
+
+// receiptFields are the JSON names of Receipt fields fields_present accepts.
+var receiptFields = func() map[string]bool {
+	m := map[string]bool{}
+	for _, n := range jsonNames(reflect.TypeOf(Receipt{})) {
+		m[n] = true
+	}
+	return m
+}()
+
+func jsonNames(t reflect.Type) []string {
+	var out []string
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// percentileKey splits "<field>.<agg>" and checks both against the query fields and
+// the aggregates that describe a distribution.
+func percentileKey(key string) (field, agg string, err error) {
+	field, agg, ok := strings.Cut(key, ".")
+	if !ok {
+		return "", "", errors.New(`want "<field>.<agg>", e.g. "handshake_ms.p95"`)
+	}
+	if _, ok := queryFields[field]; !ok {
+		return "", "", fmt.Errorf("unsupported field %q (supported: %s)", field, strings.Join(sortedKeys(queryFields), ", "))
+	}
+	switch agg {
+	case "p50", "p95", "p99", "avg", "min", "max":
+	default:
+		return "", "", fmt.Errorf("unsupported aggregate %q (supported: p50, p95, p99, avg, min, max)", agg)
+	}
+	return field, agg, nil
+}
+
+// condition is a parsed comparison such as ">=0.5".
+type condition struct {
+	op    string
+	value float64
+}
+
+func parseCondition(s string) (condition, error) {
+	s = strings.TrimSpace(s)
+	for _, op := range []string{">=", "<=", "==", ">", "<", "="} {
+		if rest, ok := strings.CutPrefix(s, op); ok {
+			v, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+			if err != nil || math.IsNaN(v) {
+				return condition{}, fmt.Errorf("condition %q: want a number after %q", s, op)
+			}
+			if op == "=" {
+				op = "=="
+			}
+			return condition{op, v}, nil
+		}
+	}
+	return condition{}, fmt.Errorf("condition %q: want an operator (>, >=, <, <=, ==) followed by a number", s)
+}
+
+func (c condition) holds(v float64) bool {
+	switch c.op {
+	case ">":
+		return v > c.value
+	case ">=":
+		return v >= c.value
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	}
+	return v == c.value
+}
+
+func (c condition) String() string { return c.op + strconv.FormatFloat(c.value, 'g', -1, 64) }
+
+func (a Assertion) inScope(r Receipt) bool {
+	switch {
+	case r.Kind != "" && r.Kind != KindConnection,
+		!a.Since.IsZero() && r.Timestamp.Before(a.Since),
+		!a.Until.IsZero() && r.Timestamp.After(a.Until),
+		a.SNI != "" && r.SNI != a.SNI,
+		a.GlobalProfile != "" && r.GlobalProfile != a.GlobalProfile,
+		a.AppliedProfile != "" && r.AppliedProfile != a.AppliedProfile,
+		a.RuleMatched != "" && r.RuleMatched != a.RuleMatched && r.RuleID != a.RuleMatched:
+		return false
+	}
+	return true
+}
+
+// Eval judges a (as returned by ParseAssertion) over rs. Results are ordered by
+// expectation name.
+func (a Assertion) Eval(rs []Receipt) AssertResult {
+	var scope []Receipt
+	for _, r := range rs {
+		if a.inScope(r) {
+			scope = append(scope, r)
+		}
+	}
+	res := AssertResult{RunID: a.RunID, Pass: true, Connections: len(scope), Results: []ExpectResult{}}
+	add := func(er ExpectResult) {
+		res.Pass = res.Pass && er.Pass
+		res.Results = append(res.Results, er)
+	}
+	e := a.Expect
+	n := float64(len(scope))
+	if e.MinConnections != nil {
+		add(ExpectResult{Expectation: "min_connections", Want: fmt.Sprintf(">=%d", *e.MinConnections), Got: n, Pass: len(scope) >= *e.MinConnections})
+	}
+	if e.MaxConnections != nil {
+		add(ExpectResult{Expectation: "max_connections", Want: fmt.Sprintf("<=%d", *e.MaxConnections), Got: n, Pass: len(scope) <= *e.MaxConnections})
+	}
+	rates := func(group string, conds map[string]string, match func(Receipt, string) bool) {
+		for _, key := range sortedKeys(conds) {
+			c, _ := parseCondition(conds[key])
+			er := ExpectResult{Expectation: group + "." + key, Want: c.String()}
+			if len(scope) == 0 {
+				er.Detail = "no connections in scope"
+				add(er)
+				continue
+			}
+			hits := 0
+			for _, r := range scope {
+				if match(r, key) {
+					hits++
+				}
+			}
+			er.Got = float64(hits) / n
+			er.Pass = c.holds(er.Got)
+			er.Detail = fmt.Sprintf("%d of %d connections", hits, len(scope))
+			add(er)
+		}
+	}
+	rates("outcome_rates", e.OutcomeRates, func(r Receipt, k string) bool { return r.Outcome == k })
+	rates("profile_rates", e.ProfileRates, func(r Receipt, k string) bool { return r.AppliedProfile == k })
+	rates("rule_rates", e.RuleRates, func(r Receipt, k string) bool { return r.RuleID == k || r.RuleMatched == k })
+	rates("fields_present", e.FieldsPresent, hasField)
+	for _, key := range sortedKeys(e.Percentiles) {
+		field, agg, _ := percentileKey(key)
+		c, _ := parseCondition(e.Percentiles[key])
+		add(percentile("percentiles."+key, scope, field, agg, c, nil))
+	}
+	if e.MaxCleanHandshakeP95Ms != nil {
+		c := condition{"<=", *e.MaxCleanHandshakeP95Ms}
+		clean := func(r Receipt) bool { return r.AppliedProfile == "CLEAN" && r.OverriddenTo == "" }
+		add(percentile("max_clean_handshake_p95_ms", scope, "handshake_ms", "p95", c, clean))
+	}
+	sort.SliceStable(res.Results, func(i, j int) bool { return res.Results[i].Expectation < res.Results[j].Expectation })
+	return res
+}
+
+// percentile aggregates field over the receipts that carry it (non-zero) and pass keep.
+func percentile(name string, scope []Receipt, field, agg string, c condition, keep func(Receipt) bool) ExpectResult {
+	er := ExpectResult{Expectation: name, Want: c.String()}
+	get := queryFields[field]
+	var vs []float64
+	for _, r := range scope {
+		if v := get(r); v != 0 && (keep == nil || keep(r)) {
+			vs = append(vs, v)
+		}
+	}
+	if len(vs) == 0 {
+		er.Detail = fmt.Sprintf("no connections in scope carry %s", field)
+		return er
+	}
+	er.Got = aggregate(agg, vs)
+	er.Pass = c.holds(er.Got)
+	er.Detail = fmt.Sprintf("%s of %s over %d connections", agg, field, len(vs))
+	return er
+}
+
+// hasField reports whether r's JSON carries field with a non-empty value.
+func hasField(r Receipt, field string) bool {
+	b, _ := json.Marshal(r)
+	var m map[string]json.RawMessage
+	_ = json.Unmarshal(b, &m)
+	v, ok := m[field]
+	if !ok {
+		return false
+	}
+	for _, empty := range []string{`null`, `""`, `0`, `false`, `[]`} {
+		if bytes.Equal(v, []byte(empty)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Assert evaluates a over the currently retained receipts.
+func (m *Manager) Assert(a Assertion) AssertResult {
+	return a.Eval(m.List(0))
+}
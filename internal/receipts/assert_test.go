@@ -0,0 +1,113 @@
+package receipts
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func parseAssert(t *testing.T, doc string) Assertion {
+    t.Helper()
+    a, err := ParseAssertion(strings.NewReader(doc))
+    if err != nil { t.Fatalf("parse %s: %v", doc, err) }
+    return a
+}
+
+func byName(res AssertResult) map[string]ExpectResult {
+    m := map[string]ExpectResult{}
+    for _, r := range res.Results { m[r.Expectation] = r }
+    return m
+}
+
+func experiment() []Receipt {
+    var rs []Receipt
+    for i := 0; i < 18; i++ { rs = append(rs, Receipt{Kind: KindConnection, AppliedProfile: "ABORT_AFTER_CH", RuleMatched: "ABORT_AFTER_CH", Outcome: "error", SNI: "a.test"}) }
+    for i := 1; i <= 20; i++ { rs = append(rs, Receipt{Kind: KindConnection, AppliedProfile: "CLEAN", Outcome: "closed", SNI: "b.test", HandshakeMs: float64(i * 10), ClientRTTMs: 1}) }
+    rs = append(rs, Receipt{Kind: KindConnection, AppliedProfile: "CLEAN", Outcome: "closed", OverriddenTo: "STALL", HandshakeMs: 5000})
+    rs = append(rs, Receipt{Kind: KindConfigChange, Outcome: "applied"}, Receipt{Kind: KindSLOAlert, Outcome: "slo_violation"})
+    return rs
+}
+
+func TestAssertPasses(t *testing.T) {
+    a := parseAssert(t, `{"expect": {
+        "min_connections": 39, "max_connections": 39,
+        "outcome_rates": {"error": ">0.45", "closed": "<=0.55"},
+        "profile_rates": {"ABORT_AFTER_CH": ">=0.46"},
+        "rule_rates": {"ABORT_AFTER_CH": "== 0.46153846153846156"},
+        "percentiles": {"handshake_ms.p50": "<200", "client_rtt_ms.max": "=1"},
+        "fields_present": {"client_rtt_ms": ">0.5", "sni": ">0.97"},
+        "max_clean_handshake_p95_ms": 190}}`)
+    res := a.Eval(experiment())
+    if !res.Pass || res.Connections != 39 || len(res.Results) != 11 { t.Fatalf("result %+v", res) }
+    got := byName(res)
+    if r := got["max_clean_handshake_p95_ms"]; r.Got != 190 || r.Want != "<=190" { t.Fatalf("clean p95 %+v (override must not count)", r) }
+    if r := got["outcome_rates.error"]; r.Detail != "18 of 39 connections" { t.Fatalf("detail %q", r.Detail) }
+    if r := got["percentiles.handshake_ms.p50"]; r.Got != 110 { t.Fatalf("p50 %+v", r) }
+    if res.Results[0].Expectation != "fields_present.client_rtt_ms" { t.Fatalf("results not ordered: %+v", res.Results) }
+}
+
+func TestAssertFailsPerExpectation(t *testing.T) {
+    a := parseAssert(t, `{"expect": {"min_connections": 50, "outcome_rates": {"error": ">0.9"}, "max_clean_handshake_p95_ms": 100}}`)
+    res := a.Eval(experiment())
+    if res.Pass { t.Fatal("assertion passed") }
+    for name, r := range byName(res) { if r.Pass { t.Errorf("%s passed: %+v", name, r) } }
+    if r := byName(res)["max_clean_handshake_p95_ms"]; r.Got != 190 { t.Fatalf("clean p95 %+v", r) }
+}
+
+func TestAssertScope(t *testing.T) {
+    rs := experiment()
+    base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+    for i := range rs { rs[i].Timestamp = base.Add(time.Duration(i) * time.Second) }
+    a := parseAssert(t, `{"since": "2026-01-01T00:00:10Z", "until": "2026-01-01T00:00:19Z", "sni": "b.test", "expect": {"min_connections": 2}}`)
+    if res := a.Eval(rs); res.Connections != 2 || !res.Pass { t.Fatalf("scoped result %+v", res) }
+    a = parseAssert(t, `{"applied_profile": "REORDER", "expect": {"outcome_rates": {"closed": ">0"}, "percentiles": {"handshake_ms.p95": "<1"}}}`)
+    res := a.Eval(rs)
+    if res.Pass || res.Connections != 0 { t.Fatalf("empty scope %+v", res) }
+    for _, r := range res.Results { if r.Pass || r.Detail == "" { t.Fatalf("empty scope result %+v", r) } }
+}
+
+func TestAssertRuleByID(t *testing.T) {
+    rs := []Receipt{
+        {Kind: KindConnection, RuleMatched: "id:big when ch_bytes > 1400 then ABORT_AFTER_CH", RuleID: "big"},
+        {Kind: KindConnection, RuleMatched: "id:big when ch_bytes > 1400 then ABORT_AFTER_CH", RuleID: "big"},
+        {Kind: KindConnection},
+    }
+    a := parseAssert(t, `{"expect": {"rule_rates": {"big": ">0.6", "id:big when ch_bytes > 1400 then ABORT_AFTER_CH": ">0.6"}}}`)
+    if res := a.Eval(rs); !res.Pass { t.Fatalf("rule rates %+v", res) }
+    a = parseAssert(t, `{"rule_matched": "big", "expect": {"min_connections": 2, "max_connections": 2}}`)
+    if res := a.Eval(rs); !res.Pass { t.Fatalf("scope by rule_id %+v", res) }
+}
+
+func TestParseAssertionErrors(t *testing.T) {
+    cases := map[string]string{
+        `{"run": "x", "expect": {"min_connections": 1}}`: `unknown field "run"; supported top-level keys: run_id,`,
+        `{"expect": {"max_retries": 3}}`: "supported expectations: min_connections, max_connections, outcome_rates",
+        `{"expect": {}}`: "no expectations given",
+        `{"expect": {"outcome_rates": {"error": "0.9"}}}`: `outcome_rates.error: condition "0.9": want an operator`,
+        `{"expect": {"profile_rates": {"CLEAN": ">lots"}}}`: `profile_rates.CLEAN: condition ">lots": want a number after ">"`,
+        `{"expect": {"percentiles": {"handshake_ms": "<1"}}}`: `percentiles.handshake_ms: want "<field>.<agg>"`,
+        `{"expect": {"percentiles": {"rtt.p95": "<1"}}}`: `unsupported field "rtt"`,
+        `{"expect": {"percentiles": {"handshake_ms.p42": "<1"}}}`: `unsupported aggregate "p42"`,
+        `{"expect": {"fields_present": {"colour": ">0"}}}`: "fields_present.colour: not a receipt field",
+        `{"expect": `: "bad json",
+    }
+    for doc, want := range cases {
+        _, err := ParseAssertion(strings.NewReader(doc))
+        if err == nil || !strings.Contains(err.Error(), want) { t.Errorf("%s: error %v, want %q", doc, err, want) }
+    }
+    // every problem is reported at once
+    _, err := ParseAssertion(strings.NewReader(`{"expect": {"outcome_rates": {"a": "x"}, "fields_present": {"b": ">0"}}}`))
+    if err == nil || !strings.Contains(err.Error(), "outcome_rates.a") || !strings.Contains(err.Error(), "fields_present.b") { t.Fatalf("combined error %v", err) }
+}
+
+func TestAssertRequestExampleWithRunID(t *testing.T) {
+    // the document from the feature request, run_id and all
+    a := parseAssert(t, `{"run_id": "ci-4821", "expect": {"min_connections": 50, "outcome_rates": {"aborted_by_profile": ">0.9"}, "max_clean_handshake_p95_ms": 200}}`)
+    var rs []Receipt
+    for i := 0; i < 57; i++ { rs = append(rs, Receipt{Kind: KindConnection, AppliedProfile: "ABORT_AFTER_CH", Outcome: "aborted_by_profile"}) }
+    for i := 0; i < 3; i++ { rs = append(rs, Receipt{Kind: KindConnection, AppliedProfile: "CLEAN", Outcome: "closed", HandshakeMs: 120}) }
+    res := a.Eval(rs)
+    if !res.Pass || res.RunID != "ci-4821" || res.Connections != 60 || len(res.Results) != 3 { t.Fatalf("result %+v", res) }
+    if r := byName(res)["outcome_rates.aborted_by_profile"]; r.Got != 0.95 { t.Fatalf("aborted rate %+v", r) }
+    if res := a.Eval(rs[:40]); res.Pass || res.RunID != "ci-4821" { t.Fatalf("40 connections passed min_connections 50: %+v", res) }
+}
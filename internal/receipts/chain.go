@@ -0,0 +1,105 @@
+package receipts
+
+import "fmt"
+
+// Chain link states reported by Verify.
+const (
+	ChainOK      = "ok"      // prev_hash is the previous receipt's hash
+	ChainGenesis = "genesis" // the first receipt: no prev_hash
+	ChainBroken  = "broken"  // prev_hash does not match the previous receipt
+	ChainUnknown = "unknown" // the previous receipt is no longer retained
+)
+
+// link checks r's prev_hash against the retained receipt before it; called with
+// m.mu held.
+func (m *Manager) link(r Receipt) string {
+	if r.ID == 1 {
+		if r.PrevHash == "" {
+			return ChainGenesis
+		}
+		return ChainBroken
+	}
+	prev, ok := m.find(r.ID - 1)
+	switch {
+	case !ok:
+		return ChainUnknown
+	case prev.Hash != r.PrevHash:
+		return ChainBroken
+	}
+	return ChainOK
+}
+
+// find returns the retained receipt with the given id; called with m.mu held.
+func (m *Manager) find(id int64) (Receipt, bool) {
+	// IDs in the ring are ascending and, unless a journal skipped a record, contiguous.
+	if n := len(m.ring); n > 0 {
+		if i := int(id - m.ring[0].ID); i >= 0 && i < n && m.ring[i].ID == id {
+			return m.ring[i], true
+		}
+	}
+	for _, r := range m.ring {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return Receipt{}, false
+}
+
+// ChainReport is the result of VerifyChain.
+type ChainReport struct {
+	From    int64  `json:"from"`    // first retained receipt walked
+	To      int64  `json:"to"`      // last retained receipt walked
+	Checked int    `json:"checked"` // receipts walked
+	OK      bool   `json:"ok"`
+	BreakID int64  `json:"break_id,omitempty"` // first receipt that failed
+	Break   string `json:"break,omitempty"`    // why it failed
+	Oldest  int64  `json:"oldest_retained"`    // receipts before this were evicted and cannot be checked
+}
+
+// VerifyChain walks the retained receipts with IDs in [from, to] (0 = no bound) in
+// order, checking each one's hash and signature and that it links to the receipt
+// before it, and reports the first break. The first receipt in range is linked to
+// its predecessor only if that is still retained: the chain is verified as far back
+// as the ring reaches.
+func (m *Manager) VerifyChain(from, to int64) ChainReport {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rep := ChainReport{OK: true}
+	if len(m.ring) > 0 {
+		rep.Oldest = m.ring[0].ID
+	}
+	var prev *Receipt
+	for i := range m.ring {
+		r := m.ring[i]
+		if r.ID < from || (to > 0 && r.ID > to) {
+			continue
+		}
+		if rep.Checked == 0 {
+			rep.From = r.ID
+		}
+		rep.To = r.ID
+		rep.Checked++
+		if !rep.OK {
+			continue
+		}
+		hashOK, sigOK := m.check(r)
+		var why string
+		switch {
+		case !hashOK:
+			why = "hash does not match the receipt"
+		case !sigOK:
+			why = "bad signature"
+		case prev != nil && prev.ID != r.ID-1:
+			why = fmt.Sprintf("receipts %d to %d are missing", prev.ID+1, r.ID-1)
+		case prev != nil && prev.Hash != r.PrevHash:
+			why = fmt.Sprintf("prev_hash does not match receipt %d", prev.ID)
+		case prev == nil && m.link(r) == ChainBroken:
+			why = "prev_hash does not match the previous receipt"
+		}
+		if why != "" {
+			rep.OK, rep.BreakID, rep.Break = false, r.ID, why
+		}
+		prev = &m.ring[i]
+	}
+	return rep
+}
@@ -0,0 +1,73 @@
+package receipts
+
+import (
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestHashChain(t *testing.T) {
+    m := newTestManager(8)
+    first := m.Add(Receipt{ConnID: 1})
+    if first.PrevHash != "" { t.Fatalf("genesis receipt has prev_hash %q", first.PrevHash) }
+    if h, s, chain := m.Verify(first); !h || !s || chain != ChainGenesis { t.Fatalf("genesis: %v %v %s", h, s, chain) }
+    prev := first
+    for i := 2; i <= 5; i++ {
+        r := m.Add(Receipt{ConnID: int64(i)})
+        if r.PrevHash != prev.Hash { t.Fatalf("receipt %d prev_hash %q, want %q", r.ID, r.PrevHash, prev.Hash) }
+        if _, _, chain := m.Verify(r); chain != ChainOK { t.Fatalf("receipt %d chain %s", r.ID, chain) }
+        prev = r
+    }
+    if rep := m.VerifyChain(0, 0); !rep.OK || rep.Checked != 5 || rep.From != 1 || rep.To != 5 || rep.Oldest != 1 { t.Fatalf("chain: %+v", rep) }
+    if rep := m.VerifyChain(2, 4); !rep.OK || rep.Checked != 3 || rep.From != 2 || rep.To != 4 { t.Fatalf("range: %+v", rep) }
+
+    // prev_hash is signed: pointing it elsewhere breaks the signature as well as the link
+    forged := prev
+    forged.PrevHash = first.Hash
+    if h, s, chain := m.Verify(forged); h || s || chain != ChainBroken { t.Fatalf("forged link: %v %v %s", h, s, chain) }
+}
+
+func TestHashChainDetectsDeletion(t *testing.T) {
+    m := newTestManager(8)
+    for i := 1; i <= 5; i++ { m.Add(Receipt{ConnID: int64(i)}) }
+    // an operator drops receipt 3 from the store
+    m.mu.Lock()
+    m.ring = append(m.ring[:2], m.ring[3:]...)
+    m.mu.Unlock()
+    rep := m.VerifyChain(0, 0)
+    if rep.OK || rep.BreakID != 4 || !strings.Contains(rep.Break, "3 to 3 are missing") || rep.Checked != 4 { t.Fatalf("deletion: %+v", rep) }
+    r4, _ := m.Get(4)
+    if _, _, chain := m.Verify(r4); chain != ChainUnknown { t.Fatalf("receipt after a gap: %s", chain) }
+    // a range starting after the gap still checks its first link when the predecessor is there
+    if rep := m.VerifyChain(5, 0); !rep.OK || rep.Checked != 1 { t.Fatalf("after the gap: %+v", rep) }
+    // putting a made-up receipt 3 in its place does not mend the chain
+    m.mu.Lock()
+    fake := Receipt{ID: 3, ConnID: 99, Kind: KindConnection, PrevHash: m.ring[1].Hash, Hash: "00", Sig: "00"}
+    m.ring = append(m.ring[:2], append([]Receipt{fake}, m.ring[2:]...)...)
+    m.mu.Unlock()
+    if rep := m.VerifyChain(0, 0); rep.OK || rep.BreakID != 3 { t.Fatalf("forged receipt: %+v", rep) }
+}
+
+func TestHashChainAcrossEviction(t *testing.T) {
+    m := newTestManager(3)
+    for i := 1; i <= 6; i++ { m.Add(Receipt{ConnID: int64(i)}) }
+    // only 4..6 are retained: 4's predecessor is gone, the rest of the chain checks
+    r4, _ := m.Get(4)
+    if h, s, chain := m.Verify(r4); !h || !s || chain != ChainUnknown { t.Fatalf("oldest retained: %v %v %s", h, s, chain) }
+    if rep := m.VerifyChain(0, 0); !rep.OK || rep.Checked != 3 || rep.From != 4 || rep.Oldest != 4 { t.Fatalf("evicted: %+v", rep) }
+    if rep := m.VerifyChain(1, 3); !rep.OK || rep.Checked != 0 { t.Fatalf("evicted range: %+v", rep) }
+}
+
+func TestHashChainAcrossRestart(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "receipts.ndjson")
+    m := newTestManager(8)
+    if _, err := m.OpenJournal(path, JournalOptions{}); err != nil { t.Fatal(err) }
+    m.Add(Receipt{ConnID: 1})
+    last := m.Add(Receipt{ConnID: 2})
+    m.CloseJournal()
+    m2 := newTestManager(8)
+    if _, err := m2.OpenJournal(path, JournalOptions{}); err != nil { t.Fatal(err) }
+    defer m2.CloseJournal()
+    if r := m2.Add(Receipt{ConnID: 3}); r.PrevHash != last.Hash { t.Fatalf("chain restarted after replay: %q", r.PrevHash) }
+    if rep := m2.VerifyChain(0, 0); !rep.OK || rep.Checked != 3 { t.Fatalf("after restart: %+v", rep) }
+}
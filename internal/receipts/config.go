@@ -0,0 +1,68 @@
+package receipts
+
+// Config-change receipts: the control-plane counterpart of connection receipts. Every
+// admin mutation emits one carrying who made it and the digest of the configuration
+// before and after the change, signed like any other receipt. Consecutive
+// config_change receipts link up: each PrevDigest is the StateDigest of the one before,
+// unless the configuration changed without an admin call in between (a timed apply
+// reverting on its own).
+
+// Receipt kinds.
+const (
+	KindConnection   = "connection"
+	KindConfigChange = "config_change"
+	KindSLOAlert     = "slo_alert"
+)
+
+// Config-change actions.
+const (
+	ActionImpairApply  = "impair_apply"
+	ActionImpairClear  = "impair_clear"
+	ActionRulesLoad    = "rules_load"
+	ActionRulesClear   = "rules_clear"
+	ActionRulesShadow  = "rules_shadow"  // a shadow rule set loaded (POST /rules?mode=shadow)
+	ActionRulesPromote = "rules_promote" // the shadow set made active
+	ActionConfigImport = "config_import" // replicated from a peer
+	ActionPresetPut    = "preset_put"
+	ActionPresetDelete = "preset_delete"
+	ActionKeyRotate    = "key_rotate" // POST /receipts/rotate_key; signed with the new key
+)
+
+// Actor is who made a configuration change.
+type Actor struct {
+	Addr    string // remote address of the admin request, or what made the change without one (replication, file:<path>)
+	Role    string // role of the bearer token the request carried (admin); empty when the admin API is open
+	TokenID string // ID of that token (adminauth.TokenID)
+}
+
+// ConfigChange returns an unsigned config_change receipt; pass it to Manager.Add.
+func ConfigChange(action string, actor Actor, prevDigest, stateDigest string) Receipt {
+	return Receipt{Kind: KindConfigChange, Action: action, Actor: actor.Addr, ActorRole: actor.Role, ActorTokenID: actor.TokenID, PrevDigest: prevDigest, StateDigest: stateDigest, Outcome: "applied"}
+}
+
+// SLOAlert returns an unsigned slo_alert receipt recording the CLEAN handshake p95
+// crossing the objective; state (slo_violation or slo_recovered) goes in Action.
+func SLOAlert(state string, p95Ms, sloMs float64, samples int, window string) Receipt {
+	return Receipt{Kind: KindSLOAlert, Action: state, SLOP95Ms: p95Ms, SLOMs: sloMs, SLOSamples: samples, SLOWindow: window, Outcome: state}
+}
+
+// ListKind is List restricted to receipts of one kind; limit applies after filtering.
+func (m *Manager) ListKind(kind string, limit int) []Receipt {
+	return m.ListWhere(limit, func(r Receipt) bool { return r.Kind == kind })
+}
+
+// ListWhere is List restricted to the receipts keep accepts; limit applies after
+// filtering.
+func (m *Manager) ListWhere(limit int, keep func(Receipt) bool) []Receipt {
+	all := m.List(0)
+	out := all[:0]
+	for _, r := range all {
+		if keep(r) {
+			out = append(out, r)
+		}
+	}
+	if limit > 0 && limit < len(out) {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
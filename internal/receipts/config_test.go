@@ -0,0 +1,48 @@
+package receipts
+
+import "testing"
+
+func TestConfigChangeChainInterleaved(t *testing.T) {
+    m := newTestManager(16)
+    digests := []string{"d0", "d1", "d2", "d3"}
+    m.Add(ConfigChange(ActionImpairApply, Actor{Addr: "127.0.0.1:5000"}, digests[0], digests[1]))
+    m.Add(Receipt{ConnID: 1, AppliedProfile: "ABORT_AFTER_CH", Outcome: "closed"})
+    m.Add(ConfigChange(ActionRulesLoad, Actor{Addr: "127.0.0.1:5001"}, digests[1], digests[2]))
+    m.Add(Receipt{ConnID: 2, AppliedProfile: "CLEAN", Outcome: "closed"})
+    m.Add(Receipt{ConnID: 3, AppliedProfile: "CLEAN", Outcome: "closed"})
+    m.Add(ConfigChange(ActionImpairClear, Actor{Addr: "127.0.0.1:5002"}, digests[2], digests[3]))
+    for _, r := range m.List(0) {
+        if h, s, _ := m.Verify(r); !h || !s { t.Fatalf("receipt %d does not verify hash=%v sig=%v", r.ID, h, s) }
+    }
+    changes := m.ListKind(KindConfigChange, 0)
+    if len(changes) != 3 { t.Fatalf("want 3 config_change receipts, got %d", len(changes)) }
+    for i, r := range changes {
+        if r.Actor == "" || r.Action == "" { t.Fatalf("config receipt missing actor/action: %#v", r) }
+        if i > 0 && r.PrevDigest != changes[i-1].StateDigest { t.Fatalf("chain broken at receipt %d: prev=%s, previous state=%s", r.ID, r.PrevDigest, changes[i-1].StateDigest) }
+        if i > 0 && r.ID <= changes[i-1].ID { t.Fatalf("config receipts out of order") }
+    }
+    conns := m.ListKind(KindConnection, 2)
+    if len(conns) != 2 || conns[0].ConnID != 2 || conns[1].ConnID != 3 { t.Fatalf("limited connection list %#v", conns) }
+    // tampering with a digest breaks the signature
+    bad := changes[1]
+    bad.PrevDigest = "forged"
+    if h, s, _ := m.Verify(bad); h || s { t.Fatalf("forged config receipt verified") }
+}
+
+func TestQueryByKind(t *testing.T) {
+    m := newTestManager(8)
+    m.Add(Receipt{ConnID: 1, HandshakeBytes: 500})
+    m.Add(ConfigChange(ActionImpairApply, Actor{Addr: "a"}, "", "x"))
+    q, err := ParseQuery(map[string][]string{"group_by": {"kind"}})
+    if err != nil { t.Fatal(err) }
+    res := m.Query(q)
+    if len(res.Groups) != 2 || res.Groups[0].Key != KindConfigChange || res.Groups[1].Key != KindConnection { t.Fatalf("groups %#v", res.Groups) }
+}
+
+func TestSLOAlertReceipt(t *testing.T) {
+    m := newTestManager(4)
+    r := m.Add(SLOAlert("slo_violation", 240.5, 100, 40, "5m0s"))
+    if r.Kind != KindSLOAlert || r.Action != "slo_violation" || r.SLOP95Ms != 240.5 || r.SLOSamples != 40 { t.Fatalf("receipt %#v", r) }
+    if h, s, _ := m.Verify(r); !h || !s { t.Fatalf("slo_alert receipt does not verify") }
+    if got := m.ListKind(KindSLOAlert, 0); len(got) != 1 { t.Fatalf("ListKind slo_alert = %d receipts", len(got)) }
+}
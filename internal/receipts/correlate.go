@@ -0,0 +1,103 @@
+package receipts
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// DefaultCorrelationTTL is how long a correlation registration waits for its
+// connection when none is given.
+const DefaultCorrelationTTL = time.Minute
+
+// maxCorrelations bounds the registrations waiting at once.
+const maxCorrelations = 1024
+
+// Correlation is a pending POST /receipts/correlate registration: the next connection
+// receipt whose client address matches ClientAddrPrefix gets Label.
+type Correlation struct {
+	ClientAddrPrefix string    `json:"client_addr_prefix"`
+	Label            string    `json:"label"`
+	Expires          time.Time `json:"expires"`
+}
+
+// matches reports whether the client address addr ("ip:port") matches prefix: a CIDR
+// prefix or an IP compares the address, anything else is a string prefix of addr
+// ("10.0.0.5:4431").
+func (c Correlation) matches(addr string) bool {
+	p := c.ClientAddrPrefix
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, ipErr := netip.ParseAddr(host)
+	if pfx, err := netip.ParsePrefix(p); err == nil {
+		return ipErr == nil && pfx.Contains(ip.Unmap())
+	}
+	if want, err := netip.ParseAddr(p); err == nil {
+		return ipErr == nil && want.Unmap() == ip.Unmap()
+	}
+	return strings.HasPrefix(addr, p)
+}
+
+// Correlate registers label for the next connection receipt from a client address
+// matching prefix (see Correlation) added within ttl (0 = DefaultCorrelationTTL).
+// Registrations are used once, oldest first.
+func (m *Manager) Correlate(prefix, label string, ttl time.Duration) (Correlation, error) {
+	switch {
+	case prefix == "":
+		return Correlation{}, errors.New("client_addr_prefix required")
+	case label == "":
+		return Correlation{}, errors.New("label required")
+	}
+	if ttl <= 0 {
+		ttl = DefaultCorrelationTTL
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireCorrelations()
+	if len(m.corr) >= maxCorrelations {
+		return Correlation{}, errors.New("too many pending correlations")
+	}
+	c := Correlation{ClientAddrPrefix: prefix, Label: label, Expires: m.now().UTC().Add(ttl)}
+	m.corr = append(m.corr, c)
+	return c, nil
+}
+
+// Correlations returns the registrations still waiting for a connection.
+func (m *Manager) Correlations() []Correlation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireCorrelations()
+	return append([]Correlation{}, m.corr...)
+}
+
+// correlate takes the oldest registration matching r's client address and returns
+// its label; called from Add with m.mu held.
+func (m *Manager) correlate(r Receipt) string {
+	if r.Kind != KindConnection || r.ClientAddr == "" || len(m.corr) == 0 {
+		return ""
+	}
+	m.expireCorrelations()
+	for i, c := range m.corr {
+		if c.matches(r.ClientAddr) {
+			m.corr = append(m.corr[:i], m.corr[i+1:]...)
+			return c.Label
+		}
+	}
+	return ""
+}
+
+// expireCorrelations drops registrations past their TTL; called with m.mu held.
+func (m *Manager) expireCorrelations() {
+	now := m.now()
+	kept := m.corr[:0]
+	for _, c := range m.corr {
+		if now.Before(c.Expires) {
+			kept = append(kept, c)
+		}
+	}
+	m.corr = kept
+}
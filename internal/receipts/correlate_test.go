@@ -0,0 +1,39 @@
+package receipts
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCorrelateTagsNextMatchingReceipt(t *testing.T) {
+    var calls []evictCall
+    m, clock := newRetentionManager(16, 0, &calls)
+    if _, err := m.Correlate("10.0.0.5", "attempt-1", 0); err != nil { t.Fatal(err) }
+    if _, err := m.Correlate("10.0.0.5", "attempt-2", 0); err != nil { t.Fatal(err) }
+    if _, err := m.Correlate("192.168.0.0/16", "lan", 0); err != nil { t.Fatal(err) }
+    if _, err := m.Correlate("[2001:db8::1]:", "v6", 0); err != nil { t.Fatal(err) }
+
+    other := m.Add(Receipt{ClientAddr: "10.0.0.50:40000"})
+    first := m.Add(Receipt{ClientAddr: "10.0.0.5:40001"})
+    second := m.Add(Receipt{ClientAddr: "10.0.0.5:40002"})
+    third := m.Add(Receipt{ClientAddr: "10.0.0.5:40003"})
+    lan := m.Add(Receipt{ClientAddr: "192.168.7.7:1234"})
+    v6 := m.Add(Receipt{ClientAddr: "[2001:db8::1]:443"})
+    cfg := m.Add(ConfigChange(ActionImpairApply, Actor{Addr: "10.0.0.5:1"}, "", ""))
+    if other.CorrelationLabel != "" || first.CorrelationLabel != "attempt-1" || second.CorrelationLabel != "attempt-2" || third.CorrelationLabel != "" {
+        t.Fatalf("labels %q %q %q %q", other.CorrelationLabel, first.CorrelationLabel, second.CorrelationLabel, third.CorrelationLabel)
+    }
+    if lan.CorrelationLabel != "lan" || v6.CorrelationLabel != "v6" || cfg.CorrelationLabel != "" { t.Fatalf("labels %q %q %q", lan.CorrelationLabel, v6.CorrelationLabel, cfg.CorrelationLabel) }
+    if h, s, _ := m.Verify(first); !h || !s { t.Fatal("labelled receipt does not verify") }
+    if got := m.ListWhere(0, func(r Receipt) bool { return r.CorrelationLabel == "attempt-2" }); len(got) != 1 || got[0].ID != second.ID { t.Fatalf("filter %+v", got) }
+
+    // registrations expire
+    m.Correlate("10.0.0.5", "late", 30*time.Second)
+    if n := len(m.Correlations()); n != 1 { t.Fatalf("%d pending", n) }
+    *clock = clock.Add(31 * time.Second)
+    if r := m.Add(Receipt{ClientAddr: "10.0.0.5:40004"}); r.CorrelationLabel != "" { t.Fatalf("expired registration used: %q", r.CorrelationLabel) }
+    if n := len(m.Correlations()); n != 0 { t.Fatalf("%d pending after expiry", n) }
+
+    if _, err := m.Correlate("", "x", 0); err == nil { t.Fatal("empty prefix accepted") }
+    if _, err := m.Correlate("10.0.0.5", "", 0); err == nil { t.Fatal("empty label accepted") }
+}
@@ -0,0 +1,178 @@
+package receipts
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats (GET /receipts/export?format=).
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+// exportBatch is how many receipts Export copies out of the ring per lock.
+const exportBatch = 64
+
+// Each calls fn for the retained receipts of the given kind ("" = all), the most
+// recent limit of them (0 = all), in ID order, as retained when Each starts. It copies
+// them out a batch at a time, so the ring stays open to Add while fn runs; a receipt
+// evicted before its batch is copied is skipped. It stops at the first error from fn.
+func (m *Manager) Each(kind string, limit int, fn func(Receipt) error) error {
+	m.mu.RLock()
+	if len(m.ring) == 0 {
+		m.mu.RUnlock()
+		return nil
+	}
+	last := m.ring[len(m.ring)-1].ID
+	after := m.ring[0].ID - 1
+	if limit > 0 {
+		n := 0
+		for i := len(m.ring) - 1; i >= 0; i-- {
+			if kind == "" || m.ring[i].Kind == kind {
+				if n++; n == limit {
+					after = m.ring[i].ID - 1
+					break
+				}
+			}
+		}
+	}
+	m.mu.RUnlock()
+	batch := make([]Receipt, 0, exportBatch)
+	for after < last {
+		batch = batch[:0]
+		m.mu.RLock()
+		for _, r := range m.ring {
+			if r.ID <= after || r.ID > last {
+				continue
+			}
+			if len(batch) == exportBatch {
+				break
+			}
+			batch = append(batch, r)
+		}
+		m.mu.RUnlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, r := range batch {
+			if kind != "" && r.Kind != kind {
+				continue
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		after = batch[len(batch)-1].ID
+	}
+	return nil
+}
+
+// Export writes the receipts Each selects to w, one JSON object per line (FormatJSONL)
+// or as CSV with a header row (FormatCSV; see CSVColumns).
+func (m *Manager) Export(w io.Writer, format, kind string, limit int) error {
+	switch format {
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		return m.Each(kind, limit, func(r Receipt) error { return enc.Encode(r) })
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(CSVColumns()); err != nil {
+			return err
+		}
+		n := 0
+		err := m.Each(kind, limit, func(r Receipt) error {
+			if err := cw.Write(CSVRecord(r)); err != nil {
+				return err
+			}
+			if n++; n%exportBatch == 0 {
+				cw.Flush()
+			}
+			return cw.Error()
+		})
+		cw.Flush()
+		if err != nil {
+			return err
+		}
+		return cw.Error()
+	}
+	return fmt.Errorf("format must be %s or %s, got %q", FormatCSV, FormatJSONL, format)
+}
+
+// csvColumn is one Receipt field exported as a CSV column.
+type csvColumn struct {
+	name  string
+	index int
+}
+
+// csvColumns are the Receipt fields in declaration order, named by their JSON keys.
+var csvColumns = func() []csvColumn {
+	t := reflect.TypeOf(Receipt{})
+	var cols []csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		cols = append(cols, csvColumn{name, i})
+	}
+	return cols
+}()
+
+// CSVColumns returns the CSV header: every receipt field by its JSON name, in the
+// order the fields are declared.
+func CSVColumns() []string {
+	out := make([]string, len(csvColumns))
+	for i, c := range csvColumns {
+		out[i] = c.name
+	}
+	return out
+}
+
+// CSVRecord returns r's CSV row in CSVColumns order. Timestamps are RFC3339 (UTC,
+// nanoseconds), string lists are joined with ";", unset optional fields are empty and
+// nested objects are JSON.
+func CSVRecord(r Receipt) []string {
+	v := reflect.ValueOf(r)
+	out := make([]string, len(csvColumns))
+	for i, c := range csvColumns {
+		out[i] = csvCell(v.Field(c.index))
+	}
+	return out
+}
+
+func csvCell(f reflect.Value) string {
+	switch x := f.Interface().(type) {
+	case time.Time:
+		if x.IsZero() {
+			return ""
+		}
+		return x.UTC().Format(time.RFC3339Nano)
+	case []string:
+		return strings.Join(x, ";")
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case *bool:
+		if x == nil {
+			return ""
+		}
+		return strconv.FormatBool(*x)
+	case int, int64:
+		return fmt.Sprint(x)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	if f.Kind() == reflect.Pointer && f.IsNil() {
+		return ""
+	}
+	b, _ := json.Marshal(f.Interface())
+	return string(b)
+}
@@ -0,0 +1,189 @@
+package receipts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal fsync policies (-receipts-fsync).
+const (
+	FsyncAlways   = "always"   // fsync after every receipt
+	FsyncInterval = "interval" // fsync every JournalOptions.Interval
+)
+
+// DefaultFsyncInterval is how often FsyncInterval syncs the journal.
+const DefaultFsyncInterval = time.Second
+
+// JournalOptions configures OpenJournal.
+type JournalOptions struct {
+	Fsync    string        // FsyncAlways or FsyncInterval (default)
+	Interval time.Duration // FsyncInterval period; 0 = DefaultFsyncInterval
+	Logf     func(format string, args ...any)
+}
+
+// journal is the append-only NDJSON file behind a Manager: one signed receipt per line.
+type journal struct {
+	f      *os.File
+	always bool
+	dirty  bool // written since the last fsync
+	logf   func(format string, args ...any)
+	stop   chan struct{}
+	done   sync.WaitGroup
+}
+
+// OpenJournal replays the receipt journal at path (created if missing) into the
+// ring, keeping the most recent receipts up to the Manager's capacity and continuing
+// the ID sequence after the highest ID found, then appends every receipt added from
+// now on to it. Lines that do not decode are skipped and logged; a partial last line
+// (a write cut short by a crash) is also cut from the file so appends start on a line
+// of their own. It returns the number of receipts read from the file.
+func (m *Manager) OpenJournal(path string, opts JournalOptions) (int, error) {
+	switch opts.Fsync {
+	case "":
+		opts.Fsync = FsyncInterval
+	case FsyncAlways, FsyncInterval:
+	default:
+		return 0, fmt.Errorf("fsync policy must be %s or %s, got %q", FsyncAlways, FsyncInterval, opts.Fsync)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultFsyncInterval
+	}
+	if opts.Logf == nil {
+		opts.Logf = func(string, ...any) {}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	loaded, end, err := m.replay(f, opts.Logf)
+	if err == nil {
+		if fi, serr := f.Stat(); serr == nil && fi.Size() > end {
+			opts.Logf("receipts journal %s: cutting a partial last record (%d bytes)", path, fi.Size()-end)
+			err = f.Truncate(end)
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return 0, fmt.Errorf("receipts journal %s: %w", path, err)
+	}
+	j := &journal{f: f, always: opts.Fsync == FsyncAlways, logf: opts.Logf, stop: make(chan struct{})}
+	if !j.always {
+		j.done.Add(1)
+		go j.syncEvery(opts.Interval, &m.mu)
+	}
+	m.mu.Lock()
+	m.journal = j
+	m.mu.Unlock()
+	return loaded, nil
+}
+
+// replay reads the journal into the ring and resumes the hash chain from its last
+// receipt. end is the offset just past the last complete line.
+func (m *Manager) replay(f *os.File, logf func(string, ...any)) (loaded int, end int64, err error) {
+	r := bufio.NewReader(f)
+	var kept []Receipt
+	var maxID int64
+	for lineNo := 1; ; lineNo++ {
+		line, rerr := r.ReadBytes('\n')
+		if rerr != nil && !errors.Is(rerr, io.EOF) {
+			return 0, 0, rerr
+		}
+		if rerr != nil { // no newline: partial last record, cut by the caller
+			break
+		}
+		end += int64(len(line))
+		var rc Receipt
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if uerr := json.Unmarshal(line, &rc); uerr != nil || rc.ID <= 0 {
+			logf("receipts journal: skipping corrupt record on line %d", lineNo)
+			continue
+		}
+		loaded++
+		maxID = max(maxID, rc.ID)
+		kept = append(kept, rc)
+		if len(kept) > 2*m.cap { // bound memory on long journals
+			kept = append(kept[:0], kept[len(kept)-m.cap:]...)
+		}
+	}
+	if len(kept) > m.cap {
+		kept = kept[len(kept)-m.cap:]
+	}
+	m.mu.Lock()
+	m.ring = append(m.ring[:0], kept...)
+	m.nextID = max(m.nextID, maxID)
+	if len(kept) > 0 && kept[len(kept)-1].ID == m.nextID {
+		m.last = kept[len(kept)-1].Hash // the chain goes on from the last receipt
+	}
+	m.mu.Unlock()
+	return loaded, end, nil
+}
+
+// write appends r to the journal; called with the Manager's lock held.
+func (j *journal) write(r Receipt) {
+	b, _ := json.Marshal(r)
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		j.logf("receipts journal: receipt %d not written: %v", r.ID, err)
+		return
+	}
+	if j.always {
+		if err := j.f.Sync(); err != nil {
+			j.logf("receipts journal: fsync: %v", err)
+		}
+		return
+	}
+	j.dirty = true
+}
+
+// syncEvery fsyncs the journal every interval when something was written.
+func (j *journal) syncEvery(interval time.Duration, mu *sync.RWMutex) {
+	defer j.done.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-t.C:
+		}
+		mu.Lock()
+		dirty := j.dirty
+		j.dirty = false
+		mu.Unlock()
+		if dirty {
+			if err := j.f.Sync(); err != nil {
+				j.logf("receipts journal: fsync: %v", err)
+			}
+		}
+	}
+}
+
+// CloseJournal syncs and closes the journal, if one is open; receipts added after it
+// are kept in memory only.
+func (m *Manager) CloseJournal() error {
+	m.mu.Lock()
+	j := m.journal
+	m.journal = nil
+	m.mu.Unlock()
+	if j == nil {
+		return nil
+	}
+	close(j.stop)
+	j.done.Wait()
+	if err := j.f.Sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
@@ -0,0 +1,63 @@
+package receipts
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "receipts.ndjson")
+    m := newTestManager(3)
+    if n, err := m.OpenJournal(path, JournalOptions{Fsync: FsyncAlways}); err != nil || n != 0 { t.Fatalf("open: %d %v", n, err) }
+    for i := 0; i < 5; i++ { m.Add(Receipt{ConnID: int64(i), Outcome: "closed"}) }
+    if err := m.CloseJournal(); err != nil { t.Fatalf("close: %v", err) }
+
+    // restart: the ring holds the newest receipts and IDs continue
+    m2 := newTestManager(3)
+    if n, err := m2.OpenJournal(path, JournalOptions{}); err != nil || n != 5 { t.Fatalf("reopen: %d %v", n, err) }
+    list := m2.List(0)
+    if len(list) != 3 || list[0].ID != 3 || list[2].ID != 5 { t.Fatalf("replayed %#v", list) }
+    for _, r := range list {
+        if h, s, _ := m2.Verify(r); !h || !s { t.Fatalf("receipt %d does not verify after replay: hash=%v sig=%v", r.ID, h, s) }
+    }
+    if r := m2.Add(Receipt{ConnID: 9}); r.ID != 6 { t.Fatalf("id sequence restarted: %d", r.ID) }
+    m2.CloseJournal()
+
+    m3 := newTestManager(10)
+    if n, err := m3.OpenJournal(path, JournalOptions{}); err != nil || n != 6 { t.Fatalf("third open: %d %v", n, err) }
+    if l := m3.List(0); len(l) != 6 || l[5].ConnID != 9 { t.Fatalf("after second restart %#v", l) }
+    m3.CloseJournal()
+}
+
+func TestJournalSkipsCorruptRecords(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "receipts.ndjson")
+    m := newTestManager(8)
+    if _, err := m.OpenJournal(path, JournalOptions{}); err != nil { t.Fatal(err) }
+    m.Add(Receipt{ConnID: 1})
+    m.Add(Receipt{ConnID: 2})
+    m.CloseJournal()
+    // a garbled record in the middle and one cut short at the end
+    f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+    fmt.Fprintf(f, "{not json\n")
+    fmt.Fprintf(f, `{"id":3,"conn_id":3,"kind":"conn`)
+    f.Close()
+
+    var logs []string
+    logf := func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+    m2 := newTestManager(8)
+    n, err := m2.OpenJournal(path, JournalOptions{Logf: logf})
+    if err != nil || n != 2 { t.Fatalf("open: %d %v", n, err) }
+    if len(logs) != 2 || !strings.Contains(logs[0], "line 3") || !strings.Contains(logs[1], "partial last record") { t.Fatalf("logs %q", logs) }
+    if r := m2.Add(Receipt{ConnID: 4}); r.ID != 3 { t.Fatalf("next id %d", r.ID) }
+    m2.CloseJournal()
+    // the partial record was cut, so the new one is readable
+    m3 := newTestManager(8)
+    if n, err := m3.OpenJournal(path, JournalOptions{}); err != nil || n != 3 { t.Fatalf("reopen: %d %v", n, err) }
+    if r, err := m3.Get(3); err != nil || r.ConnID != 4 { t.Fatalf("get 3: %#v %v", r, err) }
+    m3.CloseJournal()
+
+    if _, err := newTestManager(1).OpenJournal(path, JournalOptions{Fsync: "sometimes"}); err == nil { t.Fatalf("bad fsync policy accepted") }
+}
@@ -0,0 +1,168 @@
+package receipts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// KeyID identifies a signing key on receipts: the hex of the first 8 bytes of the
+// SHA-256 of the Ed25519 public key.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyring holds verification keys by KeyID.
+type keyring map[string]ed25519.PublicKey
+
+// candidates returns the keys r may have been signed with: the one its key_id names,
+// or, for receipts signed before key IDs were recorded, every known key.
+func (k keyring) candidates(r Receipt) []ed25519.PublicKey {
+	if r.KeyID != "" {
+		if pub, ok := k[r.KeyID]; ok {
+			return []ed25519.PublicKey{pub}
+		}
+		return nil
+	}
+	out := make([]ed25519.PublicKey, 0, len(k))
+	for _, pub := range k {
+		out = append(out, pub)
+	}
+	return out
+}
+
+// verifyWith checks r's hash, and its signature against any of keys.
+func verifyWith(keys []ed25519.PublicKey, r Receipt) (hashOK, sigOK bool) {
+	if len(keys) == 0 {
+		hashOK, _ = VerifySignature(nil, r)
+		return hashOK, false
+	}
+	for _, pub := range keys {
+		if hashOK, sigOK = VerifySignature(pub, r); sigOK {
+			break
+		}
+	}
+	return hashOK, sigOK
+}
+
+// KeyInfo describes a key in Manager.Keys.
+type KeyInfo struct {
+	ID      string `json:"key_id"`
+	PubHex  string `json:"ed25519_pubkey_hex"`
+	Current bool   `json:"current"` // signs new receipts; the others only verify old ones
+}
+
+// AddVerificationKey makes receipts signed with a retired key verifiable again, e.g.
+// after a restart.
+func (m *Manager) AddVerificationKey(pub ed25519.PublicKey) {
+	m.mu.Lock()
+	m.keys[KeyID(pub)] = pub
+	m.mu.Unlock()
+}
+
+// Rotate signs receipts from now on with priv. The previous key stays known, so
+// receipts it signed still verify. It returns the new key's ID.
+func (m *Manager) Rotate(priv ed25519.PrivateKey) string {
+	pub := priv.Public().(ed25519.PublicKey)
+	id := KeyID(pub)
+	m.mu.Lock()
+	m.priv, m.pub, m.keyID = priv, pub, id
+	m.keys[id] = pub
+	m.mu.Unlock()
+	return id
+}
+
+// Keys lists the known keys, the current signing key first, then by ID.
+func (m *Manager) Keys() []KeyInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]KeyInfo, 0, len(m.keys))
+	for id, pub := range m.keys {
+		out = append(out, KeyInfo{ID: id, PubHex: hex.EncodeToString(pub), Current: id == m.keyID})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Current != out[j].Current {
+			return out[i].Current
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// LoadKeyFile reads the 32-byte Ed25519 seed at path, creating it with a random seed
+// (mode 0600) when it is missing or not a seed, and the public keys of the seeds
+// RotateKeyFile archived next to it.
+func LoadKeyFile(path string) (priv ed25519.PrivateKey, retired []ed25519.PublicKey, created bool, err error) {
+	seed, rerr := os.ReadFile(path)
+	if rerr != nil || len(seed) != ed25519.SeedSize {
+		if seed, err = newSeedFile(path); err != nil {
+			return nil, nil, false, err
+		}
+		created = true
+	}
+	archived, _ := filepath.Glob(path + ".*.retired")
+	for _, name := range archived {
+		s, err := os.ReadFile(name)
+		if err != nil || len(s) != ed25519.SeedSize {
+			continue
+		}
+		retired = append(retired, ed25519.NewKeyFromSeed(s).Public().(ed25519.PublicKey))
+	}
+	return ed25519.NewKeyFromSeed(seed), retired, created, nil
+}
+
+// CheckKeyFile reports whether the seed at path can be read and is an Ed25519 seed,
+// without creating it as LoadKeyFile would.
+func CheckKeyFile(path string) error {
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("%s: not an Ed25519 seed", path)
+	}
+	return nil
+}
+
+// RotateKeyFile archives the seed at path as path.<key id>.retired and replaces it
+// with a new random seed, returning the new key.
+func RotateKeyFile(path string) (ed25519.PrivateKey, error) {
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(old) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: not an Ed25519 seed", path)
+	}
+	tmp := path + ".new"
+	seed, err := newSeedFile(tmp)
+	if err != nil {
+		return nil, err
+	}
+	oldID := KeyID(ed25519.NewKeyFromSeed(old).Public().(ed25519.PublicKey))
+	if err := os.Rename(path, fmt.Sprintf("%s.%s.retired", path, oldID)); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func newSeedFile(path string) ([]byte, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("generate ed25519 seed: %w", err)
+	}
+	if err := os.WriteFile(path, seed, 0o600); err != nil {
+		return nil, fmt.Errorf("write keyfile: %w", err)
+	}
+	return seed, nil
+}
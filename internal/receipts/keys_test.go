@@ -0,0 +1,58 @@
+package receipts
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestKeyRotation(t *testing.T) {
+    m := newTestManager(8)
+    idA := m.KeyID()
+    a := m.Add(Receipt{ConnID: 1})
+    if a.KeyID != idA || idA != KeyID(m.pub) || len(idA) != 16 { t.Fatalf("receipt key_id %q, manager %q", a.KeyID, idA) }
+
+    seedB := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+    idB := m.Rotate(ed25519.NewKeyFromSeed(seedB))
+    if idB == idA || m.KeyID() != idB { t.Fatalf("rotate: %s -> %s", idA, idB) }
+    b := m.Add(Receipt{ConnID: 2})
+    if b.KeyID != idB || b.PrevHash != a.Hash { t.Fatalf("receipt after rotation: %+v", b) }
+
+    for _, r := range []Receipt{a, b} {
+        if h, s, _ := m.Verify(r); !h || !s { t.Fatalf("receipt %d (key %s): %v %v", r.ID, r.KeyID, h, s) }
+    }
+    if rep := m.VerifyChain(0, 0); !rep.OK || rep.Checked != 2 { t.Fatalf("chain across rotation: %+v", rep) }
+    if rep := m.VerifyBatch(nil, true); rep.Passed != 2 { t.Fatalf("batch across rotation: %+v", rep) }
+
+    keys := m.Keys()
+    if len(keys) != 2 || keys[0].ID != idB || !keys[0].Current || keys[1].ID != idA || keys[1].Current { t.Fatalf("keys: %+v", keys) }
+
+    // a restarted manager only knows key B until key A is added back
+    m2 := NewManager(8, ed25519.NewKeyFromSeed(seedB), ManagerOptions{})
+    if _, s, _ := m2.Verify(a); s { t.Fatal("receipt under an unknown key verified") }
+    m2.AddVerificationKey(newTestManager(1).pub)
+    if _, s, _ := m2.Verify(a); !s { t.Fatal("receipt under a retired key did not verify") }
+
+    // offline: both keys needed
+    var buf bytes.Buffer
+    m.Export(&buf, FormatJSONL, "", 0)
+    if rep, _ := VerifyStream(bytes.NewReader(buf.Bytes()), m.pub); rep.Failed != 1 { t.Fatalf("one key: %+v", rep) }
+    if rep, _ := VerifyStream(bytes.NewReader(buf.Bytes()), m.pub, newTestManager(1).pub); rep.Failed != 0 { t.Fatalf("both keys: %+v", rep) }
+}
+
+func TestKeyFileRotation(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "pathlab-ed25519.key")
+    privA, retired, created, err := LoadKeyFile(path)
+    if err != nil || !created || len(retired) != 0 { t.Fatalf("first load: created=%v retired=%d err=%v", created, len(retired), err) }
+    if again, _, created, _ := LoadKeyFile(path); created || !again.Equal(privA) { t.Fatal("second load did not read the same seed") }
+
+    privB, err := RotateKeyFile(path)
+    if err != nil || privB.Equal(privA) { t.Fatalf("rotate: %v", err) }
+    pubA := privA.Public().(ed25519.PublicKey)
+    if _, err := os.Stat(path + "." + KeyID(pubA) + ".retired"); err != nil { t.Fatalf("old seed not archived: %v", err) }
+
+    priv, retired, _, err := LoadKeyFile(path)
+    if err != nil || !priv.Equal(privB) || len(retired) != 1 || !retired[0].Equal(pubA) { t.Fatalf("load after rotation: %v retired=%d", err, len(retired)) }
+}
@@ -0,0 +1,214 @@
+package receipts
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Merkle anchors: a signed root committing to a range of receipts, and inclusion
+// proofs any receipt in the range can be checked against offline. Leaves are the
+// receipts' hashes; leaf and inner nodes are domain-separated (SHA-256 of 0x00 ||
+// hash, and of 0x01 || left || right) and a node without a sibling is carried up a
+// level unchanged, so no leaf is ever duplicated.
+
+// maxAnchors bounds the anchors a Manager stores; each keeps its leaf hashes.
+const maxAnchors = 1024
+
+// Anchor is a signed Merkle root over the receipts FromID..ToID.
+type Anchor struct {
+	ID        int       `json:"id"`
+	FromID    int64     `json:"from_id"`
+	ToID      int64     `json:"to_id"`
+	Count     int       `json:"count"`
+	Root      string    `json:"root"` // hex
+	Timestamp time.Time `json:"timestamp"`
+	KeyID     string    `json:"key_id"`
+	Sig       string    `json:"sig"` // Ed25519 over the anchor's JSON with sig empty
+	leaves    [][]byte  // leaf hashes, kept for proofs after the receipts are evicted
+}
+
+// ProofStep is a sibling on the path from a leaf to the root.
+type ProofStep struct {
+	Hash string `json:"hash"` // hex
+	Left bool   `json:"left"` // the sibling is on the left
+}
+
+// Proof is the inclusion proof of one receipt in an anchor. With the receipt and the
+// public key it is all VerifyProof needs.
+type Proof struct {
+	Anchor    Anchor      `json:"anchor"`
+	ReceiptID int64       `json:"receipt_id"`
+	Index     int         `json:"index"` // leaf position: ReceiptID - Anchor.FromID
+	Path      []ProofStep `json:"path"`
+}
+
+func merkleLeaf(hash []byte) []byte {
+	h := sha256.Sum256(append([]byte{0}, hash...))
+	return h[:]
+}
+
+func merkleNode(l, r []byte) []byte {
+	buf := make([]byte, 0, 1+len(l)+len(r))
+	buf = append(append(append(buf, 1), l...), r...)
+	h := sha256.Sum256(buf)
+	return h[:]
+}
+
+// merkleRoot returns the root over leaves and, for index >= 0, that leaf's path.
+func merkleRoot(leaves [][]byte, index int) ([]byte, []ProofStep) {
+	level := append([][]byte(nil), leaves...)
+	var path []ProofStep
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i]) // no sibling: carried up
+				continue
+			}
+			switch index {
+			case i:
+				path = append(path, ProofStep{Hash: hex.EncodeToString(level[i+1])})
+			case i + 1:
+				path = append(path, ProofStep{Hash: hex.EncodeToString(level[i]), Left: true})
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		if index >= 0 {
+			index /= 2
+		}
+		level = next
+	}
+	return level[0], path
+}
+
+// proofSides returns, for the leaf at index of count, which side each sibling on its
+// path is on (true: left), from the leaf up.
+func proofSides(index, count int) []bool {
+	var sides []bool
+	for ; count > 1; count, index = (count+1)/2, index/2 {
+		if index%2 == 1 {
+			sides = append(sides, true)
+		} else if index+1 < count {
+			sides = append(sides, false)
+		}
+	}
+	return sides
+}
+
+// signedBytes is the anchor JSON its signature covers.
+func (a Anchor) signedBytes() []byte {
+	a.Sig = ""
+	b, _ := json.Marshal(a)
+	return b
+}
+
+// Anchor builds and signs a Merkle root over the receipts with IDs from..to, which
+// must all still be retained, stores it and returns it. Anchors are kept in memory
+// only, with their leaves, so proofs can be made after the receipts are evicted.
+func (m *Manager) Anchor(from, to int64) (Anchor, error) {
+	if from <= 0 || to < from {
+		return Anchor{}, fmt.Errorf("bad range %d..%d", from, to)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.anchors) >= maxAnchors {
+		return Anchor{}, fmt.Errorf("%d anchors stored, the most kept", maxAnchors)
+	}
+	leaves := make([][]byte, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		r, ok := m.find(id)
+		if !ok {
+			return Anchor{}, fmt.Errorf("receipt %d is not retained", id)
+		}
+		h, err := hex.DecodeString(r.Hash)
+		if err != nil {
+			return Anchor{}, fmt.Errorf("receipt %d: bad hash", id)
+		}
+		leaves = append(leaves, merkleLeaf(h))
+	}
+	root, _ := merkleRoot(leaves, -1)
+	a := Anchor{
+		ID:        len(m.anchors) + 1,
+		FromID:    from,
+		ToID:      to,
+		Count:     len(leaves),
+		Root:      hex.EncodeToString(root),
+		Timestamp: m.now().UTC(),
+		KeyID:     m.keyID,
+		leaves:    leaves,
+	}
+	a.Sig = hex.EncodeToString(ed25519.Sign(m.priv, a.signedBytes()))
+	m.anchors = append(m.anchors, a)
+	return a, nil
+}
+
+// Anchors returns the stored anchors, oldest first.
+func (m *Manager) Anchors() []Anchor {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Anchor{}, m.anchors...)
+}
+
+// Prove returns the inclusion proof of receipt id in anchor anchorID.
+func (m *Manager) Prove(id int64, anchorID int) (Proof, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if anchorID <= 0 || anchorID > len(m.anchors) {
+		return Proof{}, fmt.Errorf("anchor %d not found", anchorID)
+	}
+	a := m.anchors[anchorID-1]
+	if id < a.FromID || id > a.ToID {
+		return Proof{}, fmt.Errorf("receipt %d is not in anchor %d (%d..%d)", id, anchorID, a.FromID, a.ToID)
+	}
+	index := int(id - a.FromID)
+	_, path := merkleRoot(a.leaves, index)
+	return Proof{Anchor: a, ReceiptID: id, Index: index, Path: path}, nil
+}
+
+// VerifyProof checks that r is a validly signed receipt included in the signed anchor
+// of p, using only pub: r's hash and signature, the anchor's signature, and the path
+// from r's leaf to the anchor's root.
+func VerifyProof(pub ed25519.PublicKey, r Receipt, p Proof) error {
+	if hashOK, sigOK := VerifySignature(pub, r); !hashOK || !sigOK {
+		return errors.New("receipt hash or signature does not verify")
+	}
+	sig, err := hex.DecodeString(p.Anchor.Sig)
+	if err != nil || !ed25519.Verify(pub, p.Anchor.signedBytes(), sig) {
+		return errors.New("anchor signature does not verify")
+	}
+	if r.ID != p.ReceiptID || r.ID < p.Anchor.FromID || r.ID > p.Anchor.ToID || int(r.ID-p.Anchor.FromID) != p.Index ||
+		p.Anchor.Count != int(p.Anchor.ToID-p.Anchor.FromID+1) {
+		return fmt.Errorf("receipt %d is not at index %d of anchor %d..%d", r.ID, p.Index, p.Anchor.FromID, p.Anchor.ToID)
+	}
+	sides := proofSides(p.Index, p.Anchor.Count)
+	if len(sides) != len(p.Path) {
+		return fmt.Errorf("proof has %d steps, want %d", len(p.Path), len(sides))
+	}
+	h, _ := hex.DecodeString(r.Hash)
+	node := merkleLeaf(h)
+	for i, step := range p.Path {
+		if step.Left != sides[i] {
+			return fmt.Errorf("proof step %d is on the wrong side", i+1)
+		}
+		sib, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return errors.New("bad proof hash")
+		}
+		if step.Left {
+			node = merkleNode(sib, node)
+		} else {
+			node = merkleNode(node, sib)
+		}
+	}
+	root, err := hex.DecodeString(p.Anchor.Root)
+	if err != nil || !bytes.Equal(node, root) {
+		return errors.New("proof does not lead to the anchor root")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package receipts
+
+import (
+    "crypto/ed25519"
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+func TestMerkleAnchorProofs(t *testing.T) {
+    m := newTestManager(64)
+    for i := 1; i <= 20; i++ { m.Add(Receipt{ConnID: int64(i)}) }
+    for _, size := range []int{1, 2, 3, 5, 7, 8, 13} {
+        from := int64(2)
+        to := from + int64(size) - 1
+        a, err := m.Anchor(from, to)
+        if err != nil { t.Fatalf("size %d: %v", size, err) }
+        if a.Count != size || a.KeyID != m.KeyID() { t.Fatalf("size %d: anchor %+v", size, a) }
+        for _, id := range []int64{from, from + int64(size)/2, to} { // first, middle, last
+            p, err := m.Prove(id, a.ID)
+            if err != nil { t.Fatalf("size %d id %d: %v", size, id, err) }
+            // what a verifier gets: JSON of the receipt and the proof, and the public key
+            var r Receipt
+            var pr Proof
+            rb, _ := m.Get(id)
+            b, _ := json.Marshal(rb)
+            json.Unmarshal(b, &r)
+            pb, _ := json.Marshal(p)
+            json.Unmarshal(pb, &pr)
+            if err := VerifyProof(m.pub, r, pr); err != nil { t.Fatalf("size %d id %d: %v", size, id, err) }
+        }
+    }
+    if got := m.Anchors(); len(got) != 7 || got[6].ID != 7 { t.Fatalf("anchors %d", len(got)) }
+}
+
+func TestMerkleProofRejects(t *testing.T) {
+    m := newTestManager(16)
+    for i := 1; i <= 5; i++ { m.Add(Receipt{ConnID: int64(i)}) }
+    a, _ := m.Anchor(1, 5)
+    p, _ := m.Prove(3, a.ID)
+    r3, _ := m.Get(3)
+    r4, _ := m.Get(4)
+    check := func(name string, r Receipt, p Proof, want string) {
+        t.Helper()
+        err := VerifyProof(m.pub, r, p)
+        if err == nil || !strings.Contains(err.Error(), want) { t.Fatalf("%s: %v, want %q", name, err, want) }
+    }
+    check("other receipt", r4, p, "not at index")
+    tampered := r3
+    tampered.SNI = "x"
+    check("tampered receipt", tampered, p, "receipt hash")
+    badRoot := p
+    badRoot.Anchor.Root = strings.Repeat("0", 64)
+    check("forged root", r3, badRoot, "anchor signature")
+    swapped := p
+    swapped.Path = append([]ProofStep(nil), p.Path...)
+    swapped.Path[0].Left = !swapped.Path[0].Left
+    check("swapped side", r3, swapped, "wrong side")
+    wrongSib := p
+    wrongSib.Path = append([]ProofStep(nil), p.Path...)
+    wrongSib.Path[1].Hash = p.Path[0].Hash
+    check("wrong sibling", r3, wrongSib, "anchor root")
+    other := NewManager(4, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), ManagerOptions{})
+    if err := VerifyProof(other.pub, r3, p); err == nil { t.Fatal("verified with another key") }
+
+    if _, err := m.Anchor(4, 9); err == nil { t.Fatal("anchored receipts not yet added") }
+    if _, err := m.Anchor(3, 2); err == nil { t.Fatal("anchored an empty range") }
+    if _, err := m.Prove(1, 9); err == nil { t.Fatal("proof from a missing anchor") }
+    if _, err := m.Prove(6, a.ID); err == nil { t.Fatal("proof for a receipt outside the anchor") }
+}
@@ -0,0 +1,248 @@
+package receipts
+
+// Constrained receipt queries for GET /receipts/query: a fixed set of equality filters,
+// one numeric field, one aggregate and an optional group-by column. No free-form
+// expressions are accepted, so a query can never do more than scan the retained receipts.
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Query selects receipts and aggregates one numeric field over them.
+type Query struct {
+	Kind           string
+	AppliedProfile string
+	GlobalProfile  string
+	RuleMatched    string
+	RuleID         string
+	SNI            string
+	Outcome        string
+	PQC            *bool
+	Since          time.Time
+	Field          string // numeric receipt field, see queryFields
+	Agg            string // count, sum, avg, min, max, p50, p95, p99
+	GroupBy        string // optional grouping column, see groupColumns
+}
+
+// QueryGroup is one aggregate row; Key is empty when the query is not grouped.
+type QueryGroup struct {
+	Key   string  `json:"key,omitempty"`
+	Count int     `json:"count"`
+	Value float64 `json:"value"`
+}
+
+// QueryResult is the response of Manager.Query.
+type QueryResult struct {
+	Field   string       `json:"field"`
+	Agg     string       `json:"agg"`
+	GroupBy string       `json:"group_by,omitempty"`
+	Matched int          `json:"matched"`
+	Groups  []QueryGroup `json:"groups"`
+}
+
+var queryFields = map[string]func(Receipt) float64{
+	"handshake_bytes":   func(r Receipt) float64 { return float64(r.HandshakeBytes) },
+	"cipher_count":      func(r Receipt) float64 { return float64(r.CipherCount) },
+	"dropped_bytes":     func(r Receipt) float64 { return float64(r.DroppedBytes) },
+	"reset_at_bytes":    func(r Receipt) float64 { return float64(r.ResetAtBytes) },
+	"server_bytes":      func(r Receipt) float64 { return float64(r.ServerBytes) },
+	"held_ms":           func(r Receipt) float64 { return float64(r.HeldMs) },
+	"stall_ms":          func(r Receipt) float64 { return float64(r.StallMs) },
+	"handshake_ms":      func(r Receipt) float64 { return r.HandshakeMs },
+	"client_rtt_ms":     func(r Receipt) float64 { return r.ClientRTTMs },
+	"queued_ms":         func(r Receipt) float64 { return r.QueuedMs },
+	"slow_handshake_ms": func(r Receipt) float64 { return r.SlowHandshakeMs },
+	"duration_ms":       func(r Receipt) float64 { return r.DurationMs },
+	"upstream_ttfb_ms":  func(r Receipt) float64 { return r.UpstreamTTFBMs },
+	"ttfb_delay_ms":     func(r Receipt) float64 { return r.TTFBDelayMs },
+	"dial_attempts":     func(r Receipt) float64 { return float64(r.DialAttempts) },
+	"bytes_up":          func(r Receipt) float64 { return float64(r.BytesUp) },
+	"bytes_down":        func(r Receipt) float64 { return float64(r.BytesDown) },
+	"up_kbps":           func(r Receipt) float64 { return r.UpKbps },
+	"down_kbps":         func(r Receipt) float64 { return r.DownKbps },
+	"first_byte_ms":     func(r Receipt) float64 { return r.FirstByteMs },
+	"mirror_dropped":    func(r Receipt) float64 { return float64(r.MirrorDropped) },
+	"failure_ramp_pct":  func(r Receipt) float64 { return r.FailureRampPct },
+}
+
+var groupColumns = map[string]func(Receipt) string{
+	"kind":            func(r Receipt) string { return r.Kind },
+	"applied_profile": func(r Receipt) string { return r.AppliedProfile },
+	"global_profile":  func(r Receipt) string { return r.GlobalProfile },
+	"rule_matched":    func(r Receipt) string { return r.RuleMatched },
+	"rule_id":         func(r Receipt) string { return r.RuleID },
+	"sni":             func(r Receipt) string { return r.SNI },
+	"alpn_first":      func(r Receipt) string { return r.ALPNFirst },
+	"outcome":         func(r Receipt) string { return r.Outcome },
+	"pqc_hint":        func(r Receipt) string { return strconv.FormatBool(r.PQCHint) },
+	"tls_max_version": func(r Receipt) string { return r.TLSMaxVersion },
+	"ech_present":     func(r Receipt) string { return strconv.FormatBool(r.ECHPresent) },
+	"offers_psk":      func(r Receipt) string { return strconv.FormatBool(r.OffersPSK) },
+	"early_data":      func(r Receipt) string { return strconv.FormatBool(r.EarlyData) },
+	"server_version":  func(r Receipt) string { return r.ServerVersion },
+	"server_cipher":   func(r Receipt) string { return r.ServerCipher },
+}
+
+// QueryFields returns the numeric fields a Query can aggregate, sorted.
+func QueryFields() []string { return sortedKeys(queryFields) }
+
+// GroupColumns returns the columns a Query can group by, sorted.
+func GroupColumns() []string { return sortedKeys(groupColumns) }
+
+// FieldValue returns r's numeric field name (see QueryFields), 0 for an unknown one.
+func FieldValue(name string, r Receipt) float64 {
+	if f := queryFields[name]; f != nil {
+		return f(r)
+	}
+	return 0
+}
+
+// GroupValue returns r's group column name (see GroupColumns), "" for an unknown one.
+func GroupValue(name string, r Receipt) string {
+	if g := groupColumns[name]; g != nil {
+		return g(r)
+	}
+	return ""
+}
+
+var queryAggs = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true, "p50": true, "p95": true, "p99": true}
+
+// ParseQuery builds a Query from URL parameters, rejecting unknown fields, aggregates
+// and group-by columns. Defaults: field=handshake_bytes, agg=count.
+func ParseQuery(v url.Values) (Query, error) {
+	q := Query{
+		Kind:           v.Get("kind"),
+		AppliedProfile: v.Get("applied_profile"),
+		GlobalProfile:  v.Get("global_profile"),
+		RuleMatched:    v.Get("rule_matched"),
+		RuleID:         v.Get("rule_id"),
+		SNI:            v.Get("sni"),
+		Outcome:        v.Get("outcome"),
+		Field:          v.Get("field"),
+		Agg:            v.Get("agg"),
+		GroupBy:        v.Get("group_by"),
+	}
+	if s := v.Get("pqc"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, fmt.Errorf("pqc: %w", err)
+		}
+		q.PQC = &b
+	}
+	if s := v.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("since: want RFC3339: %w", err)
+		}
+		q.Since = t
+	}
+	if q.Field == "" {
+		q.Field = "handshake_bytes"
+	}
+	if q.Agg == "" {
+		q.Agg = "count"
+	}
+	if _, ok := queryFields[q.Field]; !ok {
+		return q, fmt.Errorf("unknown field %q", q.Field)
+	}
+	if !queryAggs[q.Agg] {
+		return q, fmt.Errorf("unknown agg %q", q.Agg)
+	}
+	if _, ok := groupColumns[q.GroupBy]; q.GroupBy != "" && !ok {
+		return q, fmt.Errorf("unknown group_by %q", q.GroupBy)
+	}
+	return q, nil
+}
+
+func (q Query) match(r Receipt) bool {
+	switch {
+	case q.Kind != "" && r.Kind != q.Kind,
+		q.AppliedProfile != "" && r.AppliedProfile != q.AppliedProfile,
+		q.GlobalProfile != "" && r.GlobalProfile != q.GlobalProfile,
+		q.RuleMatched != "" && r.RuleMatched != q.RuleMatched,
+		q.RuleID != "" && r.RuleID != q.RuleID,
+		q.SNI != "" && r.SNI != q.SNI,
+		q.Outcome != "" && r.Outcome != q.Outcome,
+		q.PQC != nil && r.PQCHint != *q.PQC,
+		!q.Since.IsZero() && r.Timestamp.Before(q.Since):
+		return false
+	}
+	return true
+}
+
+// Run evaluates q over rs. Groups are sorted by key.
+func (q Query) Run(rs []Receipt) QueryResult {
+	field := queryFields[q.Field]
+	if field == nil {
+		field = queryFields["handshake_bytes"]
+	}
+	group := groupColumns[q.GroupBy]
+	values := map[string][]float64{}
+	res := QueryResult{Field: q.Field, Agg: q.Agg, GroupBy: q.GroupBy, Groups: []QueryGroup{}}
+	for _, r := range rs {
+		if !q.match(r) {
+			continue
+		}
+		res.Matched++
+		key := ""
+		if group != nil {
+			key = group(r)
+		}
+		values[key] = append(values[key], field(r))
+	}
+	for key, vs := range values {
+		res.Groups = append(res.Groups, QueryGroup{Key: key, Count: len(vs), Value: aggregate(q.Agg, vs)})
+	}
+	sort.Slice(res.Groups, func(i, j int) bool { return res.Groups[i].Key < res.Groups[j].Key })
+	return res
+}
+
+// Aggregate computes agg (see ParseQuery) over vs, sorting it; percentiles are
+// nearest-rank.
+func Aggregate(agg string, vs []float64) float64 { return aggregate(agg, vs) }
+
+func aggregate(agg string, vs []float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	sort.Float64s(vs)
+	sum := 0.0
+	for _, v := range vs {
+		sum += v
+	}
+	switch agg {
+	case "sum":
+		return sum
+	case "avg":
+		return sum / float64(len(vs))
+	case "min":
+		return vs[0]
+	case "max":
+		return vs[len(vs)-1]
+	case "p50", "p95", "p99":
+		p, _ := strconv.ParseFloat(agg[1:], 64)
+		// nearest-rank percentile
+		rank := int(math.Ceil(p / 100 * float64(len(vs))))
+		return vs[max(rank, 1)-1]
+	}
+	return float64(len(vs))
+}
+
+// Query evaluates q over the currently retained receipts.
+func (m *Manager) Query(q Query) QueryResult {
+	return q.Run(m.List(0))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package receipts
+
+import (
+    "net/url"
+    "sync"
+    "testing"
+)
+
+func TestQueryFiltersAndPercentile(t *testing.T) {
+    m := newTestManager(64)
+    for i := 1; i <= 20; i++ {
+        m.Add(Receipt{AppliedProfile: "MTU1300_BLACKHOLE", PQCHint: true, HandshakeBytes: i * 100, Outcome: "closed"})
+    }
+    m.Add(Receipt{AppliedProfile: "MTU1300_BLACKHOLE", PQCHint: false, HandshakeBytes: 99999})
+    m.Add(Receipt{AppliedProfile: "CLEAN", PQCHint: true, HandshakeBytes: 99999})
+    q, err := ParseQuery(url.Values{"applied_profile": {"MTU1300_BLACKHOLE"}, "pqc": {"true"}, "agg": {"p95"}})
+    if err != nil { t.Fatalf("parse: %v", err) }
+    res := m.Query(q)
+    if res.Matched != 20 || len(res.Groups) != 1 { t.Fatalf("unexpected result %#v", res) }
+    if v := res.Groups[0].Value; v != 1900 { t.Fatalf("p95 handshake_bytes=%v want 1900", v) }
+}
+
+func TestQueryGroupBy(t *testing.T) {
+    m := newTestManager(16)
+    m.Add(Receipt{AppliedProfile: "CLEAN", CipherCount: 10})
+    m.Add(Receipt{AppliedProfile: "CLEAN", CipherCount: 20})
+    m.Add(Receipt{AppliedProfile: "ABORT_AFTER_CH", CipherCount: 5})
+    q, _ := ParseQuery(url.Values{"field": {"cipher_count"}, "agg": {"avg"}, "group_by": {"applied_profile"}})
+    res := m.Query(q)
+    if len(res.Groups) != 2 || res.Groups[0].Key != "ABORT_AFTER_CH" || res.Groups[1].Value != 15 || res.Groups[1].Count != 2 {
+        t.Fatalf("unexpected groups %#v", res.Groups)
+    }
+}
+
+func TestQueryRuleID(t *testing.T) {
+    m := newTestManager(16)
+    m.Add(Receipt{AppliedProfile: "CLEAN"})
+    m.Add(Receipt{AppliedProfile: "ABORT_AFTER_CH", RuleMatched: "id:big when ch_bytes > 1400 then ABORT_AFTER_CH", RuleID: "big"})
+    m.Add(Receipt{AppliedProfile: "ABORT_AFTER_CH", RuleMatched: "id:eu when sni_contains .eu then ABORT_AFTER_CH", RuleID: "eu"})
+    q, _ := ParseQuery(url.Values{"group_by": {"rule_id"}})
+    if res := m.Query(q); len(res.Groups) != 3 || res.Groups[0].Key != "" || res.Groups[1].Key != "big" { t.Fatalf("groups %#v", res.Groups) }
+    q, _ = ParseQuery(url.Values{"rule_id": {"eu"}})
+    if res := m.Query(q); res.Matched != 1 { t.Fatalf("rule_id filter matched %d", res.Matched) }
+}
+
+func TestParseQueryRejectsUnknown(t *testing.T) {
+    for _, v := range []url.Values{
+        {"field": {"sig"}}, {"agg": {"median; DROP TABLE"}}, {"group_by": {"hash"}}, {"pqc": {"maybe"}}, {"since": {"yesterday"}},
+    } {
+        if _, err := ParseQuery(v); err == nil { t.Errorf("expected error for %v", v) }
+    }
+}
+
+func TestQueryDuringChurn(t *testing.T) {
+    m := newTestManager(128)
+    q, _ := ParseQuery(url.Values{"agg": {"p50"}, "group_by": {"outcome"}})
+    var wg sync.WaitGroup
+    for w := 0; w < 8; w++ {
+        wg.Add(1)
+        go func() { defer wg.Done(); for i := 0; i < 500; i++ { m.Add(Receipt{HandshakeBytes: i, Outcome: "closed"}) } }()
+    }
+    done := make(chan struct{})
+    go func() { wg.Wait(); close(done) }()
+    for {
+        select {
+        case <-done:
+            if res := m.Query(q); res.Matched != 128 { t.Fatalf("matched=%d want ring capacity 128", res.Matched) }
+            return
+        default:
+            if res := m.Query(q); res.Matched > 128 { t.Fatalf("matched %d > capacity", res.Matched) }
+        }
+    }
+}
@@ -0,0 +1,333 @@
+package receipts
+
+// Signed receipts for proxied connections and admin configuration changes.
+// Each receipt is serialized to canonical JSON (with Hash and Sig empty), the SHA-256
+// of that JSON is stored in Hash and an Ed25519 signature over the same bytes in Sig.
+// Receipts are kept in a fixed-size ring buffer and fanned out to stream subscribers.
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"pathlab/internal/quicinspect"
+)
+
+// ErrNotFound is returned by Get when the id is unknown or already evicted.
+var ErrNotFound = errors.New("receipt not found")
+
+// MaxCHCapture bounds the ClientHello records -capture-clienthello puts on a
+// receipt (CHB64); larger ones are left out.
+const MaxCHCapture = 16 << 10
+
+// Receipt summarizes a single proxied connection or, with Kind config_change, an
+// admin configuration change (see ConfigChange), or with Kind slo_alert, the CLEAN
+// baseline crossing its handshake objective (see SLOAlert).
+type Receipt struct {
+	ID               int64     `json:"id"`
+	Kind             string    `json:"kind"` // connection (default), config_change or slo_alert
+	ConnID           int64     `json:"conn_id"`
+	Timestamp        time.Time `json:"timestamp"`
+	ClientAddr       string    `json:"client_addr"`
+	CorrelationLabel string    `json:"correlation_label,omitempty"` // label of the POST /receipts/correlate registration this connection's address matched
+	UpstreamAddr     string    `json:"upstream_addr"`
+	GlobalProfile    string    `json:"global_profile"`
+	AppliedProfile   string    `json:"applied_profile"`
+	RuleMatched      string    `json:"rule_matched,omitempty"`     // the matched rule's text; empty when no rule matched (receipts from before rule_id held the profile or preset action)
+	RuleID           string    `json:"rule_id,omitempty"`          // the matched rule's ID (an "id:" prefix, else derived from its text)
+	RuleSampled      *bool     `json:"rule_sampled,omitempty"`     // the rule has a "sample N%" rate: whether this connection was selected (false: rule_matched matched but was not applied)
+	RuleDescription  string    `json:"rule_description,omitempty"` // the matched rule's description, from a JSON rule set
+	ShadowProfile    string    `json:"shadow_profile,omitempty"`   // what the shadow rule set would have applied (its rule's action, else the global profile)
+	HandshakeBytes   int       `json:"handshake_bytes"`
+	CipherCount      int       `json:"cipher_count"`
+	PQCHint          bool      `json:"pqc_hint"`
+	SNI              string    `json:"sni,omitempty"`
+	ALPN             []string  `json:"alpn,omitempty"`
+	ALPNFirst        string    `json:"alpn_first,omitempty"` // the client's top ALPN preference
+	JA3              string    `json:"ja3,omitempty"`
+	JA3Normalized    string    `json:"ja3_normalized,omitempty"`     // JA3 with the extensions sorted, stable across extension-order randomization
+	GreaseCount      int       `json:"grease_count"`                 // GREASE values in the ciphers, extensions and groups; 0 suggests a non-browser client
+	CHSHA256         string    `json:"ch_sha256,omitempty"`          // SHA-256 of the ClientHello handshake message, to find it in packet captures
+	CHB64            string    `json:"ch_b64,omitempty"`             // -capture-clienthello: the ClientHello records, base64 (replay via /rules/test?ch_b64=)
+	TLSMaxVersion    string    `json:"tls_max_version,omitempty"`    // highest TLS version offered, e.g. "1.3"
+	ECHPresent       bool      `json:"ech_present,omitempty"`        // encrypted_client_hello offered; sni is the outer name
+	OffersPSK        bool      `json:"offers_psk,omitempty"`         // resumption attempt: PSK identities or a session ticket
+	PSKIdentities    int       `json:"psk_identities,omitempty"`     // identities in the pre_shared_key extension
+	SessionIDLen     int       `json:"session_id_len,omitempty"`     // legacy_session_id length
+	EarlyData        bool      `json:"early_data,omitempty"`         // early_data offered: the client sends 0-RTT data
+	CHParseError     string    `json:"ch_parse_error,omitempty"`     // the ClientHello was not fully received/parsed; the ch_* fields say how far it got
+	CHRecords        int       `json:"ch_records,omitempty"`         // ch_parse_error: complete TLS records received
+	CHBytesReceived  int       `json:"ch_bytes_received,omitempty"`  // ch_parse_error: bytes received, including a partial record
+	CHHeaderSeen     bool      `json:"ch_header_seen,omitempty"`     // ch_parse_error: the ClientHello handshake header arrived
+	DroppedBytes     int64     `json:"dropped_bytes,omitempty"`      // client->upstream bytes discarded by PACKET_LOSS, or sent after HALF_CLOSE
+	ResetAtBytes     int64     `json:"reset_at_bytes,omitempty"`     // upstream->client bytes delivered before RESET_AFTER_BYTES fired
+	ServerBytes      int64     `json:"server_bytes,omitempty"`       // ABORT_AFTER_CH with abort_after_server_bytes: upstream->client bytes delivered before the reset
+	ReorderedChunks  int64     `json:"reordered_chunks,omitempty"`   // client->upstream chunks REORDER swapped with their successor
+	CorruptedChunks  int64     `json:"corrupted_chunks,omitempty"`   // forwarded chunks CORRUPT flipped a bit in
+	FinalKbps        int       `json:"final_kbps,omitempty"`         // BANDWIDTH profiles: client->upstream cap when the connection ended (ramp-down: the last rate reached)
+	StallAtBytes     int64     `json:"stall_at_bytes,omitempty"`     // total bytes proxied when STALL froze the connection
+	StallMs          int64     `json:"stall_ms,omitempty"`           // how long the STALL freeze lasted
+	HalfClosed       bool      `json:"half_closed,omitempty"`        // HALF_CLOSE: the upstream write side was shut down (false: fell back to a full close)
+	HalfClosedBytes  int64     `json:"half_closed_bytes,omitempty"`  // HALF_CLOSE: upstream->client bytes relayed after the half-close
+	BlackholeDir     string    `json:"blackhole_dir,omitempty"`      // MTU1300_BLACKHOLE: direction black-holed (up, down or both)
+	DroppedDown      int64     `json:"dropped_down,omitempty"`       // MTU1300_BLACKHOLE down/both: upstream->client bytes discarded past the threshold
+	InterceptCN      string    `json:"intercept_cn,omitempty"`       // INTERCEPT_TLS: hostname presented instead of the requested SNI
+	InterceptResult  string    `json:"intercept_result,omitempty"`   // INTERCEPT_TLS: completed, client_rejected, client_closed or handshake_error
+	HandshakeMs      float64   `json:"handshake_ms,omitempty"`       // CLEAN: ClientHello forwarded to first upstream byte
+	SlowHandshakeMs  float64   `json:"slow_handshake_ms,omitempty"`  // SLOW_HANDSHAKE: how long the shaped handshake phase lasted (compare duration_ms)
+	TTFBDelayMs      float64   `json:"ttfb_delay_ms,omitempty"`      // DELAY_FIRST_RESPONSE: hold injected before the upstream's first chunk
+	UpstreamTTFBMs   float64   `json:"upstream_ttfb_ms,omitempty"`   // DELAY_FIRST_RESPONSE: ClientHello forwarded to the upstream's first byte (compare first_byte_ms)
+	DurationMs       float64   `json:"duration_ms,omitempty"`        // connections: accept to close, as handled by the profile
+	ClientRTTMs      float64   `json:"client_rtt_ms,omitempty"`      // client<->PathLab RTT from TCP_INFO after accept (-collect-tcpinfo)
+	QueuedMs         float64   `json:"queued_ms,omitempty"`          // -overflow=queue: time waited for a -max-conns slot
+	SOCKSDest        string    `json:"socks_dest,omitempty"`         // -socks5: host:port the client asked to CONNECT to (domain names as sent)
+	DialAttempts     int       `json:"dial_attempts,omitempty"`      // upstream dials made, -dial-retries and -dial-fallback included
+	ServedBy         string    `json:"served_by,omitempty"`          // address that served the connection: upstream_addr or the -dial-fallback
+	UpstreamMode     string    `json:"upstream_mode,omitempty"`      // proxy, or echo/sink when PathLab answered itself (-upstream-mode)
+	BytesUp          int64     `json:"bytes_up,omitempty"`           // bytes written to the upstream after impairment, ClientHello included
+	BytesDown        int64     `json:"bytes_down,omitempty"`         // bytes written to the client
+	UpKbps           float64   `json:"up_kbps,omitempty"`            // bytes_up over the handler's run time
+	DownKbps         float64   `json:"down_kbps,omitempty"`          // bytes_down over the handler's run time
+	FirstByteMs      float64   `json:"first_byte_ms,omitempty"`      // handler start to the first byte written to the client
+	MirrorDropped    int64     `json:"mirror_dropped,omitempty"`     // -mirror: client->upstream bytes the mirror did not get (buffer full, dial or write failed)
+	HRR              bool      `json:"hrr,omitempty"`                // upstream answered the first ClientHello with a HelloRetryRequest
+	ServerVersion    string    `json:"server_version,omitempty"`     // TLS version the upstream's ServerHello selected, e.g. "1.3"
+	ServerCipher     string    `json:"server_cipher,omitempty"`      // cipher suite the upstream selected, e.g. TLS_AES_128_GCM_SHA256
+	ServerGroup      string    `json:"server_group,omitempty"`       // key_share group the upstream selected (TLS 1.3), e.g. x25519
+	RetryCHBytes     int       `json:"retry_ch_bytes,omitempty"`     // handshake bytes of the client's second ClientHello after the HRR
+	RetryPQCHint     bool      `json:"retry_pqc_hint,omitempty"`     // PQC hint of the second ClientHello (key_share changes land here)
+	HeldMs           int64     `json:"held_ms,omitempty"`            // upstream kept open after client close (also_hold)
+	OverlapPartner   int64     `json:"overlap_partner,omitempty"`    // conn id of the held/retry connection sharing JA3+SNI
+	FailureRampPct   float64   `json:"failure_ramp_pct,omitempty"`   // FAILURE_RAMP abort probability when this connection was rolled
+	FirstContact     bool      `json:"first_contact,omitempty"`      // FIRST_CONTACT modifier treated this as the key's first connection
+	ImpairApplied    *bool     `json:"impairment_applied,omitempty"` // connections: false when apply_percent sampled it out to CLEAN
+	OverriddenTo     string    `json:"overridden_to,omitempty"`      // profile set mid-stream via POST /impair/conn/{id}
+	Action           string    `json:"action,omitempty"`             // config_change: what was changed, e.g. impair_apply
+	Actor            string    `json:"actor,omitempty"`              // config_change: who changed it (remote addr)
+	ActorRole        string    `json:"actor_role,omitempty"`         // config_change: role of the bearer token it was changed with (admin)
+	ActorTokenID     string    `json:"actor_token_id,omitempty"`     // config_change: ID of that token, the first 6 bytes of its SHA-256 in hex
+	StateDigest      string    `json:"state_digest,omitempty"`       // config_change: digest of the configuration after the change
+	PrevDigest       string    `json:"prev_digest,omitempty"`        // config_change: digest before the change
+	SLOP95Ms         float64   `json:"slo_p95_ms,omitempty"`         // slo_alert: CLEAN handshake p95 over the window
+	SLOMs            float64   `json:"slo_ms,omitempty"`             // slo_alert: the objective it was judged against
+	SLOSamples       int       `json:"slo_samples,omitempty"`        // slo_alert: samples in the window
+	SLOWindow        string    `json:"slo_window,omitempty"`         // slo_alert: window length
+
+	// UDP flows relayed by -listen-udp (connection receipts with transport "udp")
+	Transport     string                      `json:"transport,omitempty"`         // udp; TCP connections omit it
+	QUICInitial   *quicinspect.InitialSummary `json:"quic_initial,omitempty"`      // the flow's first client datagram parsed as a QUIC Initial
+	DatagramsUp   int64                       `json:"datagrams_up,omitempty"`      // client->upstream datagrams received
+	DatagramsDown int64                       `json:"datagrams_down,omitempty"`    // upstream->client datagrams received
+	DatagramsLost int64                       `json:"datagrams_dropped,omitempty"` // datagrams the profile did not forward
+	Truncated     int64                       `json:"truncated,omitempty"`         // MTU1300_BLACKHOLE: datagrams cut to threshold_bytes
+
+	// TLS termination (-terminate-tls)
+	Terminated         bool   `json:"terminated,omitempty"`           // handlers ran on plaintext between PathLab's two TLS sessions
+	ClientTLSVersion   string `json:"client_tls_version,omitempty"`   // version negotiated with the client
+	UpstreamTLSVersion string `json:"upstream_tls_version,omitempty"` // version negotiated with the upstream
+
+	// Connection timeline (-trace-conns)
+	TraceMs map[string]float64 `json:"trace_ms,omitempty"` // each traced event's first time after accept, by name (the events of GET /connections/{id}/trace)
+
+	Outcome  string `json:"outcome"` // connections: closed, error, idle_timeout, max_lifetime, drained (shutdown), admin_killed (DELETE /connections/{id}), rejected or queued_timeout (-max-conns); udp flows: expired or closed
+	Error    string `json:"error,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`    // signing key (see KeyID); receipts from before key rotation omit it
+	PrevHash string `json:"prev_hash,omitempty"` // hash of the receipt before this one (ID-1); empty on the first
+	Hash     string `json:"hash"`
+	Sig      string `json:"sig"`
+}
+
+// Manager signs, stores and distributes receipts.
+type Manager struct {
+	mu      sync.RWMutex
+	priv    ed25519.PrivateKey // current signing key (Rotate)
+	pub     ed25519.PublicKey
+	keyID   string
+	keys    keyring // every known key, the current one included
+	cap     int
+	ring    []Receipt
+	nextID  int64
+	subs    map[int]subscriber
+	nextSub int
+	journal *journal // OpenJournal; nil keeps receipts in memory only
+	last    string   // hash of the latest receipt, the next one's PrevHash
+	opts    ManagerOptions
+	evicted int64            // receipts evicted since startup
+	now     func() time.Time // clock for timestamps and age pruning
+	corr    []Correlation    // pending correlation registrations, oldest first
+	anchors []Anchor         // Merkle anchors, by ID - 1
+}
+
+// DefaultCapacity is the ring size when NewManager is given none.
+const DefaultCapacity = 256
+
+// NewManager returns a Manager retaining at most capacity receipts (0 =
+// DefaultCapacity), and none older than opts.MaxAge once pruned, signing with priv.
+func NewManager(capacity int, priv ed25519.PrivateKey, opts ManagerOptions) *Manager {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	m := &Manager{
+		cap:  capacity,
+		keys: make(keyring),
+		subs: make(map[int]subscriber),
+		opts: opts,
+		now:  time.Now,
+	}
+	m.Rotate(priv)
+	return m
+}
+
+// PublicKeyHex returns the hex encoded Ed25519 public key new receipts are signed with.
+func (m *Manager) PublicKeyHex() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return hex.EncodeToString(m.pub)
+}
+
+// KeyID returns the ID of the key new receipts are signed with.
+func (m *Manager) KeyID() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keyID
+}
+
+// canonical returns the JSON bytes covered by the hash and signature. They include
+// prev_hash, so both also cover the receipt's link to the one before it. Fields added
+// over time (prev_hash, key_id, rule_id, ...) are omitempty: a receipt signed before
+// one existed decodes with it empty and re-encodes to the bytes that were signed, so
+// old receipts keep verifying.
+func canonical(r Receipt) []byte {
+	r.Hash = ""
+	r.Sig = ""
+	b, _ := json.Marshal(r)
+	return b
+}
+
+// Add assigns the next id, signs the receipt, stores it and notifies subscribers.
+// Slow subscribers miss receipts rather than blocking the caller.
+func (m *Manager) Add(r Receipt) Receipt {
+	m.mu.Lock()
+	m.nextID++
+	r.ID = m.nextID
+	if r.Timestamp.IsZero() {
+		r.Timestamp = m.now().UTC()
+	}
+	if r.Kind == "" {
+		r.Kind = KindConnection
+	}
+	if r.CorrelationLabel == "" {
+		r.CorrelationLabel = m.correlate(r)
+	}
+	r.PrevHash = m.last
+	r.KeyID = m.keyID
+	data := canonical(r)
+	sum := sha256.Sum256(data)
+	r.Hash = hex.EncodeToString(sum[:])
+	m.last = r.Hash
+	r.Sig = hex.EncodeToString(ed25519.Sign(m.priv, data))
+	if m.journal != nil {
+		m.journal.write(r)
+	}
+	m.evict(len(m.ring)+1-m.cap, EvictCapacity)
+	m.ring = append(m.ring, r)
+	for _, sub := range m.subs {
+		if sub.match != nil && !sub.match(&r) {
+			continue
+		}
+		select {
+		case sub.ch <- r:
+		default:
+		}
+	}
+	m.mu.Unlock()
+	return r
+}
+
+// Get returns the retained receipt with the given id.
+func (m *Manager) Get(id int64) (Receipt, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.ring {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return Receipt{}, ErrNotFound
+}
+
+// List returns up to limit of the most recent receipts in id order (limit <= 0 means all).
+func (m *Manager) List(limit int) []Receipt {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	start := 0
+	if limit > 0 && limit < len(m.ring) {
+		start = len(m.ring) - limit
+	}
+	out := make([]Receipt, len(m.ring)-start)
+	copy(out, m.ring[start:])
+	return out
+}
+
+// Verify recomputes the canonical hash and checks the signature of r, and checks its
+// link to the receipt before it: chain is ChainOK, ChainBroken, ChainGenesis for the
+// first receipt, or ChainUnknown when the previous receipt is no longer retained.
+// The signature is checked against the key r's key_id names, current or retired.
+func (m *Manager) Verify(r Receipt) (hashOK, sigOK bool, chain string) {
+	m.mu.RLock()
+	keys, chain := m.keys.candidates(r), m.link(r)
+	m.mu.RUnlock()
+	hashOK, sigOK = verifyWith(keys, r)
+	return hashOK, sigOK, chain
+}
+
+// check recomputes the canonical hash and checks the signature of r; called with
+// m.mu held.
+func (m *Manager) check(r Receipt) (hashOK, sigOK bool) { return verifyWith(m.keys.candidates(r), r) }
+
+// VerifySignature recomputes r's canonical hash and checks its signature against pub,
+// without a Manager (offline verification).
+func VerifySignature(pub ed25519.PublicKey, r Receipt) (hashOK, sigOK bool) {
+	data := canonical(r)
+	sum := sha256.Sum256(data)
+	hashOK = hex.EncodeToString(sum[:]) == r.Hash
+	sig, err := hex.DecodeString(r.Sig)
+	sigOK = err == nil && len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, data, sig)
+	return hashOK, sigOK
+}
+
+// subscriber is a Subscribe channel and its optional filter.
+type subscriber struct {
+	ch    chan Receipt
+	match func(*Receipt) bool
+}
+
+// Subscribe returns a channel receiving each receipt added after the call and a
+// cancel function that must be called to release it.
+func (m *Manager) Subscribe(buffer int) (<-chan Receipt, func()) {
+	return m.SubscribeFunc(buffer, nil)
+}
+
+// SubscribeFunc is Subscribe for only the receipts match accepts (nil = all). match
+// runs in Add under the Manager's lock, so receipts it rejects are never copied to
+// the channel or counted against its buffer; it must be quick and not call the Manager.
+func (m *Manager) SubscribeFunc(buffer int, match func(*Receipt) bool) (<-chan Receipt, func()) {
+	ch := make(chan Receipt, buffer)
+	m.mu.Lock()
+	id := m.nextSub
+	m.nextSub++
+	m.subs[id] = subscriber{ch, match}
+	m.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subs, id)
+			m.mu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package receipts
+
+import (
+    "crypto/ed25519"
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func newTestManager(capacity int) *Manager {
+    seed := make([]byte, ed25519.SeedSize)
+    for i := range seed { seed[i] = byte(i) }
+    return NewManager(capacity, ed25519.NewKeyFromSeed(seed), ManagerOptions{})
+}
+
+func TestAddSignVerify(t *testing.T) {
+    m := newTestManager(4)
+    r := m.Add(Receipt{ConnID: 7, AppliedProfile: "CLEAN", Outcome: "closed"})
+    if r.ID != 1 || r.Hash == "" || r.Sig == "" { t.Fatalf("receipt not signed: %#v", r) }
+    got, err := m.Get(1)
+    if err != nil { t.Fatalf("get: %v", err) }
+    if h, s, _ := m.Verify(got); !h || !s { t.Fatalf("verify failed hash=%v sig=%v", h, s) }
+    got.Outcome = "error"
+    if h, s, _ := m.Verify(got); h || s { t.Fatalf("tampered receipt verified hash=%v sig=%v", h, s) }
+}
+
+func TestRingEviction(t *testing.T) {
+    m := newTestManager(3)
+    for i := 0; i < 5; i++ { m.Add(Receipt{ConnID: int64(i)}) }
+    list := m.List(0)
+    if len(list) != 3 || list[0].ID != 3 || list[2].ID != 5 { t.Fatalf("unexpected ring contents %#v", list) }
+    if _, err := m.Get(1); err != ErrNotFound { t.Fatalf("expected evicted receipt, got %v", err) }
+    if l := m.List(2); len(l) != 2 || l[0].ID != 4 { t.Fatalf("unexpected limited list %#v", l) }
+}
+
+func TestSubscribe(t *testing.T) {
+    m := newTestManager(8)
+    ch, cancel := m.Subscribe(1)
+    m.Add(Receipt{ConnID: 1})
+    select {
+    case r := <-ch:
+        if r.ID != 1 { t.Fatalf("unexpected receipt %#v", r) }
+    case <-time.After(time.Second):
+        t.Fatalf("no receipt delivered")
+    }
+    cancel()
+    m.Add(Receipt{ConnID: 2})
+    select {
+    case r := <-ch:
+        t.Fatalf("receipt delivered after cancel: %#v", r)
+    default:
+    }
+}
+
+// legacyReceipt was signed with newTestManager's key before receipts had key_id,
+// rule_id or prev_hash, when rule_matched held the applied profile.
+const legacyReceipt = `{"id":7,"kind":"connection","conn_id":7,"timestamp":"2025-01-01T12:00:00Z","client_addr":"","upstream_addr":"","global_profile":"CLEAN","applied_profile":"ABORT_AFTER_CH","rule_matched":"ABORT_AFTER_CH","handshake_bytes":517,"cipher_count":0,"pqc_hint":false,"grease_count":0,"outcome":"error","hash":"634e1af0bb59c7db3c24d925150c35525bad9197d53116087353c1c5d84681fb","sig":"25a9d3bd683a4ecc348aa1eb45a85d5a39962c9a7a1a6906b1d47c5ccc9c7181cc810aa6f653a5e9c87e86ef1d9e882e422b8108d0d5e0399b365e1ed36d930d"}`
+
+func TestLegacyReceiptVerifies(t *testing.T) {
+    var r Receipt
+    if err := json.Unmarshal([]byte(legacyReceipt), &r); err != nil { t.Fatal(err) }
+    m := newTestManager(4)
+    if h, s, _ := m.Verify(r); !h || !s { t.Fatalf("legacy receipt: hash=%v sig=%v", h, s) }
+
+    cur := m.Add(Receipt{AppliedProfile: "ABORT_AFTER_CH", RuleMatched: "id:abort when ch_bytes > 1400 then ABORT_AFTER_CH", RuleID: "abort"})
+    if h, s, _ := m.Verify(cur); !h || !s { t.Fatalf("receipt with rule_id: hash=%v sig=%v", h, s) }
+    cur.RuleID = "other"
+    if h, s, _ := m.Verify(cur); h || s { t.Fatal("rule_id is not covered by the signature") }
+}
@@ -0,0 +1,95 @@
+package receipts
+
+import (
+	"context"
+	"time"
+)
+
+// Eviction reasons passed to an EvictionCallback.
+const (
+	EvictCapacity = "capacity" // the ring was full
+	EvictAge      = "age"      // older than ManagerOptions.MaxAge
+)
+
+// EvictionCallback is called with receipts about to leave the ring, oldest first,
+// while they are still retained. It runs under the Manager's lock, in eviction
+// order: it must not call the Manager and should hand slow work (a file, a webhook)
+// to another goroutine.
+type EvictionCallback func(evicted []Receipt, reason string)
+
+// ManagerOptions configures retention beyond the ring's capacity.
+type ManagerOptions struct {
+	MaxAge  time.Duration    // receipts older than this are pruned by Prune (0 = kept until the ring is full)
+	OnEvict EvictionCallback // nil = none
+}
+
+// Retention reports how much of the receipt history the ring still holds.
+type Retention struct {
+	Retained     int   `json:"retained"`
+	EvictedTotal int64 `json:"evicted_total"` // since startup, for capacity or age
+	OldestID     int64 `json:"oldest_id"`     // 0 when nothing is retained
+}
+
+// Retention returns the ring's current retention counters.
+func (m *Manager) Retention() Retention {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r := Retention{Retained: len(m.ring), EvictedTotal: m.evicted}
+	if len(m.ring) > 0 {
+		r.OldestID = m.ring[0].ID
+	}
+	return r
+}
+
+// evict drops the n oldest receipts, telling the callback first; called with m.mu held.
+func (m *Manager) evict(n int, reason string) {
+	if n <= 0 {
+		return
+	}
+	if m.opts.OnEvict != nil {
+		m.opts.OnEvict(append([]Receipt(nil), m.ring[:n]...), reason)
+	}
+	m.ring = append(m.ring[:0], m.ring[n:]...)
+	m.evicted += int64(n)
+}
+
+// Prune evicts the receipts older than MaxAge, oldest first, stopping at the first
+// one still young enough, and returns how many it evicted.
+func (m *Manager) Prune() int {
+	if m.opts.MaxAge <= 0 {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := m.now().Add(-m.opts.MaxAge)
+	n := 0
+	for n < len(m.ring) && m.ring[n].Timestamp.Before(cutoff) {
+		n++
+	}
+	m.evict(n, EvictAge)
+	return n
+}
+
+// PruneEvery runs Prune every interval until ctx is done; without a MaxAge it
+// returns at once.
+func (m *Manager) PruneEvery(ctx context.Context, interval time.Duration) {
+	if m.opts.MaxAge <= 0 || interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			m.Prune()
+		}
+	}
+}
+
+// PruneInterval is how often PruneEvery should run for maxAge: a tenth of it, between
+// a second and a minute.
+func PruneInterval(maxAge time.Duration) time.Duration {
+	return min(max(maxAge/10, time.Second), time.Minute)
+}
@@ -0,0 +1,71 @@
+package receipts
+
+import (
+    "crypto/ed25519"
+    "testing"
+    "time"
+)
+
+type evictCall struct {
+    ids    []int64
+    reason string
+}
+
+func newRetentionManager(capacity int, maxAge time.Duration, calls *[]evictCall) (*Manager, *time.Time) {
+    clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+    var m *Manager
+    m = NewManager(capacity, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), ManagerOptions{MaxAge: maxAge, OnEvict: func(ev []Receipt, reason string) {
+        c := evictCall{reason: reason}
+        for _, r := range ev { c.ids = append(c.ids, r.ID) }
+        // still retained when the callback runs
+        if len(m.ring) == 0 || m.ring[0].ID != ev[0].ID { panic("callback ran after eviction") }
+        *calls = append(*calls, c)
+    }})
+    m.now = func() time.Time { return clock }
+    return m, &clock
+}
+
+func TestPruneByAge(t *testing.T) {
+    var calls []evictCall
+    m, clock := newRetentionManager(16, time.Minute, &calls)
+    for i := 0; i < 5; i++ {
+        m.Add(Receipt{ConnID: int64(i)})
+        *clock = clock.Add(20 * time.Second)
+    }
+    // receipts at 0s, 20s, 40s, 60s, 80s; now 100s: older than 40s go
+    if n := m.Prune(); n != 2 { t.Fatalf("pruned %d, want 2", n) }
+    if got := m.Retention(); got != (Retention{Retained: 3, EvictedTotal: 2, OldestID: 3}) { t.Fatalf("retention %+v", got) }
+    if n := m.Prune(); n != 0 { t.Fatalf("second prune took %d", n) }
+    *clock = clock.Add(time.Hour)
+    if n := m.Prune(); n != 3 { t.Fatalf("pruned %d after an hour, want 3", n) }
+    if got := m.Retention(); got != (Retention{EvictedTotal: 5}) { t.Fatalf("retention %+v", got) }
+    if len(calls) != 2 || calls[0].reason != EvictAge || len(calls[0].ids) != 2 || calls[1].ids[0] != 3 { t.Fatalf("callbacks %+v", calls) }
+
+    // IDs carry on after the ring empties
+    if r := m.Add(Receipt{}); r.ID != 6 { t.Fatalf("next id %d", r.ID) }
+    noAge, _ := newRetentionManager(16, 0, &calls)
+    noAge.Add(Receipt{})
+    if n := noAge.Prune(); n != 0 { t.Fatal("pruned without a max age") }
+}
+
+func TestEvictionCallbackOrder(t *testing.T) {
+    var calls []evictCall
+    m, clock := newRetentionManager(3, time.Minute, &calls)
+    for i := 1; i <= 6; i++ {
+        m.Add(Receipt{ConnID: int64(i)})
+        *clock = clock.Add(time.Second)
+    }
+    *clock = clock.Add(time.Minute)
+    m.Prune()
+    var order []int64
+    for i, c := range calls {
+        want := EvictCapacity
+        if i == len(calls)-1 { want = EvictAge }
+        if c.reason != want { t.Fatalf("call %d reason %s, want %s", i, c.reason, want) }
+        order = append(order, c.ids...)
+    }
+    for i, id := range order {
+        if id != int64(i+1) { t.Fatalf("eviction order %v", order) }
+    }
+    if len(order) != 6 || m.Retention().EvictedTotal != 6 { t.Fatalf("evicted %v", order) }
+}
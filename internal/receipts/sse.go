@@ -0,0 +1,97 @@
+package receipts
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sseKeepAlive is how often an idle SSE stream sends a comment, so proxies in
+// between do not time it out.
+const sseKeepAlive = 15 * time.Second
+
+// StreamFilter selects the receipts sent on a stream; empty fields match everything.
+type StreamFilter struct {
+	Profile     string // applied_profile equals
+	SNIContains string // sni contains
+}
+
+// ParseStreamFilter reads a StreamFilter from ?profile= and ?sni_contains=.
+func ParseStreamFilter(r *http.Request) StreamFilter {
+	q := r.URL.Query()
+	return StreamFilter{Profile: q.Get("profile"), SNIContains: q.Get("sni_contains")}
+}
+
+// Match reports whether r passes the filter.
+func (f StreamFilter) Match(r *Receipt) bool {
+	return (f.Profile == "" || r.AppliedProfile == f.Profile) &&
+		(f.SNIContains == "" || strings.Contains(r.SNI, f.SNIContains))
+}
+
+// ServeSSE streams receipts as Server-Sent Events, one "id: <receipt id>" and
+// "data: <receipt JSON>" frame each, for browsers' EventSource. Receipts are filtered
+// server-side by ParseStreamFilter's parameters. A client reconnecting with a
+// Last-Event-ID header first gets the receipts it missed that are still retained,
+// then the live ones; receipts evicted meanwhile are gone. It runs until the request
+// is canceled.
+func (m *Manager) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "stream unsupported", http.StatusInternalServerError)
+		return
+	}
+	filter := ParseStreamFilter(r)
+	var lastID int64
+	v := r.Header.Get("Last-Event-ID")
+	if v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+	// Subscribe before reading the ring, so nothing added in between is missed; the
+	// overlap is skipped by ID below.
+	ch, cancel := m.SubscribeFunc(64, filter.Match)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(rec Receipt) {
+		b, _ := json.Marshal(rec)
+		w.Write([]byte("id: " + strconv.FormatInt(rec.ID, 10) + "\ndata: "))
+		w.Write(b)
+		w.Write([]byte("\n\n"))
+		lastID = rec.ID
+	}
+	if v != "" {
+		for _, rec := range m.List(0) {
+			if rec.ID > lastID && filter.Match(&rec) {
+				send(rec)
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	done := r.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-keepAlive.C:
+			w.Write([]byte(": keepalive\n\n"))
+		case rec := <-ch:
+			if rec.ID <= lastID {
+				continue
+			}
+			send(rec)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,87 @@
+package receipts
+
+import (
+    "bufio"
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// sseIDs returns the id: lines of an SSE body.
+func sseIDs(body string) []string {
+    var ids []string
+    for _, line := range strings.Split(body, "\n") {
+        if id, ok := strings.CutPrefix(line, "id: "); ok { ids = append(ids, id) }
+    }
+    return ids
+}
+
+func TestSSEReplayAfterReconnect(t *testing.T) {
+    m := newTestManager(16)
+    for i, p := range []string{"CLEAN", "ABORT_AFTER_CH", "CLEAN", "CLEAN", "ABORT_AFTER_CH"} {
+        m.Add(Receipt{ConnID: int64(i), AppliedProfile: p, SNI: "api.example"})
+    }
+    // a client that saw receipt 2 reconnects; its context is already canceled, so the
+    // handler writes the replay and returns
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    req := httptest.NewRequest("GET", "/receipts/stream/sse?profile=CLEAN", nil).WithContext(ctx)
+    req.Header.Set("Last-Event-ID", "2")
+    rec := httptest.NewRecorder()
+    m.ServeSSE(rec, req)
+    if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" { t.Fatalf("content type %q", ct) }
+    if ids := sseIDs(rec.Body.String()); strings.Join(ids, ",") != "3,4" { t.Fatalf("replayed %v\n%s", ids, rec.Body) }
+    if !strings.Contains(rec.Body.String(), "data: {\"id\":3,") { t.Fatalf("frame: %s", rec.Body) }
+
+    // no Last-Event-ID: nothing replayed
+    rec = httptest.NewRecorder()
+    m.ServeSSE(rec, httptest.NewRequest("GET", "/receipts/stream/sse", nil).WithContext(ctx))
+    if ids := sseIDs(rec.Body.String()); len(ids) != 0 { t.Fatalf("replayed without Last-Event-ID: %v", ids) }
+
+    bad := httptest.NewRequest("GET", "/receipts/stream/sse", nil)
+    bad.Header.Set("Last-Event-ID", "x")
+    rec = httptest.NewRecorder()
+    m.ServeSSE(rec, bad)
+    if rec.Code != http.StatusBadRequest { t.Fatalf("bad Last-Event-ID: %d", rec.Code) }
+}
+
+func TestSSELiveFilter(t *testing.T) {
+    m := newTestManager(16)
+    m.Add(Receipt{AppliedProfile: "CLEAN", SNI: "old.example"})
+    srv := httptest.NewServer(http.HandlerFunc(m.ServeSSE))
+    defer srv.Close()
+    req, _ := http.NewRequest("GET", srv.URL+"?sni_contains=api", nil)
+    req.Header.Set("Last-Event-ID", "1")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    defer resp.Body.Close()
+
+    m.Add(Receipt{SNI: "www.example"})
+    m.Add(Receipt{SNI: "api.example"})
+    sc := bufio.NewScanner(resp.Body)
+    got := make(chan string, 1)
+    go func() {
+        for sc.Scan() {
+            if id, ok := strings.CutPrefix(sc.Text(), "id: "); ok { got <- id; return }
+        }
+    }()
+    select {
+    case id := <-got:
+        if id != "3" { t.Fatalf("first live event %s, want 3", id) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("no event")
+    }
+}
+
+func TestSubscribeFuncFilters(t *testing.T) {
+    m := newTestManager(16)
+    ch, cancel := m.SubscribeFunc(1, StreamFilter{Profile: "CLEAN"}.Match)
+    defer cancel()
+    // filtered-out receipts do not take the one buffer slot
+    for i := 0; i < 5; i++ { m.Add(Receipt{AppliedProfile: "ABORT_AFTER_CH"}) }
+    m.Add(Receipt{AppliedProfile: "CLEAN"})
+    if r := <-ch; r.ID != 6 { t.Fatalf("got receipt %d", r.ID) }
+}
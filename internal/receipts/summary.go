@@ -0,0 +1,126 @@
+package receipts
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultSummaryTop is how many SNIs a Summary lists when not told otherwise.
+const DefaultSummaryTop = 10
+
+// SummaryStats are the counts and connection latency of one group in a Summary.
+// Latency is duration_ms; connections without one (rejected before they were
+// handled) count but do not enter the percentiles.
+type SummaryStats struct {
+	Count  int     `json:"count"`
+	Errors int     `json:"errors"` // outcome error, or an error recorded
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+}
+
+// SNISummary is one row of Summary.SNIs.
+type SNISummary struct {
+	SNI string `json:"sni"`
+	SummaryStats
+}
+
+// Summary aggregates the connection receipts of a time window (GET /receipts/summary).
+type Summary struct {
+	Window      string                  `json:"window,omitempty"` // empty: every retained receipt
+	Since       *time.Time              `json:"since,omitempty"`
+	Connections int                     `json:"connections"`
+	Total       SummaryStats            `json:"total"`
+	Profiles    map[string]SummaryStats `json:"profiles"` // by applied_profile
+	Outcomes    map[string]SummaryStats `json:"outcomes"`
+	SNIs        []SNISummary            `json:"snis"` // the top connection counts, then by name; no SNI is ""
+}
+
+// summaryGroup collects one group's receipts.
+type summaryGroup struct {
+	count, errors int
+	durations     []float64
+}
+
+func (g *summaryGroup) add(r Receipt) {
+	g.count++
+	if r.Outcome == "error" || r.Error != "" {
+		g.errors++
+	}
+	if r.DurationMs > 0 {
+		g.durations = append(g.durations, r.DurationMs)
+	}
+}
+
+func (g *summaryGroup) stats() SummaryStats {
+	return SummaryStats{Count: g.count, Errors: g.errors, P50Ms: aggregate("p50", g.durations), P95Ms: aggregate("p95", g.durations)}
+}
+
+// Summarize aggregates the connection receipts in rs stamped at or after since (zero =
+// all) by applied profile, by outcome and for the top SNIs by count (0 = all).
+// Percentiles are nearest-rank, as in Query.
+func Summarize(rs []Receipt, since time.Time, top int) Summary {
+	var total summaryGroup
+	profiles := map[string]*summaryGroup{}
+	outcomes := map[string]*summaryGroup{}
+	snis := map[string]*summaryGroup{}
+	group := func(m map[string]*summaryGroup, key string) *summaryGroup {
+		g := m[key]
+		if g == nil {
+			g = &summaryGroup{}
+			m[key] = g
+		}
+		return g
+	}
+	for _, r := range rs {
+		if r.Kind != KindConnection || (!since.IsZero() && r.Timestamp.Before(since)) {
+			continue
+		}
+		total.add(r)
+		group(profiles, r.AppliedProfile).add(r)
+		group(outcomes, r.Outcome).add(r)
+		group(snis, r.SNI).add(r)
+	}
+	s := Summary{
+		Connections: total.count,
+		Total:       total.stats(),
+		Profiles:    make(map[string]SummaryStats, len(profiles)),
+		Outcomes:    make(map[string]SummaryStats, len(outcomes)),
+		SNIs:        make([]SNISummary, 0, len(snis)),
+	}
+	for k, g := range profiles {
+		s.Profiles[k] = g.stats()
+	}
+	for k, g := range outcomes {
+		s.Outcomes[k] = g.stats()
+	}
+	for k, g := range snis {
+		s.SNIs = append(s.SNIs, SNISummary{SNI: k, SummaryStats: g.stats()})
+	}
+	sort.Slice(s.SNIs, func(i, j int) bool {
+		if s.SNIs[i].Count != s.SNIs[j].Count {
+			return s.SNIs[i].Count > s.SNIs[j].Count
+		}
+		return s.SNIs[i].SNI < s.SNIs[j].SNI
+	})
+	if !since.IsZero() {
+		s.Since = &since
+	}
+	if top > 0 && len(s.SNIs) > top {
+		s.SNIs = s.SNIs[:top]
+	}
+	return s
+}
+
+// Summary summarizes the retained connection receipts of the last window (0 = all
+// retained), listing the top SNIs.
+func (m *Manager) Summary(window time.Duration, top int) Summary {
+	var since time.Time
+	if window > 0 {
+		since = m.now().UTC().Add(-window)
+	}
+	s := Summarize(m.List(0), since, top)
+	if window > 0 {
+		s.Window = window.String()
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package receipts
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSummarize(t *testing.T) {
+    base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+    var rs []Receipt
+    add := func(ago time.Duration, profile, sni, outcome string, ms float64) {
+        rs = append(rs, Receipt{Kind: KindConnection, Timestamp: base.Add(-ago), AppliedProfile: profile, SNI: sni, Outcome: outcome, DurationMs: ms})
+    }
+    // CLEAN: durations 1..20 ms on a.example
+    for i := 1; i <= 20; i++ { add(time.Minute, "CLEAN", "a.example", "closed", float64(i)) }
+    // ABORT_AFTER_CH: 4 errors, 3 on b.example, one with no duration
+    add(time.Minute, "ABORT_AFTER_CH", "b.example", "error", 5)
+    add(time.Minute, "ABORT_AFTER_CH", "b.example", "error", 7)
+    add(time.Minute, "ABORT_AFTER_CH", "b.example", "error", 9)
+    add(time.Minute, "ABORT_AFTER_CH", "c.example", "error", 0)
+    // outside the window, and not connections
+    add(time.Hour, "CLEAN", "a.example", "closed", 1000)
+    rs = append(rs, Receipt{Kind: KindConfigChange, Timestamp: base, Outcome: "applied"})
+
+    s := Summarize(rs, base.Add(-15*time.Minute), 2)
+    if s.Connections != 24 || s.Total.Count != 24 || s.Total.Errors != 4 { t.Fatalf("total %+v", s) }
+    if got := s.Profiles["CLEAN"]; got != (SummaryStats{Count: 20, P50Ms: 10, P95Ms: 19}) { t.Fatalf("CLEAN %+v", got) }
+    if got := s.Profiles["ABORT_AFTER_CH"]; got != (SummaryStats{Count: 4, Errors: 4, P50Ms: 7, P95Ms: 9}) { t.Fatalf("ABORT_AFTER_CH %+v", got) }
+    if got := s.Outcomes["error"]; got.Count != 4 || got.Errors != 4 { t.Fatalf("outcome error %+v", got) }
+    if len(s.Outcomes) != 2 { t.Fatalf("outcomes %+v", s.Outcomes) }
+    if len(s.SNIs) != 2 || s.SNIs[0].SNI != "a.example" || s.SNIs[0].Count != 20 || s.SNIs[1].SNI != "b.example" || s.SNIs[1].P50Ms != 7 { t.Fatalf("top SNIs %+v", s.SNIs) }
+    if s.Since == nil || !s.Since.Equal(base.Add(-15*time.Minute)) { t.Fatalf("since %v", s.Since) }
+
+    // the 1000ms outlier is the 21st value: nearest rank keeps p95 at the 20th
+    all := Summarize(rs, time.Time{}, 0)
+    if all.Connections != 25 || len(all.SNIs) != 3 || all.Profiles["CLEAN"] != (SummaryStats{Count: 21, P50Ms: 11, P95Ms: 20}) || all.Since != nil { t.Fatalf("all retained %+v", all) }
+}
+
+func TestManagerSummaryWindow(t *testing.T) {
+    var calls []evictCall
+    m, clock := newRetentionManager(16, 0, &calls)
+    m.Add(Receipt{AppliedProfile: "CLEAN", DurationMs: 3})
+    *clock = clock.Add(time.Hour)
+    m.Add(Receipt{AppliedProfile: "CLEAN", DurationMs: 5})
+    s := m.Summary(15*time.Minute, DefaultSummaryTop)
+    if s.Window != "15m0s" || s.Connections != 1 || s.Profiles["CLEAN"].P50Ms != 5 { t.Fatalf("summary %+v", s) }
+}
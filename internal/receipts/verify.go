@@ -0,0 +1,129 @@
+package receipts
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// VerifyResult is one receipt's entry in a BatchReport.
+type VerifyResult struct {
+	ID     int64  `json:"id"`
+	Found  bool   `json:"found"` // false: not retained, nothing checked
+	HashOK bool   `json:"hash_ok"`
+	SigOK  bool   `json:"sig_ok"`
+	Chain  string `json:"chain,omitempty"` // as in Verify
+}
+
+// BatchReport is the result of VerifyBatch.
+type BatchReport struct {
+	Results  []VerifyResult `json:"results"`
+	Checked  int            `json:"checked"`   // receipts found and checked
+	Passed   int            `json:"passed"`    // hash and signature good, chain not broken
+	Failed   int            `json:"failed"`    // checked and not passed
+	NotFound int            `json:"not_found"` // IDs not retained
+}
+
+// VerifyBatch verifies the retained receipts with the given IDs, or every retained
+// receipt when all is true. The receipts and their chain links are read under the
+// lock; the signature checks run after it is released.
+func (m *Manager) VerifyBatch(ids []int64, all bool) BatchReport {
+	type item struct {
+		r     Receipt
+		found bool
+		chain string
+		keys  []ed25519.PublicKey
+	}
+	m.mu.RLock()
+	var items []item
+	if all {
+		items = make([]item, len(m.ring))
+		for i, r := range m.ring {
+			items[i] = item{r, true, m.link(r), m.keys.candidates(r)}
+		}
+	} else {
+		items = make([]item, len(ids))
+		for i, id := range ids {
+			r, ok := m.find(id)
+			if !ok {
+				r.ID = id
+			}
+			items[i] = item{r: r, found: ok}
+			if ok {
+				items[i].chain, items[i].keys = m.link(r), m.keys.candidates(r)
+			}
+		}
+	}
+	m.mu.RUnlock()
+	rep := BatchReport{Results: make([]VerifyResult, len(items))}
+	for i, it := range items {
+		res := VerifyResult{ID: it.r.ID, Found: it.found, Chain: it.chain}
+		if !it.found {
+			rep.NotFound++
+			rep.Results[i] = res
+			continue
+		}
+		res.HashOK, res.SigOK = verifyWith(it.keys, it.r)
+		rep.Checked++
+		if res.HashOK && res.SigOK && res.Chain != ChainBroken {
+			rep.Passed++
+		} else {
+			rep.Failed++
+		}
+		rep.Results[i] = res
+	}
+	return rep
+}
+
+// StreamReport is the result of VerifyStream.
+type StreamReport struct {
+	Records  int      // lines holding a receipt
+	Failed   int      // receipts that failed, plus lines that are not receipts
+	Failures []string // one line per failure: line number, receipt ID, reason
+}
+
+// VerifyStream verifies receipts exported as JSON Lines (GET /receipts/export) against
+// the public keys pubs: each receipt's hash and its signature under the key its key_id
+// names, and, where the receipt before it is the previous line, their chain link. Blank lines are skipped; a line that is
+// not a receipt counts as a failure. The error is for reading r only.
+func VerifyStream(r io.Reader, pubs ...ed25519.PublicKey) (StreamReport, error) {
+	keys := make(keyring, len(pubs))
+	for _, pub := range pubs {
+		keys[KeyID(pub)] = pub
+	}
+	var rep StreamReport
+	fail := func(format string, args ...any) {
+		rep.Failed++
+		rep.Failures = append(rep.Failures, fmt.Sprintf(format, args...))
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 4<<20)
+	var prev *Receipt
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rc Receipt
+		if err := json.Unmarshal(sc.Bytes(), &rc); err != nil {
+			fail("line %d: not a receipt: %v", lineNo, err)
+			prev = nil
+			continue
+		}
+		rep.Records++
+		hashOK, sigOK := verifyWith(keys.candidates(rc), rc)
+		switch {
+		case !hashOK:
+			fail("line %d: receipt %d: hash does not match", lineNo, rc.ID)
+		case !sigOK:
+			fail("line %d: receipt %d: bad signature", lineNo, rc.ID)
+		case rc.ID == 1 && rc.PrevHash != "":
+			fail("line %d: receipt 1: prev_hash set on the first receipt", lineNo)
+		case prev != nil && prev.ID == rc.ID-1 && prev.Hash != rc.PrevHash:
+			fail("line %d: receipt %d: prev_hash does not match receipt %d", lineNo, rc.ID, prev.ID)
+		}
+		prev = &rc
+	}
+	return rep, sc.Err()
+}
@@ -0,0 +1,61 @@
+package receipts
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "strings"
+    "testing"
+)
+
+func TestVerifyBatch(t *testing.T) {
+    m := newTestManager(8)
+    for i := 1; i <= 4; i++ { m.Add(Receipt{ConnID: int64(i)}) }
+    // corrupt receipt 3 in place: its hash no longer covers the body
+    m.mu.Lock()
+    m.ring[2].SNI = "tampered.example"
+    m.mu.Unlock()
+
+    rep := m.VerifyBatch([]int64{1, 3, 99}, false)
+    if rep.Checked != 2 || rep.Passed != 1 || rep.Failed != 1 || rep.NotFound != 1 || len(rep.Results) != 3 { t.Fatalf("batch: %+v", rep) }
+    if r := rep.Results[0]; r.ID != 1 || !r.Found || !r.HashOK || !r.SigOK || r.Chain != ChainGenesis { t.Fatalf("receipt 1: %+v", r) }
+    if r := rep.Results[1]; r.ID != 3 || !r.Found || r.HashOK || r.SigOK { t.Fatalf("corrupted receipt: %+v", r) }
+    if r := rep.Results[2]; r.ID != 99 || r.Found { t.Fatalf("missing receipt: %+v", r) }
+
+    all := m.VerifyBatch(nil, true)
+    if all.Checked != 4 || all.Passed != 3 || all.Failed != 1 || all.NotFound != 0 { t.Fatalf("all: %+v", all) }
+}
+
+func TestVerifyStream(t *testing.T) {
+    m := newTestManager(8)
+    for i := 1; i <= 4; i++ { m.Add(Receipt{ConnID: int64(i), SNI: "a.example"}) }
+    var buf bytes.Buffer
+    if err := m.Export(&buf, FormatJSONL, "", 0); err != nil { t.Fatal(err) }
+    export := buf.String()
+
+    rep, err := VerifyStream(strings.NewReader(export), m.pub)
+    if err != nil || rep.Records != 4 || rep.Failed != 0 { t.Fatalf("clean export: %+v %v", rep, err) }
+
+    // a record edited after export fails its hash
+    tampered := strings.Replace(export, `"conn_id":3`, `"conn_id":33`, 1)
+    rep, _ = VerifyStream(strings.NewReader(tampered), m.pub)
+    if rep.Failed != 1 || !strings.Contains(rep.Failures[0], "line 3: receipt 3: hash does not match") { t.Fatalf("tampered: %+v", rep) }
+
+    // a dropped record is a gap, not a failure; a garbled line is
+    lines := strings.SplitAfter(export, "\n")
+    rep, _ = VerifyStream(strings.NewReader(lines[0]+lines[1]+lines[3]+"{not json\n"), m.pub)
+    if rep.Records != 3 || rep.Failed != 1 || !strings.Contains(rep.Failures[0], "line 4: not a receipt") { t.Fatalf("gap and garbage: %+v", rep) }
+
+    // receipt 3 of another log (same key, other contents) spliced in after 2 breaks the link
+    other := newTestManager(8)
+    for i := 1; i <= 3; i++ { other.Add(Receipt{ConnID: int64(i)}) }
+    var ob bytes.Buffer
+    if err := other.Export(&ob, FormatJSONL, "", 0); err != nil { t.Fatal(err) }
+    spliced := lines[0] + lines[1] + strings.SplitAfter(ob.String(), "\n")[2]
+    rep, _ = VerifyStream(strings.NewReader(spliced), m.pub)
+    if rep.Failed != 1 || !strings.Contains(rep.Failures[0], "receipt 3: prev_hash does not match receipt 2") { t.Fatalf("spliced: %+v", rep) }
+
+    // a different key fails every signature
+    wrong := NewManager(8, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), ManagerOptions{})
+    rep, _ = VerifyStream(strings.NewReader(export), wrong.pub)
+    if rep.Failed != 4 || !strings.Contains(rep.Failures[0], "bad signature") { t.Fatalf("wrong key: %+v", rep) }
+}
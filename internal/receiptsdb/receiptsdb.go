@@ -0,0 +1,412 @@
+// Package receiptsdb keeps receipts in a local SQLite database (-receipts-db) for
+// ad-hoc querying. A writer goroutine fed from a receipts subscription inserts them
+// in batches, so connections never wait on the disk. Each receipt is a row of the
+// receipts table, with its numeric query fields as columns and the signed receipt
+// as JSON; its string dimensions (profile, SNI, outcome and the other group-by
+// columns of receipts.Query) are rows of receipt_tags. Queries are the constrained
+// receipts.Query, never SQL from the client.
+package receiptsdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite" // pure-Go driver, registered as "sqlite"
+
+	"pathlab/internal/receipts"
+)
+
+// Defaults for Options.
+const (
+	DefaultQueue = 4096                   // receipts waiting to be written; more are missed
+	DefaultBatch = 256                    // receipts per transaction
+	DefaultDelay = 200 * time.Millisecond // longest a receipt waits for its batch
+)
+
+// Options configure Open.
+type Options struct {
+	Queue int           // subscription buffer; 0 = DefaultQueue
+	Batch int           // 0 = DefaultBatch
+	Delay time.Duration // 0 = DefaultDelay
+	Logf  func(format string, args ...any)
+}
+
+// Stats count what the writer did.
+type Stats struct {
+	Written int64 `json:"written"`
+	Missed  int64 `json:"missed"` // receipts that never reached the writer (full queue)
+	Failed  int64 `json:"failed"` // receipts in batches that could not be written
+}
+
+// DB is an open receipts database.
+type DB struct {
+	db   *sql.DB
+	opts Options
+
+	cancel func()        // ends the subscription
+	stop   chan struct{} // closed by Close
+	done   chan struct{} // closed when the writer has flushed
+	closed sync.Once
+
+	written, missed, failed atomic.Int64
+}
+
+// migrations bring a database from schema version i to i+1 (PRAGMA user_version).
+// Columns for numeric query fields are not listed here: syncColumns adds any the
+// receipts table lacks, so a field added to receipts.Query gets one on next start.
+var migrations = []string{
+	`CREATE TABLE receipts (
+		id   INTEGER PRIMARY KEY, -- the receipt's id
+		ts   INTEGER NOT NULL,    -- unix nanoseconds
+		body TEXT NOT NULL        -- the signed receipt as JSON
+	);
+	CREATE INDEX receipts_ts ON receipts(ts);
+	CREATE TABLE receipt_tags (
+		receipt_id INTEGER NOT NULL REFERENCES receipts(id) ON DELETE CASCADE,
+		name       TEXT NOT NULL,
+		value      TEXT NOT NULL,
+		PRIMARY KEY (receipt_id, name)
+	) WITHOUT ROWID;
+	CREATE INDEX receipt_tags_name_value ON receipt_tags(name, value);`,
+}
+
+// SchemaVersion is the schema version Open migrates to.
+var SchemaVersion = len(migrations)
+
+// Open opens (creating it if missing) and migrates the database at path. Call Start
+// to have it record receipts.
+func Open(path string, opts Options) (*DB, error) {
+	if opts.Queue <= 0 {
+		opts.Queue = DefaultQueue
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = DefaultBatch
+	}
+	if opts.Delay <= 0 {
+		opts.Delay = DefaultDelay
+	}
+	if opts.Logf == nil {
+		opts.Logf = func(string, ...any) {}
+	}
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{db: db, opts: opts, cancel: func() {}, stop: make(chan struct{})}
+	if err := d.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return d, nil
+}
+
+// migrate applies the migrations the database has not had, then syncColumns.
+func (d *DB) migrate() error {
+	var version int
+	if err := d.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this PathLab's %d", version, len(migrations))
+	}
+	for v := version; v < len(migrations); v++ {
+		tx, err := d.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[v]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", v+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, v+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return d.syncColumns()
+}
+
+// syncColumns adds a column for each numeric query field the receipts table lacks,
+// filled in for the rows already there from their JSON.
+func (d *DB) syncColumns() error {
+	rows, err := d.db.Query(`SELECT name FROM pragma_table_info('receipts')`)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	for _, f := range receipts.QueryFields() {
+		if have[f] {
+			continue
+		}
+		// Field names come from receipts.QueryFields, never from a request.
+		if _, err := d.db.Exec(fmt.Sprintf(`ALTER TABLE receipts ADD COLUMN %s REAL NOT NULL DEFAULT 0`, f)); err != nil {
+			return fmt.Errorf("add column %s: %w", f, err)
+		}
+		if _, err := d.db.Exec(fmt.Sprintf(`UPDATE receipts SET %[1]s = COALESCE(json_extract(body, '$.%[1]s'), 0)`, f)); err != nil {
+			return fmt.Errorf("fill column %s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// Start records every receipt m adds from now on until Close.
+func (d *DB) Start(m *receipts.Manager) {
+	ch, cancel := m.Subscribe(d.opts.Queue)
+	d.cancel, d.done = cancel, make(chan struct{})
+	go d.run(ch)
+}
+
+// Close writes what is queued and closes the database.
+func (d *DB) Close() error {
+	d.closed.Do(func() {
+		close(d.stop)
+		if d.done != nil {
+			<-d.done
+		}
+		d.cancel()
+	})
+	return d.db.Close()
+}
+
+// Stats returns the writer's counts.
+func (d *DB) Stats() Stats {
+	return Stats{Written: d.written.Load(), Missed: d.missed.Load(), Failed: d.failed.Load()}
+}
+
+// run writes the receipts from ch in batches. Receipts the subscription dropped show
+// as gaps in the IDs and are counted as missed.
+func (d *DB) run(ch <-chan receipts.Receipt) {
+	defer close(d.done)
+	t := time.NewTicker(d.opts.Delay)
+	defer t.Stop()
+	var batch []receipts.Receipt
+	var last int64
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := d.Write(batch...); err != nil {
+			d.failed.Add(int64(len(batch)))
+			d.opts.Logf("[receipts-db] %d receipts not written: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	take := func(r receipts.Receipt) {
+		if last != 0 && r.ID > last+1 {
+			d.missed.Add(r.ID - last - 1)
+			d.opts.Logf("[receipts-db] queue full: receipts %d-%d not recorded", last+1, r.ID-1)
+		}
+		last = r.ID
+		if batch = append(batch, r); len(batch) >= d.opts.Batch {
+			flush()
+		}
+	}
+	for {
+		select {
+		case r := <-ch:
+			take(r)
+		case <-t.C:
+			flush()
+		case <-d.stop:
+			for {
+				select {
+				case r := <-ch:
+					take(r)
+					continue
+				default:
+				}
+				flush()
+				return
+			}
+		}
+	}
+}
+
+// Write inserts rs in one transaction; a receipt already there is replaced.
+func (d *DB) Write(rs ...receipts.Receipt) error {
+	fields := receipts.QueryFields()
+	cols := append([]string{"id", "ts", "body"}, fields...)
+	insert := fmt.Sprintf(`INSERT OR REPLACE INTO receipts (%s) VALUES (?%s)`, strings.Join(cols, ", "), strings.Repeat(", ?", len(cols)-1))
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	ins, err := tx.Prepare(insert)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	del, err := tx.Prepare(`DELETE FROM receipt_tags WHERE receipt_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+	tag, err := tx.Prepare(`INSERT INTO receipt_tags (receipt_id, name, value) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+	args := make([]any, len(cols))
+	for _, r := range rs {
+		body, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		args[0], args[1], args[2] = r.ID, r.Timestamp.UnixNano(), string(body)
+		for i, f := range fields {
+			args[3+i] = receipts.FieldValue(f, r)
+		}
+		if _, err := ins.Exec(args...); err != nil {
+			return err
+		}
+		if _, err := del.Exec(r.ID); err != nil {
+			return err
+		}
+		for _, name := range receipts.GroupColumns() {
+			if v := receipts.GroupValue(name, r); v != "" {
+				if _, err := tag.Exec(r.ID, name, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.written.Add(int64(len(rs)))
+	return nil
+}
+
+// Count returns the number of receipts in the database.
+func (d *DB) Count(ctx context.Context) (n int64, err error) {
+	err = d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM receipts`).Scan(&n)
+	return n, err
+}
+
+// Query evaluates q over every receipt in the database, with the same results
+// receipts.Query.Run gives over the same receipts.
+func (d *DB) Query(ctx context.Context, q receipts.Query) (receipts.QueryResult, error) {
+	res := receipts.QueryResult{Field: q.Field, Agg: q.Agg, GroupBy: q.GroupBy, Groups: []receipts.QueryGroup{}}
+	if !validField(q.Field) || (q.GroupBy != "" && !validGroup(q.GroupBy)) {
+		return res, errors.New("query not from receipts.ParseQuery")
+	}
+	var where []string
+	var args []any
+	tagIs := func(name, value string) {
+		if value != "" {
+			where = append(where, `EXISTS (SELECT 1 FROM receipt_tags t WHERE t.receipt_id = r.id AND t.name = ? AND t.value = ?)`)
+			args = append(args, name, value)
+		}
+	}
+	tagIs("kind", q.Kind)
+	tagIs("applied_profile", q.AppliedProfile)
+	tagIs("global_profile", q.GlobalProfile)
+	tagIs("rule_matched", q.RuleMatched)
+	tagIs("rule_id", q.RuleID)
+	tagIs("sni", q.SNI)
+	tagIs("outcome", q.Outcome)
+	if q.PQC != nil {
+		tagIs("pqc_hint", fmt.Sprint(*q.PQC))
+	}
+	if !q.Since.IsZero() {
+		where = append(where, `r.ts >= ?`)
+		args = append(args, q.Since.UnixNano())
+	}
+	key, join := `''`, ``
+	if q.GroupBy != "" {
+		key, join = `COALESCE(g.value, '')`, ` LEFT JOIN receipt_tags g ON g.receipt_id = r.id AND g.name = ?`
+		args = append([]any{q.GroupBy}, args...)
+	}
+	from := ` FROM receipts r` + join
+	if len(where) > 0 {
+		from += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	// q.Field is one of receipts.QueryFields, checked above, so it is a column name.
+	col := `r.` + q.Field
+	switch q.Agg {
+	case "count", "sum", "avg", "min", "max":
+		agg := map[string]string{"count": `COUNT(*)`, "sum": `TOTAL(` + col + `)`, "avg": `AVG(` + col + `)`, "min": `MIN(` + col + `)`, "max": `MAX(` + col + `)`}[q.Agg]
+		rows, err := d.db.QueryContext(ctx, `SELECT `+key+`, COUNT(*), `+agg+from+` GROUP BY 1 ORDER BY 1`, args...)
+		if err != nil {
+			return res, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var g receipts.QueryGroup
+			if err := rows.Scan(&g.Key, &g.Count, &g.Value); err != nil {
+				return res, err
+			}
+			res.Matched += g.Count
+			res.Groups = append(res.Groups, g)
+		}
+		return res, rows.Err()
+	}
+	// Percentiles: the values come back sorted by group and are ranked here.
+	rows, err := d.db.QueryContext(ctx, `SELECT `+key+`, `+col+from+` ORDER BY 1, 2`, args...)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	var cur string
+	var vs []float64
+	emit := func() {
+		if len(vs) > 0 {
+			res.Groups = append(res.Groups, receipts.QueryGroup{Key: cur, Count: len(vs), Value: receipts.Aggregate(q.Agg, vs)})
+			res.Matched += len(vs)
+		}
+	}
+	for rows.Next() {
+		var k string
+		var v float64
+		if err := rows.Scan(&k, &v); err != nil {
+			return res, err
+		}
+		if k != cur {
+			emit()
+			cur, vs = k, nil
+		}
+		vs = append(vs, v)
+	}
+	emit()
+	return res, rows.Err()
+}
+
+func validField(f string) bool {
+	for _, name := range receipts.QueryFields() {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validGroup(g string) bool {
+	for _, name := range receipts.GroupColumns() {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
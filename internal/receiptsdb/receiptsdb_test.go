@@ -0,0 +1,128 @@
+package receiptsdb
+
+import (
+    "context"
+    "crypto/ed25519"
+    "database/sql"
+    "fmt"
+    "net/url"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+
+    "pathlab/internal/receipts"
+)
+
+func newManager(capacity int) *receipts.Manager {
+    seed := make([]byte, ed25519.SeedSize)
+    for i := range seed { seed[i] = byte(i) }
+    return receipts.NewManager(capacity, ed25519.NewKeyFromSeed(seed), receipts.ManagerOptions{})
+}
+
+func openTemp(t *testing.T, opts Options) (*DB, string) {
+    path := filepath.Join(t.TempDir(), "receipts.sqlite")
+    db, err := Open(path, opts)
+    if err != nil { t.Fatalf("open: %v", err) }
+    return db, path
+}
+
+func TestQueryMatchesRing(t *testing.T) {
+    m := newManager(1000)
+    db, _ := openTemp(t, Options{})
+    defer db.Close()
+    profiles := []string{"CLEAN", "MTU1300_BLACKHOLE", "ABORT_AFTER_CH"}
+    var rs []receipts.Receipt
+    for i := 0; i < 300; i++ {
+        r := m.Add(receipts.Receipt{AppliedProfile: profiles[i%3], PQCHint: i%4 == 0, HandshakeBytes: 300 + i*7%900, HeldMs: int64(i % 50), SNI: fmt.Sprintf("h%d.example", i%5), Outcome: "closed"})
+        rs = append(rs, r)
+    }
+    if err := db.Write(rs...); err != nil { t.Fatalf("write: %v", err) }
+    for _, raw := range []string{
+        "applied_profile=MTU1300_BLACKHOLE&pqc=true&field=handshake_bytes&agg=p95",
+        "field=held_ms&agg=avg&group_by=applied_profile",
+        "agg=count&group_by=sni&pqc=false",
+        "field=handshake_bytes&agg=max&group_by=rule_matched",
+        "field=handshake_bytes&agg=p50&group_by=pqc_hint",
+        "sni=h3.example&field=held_ms&agg=sum",
+        "sni=nobody.example&agg=p99",
+    } {
+        v, _ := url.ParseQuery(raw)
+        q, err := receipts.ParseQuery(v)
+        if err != nil { t.Fatalf("%s: %v", raw, err) }
+        got, err := db.Query(context.Background(), q)
+        if err != nil { t.Fatalf("%s: %v", raw, err) }
+        if want := m.Query(q); !reflect.DeepEqual(got, want) { t.Errorf("%s:\n db   %+v\n ring %+v", raw, got, want) }
+    }
+}
+
+func TestConcurrentWritesDuringChurn(t *testing.T) {
+    const writers, each = 16, 300
+    m := newManager(100) // the ring keeps far fewer than the database
+    db, path := openTemp(t, Options{Queue: writers * each, Batch: 64})
+    db.Start(m)
+    stop := make(chan struct{})
+    queried := make(chan error, 1)
+    go func(){
+        q, _ := receipts.ParseQuery(url.Values{"agg": {"p95"}, "group_by": {"applied_profile"}})
+        for {
+            select {
+            case <-stop: queried <- nil; return
+            default:
+            }
+            if _, err := db.Query(context.Background(), q); err != nil { queried <- err; return }
+        }
+    }()
+    var wg sync.WaitGroup
+    for w := 0; w < writers; w++ {
+        wg.Add(1)
+        go func(w int){
+            defer wg.Done()
+            for i := 0; i < each; i++ {
+                m.Add(receipts.Receipt{ConnID: int64(w*each + i), AppliedProfile: fmt.Sprintf("P%d", w%4), HandshakeBytes: i, Outcome: "closed"})
+            }
+        }(w)
+    }
+    wg.Wait()
+    close(stop)
+    if err := <-queried; err != nil { t.Fatalf("query during churn: %v", err) }
+    if err := db.Close(); err != nil { t.Fatalf("close: %v", err) }
+    if st := db.Stats(); st.Written != writers*each || st.Missed != 0 || st.Failed != 0 { t.Fatalf("stats %+v", st) }
+
+    db, err := Open(path, Options{})
+    if err != nil { t.Fatalf("reopen: %v", err) }
+    defer db.Close()
+    if n, err := db.Count(context.Background()); err != nil || n != writers*each { t.Fatalf("count %d, %v; want %d", n, err, writers*each) }
+    q, _ := receipts.ParseQuery(url.Values{"group_by": {"applied_profile"}})
+    res, err := db.Query(context.Background(), q)
+    if err != nil || res.Matched != writers*each || len(res.Groups) != 4 || res.Groups[0].Count != writers*each/4 { t.Fatalf("after reopen: %+v, %v", res, err) }
+}
+
+func TestMigrateOldSchemaAddsAndFillsColumns(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "old.sqlite")
+    raw, err := sql.Open("sqlite", "file:"+path)
+    if err != nil { t.Fatalf("open: %v", err) }
+    // A version 1 database from before any field columns existed.
+    for _, stmt := range []string{migrations[0], "PRAGMA user_version = 1",
+        `INSERT INTO receipts (id, ts, body) VALUES (1, 0, '{"id":1,"applied_profile":"CLEAN","handshake_bytes":1500,"failure_ramp_pct":40}')`,
+        `INSERT INTO receipt_tags (receipt_id, name, value) VALUES (1, 'applied_profile', 'CLEAN')`,
+    } {
+        if _, err := raw.Exec(stmt); err != nil { t.Fatalf("%s: %v", stmt, err) }
+    }
+    raw.Close()
+
+    db, err := Open(path, Options{})
+    if err != nil { t.Fatalf("migrate: %v", err) }
+    for field, want := range map[string]float64{"handshake_bytes": 1500, "failure_ramp_pct": 40, "held_ms": 0} {
+        q, _ := receipts.ParseQuery(url.Values{"applied_profile": {"CLEAN"}, "field": {field}, "agg": {"max"}})
+        res, err := db.Query(context.Background(), q)
+        if err != nil || res.Matched != 1 || res.Groups[0].Value != want { t.Fatalf("%s: %+v, %v; want %g", field, res, err, want) }
+    }
+    db.Close()
+
+    raw, _ = sql.Open("sqlite", "file:"+path)
+    raw.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion+1))
+    raw.Close()
+    if _, err := Open(path, Options{}); err == nil || !strings.Contains(err.Error(), "newer") { t.Fatalf("newer schema opened: %v", err) }
+}
@@ -0,0 +1,333 @@
+package replicate
+
+// Warm-standby replication of the admin configuration. A Node exports the instance's
+// configuration as a signed manifest; with a peer configured it pushes a fresh manifest
+// to the peer's POST /config/import after every local mutation, retrying with backoff.
+// Imports never trigger a push, and manifests that originated at the receiving node are
+// ignored, so two instances may replicate to each other without ping-pong. Receipts are
+// not replicated.
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"pathlab/internal/impair"
+)
+
+// Snapshot is the replicated configuration: the global impairment, the rule source and
+// the named presets.
+type Snapshot struct {
+	Impair  impair.Config            `json:"impair"`
+	Rules   string                   `json:"rules"`
+	Presets map[string]impair.Config `json:"presets,omitempty"`
+}
+
+// Hash returns the SHA-256 (hex) of the snapshot's canonical JSON. The UpdatedAt of the
+// impairment and of each preset is excluded: each instance stamps its own apply time.
+func (s Snapshot) Hash() string {
+	s.Impair.UpdatedAt = time.Time{}
+	if len(s.Presets) > 0 {
+		presets := make(map[string]impair.Config, len(s.Presets))
+		for name, cfg := range s.Presets {
+			cfg.UpdatedAt = time.Time{}
+			presets[name] = cfg
+		}
+		s.Presets = presets
+	}
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Manifest is a signed Snapshot as exchanged between instances.
+type Manifest struct {
+	Origin string `json:"origin"` // instance id of the node that made the change
+	Seq    uint64 `json:"seq"`    // per-origin sequence number
+	Snapshot
+	Hash   string `json:"hash"`
+	PubKey string `json:"pubkey"`
+	Sig    string `json:"sig"`
+}
+
+// canonical returns the bytes covered by the manifest signature.
+func (m Manifest) canonical() []byte {
+	m.Sig = ""
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// Verify checks the content hash and the Ed25519 signature against the embedded key.
+// This proves the manifest is intact, not who sent it.
+func (m Manifest) Verify() error {
+	if m.Hash != m.Snapshot.Hash() {
+		return errors.New("manifest hash mismatch")
+	}
+	pub, err := hex.DecodeString(m.PubKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("manifest pubkey invalid")
+	}
+	sig, err := hex.DecodeString(m.Sig)
+	if err != nil || !ed25519.Verify(pub, m.canonical(), sig) {
+		return errors.New("manifest signature invalid")
+	}
+	return nil
+}
+
+// Node is one instance's side of replication.
+type Node struct {
+	ID   string
+	priv ed25519.PrivateKey
+	get  func() Snapshot
+	set  func(Snapshot) error
+
+	mu      sync.Mutex
+	seq     uint64
+	lastSeq map[string]uint64 // highest imported seq per origin
+	peer    *pusher
+}
+
+// NewNode returns a Node with a random instance id. get reads the current
+// configuration; set replaces it on import.
+func NewNode(priv ed25519.PrivateKey, get func() Snapshot, set func(Snapshot) error) *Node {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &Node{ID: hex.EncodeToString(id), priv: priv, get: get, set: set, lastSeq: map[string]uint64{}}
+}
+
+// Manifest signs the current configuration.
+func (n *Node) Manifest() Manifest {
+	n.mu.Lock()
+	seq := n.seq
+	n.mu.Unlock()
+	snap := n.get()
+	m := Manifest{Origin: n.ID, Seq: seq, Snapshot: snap, Hash: snap.Hash(), PubKey: hex.EncodeToString(n.priv.Public().(ed25519.PublicKey))}
+	m.Sig = hex.EncodeToString(ed25519.Sign(n.priv, m.canonical()))
+	return m
+}
+
+// Import applies a peer's manifest. It reports false without error when the manifest
+// is our own, stale, or already matches the local configuration.
+func (n *Node) Import(m Manifest) (bool, error) {
+	if err := m.Verify(); err != nil {
+		return false, err
+	}
+	if m.Origin == n.ID {
+		return false, nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if m.Seq <= n.lastSeq[m.Origin] && n.lastSeq[m.Origin] > 0 {
+		return false, nil
+	}
+	n.lastSeq[m.Origin] = m.Seq
+	if n.get().Hash() == m.Hash {
+		return false, nil
+	}
+	return true, n.set(m.Snapshot)
+}
+
+// Changed records a local mutation and, when replicating, schedules a push.
+func (n *Node) Changed() {
+	n.mu.Lock()
+	n.seq++
+	p := n.peer
+	n.mu.Unlock()
+	if p != nil {
+		p.kick()
+	}
+}
+
+// ReplicateTo starts pushing manifests to the peer base URL (e.g. http://peer:8080)
+// until ctx is done.
+func (n *Node) ReplicateTo(ctx context.Context, peer string, client *http.Client) {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	p := &pusher{url: strings.TrimRight(peer, "/"), client: client, wake: make(chan struct{}, 1)}
+	n.mu.Lock()
+	n.peer = p
+	n.mu.Unlock()
+	go p.run(ctx, n)
+}
+
+// Backoff bounds for failed pushes.
+var (
+	minBackoff = 200 * time.Millisecond
+	maxBackoff = 15 * time.Second
+)
+
+// pusher delivers the latest manifest to one peer. Mutations that arrive while a push
+// is failing coalesce: only the newest configuration is ever retried.
+type pusher struct {
+	url    string
+	client *http.Client
+	wake   chan struct{}
+
+	mu       sync.Mutex
+	pending  bool
+	pushes   int
+	failures int
+	lastPush time.Time
+	lastErr  string
+}
+
+func (p *pusher) kick() {
+	p.mu.Lock()
+	p.pending = true
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pusher) run(ctx context.Context, n *Node) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		}
+		backoff := minBackoff
+		for {
+			err := p.push(ctx, n.Manifest())
+			p.mu.Lock()
+			if err == nil {
+				p.pushes++
+				p.lastPush = time.Now().UTC()
+				p.lastErr = ""
+			} else {
+				p.failures++
+				p.lastErr = err.Error()
+			}
+			p.mu.Unlock()
+			if err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake: // newer mutation: retry right away with the new manifest
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+		}
+		p.mu.Lock()
+		// a mutation that landed during the successful push is picked up via wake
+		p.pending = len(p.wake) > 0
+		p.mu.Unlock()
+	}
+}
+
+func (p *pusher) push(ctx context.Context, m Manifest) error {
+	body, _ := json.Marshal(m)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/config/import", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer import: %s", resp.Status)
+	}
+	return nil
+}
+
+// Status is the GET /replication/status view.
+type Status struct {
+	NodeID    string     `json:"node_id"`
+	Peer      string     `json:"peer,omitempty"`
+	LocalHash string     `json:"local_hash"`
+	PeerHash  string     `json:"peer_hash,omitempty"`
+	InSync    bool       `json:"in_sync"`
+	Pending   bool       `json:"pending"`
+	Pushes    int        `json:"pushes"`
+	Failures  int        `json:"failures"`
+	LastPush  *time.Time `json:"last_push,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	PeerError string     `json:"peer_error,omitempty"`
+}
+
+// Status compares the local manifest hash with the peer's current export.
+func (n *Node) Status(ctx context.Context) Status {
+	st := Status{NodeID: n.ID, LocalHash: n.get().Hash()}
+	n.mu.Lock()
+	p := n.peer
+	n.mu.Unlock()
+	if p == nil {
+		st.InSync = true
+		return st
+	}
+	p.mu.Lock()
+	st.Peer, st.Pending, st.Pushes, st.Failures, st.LastError = p.url, p.pending, p.pushes, p.failures, p.lastErr
+	if !p.lastPush.IsZero() {
+		last := p.lastPush
+		st.LastPush = &last
+	}
+	p.mu.Unlock()
+	m, err := p.fetch(ctx)
+	if err != nil {
+		st.PeerError = err.Error()
+		return st
+	}
+	st.PeerHash = m.Hash
+	st.InSync = m.Hash == st.LocalHash
+	return st
+}
+
+func (p *pusher) fetch(ctx context.Context) (Manifest, error) {
+	var m Manifest
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"/config/export", nil)
+	if err != nil {
+		return m, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("peer export: %s", resp.Status)
+	}
+	return m, json.NewDecoder(resp.Body).Decode(&m)
+}
+
+// Register mounts GET /config/export, POST /config/import and GET /replication/status.
+func (n *Node) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /config/export", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(n.Manifest())
+	})
+	mux.HandleFunc("POST /config/import", func(w http.ResponseWriter, r *http.Request) {
+		var m Manifest
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "bad manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		applied, err := n.Import(m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"applied": applied, "hash": m.Hash})
+	})
+	mux.HandleFunc("GET /replication/status", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		json.NewEncoder(w).Encode(n.Status(ctx))
+	})
+}
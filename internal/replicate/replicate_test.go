@@ -0,0 +1,172 @@
+package replicate
+
+import (
+    "context"
+    "crypto/ed25519"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+// instance is an in-process PathLab admin surface reduced to what replication touches.
+type instance struct {
+    mu      sync.Mutex
+    rules   string
+    state   impair.State
+    imports atomic.Int64
+    down    atomic.Bool // simulated network flap: every request fails
+    node    *Node
+    srv     *httptest.Server
+}
+
+func newInstance(t *testing.T, seed byte) *instance {
+    s := make([]byte, ed25519.SeedSize)
+    s[0] = seed
+    in := &instance{}
+    in.state.Apply(impair.Config{Profile: impair.ProfileClean})
+    in.node = NewNode(ed25519.NewKeyFromSeed(s),
+        func() Snapshot { in.mu.Lock(); defer in.mu.Unlock(); return Snapshot{Impair: in.state.Get(), Rules: in.rules} },
+        func(sn Snapshot) error { in.mu.Lock(); in.rules = sn.Rules; in.state.Apply(sn.Impair); in.mu.Unlock(); in.imports.Add(1); return nil })
+    // as in main: a scheduled revert is a change no admin handler reports
+    in.state.OnRevert(func(impair.Config) { in.node.Changed() })
+    mux := http.NewServeMux()
+    in.node.Register(mux)
+    in.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if in.down.Load() { http.Error(w, "flap", http.StatusServiceUnavailable); return }
+        mux.ServeHTTP(w, r)
+    }))
+    t.Cleanup(in.srv.Close)
+    return in
+}
+
+// mutate is what an admin handler does: change local config, then tell the node.
+func (in *instance) mutate(profile impair.ProfileName, rules string) {
+    in.apply(impair.Config{Profile: profile}, rules)
+}
+
+func (in *instance) apply(cfg impair.Config, rules string) {
+    in.mu.Lock()
+    in.rules = rules
+    in.state.Apply(cfg)
+    in.mu.Unlock()
+    in.node.Changed()
+}
+
+func (in *instance) hash() string { return in.node.get().Hash() }
+
+func fastBackoff(t *testing.T) {
+    oldMin, oldMax := minBackoff, maxBackoff
+    minBackoff, maxBackoff = 10*time.Millisecond, 50*time.Millisecond
+    t.Cleanup(func(){ minBackoff, maxBackoff = oldMin, oldMax })
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+    deadline := time.Now().Add(3 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) { t.Fatalf("timed out waiting for %s", what) }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestManifestVerify(t *testing.T) {
+    in := newInstance(t, 1)
+    in.mutate(impair.ProfileMTUBlackhole, "when pqc_hint == true then MTU1300_BLACKHOLE\n")
+    m := in.node.Manifest()
+    if err := m.Verify(); err != nil { t.Fatalf("fresh manifest: %v", err) }
+    m.Rules = "when ch_bytes > 1 then ABORT_AFTER_CH\n"
+    if err := m.Verify(); err == nil { t.Fatalf("tampered manifest verified") }
+    // UpdatedAt is per instance and must not affect the hash
+    a := Snapshot{Impair: impair.Config{Profile: impair.ProfileClean, UpdatedAt: time.Now()}}
+    b := Snapshot{Impair: impair.Config{Profile: impair.ProfileClean}}
+    if a.Hash() != b.Hash() { t.Fatalf("hash depends on UpdatedAt") }
+}
+
+func TestHashCoversPresets(t *testing.T) {
+    base := Snapshot{Impair: impair.Config{Profile: impair.ProfileClean}}
+    slow := impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 50}
+    added := base
+    added.Presets = map[string]impair.Config{"slow": slow}
+    changed := base
+    changed.Presets = map[string]impair.Config{"slow": {Profile: impair.ProfileLatencyJitter, LatencyMs: 80}}
+    renamed := base
+    renamed.Presets = map[string]impair.Config{"slower": slow}
+    seen := map[string]string{}
+    for name, s := range map[string]Snapshot{"none": base, "added": added, "changed": changed, "renamed": renamed} {
+        h := s.Hash()
+        if other, ok := seen[h]; ok { t.Fatalf("%s and %s hash the same", name, other) }
+        seen[h] = name
+    }
+    // removing the last preset is the same configuration as never having one
+    removed := added
+    removed.Presets = map[string]impair.Config{}
+    if removed.Hash() != base.Hash() { t.Fatalf("empty preset set changes the hash") }
+    stamped := added
+    stamped.Presets = map[string]impair.Config{"slow": {Profile: impair.ProfileLatencyJitter, LatencyMs: 50, UpdatedAt: time.Now()}}
+    if stamped.Hash() != added.Hash() { t.Fatalf("hash depends on a preset's UpdatedAt") }
+}
+
+func TestConvergesAfterFlap(t *testing.T) {
+    fastBackoff(t)
+    ctx, cancel := context.WithCancel(context.Background()); defer cancel()
+    primary, standby := newInstance(t, 1), newInstance(t, 2)
+    primary.node.ReplicateTo(ctx, standby.srv.URL, nil)
+
+    primary.mutate(impair.ProfileLatencyJitter, "")
+    waitFor(t, "first push", func() bool { return standby.hash() == primary.hash() })
+
+    standby.down.Store(true)
+    primary.mutate(impair.ProfileMTUBlackhole, "when pqc_hint == true then MTU1300_BLACKHOLE\n")
+    primary.mutate(impair.ProfileAbortAfterCH, "when ch_bytes > 1500 then ABORT_AFTER_CH\n")
+    waitFor(t, "failed pushes", func() bool { return primary.node.Status(ctx).Failures >= 2 })
+    if st := primary.node.Status(ctx); st.InSync || !st.Pending || st.PeerError == "" { t.Fatalf("divergence not reported during flap: %+v", st) }
+
+    standby.down.Store(false)
+    waitFor(t, "convergence", func() bool { return standby.hash() == primary.hash() })
+    if st := primary.node.Status(ctx); !st.InSync || st.PeerHash != st.LocalHash { t.Fatalf("status after recovery: %+v", st) }
+    if got := standby.node.get(); got.Impair.Profile != impair.ProfileAbortAfterCH { t.Fatalf("standby has %s, want the latest config", got.Impair.Profile) }
+
+    // a timed apply running out is a change too: the primary pushes the revert
+    rules := primary.node.get().Rules
+    primary.apply(impair.Config{Profile: impair.ProfileStall, DurationSeconds: 0.2}, rules)
+    waitFor(t, "timed apply", func() bool { return standby.node.get().Impair.Profile == impair.ProfileStall })
+    pushes := primary.node.Status(ctx).Pushes
+    waitFor(t, "revert", func() bool { return primary.node.get().Impair.Profile == impair.ProfileAbortAfterCH })
+    waitFor(t, "revert pushed", func() bool { return primary.node.Status(ctx).Pushes > pushes })
+    waitFor(t, "convergence after the revert", func() bool { return standby.hash() == primary.hash() })
+    if st := primary.node.Status(ctx); !st.InSync || st.Pending { t.Fatalf("status after the revert: %+v", st) }
+}
+
+func TestMutualReplicationDoesNotLoop(t *testing.T) {
+    fastBackoff(t)
+    ctx, cancel := context.WithCancel(context.Background()); defer cancel()
+    a, b := newInstance(t, 1), newInstance(t, 2)
+    a.node.ReplicateTo(ctx, b.srv.URL, nil)
+    b.node.ReplicateTo(ctx, a.srv.URL, nil)
+
+    a.mutate(impair.ProfileLoss, "")
+    waitFor(t, "a -> b", func() bool { return b.hash() == a.hash() })
+    b.mutate(impair.ProfileReorder, "when sni_contains x then REORDER\n")
+    waitFor(t, "b -> a", func() bool { return a.hash() == b.hash() })
+
+    time.Sleep(100 * time.Millisecond)
+    ia, ib := a.imports.Load(), b.imports.Load()
+    time.Sleep(200 * time.Millisecond)
+    if a.imports.Load() != ia || b.imports.Load() != ib || ia != 1 || ib != 1 {
+        t.Fatalf("imports kept happening (a=%d b=%d), replication is looping", a.imports.Load(), b.imports.Load())
+    }
+}
+
+func TestImportIgnoresOwnAndStaleManifests(t *testing.T) {
+    a, b := newInstance(t, 1), newInstance(t, 2)
+    a.mutate(impair.ProfileLoss, "")
+    if applied, err := a.node.Import(a.node.Manifest()); err != nil || applied { t.Fatalf("own manifest applied=%v err=%v", applied, err) }
+    old := a.node.Manifest()
+    a.mutate(impair.ProfileReorder, "")
+    if applied, _ := b.node.Import(a.node.Manifest()); !applied { t.Fatalf("newer manifest not applied") }
+    if applied, _ := b.node.Import(old); applied { t.Fatalf("stale manifest applied over a newer one") }
+}
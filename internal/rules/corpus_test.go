@@ -0,0 +1,74 @@
+package rules
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/tlsinspect"
+)
+
+// corpusDir is the ClientHello corpus shared with the tlsinspect golden tests.
+const corpusDir = "../tlsinspect/testdata/clienthellos"
+
+// corpusRules is a representative rule set evaluated in order against every fixture.
+const corpusRules = `when pqc_hint == true then ABORT_AFTER_CH
+when sni_contains mozilla then LATENCY_50MS_JITTER_10
+when cipher_count > 20 then MTU1300_BLACKHOLE
+when alpn_contains h2 then BANDWIDTH_1MBPS
+when ch_bytes > 1400 then CLEAN
+`
+
+// corpusExpect maps each fixture to the profile corpusRules should select.
+var corpusExpect = map[string]impair.ProfileName{
+    "chrome":   impair.ProfileAbortAfterCH,
+    "go-mlkem": impair.ProfileAbortAfterCH,
+    "firefox":  impair.ProfileLatencyJitter,
+    "safari":   impair.ProfileMTUBlackhole,
+    "openssl":  impair.ProfileMTUBlackhole,
+    "go":       impair.ProfileBandwidthLimit,
+}
+
+func loadCorpus(t *testing.T) map[string]tlsinspect.Result {
+    t.Helper()
+    paths, err := filepath.Glob(filepath.Join(corpusDir, "*.bin"))
+    if err != nil { t.Fatalf("glob: %v", err) }
+    if len(paths) == 0 { t.Fatalf("no fixtures found in %s", corpusDir) }
+    out := make(map[string]tlsinspect.Result, len(paths))
+    for _, p := range paths {
+        data, err := os.ReadFile(p)
+        if err != nil { t.Fatalf("read %s: %v", p, err) }
+        _, res, err := tlsinspect.ParseClientHello(bytes.NewReader(data))
+        if err != nil { t.Fatalf("parse %s: %v", p, err) }
+        out[strings.TrimSuffix(filepath.Base(p), ".bin")] = res
+    }
+    return out
+}
+
+func TestCorpusRepresentativeRules(t *testing.T) {
+    set, err := Parse(strings.NewReader(corpusRules))
+    if err != nil { t.Fatalf("parse: %v", err) }
+    for name, res := range loadCorpus(t) {
+        want, ok := corpusExpect[name]
+        if !ok { t.Errorf("fixture %s has no expectation in corpusExpect", name); continue }
+        got, matched := set.Match(res)
+        if !matched || got != want { t.Errorf("%s: got %q (matched=%v), want %q", name, got, matched, want) }
+    }
+}
+
+func TestCorpusJA3RuleIsExact(t *testing.T) {
+    corpus := loadCorpus(t)
+    for name, res := range corpus {
+        if res.JA3 == "" { t.Errorf("%s: empty JA3", name); continue }
+        set, err := Parse(strings.NewReader(fmt.Sprintf("when ja3 == %s then ABORT_AFTER_CH", res.JA3)))
+        if err != nil { t.Fatalf("parse: %v", err) }
+        for other, ores := range corpus {
+            _, matched := set.Match(ores)
+            if matched != (other == name) { t.Errorf("ja3 rule for %s: match on %s = %v", name, other, matched) }
+        }
+    }
+}
@@ -0,0 +1,56 @@
+package rules
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+    "time"
+)
+
+// RuleJSON is a rule in GET /rules?format=json, also accepted by ParseJSON.
+type RuleJSON struct {
+    ID          string    `json:"id"`
+    Raw         string    `json:"raw"`
+    Profile     string    `json:"profile"` // the action: a profile name or preset:<name>
+    Description string    `json:"description"`
+    CreatedAt   time.Time `json:"created_at"`
+}
+
+// JSON returns the set's rules in evaluation order with their metadata.
+func (s Set) JSON() []RuleJSON {
+    out := make([]RuleJSON, 0, len(s.Rules))
+    for _, r := range s.Rules {
+        out = append(out, RuleJSON{ID: r.ID, Raw: r.Raw, Profile: r.Action(), Description: r.Description, CreatedAt: r.CreatedAt})
+    }
+    return out
+}
+
+// ParseJSON parses a JSON array of rules, each {"rule": "when ... then ...",
+// "description": "..."}. The output of Set.JSON is accepted too: "raw" stands for
+// "rule", a non-zero "created_at" is kept, and "id" and "profile" are ignored (both
+// come from the rule text). Errors name the rule by its position, from 1.
+func ParseJSON(r io.Reader) (Set, error) {
+    var in []struct {
+        Rule        string    `json:"rule"`
+        Raw         string    `json:"raw"`
+        Description string    `json:"description"`
+        CreatedAt   time.Time `json:"created_at"`
+        ID          string    `json:"id"`
+        Profile     string    `json:"profile"`
+    }
+    dec := json.NewDecoder(r)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&in); err != nil { return Set{}, fmt.Errorf("bad JSON rule set: %w", err) }
+    var b setBuilder
+    for i, e := range in {
+        text := strings.TrimSpace(e.Rule)
+        if text == "" { text = strings.TrimSpace(e.Raw) }
+        if text == "" { return Set{}, fmt.Errorf("rule %d: missing rule text", i+1) }
+        if e.Rule != "" && e.Raw != "" && strings.TrimSpace(e.Raw) != text { return Set{}, fmt.Errorf("rule %d: rule and raw differ", i+1) }
+        rw, err := b.add(text, i+1)
+        if err != nil { return Set{}, fmt.Errorf("rule %d: %w", i+1, err) }
+        rw.Description, rw.CreatedAt = e.Description, e.CreatedAt
+    }
+    return b.set(), nil
+}
@@ -0,0 +1,54 @@
+package rules
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+    in := `[
+        {"rule": "id:pqc-canary when pqc_hint == true then ABORT_AFTER_CH", "description": "canary for PQC key shares"},
+        {"rule": "when ch_bytes > 1400 then preset:slow-eu", "description": ""},
+        {"rule": "when sni_contains api.example then CLEAN priority -1", "description": "never touch the API"}
+    ]`
+    set, err := ParseJSON(strings.NewReader(in))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    var st Store
+    st.Replace(set)
+    out := st.Load().JSON()
+    if len(out) != 3 { t.Fatalf("%d rules", len(out)) }
+    // priority -1 goes first
+    if out[0].Raw != "when sni_contains api.example then CLEAN priority -1" || out[0].Profile != "CLEAN" || out[0].Description != "never touch the API" { t.Fatalf("first: %+v", out[0]) }
+    if out[1].ID != "pqc-canary" || out[1].Profile != "ABORT_AFTER_CH" || out[1].Description != "canary for PQC key shares" { t.Fatalf("second: %+v", out[1]) }
+    if out[2].Profile != "preset:slow-eu" || out[2].CreatedAt.IsZero() { t.Fatalf("third: %+v", out[2]) }
+
+    // the exported JSON loads back to the same JSON, created_at included
+    b, _ := json.Marshal(out)
+    again, err := ParseJSON(strings.NewReader(string(b)))
+    if err != nil { t.Fatalf("reparse: %v", err) }
+    b2, _ := json.Marshal(again.JSON())
+    if string(b) != string(b2) { t.Fatalf("round trip:\n%s\n%s", b, b2) }
+
+    // a text reload keeps created_at of unchanged rules
+    created := out[1].CreatedAt
+    time.Sleep(time.Millisecond)
+    text, _ := Parse(strings.NewReader("id:pqc-canary when pqc_hint == true then ABORT_AFTER_CH\nwhen ch_bytes > 10 then CLEAN"))
+    st.Replace(text)
+    now := st.Load().JSON()
+    if !now[0].CreatedAt.Equal(created) || !now[1].CreatedAt.After(created) { t.Fatalf("created_at: %v, new %v (was %v)", now[0].CreatedAt, now[1].CreatedAt, created) }
+}
+
+func TestParseJSONErrors(t *testing.T) {
+    for _, c := range []struct{ in, want string }{
+        {`{"rule": "when ch_bytes > 1 then CLEAN"}`, "bad JSON rule set"},
+        {`[{"rule": "when ch_bytes > 1 then CLEAN", "descripton": "typo"}]`, "unknown field"},
+        {`[{"rule": "when ch_bytes > 1 then CLEAN"}, {"description": "no rule"}]`, "rule 2: missing rule text"},
+        {`[{"rule": "when ch_bytes > 1 then CLEAN"}, {"rule": "when ch_bytes > 1 then CLAEN"}]`, `rule 2: unknown profile "CLAEN"`},
+        {`[{"rule": "when ch_bytes > 1 then CLEAN", "raw": "when ch_bytes > 2 then CLEAN"}]`, "rule 1: rule and raw differ"},
+        {`[{"rule": "id:a when ch_bytes > 1 then CLEAN"}, {"rule": "id:a when ch_bytes > 2 then CLEAN"}]`, `rule 2: duplicate rule id "a"`},
+    } {
+        if _, err := ParseJSON(strings.NewReader(c.in)); err == nil || !strings.Contains(err.Error(), c.want) { t.Errorf("%s: got %v, want %q", c.in, err, c.want) }
+    }
+}
@@ -0,0 +1,114 @@
+package rules
+
+import (
+    "fmt"
+    "math"
+    "strings"
+)
+
+// Warning is a problem Lint found in a set that parses: the rule is valid but will
+// not behave as written.
+type Warning struct {
+    Line    int    `json:"line"` // in the text given to Parse
+    ID      string `json:"id"`
+    Rule    string `json:"rule"`
+    Message string `json:"message"`
+}
+
+// term is one comparison of a rule's condition as written: "not sni_contains x" is
+// {sni_contains, contains, x, true}, "ja3 != x" is {ja3, ==, x, true}.
+type term struct {
+    field, op, val string
+    neg            bool
+}
+
+func newTerm(fields []string, negate bool) term {
+    t := term{field: fields[0], op: "contains", val: fields[len(fields)-1], neg: negate}
+    if len(fields) == 3 { t.op = fields[1] }
+    if t.op == "!=" { t.op, t.neg = "==", !t.neg }
+    return t
+}
+
+// numericFields are the fields compared as integers, whose ranges Lint can compare.
+var numericFields = map[string]bool{"ch_bytes": true, "cipher_count": true, "tls_max_version": true, "alpn_count": true, "grease_count": true, "sni_conn_rate": true}
+
+// Lint reports rules that can never apply because an earlier rule always takes every
+// connection they match (a rule without a time window or sample rate whose condition
+// is implied by theirs, e.g. ch_bytes > 100 before ch_bytes > 1400), and, with
+// presets, preset actions naming a preset that does not exist. The check is
+// structural: it compares conditions as written and misses shadowing that depends
+// on how fields relate to each other.
+func Lint(set Set, presets PresetLookup) []Warning {
+    var out []Warning
+    warn := func(r Rule, format string, args ...any) {
+        out = append(out, Warning{Line: r.line, ID: r.ID, Rule: r.Raw, Message: fmt.Sprintf(format, args...)})
+    }
+    for j, r := range set.Rules {
+        for _, prev := range set.Rules[:j] {
+            if prev.Window != nil || prev.Sample > 0 || !implies(r.terms, prev.terms) { continue }
+            warn(r, "unreachable: every connection it matches is taken first by line %d (%s)", prev.line, prev.Raw)
+            break
+        }
+        if r.Preset != "" && presets != nil {
+            if _, ok := presets(r.Preset); !ok { warn(r, "preset %q does not exist", r.Preset) }
+        }
+    }
+    return out
+}
+
+// implies reports whether a condition matching b always matches a as well: every
+// conjunction of b implies some conjunction of a.
+func implies(b, a [][]term) bool {
+    if len(b) == 0 || len(a) == 0 { return false }
+    for _, cb := range b {
+        ok := false
+        for _, ca := range a {
+            if conjImplies(cb, ca) { ok = true; break }
+        }
+        if !ok { return false }
+    }
+    return true
+}
+
+// conjImplies reports whether the conjunction b implies every term of a.
+func conjImplies(b, a []term) bool {
+    for _, t := range a {
+        ok := false
+        for _, s := range b {
+            if termImplies(s, t) { ok = true; break }
+        }
+        if !ok { return false }
+    }
+    return true
+}
+
+// termImplies reports whether s being true means t is: the same comparison, a
+// narrower numeric range, or a longer sni_contains substring.
+func termImplies(s, t term) bool {
+    if s.field != t.field || s.neg != t.neg { return false }
+    if s == t { return true }
+    if s.neg { return false }
+    switch {
+    case numericFields[s.field]:
+        slo, shi, ok1 := interval(s)
+        tlo, thi, ok2 := interval(t)
+        return ok1 && ok2 && slo >= tlo && shi <= thi
+    case s.field == "sni_contains":
+        return strings.Contains(s.val, t.val)
+    }
+    return false
+}
+
+// interval returns the integer range a numeric comparison accepts.
+func interval(t term) (lo, hi int, ok bool) {
+    n, err := parseInt(t.val)
+    if err != nil { return 0, 0, false }
+    switch t.op {
+    case ">": return n + 1, math.MaxInt, n < math.MaxInt
+    case ">=": return n, math.MaxInt, true
+    case "<": return math.MinInt, n - 1, n > math.MinInt
+    case "<=": return math.MinInt, n, true
+    case "==": return n, n, true
+    }
+    return 0, 0, false
+}
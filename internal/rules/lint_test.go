@@ -0,0 +1,51 @@
+package rules
+
+import (
+    "strings"
+    "testing"
+
+    "pathlab/internal/impair"
+)
+
+func TestParseRejectsUnknownProfile(t *testing.T) {
+    _, err := Parse(strings.NewReader("when ch_bytes > 1 then CLEAN\n\nwhen pqc_hint == true then ABORT_AFTR_CH"))
+    if err == nil || err.Error() != `line 3: unknown profile "ABORT_AFTR_CH"` { t.Fatalf("got %v", err) }
+    if _, err := Parse(strings.NewReader("when ch_bytes > 1 then preset:not-stored-yet")); err != nil { t.Fatalf("preset names are checked by Lint, not Parse: %v", err) }
+}
+
+func TestLintShadowed(t *testing.T) {
+    set, err := Parse(strings.NewReader(strings.Join([]string{
+        "when ch_bytes > 100 then CLEAN",
+        "when ch_bytes > 1400 then MTU1300_BLACKHOLE",                         // 2: inside ch_bytes > 100
+        "when sni_contains example.com then ABORT_AFTER_CH between 01:00-02:00",
+        "when sni_contains api.example.com then BANDWIDTH_1MBPS",                // 4: only shadowed during 01:00-02:00
+        "when sni_contains example.com then LATENCY_50MS_JITTER_10 sample 50%",
+        "when sni_contains www.example.com and pqc_hint == true then CLEAN",     // 6: the bare sni rule is sampled
+        "when ja3 != 8e19337e7524d2573be54efb2b0784c9 then CLEAN",
+        "when not ja3 == 8e19337e7524d2573be54efb2b0784c9 and alpn_count >= 2 then CLEAN", // 8: same negation
+        "when cipher_count == 5 or cipher_count >= 10 then CLEAN",
+        "when cipher_count >= 12 or cipher_count == 5 then CLEAN",                 // 10: every branch covered
+        "when cipher_count >= 8 then CLEAN",                                       // 11: 8 and 9 get through
+        "when ch_bytes <= 50 then CLEAN",
+        "when tls_max_version < 0x0303 then preset:legacy",
+        "when tls_max_version < 0x0303 then preset:gone priority 5",               // 14: shadowed, and missing
+    }, "\n")))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    presets := func(name string) (impair.Config, bool) { return impair.Config{}, name == "legacy" }
+    var got []string
+    for _, w := range Lint(set, presets) {
+        got = append(got, w.Rule[:strings.Index(w.Rule, " then")]+": "+w.Message)
+        if w.ID == "" || w.Line == 0 { t.Errorf("warning without line or id: %+v", w) }
+    }
+    want := []string{
+        "when ch_bytes > 1400: unreachable: every connection it matches is taken first by line 1 (when ch_bytes > 100 then CLEAN)",
+        "when not ja3 == 8e19337e7524d2573be54efb2b0784c9 and alpn_count >= 2: unreachable: every connection it matches is taken first by line 7 (when ja3 != 8e19337e7524d2573be54efb2b0784c9 then CLEAN)",
+        "when cipher_count >= 12 or cipher_count == 5: unreachable: every connection it matches is taken first by line 9 (when cipher_count == 5 or cipher_count >= 10 then CLEAN)",
+        "when tls_max_version < 0x0303: unreachable: every connection it matches is taken first by line 13 (when tls_max_version < 0x0303 then preset:legacy)",
+        `when tls_max_version < 0x0303: preset "gone" does not exist`,
+    }
+    if strings.Join(got, "\n") != strings.Join(want, "\n") { t.Fatalf("warnings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n")) }
+    if w := Lint(set, presets)[1]; w.Line != 8 { t.Fatalf("line %d, want 8", w.Line) }
+    // without a preset lookup missing presets are not reported
+    if n := len(Lint(set, nil)); n != 4 { t.Fatalf("%d warnings without presets", n) }
+}
@@ -4,143 +4,645 @@ package rules
 // Syntax (one rule per line):
 //   when ch_bytes > 1400 then MTU1300_BLACKHOLE
 //   when pqc_hint == true then ABORT_AFTER_CH
-//   when pqc_group == 0x11ec then ABORT_AFTER_CH (future use; currently pqc_hint only)
-// Comparators: >, >=, <, <=, ==
+//   when pqc_group == 0x11ec then ABORT_AFTER_CH
+//   when ch_bytes > 1400 and pqc_hint == true then MTU1300_BLACKHOLE
+//   when not sni_contains internal.corp then LATENCY_50MS_JITTER_10
+// Comparators: >, >=, <, <=, ==, != (wherever == is supported)
+// Conditions combine with "and" and "or"; "and" binds tighter, no parentheses.
+// "not" before a comparison negates it.
 // Values: integers (decimal or 0xHEX) or 'true'/'false' for boolean fields.
 // Supported fields: 
 //   ch_bytes       (numeric comparisons)
 //   pqc_hint       (boolean equality)
+//   pqc_group      (equality; a key share for that group was offered)
+//   ech_present    (boolean equality; the SNI is only ECH's outer name when true)
+//   offers_psk     (boolean equality; the client tries to resume with a PSK or session ticket)
+//   early_data     (boolean equality; the client sends 0-RTT data)
 //   cipher_count   (numeric comparisons)
+//   tls_max_version (numeric comparisons; highest version offered, e.g. 0x0304 = TLS 1.3)
 //   sni_contains   (substring match; syntax: when sni_contains example.com then PROFILE)
+//   sni == <host>  (exact match, case-insensitive, trailing dot ignored)
+//   sni_matches    (one-label wildcard; syntax: when sni_matches *.example.com then PROFILE)
 //   alpn_contains  (exact protocol token match; syntax: when alpn_contains h2 then PROFILE)
+//   alpn_first     (equality with the client's top preference; when alpn_first == h2 then PROFILE)
+//   alpn_count     (numeric comparisons)
 //   ja3 == <md5hex> (full 32-char lowercase hex match)
-// Action: impairment profile name.
+//   ja3_normalized == <md5hex> (same, against the JA3 with extensions sorted)
+//   grease_count   (numeric comparisons; 0 for clients that send no GREASE values)
+//   has_extension  (extension type offered; syntax: when has_extension 0x0015 then PROFILE)
+//   sig_algs_contains (signature algorithm offered; syntax: when sig_algs_contains 0x0401 then PROFILE)
+//   compress_cert  (boolean equality; the client offers certificate compression)
+//   sni_conn_rate  (numeric comparisons; connections for the SNI in the last 60s, this one included)
+//   src_ip_in      (client address in a prefix list; syntax: when src_ip_in 10.1.2.0/24,2001:db8::/32 then PROFILE)
+// A rule may start with "id:<name>" to name it in /rules/stats; without one its ID
+// is a hash of the line.
+// A rule may end with "between HH:MM-HH:MM" (UTC) to match only during that daily
+// window; 23:00-01:00 crosses midnight.
+// A rule may end with "priority N": Parse sorts the set by priority, lowest first,
+// keeping line order among equal priorities. Rules without one have priority 0.
+// A rule may end with "sample N%": a match only applies the rule that fraction of the
+// time; otherwise evaluation goes on with the next rules. The suffixes "between",
+// "priority" and "sample" can be given in any order.
+// Action: impairment profile name (unknown names fail to parse), or preset:<name> for
+// a stored preset (PUT /impair/presets/{name}), optionally followed by modifiers:
+//   also_hold=5s   keep the upstream socket open for the duration after the client closes,
+//                  so a retrying client overlaps with the original connection upstream
+//   <field>=<value> any impair.Config field by its JSON name (latency_ms=200,
+//                  threshold_bytes=1200), set over the base config or preset
 
 import (
     "bufio"
+    "bytes"
+    "cmp"
+    "crypto/sha256"
     "encoding/hex"
+    "encoding/json"
     "fmt"
     "io"
+    "math/rand"
+    "net"
+    "net/netip"
+    "slices"
     "strconv"
     "strings"
+    "time"
 
     "pathlab/internal/impair"
     "pathlab/internal/tlsinspect"
 )
 
 type Rule struct {
+    ID        string // from an "id:<name>" prefix, else derived from Raw
     Raw       string
-    Predicate func(res tlsinspect.Result) bool
-    Profile   impair.ProfileName
+    Predicate Cond
+    Profile   impair.ProfileName // empty when the action is a preset
+    Preset    string             // preset name from "then preset:<name>"
+    AlsoHold  time.Duration // also_hold modifier; zero when absent
+    Overlay   impair.Config // inline parameters (latency_ms=200 ...); only the fields in params are applied
+    params    []byte        // the inline parameters as a JSON object, nil when there are none
+    Counter   *Counter      // live match counter, shared by copies and carried across reloads
+    Window    *Window       // "between HH:MM-HH:MM" suffix: the rule only matches then; nil = always
+    Priority  int           // "priority N" suffix; lower is evaluated first
+    Sample    float64       // "sample N%" suffix as a fraction in (0, 1]; 0 = every match applies
+    line      int           // line number in the parsed text, for Lint
+    terms     [][]term      // the condition as written, or-ed conjunctions, for Lint
+    Description string      // free text from a JSON rule set, echoed on receipts
+    CreatedAt time.Time     // when the rule was first loaded; kept across reloads like Counter
+}
+
+// Action returns the rule's action as written: the profile name or preset:<name>.
+func (r Rule) Action() string {
+    if r.Preset != "" { return presetPrefix + r.Preset }
+    return string(r.Profile)
+}
+
+// PresetLookup resolves a preset name to its stored config.
+type PresetLookup func(name string) (impair.Config, bool)
+
+// Config returns the config a matched rule runs a connection with: base with the
+// rule's profile, or the rule's preset as stored, with the rule's inline parameters
+// set over it. If the preset no longer exists ok is false and base is returned
+// unchanged. A FAILURE_RAMP rule ramps on its own parameters alone, from when the
+// rule was loaded, not on whatever ramp the global profile carries.
+func (r Rule) Config(base impair.Config, presets PresetLookup) (cfg impair.Config, ok bool) {
+    if r.Preset == "" {
+        base.Profile = r.Profile
+        if r.Profile == impair.ProfileFailureRamp {
+            base.MaxPct, base.RampMinutes, base.RampShape = 0, 0, ""
+            if !r.CreatedAt.IsZero() { base.UpdatedAt = r.CreatedAt }
+        }
+        return r.overlay(base), true
+    }
+    if presets != nil {
+        if cfg, ok := presets(r.Preset); ok { return r.overlay(cfg), true }
+    }
+    return base, false
+}
+
+// overlay sets the rule's inline parameters on cfg, leaving its other fields alone.
+func (r Rule) overlay(cfg impair.Config) impair.Config {
+    if r.params != nil { _ = json.Unmarshal(r.params, &cfg) } // validated by parseLine
+    return cfg
+}
+
+// parseParam checks one inline key=value parameter against impair.Config and
+// returns the value as JSON: numbers and booleans as written, anything else as a string.
+func parseParam(mod, k, v string) (json.RawMessage, error) {
+    if k == "profile" || k == "updated_at" { return nil, fmt.Errorf("%s cannot be set inline: %q", k, mod) }
+    raw := json.RawMessage(v)
+    if !json.Valid(raw) || v[0] == '{' || v[0] == '[' {
+        raw, _ = json.Marshal(v)
+    }
+    obj, _ := json.Marshal(map[string]json.RawMessage{k: raw})
+    dec := json.NewDecoder(bytes.NewReader(obj))
+    dec.DisallowUnknownFields()
+    var scratch impair.Config
+    if err := dec.Decode(&scratch); err != nil {
+        if strings.Contains(err.Error(), "unknown field") { return nil, fmt.Errorf("unknown parameter %q", mod) }
+        return nil, fmt.Errorf("bad value in %q", mod)
+    }
+    return raw, nil
+}
+
+const presetPrefix = "preset:"
+
+// HitCount returns the number of live matches counted for the rule.
+func (r Rule) HitCount() int64 {
+    if r.Counter == nil { return 0 }
+    return r.Counter.hits.Load()
+}
+
+// LastMatch returns the time of the rule's latest live match, zero before the first.
+func (r Rule) LastMatch() time.Time {
+    if r.Counter == nil { return time.Time{} }
+    return r.Counter.lastMatch()
 }
 
 type Set struct {
     Rules []Rule
+    Rand  func() float64 // rolls for "sample" rules, in [0, 1); nil uses math/rand
 }
 
 func Parse(r io.Reader) (Set, error) {
-    var set Set
+    var b setBuilder
     s := bufio.NewScanner(r)
     lineNo := 0
     for s.Scan() {
         lineNo++
         line := strings.TrimSpace(s.Text())
         if line == "" || strings.HasPrefix(line, "#") { continue }
-        rw, err := parseLine(line)
-        if err != nil { return Set{}, fmt.Errorf("line %d: %w", lineNo, err) }
-        set.Rules = append(set.Rules, rw)
+        if _, err := b.add(line, lineNo); err != nil { return Set{}, fmt.Errorf("line %d: %w", lineNo, err) }
     }
     if err := s.Err(); err != nil { return Set{}, err }
-    return set, nil
+    return b.set(), nil
+}
+
+// setBuilder collects parsed rules into a Set, giving repeated lines distinct IDs.
+type setBuilder struct {
+    rules []Rule
+    ids   map[string]int // rule ID -> how many rules have it
+}
+
+// add parses one rule; line is its position in the input, for errors and Lint.
+func (b *setBuilder) add(text string, line int) (*Rule, error) {
+    rw, err := parseLine(text)
+    if err != nil { return nil, err }
+    if b.ids == nil { b.ids = map[string]int{} }
+    if n := b.ids[rw.ID]; n > 0 {
+        if strings.HasPrefix(strings.ToLower(text), idPrefix) { return nil, fmt.Errorf("duplicate rule id %q", rw.ID) }
+        rw.ID = fmt.Sprintf("%s-%d", rw.ID, n+1) // the same rule twice
+    }
+    b.ids[rw.ID]++
+    rw.line = line
+    b.rules = append(b.rules, rw)
+    return &b.rules[len(b.rules)-1], nil
+}
+
+// set returns the rules in evaluation order.
+func (b *setBuilder) set() Set {
+    slices.SortStableFunc(b.rules, func(a, b Rule) int { return cmp.Compare(a.Priority, b.Priority) })
+    return Set{Rules: b.rules}
 }
 
+// Source renders the set back to rule text, one rule per line, such that Parse(Source())
+// yields the same rules.
+func (s Set) Source() string {
+    var b strings.Builder
+    for _, r := range s.Rules { b.WriteString(r.Raw); b.WriteByte('\n') }
+    return b.String()
+}
+
+// idPrefix starts an explicit rule ID: "id:slow-eu when ...".
+const idPrefix = "id:"
+
 func parseLine(line string) (Rule, error) {
     lower := strings.ToLower(line)
+    var id string
+    if rest, ok := strings.CutPrefix(lower, idPrefix); ok {
+        id, lower, _ = strings.Cut(rest, " ")
+        lower = strings.TrimSpace(lower)
+        if !impair.ValidPresetName(id) { return Rule{}, fmt.Errorf("invalid rule id %q", id) }
+    } else {
+        sum := sha256.Sum256([]byte(line))
+        id = hex.EncodeToString(sum[:4])
+    }
     if !strings.HasPrefix(lower, "when ") {
         return Rule{}, fmt.Errorf("missing 'when'")
     }
     parts := strings.SplitN(lower[len("when "):], " then ", 2)
     if len(parts) != 2 { return Rule{}, fmt.Errorf("missing 'then'") }
-    cond := strings.TrimSpace(parts[0])
-    action := strings.TrimSpace(parts[1])
-    prof := impair.ProfileName(strings.ToUpper(action))
-    if prof == "" { return Rule{}, fmt.Errorf("invalid profile") }
+    actionFields := strings.Fields(parts[1])
+    var window *Window
+    var priority int
+    var hasPriority bool
+    var sample float64
+suffixes:
+    for n := len(actionFields); n >= 3; n = len(actionFields) {
+        switch actionFields[n-2] {
+        case "between":
+            if window != nil { return Rule{}, fmt.Errorf("between given twice") }
+            w, err := parseWindow(actionFields[n-1])
+            if err != nil { return Rule{}, err }
+            window = &w
+        case "priority":
+            if hasPriority { return Rule{}, fmt.Errorf("priority given twice") }
+            p, err := strconv.Atoi(actionFields[n-1])
+            if err != nil { return Rule{}, fmt.Errorf("bad priority %q", actionFields[n-1]) }
+            priority, hasPriority = p, true
+        case "sample":
+            if sample != 0 { return Rule{}, fmt.Errorf("sample given twice") }
+            pct, ok := strings.CutSuffix(actionFields[n-1], "%")
+            f, err := strconv.ParseFloat(pct, 64)
+            if !ok || err != nil || !(f > 0 && f <= 100) { return Rule{}, fmt.Errorf("bad sample rate %q (want 0-100%%, e.g. 20%%)", actionFields[n-1]) }
+            sample = f / 100
+        default:
+            break suffixes
+        }
+        actionFields = actionFields[:n-2]
+    }
+    for _, kw := range []string{"between", "priority", "sample"} {
+        if slices.Contains(actionFields, kw) { return Rule{}, fmt.Errorf("%s must come after the action and its modifiers", kw) }
+    }
+    if len(actionFields) == 0 { return Rule{}, fmt.Errorf("invalid profile") }
+    var prof impair.ProfileName
+    preset, isPreset := strings.CutPrefix(actionFields[0], presetPrefix)
+    if isPreset {
+        if !impair.ValidPresetName(preset) { return Rule{}, fmt.Errorf("invalid preset name %q", preset) }
+    } else {
+        preset = ""
+        prof = impair.ProfileName(strings.ToUpper(actionFields[0]))
+        if _, ok := impair.LookupProfile(prof); !ok { return Rule{}, fmt.Errorf("unknown profile %q", prof) }
+    }
+    var hold time.Duration
+    params := map[string]json.RawMessage{}
+    for _, mod := range actionFields[1:] {
+        k, v, ok := strings.Cut(mod, "=")
+        if !ok { return Rule{}, fmt.Errorf("invalid action modifier %q", mod) }
+        switch k {
+        case "also_hold":
+            d, err := time.ParseDuration(v)
+            if err != nil || d <= 0 { return Rule{}, fmt.Errorf("bad also_hold duration %q", v) }
+            hold = d
+        default:
+            if _, dup := params[k]; dup { return Rule{}, fmt.Errorf("parameter %s given twice", k) }
+            raw, err := parseParam(mod, k, v)
+            if err != nil { return Rule{}, err }
+            params[k] = raw
+        }
+    }
+    var overlay impair.Config
+    var paramsJSON []byte
+    if len(params) > 0 {
+        paramsJSON, _ = json.Marshal(params)
+        _ = json.Unmarshal(paramsJSON, &overlay)
+        if err := overlay.Validate(); err != nil { return Rule{}, err }
+    }
+    if prof == impair.ProfileFailureRamp && (overlay.MaxPct <= 0 || overlay.RampMinutes <= 0) {
+        return Rule{}, fmt.Errorf("FAILURE_RAMP needs max_pct and ramp_minutes, e.g. then FAILURE_RAMP max_pct=50 ramp_minutes=10")
+    }
+
+    predicate, terms, err := parseCondition(strings.TrimSpace(parts[0]))
+    if err != nil { return Rule{}, err }
+    return Rule{ID: id, Raw: line, Predicate: predicate, Profile: prof, Preset: preset, AlsoHold: hold, Overlay: overlay, params: paramsJSON, Counter: new(Counter), Window: window, Priority: priority, Sample: sample, terms: terms}, nil
+}
+
+// ConnInfo is what rules can match on besides the ClientHello.
+type ConnInfo struct {
+    RemoteAddr net.Addr // the client's address (src_ip_in); nil matches no address
+    SNIRate    int      // connections for the SNI in the last minute, this one included (sni_conn_rate; see SNIRates)
+}
+
+// addr returns the client's IP, IPv4-mapped IPv6 addresses as IPv4.
+func (c ConnInfo) addr() (netip.Addr, bool) {
+    if c.RemoteAddr == nil { return netip.Addr{}, false }
+    if tcp, ok := c.RemoteAddr.(*net.TCPAddr); ok { return tcp.AddrPort().Addr().Unmap(), true }
+    host, _, err := net.SplitHostPort(c.RemoteAddr.String())
+    if err != nil { host = c.RemoteAddr.String() }
+    a, err := netip.ParseAddr(host)
+    return a.Unmap(), err == nil
+}
+
+// Cond is a parsed rule condition.
+type Cond func(res tlsinspect.Result, conn ConnInfo) bool
+
+// parseCondition parses comparisons joined by "and" and "or". "and" binds tighter
+// than "or" and there are no parentheses: a and b or c means (a and b) or c.
+func parseCondition(cond string) (Cond, [][]term, error) {
+    words := strings.Fields(cond)
+    if len(words) == 0 { return nil, nil, fmt.Errorf("empty condition") }
+    var anyOf []Cond
+    var terms [][]term
+    for _, alt := range splitOn(words, "or") {
+        if len(alt) == 0 { return nil, nil, fmt.Errorf("dangling 'or' in condition") }
+        var allOf []Cond
+        var conj []term
+        for _, fields := range splitOn(alt, "and") {
+            if len(fields) == 0 { return nil, nil, fmt.Errorf("dangling 'and' in condition") }
+            negate := fields[0] == "not"
+            if negate {
+                fields = fields[1:]
+                if len(fields) == 0 { return nil, nil, fmt.Errorf("dangling 'not' in condition") }
+                if fields[0] == "not" || slices.Contains(fields, "!=") { return nil, nil, fmt.Errorf("double negation in condition") }
+            }
+            p, err := parseComparison(fields)
+            if err != nil { return nil, nil, err }
+            if negate { p = not(p) }
+            allOf = append(allOf, p)
+            conj = append(conj, newTerm(fields, negate))
+        }
+        anyOf = append(anyOf, all(allOf))
+        terms = append(terms, conj)
+    }
+    if len(anyOf) == 1 { return anyOf[0], terms, nil }
+    return func(r tlsinspect.Result, c ConnInfo) bool {
+        for _, p := range anyOf { if p(r, c) { return true } }
+        return false
+    }, terms, nil
+}
+
+// not returns the negation of p.
+func not(p Cond) Cond {
+    return func(r tlsinspect.Result, c ConnInfo) bool { return !p(r, c) }
+}
+
+// all returns a predicate true when every one of ps is, checked left to right.
+func all(ps []Cond) Cond {
+    if len(ps) == 1 { return ps[0] }
+    return func(r tlsinspect.Result, c ConnInfo) bool {
+        for _, p := range ps { if !p(r, c) { return false } }
+        return true
+    }
+}
 
+// splitOn splits fields at every occurrence of word. A leading, trailing or
+// doubled word yields an empty part.
+func splitOn(fields []string, word string) [][]string {
+    parts := [][]string{nil}
+    for _, f := range fields {
+        if f == word {
+            parts = append(parts, nil)
+            continue
+        }
+        parts[len(parts)-1] = append(parts[len(parts)-1], f)
+    }
+    return parts
+}
+
+// operatorless are the fields written without an operator ("sni_contains example.com").
+var operatorless = map[string]bool{"sni_contains": true, "sni_matches": true, "alpn_contains": true, "has_extension": true, "sig_algs_contains": true, "src_ip_in": true}
+
+// parseComparison parses a single comparison, already split into fields.
+func parseComparison(fields []string) (Cond, error) {
     // Supported forms:
     //   ch_bytes > N
     //   ch_bytes >= N
     //   pqc_hint == true|false
+    //   pqc_group == 0x11ec
+    //   ech_present == true|false
+    //   offers_psk == true|false
+    //   early_data == true|false
     //   cipher_count >= N
+    //   tls_max_version < 0x0304
     //   sni_contains example.com
+    //   sni == example.com
+    //   sni_matches *.example.com
     //   alpn_contains h2
+    //   alpn_first == h2
+    //   alpn_count >= 2
     //   ja3 == 771f... (md5 hex)
+    //   ja3_normalized == 8e19... (md5 hex)
+    //   grease_count == 0
+    //   has_extension 0x0015
+    //   sig_algs_contains 0x0401
+    //   compress_cert == true|false
+    //   sni_conn_rate > 100
+    //   src_ip_in 10.1.2.0/24 (also single addresses, IPv6, comma-separated lists)
+    //   <field> != value, for every field with ==
     var predicate func(res tlsinspect.Result) bool
-    fields := strings.Fields(cond)
     var field, op, val string
     switch len(fields) {
     case 3:
         field, op, val = fields[0], fields[1], fields[2]
-    case 2: // substring style: sni_contains value or alpn_contains value
+    case 2: // substring style: sni_contains, sni_matches, alpn_contains, has_extension or sig_algs_contains value
         field = fields[0]
         val = fields[1]
         op = "contains"
     default:
-        return Rule{}, fmt.Errorf("invalid condition format")
+        return nil, fmt.Errorf("invalid condition format")
+    }
+    if op == "!=" { // the negation of ==, for every field that has ==
+        if operatorless[field] { return nil, fmt.Errorf("%s takes no operator, negate it with not", field) }
+        p, err := parseComparison([]string{field, "==", val})
+        if err != nil { return nil, err }
+        return not(p), nil
     }
     switch field {
     case "ch_bytes":
         n, err := parseInt(val)
-        if err != nil { return Rule{}, fmt.Errorf("bad int: %w", err) }
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
         switch op {
         case ">": predicate = func(r tlsinspect.Result) bool { return r.HandshakeBytes > n }
         case ">=": predicate = func(r tlsinspect.Result) bool { return r.HandshakeBytes >= n }
         case "<": predicate = func(r tlsinspect.Result) bool { return r.HandshakeBytes < n }
         case "<=": predicate = func(r tlsinspect.Result) bool { return r.HandshakeBytes <= n }
         case "==": predicate = func(r tlsinspect.Result) bool { return r.HandshakeBytes == n }
-        default: return Rule{}, fmt.Errorf("unsupported operator %s", op)
+        default: return nil, fmt.Errorf("unsupported operator %s", op)
         }
     case "pqc_hint":
         b, err := strconv.ParseBool(val)
-        if err != nil { return Rule{}, fmt.Errorf("bad bool: %w", err) }
+        if err != nil { return nil, fmt.Errorf("bad bool: %w", err) }
         switch op {
         case "==": predicate = func(r tlsinspect.Result) bool { return r.PQCHint == b }
-        default: return Rule{}, fmt.Errorf("unsupported operator for pqc_hint: %s", op)
+        default: return nil, fmt.Errorf("unsupported operator for pqc_hint: %s", op)
+        }
+    case "ech_present":
+        b, err := strconv.ParseBool(val)
+        if err != nil { return nil, fmt.Errorf("bad bool: %w", err) }
+        switch op {
+        case "==": predicate = func(r tlsinspect.Result) bool { return r.ECHPresent == b }
+        default: return nil, fmt.Errorf("unsupported operator for ech_present: %s", op)
+        }
+    case "offers_psk":
+        b, err := strconv.ParseBool(val)
+        if err != nil { return nil, fmt.Errorf("bad bool: %w", err) }
+        switch op {
+        case "==": predicate = func(r tlsinspect.Result) bool { return r.OffersPSK == b }
+        default: return nil, fmt.Errorf("unsupported operator for offers_psk: %s", op)
         }
+    case "early_data":
+        b, err := strconv.ParseBool(val)
+        if err != nil { return nil, fmt.Errorf("bad bool: %w", err) }
+        switch op {
+        case "==": predicate = func(r tlsinspect.Result) bool { return r.EarlyData == b }
+        default: return nil, fmt.Errorf("unsupported operator for early_data: %s", op)
+        }
+    case "pqc_group":
+        if op != "==" { return nil, fmt.Errorf("unsupported operator for pqc_group: %s", op) }
+        n, err := parseInt(val)
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
+        g := uint16(n)
+        predicate = func(r tlsinspect.Result) bool { return slices.Contains(r.KeyShareGroups, g) }
     case "cipher_count":
         n, err := parseInt(val)
-        if err != nil { return Rule{}, fmt.Errorf("bad int: %w", err) }
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
         switch op {
         case ">": predicate = func(r tlsinspect.Result) bool { return r.CipherSuites > n }
         case ">=": predicate = func(r tlsinspect.Result) bool { return r.CipherSuites >= n }
         case "<": predicate = func(r tlsinspect.Result) bool { return r.CipherSuites < n }
         case "<=": predicate = func(r tlsinspect.Result) bool { return r.CipherSuites <= n }
         case "==": predicate = func(r tlsinspect.Result) bool { return r.CipherSuites == n }
-        default: return Rule{}, fmt.Errorf("unsupported operator %s", op)
+        default: return nil, fmt.Errorf("unsupported operator %s", op)
+        }
+    case "tls_max_version":
+        n, err := parseInt(val)
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
+        v := uint16(n)
+        switch op {
+        case ">": predicate = func(r tlsinspect.Result) bool { return r.MaxVersion > v }
+        case ">=": predicate = func(r tlsinspect.Result) bool { return r.MaxVersion >= v }
+        case "<": predicate = func(r tlsinspect.Result) bool { return r.MaxVersion < v }
+        case "<=": predicate = func(r tlsinspect.Result) bool { return r.MaxVersion <= v }
+        case "==": predicate = func(r tlsinspect.Result) bool { return r.MaxVersion == v }
+        default: return nil, fmt.Errorf("unsupported operator %s", op)
         }
-    case "ja3":
-        if op != "==" { return Rule{}, fmt.Errorf("ja3 only supports == operator") }
+    case "alpn_first":
+        if op != "==" { return nil, fmt.Errorf("alpn_first only supports == operator") }
+        predicate = func(r tlsinspect.Result) bool { return len(r.ALPN) > 0 && strings.ToLower(r.ALPN[0]) == val }
+    case "alpn_count":
+        n, err := parseInt(val)
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
+        switch op {
+        case ">": predicate = func(r tlsinspect.Result) bool { return len(r.ALPN) > n }
+        case ">=": predicate = func(r tlsinspect.Result) bool { return len(r.ALPN) >= n }
+        case "<": predicate = func(r tlsinspect.Result) bool { return len(r.ALPN) < n }
+        case "<=": predicate = func(r tlsinspect.Result) bool { return len(r.ALPN) <= n }
+        case "==": predicate = func(r tlsinspect.Result) bool { return len(r.ALPN) == n }
+        default: return nil, fmt.Errorf("unsupported operator %s", op)
+        }
+    case "ja3", "ja3_normalized":
+        if op != "==" { return nil, fmt.Errorf("%s only supports == operator", field) }
         hexVal := strings.ToLower(val)
-        if len(hexVal) != 32 { return Rule{}, fmt.Errorf("expected 32 hex chars for ja3") }
-        for _, c := range hexVal { if (c < '0' || c > '9') && (c < 'a' || c > 'f') { return Rule{}, fmt.Errorf("invalid hex in ja3") } }
-        predicate = func(r tlsinspect.Result) bool { return r.JA3 == hexVal }
+        if len(hexVal) != 32 { return nil, fmt.Errorf("expected 32 hex chars for %s", field) }
+        for _, c := range hexVal { if (c < '0' || c > '9') && (c < 'a' || c > 'f') { return nil, fmt.Errorf("invalid hex in %s", field) } }
+        if field == "ja3" {
+            predicate = func(r tlsinspect.Result) bool { return r.JA3 == hexVal }
+        } else {
+            predicate = func(r tlsinspect.Result) bool { return r.NormalizedJA3 == hexVal }
+        }
+    case "grease_count":
+        n, err := parseInt(val)
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
+        switch op {
+        case ">": predicate = func(r tlsinspect.Result) bool { return r.GreaseCount > n }
+        case ">=": predicate = func(r tlsinspect.Result) bool { return r.GreaseCount >= n }
+        case "<": predicate = func(r tlsinspect.Result) bool { return r.GreaseCount < n }
+        case "<=": predicate = func(r tlsinspect.Result) bool { return r.GreaseCount <= n }
+        case "==": predicate = func(r tlsinspect.Result) bool { return r.GreaseCount == n }
+        default: return nil, fmt.Errorf("unsupported operator %s", op)
+        }
     case "sni_contains":
-        if val == "" { return Rule{}, fmt.Errorf("empty substring") }
+        if val == "" { return nil, fmt.Errorf("empty substring") }
         needle := strings.ToLower(val)
         predicate = func(r tlsinspect.Result) bool { return r.SNI != "" && strings.Contains(strings.ToLower(r.SNI), needle) }
+    case "sni":
+        if op != "==" { return nil, fmt.Errorf("sni only supports == operator") }
+        host, err := ruleHost(val)
+        if err != nil { return nil, err }
+        predicate = func(r tlsinspect.Result) bool { return r.SNI != "" && sniHost(r.SNI) == host }
+    case "sni_matches":
+        if op != "contains" { return nil, fmt.Errorf("sni_matches takes no operator") }
+        suffix, ok := strings.CutPrefix(val, "*.")
+        if !ok { return nil, fmt.Errorf("sni_matches pattern must start with *.") }
+        suffix, err := ruleHost(suffix)
+        if err != nil { return nil, err }
+        if strings.Contains(suffix, "*") { return nil, fmt.Errorf("only one leading *. is supported") }
+        predicate = func(r tlsinspect.Result) bool {
+            label, rest, ok := strings.Cut(sniHost(r.SNI), ".")
+            return ok && label != "" && rest == suffix
+        }
     case "alpn_contains":
-        if val == "" { return Rule{}, fmt.Errorf("empty alpn token") }
+        if val == "" { return nil, fmt.Errorf("empty alpn token") }
         needle := strings.ToLower(val)
         predicate = func(r tlsinspect.Result) bool {
             for _, p := range r.ALPN { if strings.ToLower(p) == needle { return true } }
             return false
         }
+    case "has_extension":
+        if op != "contains" { return nil, fmt.Errorf("has_extension takes no operator") }
+        n, err := parseInt(val)
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
+        ext := uint16(n)
+        predicate = func(r tlsinspect.Result) bool { return slices.Contains(r.Extensions, ext) }
+    case "sig_algs_contains":
+        if op != "contains" { return nil, fmt.Errorf("sig_algs_contains takes no operator") }
+        n, err := parseInt(val)
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
+        alg := uint16(n)
+        predicate = func(r tlsinspect.Result) bool { return slices.Contains(r.SignatureAlgorithms, alg) }
+    case "compress_cert":
+        b, err := strconv.ParseBool(val)
+        if err != nil { return nil, fmt.Errorf("bad bool: %w", err) }
+        switch op {
+        case "==": predicate = func(r tlsinspect.Result) bool { return (len(r.CompressCertAlgos) > 0) == b }
+        default: return nil, fmt.Errorf("unsupported operator for compress_cert: %s", op)
+        }
+    case "sni_conn_rate":
+        n, err := parseInt(val)
+        if err != nil { return nil, fmt.Errorf("bad int: %w", err) }
+        var cond func(rate int) bool
+        switch op {
+        case ">": cond = func(rate int) bool { return rate > n }
+        case ">=": cond = func(rate int) bool { return rate >= n }
+        case "<": cond = func(rate int) bool { return rate < n }
+        case "<=": cond = func(rate int) bool { return rate <= n }
+        case "==": cond = func(rate int) bool { return rate == n }
+        default: return nil, fmt.Errorf("unsupported operator %s", op)
+        }
+        return func(_ tlsinspect.Result, c ConnInfo) bool { return cond(c.SNIRate) }, nil
+    case "src_ip_in":
+        if op != "contains" { return nil, fmt.Errorf("src_ip_in takes no operator") }
+        prefixes, err := parsePrefixes(val)
+        if err != nil { return nil, err }
+        return func(_ tlsinspect.Result, c ConnInfo) bool {
+            ip, ok := c.addr()
+            return ok && slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(ip) })
+        }, nil
     default:
-        return Rule{}, fmt.Errorf("unsupported field %s", field)
+        return nil, fmt.Errorf("unsupported field %s", field)
+    }
+    return func(r tlsinspect.Result, _ ConnInfo) bool { return predicate(r) }, nil
+}
+
+// parsePrefixes parses a comma-separated list of addresses and CIDR prefixes.
+func parsePrefixes(v string) ([]netip.Prefix, error) {
+    var out []netip.Prefix
+    for _, s := range strings.Split(v, ",") {
+        if p, err := netip.ParsePrefix(s); err == nil {
+            out = append(out, p.Masked())
+            continue
+        }
+        a, err := netip.ParseAddr(s)
+        if err != nil { return nil, fmt.Errorf("bad address or prefix %q", s) }
+        out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
     }
+    return out, nil
+}
 
-    return Rule{Raw: line, Predicate: predicate, Profile: prof}, nil
+// ruleHost validates and normalizes a hostname written in a rule. SNI carries
+// ASCII hostnames only, internationalized names as A-labels (xn--...), and never a port.
+func ruleHost(v string) (string, error) {
+    host := sniHost(v)
+    if host == "" { return "", fmt.Errorf("empty hostname") }
+    for _, c := range host {
+        if c > 0x7f { return "", fmt.Errorf("hostname %q is not ASCII; write internationalized names as A-labels (xn--...)", v) }
+        if c == ':' || c == '/' { return "", fmt.Errorf("hostname %q: SNI never carries a port or path", v) }
+    }
+    return host, nil
 }
 
+// sniHost lowercases a hostname and drops a trailing dot.
+func sniHost(v string) string { return strings.TrimSuffix(strings.ToLower(v), ".") }
+
 func parseInt(v string) (int, error) {
     if strings.HasPrefix(v, "0x") {
         b, err := hex.DecodeString(strings.TrimPrefix(v, "0x"))
@@ -152,12 +654,73 @@ func parseInt(v string) (int, error) {
     return strconv.Atoi(v)
 }
 
-// Match returns the first profile whose predicate returns true.
+// Match returns the profile of the first rule whose predicate returns true (empty for
+// a preset action; use MatchRule and Rule.Config to resolve those).
 func (s Set) Match(res tlsinspect.Result) (impair.ProfileName, bool) {
+    r, ok := s.MatchRule(res)
+    return r.Profile, ok
+}
+
+// MatchRule returns the first rule active now whose predicate returns true, including
+// its modifiers. Connection conditions (src_ip_in) do not match; see MatchRuleAt.
+func (s Set) MatchRule(res tlsinspect.Result) (Rule, bool) {
+    return s.MatchRuleAt(res, ConnInfo{}, time.Now())
+}
+
+// MatchRuleAt is MatchRule for a connection described by conn, at time now: rules with
+// a time window not containing now are skipped.
+func (s Set) MatchRuleAt(res tlsinspect.Result, conn ConnInfo, now time.Time) (Rule, bool) {
+    d := s.Decide(res, conn, now)
+    return d.Rule, d.OK
+}
+
+// Decision is the outcome of evaluating a Set for one connection.
+type Decision struct {
+    Rule       Rule   // the rule to apply, when OK
+    OK         bool
+    SampledOut []Rule // "sample" rules that matched but lost their roll, in evaluation order
+}
+
+// Decide evaluates the rules in order like MatchRuleAt, rolling s.Rand for each
+// matching rule with a sample rate.
+func (s Set) Decide(res tlsinspect.Result, conn ConnInfo, now time.Time) Decision {
+    var d Decision
     for _, r := range s.Rules {
-        if r.Predicate(res) {
-            return r.Profile, true
+        if !r.ActiveAt(now) || !r.Predicate(res, conn) { continue }
+        if r.Sample > 0 && s.roll() >= r.Sample {
+            d.SampledOut = append(d.SampledOut, r)
+            continue
         }
+        d.Rule, d.OK = r, true
+        break
+    }
+    return d
+}
+
+func (s Set) roll() float64 {
+    if s.Rand != nil { return s.Rand() }
+    return rand.Float64()
+}
+
+// Reported returns the rule a receipt records (rule_matched) and whether sampling
+// selected it (rule_sampled, nil for a rule without a sample rate): the applied rule,
+// else the first sampled rule that matched but was not selected.
+func (d Decision) Reported() (r Rule, ok bool, sampled *bool) {
+    switch {
+    case d.OK:
+        r, ok = d.Rule, true
+    case len(d.SampledOut) > 0:
+        r, ok = d.SampledOut[0], true
+    default:
+        return Rule{}, false, nil
+    }
+    if r.Sample > 0 {
+        sel := d.OK
+        sampled = &sel
     }
-    return "", false
+    return r, ok, sampled
 }
+
+// ActiveAt reports whether the rule can match at now: it has no time window or now
+// is inside it.
+func (r Rule) ActiveAt(now time.Time) bool { return r.Window == nil || r.Window.Contains(now) }
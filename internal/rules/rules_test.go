@@ -1,8 +1,13 @@
 package rules
 
 import (
+    mrand "math/rand"
+    "net"
+    "net/netip"
+    "slices"
     "strings"
     "testing"
+    "time"
     "pathlab/internal/tlsinspect"
     "pathlab/internal/impair"
 )
@@ -23,3 +28,381 @@ when alpn_contains h2 then LATENCY_50MS_JITTER_10
     if !ok { t.Fatalf("expected match") }
     if prof != impair.ProfileMTUBlackhole && prof != impair.ProfileLatencyJitter { t.Fatalf("unexpected profile %s", prof) }
 }
+
+func TestParseAlsoHoldModifier(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sni_contains retry.example then ABORT_AFTER_CH also_hold=5s"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    ru, ok := set.MatchRule(tlsinspect.Result{SNI: "retry.example"})
+    if !ok || ru.Profile != impair.ProfileAbortAfterCH || ru.AlsoHold.Seconds() != 5 { t.Fatalf("unexpected rule %#v ok=%v", ru, ok) }
+    for _, bad := range []string{
+        "when ch_bytes > 1 then CLEAN also_hold=soon",
+        "when ch_bytes > 1 then CLEAN also_hold=-1s",
+        "when ch_bytes > 1 then CLEAN hold_forever",
+        "when ch_bytes > 1 then CLEAN keep=5s",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestPresetAction(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sni_contains eu.example then preset:Slow-EU also_hold=1s\nwhen ch_bytes > 1 then ABORT_AFTER_CH"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    presets := func(name string) (impair.Config, bool) {
+        if name == "slow-eu" { return impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 150}, true }
+        return impair.Config{}, false
+    }
+    base := impair.Config{Profile: impair.ProfileClean, ThresholdBytes: 1300}
+    ru, ok := set.MatchRule(tlsinspect.Result{SNI: "api.eu.example", HandshakeBytes: 500})
+    if !ok || ru.Preset != "slow-eu" || ru.Profile != "" || ru.Action() != "preset:slow-eu" || ru.AlsoHold.Seconds() != 1 { t.Fatalf("preset rule %#v", ru) }
+    if cfg, ok := ru.Config(base, presets); !ok || cfg.Profile != impair.ProfileLatencyJitter || cfg.LatencyMs != 150 { t.Fatalf("resolved %+v %v", cfg, ok) }
+    // a preset deleted after the rules were loaded leaves the connection on the base config
+    if cfg, ok := ru.Config(base, func(string) (impair.Config, bool) { return impair.Config{}, false }); ok || cfg != base { t.Fatalf("missing preset resolved to %+v %v", cfg, ok) }
+    ru, _ = set.MatchRule(tlsinspect.Result{HandshakeBytes: 500})
+    if cfg, ok := ru.Config(base, presets); !ok || cfg.Profile != impair.ProfileAbortAfterCH || cfg.ThresholdBytes != 1300 || ru.Action() != "ABORT_AFTER_CH" { t.Fatalf("profile rule resolved to %+v", cfg) }
+    for _, bad := range []string{"when ch_bytes > 1 then preset:", "when ch_bytes > 1 then preset:a/b"} {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestTLSMaxVersion(t *testing.T) {
+    set, err := Parse(strings.NewReader("when tls_max_version < 0x0304 then ABORT_AFTER_CH"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if prof, ok := set.Match(tlsinspect.Result{MaxVersion: 0x0303}); !ok || prof != impair.ProfileAbortAfterCH { t.Fatalf("TLS 1.2 client: %s %v", prof, ok) }
+    if _, ok := set.Match(tlsinspect.Result{MaxVersion: 0x0304}); ok { t.Fatalf("TLS 1.3 client matched") }
+    if _, err := Parse(strings.NewReader("when tls_max_version =< 0x0304 then CLEAN")); err == nil { t.Fatalf("expected error for =<") }
+}
+
+func TestPQCGroup(t *testing.T) {
+    set, err := Parse(strings.NewReader("when pqc_group == 0x11ec then ABORT_AFTER_CH"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if _, ok := set.Match(tlsinspect.Result{KeyShareGroups: []uint16{0x11ec, 0x001d}}); !ok { t.Fatalf("X25519MLKEM768 share not matched") }
+    if _, ok := set.Match(tlsinspect.Result{KeyShareGroups: []uint16{0x6399}, PQCHint: true}); ok { t.Fatalf("other hybrid group matched") }
+    if _, err := Parse(strings.NewReader("when pqc_group > 0x11ec then CLEAN")); err == nil { t.Fatalf("expected error for >") }
+}
+
+func TestECHPresent(t *testing.T) {
+    set, err := Parse(strings.NewReader("when ech_present == true then LATENCY_50MS_JITTER_10"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if _, ok := set.Match(tlsinspect.Result{ECHPresent: true, SNI: "public.example"}); !ok { t.Fatalf("ECH client not matched") }
+    if _, ok := set.Match(tlsinspect.Result{SNI: "public.example"}); ok { t.Fatalf("non-ECH client matched") }
+    if _, err := Parse(strings.NewReader("when ech_present == maybe then CLEAN")); err == nil { t.Fatalf("expected error for bad bool") }
+}
+
+func TestHasExtension(t *testing.T) {
+    set, err := Parse(strings.NewReader("when has_extension 0x0015 then MTU1300_BLACKHOLE"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if _, ok := set.Match(tlsinspect.Result{Extensions: []uint16{0x0000, 0x0015, 0x002b}}); !ok { t.Fatalf("padding extension not matched") }
+    if _, ok := set.Match(tlsinspect.Result{Extensions: []uint16{0x0000, 0x002b}}); ok { t.Fatalf("matched without the extension") }
+    for _, bad := range []string{"when has_extension == 0x0015 then CLEAN", "when has_extension padding then CLEAN"} {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestEarlyData(t *testing.T) {
+    set, err := Parse(strings.NewReader("when early_data == true then ABORT_AFTER_CH"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if prof, ok := set.Match(tlsinspect.Result{EarlyData: true, OffersPSK: true}); !ok || prof != impair.ProfileAbortAfterCH { t.Fatalf("0-RTT attempt not matched") }
+    if _, ok := set.Match(tlsinspect.Result{OffersPSK: true}); ok { t.Fatalf("resumption without early data matched") }
+    if _, err := Parse(strings.NewReader("when early_data >= 1 then CLEAN")); err == nil { t.Fatalf("expected error for >=") }
+}
+
+func TestOffersPSK(t *testing.T) {
+    set, err := Parse(strings.NewReader("when offers_psk == true then ABORT_AFTER_CH"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if prof, ok := set.Match(tlsinspect.Result{OffersPSK: true, PSKIdentityCount: 1}); !ok || prof != impair.ProfileAbortAfterCH { t.Fatalf("resumption not matched") }
+    if _, ok := set.Match(tlsinspect.Result{SessionIDLen: 32}); ok { t.Fatalf("full handshake matched") }
+    if _, err := Parse(strings.NewReader("when offers_psk > 0 then CLEAN")); err == nil { t.Fatalf("expected error for >") }
+}
+
+func TestSigAlgsAndCompressCert(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sig_algs_contains 0x0804 then CLEAN\nwhen compress_cert == false then LATENCY_50MS_JITTER_10"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if prof, _ := set.Match(tlsinspect.Result{SignatureAlgorithms: []uint16{0x0403, 0x0804}}); prof != impair.ProfileClean { t.Fatalf("rsa_pss client: %s", prof) }
+    // a PKCS#1-only client without certificate compression falls to the second rule
+    if prof, _ := set.Match(tlsinspect.Result{SignatureAlgorithms: []uint16{0x0401, 0x0201}}); prof != impair.ProfileLatencyJitter { t.Fatalf("pkcs1 client: %s", prof) }
+    if _, ok := set.Match(tlsinspect.Result{SignatureAlgorithms: []uint16{0x0401}, CompressCertAlgos: []uint16{2}}); ok { t.Fatalf("compressing pkcs1 client matched") }
+    for _, bad := range []string{"when sig_algs_contains == 0x0401 then CLEAN", "when compress_cert == brotli then CLEAN"} {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestSNIExactAndWildcard(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sni == Example.COM. then ABORT_AFTER_CH\nwhen sni_matches *.XN--BCHER-KVA.example then CLEAN"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    for sni, want := range map[string]impair.ProfileName{
+        "example.com":               impair.ProfileAbortAfterCH,
+        "example.com.":              impair.ProfileAbortAfterCH,
+        "notexample.com.evil.test":  "",
+        "www.example.com":           "",
+        "shop.xn--bcher-kva.example": impair.ProfileClean,
+        "xn--bcher-kva.example":     "", // the wildcard needs a label
+        "a.b.xn--bcher-kva.example": "", // and matches exactly one
+    } {
+        if prof, _ := set.Match(tlsinspect.Result{SNI: sni}); prof != want { t.Errorf("%s: got %q, want %q", sni, prof, want) }
+    }
+    // sni_contains is unchanged: a substring anywhere
+    set, _ = Parse(strings.NewReader("when sni_contains example.com then CLEAN"))
+    if _, ok := set.Match(tlsinspect.Result{SNI: "notexample.com.evil.test"}); !ok { t.Fatalf("sni_contains no longer matches substrings") }
+    for _, bad := range []string{
+        "when sni == example.com:443 then CLEAN",
+        "when sni == bücher.example then CLEAN",
+        "when sni contains example.com then CLEAN",
+        "when sni_matches example.com then CLEAN",
+        "when sni_matches *.*.example.com then CLEAN",
+        "when sni_matches *. then CLEAN",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestALPNFirstAndCount(t *testing.T) {
+    set, err := Parse(strings.NewReader("when alpn_first == h2 then BANDWIDTH_1MBPS\nwhen alpn_count >= 2 then LATENCY_50MS_JITTER_10\nwhen alpn_count == 0 then ABORT_AFTER_CH"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    for _, c := range []struct{ alpn []string; want impair.ProfileName }{
+        {nil, impair.ProfileAbortAfterCH},
+        {[]string{"H2"}, impair.ProfileBandwidthLimit},
+        {[]string{"http/1.1"}, ""},
+        {[]string{"h2", "http/1.1"}, impair.ProfileBandwidthLimit},
+        {[]string{"http/1.1", "h2"}, impair.ProfileLatencyJitter}, // h2 offered, but not preferred
+    } {
+        if prof, _ := set.Match(tlsinspect.Result{ALPN: c.alpn}); prof != c.want { t.Errorf("alpn %q: got %q, want %q", c.alpn, prof, c.want) }
+    }
+    for _, bad := range []string{"when alpn_first > h2 then CLEAN", "when alpn_count >= two then CLEAN"} {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestGreaseCountAndNormalizedJA3(t *testing.T) {
+    set, err := Parse(strings.NewReader("when grease_count == 0 then ABORT_AFTER_CH\nwhen ja3_normalized == 8E19337E7524D2573BE54EFB2B0784C9 then BANDWIDTH_1MBPS"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    for _, c := range []struct{ res tlsinspect.Result; want impair.ProfileName }{
+        {tlsinspect.Result{}, impair.ProfileAbortAfterCH},
+        {tlsinspect.Result{GreaseCount: 4}, ""},
+        {tlsinspect.Result{GreaseCount: 4, NormalizedJA3: "8e19337e7524d2573be54efb2b0784c9"}, impair.ProfileBandwidthLimit},
+        {tlsinspect.Result{GreaseCount: 4, JA3: "8e19337e7524d2573be54efb2b0784c9"}, ""}, // the plain JA3 is not looked at
+    } {
+        if prof, _ := set.Match(c.res); prof != c.want { t.Errorf("%+v: got %q, want %q", c.res, prof, c.want) }
+    }
+    for _, bad := range []string{"when grease_count == some then CLEAN", "when ja3_normalized == abc then CLEAN", "when ja3_normalized > 8e19337e7524d2573be54efb2b0784c9 then CLEAN"} {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestAndOr(t *testing.T) {
+    line := "when sni_contains a.com or ch_bytes > 1400 and pqc_hint == true or alpn_contains h3 and cipher_count < 5 then MTU1300_BLACKHOLE"
+    set, err := Parse(strings.NewReader(line))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if set.Rules[0].Raw != line { t.Fatalf("raw %q", set.Rules[0].Raw) }
+    for _, c := range []struct{ res tlsinspect.Result; want bool }{
+        {tlsinspect.Result{SNI: "www.a.com"}, true},
+        {tlsinspect.Result{HandshakeBytes: 1500, PQCHint: true}, true},
+        {tlsinspect.Result{HandshakeBytes: 1500}, false}, // and binds tighter: not (a or ch_bytes) and pqc_hint
+        {tlsinspect.Result{SNI: "a.com", PQCHint: false}, true},
+        {tlsinspect.Result{PQCHint: true}, false},
+        {tlsinspect.Result{ALPN: []string{"h3"}, CipherSuites: 3}, true},
+        {tlsinspect.Result{ALPN: []string{"h3"}, CipherSuites: 16}, false},
+    } {
+        if _, ok := set.Match(c.res); ok != c.want { t.Errorf("%+v: matched %v, want %v", c.res, ok, c.want) }
+    }
+}
+
+func TestAndOrErrors(t *testing.T) {
+    for _, bad := range []string{
+        "when ch_bytes > 1400 and then CLEAN",
+        "when or sni_contains a.com then CLEAN",
+        "when sni_contains a.com or or sni_contains b.com then CLEAN",
+        "when sni_contains a.com and or pqc_hint == true then CLEAN",
+        "when ch_bytes > 1400 and pqc_hint then CLEAN",
+        "when  then CLEAN",
+    } {
+        _, err := Parse(strings.NewReader("when ch_bytes > 1 then CLEAN\n" + bad))
+        if err == nil || !strings.HasPrefix(err.Error(), "line 2: ") { t.Errorf("%q: err %v, want a line 2 error", bad, err) }
+    }
+}
+
+func TestNotAndNotEqual(t *testing.T) {
+    set, err := Parse(strings.NewReader(strings.Join([]string{
+        "when not sni_contains internal.corp and pqc_hint != true then LATENCY_50MS_JITTER_10",
+        "when ja3 != 8e19337e7524d2573be54efb2b0784c9 and not alpn_contains h2 then ABORT_AFTER_CH",
+        "when not cipher_count >= 10 or sni != a.test then BANDWIDTH_1MBPS",
+    }, "\n")))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    const ja3 = "8e19337e7524d2573be54efb2b0784c9"
+    for _, c := range []struct{ res tlsinspect.Result; want impair.ProfileName }{
+        {tlsinspect.Result{SNI: "www.example.com", JA3: ja3}, impair.ProfileLatencyJitter},
+        {tlsinspect.Result{SNI: "app.internal.corp", JA3: ja3, CipherSuites: 16}, impair.ProfileBandwidthLimit},
+        {tlsinspect.Result{SNI: "a.test", JA3: ja3, PQCHint: true, CipherSuites: 16}, ""},
+        {tlsinspect.Result{SNI: "a.test", PQCHint: true, CipherSuites: 16}, impair.ProfileAbortAfterCH},
+        {tlsinspect.Result{SNI: "a.test", PQCHint: true, ALPN: []string{"h2"}, CipherSuites: 3}, impair.ProfileBandwidthLimit},
+    } {
+        if prof, _ := set.Match(c.res); prof != c.want { t.Errorf("%+v: got %q, want %q", c.res, prof, c.want) }
+    }
+    for _, bad := range []string{
+        "when not not sni_contains a.com then CLEAN",
+        "when not ja3 != 8e19337e7524d2573be54efb2b0784c9 then CLEAN",
+        "when not then CLEAN",
+        "when ch_bytes > 1 and not then CLEAN",
+        "when sni_contains != a.com then CLEAN", // the operator-less forms take not instead
+        "when has_extension != 0x0015 then CLEAN",
+        "when not sni_contains then CLEAN",
+        "when pqc_hint != maybe then CLEAN",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestInlineParams(t *testing.T) {
+    set, err := Parse(strings.NewReader(strings.Join([]string{
+        "when sni_contains slow.example then LATENCY_50MS_JITTER_10 latency_ms=200 jitter_ms=50 jitter_distribution=normal",
+        "when ch_bytes > 1400 then MTU1300_BLACKHOLE threshold_bytes=1200 also_hold=2s",
+        "when pqc_hint == true then preset:slow-eu latency_ms=20",
+    }, "\n")))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    base := impair.Config{Profile: impair.ProfileClean, ThresholdBytes: 1300, LatencyMs: 10, BandwidthKbps: 512}
+    presets := func(name string) (impair.Config, bool) { return impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 150, JitterMs: 5}, name == "slow-eu" }
+
+    cfg, _ := set.Rules[0].Config(base, presets)
+    want := base
+    want.Profile, want.LatencyMs, want.JitterMs, want.JitterDistribution = impair.ProfileLatencyJitter, 200, 50, impair.JitterNormal
+    if cfg != want { t.Fatalf("latency rule: %+v, want %+v", cfg, want) }
+    if o := set.Rules[0].Overlay; o.LatencyMs != 200 || o.JitterMs != 50 || o.ThresholdBytes != 0 { t.Fatalf("overlay %+v", o) }
+
+    cfg, _ = set.Rules[1].Config(base, presets)
+    if cfg.Profile != impair.ProfileMTUBlackhole || cfg.ThresholdBytes != 1200 || cfg.LatencyMs != 10 || set.Rules[1].AlsoHold.Seconds() != 2 { t.Fatalf("blackhole rule: %+v", cfg) }
+    // over a preset: the preset's fields stay unless a parameter replaces them
+    cfg, _ = set.Rules[2].Config(base, presets)
+    if cfg.Profile != impair.ProfileLatencyJitter || cfg.LatencyMs != 20 || cfg.JitterMs != 5 { t.Fatalf("preset rule: %+v", cfg) }
+
+    for bad, want := range map[string]string{
+        "when ch_bytes > 1 then CLEAN latency_msec=5":              `unknown parameter "latency_msec=5"`,
+        "when ch_bytes > 1 then CLEAN latency_ms=fast":             `bad value in "latency_ms=fast"`,
+        "when ch_bytes > 1 then CLEAN latency_ms=-5":               "latency_ms",
+        "when ch_bytes > 1 then CLEAN profile=abort_after_ch":      "cannot be set inline",
+        "when ch_bytes > 1 then CLEAN latency_ms=5 latency_ms=6":   "given twice",
+    } {
+        _, err := Parse(strings.NewReader(bad))
+        if err == nil || !strings.Contains(err.Error(), want) || !strings.HasPrefix(err.Error(), "line 1: ") { t.Errorf("%q: err %v, want %q", bad, err, want) }
+    }
+}
+
+func TestFailureRampRuleUsesItsOwnRamp(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sni_contains flaky. then FAILURE_RAMP max_pct=40 ramp_minutes=10"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    ru := set.Rules[0]
+    ru.CreatedAt = time.Unix(1700000000, 0)
+    // the global profile is not a ramp, or ramps on other terms; neither leaks in
+    for _, base := range []impair.Config{
+        {Profile: impair.ProfileClean, UpdatedAt: time.Unix(1600000000, 0)},
+        {Profile: impair.ProfileFailureRamp, MaxPct: 100, RampMinutes: 1, RampShape: impair.RampExponential, UpdatedAt: time.Unix(1600000000, 0)},
+    } {
+        cfg, _ := ru.Config(base, nil)
+        if cfg.MaxPct != 40 || cfg.RampMinutes != 10 || cfg.RampShape != "" || !cfg.UpdatedAt.Equal(ru.CreatedAt) { t.Fatalf("over %s: %+v", base.Profile, cfg) }
+        if pct := cfg.FailureRampPct(ru.CreatedAt.Add(5 * time.Minute)); pct != 20 { t.Fatalf("over %s: ramp at 5m = %g%%, want 20%%", base.Profile, pct) }
+    }
+    for _, bad := range []string{
+        "when ch_bytes > 1 then FAILURE_RAMP",
+        "when ch_bytes > 1 then FAILURE_RAMP max_pct=50",
+        "when ch_bytes > 1 then FAILURE_RAMP ramp_minutes=5 ramp_shape=exponential",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "needs max_pct and ramp_minutes") { t.Errorf("%q: err %v", bad, err) }
+    }
+}
+
+func TestSrcIPIn(t *testing.T) {
+    set, err := Parse(strings.NewReader(strings.Join([]string{
+        "when src_ip_in 10.1.2.0/24,192.0.2.7 then ABORT_AFTER_CH",
+        "when src_ip_in 2001:DB8::/32 and sni_contains eu. then BANDWIDTH_1MBPS",
+        "when not src_ip_in 127.0.0.1,::1 then LATENCY_50MS_JITTER_10",
+    }, "\n")))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    tcp := func(s string) ConnInfo { return ConnInfo{RemoteAddr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))} }
+    eu := tlsinspect.Result{SNI: "eu.example.com"}
+    for _, c := range []struct{ conn ConnInfo; res tlsinspect.Result; want impair.ProfileName }{
+        {tcp("10.1.2.200:5000"), eu, impair.ProfileAbortAfterCH},
+        {tcp("[::ffff:10.1.2.3]:5000"), eu, impair.ProfileAbortAfterCH}, // IPv4-mapped
+        {tcp("192.0.2.7:1"), eu, impair.ProfileAbortAfterCH},
+        {tcp("192.0.2.8:1"), eu, impair.ProfileLatencyJitter},
+        {tcp("[2001:db8:5::1]:443"), eu, impair.ProfileBandwidthLimit},
+        {tcp("[2001:db8:5::1]:443"), tlsinspect.Result{SNI: "us.example.com"}, impair.ProfileLatencyJitter},
+        {tcp("127.0.0.1:9"), eu, ""},
+        {tcp("[::1]:9"), eu, ""},
+        {ConnInfo{RemoteAddr: &net.UDPAddr{IP: net.ParseIP("10.1.2.9"), Port: 53}}, eu, impair.ProfileAbortAfterCH},
+        {ConnInfo{}, eu, impair.ProfileLatencyJitter}, // no address: src_ip_in never matches
+    } {
+        r, _ := set.MatchRuleAt(c.res, c.conn, time.Now())
+        if r.Profile != c.want { t.Errorf("%v: got %q, want %q", c.conn.RemoteAddr, r.Profile, c.want) }
+    }
+    for _, bad := range []string{
+        "when src_ip_in 10.1.2.0/33 then CLEAN",
+        "when src_ip_in 10.1.2 then CLEAN",
+        "when src_ip_in 10.0.0.1, then CLEAN",
+        "when src_ip_in == 10.0.0.1 then CLEAN",
+        "when src_ip_in != 10.0.0.1 then CLEAN",
+        "when src_ip_in then CLEAN",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestPriority(t *testing.T) {
+    set, err := Parse(strings.NewReader(strings.Join([]string{
+        "when ch_bytes > 1400 then MTU1300_BLACKHOLE priority 10",
+        "when sni_contains example.com then LATENCY_50MS_JITTER_10",
+        "when ch_bytes > 1400 then ABORT_AFTER_CH priority 1",
+        "when sni_contains example.com then BANDWIDTH_1MBPS between 00:00-23:59 priority -1",
+        "when ch_bytes > 1400 then CLEAN priority 1 between 00:00-23:59",
+    }, "\n")))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    var order []int
+    for _, r := range set.Rules { order = append(order, r.Priority) }
+    if !slices.Equal(order, []int{-1, 0, 1, 1, 10}) { t.Fatalf("priorities in order %v", order) }
+    if set.Rules[2].Profile != impair.ProfileAbortAfterCH || set.Rules[3].Profile != impair.ProfileClean || set.Rules[3].Window == nil { t.Fatalf("ties out of line order: %+v %+v", set.Rules[2], set.Rules[3]) }
+    // the later rule with the lower priority number wins over the earlier one
+    if prof, _ := set.Match(tlsinspect.Result{HandshakeBytes: 1500}); prof != impair.ProfileAbortAfterCH { t.Fatalf("got %q", prof) }
+    // Source round-trips to the same order
+    again, err := Parse(strings.NewReader(set.Source()))
+    if err != nil || again.Source() != set.Source() { t.Fatalf("source round trip: %v\n%s", err, again.Source()) }
+    for _, bad := range []string{
+        "when ch_bytes > 1 then CLEAN priority high",
+        "when ch_bytes > 1 then CLEAN priority",
+        "when ch_bytes > 1 then CLEAN priority 1 priority 2",
+        "when ch_bytes > 1 then CLEAN priority 1 also_hold=1s",
+        "when ch_bytes > 1 then priority 1",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestSample(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sni_contains api.example then ABORT_AFTER_CH sample 20%\nwhen ch_bytes > 1400 then MTU1300_BLACKHOLE"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if set.Rules[0].Sample != 0.2 || set.Rules[1].Sample != 0 { t.Fatalf("sample rates %v %v", set.Rules[0].Sample, set.Rules[1].Sample) }
+    rng := mrand.New(mrand.NewSource(1))
+    set.Rand = rng.Float64
+    res := tlsinspect.Result{SNI: "api.example"}
+    selected := 0
+    for i := 0; i < 1000; i++ {
+        d := set.Decide(res, ConnInfo{}, time.Now())
+        r, ok, sampled := d.Reported()
+        if !ok || sampled == nil || r.Profile != impair.ProfileAbortAfterCH || *sampled != d.OK { t.Fatalf("reported %+v %v %v for %+v", r, ok, sampled, d) }
+        if d.OK { selected++ } else if len(d.SampledOut) != 1 { t.Fatalf("sampled out %d", len(d.SampledOut)) }
+    }
+    if selected < 160 || selected > 240 { t.Fatalf("selected %d of 1000 at 20%%", selected) }
+    // a connection sampled out falls through to the next matching rule
+    set.Rand = func() float64 { return 0.5 }
+    d := set.Decide(tlsinspect.Result{SNI: "api.example", HandshakeBytes: 1500}, ConnInfo{}, time.Now())
+    if !d.OK || d.Rule.Profile != impair.ProfileMTUBlackhole || len(d.SampledOut) != 1 { t.Fatalf("fall through: %+v", d) }
+    if _, _, sampled := d.Reported(); sampled != nil { t.Fatalf("unsampled rule reported as sampled") }
+    set.Rand = func() float64 { return 0.1999 }
+    if prof, _ := set.Match(res); prof != impair.ProfileAbortAfterCH { t.Fatalf("roll under the rate not selected: %q", prof) }
+    for _, bad := range []string{
+        "when ch_bytes > 1 then CLEAN sample 20",
+        "when ch_bytes > 1 then CLEAN sample 0%",
+        "when ch_bytes > 1 then CLEAN sample 120%",
+        "when ch_bytes > 1 then CLEAN sample 10% sample 20%",
+        "when ch_bytes > 1 then CLEAN sample 10% also_hold=1s",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+    if _, err := Parse(strings.NewReader("when ch_bytes > 1 then CLEAN also_hold=1s sample 12.5% priority 2 between 01:00-02:00")); err != nil { t.Fatalf("all suffixes: %v", err) }
+}
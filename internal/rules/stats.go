@@ -0,0 +1,106 @@
+package rules
+
+import (
+    "sync"
+    "time"
+)
+
+// SNI rate defaults: the sni_conn_rate window and how many names are tracked at once.
+const (
+    DefaultRateWindow = time.Minute
+    DefaultRateNames  = 10000
+)
+
+// rateBuckets is how many slices a window is counted in.
+const rateBuckets = 60
+
+// SNIRates counts connections per SNI over a sliding window (sni_conn_rate). Each
+// name has a ring of rateBuckets counters, one per window/rateBuckets slice of time,
+// so memory is bounded by the number of names; when that reaches its limit, names
+// with nothing in the window go first, then the least recently seen. Safe for
+// concurrent use.
+type SNIRates struct {
+    mu       sync.Mutex
+    width    int64 // nanoseconds per bucket
+    maxNames int
+    names    map[string]*rateRing
+    now      func() time.Time
+}
+
+// rateRing is one name's counters: counts[i] belongs to time slice slots[i].
+type rateRing struct {
+    counts [rateBuckets]int
+    slots  [rateBuckets]int64
+    last   int64 // slice of the latest Add
+}
+
+// NewSNIRates counts over window (0 = DefaultRateWindow), tracking at most maxNames
+// names (0 = DefaultRateNames).
+func NewSNIRates(window time.Duration, maxNames int) *SNIRates {
+    if window <= 0 { window = DefaultRateWindow }
+    if maxNames <= 0 { maxNames = DefaultRateNames }
+    width := int64(window) / rateBuckets
+    if width < 1 { width = 1 }
+    return &SNIRates{width: width, maxNames: maxNames, names: map[string]*rateRing{}, now: time.Now}
+}
+
+// Add counts a connection for sni (case-insensitive, trailing dot ignored) and returns
+// the connections for it in the window, this one included. An empty sni is not counted
+// and returns 0.
+func (s *SNIRates) Add(sni string) int {
+    if sni == "" { return 0 }
+    sni = sniHost(sni)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    slot := s.now().UnixNano() / s.width
+    r := s.names[sni]
+    if r == nil {
+        if len(s.names) >= s.maxNames { s.evict(slot) }
+        r = &rateRing{}
+        s.names[sni] = r
+    }
+    i := slot % rateBuckets
+    if r.slots[i] != slot { r.slots[i], r.counts[i] = slot, 0 }
+    r.counts[i]++
+    r.last = slot
+    return r.sum(slot)
+}
+
+// Rate returns the connections counted for sni in the window.
+func (s *SNIRates) Rate(sni string) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    r := s.names[sniHost(sni)]
+    if r == nil { return 0 }
+    return r.sum(s.now().UnixNano() / s.width)
+}
+
+// Len returns how many names are tracked.
+func (s *SNIRates) Len() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.names)
+}
+
+// sum adds up the buckets inside the window ending at slot.
+func (r *rateRing) sum(slot int64) int {
+    n := 0
+    for i, c := range r.counts {
+        if r.slots[i] > slot-rateBuckets && r.slots[i] <= slot { n += c }
+    }
+    return n
+}
+
+// evict makes room for one name: every name idle for a whole window, else the least
+// recently seen one.
+func (s *SNIRates) evict(slot int64) {
+    var oldest string
+    for name, r := range s.names {
+        if r.last <= slot-rateBuckets {
+            delete(s.names, name)
+            continue
+        }
+        if oldest == "" || r.last < s.names[oldest].last { oldest = name }
+    }
+    if len(s.names) >= s.maxNames { delete(s.names, oldest) }
+}
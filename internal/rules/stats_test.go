@@ -0,0 +1,88 @@
+package rules
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/tlsinspect"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestSNIRatesWindow(t *testing.T) {
+    clk := &fakeClock{time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+    r := NewSNIRates(time.Minute, 0)
+    r.now = clk.now
+    for i := 1; i <= 5; i++ {
+        if n := r.Add("API.example."); n != i { t.Fatalf("add %d: rate %d", i, n) }
+        clk.t = clk.t.Add(10 * time.Second)
+    }
+    // names are case-insensitive, trailing dot ignored
+    if n := r.Rate("api.example"); n != 5 { t.Fatalf("rate %d", n) }
+    if n := r.Add(""); n != 0 || r.Len() != 1 { t.Fatalf("empty sni counted: %d, %d names", n, r.Len()) }
+    // at 12:01:00 the first connection (12:00:00) has left the window
+    clk.t = clk.t.Add(10 * time.Second)
+    if n := r.Rate("api.example"); n != 4 { t.Fatalf("after a minute: rate %d", n) }
+    clk.t = clk.t.Add(40 * time.Second)
+    if n := r.Rate("api.example"); n != 0 { t.Fatalf("after the window: rate %d", n) }
+    // buckets reused after wrapping around the ring start from zero
+    if n := r.Add("api.example"); n != 1 { t.Fatalf("after wrap: rate %d", n) }
+}
+
+func TestSNIRatesBounded(t *testing.T) {
+    clk := &fakeClock{time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+    r := NewSNIRates(time.Minute, 3)
+    r.now = clk.now
+    for _, name := range []string{"a", "b", "c"} {
+        r.Add(name)
+        clk.t = clk.t.Add(time.Second)
+    }
+    r.Add("a")
+    r.Add("d") // evicts b, the least recently seen
+    if r.Len() != 3 || r.Rate("b") != 0 || r.Rate("a") != 2 || r.Rate("d") != 1 { t.Fatalf("eviction: %d names, a=%d b=%d d=%d", r.Len(), r.Rate("a"), r.Rate("b"), r.Rate("d")) }
+    // names idle for a whole window all go at once
+    clk.t = clk.t.Add(2 * time.Minute)
+    r.Add("e")
+    if r.Len() != 1 { t.Fatalf("%d names after idle eviction", r.Len()) }
+}
+
+func TestSNIRatesConcurrent(t *testing.T) {
+    r := NewSNIRates(time.Hour, 0)
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 500; i++ { r.Add(fmt.Sprintf("host%d.example", i%4)) }
+        }(g)
+    }
+    wg.Wait()
+    for i := 0; i < 4; i++ {
+        if n := r.Rate(fmt.Sprintf("host%d.example", i)); n != 1000 { t.Fatalf("host%d: rate %d", i, n) }
+    }
+}
+
+func TestSNIConnRateRule(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sni_conn_rate > 3 then BANDWIDTH_1MBPS"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    clk := &fakeClock{time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+    rates := NewSNIRates(time.Minute, 0)
+    rates.now = clk.now
+    var got []impair.ProfileName
+    for i := 0; i < 5; i++ {
+        res := tlsinspect.Result{SNI: "burst.example"}
+        prof, _ := set.MatchRuleAt(res, ConnInfo{SNIRate: rates.Add(res.SNI)}, clk.t)
+        got = append(got, prof.Profile)
+        clk.t = clk.t.Add(time.Second)
+    }
+    if fmt.Sprint(got) != "[   BANDWIDTH_1MBPS BANDWIDTH_1MBPS]" { t.Fatalf("profiles %q", got) }
+    // other names are counted separately
+    if r, ok := set.MatchRuleAt(tlsinspect.Result{SNI: "quiet.example"}, ConnInfo{SNIRate: rates.Add("quiet.example")}, clk.t); ok { t.Fatalf("quiet name matched %q", r.Raw) }
+    if _, err := Parse(strings.NewReader("when sni_conn_rate > many then CLEAN")); err == nil { t.Fatalf("expected error") }
+}
@@ -0,0 +1,204 @@
+package rules
+
+import (
+    "slices"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/tlsinspect"
+)
+
+// Counter counts a rule's live matches (Store.Match).
+type Counter struct {
+    hits atomic.Int64
+    last atomic.Int64 // unix nanoseconds of the latest match, 0 before the first
+}
+
+func (c *Counter) hit(now time.Time) {
+    c.hits.Add(1)
+    c.last.Store(now.UnixNano())
+}
+
+func (c *Counter) lastMatch() time.Time {
+    if ns := c.last.Load(); ns != 0 { return time.Unix(0, ns) }
+    return time.Time{}
+}
+
+func (c *Counter) reset() {
+    c.hits.Store(0)
+    c.last.Store(0)
+}
+
+// Store holds the active rule Set. Live matches and reloads are serialized with a
+// RWMutex so a hit is always counted on a counter that survives the swap: rules whose
+// Raw text is unchanged keep their counter objects across Replace.
+type Store struct {
+    mu       sync.RWMutex
+    set      Set
+    source   string    // SourceAPI, SourceFile or SourceConfig
+    loadedAt time.Time // last Replace
+}
+
+// RuleCount is a rule's raw text with its hit counter value.
+type RuleCount struct {
+    Raw  string `json:"raw"`
+    Hits int64  `json:"hits"`
+}
+
+// ReloadReport describes how counters were carried across a Replace.
+type ReloadReport struct {
+    Loaded      int         `json:"loaded"`
+    CarriedOver []RuleCount `json:"carried_over"`
+    New         []string    `json:"new"`
+    Removed     []RuleCount `json:"removed"` // final counts of rules no longer present
+}
+
+// Load returns the active Set. Matching on it directly (e.g. dry runs) does not count hits.
+func (s *Store) Load() Set {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.set
+}
+
+// Match evaluates the active Set and counts a hit on the matched rule. Connection
+// conditions (src_ip_in) do not match; see MatchConn.
+func (s *Store) Match(res tlsinspect.Result) (Rule, bool) {
+    return s.MatchConn(res, ConnInfo{})
+}
+
+// MatchConn is Match for a connection described by conn.
+func (s *Store) MatchConn(res tlsinspect.Result, conn ConnInfo) (Rule, bool) {
+    d := s.Decide(res, conn)
+    return d.Rule, d.OK
+}
+
+// Decide evaluates the active Set for a connection described by conn and counts a hit
+// on the rule it applies (not on sampled rules that lost their roll).
+func (s *Store) Decide(res tlsinspect.Result, conn ConnInfo) Decision {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    d := s.set.Decide(res, conn, time.Now())
+    if d.OK && d.Rule.Counter != nil {
+        d.Rule.Counter.hit(time.Now())
+    }
+    return d
+}
+
+// Shadow evaluates res against the set as a shadow set (loaded to be watched, not
+// enforced): a matched rule counts a hit as in Match, and the result is the action
+// the set would take, fallback when no rule matches. It is "" when the set is empty.
+func (s *Store) Shadow(res tlsinspect.Result, conn ConnInfo, fallback impair.ProfileName) string {
+    s.mu.RLock()
+    empty := len(s.set.Rules) == 0
+    s.mu.RUnlock()
+    if empty { return "" }
+    if r, ok := s.MatchConn(res, conn); ok { return r.Action() }
+    return string(fallback)
+}
+
+// Promote replaces the active set with shadow's, which is left empty. The promoted
+// rules start with fresh counters unless Replace carries them over from the active
+// set. ok is false, and nothing changes, when shadow has no rules.
+func (s *Store) Promote(shadow *Store) (rep ReloadReport, ok bool) {
+    shadow.mu.Lock()
+    defer shadow.mu.Unlock()
+    if len(shadow.set.Rules) == 0 { return ReloadReport{}, false }
+    next := Set{Rules: make([]Rule, len(shadow.set.Rules))}
+    for i, r := range shadow.set.Rules {
+        r.Counter = nil
+        next.Rules[i] = r
+    }
+    shadow.set = Set{}
+    return s.Replace(next), true
+}
+
+// Origin returns where the active set came from (SourceAPI, SourceFile or
+// SourceConfig) and when it was installed; both are zero before the first Replace.
+func (s *Store) Origin() (source string, loadedAt time.Time) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.source, s.loadedAt
+}
+
+// Replace installs next, carrying over hit counters for rules whose Raw text is
+// unchanged (duplicates pair up in order), and reports carried/new/removed rules.
+func (s *Store) Replace(next Set) ReloadReport {
+    return s.ReplaceFrom(next, SourceAPI)
+}
+
+// ReplaceFrom is Replace recording source as the origin of the set.
+func (s *Store) ReplaceFrom(next Set, source string) ReloadReport {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.source, s.loadedAt = source, time.Now()
+    old := make(map[string][]Rule)
+    for _, r := range s.set.Rules {
+        if r.Counter != nil {
+            old[r.Raw] = append(old[r.Raw], r)
+        }
+    }
+    now := time.Now()
+    rep := ReloadReport{Loaded: len(next.Rules), CarriedOver: []RuleCount{}, New: []string{}, Removed: []RuleCount{}}
+    for i := range next.Rules {
+        r := &next.Rules[i]
+        if prev := old[r.Raw]; len(prev) > 0 {
+            r.Counter = prev[0].Counter
+            if r.CreatedAt.IsZero() { r.CreatedAt = prev[0].CreatedAt }
+            old[r.Raw] = prev[1:]
+            rep.CarriedOver = append(rep.CarriedOver, RuleCount{Raw: r.Raw, Hits: r.HitCount()})
+            continue
+        }
+        if r.Counter == nil {
+            r.Counter = new(Counter)
+        }
+        if r.CreatedAt.IsZero() { r.CreatedAt = now }
+        rep.New = append(rep.New, r.Raw)
+    }
+    for _, r := range s.set.Rules {
+        if slices.ContainsFunc(old[r.Raw], func(o Rule) bool { return o.Counter == r.Counter }) {
+            rep.Removed = append(rep.Removed, RuleCount{Raw: r.Raw, Hits: r.HitCount()})
+        }
+    }
+    s.set = next
+    return rep
+}
+
+// RuleStats is one rule's entry in GET /rules/stats.
+type RuleStats struct {
+    ID        string     `json:"id"`
+    Raw       string     `json:"raw"`
+    Matches   int64      `json:"matches"`
+    LastMatch *time.Time `json:"last_match"` // null until the rule first matches
+    Window    string     `json:"window,omitempty"` // "between" window, HH:MM-HH:MM UTC
+    Active    bool       `json:"active"`           // the rule can match now (outside its window it cannot)
+}
+
+// Stats returns the live match counters of the active rules, in rule order.
+func (s *Store) Stats() []RuleStats {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    out := make([]RuleStats, 0, len(s.set.Rules))
+    now := time.Now()
+    for _, r := range s.set.Rules {
+        st := RuleStats{ID: r.ID, Raw: r.Raw, Matches: r.HitCount(), Active: r.ActiveAt(now)}
+        if r.Window != nil { st.Window = r.Window.String() }
+        if t := r.LastMatch(); !t.IsZero() {
+            st.LastMatch = &t
+        }
+        out = append(out, st)
+    }
+    return out
+}
+
+// ResetCounters zeroes the match counters of the active rules.
+func (s *Store) ResetCounters() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, r := range s.set.Rules {
+        if r.Counter != nil {
+            r.Counter.reset()
+        }
+    }
+}
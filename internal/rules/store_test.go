@@ -0,0 +1,129 @@
+package rules
+
+import (
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/tlsinspect"
+)
+
+func mustParse(t *testing.T, src string) Set {
+    t.Helper()
+    set, err := Parse(strings.NewReader(src))
+    if err != nil { t.Fatalf("parse: %v", err) }
+    return set
+}
+
+func TestStoreReplaceReport(t *testing.T) {
+    var s Store
+    s.Replace(mustParse(t, "when ch_bytes > 100 then CLEAN\nwhen sni_contains old.example then ABORT_AFTER_CH"))
+    s.Match(tlsinspect.Result{HandshakeBytes: 200})
+    s.Match(tlsinspect.Result{HandshakeBytes: 200})
+    s.Match(tlsinspect.Result{SNI: "old.example"})
+    rep := s.Replace(mustParse(t, "when ch_bytes > 100 then CLEAN\nwhen sni_contains new.example then ABORT_AFTER_CH"))
+    if rep.Loaded != 2 { t.Fatalf("loaded %d", rep.Loaded) }
+    if len(rep.CarriedOver) != 1 || rep.CarriedOver[0].Raw != "when ch_bytes > 100 then CLEAN" || rep.CarriedOver[0].Hits != 2 { t.Fatalf("carried %#v", rep.CarriedOver) }
+    if len(rep.New) != 1 || rep.New[0] != "when sni_contains new.example then ABORT_AFTER_CH" { t.Fatalf("new %#v", rep.New) }
+    if len(rep.Removed) != 1 || rep.Removed[0].Hits != 1 { t.Fatalf("removed %#v", rep.Removed) }
+    if got := s.Load().Rules[0].HitCount(); got != 2 { t.Fatalf("carried counter = %d", got) }
+    if got := s.Load().Rules[1].HitCount(); got != 0 { t.Fatalf("new counter = %d", got) }
+}
+
+func TestStoreDryRunDoesNotCount(t *testing.T) {
+    var s Store
+    s.Replace(mustParse(t, "when ch_bytes > 100 then CLEAN"))
+    s.Load().Match(tlsinspect.Result{HandshakeBytes: 200})
+    if got := s.Load().Rules[0].HitCount(); got != 0 { t.Fatalf("dry run counted: %d", got) }
+}
+
+func TestStoreReloadMidTrafficKeepsCounts(t *testing.T) {
+    var s Store
+    const kept = "when ch_bytes > 100 then CLEAN"
+    a := kept + "\nwhen sni_contains a.example then ABORT_AFTER_CH"
+    b := "when sni_contains b.example then ABORT_AFTER_CH\n" + kept
+    s.Replace(mustParse(t, a))
+    // Workers keep matching until the reloader has swapped the set many times.
+    var reloaded atomic.Bool
+    var total atomic.Int64
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(){
+            defer wg.Done()
+            for j := 0; !reloaded.Load() || j < 500; j++ {
+                if _, ok := s.Match(tlsinspect.Result{HandshakeBytes: 500}); !ok { t.Errorf("no match"); return }
+                total.Add(1)
+            }
+        }()
+    }
+    for n := 0; n < 200; n++ {
+        src := a
+        if n%2 == 0 { src = b }
+        s.Replace(mustParse(t, src))
+    }
+    reloaded.Store(true)
+    wg.Wait()
+    for _, r := range s.Load().Rules {
+        if r.Raw == kept && r.HitCount() != total.Load() {
+            t.Fatalf("kept rule counted %d hits, want %d", r.HitCount(), total.Load())
+        }
+    }
+}
+
+func TestStoreStats(t *testing.T) {
+    var s Store
+    s.Replace(mustParse(t, "id:big when ch_bytes > 100 then CLEAN\nwhen sni_contains a.example then ABORT_AFTER_CH\nwhen pqc_hint == true then CLEAN"))
+    before := time.Now()
+    for i := 0; i < 3; i++ { s.Match(tlsinspect.Result{HandshakeBytes: 200}) }
+    s.Match(tlsinspect.Result{SNI: "a.example"})
+    s.Match(tlsinspect.Result{SNI: "other.example"}) // no rule
+    st := s.Stats()
+    if len(st) != 3 { t.Fatalf("stats %+v", st) }
+    if st[0].ID != "big" || st[0].Raw != "id:big when ch_bytes > 100 then CLEAN" || st[0].Matches != 3 { t.Fatalf("rule 0: %+v", st[0]) }
+    if st[1].Matches != 1 || st[1].LastMatch == nil || st[1].LastMatch.Before(before) { t.Fatalf("rule 1: %+v", st[1]) }
+    if len(st[1].ID) != 8 { t.Fatalf("derived id %q", st[1].ID) }
+    if st[2].Matches != 0 || st[2].LastMatch != nil { t.Fatalf("rule 2: %+v", st[2]) }
+    // IDs are stable across parses and reloads
+    if again := mustParse(t, "when sni_contains a.example then ABORT_AFTER_CH"); again.Rules[0].ID != st[1].ID { t.Fatalf("id %q then %q", st[1].ID, again.Rules[0].ID) }
+    s.ResetCounters()
+    if st := s.Stats(); st[0].Matches != 0 || st[1].LastMatch != nil { t.Fatalf("after reset: %+v", st) }
+}
+
+func TestRuleIDs(t *testing.T) {
+    set := mustParse(t, "when ch_bytes > 1 then CLEAN\nwhen ch_bytes > 1 then CLEAN\nID:Slow-EU when ch_bytes > 2 then CLEAN")
+    if set.Rules[1].ID != set.Rules[0].ID+"-2" || set.Rules[2].ID != "slow-eu" { t.Fatalf("ids %q %q %q", set.Rules[0].ID, set.Rules[1].ID, set.Rules[2].ID) }
+    if set.Rules[2].Raw != "ID:Slow-EU when ch_bytes > 2 then CLEAN" { t.Fatalf("raw %q", set.Rules[2].Raw) }
+    for _, bad := range []string{"id:a when ch_bytes > 1 then CLEAN\nid:a when ch_bytes > 2 then CLEAN", "id:a/b when ch_bytes > 1 then CLEAN", "id: when ch_bytes > 1 then CLEAN"} {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
+
+func TestShadowSet(t *testing.T) {
+    var active, shadow Store
+    active.Replace(mustParse(t, "when sni_contains a.example then MTU1300_BLACKHOLE\nwhen ch_bytes > 100 then CLEAN"))
+    if got := shadow.Shadow(tlsinspect.Result{SNI: "a.example"}, ConnInfo{}, impair.ProfileClean); got != "" { t.Fatalf("empty shadow set decided %q", got) }
+    shadow.Replace(mustParse(t, "when sni_contains a.example then ABORT_AFTER_CH"))
+
+    // a connection both sets match differently: the active rule applies, the shadow one is reported
+    res := tlsinspect.Result{SNI: "a.example"}
+    ru, ok := active.Match(res)
+    if !ok { t.Fatalf("active set did not match") }
+    cfg, _ := ru.Config(impair.Config{Profile: impair.ProfileLatencyJitter}, nil)
+    if cfg.Profile != impair.ProfileMTUBlackhole { t.Fatalf("applied %s", cfg.Profile) }
+    if got := shadow.Shadow(res, ConnInfo{}, impair.ProfileLatencyJitter); got != string(impair.ProfileAbortAfterCH) { t.Fatalf("shadow decided %q", got) }
+    // no shadow rule matches: the shadow decision is the global profile
+    if got := shadow.Shadow(tlsinspect.Result{HandshakeBytes: 500}, ConnInfo{}, impair.ProfileLatencyJitter); got != string(impair.ProfileLatencyJitter) { t.Fatalf("shadow fallback %q", got) }
+    if st := shadow.Stats(); st[0].Matches != 1 { t.Fatalf("shadow hits %d", st[0].Matches) }
+    if st := active.Stats(); st[0].Matches != 1 { t.Fatalf("active hits %d", st[0].Matches) }
+
+    rep, ok := active.Promote(&shadow)
+    if !ok || rep.Loaded != 1 || len(rep.Removed) != 2 { t.Fatalf("promote %v %+v", ok, rep) }
+    if prof, _ := active.Match(res); prof.Profile != impair.ProfileAbortAfterCH { t.Fatalf("after promote: %s", prof.Profile) }
+    if st := active.Stats(); st[0].Matches != 1 { t.Fatalf("promoted rule counted %d, want only its live hit", st[0].Matches) }
+    if len(shadow.Load().Rules) != 0 { t.Fatalf("shadow set not emptied") }
+    if _, ok := active.Promote(&shadow); ok { t.Fatalf("promoted an empty shadow set") }
+}
@@ -0,0 +1,79 @@
+package rules
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+)
+
+// DefaultPollInterval is how often PollFile looks at the rules file (-rules-poll).
+const DefaultPollInterval = 2 * time.Second
+
+// Where the active rules came from, for GET /rules.
+const (
+    SourceAPI    = "api"
+    SourceFile   = "file"
+    SourceConfig = "config" // the server config file (-config)
+)
+
+// LoadFile parses the rules file at path: rule text, or a JSON rule set (ParseJSON)
+// when the name ends in .json.
+func LoadFile(path string) (Set, error) {
+    f, err := os.Open(path)
+    if err != nil { return Set{}, err }
+    defer f.Close()
+    parse := Parse
+    if strings.HasSuffix(path, ".json") { parse = ParseJSON }
+    set, err := parse(f)
+    if err != nil { return Set{}, fmt.Errorf("%s: %w", path, err) }
+    return set, nil
+}
+
+// fileStamp is what PollFile compares to notice a change.
+type fileStamp struct {
+    mtime time.Time
+    size  int64
+}
+
+func statFile(path string) (fileStamp, error) {
+    fi, err := os.Stat(path)
+    if err != nil { return fileStamp{}, err }
+    return fileStamp{fi.ModTime(), fi.Size()}, nil
+}
+
+// PollFile checks the rules file at path every interval until ctx is done, and calls
+// apply with the parsed rules whenever its modification time or size has changed
+// since the previous check (the first check compares against the file as it is when
+// PollFile starts). A change is loaded once two checks in a row see it, so a file
+// caught halfway through an in-place save is not applied. A version that cannot be read or parsed is reported through logf
+// and skipped: apply is not called and the active rules stay until the next change.
+func PollFile(ctx context.Context, path string, interval time.Duration, apply func(Set), logf func(format string, args ...any)) {
+    last, _ := statFile(path)
+    var pending fileStamp // a change seen by one check, loaded if the next sees it too
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+        st, err := statFile(path)
+        if err != nil {
+            if last != (fileStamp{}) { logf("rules file %s: %v (keeping the active rules)", path, err) }
+            last, pending = fileStamp{}, fileStamp{}
+            continue
+        }
+        if st == last { pending = fileStamp{}; continue }
+        if st != pending { pending = st; continue } // may still be being written
+        last, pending = st, fileStamp{}
+        set, err := LoadFile(path)
+        if err != nil {
+            logf("rules file not reloaded, keeping the active rules: %v", err)
+            continue
+        }
+        apply(set)
+    }
+}
@@ -0,0 +1,59 @@
+package rules
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestPollFileReloadsAndKeepsRulesOnBadEdit(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "rules.txt")
+    write := func(src string, age time.Duration) {
+        if err := os.WriteFile(path, []byte(src), 0o644); err != nil { t.Fatal(err) }
+        mt := time.Now().Add(-age) // distinct mtimes even on coarse filesystem clocks
+        if err := os.Chtimes(path, mt, mt); err != nil { t.Fatal(err) }
+    }
+    write("when ch_bytes > 1 then CLEAN\n", 3*time.Minute)
+    set, err := LoadFile(path)
+    if err != nil || len(set.Rules) != 1 { t.Fatalf("initial load: %v %v", set, err) }
+    var s Store
+    s.ReplaceFrom(set, SourceFile)
+
+    applied := make(chan Set, 4)
+    logged := make(chan string, 4)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go PollFile(ctx, path, 10*time.Millisecond, func(set Set) { s.ReplaceFrom(set, SourceFile); applied <- set },
+        func(format string, args ...any) { logged <- fmt.Sprintf(format, args...) })
+    time.Sleep(30 * time.Millisecond) // let it take its first stamp
+
+    write("when ch_bytes > 1 then CLEAN\nwhen sni_contains a.example then ABORT_AFTER_CH\n", 2*time.Minute)
+    select {
+    case set := <-applied:
+        if len(set.Rules) != 2 { t.Fatalf("reloaded %d rules", len(set.Rules)) }
+    case <-time.After(2 * time.Second):
+        t.Fatalf("change not picked up")
+    }
+    // a broken edit is reported and leaves the active rules alone
+    write("when ch_bytes >>> then CLEAN\n", time.Minute)
+    select {
+    case msg := <-logged:
+        if want := "line 1"; !strings.Contains(msg, want) { t.Fatalf("log %q lacks %q", msg, want) }
+    case set := <-applied:
+        t.Fatalf("broken file applied: %v", set)
+    case <-time.After(2 * time.Second):
+        t.Fatalf("broken edit not reported")
+    }
+    time.Sleep(50 * time.Millisecond)
+    if n := len(s.Load().Rules); n != 2 { t.Fatalf("active rules after a bad edit: %d", n) }
+    if src, at := s.Origin(); src != SourceFile || at.IsZero() { t.Fatalf("origin %q %v", src, at) }
+    select {
+    case set := <-applied:
+        t.Fatalf("unchanged broken file applied: %v", set)
+    default:
+    }
+}
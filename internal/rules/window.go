@@ -0,0 +1,37 @@
+package rules
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Window is the daily UTC time range a rule with a "between HH:MM-HH:MM" suffix is
+// active in, start included, end excluded. An end before the start wraps past
+// midnight: 23:00-01:00 is active from 23:00 to 01:00 the next day.
+type Window struct {
+    Start, End int // minutes after midnight UTC
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+    t = t.UTC()
+    m := t.Hour()*60 + t.Minute()
+    if w.Start < w.End { return m >= w.Start && m < w.End }
+    return m >= w.Start || m < w.End
+}
+
+func (w Window) String() string {
+    return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// parseWindow parses HH:MM-HH:MM.
+func parseWindow(v string) (Window, error) {
+    from, to, ok := strings.Cut(v, "-")
+    start, err1 := time.Parse("15:04", from)
+    end, err2 := time.Parse("15:04", to)
+    if !ok || err1 != nil || err2 != nil { return Window{}, fmt.Errorf("bad time window %q, want HH:MM-HH:MM", v) }
+    w := Window{Start: start.Hour()*60 + start.Minute(), End: end.Hour()*60 + end.Minute()}
+    if w.Start == w.End { return Window{}, fmt.Errorf("empty time window %q", v) }
+    return w, nil
+}
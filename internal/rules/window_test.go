@@ -0,0 +1,46 @@
+package rules
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+    "pathlab/internal/tlsinspect"
+)
+
+func at(hhmm string) time.Time {
+    t, _ := time.Parse("2006-01-02 15:04", "2026-03-01 "+hhmm)
+    return t
+}
+
+func TestBetweenWindow(t *testing.T) {
+    set, err := Parse(strings.NewReader("when sni_contains api.example then ABORT_AFTER_CH between 02:00-03:00\nwhen sni_contains api.example then MTU1300_BLACKHOLE threshold_bytes=1200 between 23:00-01:00\nwhen sni_contains api.example then CLEAN"))
+    if err != nil { t.Fatalf("parse failed: %v", err) }
+    if w := set.Rules[1].Window; w == nil || w.String() != "23:00-01:00" || set.Rules[2].Window != nil { t.Fatalf("windows %v %v", w, set.Rules[2].Window) }
+    if cfg, _ := set.Rules[1].Config(impair.Config{}, nil); cfg.ThresholdBytes != 1200 { t.Fatalf("params lost with a window: %+v", cfg) }
+    res := tlsinspect.Result{SNI: "api.example"}
+    for _, c := range []struct{ at string; want impair.ProfileName }{
+        {"01:59", impair.ProfileClean},
+        {"02:00", impair.ProfileAbortAfterCH},
+        {"02:59", impair.ProfileAbortAfterCH},
+        {"03:00", impair.ProfileClean},
+        {"22:59", impair.ProfileClean},
+        {"23:00", impair.ProfileMTUBlackhole},
+        {"00:30", impair.ProfileMTUBlackhole}, // across midnight
+        {"01:00", impair.ProfileClean},
+    } {
+        if r, _ := set.MatchRuleAt(res, ConnInfo{}, at(c.at)); r.Profile != c.want { t.Errorf("%s: got %q, want %q", c.at, r.Profile, c.want) }
+    }
+    // the window is UTC whatever the location of the time given
+    if !set.Rules[0].ActiveAt(at("02:30").In(time.FixedZone("X", 5*3600))) { t.Fatalf("window not evaluated in UTC") }
+    for _, bad := range []string{
+        "when ch_bytes > 1 then CLEAN between 2am-3am",
+        "when ch_bytes > 1 then CLEAN between 24:00-01:00",
+        "when ch_bytes > 1 then CLEAN between 02:00-02:00",
+        "when ch_bytes > 1 then CLEAN between 02:00",
+        "when ch_bytes > 1 then CLEAN between 02:00-03:00 also_hold=1s",
+    } {
+        if _, err := Parse(strings.NewReader(bad)); err == nil { t.Errorf("expected error for %q", bad) }
+    }
+}
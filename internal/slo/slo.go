@@ -0,0 +1,198 @@
+// Package slo watches the unimpaired baseline: handshake durations of CLEAN
+// connections (ClientHello forwarded to first upstream byte) are kept for a rolling
+// window, and when their p95 exceeds the configured objective the tracker reports a
+// violation, so a degraded lab upstream is not mistaken for the impairment under test.
+package slo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for fields left unset in Config.
+const (
+	DefaultWindow     = 5 * time.Minute
+	DefaultMinSamples = 20
+	// maxSamples bounds memory under heavy traffic; the oldest samples go first.
+	maxSamples = 10000
+)
+
+// Alert states.
+const (
+	StateViolation = "slo_violation"
+	StateRecovered = "slo_recovered"
+)
+
+// Config sets the objective. SLOMs of 0 disables tracking.
+type Config struct {
+	SLOMs      float64 `json:"slo_ms"`                // p95 handshake duration objective
+	Window     string  `json:"window,omitempty"`      // rolling window as a Go duration (default 5m)
+	MinSamples int     `json:"min_samples,omitempty"` // samples needed in the window before p95 is judged (default 20)
+}
+
+// Alert is emitted when the p95 crosses the objective in either direction.
+type Alert struct {
+	State   string    `json:"state"` // slo_violation or slo_recovered
+	At      time.Time `json:"at"`
+	P95Ms   float64   `json:"p95_ms"`
+	SLOMs   float64   `json:"slo_ms"`
+	Samples int       `json:"samples"`
+	Window  string    `json:"window"`
+}
+
+// Violation describes an ongoing violation in Status.
+type Violation struct {
+	Since time.Time `json:"since"`
+	P95Ms float64   `json:"p95_ms"` // p95 when the violation started
+	SLOMs float64   `json:"slo_ms"`
+}
+
+// Status is the GET /slo view.
+type Status struct {
+	Config
+	Enabled      bool       `json:"enabled"`
+	Samples      int        `json:"samples"`
+	P50Ms        float64    `json:"p50_ms"`
+	P95Ms        float64    `json:"p95_ms"`
+	MaxMs        float64    `json:"max_ms"`
+	Violation    *Violation `json:"slo_violation,omitempty"`
+	AlertsFired  int64      `json:"alerts_fired"`
+	LastObserved *time.Time `json:"last_observed,omitempty"`
+}
+
+type sample struct {
+	at time.Time
+	d  time.Duration
+}
+
+// Tracker aggregates handshake durations. Safe for concurrent use.
+type Tracker struct {
+	mu        sync.Mutex
+	cfg       Config
+	window    time.Duration
+	min       int
+	samples   []sample // in observation order
+	violation *Violation
+	alerts    int64
+}
+
+// New returns a tracker with cfg applied.
+func New(cfg Config) (*Tracker, error) {
+	t := &Tracker{}
+	if err := t.Configure(cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Configure replaces the objective. Collected samples are kept; an ongoing violation
+// is re-judged against the new threshold on the next observation.
+func (t *Tracker) Configure(cfg Config) error {
+	if cfg.SLOMs < 0 || math.IsNaN(cfg.SLOMs) {
+		return errors.New("slo_ms must be >= 0")
+	}
+	window := DefaultWindow
+	if cfg.Window != "" {
+		d, err := time.ParseDuration(cfg.Window)
+		if err != nil {
+			return fmt.Errorf("window: %w", err)
+		}
+		if d <= 0 {
+			return errors.New("window must be positive")
+		}
+		window = d
+	}
+	if cfg.MinSamples < 0 {
+		return errors.New("min_samples must be >= 0")
+	}
+	min := cfg.MinSamples
+	if min == 0 {
+		min = DefaultMinSamples
+	}
+	cfg.Window, cfg.MinSamples = window.String(), min
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cfg, t.window, t.min = cfg, window, min
+	if cfg.SLOMs == 0 {
+		t.violation = nil
+	}
+	return nil
+}
+
+// Observe records a handshake duration seen at at and returns an alert when the
+// window's p95 moves across the objective. Samples are expected in time order.
+func (t *Tracker) Observe(d time.Duration, at time.Time) *Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, sample{at: at, d: d})
+	if len(t.samples) > maxSamples {
+		t.samples = append(t.samples[:0], t.samples[len(t.samples)-maxSamples:]...)
+	}
+	t.pruneLocked(at)
+	if t.cfg.SLOMs == 0 || len(t.samples) < t.min {
+		return nil
+	}
+	p95 := ms(t.quantileLocked(0.95))
+	switch over := p95 > t.cfg.SLOMs; {
+	case over && t.violation == nil:
+		t.violation = &Violation{Since: at, P95Ms: p95, SLOMs: t.cfg.SLOMs}
+		return t.alertLocked(StateViolation, at, p95)
+	case !over && t.violation != nil:
+		t.violation = nil
+		return t.alertLocked(StateRecovered, at, p95)
+	}
+	return nil
+}
+
+func (t *Tracker) alertLocked(state string, at time.Time, p95 float64) *Alert {
+	t.alerts++
+	return &Alert{State: state, At: at, P95Ms: p95, SLOMs: t.cfg.SLOMs, Samples: len(t.samples), Window: t.cfg.Window}
+}
+
+// Status summarizes the samples still inside the window at now.
+func (t *Tracker) Status(now time.Time) Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneLocked(now)
+	st := Status{Config: t.cfg, Enabled: t.cfg.SLOMs > 0, Samples: len(t.samples), AlertsFired: t.alerts}
+	if n := len(t.samples); n > 0 {
+		st.P50Ms = ms(t.quantileLocked(0.5))
+		st.P95Ms = ms(t.quantileLocked(0.95))
+		st.MaxMs = ms(t.quantileLocked(1))
+		last := t.samples[n-1].at
+		st.LastObserved = &last
+	}
+	if t.violation != nil {
+		v := *t.violation
+		st.Violation = &v
+	}
+	return st
+}
+
+func (t *Tracker) pruneLocked(now time.Time) {
+	cut := now.Add(-t.window)
+	i := 0
+	for i < len(t.samples) && t.samples[i].at.Before(cut) {
+		i++
+	}
+	if i > 0 {
+		t.samples = append(t.samples[:0], t.samples[i:]...)
+	}
+}
+
+// quantileLocked returns the nearest-rank q-quantile of the window (q in (0,1]).
+func (t *Tracker) quantileLocked(q float64) time.Duration {
+	ds := make([]time.Duration, len(t.samples))
+	for i, s := range t.samples {
+		ds[i] = s.d
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	rank := int(math.Ceil(q*float64(len(ds)))) - 1
+	return ds[max(rank, 0)]
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
@@ -0,0 +1,57 @@
+package slo
+
+import (
+    "testing"
+    "time"
+)
+
+var t0 = time.Unix(1700000000, 0)
+
+func feed(tr *Tracker, start time.Time, n int, d time.Duration) (alerts []*Alert) {
+    for i := 0; i < n; i++ {
+        if a := tr.Observe(d, start.Add(time.Duration(i)*time.Second)); a != nil { alerts = append(alerts, a) }
+    }
+    return alerts
+}
+
+func TestViolationAndRecovery(t *testing.T) {
+    tr, err := New(Config{SLOMs: 100, Window: "1m", MinSamples: 10})
+    if err != nil { t.Fatal(err) }
+    if a := feed(tr, t0, 30, 20*time.Millisecond); len(a) != 0 { t.Fatalf("healthy baseline alerted: %+v", a) }
+    // 5% slow samples leave p95 healthy; more than that breaches it
+    if a := feed(tr, t0.Add(30*time.Second), 1, 500*time.Millisecond); len(a) != 0 { t.Fatalf("single outlier alerted: %+v", a) }
+    a := feed(tr, t0.Add(31*time.Second), 3, 500*time.Millisecond)
+    if len(a) != 1 || a[0].State != StateViolation || a[0].P95Ms != 500 || a[0].SLOMs != 100 || a[0].Window != "1m0s" { t.Fatalf("alerts=%+v", a) }
+    st := tr.Status(t0.Add(34 * time.Second))
+    if st.Violation == nil || st.Violation.P95Ms != 500 || !st.Violation.Since.Equal(t0.Add(31*time.Second)) { t.Fatalf("status violation %+v", st.Violation) }
+    if st.Samples != 34 || st.P50Ms != 20 || st.MaxMs != 500 || st.AlertsFired != 1 { t.Fatalf("status %+v", st) }
+    // still violating: no repeat alert
+    if a := feed(tr, t0.Add(34*time.Second), 2, 400*time.Millisecond); len(a) != 0 { t.Fatalf("repeat alert %+v", a) }
+    // the slow samples age out of the window; fast ones bring p95 back
+    a = feed(tr, t0.Add(100*time.Second), 20, 10*time.Millisecond)
+    if len(a) != 1 || a[0].State != StateRecovered || a[0].P95Ms != 10 { t.Fatalf("recovery alerts=%+v", a) }
+    if st := tr.Status(t0.Add(120 * time.Second)); st.Violation != nil || st.AlertsFired != 2 { t.Fatalf("status after recovery %+v", st) }
+}
+
+func TestMinSamplesAndDisabled(t *testing.T) {
+    tr, _ := New(Config{SLOMs: 50, MinSamples: 5})
+    if a := feed(tr, t0, 4, time.Second); len(a) != 0 { t.Fatalf("judged before min_samples: %+v", a) }
+    if a := feed(tr, t0.Add(4*time.Second), 1, time.Second); len(a) != 1 { t.Fatalf("no alert at min_samples") }
+    // disabling clears the violation and stops judging, samples keep being collected
+    if err := tr.Configure(Config{}); err != nil { t.Fatal(err) }
+    if a := feed(tr, t0.Add(5*time.Second), 5, time.Second); len(a) != 0 { t.Fatalf("disabled tracker alerted: %+v", a) }
+    st := tr.Status(t0.Add(10 * time.Second))
+    if st.Enabled || st.Violation != nil || st.Samples != 10 || st.Window != "5m0s" || st.MinSamples != DefaultMinSamples { t.Fatalf("status %+v", st) }
+}
+
+func TestConfigureRejectsBadValues(t *testing.T) {
+    for _, c := range []Config{{SLOMs: -1}, {SLOMs: 10, Window: "soon"}, {SLOMs: 10, Window: "-1m"}, {SLOMs: 10, MinSamples: -2}} {
+        if _, err := New(c); err == nil { t.Errorf("accepted %+v", c) }
+    }
+}
+
+func TestSampleCap(t *testing.T) {
+    tr, _ := New(Config{SLOMs: 1, Window: "24h"})
+    for i := 0; i < maxSamples+50; i++ { tr.Observe(time.Millisecond, t0.Add(time.Duration(i)*time.Millisecond)) }
+    if st := tr.Status(t0.Add(time.Minute)); st.Samples != maxSamples { t.Fatalf("samples=%d", st.Samples) }
+}
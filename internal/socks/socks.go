@@ -0,0 +1,235 @@
+// Package socks implements the server side of a SOCKS5 (RFC 1928) CONNECT handshake,
+// with optional username/password authentication (RFC 1929), so clients can pick the
+// upstream of each connection they open through PathLab.
+package socks
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+)
+
+const version = 5
+
+// authVersion is the version of the RFC 1929 username/password subnegotiation.
+const authVersion = 0x01
+
+// Authentication methods.
+const (
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// Commands.
+const (
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+)
+
+// Address types.
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes.
+const (
+	replySucceeded           = 0x00
+	replyHostUnreachable     = 0x04
+	replyConnectionRefused   = 0x05
+	replyCommandNotSupported = 0x07
+	replyAddrNotSupported    = 0x08
+)
+
+// Errors returned by Accept. Each is sent to the client as the matching reply or
+// method selection before Accept returns.
+var (
+	ErrVersion             = errors.New("socks: not a SOCKS5 client")
+	ErrNoAcceptableMethod  = errors.New("socks: client offers no acceptable authentication method")
+	ErrAuthFailed          = errors.New("socks: bad username or password")
+	ErrAuthVersion         = errors.New("socks: unsupported username/password auth version")
+	ErrCommandNotSupported = errors.New("socks: command not supported")
+	ErrAddrNotSupported    = errors.New("socks: address type not supported")
+	ErrConnectFailed       = errors.New("socks: connect failed")
+)
+
+// Credentials are the username and password clients must present. A nil
+// *Credentials accepts clients without authentication.
+type Credentials struct {
+	Username, Password string
+}
+
+// Accept runs the handshake on c and returns the host:port the client asked to
+// CONNECT to (a domain name is returned unresolved). connect is called with it before
+// the reply: when it fails the client is told the host is unreachable (or refused the
+// connection) and Accept returns ErrConnectFailed wrapping its error. On success the
+// client has been told the connection succeeded and everything it sends next is the
+// tunneled stream. Accept reads exactly the handshake's bytes.
+func Accept(c net.Conn, creds *Credentials, connect func(dest string) error) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", fmt.Errorf("socks: read greeting: %w", err)
+	}
+	if hdr[0] != version {
+		return "", ErrVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", fmt.Errorf("socks: read greeting: %w", err)
+	}
+	want := byte(methodNoAuth)
+	if creds != nil {
+		want = methodUserPass
+	}
+	chosen := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			chosen = want
+		}
+	}
+	if _, err := c.Write([]byte{version, chosen}); err != nil {
+		return "", fmt.Errorf("socks: write method: %w", err)
+	}
+	if chosen == methodNoAcceptable {
+		return "", ErrNoAcceptableMethod
+	}
+	if creds != nil {
+		if err := authenticate(c, creds); err != nil {
+			return "", err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return "", fmt.Errorf("socks: read request: %w", err)
+	}
+	if req[0] != version {
+		return "", ErrVersion
+	}
+	host, err := readAddr(c, req[3])
+	if err != nil {
+		if errors.Is(err, ErrAddrNotSupported) {
+			_ = reply(c, replyAddrNotSupported)
+		}
+		return "", err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", fmt.Errorf("socks: read request: %w", err)
+	}
+	if req[1] != cmdConnect {
+		// BIND and UDP ASSOCIATE included: PathLab only relays outbound TCP streams.
+		_ = reply(c, replyCommandNotSupported)
+		return "", fmt.Errorf("%w: %s", ErrCommandNotSupported, commandName(req[1]))
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	if err := connect(dest); err != nil {
+		code := byte(replyHostUnreachable)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			code = replyConnectionRefused
+		}
+		_ = reply(c, code)
+		return "", fmt.Errorf("%w: %s: %w", ErrConnectFailed, dest, err)
+	}
+	if err := reply(c, replySucceeded); err != nil {
+		return "", fmt.Errorf("socks: write reply: %w", err)
+	}
+	return dest, nil
+}
+
+// authenticate runs the RFC 1929 username/password subnegotiation.
+func authenticate(c net.Conn, creds *Credentials) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return fmt.Errorf("socks: read credentials: %w", err)
+	}
+	if ver[0] != authVersion {
+		if _, err := c.Write([]byte{authVersion, 1}); err != nil {
+			return fmt.Errorf("socks: write auth status: %w", err)
+		}
+		return ErrAuthVersion
+	}
+	user, err := readShortString(c)
+	if err != nil {
+		return fmt.Errorf("socks: read credentials: %w", err)
+	}
+	pass, err := readShortString(c)
+	if err != nil {
+		return fmt.Errorf("socks: read credentials: %w", err)
+	}
+	ok := subtle.ConstantTimeCompare([]byte(user), []byte(creds.Username)) == 1
+	ok = subtle.ConstantTimeCompare([]byte(pass), []byte(creds.Password)) == 1 && ok
+	status := byte(0)
+	if !ok {
+		status = 1
+	}
+	if _, err := c.Write([]byte{authVersion, status}); err != nil {
+		return fmt.Errorf("socks: write auth status: %w", err)
+	}
+	if !ok {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func readAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case atypIPv4, atypIPv6:
+		b := make([]byte, 4)
+		if atyp == atypIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("socks: read address: %w", err)
+		}
+		a, _ := netip.AddrFromSlice(b)
+		return a.String(), nil
+	case atypDomain:
+		s, err := readShortString(r)
+		if err != nil {
+			return "", fmt.Errorf("socks: read address: %w", err)
+		}
+		return s, nil
+	default:
+		return "", fmt.Errorf("%w: 0x%02x", ErrAddrNotSupported, atyp)
+	}
+}
+
+// readShortString reads a length-prefixed string of up to 255 bytes.
+func readShortString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// reply sends a reply with an unspecified bound address.
+func reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{version, code, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func commandName(cmd byte) string {
+	switch cmd {
+	case cmdBind:
+		return "BIND"
+	case cmdUDPAssociate:
+		return "UDP ASSOCIATE"
+	default:
+		return fmt.Sprintf("0x%02x", cmd)
+	}
+}
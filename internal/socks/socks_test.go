@@ -0,0 +1,94 @@
+package socks
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "net"
+    "syscall"
+    "testing"
+)
+
+// exchange runs Accept against a client that sends in and then reads everything
+// PathLab answers until Accept returns. Every CONNECT succeeds.
+func exchange(t *testing.T, creds *Credentials, in []byte) (string, error, []byte) {
+    return exchangeConnect(t, creds, in, func(string) error { return nil })
+}
+
+func exchangeConnect(t *testing.T, creds *Credentials, in []byte, connect func(string) error) (string, error, []byte) {
+    c1, c2 := net.Pipe()
+    out := make(chan []byte, 1)
+    go func(){ b, _ := io.ReadAll(c1); out <- b }()
+    go func(){ c1.Write(in) }()
+    dest, err := Accept(c2, creds, connect)
+    c2.Close()
+    return dest, err, <-out
+}
+
+var okReply = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+
+func TestAcceptConnect(t *testing.T) {
+    cases := []struct {
+        name string
+        req  []byte
+        want string
+    }{
+        {"ipv4", []byte{5, 1, 0, 1, 192, 0, 2, 1, 0x01, 0xbb}, "192.0.2.1:443"},
+        {"domain", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0x1f, 0x90), "example.com:8080"},
+        {"ipv6", append(append([]byte{5, 1, 0, 4}, net.ParseIP("2001:db8::1")...), 0, 80), "[2001:db8::1]:80"},
+    }
+    for _, c := range cases {
+        dest, err, got := exchange(t, nil, append([]byte{5, 2, 2, 0}, c.req...))
+        if err != nil || dest != c.want { t.Errorf("%s: dest %q, err %v; want %q", c.name, dest, err, c.want) }
+        if want := append([]byte{5, 0}, okReply...); !bytes.Equal(got, want) { t.Errorf("%s: replies % x, want % x", c.name, got, want) }
+    }
+}
+
+func TestAcceptUserPass(t *testing.T) {
+    creds := &Credentials{Username: "lab", Password: "s3cret"}
+    auth := append(append(append([]byte{5, 1, 2, 1, 3}, "lab"...), 6), "s3cret"...)
+    req := []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}
+    dest, err, got := exchange(t, creds, append(auth, req...))
+    if err != nil || dest != "127.0.0.1:80" { t.Fatalf("dest %q, err %v", dest, err) }
+    if want := append([]byte{5, 2, 1, 0}, okReply...); !bytes.Equal(got, want) { t.Fatalf("replies % x, want % x", got, want) }
+
+    bad := append(append(append([]byte{5, 1, 2, 1, 3}, "lab"...), 5), "wrong"...)
+    if _, err, got := exchange(t, creds, bad); !errors.Is(err, ErrAuthFailed) || !bytes.Equal(got, []byte{5, 2, 1, 1}) { t.Fatalf("bad password: err %v, replies % x", err, got) }
+    // a subnegotiation version other than 1 is refused before the credentials are read
+    badVer := append(append(append([]byte{5, 1, 2, 5, 3}, "lab"...), 6), "s3cret"...)
+    if _, err, got := exchange(t, creds, badVer); !errors.Is(err, ErrAuthVersion) || !bytes.Equal(got, []byte{5, 2, 1, 1}) { t.Fatalf("auth version 5: err %v, replies % x", err, got) }
+    // a client that only offers no-auth is turned away
+    if _, err, got := exchange(t, creds, []byte{5, 1, 0}); !errors.Is(err, ErrNoAcceptableMethod) || !bytes.Equal(got, []byte{5, 0xff}) { t.Fatalf("no-auth client: err %v, replies % x", err, got) }
+}
+
+func TestAcceptRepliesAfterConnect(t *testing.T) {
+    req := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80}
+    var asked string
+    if _, err, got := exchangeConnect(t, nil, req, func(dest string) error { asked = dest; return nil }); err != nil || asked != "127.0.0.1:80" || !bytes.Equal(got[2:], okReply) {
+        t.Fatalf("connect asked %q, err %v, replies % x", asked, err, got)
+    }
+    for _, c := range []struct {
+        name string
+        err  error
+        code byte
+    }{
+        {"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, 5},
+        {"unreachable", errors.New("i/o timeout"), 4},
+    } {
+        dest, err, got := exchangeConnect(t, nil, req, func(string) error { return c.err })
+        if dest != "" || !errors.Is(err, ErrConnectFailed) || !errors.Is(err, c.err) { t.Errorf("%s: dest %q, err %v", c.name, dest, err) }
+        if want := []byte{5, 0, 5, c.code, 0, 1, 0, 0, 0, 0, 0, 0}; !bytes.Equal(got, want) { t.Errorf("%s: replies % x, want % x", c.name, got, want) }
+    }
+    // nothing is dialed for a request that is refused outright
+    if _, err, _ := exchangeConnect(t, nil, []byte{5, 1, 0, 5, 2, 0, 1, 10, 0, 0, 1, 0, 53}, func(string) error { t.Fatal("BIND dialed"); return nil }); !errors.Is(err, ErrCommandNotSupported) { t.Errorf("bind: err %v", err) }
+}
+
+func TestAcceptRejectsOtherCommands(t *testing.T) {
+    for _, cmd := range []byte{2, 3, 9} {
+        _, err, got := exchange(t, nil, []byte{5, 1, 0, 5, cmd, 0, 1, 10, 0, 0, 1, 0, 53})
+        if !errors.Is(err, ErrCommandNotSupported) || !bytes.Equal(got, []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0}) { t.Errorf("cmd %d: err %v, replies % x", cmd, err, got) }
+    }
+    _, err, got := exchange(t, nil, []byte{5, 1, 0, 5, 1, 0, 9})
+    if !errors.Is(err, ErrAddrNotSupported) || !bytes.Equal(got, []byte{5, 0, 5, 8, 0, 1, 0, 0, 0, 0, 0, 0}) { t.Errorf("bad atyp: err %v, replies % x", err, got) }
+    if _, err, _ := exchange(t, nil, []byte{4, 1, 0, 80}); !errors.Is(err, ErrVersion) { t.Errorf("socks4: err %v", err) }
+}
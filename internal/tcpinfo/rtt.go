@@ -0,0 +1,136 @@
+package tcpinfo
+
+import (
+	"math"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bounds on what RTTStats keeps in memory.
+const (
+	maxPrefixes      = 1024 // least recently seen prefixes are dropped beyond this
+	samplesPerPrefix = 256  // newest samples kept per prefix for the percentiles
+	ipv4PrefixBits   = 24
+	ipv6PrefixBits   = 48
+)
+
+// PrefixRTT is the RTT distribution of one client prefix in GET /clients/rtt.
+type PrefixRTT struct {
+	Prefix   string    `json:"prefix"`
+	Samples  int64     `json:"samples"` // connections measured since start
+	MinMs    float64   `json:"min_ms"`  // min/p50/p95/max/mean cover the newest samples kept
+	P50Ms    float64   `json:"p50_ms"`
+	P95Ms    float64   `json:"p95_ms"`
+	MaxMs    float64   `json:"max_ms"`
+	MeanMs   float64   `json:"mean_ms"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type prefixSamples struct {
+	count int64
+	ring  []time.Duration
+	next  int
+	last  time.Time
+}
+
+// RTTStats aggregates client RTTs per IP prefix (/24 for IPv4, /48 for IPv6) so a far
+// away client network stands apart from latency the impairment adds. Safe for
+// concurrent use.
+type RTTStats struct {
+	mu       sync.Mutex
+	prefixes map[netip.Prefix]*prefixSamples
+}
+
+// NewRTTStats returns an empty aggregator.
+func NewRTTStats() *RTTStats {
+	return &RTTStats{prefixes: map[netip.Prefix]*prefixSamples{}}
+}
+
+// ClientPrefix returns the prefix ip is grouped under.
+func ClientPrefix(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	bits := ipv6PrefixBits
+	if ip.Is4() {
+		bits = ipv4PrefixBits
+	}
+	p, _ := ip.Prefix(bits)
+	return p
+}
+
+// Observe records one RTT measured for a client at ip.
+func (s *RTTStats) Observe(ip netip.Addr, rtt time.Duration, at time.Time) {
+	if !ip.IsValid() {
+		return
+	}
+	key := ClientPrefix(ip)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.prefixes[key]
+	if !ok {
+		if len(s.prefixes) >= maxPrefixes {
+			s.evictOldestLocked()
+		}
+		ps = &prefixSamples{}
+		s.prefixes[key] = ps
+	}
+	ps.count++
+	ps.last = at
+	if len(ps.ring) < samplesPerPrefix {
+		ps.ring = append(ps.ring, rtt)
+	} else {
+		ps.ring[ps.next] = rtt
+		ps.next = (ps.next + 1) % samplesPerPrefix
+	}
+}
+
+func (s *RTTStats) evictOldestLocked() {
+	var oldest netip.Prefix
+	var at time.Time
+	for p, ps := range s.prefixes {
+		if at.IsZero() || ps.last.Before(at) {
+			oldest, at = p, ps.last
+		}
+	}
+	delete(s.prefixes, oldest)
+}
+
+// Snapshot returns the distribution of every prefix, most samples first.
+func (s *RTTStats) Snapshot() []PrefixRTT {
+	s.mu.Lock()
+	out := make([]PrefixRTT, 0, len(s.prefixes))
+	for p, ps := range s.prefixes {
+		ds := append([]time.Duration(nil), ps.ring...)
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		var sum time.Duration
+		for _, d := range ds {
+			sum += d
+		}
+		out = append(out, PrefixRTT{
+			Prefix:   p.String(),
+			Samples:  ps.count,
+			MinMs:    ms(ds[0]),
+			P50Ms:    ms(quantile(ds, 0.5)),
+			P95Ms:    ms(quantile(ds, 0.95)),
+			MaxMs:    ms(ds[len(ds)-1]),
+			MeanMs:   ms(sum / time.Duration(len(ds))),
+			LastSeen: ps.last,
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Samples != out[j].Samples {
+			return out[i].Samples > out[j].Samples
+		}
+		return out[i].Prefix < out[j].Prefix
+	})
+	return out
+}
+
+// quantile returns the nearest-rank q-quantile of sorted ds.
+func quantile(ds []time.Duration, q float64) time.Duration {
+	return ds[max(int(math.Ceil(q*float64(len(ds))))-1, 0)]
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
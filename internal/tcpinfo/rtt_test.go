@@ -0,0 +1,52 @@
+package tcpinfo
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "net/netip"
+    "testing"
+    "time"
+)
+
+func TestReadWithoutSocketIsUnsupported(t *testing.T) {
+    a, b := net.Pipe()
+    defer a.Close(); defer b.Close()
+    if _, err := Read(a); !errors.Is(err, ErrUnsupported) { t.Fatalf("net.Pipe: %v", err) }
+}
+
+func TestClientPrefix(t *testing.T) {
+    for in, want := range map[string]string{
+        "192.0.2.77": "192.0.2.0/24",
+        "::ffff:192.0.2.77": "192.0.2.0/24",
+        "2001:db8:1234:5678::1": "2001:db8:1234::/48",
+    } {
+        if got := ClientPrefix(netip.MustParseAddr(in)).String(); got != want { t.Errorf("%s -> %s, want %s", in, got, want) }
+    }
+}
+
+func TestRTTStatsPerPrefix(t *testing.T) {
+    s := NewRTTStats()
+    now := time.Now()
+    for i := 1; i <= 100; i++ { s.Observe(netip.MustParseAddr(fmt.Sprintf("10.0.0.%d", i)), time.Duration(i)*time.Millisecond, now) }
+    s.Observe(netip.MustParseAddr("2001:db8::1"), 80*time.Millisecond, now)
+    s.Observe(netip.Addr{}, time.Second, now) // no address: ignored
+    snap := s.Snapshot()
+    if len(snap) != 2 { t.Fatalf("prefixes %+v", snap) }
+    p := snap[0]
+    if p.Prefix != "10.0.0.0/24" || p.Samples != 100 || p.MinMs != 1 || p.P50Ms != 50 || p.P95Ms != 95 || p.MaxMs != 100 || p.MeanMs != 50.5 { t.Fatalf("v4 prefix %+v", p) }
+    if p := snap[1]; p.Prefix != "2001:db8::/48" || p.Samples != 1 || p.P95Ms != 80 { t.Fatalf("v6 prefix %+v", p) }
+}
+
+func TestRTTStatsBounded(t *testing.T) {
+    s := NewRTTStats()
+    start := time.Now()
+    for i := 0; i < 2*samplesPerPrefix; i++ { s.Observe(netip.MustParseAddr("10.0.0.1"), time.Duration(i)*time.Millisecond, start) }
+    if p := s.Snapshot()[0]; p.Samples != 2*samplesPerPrefix || p.MinMs != samplesPerPrefix { t.Fatalf("ring kept old samples: %+v", p) }
+    for i := 0; i < maxPrefixes+10; i++ {
+        s.Observe(netip.AddrFrom4([4]byte{11, byte(i >> 8), byte(i), 1}), time.Millisecond, start.Add(time.Duration(i+1)*time.Second))
+    }
+    snap := s.Snapshot()
+    if len(snap) != maxPrefixes { t.Fatalf("%d prefixes kept", len(snap)) }
+    for _, p := range snap { if p.Prefix == "10.0.0.0/24" { t.Fatal("least recently seen prefix not dropped") } }
+}
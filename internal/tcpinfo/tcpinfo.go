@@ -0,0 +1,40 @@
+// Package tcpinfo reads kernel TCP state (TCP_INFO) from accepted connections and
+// aggregates the client RTTs it yields. Reading is implemented on Linux (except 386,
+// where getsockopt goes through socketcall); elsewhere Read reports ErrUnsupported
+// and callers skip the measurement.
+package tcpinfo
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrUnsupported is returned by Read where TCP_INFO is not available (non-Linux
+// platforms, or connections without a socket such as net.Pipe).
+var ErrUnsupported = errors.New("tcp_info not supported")
+
+// Info is the subset of TCP_INFO PathLab uses.
+type Info struct {
+	RTT    time.Duration // smoothed round-trip time (srtt); right after accept this is the handshake RTT
+	RTTVar time.Duration // RTT variance
+}
+
+// Read returns the TCP_INFO of c, which must expose its socket (syscall.Conn).
+func Read(c net.Conn) (Info, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return Info{}, ErrUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return Info{}, err
+	}
+	var info Info
+	var serr error
+	if err := raw.Control(func(fd uintptr) { info, serr = readFD(fd) }); err != nil {
+		return Info{}, err
+	}
+	return info, serr
+}
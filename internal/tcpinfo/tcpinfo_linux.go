@@ -0,0 +1,23 @@
+//go:build linux && !386
+
+package tcpinfo
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func readFD(fd uintptr) (Info, error) {
+	var ti syscall.TCPInfo
+	size := uint32(unsafe.Sizeof(ti))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return Info{}, errno
+	}
+	return Info{
+		RTT:    time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar: time.Duration(ti.Rttvar) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,25 @@
+//go:build linux && !386
+
+package tcpinfo
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+func TestReadLoopbackRTT(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    client, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer client.Close()
+    c, err := ln.Accept()
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    info, err := Read(c)
+    if err != nil { t.Fatalf("Read: %v", err) }
+    if info.RTT < 0 || info.RTT > 10*time.Millisecond { t.Fatalf("loopback rtt %v, want ~0", info.RTT) }
+    t.Logf("loopback rtt %v (var %v)", info.RTT, info.RTTVar)
+}
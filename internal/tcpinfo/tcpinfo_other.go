@@ -0,0 +1,5 @@
+//go:build !linux || 386
+
+package tcpinfo
+
+func readFD(uintptr) (Info, error) { return Info{}, ErrUnsupported }
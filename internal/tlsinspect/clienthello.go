@@ -1,223 +1,388 @@
 package tlsinspect
 
 import (
-	"bytes"
 	"crypto/md5"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strconv"
 	"strings"
 )
 
+// Golden Results for the ClientHello corpus in testdata/clienthellos are
+// regenerated intentionally; review the resulting diff before committing.
+//go:generate go test -run TestClientHelloGolden -update .
+
 // Result holds parsed information about the ClientHello
 type Result struct {
 	HandshakeBytes int    // total bytes comprising the ClientHello handshake message (not including record headers)
 	RecordsBytes   int    // total bytes of all TLS records that carried the ClientHello
-	PQCHint        bool   // best-effort hint if PQC hybrid group id bytes observed (e.g., 0x11ec for X25519MLKEM768)
+	PQCHint        bool   // a key share was offered for a PQC hybrid group (e.g., 0x11ec for X25519MLKEM768)
 	ClientHelloLen int    // length field from handshake header
 	SNI            string // extracted server_name (first host_name entry) if present
 	ALPN           []string // list of advertised ALPN protocol strings
 	CipherSuites   int    // number of cipher suites offered
 	JA3            string // md5 hash (hex) of JA3 fingerprint
+	NormalizedJA3  string // JA3 with the extension list sorted, stable across extension-order randomization (Chrome 110+)
+	GreaseCount    int    // GREASE values among the cipher suites, extension types and supported groups (0 for most non-browser stacks)
+	Records        int    // TLS records consumed
+	BytesReceived  int    // bytes consumed, including a record still being received
+	HeaderSeen     bool   // the ClientHello handshake header (type and length) was received
+	SupportedVersions []uint16 // supported_versions extension (0x002b) entries, GREASE skipped, in offered order
+	MaxVersion     uint16 // highest version offered: from supported_versions, else the legacy_version field
+	KeyShareGroups []uint16 // groups of the key_share extension (0x0033) entries, GREASE skipped, in offered order
+	ECHPresent     bool   // encrypted_client_hello (0xfe0d) offered: SNI is then the outer, public name (GREASE ECH looks the same)
+	ECHConfigID    byte   // config_id of an outer encrypted_client_hello
+	Extensions     []uint16 // extension types in offered order, GREASE values included (see IsGREASE)
+	ParseWarnings  []string // parts of a complete ClientHello that were malformed and skipped
+	OffersPSK      bool   // resumption attempt: pre_shared_key (0x0029) identities or a non-empty session_ticket (0x0023)
+	PSKIdentityCount int  // identities in the pre_shared_key extension
+	SessionIDLen   int    // legacy_session_id length (TLS 1.3 clients send 32 bytes in compatibility mode without resuming)
+	EarlyData      bool   // early_data (0x002a) offered: 0-RTT application data follows the ClientHello
+	SignatureAlgorithms []uint16 // signature_algorithms (0x000d) entries, GREASE skipped, in offered order
+	CompressCertAlgos []uint16 // compress_certificate (0x001b) algorithms, GREASE skipped (1 zlib, 2 brotli, 3 zstd)
+	CHSHA256       string // SHA-256 (hex) of the raw ClientHello handshake message, header included
+}
+
+// pqcGroups are the hybrid post-quantum named groups that set PQCHint when a key
+// share for one of them is offered.
+var pqcGroups = map[uint16]string{
+	0x11eb: "SecP256r1MLKEM768",
+	0x11ec: "X25519MLKEM768",
+	0x11ed: "SecP384r1MLKEM1024",
+	0x6399: "X25519Kyber768Draft00",
+	0x639a: "SecP256r1Kyber768Draft00",
+}
+
+// VersionName returns v as "1.0" to "1.3", or as hex for anything else (SSL 3.0,
+// drafts, zero).
+func VersionName(v uint16) string {
+	switch v {
+	case 0x0301:
+		return "1.0"
+	case 0x0302:
+		return "1.1"
+	case 0x0303:
+		return "1.2"
+	case 0x0304:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
 }
 
 // ParseClientHello reads from r until a full ClientHello handshake message is obtained.
 // It returns the raw concatenated handshake bytes and a Result. The function tolerates
-// multiple TLS records carrying parts of the handshake.
+// multiple TLS records carrying parts of the handshake. It reads exactly the records
+// carrying the ClientHello and nothing after them. On error, res is the partial
+// Result of what was received (see CHParser.Partial).
 func ParseClientHello(r io.Reader) (raw []byte, res Result, err error) {
-	var buf bytes.Buffer
-	var totalRecordsBytes int
-	var need int = -1 // handshake bytes needed (length + 4 header)
+	return ParseClientHelloOpts(r, Options{})
+}
+
+// ParseClientHelloOpts is ParseClientHello with opts. A ClientHello over
+// opts.MaxHandshakeBytes fails with ErrHandshakeTooLarge.
+func ParseClientHelloOpts(r io.Reader, opts Options) (raw []byte, res Result, err error) {
+	p := NewCHParserOpts(opts)
 	for {
-		// Read TLS record header: 5 bytes
-		hdr := make([]byte, 5)
-		if _, err = io.ReadFull(r, hdr); err != nil {
-			return nil, res, fmt.Errorf("read record header: %w", err)
+		what := "record body"
+		if p.inHeader() {
+			what = "record header"
 		}
-		contentType := hdr[0]         // expect 0x16 (handshake)
-		version := binary.BigEndian.Uint16(hdr[1:3]) // legacy version often 0x0301 in TLS1.3
-		length := int(binary.BigEndian.Uint16(hdr[3:5]))
-		if length <= 0 || length > 1<<14+256 {
-			return nil, res, errors.New("invalid TLS record length")
+		buf := make([]byte, p.Need())
+		n, rerr := io.ReadFull(r, buf)
+		done, ferr := p.Feed(buf[:n])
+		if ferr != nil {
+			return nil, p.Partial(), ferr
 		}
-		body := make([]byte, length)
-		if _, err = io.ReadFull(r, body); err != nil {
-			return nil, res, fmt.Errorf("read record body: %w", err)
+		if done {
+			return p.Raw(), p.Partial(), nil
 		}
-		totalRecordsBytes += 5 + length
-
-		if contentType != 0x16 {
-			// Not a handshake record, push back?
-			// For simplicity, return error.
-			return nil, res, fmt.Errorf("unexpected TLS content type 0x%02x (version 0x%04x)", contentType, version)
+		if rerr != nil {
+			return nil, p.Partial(), fmt.Errorf("read %s: %w", what, rerr)
 		}
+	}
+}
+
+// parseHello fills res from raw, a complete ClientHello handshake message (header
+// included): SNI, ALPN, cipher count, versions, key shares, JA3 and the PQC hint.
+// Whatever cannot be parsed is skipped and reported in res.ParseWarnings.
+func parseHello(raw []byte, res *Result) {
+	res.HandshakeBytes = len(raw)
+	sum := sha256.Sum256(raw)
+	res.CHSHA256 = hex.EncodeToString(sum[:])
+	if len(raw) < 4 {
+		return
+	}
+	if err := parseHelloBody(chCursor{raw[4:]}, res); err != nil {
+		res.ParseWarnings = append(res.ParseWarnings, err.Error())
+	}
+}
 
-		// Append to buffer of handshake bytes
-		buf.Write(body)
+// ja3Lists are the ClientHello lists JA3 is computed from besides the ciphers and
+// Result.Extensions.
+type ja3Lists struct {
+	groups       []uint16
+	pointFormats []byte
+}
 
-		// On first record, read handshake header to know total length
-		if need < 0 && buf.Len() >= 4 {
-			handshakeType := buf.Bytes()[0]
-			if handshakeType != 0x01 {
-				return nil, res, fmt.Errorf("not a ClientHello (type=0x%02x)", handshakeType)
+// parseHelloBody parses the ClientHello body. Malformed extensions are reported in
+// res.ParseWarnings and skipped; a malformed field before or around them ends the
+// parse with an error, and JA3 is then left empty.
+func parseHelloBody(c chCursor, res *Result) error {
+	version, err := c.uint16()
+	if err != nil {
+		return fmt.Errorf("legacy_version: %w", err)
+	}
+	res.MaxVersion = version
+	if _, err := c.bytes(32); err != nil {
+		return fmt.Errorf("random: %w", err)
+	}
+	sid, err := c.vector8()
+	if err != nil {
+		return fmt.Errorf("session_id: %w", err)
+	}
+	res.SessionIDLen = len(sid.b)
+	cs, err := c.vector16()
+	if err != nil {
+		return fmt.Errorf("cipher_suites: %w", err)
+	}
+	ciphers, err := cs.uint16s()
+	if err != nil {
+		return fmt.Errorf("cipher_suites: %w", err)
+	}
+	res.CipherSuites = len(ciphers)
+	if _, err := c.vector8(); err != nil {
+		return fmt.Errorf("compression_methods: %w", err)
+	}
+	var lists ja3Lists
+	if !c.empty() { // the extensions vector is optional
+		exts, err := c.vector16()
+		if err != nil {
+			return fmt.Errorf("extensions: %w", err)
+		}
+		for !exts.empty() {
+			typ, err := exts.uint16()
+			if err != nil {
+				return fmt.Errorf("extensions: %w", err)
+			}
+			data, err := exts.vector16()
+			if err != nil {
+				return fmt.Errorf("extension 0x%04x: %w", typ, err)
+			}
+			res.Extensions = append(res.Extensions, typ)
+			if err := parseExtension(typ, data, res, &lists); err != nil {
+				res.ParseWarnings = append(res.ParseWarnings, fmt.Sprintf("extension 0x%04x: %v", typ, err))
 			}
-			hl := int(buf.Bytes()[1])<<16 | int(buf.Bytes()[2])<<8 | int(buf.Bytes()[3])
-			need = hl + 4 // include header
-			res.ClientHelloLen = hl
 		}
+	}
+	res.JA3 = ja3(version, ciphers, res.Extensions, lists.groups, lists.pointFormats)
+	sorted := slices.Clone(res.Extensions)
+	slices.Sort(sorted)
+	res.NormalizedJA3 = ja3(version, ciphers, sorted, lists.groups, lists.pointFormats)
+	res.GreaseCount = countGREASE(ciphers) + countGREASE(res.Extensions) + countGREASE(lists.groups)
+	return nil
+}
 
-		if need > 0 && buf.Len() >= need {
-			raw = buf.Bytes()[:need]
-			break
+// parseExtension records what res and lists keep from one extension's data.
+func parseExtension(typ uint16, data chCursor, res *Result, lists *ja3Lists) error {
+	switch typ {
+	case 0x0000: // server_name
+		names, err := data.vector16()
+		if err != nil {
+			return err
+		}
+		for !names.empty() {
+			nameType, err := names.uint8()
+			if err != nil {
+				return err
+			}
+			name, err := names.vector16()
+			if err != nil {
+				return err
+			}
+			if nameType == 0 { // host_name
+				res.SNI = strings.ToLower(string(name.b))
+				return nil
+			}
+		}
+	case 0x0010: // ALPN
+		protos, err := data.vector16()
+		if err != nil {
+			return err
+		}
+		for !protos.empty() {
+			proto, err := protos.vector8()
+			if err != nil {
+				return err
+			}
+			if !proto.empty() {
+				res.ALPN = append(res.ALPN, string(proto.b))
+			}
+		}
+	case 0x000a: // supported_groups (elliptic curves)
+		groups, err := data.vector16()
+		if err != nil {
+			return err
+		}
+		if lists.groups, err = groups.uint16s(); err != nil {
+			return err
 		}
-		// else continue reading next record
+	case 0x000b: // ec_point_formats
+		formats, err := data.vector8()
+		if err != nil {
+			return err
+		}
+		lists.pointFormats = formats.b
+	case 0x002b: // supported_versions
+		versions, err := data.vector8()
+		if err != nil {
+			return err
+		}
+		vs, err := versions.uint16s()
+		if err != nil {
+			return err
+		}
+		for _, v := range vs {
+			if IsGREASE(v) {
+				continue
+			}
+			if len(res.SupportedVersions) == 0 {
+				res.MaxVersion = 0
+			}
+			res.SupportedVersions = append(res.SupportedVersions, v)
+			res.MaxVersion = max(res.MaxVersion, v)
+		}
+	case 0x0033: // key_share
+		shares, err := data.vector16()
+		if err != nil {
+			return err
+		}
+		for !shares.empty() {
+			group, err := shares.uint16()
+			if err != nil {
+				return err
+			}
+			if _, err := shares.vector16(); err != nil {
+				return err
+			}
+			if IsGREASE(group) {
+				continue
+			}
+			res.KeyShareGroups = append(res.KeyShareGroups, group)
+			if _, ok := pqcGroups[group]; ok {
+				res.PQCHint = true
+			}
+		}
+	case 0x000d: // signature_algorithms
+		algs, err := data.vector16()
+		if err != nil {
+			return err
+		}
+		vs, err := algs.uint16s()
+		if err != nil {
+			return err
+		}
+		res.SignatureAlgorithms = withoutGREASE(vs)
+	case 0x001b: // compress_certificate
+		algs, err := data.vector8()
+		if err != nil {
+			return err
+		}
+		vs, err := algs.uint16s()
+		if err != nil {
+			return err
+		}
+		res.CompressCertAlgos = withoutGREASE(vs)
+	case 0x0023: // session_ticket: empty only announces support, a ticket resumes
+		if !data.empty() {
+			res.OffersPSK = true
+		}
+	case 0x0029: // pre_shared_key: identities, then binders
+		ids, err := data.vector16()
+		if err != nil {
+			return err
+		}
+		for !ids.empty() {
+			if _, err := ids.vector16(); err != nil {
+				return err
+			}
+			if _, err := ids.bytes(4); err != nil { // obfuscated_ticket_age
+				return err
+			}
+			res.PSKIdentityCount++
+		}
+		res.OffersPSK = res.OffersPSK || res.PSKIdentityCount > 0
+	case 0x002a: // early_data: empty in a ClientHello, the 0-RTT data follows in its own records
+		res.EarlyData = true
+	case 0xfe0d: // encrypted_client_hello
+		res.ECHPresent = true
+		// outer: type(1)=0, cipher_suite(4), config_id(1), enc, payload; inner: type(1)=1
+		if echType, err := data.uint8(); err != nil || echType != 0 {
+			return err
+		}
+		if _, err := data.bytes(4); err != nil {
+			return err
+		}
+		id, err := data.uint8()
+		if err != nil {
+			return err
+		}
+		res.ECHConfigID = id
 	}
+	return nil
+}
 
-	// heuristic: look for the key_share extension (0x0033) and group id 0x11ec (X25519MLKEM768)
-	if bytes.Contains(raw, []byte{0x11, 0xec}) {
-		res.PQCHint = true
+// ja3 returns the JA3 fingerprint, the md5 (hex) of
+// "version,ciphers,extensions,groups,point_formats" with GREASE values left out of
+// every list.
+func ja3(version uint16, ciphers, extensions, groups []uint16, pointFormats []byte) string {
+	pf := make([]uint16, len(pointFormats))
+	for i, b := range pointFormats {
+		pf[i] = uint16(b)
 	}
-	res.HandshakeBytes = len(raw)
-	res.RecordsBytes = totalRecordsBytes
-
-	// Best-effort deeper parse of ClientHello body for SNI, ALPN, cipher count and JA3.
-	// raw layout: HandshakeHeader(4) + body
-	if len(raw) >= 4 {
-		body := raw[4:]
-		off := 0
-		// legacy_version (2) + random (32)
-		if len(body) >= off+34 {
-			off += 34
-			// session_id
-			if len(body) > off {
-				if sidLen := int(body[off]); len(body) >= off+1+sidLen {
-					off += 1 + sidLen
-					// cipher_suites vector (2 len + data)
-					if len(body) >= off+2 {
-						csLen := int(binary.BigEndian.Uint16(body[off:off+2]))
-						off += 2
-						if csLen%2 == 0 && len(body) >= off+csLen {
-							cipherStart := off
-							res.CipherSuites = csLen / 2
-							off += csLen
-							// compression methods (1 len + data)
-							if len(body) > off {
-								compLen := int(body[off])
-								if len(body) >= off+1+compLen {
-									off += 1 + compLen
-									// extensions vector (2 len + data)
-									if len(body) >= off+2 {
-										extLen := int(binary.BigEndian.Uint16(body[off:off+2]))
-										off += 2
-										if len(body) >= off+extLen {
-											extEnd := off + extLen
-											// Prepare JA3 component collectors
-											legacyVersion := int(binary.BigEndian.Uint16(body[0:2]))
-											var ja3Ciphers []string
-											for i := 0; i < csLen; i += 2 { // exclude GREASE
-												val := binary.BigEndian.Uint16(body[cipherStart+i : cipherStart+i+2])
-												if isGrease(val) { continue }
-												ja3Ciphers = append(ja3Ciphers, strconv.Itoa(int(val)))
-											}
-											var ja3Exts []string
-											var ja3Groups []string
-											var ja3PF []string
-											// Iterate extensions
-											for off+4 <= extEnd {
-												etype := binary.BigEndian.Uint16(body[off:off+2])
-												elen := int(binary.BigEndian.Uint16(body[off+2:off+4]))
-												off += 4
-												if off+elen > extEnd { break }
-												edata := body[off:off+elen]
-												switch etype {
-												case 0x0000: // server_name
-													if len(edata) >= 2 {
-														listLen := int(binary.BigEndian.Uint16(edata[:2]))
-														if listLen+2 <= len(edata) {
-															p := 2
-															for p+3 <= 2+listLen {
-																nameType := edata[p]
-																if p+3 > len(edata) { break }
-																nameLen := int(binary.BigEndian.Uint16(edata[p+1:p+3]))
-																p += 3
-																if p+nameLen > len(edata) { break }
-																if nameType == 0 { // host_name
-																	res.SNI = strings.ToLower(string(edata[p : p+nameLen]))
-																	break
-																}
-																p += nameLen
-															}
-														}
-													}
-												case 0x0010: // ALPN
-													if len(edata) >= 2 {
-														listLen := int(binary.BigEndian.Uint16(edata[:2]))
-														if listLen+2 <= len(edata) {
-															p := 2
-															for p < 2+listLen && p < len(edata) {
-																if p >= len(edata) { break }
-																l := int(edata[p])
-																p++
-																if p+l > len(edata) { break }
-																if l > 0 {
-																	res.ALPN = append(res.ALPN, string(edata[p:p+l]))
-																}
-																p += l
-															}
-														}
-													}
-												case 0x000a: // supported_groups (elliptic curves)
-													if len(edata) >= 2 {
-														glen := int(binary.BigEndian.Uint16(edata[:2]))
-														if glen+2 <= len(edata) && glen%2 == 0 {
-															for p := 2; p < 2+glen; p += 2 {
-																gid := binary.BigEndian.Uint16(edata[p : p+2])
-																if isGrease(gid) { continue }
-																ja3Groups = append(ja3Groups, strconv.Itoa(int(gid)))
-															}
-														}
-													}
-												case 0x000b: // ec_point_formats
-													if len(edata) >= 1 {
-														plen := int(edata[0])
-														if plen+1 <= len(edata) {
-															for p := 1; p < 1+plen; p++ {
-																ja3PF = append(ja3PF, strconv.Itoa(int(edata[p])))
-															}
-														}
-													}
-												}
-												if !isGrease(etype) && etype != 0x0000 && etype != 0x0010 && etype != 0x000a && etype != 0x000b {
-													// we'll record all extension types (including those we processed) except GREASE; duplicates not expected
-												}
-												if !isGrease(etype) {
-													ja3Exts = append(ja3Exts, strconv.Itoa(int(etype)))
-												}
-												off += elen
-											}
-											// Build JA3 string: version,ciphers,extensions,groups,points
-											ja3Str := fmt.Sprintf("%d,%s,%s,%s,%s", legacyVersion, strings.Join(ja3Ciphers, "-"), strings.Join(ja3Exts, "-"), strings.Join(ja3Groups, "-"), strings.Join(ja3PF, "-"))
-											sum := md5.Sum([]byte(ja3Str))
-											res.JA3 = hex.EncodeToString(sum[:])
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-
-	return raw, res, nil
+	s := fmt.Sprintf("%d,%s,%s,%s,%s", version, ja3List(ciphers), ja3List(extensions), ja3List(groups), ja3List(pf))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja3List joins the non-GREASE values of vs in decimal with "-".
+func ja3List(vs []uint16) string {
+	var parts []string
+	for _, v := range vs {
+		if !IsGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// withoutGREASE returns vs with GREASE values removed (nil when none remain).
+func withoutGREASE(vs []uint16) []uint16 {
+	var out []uint16
+	for _, v := range vs {
+		if !IsGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// countGREASE returns how many values of vs are GREASE.
+func countGREASE(vs []uint16) int {
+	n := 0
+	for _, v := range vs {
+		if IsGREASE(v) {
+			n++
+		}
+	}
+	return n
 }
 
-// isGrease returns true if the value matches a GREASE pattern per RFC 8701.
-func isGrease(v uint16) bool {
+// IsGREASE reports whether v is a GREASE value (RFC 8701), which clients send in
+// cipher, extension, group and version lists to keep servers tolerant.
+func IsGREASE(v uint16) bool {
 	// pattern 0x?a?a where high and low bytes identical and low byte is 0x0a
 	if byte(v>>8) == byte(v&0xff) && byte(v&0xff) == 0x0a {
 		return true
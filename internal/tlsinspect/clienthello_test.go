@@ -2,8 +2,13 @@ package tlsinspect
 
 import (
     "bytes"
+    "crypto/md5"
     "encoding/binary"
+    "encoding/hex"
+    "fmt"
     "io"
+    "os"
+    "path/filepath"
     "testing"
 )
 
@@ -53,3 +58,215 @@ func (s *sliceReader) Read(p []byte) (int, error) {
     s.b = s.b[n:]
     return n, nil
 }
+
+func TestReadClientHelloReturnsRecords(t *testing.T) {
+    for _, name := range []string{"chrome", "go"} {
+        b, err := os.ReadFile(filepath.Join("testdata", "clienthellos", name+".bin"))
+        if err != nil { t.Fatalf("read fixture: %v", err) }
+        stream := append(append([]byte(nil), b...), "trailing app data"...)
+        records, raw, res, err := ReadClientHello(bytes.NewReader(stream))
+        if err != nil { t.Fatalf("%s: %v", name, err) }
+        if !bytes.Equal(records, b) || len(records) != res.RecordsBytes { t.Errorf("%s: records %d bytes, want the %d fixture bytes", name, len(records), len(b)) }
+        if len(raw) != res.HandshakeBytes { t.Errorf("%s: raw %d != handshake bytes %d", name, len(raw), res.HandshakeBytes) }
+    }
+    // Bytes consumed before a parse failure are still handed back for replay.
+    req := "GET / HTTP/1.1\r\n\r\n"
+    records, _, _, err := ReadClientHello(bytes.NewReader([]byte(req)))
+    if err == nil || string(records) != req { t.Fatalf("records=%q err=%v", records, err) }
+}
+
+func TestIsHelloRetryRequest(t *testing.T) {
+    sh := make([]byte, 38)
+    sh[0] = 0x02
+    copy(sh[6:], helloRetryRandom)
+    if !IsHelloRetryRequest(sh) { t.Fatalf("HRR random not detected") }
+    sh[37] ^= 1
+    if IsHelloRetryRequest(sh) { t.Fatalf("ordinary ServerHello reported as HRR") }
+    if IsHelloRetryRequest(sh[:20]) { t.Fatalf("truncated message reported as HRR") }
+}
+
+// helloWithExtensions builds a ClientHello record (legacy_version TLS 1.2, one cipher
+// suite) carrying exts, each given as type followed by its body.
+func helloWithExtensions(exts ...[]byte) []byte {
+    var ext bytes.Buffer
+    for _, e := range exts {
+        ext.Write(e[:2])
+        binary.Write(&ext, binary.BigEndian, uint16(len(e)-2))
+        ext.Write(e[2:])
+    }
+    var body bytes.Buffer
+    body.Write([]byte{0x03, 0x03})
+    body.Write(make([]byte, 32))
+    body.Write([]byte{0x00, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00})
+    binary.Write(&body, binary.BigEndian, uint16(ext.Len()))
+    body.Write(ext.Bytes())
+    hs := append([]byte{0x01, 0x00, byte(body.Len() >> 8), byte(body.Len())}, body.Bytes()...)
+    return append([]byte{0x16, 0x03, 0x01, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+func TestSupportedVersions(t *testing.T) {
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions([]byte{0x00, 0x2b, 6, 0x1a, 0x1a, 0x03, 0x04, 0x03, 0x03})))
+    if err != nil { t.Fatal(err) }
+    if len(res.SupportedVersions) != 2 || res.SupportedVersions[0] != 0x0304 || res.MaxVersion != 0x0304 || VersionName(res.MaxVersion) != "1.3" { t.Fatalf("versions %x max %x", res.SupportedVersions, res.MaxVersion) }
+    // without the extension the legacy_version field is all there is
+    _, res, _ = ParseClientHello(bytes.NewReader(helloWithExtensions()))
+    if res.SupportedVersions != nil || res.MaxVersion != 0x0303 || VersionName(res.MaxVersion) != "1.2" { t.Fatalf("legacy only: versions %x max %x", res.SupportedVersions, res.MaxVersion) }
+    if VersionName(0x0300) != "0x0300" { t.Fatalf("ssl3 named %q", VersionName(0x0300)) }
+}
+
+func keyShareExt(groups ...uint16) []byte {
+    var shares bytes.Buffer
+    for _, g := range groups {
+        binary.Write(&shares, binary.BigEndian, g)
+        binary.Write(&shares, binary.BigEndian, uint16(4))
+        shares.Write([]byte{1, 2, 3, 4})
+    }
+    return append([]byte{0x00, 0x33, byte(shares.Len() >> 8), byte(shares.Len())}, shares.Bytes()...)
+}
+
+func TestKeyShareGroups(t *testing.T) {
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions(keyShareExt(0x2a2a, 0x11ec, 0x001d))))
+    if err != nil { t.Fatal(err) }
+    if len(res.KeyShareGroups) != 2 || res.KeyShareGroups[0] != 0x11ec || res.KeyShareGroups[1] != 0x001d || !res.PQCHint { t.Fatalf("groups %x hint %v", res.KeyShareGroups, res.PQCHint) }
+}
+
+func TestPQCHintIgnoresGroupBytesOutsideKeyShare(t *testing.T) {
+    rec := helloWithExtensions(keyShareExt(0x001d))
+    // 0x11ec in the client random (record header 5 + handshake header 4 + legacy_version 2)
+    rec[11], rec[12] = 0x11, 0xec
+    _, res, err := ParseClientHello(bytes.NewReader(rec))
+    if err != nil { t.Fatal(err) }
+    if res.PQCHint || len(res.KeyShareGroups) != 1 { t.Fatalf("hint %v groups %x", res.PQCHint, res.KeyShareGroups) }
+}
+
+func TestECHOuter(t *testing.T) {
+    // outer ECH: type 0, HPKE suite 0x0001/0x0001, config_id 0x2a, enc 2 bytes, payload 3 bytes
+    ech := []byte{0xfe, 0x0d, 0, 0x00, 0x01, 0x00, 0x01, 0x2a, 0x00, 0x02, 9, 9, 0x00, 0x03, 7, 7, 7}
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions(ech)))
+    if err != nil { t.Fatal(err) }
+    if !res.ECHPresent || res.ECHConfigID != 0x2a { t.Fatalf("ech %v config id %#x", res.ECHPresent, res.ECHConfigID) }
+    // inner marker: present, no config id
+    _, res, _ = ParseClientHello(bytes.NewReader(helloWithExtensions([]byte{0xfe, 0x0d, 1})))
+    if !res.ECHPresent || res.ECHConfigID != 0 { t.Fatalf("inner ech %v config id %#x", res.ECHPresent, res.ECHConfigID) }
+    _, res, _ = ParseClientHello(bytes.NewReader(helloWithExtensions()))
+    if res.ECHPresent { t.Fatalf("ech reported without the extension") }
+}
+
+func TestExtensionsKeepOrderAndGREASE(t *testing.T) {
+    exts := [][]byte{
+        {0x3a, 0x3a}, // GREASE
+        {0x00, 0x17}, // extended_master_secret
+        {0xff, 0x01, 0x00}, // renegotiation_info
+        {0x00, 0x0b, 0x01, 0x00}, // ec_point_formats
+        {0x00, 0x0a, 0x00, 0x04, 0x4a, 0x4a, 0x00, 0x1d}, // supported_groups, GREASE first
+        {0x00, 0x23}, // session_ticket
+        {0x00, 0x2b, 0x02, 0x03, 0x04}, // supported_versions
+        {0x00, 0x15, 0x00, 0x00}, // padding
+    }
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions(exts...)))
+    if err != nil { t.Fatal(err) }
+    want := []uint16{0x3a3a, 0x0017, 0xff01, 0x000b, 0x000a, 0x0023, 0x002b, 0x0015}
+    if fmt.Sprint(res.Extensions) != fmt.Sprint(want) { t.Fatalf("extensions %x, want %x", res.Extensions, want) }
+    if !IsGREASE(res.Extensions[0]) || IsGREASE(res.Extensions[1]) { t.Fatalf("GREASE flagging wrong") }
+    // JA3 leaves GREASE out of the extension and group lists
+    if got, want := res.JA3, ja3(0x0303, []uint16{0x1301}, want[1:], []uint16{0x001d}, []byte{0}); got != want { t.Fatalf("ja3 %s, want %s", got, want) }
+}
+
+func TestGreaseCountAndNormalizedJA3(t *testing.T) {
+    exts := [][]byte{
+        {0x3a, 0x3a}, // GREASE
+        {0x00, 0x17},
+        {0xff, 0x01, 0x00},
+        {0x00, 0x0a, 0x00, 0x04, 0x4a, 0x4a, 0x00, 0x1d}, // supported_groups, GREASE first
+        {0x00, 0x2b, 0x02, 0x03, 0x04},
+        {0xda, 0xda, 0x00}, // GREASE
+    }
+    _, greasy, err := ParseClientHello(bytes.NewReader(helloWithExtensions(exts...)))
+    if err != nil { t.Fatal(err) }
+    if greasy.GreaseCount != 3 { t.Fatalf("grease count %d, want 3", greasy.GreaseCount) }
+    // the same hello without GREASE: nothing counted, same fingerprints
+    _, plain, _ := ParseClientHello(bytes.NewReader(helloWithExtensions(exts[1], exts[2], []byte{0x00, 0x0a, 0x00, 0x02, 0x00, 0x1d}, exts[4])))
+    if plain.GreaseCount != 0 || plain.JA3 != greasy.JA3 || plain.NormalizedJA3 != greasy.NormalizedJA3 { t.Fatalf("without GREASE: %+v", plain) }
+    // shuffled extension orders: JA3 changes, the normalized one does not
+    _, shuffled, _ := ParseClientHello(bytes.NewReader(helloWithExtensions(exts[4], exts[5], exts[3], exts[0], exts[2], exts[1])))
+    if shuffled.JA3 == greasy.JA3 { t.Fatalf("shuffled extensions kept JA3 %s", shuffled.JA3) }
+    if shuffled.NormalizedJA3 != greasy.NormalizedJA3 || shuffled.GreaseCount != 3 { t.Fatalf("normalized %s, want %s", shuffled.NormalizedJA3, greasy.NormalizedJA3) }
+    if got, want := greasy.NormalizedJA3, ja3(0x0303, []uint16{0x1301}, []uint16{0x000a, 0x0017, 0x002b, 0xff01}, []uint16{0x001d}, nil); got != want { t.Fatalf("normalized %s, want %s", got, want) }
+}
+
+func TestJA3String(t *testing.T) {
+    // md5("771,4865-4866,0-23-43,29-23,0")
+    sum := md5.Sum([]byte("771,4865-4866,0-23-43,29-23,0"))
+    got := ja3(771, []uint16{0x0a0a, 4865, 4866}, []uint16{0, 0xfafa, 23, 43}, []uint16{29, 23}, []byte{0})
+    if got != hex.EncodeToString(sum[:]) { t.Fatalf("ja3 %s", got) }
+}
+
+func TestParseWarningsKeepTheRest(t *testing.T) {
+    sni := []byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x09, 'a', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e'}
+    badALPN := []byte{0x00, 0x10, 0x00, 0x05, 0x02, 'h', '2'} // protocol list claims 5 bytes, has 3
+    raw, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions(badALPN, sni)))
+    if err != nil || raw == nil { t.Fatalf("a malformed extension failed the handshake: %v", err) }
+    if fmt.Sprint(res.ParseWarnings) != "[extension 0x0010: truncated]" { t.Fatalf("warnings %q", res.ParseWarnings) }
+    if res.SNI != "a.example" || res.JA3 == "" || len(res.ALPN) != 0 { t.Fatalf("sni %q ja3 %q alpn %q", res.SNI, res.JA3, res.ALPN) }
+
+    // an extensions vector longer than the message ends the parse: no JA3
+    rec := helloWithExtensions(sni)
+    rec[len(rec)-len(sni)-3] += 4 // low byte of the extensions vector length
+    _, res, err = ParseClientHello(bytes.NewReader(rec))
+    if err != nil { t.Fatal(err) }
+    if fmt.Sprint(res.ParseWarnings) != "[extensions: truncated]" || res.JA3 != "" || res.CipherSuites != 1 { t.Fatalf("warnings %q ja3 %q", res.ParseWarnings, res.JA3) }
+}
+
+func FuzzParseClientHello(f *testing.F) {
+    paths, _ := filepath.Glob(filepath.Join(corpusDir, "*.bin"))
+    for _, p := range paths {
+        if b, err := os.ReadFile(p); err == nil { f.Add(b) }
+    }
+    f.Add(helloWithExtensions(keyShareExt(0x11ec), []byte{0x00, 0x2b, 3, 2, 3, 4}, []byte{0xfe, 0x0d, 0}))
+    f.Fuzz(func(t *testing.T, data []byte) {
+        raw, res, err := ParseClientHello(bytes.NewReader(data))
+        if err == nil && (len(raw) != res.HandshakeBytes || res.RecordsBytes > len(data)) { t.Fatalf("raw %d handshake %d records %d of %d", len(raw), res.HandshakeBytes, res.RecordsBytes, len(data)) }
+        // the message parser alone, on bytes the record layer would reject
+        var direct Result
+        parseHello(data, &direct)
+        if direct.HandshakeBytes != len(data) || len(direct.SNI) > len(data) { t.Fatalf("direct parse %+v of %d bytes", direct, len(data)) }
+    })
+}
+
+func TestResumptionOffers(t *testing.T) {
+    // pre_shared_key with two identities (4- and 2-byte tickets), then one binder
+    psk := []byte{0x00, 0x29, 0x00, 0x12, 0x00, 0x04, 1, 2, 3, 4, 0, 0, 0, 1, 0x00, 0x02, 5, 6, 0, 0, 0, 2, 0x00, 0x03, 0x02, 9, 9}
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions(psk)))
+    if err != nil { t.Fatal(err) }
+    if !res.OffersPSK || res.PSKIdentityCount != 2 || len(res.ParseWarnings) != 0 { t.Fatalf("psk %v identities %d warnings %q", res.OffersPSK, res.PSKIdentityCount, res.ParseWarnings) }
+    // an empty session_ticket only announces support; one carrying a ticket resumes
+    _, res, _ = ParseClientHello(bytes.NewReader(helloWithExtensions([]byte{0x00, 0x23})))
+    if res.OffersPSK { t.Fatalf("empty session_ticket counted as resumption") }
+    _, res, _ = ParseClientHello(bytes.NewReader(helloWithExtensions([]byte{0x00, 0x23, 0xab, 0xcd})))
+    if !res.OffersPSK || res.PSKIdentityCount != 0 || res.SessionIDLen != 0 { t.Fatalf("ticket: psk %v identities %d sid %d", res.OffersPSK, res.PSKIdentityCount, res.SessionIDLen) }
+}
+
+func TestEarlyData(t *testing.T) {
+    psk := []byte{0x00, 0x29, 0x00, 0x0a, 0x00, 0x04, 1, 2, 3, 4, 0, 0, 0, 1, 0x00, 0x03, 0x02, 9, 9}
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions([]byte{0x00, 0x2a}, psk)))
+    if err != nil { t.Fatal(err) }
+    if !res.EarlyData || !res.OffersPSK || len(res.ParseWarnings) != 0 { t.Fatalf("early data %v psk %v warnings %q", res.EarlyData, res.OffersPSK, res.ParseWarnings) }
+    _, res, _ = ParseClientHello(bytes.NewReader(helloWithExtensions(psk)))
+    if res.EarlyData { t.Fatalf("early data flagged without the extension") }
+}
+
+func TestSignatureAlgorithmsAndCertCompression(t *testing.T) {
+    sigAlgs := []byte{0x00, 0x0d, 0x00, 0x08, 0x5a, 0x5a, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01} // GREASE, ecdsa_secp256r1_sha256, rsa_pss_rsae_sha256, rsa_pkcs1_sha256
+    compress := []byte{0x00, 0x1b, 0x04, 0x6a, 0x6a, 0x00, 0x02}                            // GREASE, brotli
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions(sigAlgs, compress)))
+    if err != nil { t.Fatal(err) }
+    if fmt.Sprint(res.SignatureAlgorithms) != fmt.Sprint([]uint16{0x0403, 0x0804, 0x0401}) { t.Fatalf("signature algorithms %x", res.SignatureAlgorithms) }
+    if fmt.Sprint(res.CompressCertAlgos) != "[2]" || len(res.ParseWarnings) != 0 { t.Fatalf("compress_certificate %x warnings %q", res.CompressCertAlgos, res.ParseWarnings) }
+}
+
+func TestALPNKeepsWireOrder(t *testing.T) {
+    alpn := []byte{0x00, 0x10, 0x00, 0x0f, 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1', 0x02, 'h', '2', 0x02, 'h', '3'}
+    _, res, err := ParseClientHello(bytes.NewReader(helloWithExtensions(alpn)))
+    if err != nil { t.Fatal(err) }
+    if fmt.Sprint(res.ALPN) != "[http/1.1 h2 h3]" { t.Fatalf("alpn %q", res.ALPN) }
+}
@@ -0,0 +1,81 @@
+package tlsinspect
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errTruncated is returned by chCursor reads that run past the end of the data.
+var errTruncated = errors.New("truncated")
+
+// chCursor reads the fields of a handshake message front to back. Every read checks
+// the remaining length first and fails with errTruncated instead of reading past it.
+type chCursor struct {
+	b []byte
+}
+
+// empty reports whether everything has been read.
+func (c *chCursor) empty() bool { return len(c.b) == 0 }
+
+// bytes returns the next n bytes.
+func (c *chCursor) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(c.b) {
+		return nil, errTruncated
+	}
+	out := c.b[:n:n]
+	c.b = c.b[n:]
+	return out, nil
+}
+
+// uint8 returns the next byte.
+func (c *chCursor) uint8() (byte, error) {
+	b, err := c.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// uint16 returns the next two bytes as a big-endian value.
+func (c *chCursor) uint16() (uint16, error) {
+	b, err := c.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// vector8 returns a cursor over the contents of the next vector with a one-byte
+// length prefix.
+func (c *chCursor) vector8() (chCursor, error) {
+	n, err := c.uint8()
+	if err != nil {
+		return chCursor{}, err
+	}
+	b, err := c.bytes(int(n))
+	return chCursor{b}, err
+}
+
+// vector16 returns a cursor over the contents of the next vector with a two-byte
+// length prefix.
+func (c *chCursor) vector16() (chCursor, error) {
+	n, err := c.uint16()
+	if err != nil {
+		return chCursor{}, err
+	}
+	b, err := c.bytes(int(n))
+	return chCursor{b}, err
+}
+
+// uint16s reads the rest as a list of two-byte values.
+func (c *chCursor) uint16s() ([]uint16, error) {
+	if len(c.b)%2 != 0 {
+		return nil, errors.New("odd length")
+	}
+	var vs []uint16
+	for !c.empty() {
+		v, _ := c.uint16()
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
@@ -0,0 +1,50 @@
+package tlsinspect
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// update rewrites the golden Result files instead of comparing against them.
+// Use `go generate ./internal/tlsinspect` rather than passing it by hand.
+var update = flag.Bool("update", false, "rewrite testdata/clienthellos/*.golden.json")
+
+const corpusDir = "testdata/clienthellos"
+
+func TestClientHelloGolden(t *testing.T) {
+    paths, err := filepath.Glob(filepath.Join(corpusDir, "*.bin"))
+    if err != nil { t.Fatalf("glob: %v", err) }
+    if len(paths) == 0 { t.Fatalf("no fixtures found in %s", corpusDir) }
+    for _, p := range paths {
+        name := strings.TrimSuffix(filepath.Base(p), ".bin")
+        t.Run(name, func(t *testing.T) {
+            data, err := os.ReadFile(p)
+            if err != nil { t.Fatalf("read fixture: %v", err) }
+            raw, res, err := ParseClientHello(bytes.NewReader(data))
+            if err != nil { t.Fatalf("ParseClientHello: %v", err) }
+            if len(raw) != res.HandshakeBytes { t.Errorf("raw len %d != handshake bytes %d", len(raw), res.HandshakeBytes) }
+            if res.RecordsBytes != len(data) { t.Errorf("records bytes %d != fixture size %d", res.RecordsBytes, len(data)) }
+            if sum := sha256.Sum256(raw); res.CHSHA256 != hex.EncodeToString(sum[:]) { t.Errorf("ch sha256 %s is not the hash of the raw handshake", res.CHSHA256) }
+            got, err := json.MarshalIndent(res, "", "  ")
+            if err != nil { t.Fatalf("marshal: %v", err) }
+            got = append(got, '\n')
+            golden := strings.TrimSuffix(p, ".bin") + ".golden.json"
+            if *update {
+                if err := os.WriteFile(golden, got, 0o644); err != nil { t.Fatalf("write golden: %v", err) }
+                return
+            }
+            want, err := os.ReadFile(golden)
+            if err != nil { t.Fatalf("read golden (run go generate ./internal/tlsinspect): %v", err) }
+            if !bytes.Equal(got, want) {
+                t.Errorf("Result drifted from %s; if intentional run go generate ./internal/tlsinspect\n--- got\n%s--- want\n%s", golden, got, want)
+            }
+        })
+    }
+}
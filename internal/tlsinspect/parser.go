@@ -0,0 +1,158 @@
+package tlsinspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CHParser parses a ClientHello incrementally from bytes handed to Feed as they
+// arrive, so a caller reading with a deadline can give up on a stalled client and
+// still report what it sent (Partial). ParseClientHello is a wrapper over it.
+type CHParser struct {
+	max  int    // handshake message size limit
+	rec  []byte // record being assembled: 5-byte header, then body
+	hs   []byte // handshake bytes from completed records
+	need int    // handshake bytes needed including the header; -1 until the header is seen
+	raw  []byte
+	res  Result
+	done bool
+	err  error
+}
+
+// DefaultMaxHandshakeBytes is the ClientHello size limit when Options sets none.
+const DefaultMaxHandshakeBytes = 64 << 10
+
+// ErrHandshakeTooLarge is the parse error of a ClientHello whose handshake length
+// exceeds Options.MaxHandshakeBytes. It is reported as soon as the handshake header
+// arrives, without buffering the rest.
+var ErrHandshakeTooLarge = errors.New("clienthello exceeds the handshake size limit")
+
+// Options tune ClientHello parsing.
+type Options struct {
+	MaxHandshakeBytes int // handshake message size limit, header included (0 = DefaultMaxHandshakeBytes)
+}
+
+// NewCHParser returns a parser waiting for the first record header, with default Options.
+func NewCHParser() *CHParser {
+	return NewCHParserOpts(Options{})
+}
+
+// NewCHParserOpts is NewCHParser with opts.
+func NewCHParserOpts(opts Options) *CHParser {
+	limit := opts.MaxHandshakeBytes
+	if limit <= 0 {
+		limit = DefaultMaxHandshakeBytes
+	}
+	return &CHParser{max: limit, need: -1}
+}
+
+func (p *CHParser) inHeader() bool { return len(p.rec) < 5 }
+
+// Need returns how many more bytes complete the record header or body being read,
+// or 0 once the parser is done or has failed. Feeding exactly Need bytes at a time
+// never consumes anything past the ClientHello.
+func (p *CHParser) Need() int {
+	if p.done || p.err != nil {
+		return 0
+	}
+	if p.inHeader() {
+		return 5 - len(p.rec)
+	}
+	return 5 + int(binary.BigEndian.Uint16(p.rec[3:5])) - len(p.rec)
+}
+
+// Feed consumes b up to the end of the record that completes the ClientHello and
+// reports whether it is complete. Bytes after that record are not consumed
+// (Partial().BytesReceived says how many were). After done or an error, further
+// calls return the same outcome without consuming anything.
+func (p *CHParser) Feed(b []byte) (done bool, err error) {
+	for len(b) > 0 && !p.done && p.err == nil {
+		n := min(p.Need(), len(b))
+		p.rec = append(p.rec, b[:n]...)
+		p.res.BytesReceived += n
+		b = b[n:]
+		if len(p.rec) == 5 {
+			if length := int(binary.BigEndian.Uint16(p.rec[3:5])); length <= 0 || length > 1<<14+256 {
+				p.err = errors.New("invalid TLS record length")
+			}
+			continue
+		}
+		if p.Need() == 0 {
+			p.endRecord()
+		} else {
+			p.peekHeader()
+		}
+	}
+	return p.done, p.err
+}
+
+// endRecord handles a completely received record.
+func (p *CHParser) endRecord() {
+	rec := p.rec
+	p.rec = nil
+	p.res.Records++
+	p.res.RecordsBytes += len(rec)
+	if rec[0] != 0x16 {
+		p.err = fmt.Errorf("unexpected TLS content type 0x%02x (version 0x%04x)", rec[0], binary.BigEndian.Uint16(rec[1:3]))
+		return
+	}
+	p.hs = append(p.hs, rec[5:]...)
+	if p.need < 0 && len(p.hs) >= 4 {
+		if p.hs[0] != 0x01 {
+			p.err = fmt.Errorf("not a ClientHello (type=0x%02x)", p.hs[0])
+			return
+		}
+		hl := int(p.hs[1])<<16 | int(p.hs[2])<<8 | int(p.hs[3])
+		p.need = hl + 4
+		p.res.ClientHelloLen = hl
+		p.res.HeaderSeen = true
+		if p.checkSize(); p.err != nil {
+			return
+		}
+	}
+	if p.need > 0 && len(p.hs) >= p.need {
+		p.raw = p.hs[:p.need]
+		parseHello(p.raw, &p.res)
+		p.done = true
+	}
+}
+
+// peekHeader notes the ClientHello header as soon as it has arrived, even inside a
+// record that is still incomplete, so a client stalling mid-record is reported with it.
+func (p *CHParser) peekHeader() {
+	if p.res.HeaderSeen || p.rec[0] != 0x16 || len(p.hs)+len(p.rec)-5 < 4 {
+		return
+	}
+	h := append(append([]byte(nil), p.hs...), p.rec[5:]...)
+	if h[0] == 0x01 {
+		p.res.ClientHelloLen = int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+		p.res.HeaderSeen = true
+		p.checkSize()
+	}
+}
+
+// checkSize fails the parse when the ClientHello header declares more than the limit.
+func (p *CHParser) checkSize() {
+	if n := p.res.ClientHelloLen + 4; n > p.max {
+		p.err = fmt.Errorf("%w: %d bytes declared, limit %d", ErrHandshakeTooLarge, n, p.max)
+	}
+}
+
+// Raw returns the ClientHello handshake message (header included) once Feed reported
+// done, nil before.
+func (p *CHParser) Raw() []byte { return p.raw }
+
+// Partial returns what is known so far. Once done it is the full Result; before that
+// HandshakeBytes counts the handshake bytes of the completed records, RecordsBytes
+// those records, and PQCHint is judged on the bytes at hand.
+func (p *CHParser) Partial() Result {
+	res := p.res
+	if !p.done {
+		res.HandshakeBytes = len(p.hs)
+		res.PQCHint = bytes.Contains(p.hs, []byte{0x11, 0xec})
+	}
+	res.ALPN = append([]string(nil), res.ALPN...)
+	return res
+}
@@ -0,0 +1,122 @@
+package tlsinspect
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func fixture(t *testing.T, name string) []byte {
+    b, err := os.ReadFile(filepath.Join(corpusDir, name+".bin"))
+    if err != nil { t.Fatalf("read fixture: %v", err) }
+    return b
+}
+
+func TestCHParserByteAtATimeMatchesParseClientHello(t *testing.T) {
+    for _, name := range []string{"chrome", "firefox", "go-mlkem"} {
+        b := fixture(t, name)
+        wantRaw, want, err := ParseClientHello(bytes.NewReader(b))
+        if err != nil { t.Fatalf("%s: %v", name, err) }
+        p := NewCHParser()
+        for i := range b {
+            done, err := p.Feed(b[i : i+1])
+            if err != nil { t.Fatalf("%s: byte %d: %v", name, i, err) }
+            if done != (i == len(b)-1) { t.Fatalf("%s: done=%v at byte %d of %d", name, done, i, len(b)) }
+        }
+        if got := p.Partial(); !reflect.DeepEqual(got, want) { t.Errorf("%s: incremental %+v\nwant %+v", name, got, want) }
+        if !bytes.Equal(p.Raw(), wantRaw) { t.Errorf("%s: raw differs", name) }
+    }
+}
+
+// splitRecords re-frames a single-record ClientHello into records of at most n bytes.
+func splitRecords(rec []byte, n int) []byte {
+    var out []byte
+    for body := rec[5:]; len(body) > 0; {
+        k := min(n, len(body))
+        out = append(out, 0x16, 0x03, 0x01, byte(k>>8), byte(k))
+        out = append(out, body[:k]...)
+        body = body[k:]
+    }
+    return out
+}
+
+func TestCHParserAcrossRecordsAndTrailingBytes(t *testing.T) {
+    b := splitRecords(fixture(t, "chrome"), 600)
+    stream := append(append([]byte(nil), b...), "application data"...)
+    p := NewCHParser()
+    done, err := p.Feed(stream)
+    if err != nil || !done { t.Fatalf("done=%v err=%v", done, err) }
+    res := p.Partial()
+    if res.Records != 3 || res.RecordsBytes != len(b) || res.BytesReceived != len(b) || res.SNI == "" { t.Fatalf("result %+v (fed %d bytes of records)", res, len(b)) }
+    // further input is ignored once done
+    if done, err := p.Feed([]byte("more")); !done || err != nil || p.Partial().BytesReceived != len(b) { t.Fatalf("feed after done consumed input") }
+}
+
+func TestCHParserPartialAfterStall(t *testing.T) {
+    b := splitRecords(fixture(t, "chrome"), 600)
+    p := NewCHParser()
+    if done, _ := p.Feed(b[:3]); done { t.Fatalf("done after 3 bytes") }
+    if res := p.Partial(); res.BytesReceived != 3 || res.HeaderSeen || res.Records != 0 { t.Fatalf("after 3 bytes: %+v", res) }
+    // header seen inside the first, still incomplete record
+    p.Feed(b[3:20])
+    if res := p.Partial(); !res.HeaderSeen || res.ClientHelloLen != 1715 || res.Records != 0 { t.Fatalf("mid first record: %+v", res) }
+    // first record complete, stalled in the second
+    p.Feed(b[20:700])
+    res := p.Partial()
+    if res.Records != 1 || res.RecordsBytes != 605 || res.HandshakeBytes != 600 || res.BytesReceived != 700 || res.SNI != "" { t.Fatalf("mid second record: %+v", res) }
+    // the one-shot wrapper reports the same partial state with the read error
+    _, res2, err := ParseClientHello(bytes.NewReader(b[:700]))
+    if err == nil || res2.Records != 1 || res2.BytesReceived != 700 || !res2.HeaderSeen { t.Fatalf("ParseClientHello partial %+v err=%v", res2, err) }
+}
+
+func TestCHParserErrors(t *testing.T) {
+    p := NewCHParser()
+    alert := []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}
+    if _, err := p.Feed(alert); err == nil { t.Fatalf("alert record accepted") }
+    if res := p.Partial(); res.Records != 1 || res.BytesReceived != 7 { t.Fatalf("partial %+v", res) }
+    if _, err := NewCHParser().Feed([]byte{0x16, 0x03, 0x01, 0x00, 0x00}); err == nil { t.Fatalf("zero-length record accepted") }
+    sh := []byte{0x16, 0x03, 0x03, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}
+    if _, err := NewCHParser().Feed(sh); err == nil { t.Fatalf("ServerHello accepted as ClientHello") }
+    var hdr [5]byte
+    hdr[0] = 0x16
+    binary.BigEndian.PutUint16(hdr[3:], 1<<14+257)
+    if _, err := NewCHParser().Feed(hdr[:]); err == nil { t.Fatalf("oversized record accepted") }
+}
+
+// fragmentedHello returns n handshake records of size bytes each, carrying one
+// ClientHello whose header declares all n*size bytes.
+func fragmentedHello(n, size int) []byte {
+    hs := make([]byte, n*size)
+    hs[0] = 0x01
+    l := len(hs) - 4
+    hs[1], hs[2], hs[3] = byte(l>>16), byte(l>>8), byte(l)
+    var out []byte
+    for i := 0; i < n; i++ {
+        out = append(out, 0x16, 0x03, 0x01, byte(size>>8), byte(size))
+        out = append(out, hs[i*size:(i+1)*size]...)
+    }
+    return out
+}
+
+func TestHandshakeTooLarge(t *testing.T) {
+    // 100 records of 1000 bytes: none is large, together they exceed the 64KB default
+    b := fragmentedHello(100, 1000)
+    r := bytes.NewReader(b)
+    _, res, err := ParseClientHello(r)
+    if !errors.Is(err, ErrHandshakeTooLarge) { t.Fatalf("err = %v, want ErrHandshakeTooLarge", err) }
+    // rejected on the declared length, without buffering the records that follow
+    if res.BytesReceived > 1005 || r.Len() < len(b)-1005 || !res.HeaderSeen { t.Fatalf("read %d bytes before rejecting: %+v", len(b)-r.Len(), res) }
+
+    // the limit is configurable, both ways
+    if _, _, err := ParseClientHelloOpts(bytes.NewReader(b), Options{MaxHandshakeBytes: 100000}); err != nil { t.Fatalf("under a 100000 byte limit: %v", err) }
+    chrome := fixture(t, "chrome")
+    if _, _, err := ParseClientHelloOpts(bytes.NewReader(chrome), Options{MaxHandshakeBytes: 1024}); !errors.Is(err, ErrHandshakeTooLarge) { t.Fatalf("chrome under a 1KB limit: %v", err) }
+
+    // a header arriving inside a record still being received is checked at once
+    p := NewCHParserOpts(Options{MaxHandshakeBytes: 1024})
+    if _, err := p.Feed(chrome[:9]); !errors.Is(err, ErrHandshakeTooLarge) { t.Fatalf("mid-record header: %v", err) }
+}
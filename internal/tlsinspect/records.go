@@ -0,0 +1,37 @@
+package tlsinspect
+
+import (
+	"bytes"
+	"io"
+)
+
+// helloRetryRandom is the fixed ServerHello.random that marks a TLS 1.3
+// HelloRetryRequest (RFC 8446 section 4.1.3).
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// ReadClientHello is ParseClientHello that also returns the exact record bytes it
+// consumed from r (headers included), which is what a proxy must forward upstream.
+// records is returned even when parsing fails so the caller can replay them.
+func ReadClientHello(r io.Reader) (records, raw []byte, res Result, err error) {
+	return ReadClientHelloOpts(r, Options{})
+}
+
+// ReadClientHelloOpts is ReadClientHello with opts.
+func ReadClientHelloOpts(r io.Reader, opts Options) (records, raw []byte, res Result, err error) {
+	var rec bytes.Buffer
+	raw, res, err = ParseClientHelloOpts(io.TeeReader(r, &rec), opts)
+	return rec.Bytes(), raw, res, err
+}
+
+// IsHelloRetryRequest reports whether msg, a handshake message starting with its
+// 4-byte header, is a ServerHello carrying the HelloRetryRequest random.
+func IsHelloRetryRequest(msg []byte) bool {
+	// type(1) + length(3) + legacy_version(2) + random(32)
+	if len(msg) < 38 || msg[0] != 0x02 {
+		return false
+	}
+	return bytes.Equal(msg[6:38], helloRetryRandom)
+}
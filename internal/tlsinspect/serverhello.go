@@ -0,0 +1,134 @@
+package tlsinspect
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ServerHello holds what the server chose in its ServerHello.
+type ServerHello struct {
+	Version     uint16 // negotiated version: supported_versions when present (TLS 1.3), else legacy_version
+	CipherSuite uint16 // selected cipher suite
+	Group       uint16 // selected key_share group (TLS 1.3); 0 when the ServerHello carries none
+	HRR         bool   // a HelloRetryRequest came first; the fields above are from the ServerHello after it
+}
+
+// ParseServerHello reads the server's first flight from r up to the end of its
+// ServerHello, reading whole records only. When the first message is a
+// HelloRetryRequest it goes on, past ChangeCipherSpec records, to the ServerHello sent
+// after the client's retry. On error sh holds what was learned so far (HRR included);
+// a stream that is not TLS fails on its first record.
+func ParseServerHello(r io.Reader) (sh ServerHello, err error) {
+	var hs []byte
+	for {
+		if len(hs) >= 4 {
+			n := 4 + (int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]))
+			if len(hs) >= n {
+				msg := hs[:n]
+				hs = hs[n:]
+				if msg[0] != 0x02 {
+					return sh, fmt.Errorf("not a ServerHello (type=0x%02x)", msg[0])
+				}
+				if IsHelloRetryRequest(msg) {
+					sh.HRR = true
+					continue
+				}
+				err := parseServerHelloBody(chCursor{msg[4:]}, &sh)
+				return sh, err
+			}
+		}
+		var hdr [5]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return sh, fmt.Errorf("read record header: %w", err)
+		}
+		length := int(binary.BigEndian.Uint16(hdr[3:5]))
+		if (hdr[0] != 0x14 && hdr[0] != 0x16) || length == 0 || length > 1<<14+256 {
+			return sh, fmt.Errorf("unexpected TLS record (type 0x%02x, length %d)", hdr[0], length)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return sh, fmt.Errorf("read record body: %w", err)
+		}
+		if hdr[0] == 0x16 { // ChangeCipherSpec records (compatibility mode) are skipped
+			hs = append(hs, body...)
+		}
+	}
+}
+
+// parseServerHelloBody fills sh from a ServerHello body (handshake header stripped).
+func parseServerHelloBody(c chCursor, sh *ServerHello) error {
+	version, err := c.uint16()
+	if err != nil {
+		return fmt.Errorf("legacy_version: %w", err)
+	}
+	if _, err := c.bytes(32); err != nil {
+		return fmt.Errorf("random: %w", err)
+	}
+	if _, err := c.vector8(); err != nil {
+		return fmt.Errorf("session_id: %w", err)
+	}
+	cipher, err := c.uint16()
+	if err != nil {
+		return fmt.Errorf("cipher_suite: %w", err)
+	}
+	if _, err := c.uint8(); err != nil {
+		return fmt.Errorf("compression_method: %w", err)
+	}
+	sh.Version, sh.CipherSuite = version, cipher
+	if c.empty() { // no extensions: TLS 1.2 or older
+		return nil
+	}
+	exts, err := c.vector16()
+	if err != nil {
+		return fmt.Errorf("extensions: %w", err)
+	}
+	for !exts.empty() {
+		typ, err := exts.uint16()
+		if err != nil {
+			return fmt.Errorf("extensions: %w", err)
+		}
+		data, err := exts.vector16()
+		if err != nil {
+			return fmt.Errorf("extension 0x%04x: %w", typ, err)
+		}
+		switch typ {
+		case 0x002b: // supported_versions: the selected version
+			v, err := data.uint16()
+			if err != nil {
+				return fmt.Errorf("extension 0x%04x: %w", typ, err)
+			}
+			sh.Version = v
+		case 0x0033: // key_share: the server's entry, group first
+			g, err := data.uint16()
+			if err != nil {
+				return fmt.Errorf("extension 0x%04x: %w", typ, err)
+			}
+			sh.Group = g
+		}
+	}
+	return nil
+}
+
+// groupNames are the names of the common named groups.
+var groupNames = map[uint16]string{
+	0x0017: "secp256r1",
+	0x0018: "secp384r1",
+	0x0019: "secp521r1",
+	0x001d: "x25519",
+	0x001e: "x448",
+	0x0100: "ffdhe2048",
+	0x0101: "ffdhe3072",
+}
+
+// GroupName returns the name of a named group (key_share or supported_groups entry),
+// or its hex value when unknown.
+func GroupName(g uint16) string {
+	if n, ok := groupNames[g]; ok {
+		return n
+	}
+	if n, ok := pqcGroups[g]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%04x", g)
+}
@@ -0,0 +1,73 @@
+package tlsinspect
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "testing"
+)
+
+// serverHelloRecord builds a ServerHello record with the given random and cipher
+// suite; exts are given as type followed by body, nil exts means no extensions vector.
+func serverHelloRecord(random []byte, cipher uint16, exts ...[]byte) []byte {
+    var body bytes.Buffer
+    body.Write([]byte{0x03, 0x03})
+    body.Write(random)
+    body.WriteByte(0) // session_id
+    binary.Write(&body, binary.BigEndian, cipher)
+    body.WriteByte(0) // compression
+    if exts != nil {
+        var ext bytes.Buffer
+        for _, e := range exts {
+            ext.Write(e[:2])
+            binary.Write(&ext, binary.BigEndian, uint16(len(e)-2))
+            ext.Write(e[2:])
+        }
+        binary.Write(&body, binary.BigEndian, uint16(ext.Len()))
+        body.Write(ext.Bytes())
+    }
+    hs := append([]byte{0x02, 0x00, byte(body.Len() >> 8), byte(body.Len())}, body.Bytes()...)
+    return append([]byte{0x16, 0x03, 0x03, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+var (
+    tls13Version = []byte{0x00, 0x2b, 0x03, 0x04}
+    changeCipherSpec = []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+)
+
+func TestParseServerHelloTLS13(t *testing.T) {
+    rec := serverHelloRecord(make([]byte, 32), 0x1301, tls13Version, []byte{0x00, 0x33, 0x00, 0x1d, 0x00, 0x02, 0xaa, 0xbb})
+    // what follows the ServerHello is not read
+    r := bytes.NewReader(append(rec, changeCipherSpec...))
+    sh, err := ParseServerHello(r)
+    if err != nil { t.Fatal(err) }
+    if sh != (ServerHello{Version: 0x0304, CipherSuite: 0x1301, Group: 0x001d}) { t.Fatalf("got %+v", sh) }
+    if r.Len() != len(changeCipherSpec) { t.Fatalf("read %d bytes past the ServerHello", len(changeCipherSpec)-r.Len()) }
+    if GroupName(sh.Group) != "x25519" || GroupName(0x11ec) != "X25519MLKEM768" || GroupName(0x1234) != "0x1234" { t.Fatalf("group names") }
+}
+
+func TestParseServerHelloAfterHRR(t *testing.T) {
+    hrr := serverHelloRecord(helloRetryRandom, 0x1301, tls13Version, []byte{0x00, 0x33, 0x00, 0x17})
+    sh := serverHelloRecord(bytes.Repeat([]byte{7}, 32), 0x1301, tls13Version, []byte{0x00, 0x33, 0x00, 0x17, 0x00, 0x01, 0x04})
+    var flight []byte
+    flight = append(append(append(flight, hrr...), changeCipherSpec...), sh...)
+    got, err := ParseServerHello(bytes.NewReader(flight))
+    if err != nil { t.Fatal(err) }
+    if got != (ServerHello{Version: 0x0304, CipherSuite: 0x1301, Group: 0x0017, HRR: true}) { t.Fatalf("got %+v", got) }
+
+    // the retry's ServerHello has not arrived yet
+    got, err = ParseServerHello(bytes.NewReader(hrr))
+    if !errors.Is(err, io.EOF) || !got.HRR || got.Version != 0 { t.Fatalf("got %+v, %v", got, err) }
+}
+
+func TestParseServerHelloTLS12(t *testing.T) {
+    sh, err := ParseServerHello(bytes.NewReader(serverHelloRecord(make([]byte, 32), 0xc02f)))
+    if err != nil { t.Fatal(err) }
+    if sh != (ServerHello{Version: 0x0303, CipherSuite: 0xc02f}) { t.Fatalf("got %+v", sh) }
+}
+
+func TestParseServerHelloNotTLS(t *testing.T) {
+    sh, err := ParseServerHello(bytes.NewReader([]byte("HTTP/1.1 400 Bad Request\r\n\r\n")))
+    if err == nil || sh != (ServerHello{}) { t.Fatalf("got %+v, %v", sh, err) }
+}
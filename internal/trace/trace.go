@@ -0,0 +1,132 @@
+// Package trace keeps a timeline of what PathLab did to each recent connection
+// (GET /connections/{id}/trace): accepted, ClientHello parsed, rule matched, upstream
+// dialed, and so on, each with its time.
+package trace
+
+import (
+	"sync"
+	"time"
+)
+
+// Event names, in the order they usually happen.
+const (
+	Accepted          = "accepted"
+	CHParsed          = "ch_parsed"
+	RuleMatched       = "rule_matched"
+	UpstreamDialed    = "upstream_dialed"
+	ImpairmentApplied = "impairment_applied"
+	FirstUpstreamByte = "first_upstream_byte" // the first byte from the upstream reached the client
+	Closed            = "closed"
+)
+
+// DefaultKeep is how many connections' timelines a Log keeps by default (-trace-conns).
+const DefaultKeep = 1024
+
+// Event is one step of a connection's timeline.
+type Event struct {
+	Name     string    `json:"event"`
+	At       time.Time `json:"at"`
+	OffsetMs float64   `json:"offset_ms"` // since the connection was accepted
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// Recorder collects one connection's events. A nil *Recorder records nothing, so
+// callers need not check whether tracing is on.
+type Recorder struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []Event
+}
+
+// NewRecorder returns a Recorder whose timeline starts now with Accepted.
+func NewRecorder() *Recorder {
+	r := &Recorder{}
+	r.Record(Accepted, "")
+	return r
+}
+
+// Record appends the event name, now.
+func (r *Recorder) Record(name, detail string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if len(r.events) == 0 {
+		r.start = now
+	}
+	r.events = append(r.events, Event{Name: name, At: now.UTC(), OffsetMs: float64(now.Sub(r.start)) / float64(time.Millisecond), Detail: detail})
+}
+
+// Events returns a copy of the events in the order they were recorded.
+func (r *Recorder) Events() []Event {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// Offsets returns each event's offset from the first, in milliseconds, by name; an
+// event recorded more than once is there at its first time. It is nil when nothing
+// was recorded.
+func (r *Recorder) Offsets() map[string]float64 {
+	events := r.Events()
+	if len(events) == 0 {
+		return nil
+	}
+	out := make(map[string]float64, len(events))
+	for _, e := range events {
+		if _, ok := out[e.Name]; !ok {
+			out[e.Name] = e.OffsetMs
+		}
+	}
+	return out
+}
+
+// Log holds the recorders of the most recent connections, by connection id.
+type Log struct {
+	mu    sync.Mutex
+	keep  int
+	byID  map[int64]*Recorder
+	order []int64 // ids, oldest first
+}
+
+// NewLog returns a Log keeping the timelines of the last keep connections; with keep
+// <= 0 tracing is off and Start returns nil.
+func NewLog(keep int) *Log {
+	return &Log{keep: keep, byID: map[int64]*Recorder{}}
+}
+
+// Start begins the timeline of connection id with its Accepted event, evicting the
+// oldest timeline when the Log is full.
+func (l *Log) Start(id int64) *Recorder {
+	if l.keep <= 0 {
+		return nil
+	}
+	r := NewRecorder()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.byID[id]; !ok {
+		l.order = append(l.order, id)
+	}
+	l.byID[id] = r
+	for len(l.order) > l.keep {
+		delete(l.byID, l.order[0])
+		l.order = l.order[1:]
+	}
+	return r
+}
+
+// Get returns the events of connection id, or false when it is not kept.
+func (l *Log) Get(id int64) ([]Event, bool) {
+	l.mu.Lock()
+	r, ok := l.byID[id]
+	l.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return r.Events(), true
+}
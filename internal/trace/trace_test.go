@@ -0,0 +1,29 @@
+package trace
+
+import "testing"
+
+func TestNilRecorderIsOff(t *testing.T) {
+    var r *Recorder
+    r.Record(Closed, "")
+    if r.Events() != nil || r.Offsets() != nil { t.Fatal("nil recorder returned events") }
+    if NewLog(0).Start(1) != nil { t.Fatal("Start with keep 0 returned a recorder") }
+}
+
+func TestLogKeepsLastN(t *testing.T) {
+    l := NewLog(2)
+    for id := int64(1); id <= 3; id++ { l.Start(id) }
+    if _, ok := l.Get(1); ok { t.Fatal("oldest timeline not evicted") }
+    for _, id := range []int64{2, 3} {
+        ev, ok := l.Get(id)
+        if !ok || len(ev) != 1 || ev[0].Name != Accepted || ev[0].OffsetMs != 0 { t.Fatalf("timeline %d = %+v, %v", id, ev, ok) }
+    }
+}
+
+func TestOffsetsKeepFirstOccurrence(t *testing.T) {
+    r := NewLog(1).Start(1)
+    r.Record(RuleMatched, "a")
+    first := r.Events()[1].OffsetMs
+    r.Record(RuleMatched, "b")
+    off := r.Offsets()
+    if len(off) != 2 || off[Accepted] != 0 || off[RuleMatched] != first { t.Fatalf("offsets = %v, want accepted 0 and rule_matched %v", off, first) }
+}
@@ -0,0 +1,333 @@
+// Package udpproxy relays UDP datagrams (QUIC) between clients and one upstream and
+// applies impairment profiles per datagram. Each client address is a flow with its
+// own upstream socket; a flow expires after it has been idle for the flow timeout.
+// The first datagram of a flow is summarized with quicinspect.ParseInitial.
+//
+// Profiles act on whole datagrams: MTU1300_BLACKHOLE truncates datagrams larger than
+// ThresholdBytes in the blackhole_direction (the receiver drops them, as it would a
+// packet lost to a PMTUD black hole), LATENCY_50MS_JITTER_10 delays them, PACKET_LOSS
+// drops client->upstream datagrams and ABORT_AFTER_CH forwards only the first one.
+// Other profiles relay unimpaired.
+package udpproxy
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pathlab/internal/impair"
+	"pathlab/internal/quicinspect"
+)
+
+// DefaultFlowTimeout is how long an idle flow is kept when Options.FlowTimeout is 0.
+const DefaultFlowTimeout = 30 * time.Second
+
+// maxDatagram is the largest UDP payload read.
+const maxDatagram = 64 * 1024
+
+// Options configure a Server.
+type Options struct {
+	Upstream    string        // upstream host:port
+	FlowTimeout time.Duration // idle time before a flow expires (0 = DefaultFlowTimeout)
+	State       *impair.State // impairment in effect; read when a flow starts
+	NextID      func() int64  // flow ids, shared with the TCP connections (nil = own counter)
+	OnFlowEnd   func(Flow)    // called once per flow when it expires or the server closes
+	Logger      *log.Logger   // nil = log.Default()
+}
+
+// Flow describes a finished flow.
+type Flow struct {
+	ID            int64
+	Client        string
+	Upstream      string
+	GlobalProfile impair.ProfileName
+	Profile       impair.ProfileName // applied: CLEAN when apply_percent sampled the flow out
+	ImpairApplied bool
+	Initial       quicinspect.InitialSummary // the flow's first client datagram
+	Start, End    time.Time
+	DatagramsUp   int64  // client->upstream datagrams received
+	DatagramsDown int64  // upstream->client datagrams received
+	Dropped       int64  // datagrams not forwarded (either direction)
+	Truncated     int64  // datagrams cut to ThresholdBytes
+	Reason        string // expired (idle) or closed (server shutdown)
+}
+
+// Server is a UDP relay. Safe for concurrent use.
+type Server struct {
+	conn *net.UDPConn
+	opts Options
+	up   *net.UDPAddr
+	ids  atomic.Int64
+
+	mu     sync.Mutex
+	flows  map[string]*flow
+	closed bool
+	wg     sync.WaitGroup
+	done   chan struct{}
+}
+
+type flow struct {
+	info     Flow
+	cfg      impair.Config
+	client   *net.UDPAddr
+	up       *net.UDPConn
+	last     atomic.Int64 // unix nanos of the last datagram either way
+	upDelay  *impair.DelaySampler
+	dnDelay  *impair.DelaySampler
+	upCount  atomic.Int64
+	dnCount  atomic.Int64
+	dropped  atomic.Int64
+	cut      atomic.Int64
+	rngMu    sync.Mutex
+	rng      *rand.Rand
+	endOnce  sync.Once
+	upClosed chan struct{} // closed when the flow ends; delayed datagrams still due are discarded
+}
+
+// Listen binds addr and returns a Server; call Serve to start relaying.
+func Listen(addr string, opts Options) (*Server, error) {
+	if opts.FlowTimeout <= 0 {
+		opts.FlowTimeout = DefaultFlowTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	up, err := net.ResolveUDPAddr("udp", opts.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	la, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", la)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{conn: conn, opts: opts, up: up, flows: map[string]*flow{}, done: make(chan struct{})}, nil
+}
+
+// Addr returns the listening address.
+func (s *Server) Addr() net.Addr { return s.conn.LocalAddr() }
+
+// Serve relays datagrams until Close. It returns nil after Close.
+func (s *Server) Serve() error {
+	go s.expireLoop()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			s.opts.Logger.Printf("[udp] read: %v", err)
+			continue
+		}
+		f, err := s.flowFor(from, buf[:n])
+		if err != nil {
+			s.opts.Logger.Printf("[udp] new flow from %s: %v", from, err)
+			continue
+		}
+		if f != nil {
+			f.upCount.Add(1)
+			f.last.Store(time.Now().UnixNano())
+			f.forward(f.up, nil, buf[:n], true)
+		}
+	}
+}
+
+// Close stops the server and ends every flow.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	flows := s.flows
+	s.flows = map[string]*flow{}
+	s.mu.Unlock()
+	err := s.conn.Close()
+	for _, f := range flows {
+		s.endFlow(f, "closed")
+	}
+	s.wg.Wait()
+	return err
+}
+
+// flowFor returns the flow of from, starting one (with first as its first datagram)
+// if needed. It returns nil without error once the server is closed.
+func (s *Server) flowFor(from *net.UDPAddr, first []byte) (*flow, error) {
+	key := from.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil
+	}
+	if f, ok := s.flows[key]; ok {
+		return f, nil
+	}
+	up, err := net.DialUDP("udp", nil, s.up)
+	if err != nil {
+		return nil, err
+	}
+	var cfg impair.Config
+	applied := true
+	if s.opts.State != nil {
+		cfg = s.opts.State.Get()
+		applied = s.opts.State.RollApply(cfg)
+	}
+	global := cfg.Profile
+	if !applied {
+		cfg.Profile = impair.ProfileClean
+	}
+	var id int64
+	if s.opts.NextID != nil {
+		id = s.opts.NextID()
+	} else {
+		id = s.ids.Add(1)
+	}
+	f := &flow{
+		info: Flow{ID: id, Client: key, Upstream: s.opts.Upstream, GlobalProfile: global, Profile: cfg.Profile,
+			ImpairApplied: applied, Initial: quicinspect.ParseInitial(first), Start: time.Now()},
+		cfg:      cfg,
+		client:   from,
+		up:       up,
+		upDelay:  cfg.DelaySampler(true),
+		dnDelay:  cfg.DelaySampler(false),
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		upClosed: make(chan struct{}),
+	}
+	f.last.Store(time.Now().UnixNano())
+	s.flows[key] = f
+	s.opts.Logger.Printf("[udp %d] flow from %s -> %s, profile=%s quic_initial_valid=%v", id, key, s.opts.Upstream, cfg.Profile, f.info.Initial.Valid)
+	s.wg.Add(1)
+	go s.relayDown(f)
+	return f, nil
+}
+
+// relayDown copies upstream datagrams of f back to its client until f ends.
+func (s *Server) relayDown(f *flow) {
+	defer s.wg.Done()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := f.up.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. ICMP port unreachable from the upstream: keep the flow
+			continue
+		}
+		f.dnCount.Add(1)
+		f.last.Store(time.Now().UnixNano())
+		f.forward(s.conn, f.client, buf[:n], false)
+	}
+}
+
+// forward applies the flow's profile to one datagram and sends it on conn (to addr
+// when conn is the shared listener).
+func (f *flow) forward(conn *net.UDPConn, addr *net.UDPAddr, p []byte, up bool) {
+	cfg := f.cfg
+	switch cfg.Profile {
+	case impair.ProfileAbortAfterCH:
+		if !up || f.upCount.Load() > 1 {
+			f.dropped.Add(1)
+			return
+		}
+	case impair.ProfileLoss:
+		if up && f.chance(cfg.LossPercent) {
+			f.dropped.Add(1)
+			return
+		}
+	case impair.ProfileMTUBlackhole:
+		th := cfg.ThresholdBytes
+		if th <= 0 {
+			th = 1300
+		}
+		dir := cfg.BlackholeDirection
+		if len(p) > th && (dir == impair.BlackholeBoth || (dir == impair.BlackholeDown) == !up) {
+			p = p[:th]
+			f.cut.Add(1)
+		}
+	case impair.ProfileLatencyJitter:
+		d := f.dnDelay.Next()
+		if up {
+			d = f.upDelay.Next()
+		}
+		if d > 0 {
+			b := append([]byte(nil), p...)
+			time.AfterFunc(d, func() {
+				select {
+				case <-f.upClosed:
+				default:
+					send(conn, addr, b)
+				}
+			})
+			return
+		}
+	}
+	send(conn, addr, p)
+}
+
+func send(conn *net.UDPConn, addr *net.UDPAddr, p []byte) {
+	if addr != nil {
+		_, _ = conn.WriteToUDP(p, addr)
+	} else {
+		_, _ = conn.Write(p)
+	}
+}
+
+// chance reports true with probability pct/100.
+func (f *flow) chance(pct float64) bool {
+	f.rngMu.Lock()
+	defer f.rngMu.Unlock()
+	return f.rng.Float64()*100 < pct
+}
+
+// expireLoop ends flows idle for longer than the flow timeout.
+func (s *Server) expireLoop() {
+	t := time.NewTicker(max(s.opts.FlowTimeout/4, 10*time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			var idle []*flow
+			s.mu.Lock()
+			for key, f := range s.flows {
+				if now.Sub(time.Unix(0, f.last.Load())) > s.opts.FlowTimeout {
+					idle = append(idle, f)
+					delete(s.flows, key)
+				}
+			}
+			s.mu.Unlock()
+			for _, f := range idle {
+				s.endFlow(f, "expired")
+			}
+		}
+	}
+}
+
+// endFlow closes f's upstream socket and reports it, once.
+func (s *Server) endFlow(f *flow, reason string) {
+	f.endOnce.Do(func() {
+		close(f.upClosed)
+		_ = f.up.Close()
+		info := f.info
+		info.End = time.Now()
+		info.DatagramsUp, info.DatagramsDown = f.upCount.Load(), f.dnCount.Load()
+		info.Dropped, info.Truncated = f.dropped.Load(), f.cut.Load()
+		info.Reason = reason
+		s.opts.Logger.Printf("[udp %d] flow %s: up=%d down=%d dropped=%d truncated=%d", info.ID, reason, info.DatagramsUp, info.DatagramsDown, info.Dropped, info.Truncated)
+		if s.opts.OnFlowEnd != nil {
+			s.opts.OnFlowEnd(info)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package udpproxy
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "testing"
+    "time"
+
+    "pathlab/internal/impair"
+)
+
+// startEcho runs a UDP echo upstream.
+func startEcho(t *testing.T) string {
+    c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil { t.Fatalf("listen: %v", err) }
+    t.Cleanup(func(){ c.Close() })
+    go func(){
+        buf := make([]byte, 64*1024)
+        for {
+            n, from, err := c.ReadFromUDP(buf)
+            if err != nil { return }
+            c.WriteToUDP(buf[:n], from)
+        }
+    }()
+    return c.LocalAddr().String()
+}
+
+// startRelay runs a Server under cfg in front of upstream; ended flows arrive on the channel.
+func startRelay(t *testing.T, upstream string, cfg impair.Config, timeout time.Duration) (*Server, <-chan Flow) {
+    flows := make(chan Flow, 16)
+    s, err := Listen("127.0.0.1:0", Options{Upstream: upstream, FlowTimeout: timeout, State: impair.NewState(cfg),
+        OnFlowEnd: func(f Flow){ flows <- f }, Logger: log.New(io.Discard, "", 0)})
+    if err != nil { t.Fatalf("listen: %v", err) }
+    go s.Serve()
+    t.Cleanup(func(){ s.Close() })
+    return s, flows
+}
+
+func dial(t *testing.T, s *Server) *net.UDPConn {
+    c, err := net.DialUDP("udp", nil, s.Addr().(*net.UDPAddr))
+    if err != nil { t.Fatalf("dial: %v", err) }
+    t.Cleanup(func(){ c.Close() })
+    return c
+}
+
+// roundTrip sends p and returns the echo, or nil if none arrives within wait.
+func roundTrip(c *net.UDPConn, p []byte, wait time.Duration) []byte {
+    c.Write(p)
+    _ = c.SetReadDeadline(time.Now().Add(wait))
+    buf := make([]byte, 64*1024)
+    n, err := c.Read(buf)
+    if err != nil { return nil }
+    return buf[:n]
+}
+
+// quicInitial is a long-header Initial-like datagram padded to size.
+func quicInitial(size int) []byte {
+    p := []byte{0xC3, 0, 0, 0, 1, 1, 0x11, 1, 0x22, 0x00, 0x05}
+    return append(p, make([]byte, size-len(p))...)
+}
+
+func TestCleanRelayAndFlowExpiry(t *testing.T) {
+    s, flows := startRelay(t, startEcho(t), impair.Config{Profile: impair.ProfileClean}, 100*time.Millisecond)
+    c := dial(t, s)
+    first := quicInitial(1200)
+    if got := roundTrip(c, first, time.Second); !bytes.Equal(got, first) { t.Fatalf("echo of %d bytes, want 1200", len(got)) }
+    if got := roundTrip(c, []byte("short"), time.Second); string(got) != "short" { t.Fatalf("echo %q", got) }
+    select {
+    case f := <-flows:
+        if f.Reason != "expired" || f.DatagramsUp != 2 || f.DatagramsDown != 2 || f.Dropped != 0 { t.Fatalf("flow %+v", f) }
+        if !f.Initial.Valid || f.Initial.Version != 1 || f.Initial.DatagramSize != 1200 { t.Fatalf("initial summary %+v", f.Initial) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("idle flow did not expire")
+    }
+    // the same client starts a new flow after expiry
+    roundTrip(c, []byte("again"), time.Second)
+    s.Close()
+    if f := <-flows; f.Reason != "closed" || f.Initial.Valid { t.Fatalf("flow after expiry %+v", f) }
+}
+
+func TestBlackholeTruncatesLargeDatagrams(t *testing.T) {
+    s, flows := startRelay(t, startEcho(t), impair.Config{Profile: impair.ProfileMTUBlackhole, ThresholdBytes: 1000}, time.Minute)
+    c := dial(t, s)
+    if got := roundTrip(c, quicInitial(1200), time.Second); len(got) != 1000 { t.Fatalf("echo of %d bytes, want it cut to 1000", len(got)) }
+    if got := roundTrip(c, make([]byte, 800), time.Second); len(got) != 800 { t.Fatalf("small datagram echo %d bytes", len(got)) }
+    s.Close()
+    if f := <-flows; f.Truncated != 1 { t.Fatalf("truncated %d, want 1", f.Truncated) }
+}
+
+func TestLossDropsClientDatagrams(t *testing.T) {
+    s, flows := startRelay(t, startEcho(t), impair.Config{Profile: impair.ProfileLoss, LossPercent: 100}, time.Minute)
+    c := dial(t, s)
+    if got := roundTrip(c, quicInitial(1200), 200*time.Millisecond); got != nil { t.Fatalf("datagram got through: %d bytes", len(got)) }
+    s.Close()
+    if f := <-flows; f.Dropped != 1 || f.DatagramsDown != 0 { t.Fatalf("flow %+v", f) }
+}
+
+func TestLatencyDelaysDatagrams(t *testing.T) {
+    s, _ := startRelay(t, startEcho(t), impair.Config{Profile: impair.ProfileLatencyJitter, LatencyMs: 80, LatencyDownMs: 40}, time.Minute)
+    c := dial(t, s)
+    start := time.Now()
+    if got := roundTrip(c, []byte("ping"), 2*time.Second); string(got) != "ping" { t.Fatalf("echo %q", got) }
+    if d := time.Since(start); d < 120*time.Millisecond { t.Fatalf("round trip %v, want >= 120ms", d) }
+}
+
+func TestAbortForwardsOnlyFirstDatagram(t *testing.T) {
+    s, flows := startRelay(t, startEcho(t), impair.Config{Profile: impair.ProfileAbortAfterCH}, time.Minute)
+    c := dial(t, s)
+    if got := roundTrip(c, quicInitial(1200), 200*time.Millisecond); got != nil { t.Fatal("the upstream's answer got through") }
+    roundTrip(c, []byte("second"), 100*time.Millisecond)
+    s.Close()
+    if f := <-flows; f.DatagramsUp != 2 || f.DatagramsDown != 1 || f.Dropped != 2 { t.Fatalf("flow %+v", f) }
+}
@@ -0,0 +1,345 @@
+// Package websocket is a minimal RFC 6455 WebSocket implementation: the server
+// upgrade, a client Dial, and unfragmented sends of whole messages. There are no
+// extensions (permessage-deflate is never negotiated) and no subprotocols.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frame opcodes.
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// Close status codes sent by this package.
+const (
+	CloseNormal        = 1000
+	CloseProtocolError = 1002
+	ClosePolicy        = 1008 // e.g. a consumer too slow to keep up
+	CloseTooBig        = 1009
+)
+
+// MaxMessageSize is the largest message ReadMessage accepts.
+const MaxMessageSize = 1 << 20
+
+// acceptGUID is the key suffix of the handshake (RFC 6455 section 1.3).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeTimeout bounds the write of a close frame.
+const closeTimeout = time.Second
+
+// Errors returned by Upgrade, Dial and ReadMessage.
+var (
+	ErrNotWebSocket = errors.New("websocket: not a websocket handshake")
+	ErrProtocol     = errors.New("websocket: protocol error")
+	ErrTooBig       = errors.New("websocket: message too big")
+)
+
+// CloseError is returned by ReadMessage once the peer sent a close frame.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed by peer (%d %s)", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read while another writes;
+// writes are serialized.
+type Conn struct {
+	c      net.Conn
+	br     *bufio.Reader
+	client bool // frames sent are masked
+	wmu    sync.Mutex
+	closed bool // a close frame was sent; guarded by wmu
+}
+
+// acceptKey is the Sec-WebSocket-Accept value for key.
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerHas reports whether the comma-separated header name in h lists token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade completes the server side of the handshake on a GET request and takes
+// over its connection. On a request that is not a version 13 upgrade it replies 400
+// (426 for another version) and returns ErrNotWebSocket. Deadlines the http.Server
+// set on the connection are cleared.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrNotWebSocket
+	}
+	c, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return nil, err
+	}
+	_ = c.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := c.Write([]byte(resp)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &Conn{c: c, br: brw.Reader}, nil
+}
+
+// Dial opens a client connection to a ws:// URL, sending header with the handshake.
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	c, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: http.Header{}, ProtoMajor: 1, ProtoMinor: 1}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		c.Close()
+		return nil, fmt.Errorf("%w: server answered %s", ErrNotWebSocket, resp.Status)
+	}
+	_ = c.SetDeadline(time.Time{})
+	return &Conn{c: c, br: br, client: true}, nil
+}
+
+// SetReadDeadline sets the deadline for ReadMessage.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.c.SetReadDeadline(t) }
+
+// SetWriteDeadline sets the deadline for WriteMessage.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.c.SetWriteDeadline(t) }
+
+// RemoteAddr returns the peer's address.
+func (c *Conn) RemoteAddr() net.Addr { return c.c.RemoteAddr() }
+
+// WriteMessage sends data as one frame with opcode op.
+func (c *Conn) WriteMessage(op int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.writeFrame(op, data)
+}
+
+// writeFrame sends one final frame; called with c.wmu held.
+func (c *Conn) writeFrame(op int, data []byte) error {
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | byte(op)
+	switch n := len(data); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if c.client {
+		hdr[1] |= 0x80
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		hdr = append(hdr, mask[:]...)
+		masked := make([]byte, len(data))
+		for i, b := range data {
+			masked[i] = b ^ mask[i%4]
+		}
+		data = masked
+	}
+	_, err := c.c.Write(append(hdr, data...))
+	return err
+}
+
+// ReadMessage returns the next text or binary message, reassembling fragments. It
+// answers pings itself and skips pongs. When the peer closes, it echoes the close
+// frame and returns a *CloseError.
+func (c *Conn) ReadMessage() (op int, data []byte, err error) {
+	for {
+		fin, fop, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch fop {
+		case OpPing:
+			c.wmu.Lock()
+			if !c.closed {
+				err = c.writeFrame(OpPong, payload)
+			}
+			c.wmu.Unlock()
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			ce := &CloseError{Code: 1005}
+			if len(payload) >= 2 {
+				ce.Code, ce.Reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+			}
+			_ = c.CloseWith(CloseNormal, "")
+			return 0, nil, ce
+		case OpContinuation:
+			if op == 0 {
+				return 0, nil, c.fail(ErrProtocol)
+			}
+		case OpText, OpBinary:
+			if op != 0 {
+				return 0, nil, c.fail(ErrProtocol)
+			}
+			op = fop
+		default:
+			return 0, nil, c.fail(ErrProtocol)
+		}
+		if len(data)+len(payload) > MaxMessageSize {
+			return 0, nil, c.fail(ErrTooBig)
+		}
+		data = append(data, payload...)
+		if fin {
+			return op, data, nil
+		}
+	}
+}
+
+// readFrame reads one frame, unmasking it. Frames from a client must be masked and
+// frames from a server must not be.
+func (c *Conn) readFrame() (fin bool, op int, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = h[0]&0x80 != 0, int(h[0]&0x0F)
+	masked := h[1]&0x80 != 0
+	if h[0]&0x70 != 0 || masked == c.client {
+		return false, 0, nil, c.fail(ErrProtocol)
+	}
+	n := uint64(h[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= OpClose && (n > 125 || !fin) {
+		return false, 0, nil, c.fail(ErrProtocol)
+	}
+	if n > MaxMessageSize {
+		return false, 0, nil, c.fail(ErrTooBig)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// fail closes the connection with the status code for err and returns err.
+func (c *Conn) fail(err error) error {
+	code := CloseProtocolError
+	if errors.Is(err, ErrTooBig) {
+		code = CloseTooBig
+	}
+	_ = c.CloseWith(code, "")
+	return err
+}
+
+// CloseWith sends a close frame with code and reason (best effort, bounded by a
+// short deadline) and closes the connection.
+func (c *Conn) CloseWith(code int, reason string) error {
+	c.wmu.Lock()
+	if !c.closed {
+		c.closed = true
+		_ = c.c.SetWriteDeadline(time.Now().Add(closeTimeout))
+		_ = c.writeFrame(OpClose, append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...))
+	}
+	c.wmu.Unlock()
+	return c.c.Close()
+}
+
+// Close is CloseWith(CloseNormal, "").
+func (c *Conn) Close() error { return c.CloseWith(CloseNormal, "") }
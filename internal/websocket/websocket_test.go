@@ -0,0 +1,76 @@
+package websocket
+
+import (
+    "bytes"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func echoServer(t *testing.T) *httptest.Server {
+    t.Helper()
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        c, err := Upgrade(w, r)
+        if err != nil { return }
+        for {
+            op, msg, err := c.ReadMessage()
+            if err != nil { return }
+            if err := c.WriteMessage(op, msg); err != nil { return }
+        }
+    }))
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func wsURL(srv *httptest.Server) string { return "ws" + strings.TrimPrefix(srv.URL, "http") }
+
+func TestEchoRoundTrip(t *testing.T) {
+    srv := echoServer(t)
+    c, err := Dial(wsURL(srv), nil)
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    // 125, 126 and 64K+ bytes cover the three payload length encodings.
+    for _, n := range []int{0, 5, 125, 126, 70000} {
+        msg := bytes.Repeat([]byte{'x'}, n)
+        if err := c.WriteMessage(OpBinary, msg); err != nil { t.Fatal(err) }
+        op, got, err := c.ReadMessage()
+        if err != nil || op != OpBinary || !bytes.Equal(got, msg) { t.Fatalf("%d bytes: op %d, %d bytes back, %v", n, op, len(got), err) }
+    }
+    // A ping is answered by the server's ReadMessage; the pong is skipped by ours.
+    if err := c.WriteMessage(OpPing, []byte("p")); err != nil { t.Fatal(err) }
+    c.WriteMessage(OpText, []byte("after ping"))
+    if _, got, err := c.ReadMessage(); err != nil || string(got) != "after ping" { t.Fatalf("got %q, %v", got, err) }
+}
+
+func TestCloseIsEchoed(t *testing.T) {
+    srv := echoServer(t)
+    c, err := Dial(wsURL(srv), nil)
+    if err != nil { t.Fatal(err) }
+    c.wmu.Lock()
+    c.writeFrame(OpClose, []byte{0x03, 0xE8, 'b', 'y', 'e'})
+    c.wmu.Unlock()
+    _, _, err = c.ReadMessage()
+    var ce *CloseError
+    if !errors.As(err, &ce) || ce.Code != CloseNormal { t.Fatalf("got %v, want the server's close", err) }
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+    srv := echoServer(t)
+    resp, err := http.Get(srv.URL)
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusBadRequest { t.Fatalf("status %d, want 400", resp.StatusCode) }
+    req, _ := http.NewRequest("GET", srv.URL, nil)
+    req.Header.Set("Connection", "Upgrade"); req.Header.Set("Upgrade", "websocket"); req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="); req.Header.Set("Sec-WebSocket-Version", "8")
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-WebSocket-Version") != "13" { t.Fatalf("status %d, want 426 naming version 13", resp.StatusCode) }
+}
+
+func TestAcceptKey(t *testing.T) {
+    // The example from RFC 6455 section 1.3.
+    if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" { t.Fatalf("acceptKey = %s", got) }
+}